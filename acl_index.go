@@ -0,0 +1,102 @@
+package knox
+
+import (
+	"sort"
+)
+
+// ACLIndex is a read-only lookup structure over an ACL. Exact principal types
+// are stored in maps and prefix types are grouped by prefix length, so access
+// checks no longer scan every entry of large ACLs. Build one per key fetch
+// with NewACLIndex and share it between all principals being checked.
+type ACLIndex struct {
+	exact    map[PrincipalType]map[string]AccessType
+	prefixes map[PrincipalType]*prefixIndex
+}
+
+type prefixIndex struct {
+	entries map[string]AccessType
+	// lengths holds the distinct prefix lengths in ascending order.
+	lengths []int
+}
+
+// NewACLIndex builds an index over the given ACL. If an entry appears more
+// than once the highest access wins, matching the behavior of a linear scan.
+func NewACLIndex(acl ACL) *ACLIndex {
+	idx := &ACLIndex{
+		exact:    map[PrincipalType]map[string]AccessType{},
+		prefixes: map[PrincipalType]*prefixIndex{},
+	}
+	for _, a := range acl {
+		switch a.Type {
+		case MachinePrefix, ServicePrefix:
+			p, ok := idx.prefixes[a.Type]
+			if !ok {
+				p = &prefixIndex{entries: map[string]AccessType{}}
+				idx.prefixes[a.Type] = p
+			}
+			if existing, ok := p.entries[a.ID]; !ok || existing < a.AccessType {
+				if !ok {
+					p.lengths = append(p.lengths, len(a.ID))
+				}
+				p.entries[a.ID] = a.AccessType
+			}
+		default:
+			m, ok := idx.exact[a.Type]
+			if !ok {
+				m = map[string]AccessType{}
+				idx.exact[a.Type] = m
+			}
+			if existing, ok := m[a.ID]; !ok || existing < a.AccessType {
+				m[a.ID] = a.AccessType
+			}
+		}
+	}
+	for _, p := range idx.prefixes {
+		sort.Ints(p.lengths)
+		p.lengths = dedupSorted(p.lengths)
+	}
+	return idx
+}
+
+func dedupSorted(s []int) []int {
+	out := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Exact returns the access granted to the principal with exactly this type
+// and ID, and whether any such entry exists.
+func (idx *ACLIndex) Exact(t PrincipalType, id string) (AccessType, bool) {
+	a, ok := idx.exact[t][id]
+	return a, ok
+}
+
+// Prefix returns the highest access granted by any prefix entry of type t
+// that is a prefix of id, and whether any such entry exists.
+func (idx *ACLIndex) Prefix(t PrincipalType, id string) (AccessType, bool) {
+	p, ok := idx.prefixes[t]
+	if !ok {
+		return None, false
+	}
+	best, found := None, false
+	for _, l := range p.lengths {
+		if l > len(id) {
+			break
+		}
+		if a, ok := p.entries[id[:l]]; ok && (!found || a > best) {
+			best, found = a, true
+		}
+	}
+	return best, found
+}
+
+// IndexedPrincipal is implemented by principals that can check access against
+// a prebuilt ACLIndex. It must give the same answer as CanAccess on the
+// ACL the index was built from.
+type IndexedPrincipal interface {
+	CanAccessIndex(idx *ACLIndex, accessType AccessType) bool
+}
@@ -0,0 +1,56 @@
+package knox
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+// PlanPrincipal identifies a principal whose access is checked by an ACL
+// plan. Type is "user", "machine" or "service", where a service ID is its
+// SPIFFE ID. Groups are the user's groups.
+type PlanPrincipal struct {
+	Type   string   `json:"type"`
+	ID     string   `json:"id"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// AccessChange is a principal's highest access to a key before and after an
+// ACL change.
+type AccessChange struct {
+	Principal PlanPrincipal `json:"principal"`
+	Before    AccessType    `json:"before"`
+	After     AccessType    `json:"after"`
+}
+
+// ACLPlan is the effect an ACL change would have on a key without applying it.
+type ACLPlan struct {
+	// ACL is the key's ACL after the change.
+	ACL ACL `json:"acl"`
+	// Changes lists the checked principals whose access would change.
+	Changes []AccessChange `json:"changes"`
+}
+
+// PlanAccess reports how applying acl with PutAccess would change the access
+// of principals to a key.
+func (c *HTTPClient) PlanAccess(keyID string, principals []PlanPrincipal, acl ...Access) (*ACLPlan, error) {
+	return c.UncachedClient.PlanAccess(keyID, principals, acl...)
+}
+
+// PlanAccess reports how applying acl with PutAccess would change the access
+// of principals to a key.
+func (c *UncachedHTTPClient) PlanAccess(keyID string, principals []PlanPrincipal, acl ...Access) (*ACLPlan, error) {
+	s, err := json.Marshal(acl)
+	if err != nil {
+		return nil, err
+	}
+	p, err := json.Marshal(principals)
+	if err != nil {
+		return nil, err
+	}
+	d := url.Values{}
+	d.Set("acl", string(s))
+	d.Set("principals", string(p))
+	plan := &ACLPlan{}
+	err = c.getHTTPData("POST", "/v0/keys/"+keyID+"/access/plan/", d, plan)
+	return plan, err
+}
@@ -0,0 +1,213 @@
+package knox
+
+import (
+	"encoding/base64"
+	"net/url"
+	"time"
+)
+
+// KeySummary describes a key without its data, as listed by the admin API.
+type KeySummary struct {
+	ID          string      `json:"id"`
+	ACL         ACL         `json:"acl"`
+	Metadata    KeyMetadata `json:"metadata,omitempty"`
+	VersionHash string      `json:"hash"`
+	// Versions is the number of versions with each status.
+	Versions       map[string]int `json:"versions"`
+	PrimaryVersion uint64         `json:"primary_version"`
+	ContentType    string         `json:"content_type,omitempty"`
+	// ReadsRemaining is set for keys with a read limit.
+	ReadsRemaining *int `json:"reads_remaining,omitempty"`
+}
+
+// ReencryptResult is the outcome of re-encrypting all keys.
+type ReencryptResult struct {
+	Reencrypted int      `json:"reencrypted"`
+	Failed      []string `json:"failed"`
+}
+
+// AuditEvent is a request recorded in the server's audit log.
+type AuditEvent struct {
+	Principal     string    `json:"principal"`
+	PrincipalType string    `json:"principal_type"`
+	RouteID       string    `json:"route"`
+	KeyID         string    `json:"key_id,omitempty"`
+	Success       bool      `json:"success"`
+	Time          time.Time `json:"time"`
+}
+
+// UnsealStatus is the state of a server that starts sealed, without its
+// master key. Progress is the number of master key shares submitted of the
+// Threshold needed to unseal it.
+type UnsealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Progress  int  `json:"progress"`
+}
+
+// Problems found by the server's consistency check.
+const (
+	// NoPrimaryProblem is a key without a Primary version.
+	NoPrimaryProblem = "no_primary"
+	// MultiplePrimariesProblem is a key with more than one Primary version.
+	MultiplePrimariesProblem = "multiple_primaries"
+	// DuplicateVersionProblem is a key with two versions with the same ID.
+	DuplicateVersionProblem = "duplicate_version_id"
+	// VersionHashProblem is a key whose version hash doesn't match its
+	// versions.
+	VersionHashProblem = "version_hash_mismatch"
+)
+
+// ConsistencyIssue is a key that breaks an invariant of its version list.
+type ConsistencyIssue struct {
+	KeyID   string `json:"key_id"`
+	Problem string `json:"problem"`
+	// Versions are the IDs of the versions involved, e.g. the primaries.
+	Versions []uint64 `json:"versions,omitempty"`
+	Repaired bool     `json:"repaired"`
+	// Repair describes the change made, or why the key can't be repaired.
+	Repair string `json:"repair,omitempty"`
+}
+
+// ConsistencyReport is the outcome of checking, and possibly repairing, the
+// keys on a server.
+type ConsistencyReport struct {
+	Checked int                `json:"checked"`
+	Issues  []ConsistencyIssue `json:"issues"`
+}
+
+// RestoreResult is the outcome of restoring a snapshot of the key database.
+// Failed lists the keys that could not be written.
+type RestoreResult struct {
+	Added     int      `json:"added"`
+	Replaced  int      `json:"replaced"`
+	Unchanged int      `json:"unchanged"`
+	Failed    []string `json:"failed"`
+}
+
+// AdminClient calls the server's admin routes, which are only available to
+// the principals configured as server admins.
+type AdminClient interface {
+	AdminListKeys() ([]KeySummary, error)
+	AdminReencryptKeys() (*ReencryptResult, error)
+	// AdminAuditLog returns recent requests, filtered by the principal, key and
+	// limit query parameters.
+	AdminAuditLog(query url.Values) ([]AuditEvent, error)
+	// AdminUnseal submits a share of the master key to a sealed server.
+	AdminUnseal(share []byte) (*UnsealStatus, error)
+	// AdminCheckConsistency checks every key for broken invariants, such as
+	// zero or several Primary versions, without changing them.
+	AdminCheckConsistency() (*ConsistencyReport, error)
+	// AdminRepairConsistency repairs the keys with broken invariants, or only
+	// keyID if it is not empty.
+	AdminRepairConsistency(keyID string) (*ConsistencyReport, error)
+	// AdminSnapshot returns a snapshot of every key, encrypted with the
+	// server's snapshot key.
+	AdminSnapshot() ([]byte, error)
+	// AdminRestore restores the keys of a snapshot made with AdminSnapshot.
+	AdminRestore(snapshot []byte) (*RestoreResult, error)
+}
+
+// AdminListKeys lists every key with its ACL and metadata.
+func (c *HTTPClient) AdminListKeys() ([]KeySummary, error) {
+	return c.UncachedClient.AdminListKeys()
+}
+
+// AdminReencryptKeys re-encrypts every key with the server's current master key.
+func (c *HTTPClient) AdminReencryptKeys() (*ReencryptResult, error) {
+	return c.UncachedClient.AdminReencryptKeys()
+}
+
+// AdminAuditLog returns recent requests recorded by the server.
+func (c *HTTPClient) AdminAuditLog(query url.Values) ([]AuditEvent, error) {
+	return c.UncachedClient.AdminAuditLog(query)
+}
+
+// AdminUnseal submits a share of the master key to a sealed server.
+func (c *HTTPClient) AdminUnseal(share []byte) (*UnsealStatus, error) {
+	return c.UncachedClient.AdminUnseal(share)
+}
+
+// AdminCheckConsistency checks every key for broken invariants.
+func (c *HTTPClient) AdminCheckConsistency() (*ConsistencyReport, error) {
+	return c.UncachedClient.AdminCheckConsistency()
+}
+
+// AdminRepairConsistency repairs the keys with broken invariants.
+func (c *HTTPClient) AdminRepairConsistency(keyID string) (*ConsistencyReport, error) {
+	return c.UncachedClient.AdminRepairConsistency(keyID)
+}
+
+// AdminSnapshot returns an encrypted snapshot of every key.
+func (c *HTTPClient) AdminSnapshot() ([]byte, error) {
+	return c.UncachedClient.AdminSnapshot()
+}
+
+// AdminRestore restores the keys of an encrypted snapshot.
+func (c *HTTPClient) AdminRestore(snapshot []byte) (*RestoreResult, error) {
+	return c.UncachedClient.AdminRestore(snapshot)
+}
+
+// AdminListKeys lists every key with its ACL and metadata.
+func (c *UncachedHTTPClient) AdminListKeys() ([]KeySummary, error) {
+	var keys []KeySummary
+	err := c.getHTTPData("GET", "/v0/admin/keys/", nil, &keys)
+	return keys, err
+}
+
+// AdminReencryptKeys re-encrypts every key with the server's current master key.
+func (c *UncachedHTTPClient) AdminReencryptKeys() (*ReencryptResult, error) {
+	result := &ReencryptResult{}
+	err := c.getHTTPData("POST", "/v0/admin/reencrypt/", nil, result)
+	return result, err
+}
+
+// AdminAuditLog returns recent requests recorded by the server.
+func (c *UncachedHTTPClient) AdminAuditLog(query url.Values) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := c.getHTTPData("GET", "/v0/admin/audit/?"+query.Encode(), nil, &events)
+	return events, err
+}
+
+// AdminUnseal submits a share of the master key to a sealed server.
+func (c *UncachedHTTPClient) AdminUnseal(share []byte) (*UnsealStatus, error) {
+	d := url.Values{}
+	d.Set("share", base64.StdEncoding.EncodeToString(share))
+	status := &UnsealStatus{}
+	err := c.getHTTPData("POST", "/v0/admin/unseal/", d, status)
+	return status, err
+}
+
+// AdminCheckConsistency checks every key for broken invariants.
+func (c *UncachedHTTPClient) AdminCheckConsistency() (*ConsistencyReport, error) {
+	report := &ConsistencyReport{}
+	err := c.getHTTPData("GET", "/v0/admin/consistency/", nil, report)
+	return report, err
+}
+
+// AdminRepairConsistency repairs the keys with broken invariants.
+func (c *UncachedHTTPClient) AdminRepairConsistency(keyID string) (*ConsistencyReport, error) {
+	d := url.Values{}
+	if keyID != "" {
+		d.Set("key", keyID)
+	}
+	report := &ConsistencyReport{}
+	err := c.getHTTPData("POST", "/v0/admin/consistency/", d, report)
+	return report, err
+}
+
+// AdminSnapshot returns an encrypted snapshot of every key.
+func (c *UncachedHTTPClient) AdminSnapshot() ([]byte, error) {
+	var snapshot []byte
+	err := c.getHTTPData("GET", "/v0/admin/snapshot/", nil, &snapshot)
+	return snapshot, err
+}
+
+// AdminRestore restores the keys of an encrypted snapshot.
+func (c *UncachedHTTPClient) AdminRestore(snapshot []byte) (*RestoreResult, error) {
+	d := url.Values{}
+	d.Set("snapshot", base64.StdEncoding.EncodeToString(snapshot))
+	result := &RestoreResult{}
+	err := c.getHTTPData("POST", "/v0/admin/snapshot/", d, result)
+	return result, err
+}
@@ -0,0 +1,76 @@
+// Package apikey validates API keys on inbound HTTP requests against the
+// active versions of a knox key, so API secrets can be rotated through knox:
+// add a new version, hand it to callers, and deactivate the old one once
+// callers have moved over.
+package apikey
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+// DefaultHeader is the request header read when none is configured.
+const DefaultHeader = "X-Api-Key"
+
+// Validator checks API keys against the active versions of a knox key.
+type Validator struct {
+	client knox.Client
+}
+
+// NewValidator creates a Validator backed by the given knox client.
+func NewValidator(client knox.Client) *Validator {
+	return &Validator{client: client}
+}
+
+// Valid reports whether key matches any active version. Every version is
+// compared, and values are hashed first, so the time taken does not reveal
+// which version matched or the length of the secret.
+func (v *Validator) Valid(key string) bool {
+	if key == "" {
+		return false
+	}
+	got := sha256.Sum256([]byte(key))
+	match := 0
+	for _, a := range v.client.GetActive() {
+		if a == "" {
+			continue
+		}
+		want := sha256.Sum256([]byte(a))
+		match |= subtle.ConstantTimeCompare(got[:], want[:])
+	}
+	return match == 1
+}
+
+// Middleware rejects requests whose API key does not match an active version
+// of the knox key with 401 Unauthorized. The key is read from header, or from
+// DefaultHeader if header is empty, and falls back to a bearer token in the
+// Authorization header.
+func Middleware(client knox.Client, header string) func(http.Handler) http.Handler {
+	if header == "" {
+		header = DefaultHeader
+	}
+	v := NewValidator(client)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !v.Valid(requestKey(r, header)) {
+				http.Error(w, "invalid API key", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func requestKey(r *http.Request, header string) string {
+	if k := r.Header.Get(header); k != "" {
+		return k
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package apikey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestValidator(t *testing.T) {
+	v := NewValidator(knox.NewMock("new", []string{"new", "old"}))
+	for key, expected := range map[string]bool{
+		"new":  true,
+		"old":  true,
+		"":     false,
+		"ne":   false,
+		"bad!": false,
+	} {
+		if v.Valid(key) != expected {
+			t.Fatalf("Valid(%q) should be %t", key, expected)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	h := Middleware(knox.NewMock("secret", []string{"secret"}), "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		header, value string
+		code          int
+	}{
+		{DefaultHeader, "secret", http.StatusNoContent},
+		{"Authorization", "Bearer secret", http.StatusNoContent},
+		{DefaultHeader, "wrong", http.StatusUnauthorized},
+		{"Authorization", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("%s: %s got %d, expected %d", c.header, c.value, w.Code, c.code)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package knox
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,17 +19,45 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/pinterest/knox/internal/singleflight"
 )
 
-const refresh = 10 * time.Second
+// DefaultFileClientRefresh is how often clients from NewFileClient refresh
+// their key.
+const DefaultFileClientRefresh = 10 * time.Second
 
 // For linear random backoff on write requests.
 const baseBackoff = 50 * time.Millisecond
 const maxBackoff = 3 * time.Second
 const maxRetryAttempts = 3
 
+// DefaultCacheRoot is the directory where the knox daemon caches keys.
+const DefaultCacheRoot = "/var/lib/knox"
+
+// CacheRootEnv is the environment variable that overrides DefaultCacheRoot,
+// e.g. to keep keys in a directory with an SELinux label or AppArmor profile
+// made for them.
+const CacheRootEnv = "KNOX_CACHE_ROOT"
+
+// CacheRoot returns the directory where the knox daemon caches keys.
+func CacheRoot() string {
+	if root := os.Getenv(CacheRootEnv); root != "" {
+		return root
+	}
+	return DefaultCacheRoot
+}
+
+// KeyCacheFolder returns the folder for cached keys under the cache root.
+func KeyCacheFolder(root string) string {
+	return path.Join(root, "v0", "keys") + "/"
+}
+
 // Client is an interface for interacting with a specific knox key
 type Client interface {
 	// GetPrimary returns the primary key version for the knox key.
@@ -38,18 +70,60 @@ type Client interface {
 	GetKeyObject() Key
 }
 
+// RotationClient is a Client that follows the rotations of its key. The
+// clients made by this package implement it, so a Client from NewFileClient
+// or NewMock can be asserted to a RotationClient.
+type RotationClient interface {
+	Client
+	// GetPrimaryVersion returns the primary key version with its version ID,
+	// e.g. to tag ciphertexts or signatures with the version that made them.
+	GetPrimaryVersion() (id uint64, data string)
+	// GetActiveVersions returns the primary and active key versions by
+	// version ID, e.g. to decrypt or verify with the version a ciphertext or
+	// signature was tagged with.
+	GetActiveVersions() map[uint64]string
+	// GetPrimaryAndPrevious returns the primary key version and, while the key's
+	// rotation grace window is open, the primary it replaced. Outside the window
+	// previous is empty. This is meant for consumers doing dual-write or
+	// dual-read during a rotation.
+	GetPrimaryAndPrevious() (primary string, previous string)
+	// GetConcatenated returns the primary and active key versions concatenated,
+	// each terminated by sep, e.g. "\n" for a CA bundle or known_hosts file
+	// that trusts every active version during a rotation.
+	GetConcatenated(sep string) string
+	// OnRotation registers a callback that is run whenever a refresh observes a
+	// change in the key's versions, e.g. to rebuild connection pools or TLS
+	// configs. Callbacks run synchronously on the refresh goroutine.
+	OnRotation(f func(old, new Key))
+	// Close stops refreshing the key. The last value stays available.
+	Close() error
+}
+
 type fileClient struct {
 	sync.RWMutex
 	keyID     string
-	primary   string
-	active    []string
+	keyFolder string
+	// load gets the latest key. If nil, the key is read from keyFolder.
+	load      func() (*Key, error)
+	stop      chan struct{}
+	stopOnce  sync.Once
+	values    KeyValues
 	keyObject Key
+	callbacks []func(old, new Key)
 }
 
-// update reads the file from a specific location, decodes json, and updates the key in memory.
+// update gets the latest key and updates the key in memory.
 func (c *fileClient) update() error {
+	if c.load != nil {
+		key, err := c.load()
+		if err != nil {
+			return err
+		}
+		c.refresh(key)
+		return nil
+	}
 	var key Key
-	f, err := os.Open("/var/lib/knox/v0/keys/" + c.keyID)
+	f, err := os.Open(path.Join(c.keyFolder, c.keyID))
 	if err != nil {
 		return fmt.Errorf("Knox key file err: %s", err.Error())
 	}
@@ -58,32 +132,69 @@ func (c *fileClient) update() error {
 	if err != nil {
 		return fmt.Errorf("Knox json decode err: %s", err.Error())
 	}
-	c.setValues(&key)
+	c.refresh(&key)
 	return nil
 }
 
-func (c *fileClient) setValues(key *Key) {
+// refresh updates the key in memory and runs the rotation callbacks if its
+// versions changed.
+func (c *fileClient) refresh(key *Key) {
+	old, callbacks := c.setValues(key)
+	if old.VersionHash != key.VersionHash {
+		for _, f := range callbacks {
+			f(old, *key)
+		}
+	}
+}
+
+// setValues replaces the key in memory. It returns the previous key and the
+// registered rotation callbacks so they can be run without holding the lock.
+func (c *fileClient) setValues(key *Key) (Key, []func(old, new Key)) {
 	c.Lock()
 	defer c.Unlock()
+	old := c.keyObject
 	c.keyObject = *key
-	c.primary = string(key.VersionList.GetPrimary().Data)
-	ks := key.VersionList.GetActive()
-	c.active = make([]string, len(ks))
-	for _, kv := range ks {
-		c.active = append(c.active, string(kv.Data))
-	}
+	c.values = NewKeyValues(key.VersionList)
+	return old, c.callbacks
 }
 
 func (c *fileClient) GetPrimary() string {
 	c.RLock()
 	defer c.RUnlock()
-	return c.primary
+	return c.values.PrimaryData()
 }
 
 func (c *fileClient) GetActive() []string {
 	c.RLock()
 	defer c.RUnlock()
-	return c.active
+	return c.values.ActiveData()
+}
+
+func (c *fileClient) GetPrimaryVersion() (uint64, string) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.values.Primary.ID, c.values.Primary.Data
+}
+
+func (c *fileClient) GetActiveVersions() map[uint64]string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.values.ActiveVersions()
+}
+
+func (c *fileClient) GetPrimaryAndPrevious() (string, string) {
+	c.RLock()
+	defer c.RUnlock()
+	if prev := c.keyObject.PreviousPrimary(time.Now()); prev != nil {
+		return c.values.PrimaryData(), string(prev.Data)
+	}
+	return c.values.PrimaryData(), ""
+}
+
+func (c *fileClient) GetConcatenated(sep string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return string(c.keyObject.VersionList.Concat(sep))
 }
 
 func (c *fileClient) GetKeyObject() Key {
@@ -92,29 +203,160 @@ func (c *fileClient) GetKeyObject() Key {
 	return c.keyObject
 }
 
-// NewFileClient creates a file watcher knox client for the keyID given (it refreshes every ten seconds).
-// This client calls `knox register` to cache the key locally on the file system.
+func (c *fileClient) OnRotation(f func(old, new Key)) {
+	c.Lock()
+	defer c.Unlock()
+	c.callbacks = append(c.callbacks, f)
+}
+
+// NewFileClient creates a file watcher knox client for the keyID given (it refreshes every ten seconds, with jitter).
+// This client calls `knox register` to cache the key locally on the file system
+// and reads it from the cache root given by CacheRoot.
+// If FakeKeysEnabled, the key is read from the fake keys instead.
 func NewFileClient(keyID string) (Client, error) {
-	var key Key
-	c := &fileClient{keyID: keyID}
+	return NewFileClientWithOptions(keyID, FileClientOptions{})
+}
+
+// FileClientOptions configures how NewFileClientWithOptions registers and
+// refreshes a key. With neither Socket nor APIClient set the knox binary is
+// used, like NewFileClient does.
+type FileClientOptions struct {
+	// Socket is the unix socket of a knox daemon started with -socket. The
+	// key is registered with and read from the daemon through it, so neither
+	// the knox binary nor access to the cache root are needed.
+	Socket string
+	// APIClient gets the key directly from the knox server when no Socket is
+	// set. The key is kept in memory and refreshed only when its version hash
+	// changed, with no daemon involved.
+	APIClient APIClient
+	// Refresh is the interval between refreshes of the key,
+	// DefaultFileClientRefresh if zero.
+	Refresh time.Duration
+	// Jitter is the largest random delay added to each refresh, so processes
+	// started together don't all read the key at once. It defaults to a tenth
+	// of Refresh, and a negative Jitter disables it.
+	Jitter time.Duration
+}
+
+// NewFileClientWithOptions creates a knox client for the keyID given,
+// registering and refreshing the key as configured by opts. The refresh
+// goroutine stops once the client is garbage collected.
+// If FakeKeysEnabled, the key is read from the fake keys instead.
+func NewFileClientWithOptions(keyID string, opts FileClientOptions) (RotationClient, error) {
+	return NewFileClientWithContext(context.Background(), keyID, opts)
+}
+
+// NewFileClientWithContext is NewFileClientWithOptions for a client that
+// stops refreshing the key once ctx is done, or it is closed.
+func NewFileClientWithContext(ctx context.Context, keyID string, opts FileClientOptions) (RotationClient, error) {
+	if FakeKeysEnabled() {
+		return newFakeClient(ctx, keyID, opts)
+	}
+	c := &fileClient{keyID: keyID, keyFolder: KeyCacheFolder(CacheRoot())}
+	var key *Key
+	var err error
+	switch {
+	case opts.Socket != "":
+		d := newDaemonSocketClient(opts.Socket)
+		key, err = d.register(ctx, keyID)
+		c.load = func() (*Key, error) { return d.getKey(ctx, keyID) }
+	case opts.APIClient != nil:
+		key, err = opts.APIClient.NetworkGetKey(keyID)
+		c.load = func() (*Key, error) { return c.loadChanged(opts.APIClient) }
+	default:
+		key, err = registerWithBinary(keyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.setValues(key)
+	return c.start(ctx, opts), nil
+}
+
+// managedFileClient is the handle returned to callers of
+// NewFileClientWithOptions. The refresh goroutine only references the
+// fileClient, so the handle can be garbage collected, which stops it.
+type managedFileClient struct {
+	*fileClient
+}
+
+// start refreshes the key in the background until ctx is done or the
+// returned client is closed or garbage collected.
+func (c *fileClient) start(ctx context.Context, opts FileClientOptions) RotationClient {
+	interval := opts.Refresh
+	if interval <= 0 {
+		interval = DefaultFileClientRefresh
+	}
+	jitter := opts.Jitter
+	if jitter == 0 {
+		jitter = interval / 10
+	}
+	c.stop = make(chan struct{})
+	go c.run(ctx, interval, jitter)
+	h := &managedFileClient{c}
+	runtime.SetFinalizer(h, func(h *managedFileClient) { h.Close() })
+	return h
+}
+
+func (c *fileClient) run(ctx context.Context, interval, jitter time.Duration) {
+	for {
+		delay := interval
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-c.stop:
+			t.Stop()
+			return
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if err := c.update(); err != nil {
+			log.Println("Failed to update knox key ", err.Error())
+		}
+	}
+}
+
+// Close stops the refresh goroutine.
+func (c *fileClient) Close() error {
+	c.stopOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
+	return nil
+}
+
+// loadChanged gets the key from the server if its version hash changed and
+// otherwise returns the key in memory.
+func (c *fileClient) loadChanged(api APIClient) (*Key, error) {
+	current := c.GetKeyObject()
+	changed, err := api.GetKeys(map[string]string{c.keyID: current.VersionHash})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range changed {
+		if id == c.keyID {
+			return api.NetworkGetKey(c.keyID)
+		}
+	}
+	return &current, nil
+}
+
+func registerWithBinary(keyID string) (*Key, error) {
 	jsonKey, err := Register(keyID)
 	if err != nil {
 		return nil, err
 	}
+	var key Key
 	err = json.Unmarshal(jsonKey, &key)
 	if err != nil {
 		return nil, fmt.Errorf("Knox json decode err: %s", err.Error())
 	}
-	c.setValues(&key)
-	go func() {
-		for range time.Tick(refresh) {
-			err := c.update()
-			if err != nil {
-				log.Println("Failed to update knox key ", err.Error())
-			}
-		}
-	}()
-	return c, nil
+	return &key, nil
 }
 
 // NewMockKeyVersion creates a Knox KeyVersion to be used for testing
@@ -122,18 +364,22 @@ func NewMockKeyVersion(keydata []byte, status VersionStatus) KeyVersion {
 	return KeyVersion{Data: keydata, Status: status}
 }
 
-// NewMock is a knox Client to be used for testing.
+// NewMock is a knox Client to be used for testing. GetActive returns active
+// as given, whether or not it includes primary.
 func NewMock(primary string, active []string) Client {
 	var kvl []KeyVersion
 	kvl = append(kvl, NewMockKeyVersion([]byte(primary), Primary))
+	values := KeyValues{Primary: KeyValue{Data: primary}}
 	for _, data := range active {
 		kvl = append(kvl, NewMockKeyVersion([]byte(data), Active))
+		values.Active = append(values.Active, KeyValue{Data: data})
 	}
 
-	return &fileClient{primary: primary, active: active, keyObject: Key{VersionList: KeyVersionList(kvl)}}
+	return &fileClient{values: values, keyObject: Key{VersionList: KeyVersionList(kvl)}}
 }
 
 // Register registers the given keyName with knox. If the operation fails, it returns an error.
+// The knox command inherits the environment, including $KNOX_CACHE_ROOT.
 func Register(keyID string) ([]byte, error) {
 	var stdout, stderr bytes.Buffer
 
@@ -176,17 +422,31 @@ func GetBackoffDuration(attempt int) time.Duration {
 type APIClient interface {
 	GetKey(keyID string) (*Key, error)
 	CreateKey(keyID string, data []byte, acl ACL) (uint64, error)
+	CreateKeyWithContentType(keyID string, data []byte, acl ACL, contentType string) (uint64, error)
 	GetKeys(keys map[string]string) ([]string, error)
+	SyncKeys(versions map[string]string) (*KeySync, error)
 	DeleteKey(keyID string) error
 	GetACL(keyID string) (*ACL, error)
 	PutAccess(keyID string, acl ...Access) error
+	PutAccessIfHash(keyID, versionHash string, acl ...Access) error
+	PlanAccess(keyID string, principals []PlanPrincipal, acl ...Access) (*ACLPlan, error)
 	AddVersion(keyID string, data []byte) (uint64, error)
+	AddVersionWithContentType(keyID string, data []byte, contentType string) (uint64, error)
+	AddVersionIfHash(keyID string, data []byte, contentType, versionHash string) (uint64, error)
+	AddScheduledVersion(keyID string, data []byte, activation time.Time) (uint64, error)
+	RotateKey(keyID string, promote bool) (uint64, error)
 	UpdateVersion(keyID, versionID string, status VersionStatus) error
 	CacheGetKey(keyID string) (*Key, error)
 	NetworkGetKey(keyID string) (*Key, error)
 	GetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
 	CacheGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
 	NetworkGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
+	SearchKeys(query url.Values) ([]string, error)
+	UpdateMetadata(keyID string, md KeyMetadata) error
+	LockKey(keyID, message string) error
+	UnlockKey(keyID string) error
+	// Close releases the client's connections. Requests made after Close fail.
+	Close() error
 }
 
 type HTTP interface {
@@ -201,6 +461,11 @@ type HTTPClient struct {
 	UncachedClient *UncachedHTTPClient
 }
 
+// SetCacheRoot makes the client read cached keys from the given cache root.
+func (c *HTTPClient) SetCacheRoot(root string) {
+	c.KeyFolder = KeyCacheFolder(root)
+}
+
 // NewClient creates a new client to connect to talk to Knox.
 func NewClient(host string, client HTTP, authHandler func() string, keyFolder, version string) APIClient {
 	return &HTTPClient{
@@ -256,7 +521,7 @@ func (c *HTTPClient) CacheGetKeyWithStatus(keyID string, status VersionStatus) (
 	if err != nil {
 		return nil, err
 	}
-	path := c.KeyFolder + keyID + "?status=" + string(st)
+	path := path.Join(c.KeyFolder, keyID+"?status="+string(st))
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -289,11 +554,26 @@ func (c *HTTPClient) CreateKey(keyID string, data []byte, acl ACL) (uint64, erro
 	return c.UncachedClient.CreateKey(keyID, data, acl)
 }
 
+// CreateKeyWithContentType creates a knox key whose data has the given content type.
+func (c *HTTPClient) CreateKeyWithContentType(keyID string, data []byte, acl ACL, contentType string) (uint64, error) {
+	return c.UncachedClient.CreateKeyWithContentType(keyID, data, acl, contentType)
+}
+
 // GetKeys gets all Knox (if empty map) or gets all keys in map that do not match key version hash.
 func (c *HTTPClient) GetKeys(keys map[string]string) ([]string, error) {
 	return c.UncachedClient.GetKeys(keys)
 }
 
+// Close closes the underlying uncached client.
+func (c *HTTPClient) Close() error {
+	return c.UncachedClient.Close()
+}
+
+// SyncKeys returns the keys in versions whose version hash changed.
+func (c *HTTPClient) SyncKeys(versions map[string]string) (*KeySync, error) {
+	return c.UncachedClient.SyncKeys(versions)
+}
+
 // DeleteKey deletes a key from Knox.
 func (c HTTPClient) DeleteKey(keyID string) error {
 	return c.UncachedClient.DeleteKey(keyID)
@@ -309,16 +589,81 @@ func (c *HTTPClient) PutAccess(keyID string, a ...Access) error {
 	return c.UncachedClient.PutAccess(keyID, a...)
 }
 
+// PutAccessIfHash adds ACL rules to a key only if its version hash is versionHash.
+func (c *HTTPClient) PutAccessIfHash(keyID, versionHash string, a ...Access) error {
+	return c.UncachedClient.PutAccessIfHash(keyID, versionHash, a...)
+}
+
 // AddVersion adds a key version to a specific key.
 func (c *HTTPClient) AddVersion(keyID string, data []byte) (uint64, error) {
 	return c.UncachedClient.AddVersion(keyID, data)
 }
 
+// AddVersionWithContentType adds a key version whose data has the given content type.
+func (c *HTTPClient) AddVersionWithContentType(keyID string, data []byte, contentType string) (uint64, error) {
+	return c.UncachedClient.AddVersionWithContentType(keyID, data, contentType)
+}
+
+// AddVersionIfHash adds a key version only if the key's version hash is versionHash.
+func (c *HTTPClient) AddVersionIfHash(keyID string, data []byte, contentType, versionHash string) (uint64, error) {
+	return c.UncachedClient.AddVersionIfHash(keyID, data, contentType, versionHash)
+}
+
+// AddScheduledVersion adds a key version that becomes Primary at activation.
+func (c *HTTPClient) AddScheduledVersion(keyID string, data []byte, activation time.Time) (uint64, error) {
+	return c.UncachedClient.AddScheduledVersion(keyID, data, activation)
+}
+
+// RotateKey has the server generate a new key version.
+func (c *HTTPClient) RotateKey(keyID string, promote bool) (uint64, error) {
+	return c.UncachedClient.RotateKey(keyID, promote)
+}
+
 // UpdateVersion either promotes or demotes a specific key version.
 func (c *HTTPClient) UpdateVersion(keyID, versionID string, status VersionStatus) error {
 	return c.UncachedClient.UpdateVersion(keyID, versionID, status)
 }
 
+// SearchKeys returns the key IDs matching the search query (owner, tag, created_after, created_before).
+func (c *HTTPClient) SearchKeys(query url.Values) ([]string, error) {
+	return c.UncachedClient.SearchKeys(query)
+}
+
+// UpdateMetadata merges the given entries into a key's metadata.
+func (c *HTTPClient) UpdateMetadata(keyID string, md KeyMetadata) error {
+	return c.UncachedClient.UpdateMetadata(keyID, md)
+}
+
+// LockKey makes all reads of a key fail with the given message.
+func (c *HTTPClient) LockKey(keyID, message string) error {
+	return c.UncachedClient.LockKey(keyID, message)
+}
+
+// UnlockKey allows a locked key to be read again.
+func (c *HTTPClient) UnlockKey(keyID string) error {
+	return c.UncachedClient.UnlockKey(keyID)
+}
+
+// SetAPIVersion selects the server API version, "v0" or "v1".
+func (c *HTTPClient) SetAPIVersion(version string) {
+	c.UncachedClient.SetAPIVersion(version)
+}
+
+// SetHost changes the knox server the client talks to.
+func (c *HTTPClient) SetHost(host string) {
+	c.UncachedClient.SetHost(host)
+}
+
+// SetRootCAs makes the client verify the server's certificate with pool.
+func (c *HTTPClient) SetRootCAs(pool *x509.CertPool) error {
+	return c.UncachedClient.SetRootCAs(pool)
+}
+
+// SetAuthType makes the client only authenticate as one type of principal.
+func (c *HTTPClient) SetAuthType(t byte) {
+	c.UncachedClient.SetAuthType(t)
+}
+
 func (c *HTTPClient) getClient() (HTTP, error) {
 	if c.UncachedClient.Client == nil {
 		c.UncachedClient.Client = &http.Client{}
@@ -340,6 +685,59 @@ type UncachedHTTPClient struct {
 	Client HTTP
 	// Version is the current client version, useful for debugging and sent as a header
 	Version string
+	// Warnf is called with any warnings returned by the server. If nil, warnings are logged.
+	// Each distinct warning is reported once per client, so long running
+	// processes don't repeat warnings such as an upgrade notice on every request.
+	Warnf func(format string, args ...interface{})
+	// APIVersion selects the server API, "v0" (the default) or "v1".
+	APIVersion string
+	// Application identifies the service embedding the client, e.g. "myservice/1.2.3".
+	// It is appended to the User-Agent so server logs can attribute traffic.
+	Application string
+	// Headers are extra headers sent with every request, e.g. for telemetry.
+	// They can't replace headers set by the client such as Authorization.
+	Headers http.Header
+
+	// Context bounds every request. Once it is done, or the client is
+	// closed, requests fail. It defaults to context.Background().
+	Context context.Context
+
+	// reads collapses concurrent gets of the same key into one request.
+	reads singleflight.Group[*Key]
+	// warned holds the warnings already reported.
+	warned sync.Map
+
+	lifecycleOnce sync.Once
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+// ErrClientClosed is returned for requests made with a closed client.
+var ErrClientClosed = errors.New("knox client is closed")
+
+// context returns the context requests are made with, which is canceled by
+// Close.
+func (c *UncachedHTTPClient) context() context.Context {
+	c.lifecycleOnce.Do(func() {
+		parent := c.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		c.ctx, c.cancel = context.WithCancel(parent)
+	})
+	return c.ctx
+}
+
+// Close cancels requests in flight, makes later requests fail with
+// ErrClientClosed and closes idle connections of the HTTP client if it
+// supports it.
+func (c *UncachedHTTPClient) Close() error {
+	c.context()
+	c.cancel()
+	if cli, ok := c.Client.(interface{ CloseIdleConnections() }); ok {
+		cli.CloseIdleConnections()
+	}
+	return nil
 }
 
 // NewClient creates a new uncached client to connect to talk to Knox.
@@ -354,8 +752,7 @@ func NewUncachedClient(host string, client HTTP, authHandler func() string, vers
 
 // NetworkGetKey gets a knox key by keyID and only uses network without the caches.
 func (c *UncachedHTTPClient) NetworkGetKey(keyID string) (*Key, error) {
-	key := &Key{}
-	err := c.getHTTPData("GET", "/v0/keys/"+keyID+"/", nil, key)
+	key, err := c.getKeyOnce(keyID, "/v0/keys/"+keyID+"/")
 	if err != nil {
 		return nil, err
 	}
@@ -368,6 +765,20 @@ func (c *UncachedHTTPClient) NetworkGetKey(keyID string) (*Key, error) {
 	return key, err
 }
 
+// getKeyOnce gets the key at path, sharing the request with concurrent calls
+// for the same path. Each caller gets its own copy of the key.
+func (c *UncachedHTTPClient) getKeyOnce(keyID, path string) (*Key, error) {
+	key, err, _ := c.reads.Do(path, func() (*Key, error) {
+		key := &Key{}
+		err := c.getHTTPData("GET", path, nil, key)
+		return key, err
+	})
+	if key == nil {
+		return nil, err
+	}
+	return key.Copy(), err
+}
+
 // CacheGetKey acts same as NetworkGetKey for UncachedHTTPClient.
 func (c *UncachedHTTPClient) CacheGetKey(keyID string) (*Key, error) {
 	return c.NetworkGetKey(keyID)
@@ -391,9 +802,7 @@ func (c *UncachedHTTPClient) NetworkGetKeyWithStatus(keyID string, status Versio
 		return nil, err
 	}
 
-	key := &Key{}
-	err = c.getHTTPData("GET", "/v0/keys/"+keyID+"/?status="+string(s), nil, key)
-	return key, err
+	return c.getKeyOnce(keyID, "/v0/keys/"+keyID+"/?status="+string(s))
 }
 
 // GetKeyWithStatus gets a knox key by keyID and status (no cache).
@@ -403,6 +812,11 @@ func (c *UncachedHTTPClient) GetKeyWithStatus(keyID string, status VersionStatus
 
 // CreateKey creates a knox key with given keyID data and ACL.
 func (c *UncachedHTTPClient) CreateKey(keyID string, data []byte, acl ACL) (uint64, error) {
+	return c.CreateKeyWithContentType(keyID, data, acl, "")
+}
+
+// CreateKeyWithContentType creates a knox key whose data has the given content type.
+func (c *UncachedHTTPClient) CreateKeyWithContentType(keyID string, data []byte, acl ACL, contentType string) (uint64, error) {
 	var i uint64
 	d := url.Values{}
 	d.Set("id", keyID)
@@ -412,12 +826,36 @@ func (c *UncachedHTTPClient) CreateKey(keyID string, data []byte, acl ACL) (uint
 		return i, err
 	}
 	d.Set("acl", string(s))
+	if contentType != "" {
+		d.Set("content_type", contentType)
+	}
+	d.Set(idempotencyKeyParam, newIdempotencyKey())
 	err = c.getHTTPData("POST", "/v0/keys/", d, &i)
 	return i, err
 }
 
+// SyncKeys returns the keys in versions whose version hash differs from the
+// given one in a single request.
+func (c *UncachedHTTPClient) SyncKeys(versions map[string]string) (*KeySync, error) {
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return nil, err
+	}
+	d := url.Values{}
+	d.Set("versions", string(b))
+	s := &KeySync{}
+	err = c.getHTTPData("POST", "/v0/sync/", d, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 // GetKeys gets all Knox (if empty map) or gets all keys in map that do not match key version hash.
 func (c *UncachedHTTPClient) GetKeys(keys map[string]string) ([]string, error) {
+	if c.APIVersion == "v1" {
+		return c.getKeysV1(keys)
+	}
 	var l []string
 
 	d := url.Values{}
@@ -429,8 +867,93 @@ func (c *UncachedHTTPClient) GetKeys(keys map[string]string) ([]string, error) {
 	return l, err
 }
 
+func (c *UncachedHTTPClient) getKeysV1(keys map[string]string) ([]string, error) {
+	if len(keys) > 0 {
+		versions, err := json.Marshal(keys)
+		if err != nil {
+			return nil, err
+		}
+		d := url.Values{}
+		d.Set("versions", string(versions))
+		l := []string{}
+		err = c.getHTTPData("POST", "/v1/keys/updated/", d, &l)
+		return l, err
+	}
+	l := []string{}
+	cursor := ""
+	for {
+		var page KeyPage
+		err := c.getHTTPData("GET", "/v1/keys/?cursor="+url.QueryEscape(cursor), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, page.Keys...)
+		if page.Next == "" {
+			return l, nil
+		}
+		cursor = page.Next
+	}
+}
+
+// SetAPIVersion selects the server API version, "v0" or "v1".
+func (c *UncachedHTTPClient) SetAPIVersion(version string) {
+	c.APIVersion = version
+}
+
+// SetHost changes the knox server the client talks to.
+func (c *UncachedHTTPClient) SetHost(host string) {
+	c.Host = host
+}
+
+// SetRootCAs makes the client verify the server's certificate with the
+// certificate authorities in pool, even if its TLS config skipped the
+// verification. It only works for clients whose HTTP client is an
+// *http.Client with an *http.Transport or the default transport.
+func (c *UncachedHTTPClient) SetRootCAs(pool *x509.CertPool) error {
+	if c.Client == nil {
+		c.Client = &http.Client{}
+	}
+	hc, ok := c.Client.(*http.Client)
+	if !ok {
+		return fmt.Errorf("cannot set the CA bundle of a %T", c.Client)
+	}
+	var t *http.Transport
+	switch rt := hc.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return fmt.Errorf("cannot set the CA bundle of a %T", hc.Transport)
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.RootCAs = pool
+	t.TLSClientConfig.InsecureSkipVerify = false
+	hc.Transport = t
+	return nil
+}
+
+// SetAuthType makes the client only authenticate as one type of principal,
+// given by the type byte of its authorization header, e.g. 'u' for users.
+// Requests fail as unauthenticated when the AuthHandler returns another type.
+func (c *UncachedHTTPClient) SetAuthType(t byte) {
+	handler := c.AuthHandler
+	if handler == nil {
+		return
+	}
+	c.AuthHandler = func() string {
+		auth := handler()
+		if len(auth) < 2 || auth[1] != t {
+			return ""
+		}
+		return auth
+	}
+}
+
 // DeleteKey deletes a key from Knox.
-func (c UncachedHTTPClient) DeleteKey(keyID string) error {
+func (c *UncachedHTTPClient) DeleteKey(keyID string) error {
 	err := c.getHTTPData("DELETE", "/v0/keys/"+keyID+"/", nil, nil)
 	return err
 }
@@ -444,7 +967,16 @@ func (c *UncachedHTTPClient) GetACL(keyID string) (*ACL, error) {
 
 // PutAccess will add an ACL rule to a specific key.
 func (c *UncachedHTTPClient) PutAccess(keyID string, a ...Access) error {
+	return c.PutAccessIfHash(keyID, "", a...)
+}
+
+// PutAccessIfHash adds ACL rules to a key only if the key's version hash is
+// versionHash. An empty versionHash skips the check.
+func (c *UncachedHTTPClient) PutAccessIfHash(keyID, versionHash string, a ...Access) error {
 	d := url.Values{}
+	if versionHash != "" {
+		d.Set(versionHashParam, versionHash)
+	}
 	s, err := json.Marshal(a)
 	if err != nil {
 		return err
@@ -456,13 +988,53 @@ func (c *UncachedHTTPClient) PutAccess(keyID string, a ...Access) error {
 
 // AddVersion adds a key version to a specific key.
 func (c *UncachedHTTPClient) AddVersion(keyID string, data []byte) (uint64, error) {
+	return c.AddVersionWithContentType(keyID, data, "")
+}
+
+// AddVersionWithContentType adds a key version whose data has the given content type.
+func (c *UncachedHTTPClient) AddVersionWithContentType(keyID string, data []byte, contentType string) (uint64, error) {
+	return c.AddVersionIfHash(keyID, data, contentType, "")
+}
+
+// AddVersionIfHash adds a key version only if the key's version hash is
+// versionHash, so the version isn't added to a key that changed since it was
+// read. An empty versionHash skips the check.
+func (c *UncachedHTTPClient) AddVersionIfHash(keyID string, data []byte, contentType, versionHash string) (uint64, error) {
 	var i uint64
 	d := url.Values{}
 	d.Set("data", base64.StdEncoding.EncodeToString(data))
+	if contentType != "" {
+		d.Set("content_type", contentType)
+	}
+	if versionHash != "" {
+		d.Set(versionHashParam, versionHash)
+	}
+	d.Set(idempotencyKeyParam, newIdempotencyKey())
 	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/versions/", d, &i)
 	return i, err
 }
 
+// AddScheduledVersion adds a key version that becomes Primary at activation.
+func (c *UncachedHTTPClient) AddScheduledVersion(keyID string, data []byte, activation time.Time) (uint64, error) {
+	var i uint64
+	d := url.Values{}
+	d.Set("data", base64.StdEncoding.EncodeToString(data))
+	d.Set("activation", activation.UTC().Format(time.RFC3339))
+	d.Set(idempotencyKeyParam, newIdempotencyKey())
+	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/versions/", d, &i)
+	return i, err
+}
+
+// RotateKey has the server generate a new key version using the generator in
+// the key's metadata. If promote is true the new version becomes Primary.
+func (c *UncachedHTTPClient) RotateKey(keyID string, promote bool) (uint64, error) {
+	var i uint64
+	d := url.Values{}
+	d.Set("promote", strconv.FormatBool(promote))
+	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/rotate/", d, &i)
+	return i, err
+}
+
 // UpdateVersion either promotes or demotes a specific key version.
 func (c *UncachedHTTPClient) UpdateVersion(keyID, versionID string, status VersionStatus) error {
 	d := url.Values{}
@@ -476,6 +1048,69 @@ func (c *UncachedHTTPClient) UpdateVersion(keyID, versionID string, status Versi
 	return err
 }
 
+// SearchKeys returns the key IDs matching the search query (owner, tag, created_after, created_before).
+func (c *UncachedHTTPClient) SearchKeys(query url.Values) ([]string, error) {
+	var l []string
+	err := c.getHTTPData("GET", "/v0/keys/search?"+query.Encode(), nil, &l)
+	return l, err
+}
+
+// UpdateMetadata merges the given entries into a key's metadata. Entries with
+// an empty value are removed.
+func (c *UncachedHTTPClient) UpdateMetadata(keyID string, md KeyMetadata) error {
+	d := url.Values{}
+	s, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	d.Set("metadata", string(s))
+	return c.getHTTPData("PUT", "/v0/keys/"+keyID+"/metadata/", d, nil)
+}
+
+// LockKey makes all reads of a key fail with the given message.
+func (c *UncachedHTTPClient) LockKey(keyID, message string) error {
+	d := url.Values{}
+	d.Set("message", message)
+	return c.getHTTPData("PUT", "/v0/keys/"+keyID+"/lock/", d, nil)
+}
+
+// UnlockKey allows a locked key to be read again.
+func (c *UncachedHTTPClient) UnlockKey(keyID string) error {
+	return c.getHTTPData("DELETE", "/v0/keys/"+keyID+"/lock/", nil, nil)
+}
+
+// userAgent is the User-Agent header of requests to knox.
+func (c *UncachedHTTPClient) userAgent() string {
+	ua := fmt.Sprintf("Knox_Client/%s", c.Version)
+	if c.Application != "" {
+		ua += " " + c.Application
+	}
+	return ua
+}
+
+func (c *UncachedHTTPClient) warnf(format string, args ...interface{}) {
+	if c.Warnf != nil {
+		c.Warnf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// reportWarnings reports the warnings of a response that weren't reported
+// before, with the version of the server if it sent one.
+func (c *UncachedHTTPClient) reportWarnings(resp *Response) {
+	for _, w := range resp.Warnings {
+		if _, seen := c.warned.LoadOrStore(w, true); seen {
+			continue
+		}
+		if resp.ServerVersion != "" {
+			c.warnf("knox: warning from server %s: %s", resp.ServerVersion, w)
+		} else {
+			c.warnf("knox: warning: %s", w)
+		}
+	}
+}
+
 func (c *UncachedHTTPClient) getClient() (HTTP, error) {
 	if c.Client == nil {
 		c.Client = &http.Client{}
@@ -484,7 +1119,34 @@ func (c *UncachedHTTPClient) getClient() (HTTP, error) {
 }
 
 func (c *UncachedHTTPClient) getHTTPData(method string, path string, body url.Values, data interface{}) error {
-	r, err := http.NewRequest(method, "https://"+c.Host+path, bytes.NewBufferString(body.Encode()))
+	contentType := "application/x-www-form-urlencoded"
+	encoded := body.Encode()
+	if c.APIVersion == "v1" {
+		// The v1 API takes the same fields as a JSON object.
+		if rest, ok := strings.CutPrefix(path, "/v0/"); ok {
+			path = "/v1/" + rest
+		}
+		if body != nil {
+			contentType = JSONContentType
+			fields := map[string]string{}
+			for k := range body {
+				fields[k] = body.Get(k)
+			}
+			b, err := json.Marshal(fields)
+			if err != nil {
+				return err
+			}
+			encoded = string(b)
+		}
+	}
+	ctx := c.context()
+	if ctx.Err() != nil {
+		if c.Context != nil && c.Context.Err() != nil {
+			return c.Context.Err()
+		}
+		return ErrClientClosed
+	}
+	r, err := http.NewRequestWithContext(ctx, method, "https://"+c.Host+path, bytes.NewBufferString(encoded))
 
 	if err != nil {
 		return err
@@ -496,10 +1158,20 @@ func (c *UncachedHTTPClient) getHTTPData(method string, path string, body url.Va
 	}
 	// Get user from env variable and machine hostname from elsewhere.
 	r.Header.Set("Authorization", auth)
-	r.Header.Set("User-Agent", fmt.Sprintf("Knox_Client/%s", c.Version))
+	r.Header.Set("User-Agent", c.userAgent())
+	for k, vs := range c.Headers {
+		if r.Header.Get(k) != "" {
+			continue
+		}
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	// Prefer the binary encoding, older servers will ignore this and send JSON.
+	r.Header.Set("Accept", MsgpackContentType+", "+JSONContentType+";q=0.9")
 
 	if body != nil {
-		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Content-Type", contentType)
 	}
 
 	cli, err := c.getClient()
@@ -509,17 +1181,36 @@ func (c *UncachedHTTPClient) getHTTPData(method string, path string, body url.Va
 
 	resp := &Response{}
 	resp.Data = data
-	// Contains retry logic if we decode a 500 error.
+	// Contains retry logic if we decode a 500 error. Requests with an
+	// idempotency key are also retried after network errors, since the server
+	// replays the response if the first attempt succeeded.
+	idempotent := body.Get(idempotencyKeyParam) != ""
 	for i := 1; i <= maxRetryAttempts; i++ {
+		if i > 1 && r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				return err
+			}
+		}
 		err = getHTTPResp(cli, r, resp)
 		if err != nil {
-			return err
+			if !idempotent || i == maxRetryAttempts {
+				return err
+			}
+			if err := sleepContext(ctx, GetBackoffDuration(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.Status == "ok" {
+			c.reportWarnings(resp)
 		}
 		if resp.Status != "ok" {
 			if (resp.Code != InternalServerErrorCode) || (i == maxRetryAttempts) {
-				return fmt.Errorf(resp.Message)
+				return &APIError{Code: resp.Code, Message: resp.Message}
+			}
+			if err := sleepContext(ctx, GetBackoffDuration(i)); err != nil {
+				return err
 			}
-			time.Sleep(GetBackoffDuration(i))
 		} else {
 			break
 		}
@@ -528,6 +1219,35 @@ func (c *UncachedHTTPClient) getHTTPData(method string, path string, body url.Va
 	return nil
 }
 
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// idempotencyKeyParam carries a random key with requests that create keys or
+// versions, so the server can recognize retries of the same request.
+const idempotencyKeyParam = "idempotency_key"
+
+// versionHashParam makes the server reject a change unless the key's version
+// hash is the given one.
+const versionHashParam = "precondition_version_hash"
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		// Without a key the request is simply not retried on network errors.
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
 func getHTTPResp(cli HTTP, r *http.Request, resp *Response) error {
 	w, err := cli.Do(r)
 	if err != nil {
@@ -535,8 +1255,7 @@ func getHTTPResp(cli HTTP, r *http.Request, resp *Response) error {
 	}
 	defer w.Body.Close()
 
-	decoder := json.NewDecoder(w.Body)
-	return decoder.Decode(resp)
+	return CodecForContentType(w.Header.Get("Content-Type")).Decode(w.Body, resp)
 }
 
 // MockClient builds a client that ignores certs and talks to the given host.
@@ -2,8 +2,10 @@ package client
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
 )
 
 func init() {
@@ -11,7 +13,7 @@ func init() {
 }
 
 var cmdAdd = &Command{
-	UsageLine: "add [--key-template template_name] <key_identifier>",
+	UsageLine: "add [--key-template template_name] [--activate-at time] [--content-type type] [--if-hash hash] [--base64] <key_identifier>",
 	Short:     "adds a new key version to knox",
 	Long: `
 Add will add a new key version to an existing key in knox. Key data of new version should be sent to stdin unless a key-template is specified.
@@ -24,6 +26,18 @@ Please run "knox add --key-template <template_name> <key_identifier>".
 
 This key version will be set to active upon creation. The version id will be sent to stdout on creation.
 
+The activate-at option schedules the new version instead: it is not served to clients until the given
+time (RFC 3339, e.g. 2024-01-02T15:04:05Z), at which point the server makes it the primary version.
+Use "knox deactivate" to cancel a scheduled version or "knox promote" to activate it early.
+
+The base64 option decodes the key data read from stdin from base64, as printed by "knox get --base64", so
+binary key material can be passed through terminals and CI logs.
+
+The content-type option records the format of the key data as in "knox create".
+
+The if-hash option only adds the version if the key's version hash, as shown by "knox get -j", is
+still the given one, so automation can't add a version to a key that changed since it was read.
+
 This command uses user access and requires write access in the key's ACL.
 
 For more about knox, see https://github.com/pinterest/knox.
@@ -32,23 +46,60 @@ See also: knox create, knox promote
 	`,
 }
 var addTinkKeyset = cmdAdd.Flag.String("key-template", "", "name of a knox-supported Tink key template")
+var addActivateAt = cmdAdd.Flag.String("activate-at", "", "RFC 3339 time at which the new version becomes primary")
+var addContentType = cmdAdd.Flag.String("content-type", "", "content type of the key data")
+var addIfHash = cmdAdd.Flag.String("if-hash", "", "version hash the key must have")
+var addBase64 = cmdAdd.Flag.Bool("base64", false, "key data on stdin is base64 encoded")
 
 func runAdd(cmd *Command, args []string) *ErrorStatus {
 	if len(args) != 1 {
 		return &ErrorStatus{fmt.Errorf("add takes only one argument. See 'knox help add'"), false}
 	}
 	keyID := args[0]
+	var activation time.Time
+	if *addActivateAt != "" {
+		var err error
+		activation, err = time.Parse(time.RFC3339, *addActivateAt)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("Invalid activation time: %s", err.Error()), false}
+		}
+	}
 	var data []byte
 	var err error
+	var kekURI string
 	if *addTinkKeyset != "" {
-		data, err = getDataWithTemplate(*addTinkKeyset, keyID)
+		if *addBase64 {
+			return &ErrorStatus{fmt.Errorf("--base64 can't be used with --key-template"), false}
+		}
+		data, kekURI, err = getDataWithTemplate(*addTinkKeyset, keyID)
 	} else {
 		data, err = readDataFromStdin()
+		if err == nil && *addBase64 {
+			data, err = decodeBase64Data(data)
+		}
 	}
 	if err != nil {
 		return &ErrorStatus{err, false}
 	}
-	versionID, err := cli.AddVersion(keyID, data)
+	contentType := *addContentType
+	if contentType == "" && *addTinkKeyset != "" {
+		contentType = tink.ContentType(kekURI)
+	}
+	if err := validateContent(contentType, data); err != nil {
+		return &ErrorStatus{err, false}
+	}
+	var versionID uint64
+	if activation.IsZero() {
+		versionID, err = cli.AddVersionIfHash(keyID, data, contentType, *addIfHash)
+	} else {
+		if contentType != "" {
+			return &ErrorStatus{fmt.Errorf("--content-type can't be used with --activate-at"), false}
+		}
+		if *addIfHash != "" {
+			return &ErrorStatus{fmt.Errorf("--if-hash can't be used with --activate-at"), false}
+		}
+		versionID, err = cli.AddScheduledVersion(keyID, data, activation)
+	}
 	if err != nil {
 		return &ErrorStatus{fmt.Errorf("Error adding version: %s", err.Error()), true}
 	}
@@ -56,16 +107,19 @@ func runAdd(cmd *Command, args []string) *ErrorStatus {
 	return nil
 }
 
-// getDataWithTemplate returns the data for a new version of a knox identifier that stores Tink keyset.
-func getDataWithTemplate(templateName string, keyID string) ([]byte, error) {
-	err := obeyNamingRule(templateName, keyID)
+// getDataWithTemplate returns the data for a new version of a knox identifier that stores Tink keyset,
+// and the URI of the KMS key it is encrypted with, if any.
+func getDataWithTemplate(templateName string, keyID string) ([]byte, string, error) {
+	err := tink.CheckKeyID(templateName, keyID)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	// get all versions (primary, active, inactive) of this knox identifier
 	allVersions, err := cli.NetworkGetKeyWithStatus(keyID, knox.Inactive)
 	if err != nil {
-		return nil, fmt.Errorf("error getting key: %s", err.Error())
+		return nil, "", fmt.Errorf("error getting key: %s", err.Error())
 	}
-	return addNewTinkKeyset(tinkKeyTemplates[templateName].templateFunc, allVersions.VersionList)
+	kekURI := allVersions.Metadata[knox.MetadataTinkKMSKeyURI]
+	data, err := tink.NextKeyset(templateName, allVersions.VersionList, kekURI)
+	return data, kekURI, err
 }
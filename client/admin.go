@@ -0,0 +1,292 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdAdmin.Run = runAdmin // break init cycle
+}
+
+var cmdAdmin = &Command{
+	UsageLine:   "admin keys [-json] | reencrypt | audit [-principal id] [-key key_identifier] [-limit n] | unseal | consistency [-repair] [-key key_identifier] | snapshot | restore",
+	Short:       "runs server operations",
+	CustomFlags: true,
+	Long: `
+Admin runs operations on the knox server through its admin API. They are only available to the
+principals the server is configured to treat as admins.
+
+admin keys lists every key with its primary version, the number of versions with each status,
+the reads left for keys with a read limit and its metadata. No key data is returned. -json prints the full list as JSON, including ACLs.
+
+admin reencrypt re-encrypts every key with the server's current master key, e.g. after the master
+key was changed. Keys that could not be re-encrypted are listed and the command fails; it is safe
+to run again.
+
+admin audit shows the most recent requests recorded by the server, newest first.
+-principal and -key only show requests by that principal or for that key.
+-limit sets the number of requests to show (default 100).
+
+admin unseal submits a share of the master key, read as base64 from stdin, to a server that
+started sealed. It prints how many of the shares needed to unseal the server were submitted.
+
+admin consistency lists the keys whose versions break an invariant, such as keys with zero or
+several primary versions, with the repair the server would make. -repair makes the repairs, which
+are recorded in the server's audit log. -key only checks and repairs that key. The command fails
+if any problem is left unrepaired.
+
+admin snapshot writes a snapshot of every key to stdout, encrypted and authenticated with the
+server's snapshot key, e.g. "knox admin snapshot > knox.snapshot". Key data stays encrypted with the
+master key as well.
+
+admin restore restores a snapshot read from stdin. Missing keys are added and keys that differ
+from the snapshot are replaced; keys created since the snapshot are kept. It fails without
+changes if the snapshot is damaged or was taken on a server with another master key. Keys that
+could not be written are listed and the command fails; it is safe to run again.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox keys, knox search
+	`,
+}
+
+func runAdmin(cmd *Command, args []string) *ErrorStatus {
+	if len(args) == 0 {
+		return &ErrorStatus{fmt.Errorf("admin needs an operation. See 'knox help admin'"), false}
+	}
+	admin, ok := cli.(knox.AdminClient)
+	if !ok {
+		return &ErrorStatus{fmt.Errorf("This client does not support admin operations"), false}
+	}
+	switch args[0] {
+	case "keys":
+		return runAdminKeys(admin, args[1:])
+	case "reencrypt":
+		return runAdminReencrypt(admin, args[1:])
+	case "audit":
+		return runAdminAudit(admin, args[1:])
+	case "unseal":
+		return runAdminUnseal(admin, args[1:])
+	case "consistency":
+		return runAdminConsistency(admin, args[1:])
+	case "snapshot":
+		return runAdminSnapshot(admin, args[1:])
+	case "restore":
+		return runAdminRestore(admin, args[1:])
+	}
+	return &ErrorStatus{fmt.Errorf("Unknown admin operation %q. See 'knox help admin'", args[0]), false}
+}
+
+func runAdminKeys(admin knox.AdminClient, args []string) *ErrorStatus {
+	fs := newAdminFlags("keys")
+	asJSON := fs.Bool("json", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help admin'"), false}
+	}
+	keys, err := admin.AdminListKeys()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error listing keys: %s", err.Error()), true}
+	}
+	if *asJSON {
+		b, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return &ErrorStatus{err, false}
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tPRIMARY\tVERSIONS\tREADS LEFT\tMETADATA")
+	for _, k := range keys {
+		reads := "-"
+		if k.ReadsRemaining != nil {
+			reads = strconv.Itoa(*k.ReadsRemaining)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", k.ID, k.PrimaryVersion, formatCounts(k.Versions), reads, formatMetadata(k.Metadata))
+	}
+	w.Flush()
+	return nil
+}
+
+func runAdminReencrypt(admin knox.AdminClient, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("admin reencrypt takes no arguments. See 'knox help admin'"), false}
+	}
+	result, err := admin.AdminReencryptKeys()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error re-encrypting keys: %s", err.Error()), true}
+	}
+	fmt.Printf("Re-encrypted %d keys\n", result.Reencrypted)
+	if len(result.Failed) > 0 {
+		return &ErrorStatus{fmt.Errorf("Failed to re-encrypt %d keys: %s", len(result.Failed), strings.Join(result.Failed, ", ")), true}
+	}
+	return nil
+}
+
+func runAdminAudit(admin knox.AdminClient, args []string) *ErrorStatus {
+	fs := newAdminFlags("audit")
+	principal := fs.String("principal", "", "")
+	keyID := fs.String("key", "", "")
+	limit := fs.Int("limit", 0, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *limit < 0 {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help admin'"), false}
+	}
+	q := url.Values{}
+	if *principal != "" {
+		q.Set("principal", *principal)
+	}
+	if *keyID != "" {
+		q.Set("key", *keyID)
+	}
+	if *limit > 0 {
+		q.Set("limit", strconv.Itoa(*limit))
+	}
+	events, err := admin.AdminAuditLog(q)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error getting audit log: %s", err.Error()), true}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPRINCIPAL\tROUTE\tKEY\tRESULT")
+	for _, e := range events {
+		result := "ok"
+		if !e.Success {
+			result = "failed"
+		}
+		fmt.Fprintf(w, "%s\t%s (%s)\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Principal, e.PrincipalType, e.RouteID, e.KeyID, result)
+	}
+	w.Flush()
+	return nil
+}
+
+func runAdminUnseal(admin knox.AdminClient, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("admin unseal takes no arguments. See 'knox help admin'"), false}
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Problem reading share from stdin: %s", err.Error()), false}
+	}
+	share, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(share) == 0 {
+		return &ErrorStatus{fmt.Errorf("The master key share must be base64 encoded"), false}
+	}
+	status, err := admin.AdminUnseal(share)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error unsealing server: %s", err.Error()), true}
+	}
+	if status.Sealed {
+		fmt.Printf("Server is sealed, %d of %d shares submitted\n", status.Progress, status.Threshold)
+	} else {
+		fmt.Println("Server is unsealed")
+	}
+	return nil
+}
+
+func runAdminConsistency(admin knox.AdminClient, args []string) *ErrorStatus {
+	fs := newAdminFlags("consistency")
+	repair := fs.Bool("repair", false, "")
+	keyID := fs.String("key", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || (*keyID != "" && !*repair) {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help admin'"), false}
+	}
+	var report *knox.ConsistencyReport
+	var err error
+	if *repair {
+		report, err = admin.AdminRepairConsistency(*keyID)
+	} else {
+		report, err = admin.AdminCheckConsistency()
+	}
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error checking keys: %s", err.Error()), true}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tPROBLEM\tVERSIONS\tREPAIRED\tREPAIR")
+	unrepaired := 0
+	for _, issue := range report.Issues {
+		versions := make([]string, 0, len(issue.Versions))
+		for _, v := range issue.Versions {
+			versions = append(versions, strconv.FormatUint(v, 10))
+		}
+		if !issue.Repaired {
+			unrepaired++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", issue.KeyID, issue.Problem, strings.Join(versions, ","), issue.Repaired, issue.Repair)
+	}
+	w.Flush()
+	fmt.Printf("Checked %d keys\n", report.Checked)
+	if unrepaired > 0 {
+		return &ErrorStatus{fmt.Errorf("%d problems were not repaired", unrepaired), true}
+	}
+	return nil
+}
+
+func runAdminSnapshot(admin knox.AdminClient, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("admin snapshot takes no arguments. See 'knox help admin'"), false}
+	}
+	snapshot, err := admin.AdminSnapshot()
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error taking snapshot: %s", err.Error()), true}
+	}
+	if _, err := os.Stdout.Write(snapshot); err != nil {
+		return &ErrorStatus{err, false}
+	}
+	return nil
+}
+
+func runAdminRestore(admin knox.AdminClient, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("admin restore takes no arguments. See 'knox help admin'"), false}
+	}
+	snapshot, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Problem reading snapshot from stdin: %s", err.Error()), false}
+	}
+	result, err := admin.AdminRestore(snapshot)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error restoring snapshot: %s", err.Error()), true}
+	}
+	fmt.Printf("Added %d keys, replaced %d and left %d unchanged\n", result.Added, result.Replaced, result.Unchanged)
+	for _, id := range result.Failed {
+		fmt.Printf("Failed: %s\n", id)
+	}
+	if len(result.Failed) > 0 {
+		return &ErrorStatus{fmt.Errorf("%d keys could not be restored", len(result.Failed)), true}
+	}
+	return nil
+}
+
+func newAdminFlags(op string) *flag.FlagSet {
+	return flag.NewFlagSet("admin "+op, flag.ContinueOnError)
+}
+
+func formatCounts(counts map[string]int) string {
+	parts := make([]string, 0, len(counts))
+	for status, n := range counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", strings.ToLower(status), n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func formatMetadata(md knox.KeyMetadata) string {
+	parts := make([]string, 0, len(md))
+	for k, v := range md {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
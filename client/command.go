@@ -49,6 +49,10 @@ const defaultTokenFileLocation = ".knox_user_auth"
 
 var cli knox.APIClient
 
+var flagCacheRoot = flag.String("cache-root", "", "Directory of the local key cache. Defaults to $KNOX_CACHE_ROOT or /var/lib/knox.")
+
+var flagAPIVersion = flag.String("api", "", "Server API version to use, v0 or v1. Defaults to $KNOX_API_VERSION or v0.")
+
 // VisibilityParams exposes functions for the knox client to provide information
 type VisibilityParams struct {
 	Logf           func(string, ...interface{})
@@ -95,6 +99,9 @@ func Run(
 	commands = append(commands, loginCommand)
 	flag.Usage = usage
 	flag.Parse()
+	setProfile(client)
+	setAPIVersion(client)
+	setCacheRoot(client)
 
 	args := flag.Args()
 	if len(args) < 1 {
@@ -150,24 +157,43 @@ var commands = []*Command{
 	cmdDaemon,
 	cmdRegister,
 	cmdUnregister,
+	cmdFetch,
+	cmdPrewarm,
 
 	// These commands are related to key management by users.
 	cmdGetKeys,
+	cmdSearch,
 	cmdGet,
 	cmdGetVersions,
 	cmdGetACL,
 	cmdPromote,
 	cmdCreate,
+	cmdInitKey,
 	cmdAdd,
+	cmdRotate,
 	cmdDeactivate,
 	cmdReactivate,
 	cmdUpdateAccess,
+	cmdTag,
+	cmdDeprecate,
+	cmdLock,
+	cmdUnlock,
 	cmdDelete,
+	cmdTink,
+	cmdMAC,
+	cmdShamir,
+
+	// These commands are for server operators.
+	cmdAdmin,
+	cmdImportVault,
+	cmdImportK8s,
+	cmdImportAWS,
 
 	// These are additional help topics
 	cmdListKeyTemplates,
 	cmdVersion,
 	helpAuth,
+	helpProfiles,
 }
 
 // A Command is an implementation of a go command
@@ -201,6 +227,11 @@ type ErrorStatus struct {
 	serverError bool
 }
 
+// Unwrap returns the underlying error.
+func (e *ErrorStatus) Unwrap() error {
+	return e.error
+}
+
 // Name returns the command's name: the first word in the usage line.
 func (c *Command) Name() string {
 	name := c.UsageLine
@@ -257,6 +288,37 @@ func printUsage(w io.Writer) {
 	tmpl(w, usageTemplate, commands)
 }
 
+// setCacheRoot applies the -cache-root flag to the daemon, register commands and
+// the client's cache. It is exported to the environment so that processes
+// started by knox, like knox.Register, use the same root.
+func setCacheRoot(client knox.APIClient) {
+	if *flagCacheRoot == "" {
+		return
+	}
+	os.Setenv(knox.CacheRootEnv, *flagCacheRoot)
+	daemonFolder = *flagCacheRoot
+	if c, ok := client.(interface{ SetCacheRoot(string) }); ok {
+		c.SetCacheRoot(*flagCacheRoot)
+	}
+}
+
+// setAPIVersion applies the -api flag to clients that support it.
+func setAPIVersion(client knox.APIClient) {
+	version := *flagAPIVersion
+	if version == "" {
+		version = os.Getenv("KNOX_API_VERSION")
+	}
+	if version == "" {
+		return
+	}
+	if version != "v0" && version != "v1" {
+		fatalf("Unknown API version %q, expected v0 or v1", version)
+	}
+	if c, ok := client.(interface{ SetAPIVersion(string) }); ok {
+		c.SetAPIVersion(version)
+	}
+}
+
 func usage() {
 	// special case "go test -h"
 	if len(os.Args) > 1 && os.Args[1] == "test" {
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
+)
+
+// validateContent checks that data is well formed for its content type before
+// it is sent to the server.
+func validateContent(contentType string, data []byte) error {
+	if !knox.ValidContentType(contentType) {
+		return fmt.Errorf("invalid content type %q", contentType)
+	}
+	switch contentType {
+	case knox.ContentTypeTinkKeyset, knox.ContentTypeTinkEncryptedKeyset:
+		_, err := tink.VersionInfo(knox.KeyVersion{Data: data, ContentType: contentType})
+		return err
+	}
+	return knox.ValidateContent(contentType, data)
+}
+
+// prettyData formats version data for a terminal based on its content type.
+// Data that can't be formatted is returned unchanged.
+func prettyData(v *knox.KeyVersion) []byte {
+	switch v.ContentType {
+	case knox.ContentTypeJSON:
+		var buf bytes.Buffer
+		if json.Indent(&buf, v.Data, "", "  ") == nil {
+			buf.WriteByte('\n')
+			return buf.Bytes()
+		}
+	case knox.ContentTypeTinkKeyset, knox.ContentTypeTinkEncryptedKeyset:
+		// Only show keyset metadata, never the key material. Encrypted
+		// keysets carry their metadata in cleartext.
+		info, err := tink.VersionInfo(*v)
+		if err != nil {
+			break
+		}
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err == nil {
+			return append(b, '\n')
+		}
+	}
+	return v.Data
+}
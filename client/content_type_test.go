@@ -0,0 +1,30 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
+)
+
+func TestContentTypeHelpers(t *testing.T) {
+	keyset, err := tink.NewKeyset("TINK_AEAD_AES256_GCM", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateContent(knox.ContentTypeTinkKeyset, keyset); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateContent(knox.ContentTypeTinkKeyset, []byte("nope")); err == nil {
+		t.Fatal("Expected invalid keyset to fail")
+	}
+
+	v := &knox.KeyVersion{Data: []byte(`{"a":1}`), ContentType: knox.ContentTypeJSON}
+	if got := string(prettyData(v)); got != "{\n  \"a\": 1\n}\n" {
+		t.Fatalf("Unexpected pretty JSON %q", got)
+	}
+	v.ContentType = ""
+	if got := string(prettyData(v)); got != `{"a":1}` {
+		t.Fatalf("Expected data unchanged, got %q", got)
+	}
+}
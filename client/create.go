@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
 )
 
 func init() {
@@ -13,7 +15,7 @@ func init() {
 }
 
 var cmdCreate = &Command{
-	UsageLine: "create [--key-template template_name] <key_identifier>",
+	UsageLine: "create [--key-template template_name [--tink-kms-key-uri uri]] [--content-type type] [--expires-in duration [--delete-on-expiry]] <key_identifier>",
 	Short:     "creates a new key",
 	Long: `
 Create will create a new key in knox with input as the primary key version. Key data should be sent to stdin unless a key-template is specified.
@@ -24,6 +26,21 @@ Please run "knox create <key_identifier>".
 Second way: the key-template option can be used to specify a template to generate the initial primary key version, instead of stdin. For available key templates, run "knox key-templates".
 Please run "knox create --key-template <template_name> <key_identifier>".
 
+The content-type option records the format of the key data, e.g. application/json, application/x-pem-file,
+or tink-keyset. JSON and PEM data and Tink keysets are checked before they are sent. Keys created from a
+key-template are tink-keyset by default.
+
+The tink-kms-key-uri option encrypts the keysets of a key created from a key-template with a KMS key,
+e.g. aws-kms://arn:aws:kms:us-east-1:123456789012:key/..., so the cleartext keyset is never stored in
+knox. Its versions are tink-encrypted-keyset and the URI is kept in the key's knox.tink_kms_key_uri
+metadata, which "knox add" and "knox get" use to encrypt and decrypt them. The knox binary must register
+a Tink KMS client for the URI.
+
+The expires-in option sets a time after which the server refuses to return the key's data, e.g. 72h for
+a temporary credential. Reads return a warning as the expiry approaches. With delete-on-expiry the server
+deletes the key once it has expired. The expiry can be changed later with knox tag and the
+knox.expires_at entry.
+
 The original key version id will be print to stdout.
 
 To create a new key, user credentials are required. The default access list will include the creator of this key and a limited set of site reliablity and security engineers.
@@ -34,34 +51,74 @@ See also: knox add, knox get
 	`,
 }
 var createTinkKeyset = cmdCreate.Flag.String("key-template", "", "name of a knox-supported Tink key template")
+var createTinkKMSKeyURI = cmdCreate.Flag.String("tink-kms-key-uri", "", "URI of a KMS key that encrypts the Tink keyset")
+var createContentType = cmdCreate.Flag.String("content-type", "", "content type of the key data")
+var createExpiresIn = cmdCreate.Flag.Duration("expires-in", 0, "time until the key expires")
+var createDeleteOnExpiry = cmdCreate.Flag.Bool("delete-on-expiry", false, "delete the key when it expires")
 
 func runCreate(cmd *Command, args []string) *ErrorStatus {
 	if len(args) != 1 {
 		return &ErrorStatus{fmt.Errorf("create takes exactly one argument. See 'knox help create'"), false}
 	}
 	keyID := args[0]
+	if *createExpiresIn < 0 {
+		return &ErrorStatus{fmt.Errorf("expires-in must be positive. See 'knox help create'"), false}
+	}
+	if *createDeleteOnExpiry && *createExpiresIn == 0 {
+		return &ErrorStatus{fmt.Errorf("delete-on-expiry needs expires-in. See 'knox help create'"), false}
+	}
+	if *createTinkKMSKeyURI != "" && *createTinkKeyset == "" {
+		return &ErrorStatus{fmt.Errorf("tink-kms-key-uri needs key-template. See 'knox help create'"), false}
+	}
 	var data []byte
 	var err error
 	if *createTinkKeyset != "" {
 		templateName := *createTinkKeyset
-		err = obeyNamingRule(templateName, keyID)
+		err = tink.CheckKeyID(templateName, keyID)
 		if err != nil {
 			return &ErrorStatus{err, false}
 		}
-		data, err = createNewTinkKeyset(tinkKeyTemplates[templateName].templateFunc)
+		data, err = tink.NewKeyset(templateName, *createTinkKMSKeyURI)
 	} else {
 		data, err = readDataFromStdin()
 	}
 	if err != nil {
 		return &ErrorStatus{err, false}
 	}
+	contentType := *createContentType
+	if contentType == "" && *createTinkKeyset != "" {
+		contentType = tink.ContentType(*createTinkKMSKeyURI)
+	}
+	if err := validateContent(contentType, data); err != nil {
+		return &ErrorStatus{err, false}
+	}
 	// TODO(devinlundberg): allow ACL to be entered as input
 	acl := knox.ACL{}
-	versionID, err := cli.CreateKey(keyID, data, acl)
+	versionID, err := cli.CreateKeyWithContentType(keyID, data, acl, contentType)
 	if err != nil {
 		return &ErrorStatus{fmt.Errorf("Error adding version: %s", err.Error()), true}
 	}
 	fmt.Printf("Created key with initial version %d\n", versionID)
+	if *createTinkKeyset != "" {
+		// Record the template so the key can be rotated with knox rotate.
+		md := knox.KeyMetadata{knox.MetadataGenerator: "tink:" + *createTinkKeyset}
+		if *createTinkKMSKeyURI != "" {
+			md[knox.MetadataTinkKMSKeyURI] = *createTinkKMSKeyURI
+		}
+		if err := cli.UpdateMetadata(keyID, md); err != nil {
+			return &ErrorStatus{fmt.Errorf("Error setting key generator: %s", err.Error()), true}
+		}
+	}
+	if *createExpiresIn > 0 {
+		md := knox.KeyMetadata{knox.MetadataExpiresAt: time.Now().Add(*createExpiresIn).UTC().Format(time.RFC3339)}
+		if *createDeleteOnExpiry {
+			md[knox.MetadataExpiryAction] = knox.ExpiryDelete
+		}
+		if err := cli.UpdateMetadata(keyID, md); err != nil {
+			return &ErrorStatus{fmt.Errorf("Error setting key expiry: %s", err.Error()), true}
+		}
+		fmt.Printf("Key expires at %s\n", md[knox.MetadataExpiresAt])
+	}
 	return nil
 }
 
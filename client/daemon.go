@@ -11,25 +11,56 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"gopkg.in/fsnotify.v1"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
 )
 
+func init() {
+	cmdDaemon.Run = runDaemon // break init cycle
+}
+
 var cmdDaemon = &Command{
-	Run:       runDaemon,
-	UsageLine: "daemon",
+	UsageLine: "daemon [-socket path] [-socket-uids uid,...] [-consumers file] [-key-mode mode] [-priority prefix,...] [-max-refresh n]",
 	Short:     "runs a process to keep keys in sync with server",
 	Long: `
 daemon runs the knox process that will keep keys in sync.
 
 This process will keep running until sent a kill signal or it crashes.
 
-This maintains a file system cache of knox keys that is used for all other knox commands.
+This maintains a file system cache of knox keys that is used for all other knox commands. The cache
+is kept under /var/lib/knox unless another root is set with -cache-root or $KNOX_CACHE_ROOT.
+
+-socket also serves registered keys read-only over a unix domain socket at the given path. Local
+processes can GET /v0/keys/<key_identifier>/ for the key as JSON or /v0/keys/<key_identifier>/primary
+for the primary version's data, and POST /v0/keys/<key_identifier>/ to register a key and get it once
+cached, as knox.NewFileClientWithOptions does. Callers are identified with SO_PEERCRED (Linux only)
+and logged.
+-socket-uids restricts socket access to a comma separated list of user ids.
+
+-consumers gives each consumer on a multi-tenant host a private copy of its keys. The file is a JSON
+list of {"name", "uid", "gid", "mode", "keys"} objects. Keys are written to
+<cache root>/consumers/<name>/<key_identifier> owned by uid and gid with mode (default 0400). The keys
+are kept up to date like registered keys and ownership is reset on every refresh.
+-key-mode sets the octal mode of the shared key cache files (default 0666), e.g. 0600 so that keys
+are only readable through consumer directories.
+
+When many keys change at once, e.g. after a mass rotation, keys are refreshed in priority order:
+keys matching the comma separated key ID prefixes given with -priority, in the order given, then
+keys whose primary version is a PEM file such as TLS certificates, then all other keys.
+-max-refresh limits the number of keys refreshed per cycle; the rest are refreshed in the following
+cycles, which then start after 30 seconds instead of waiting for the next refresh. A key that fails
+to refresh is retried after 30 seconds, doubling up to an hour with every further failure, so a
+broken key does not hold up the others.
 
 For more about knox, see https://github.com/pinterest/knox.
 
@@ -37,7 +68,7 @@ See also: knox register, knox unregister
 	`,
 }
 
-var daemonFolder = "/var/lib/knox"
+var daemonFolder = knox.CacheRoot()
 var daemonToRegister = "/.registered"
 var daemonKeys = "/v0/keys/"
 
@@ -49,8 +80,6 @@ var defaultDirPermission os.FileMode = 0777
 
 var daemonRefreshTime = 10 * time.Minute
 
-const tinkPrefix = "tink:"
-
 func runDaemon(cmd *Command, args []string) *ErrorStatus {
 
 	if os.Getenv("KNOX_MACHINE_AUTH") == "" {
@@ -66,11 +95,39 @@ func runDaemon(cmd *Command, args []string) *ErrorStatus {
 		registerFile: daemonToRegister,
 		keysDir:      daemonKeys,
 		cli:          cli,
+		keyMode:      defaultFilePermission,
+	}
+	if *daemonMaxRefresh < 0 {
+		return &ErrorStatus{fmt.Errorf("Invalid -max-refresh: must not be negative"), false}
+	}
+	d.schedule = newRefreshScheduler(parsePriority(*daemonPriority), *daemonMaxRefresh)
+	if *daemonConsumers != "" {
+		consumers, err := loadConsumers(*daemonConsumers)
+		if err != nil {
+			return &ErrorStatus{err, false}
+		}
+		d.consumers = consumers
+	}
+	if *daemonKeyMode != "" {
+		mode, err := parseFileMode(*daemonKeyMode)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("Invalid -key-mode: %s", err.Error()), false}
+		}
+		d.keyMode = mode
 	}
 	err := d.initialize()
 	if err != nil {
 		return &ErrorStatus{err, false}
 	}
+	if *daemonSocket != "" {
+		uids, err := parseUIDs(*daemonSocketUIDs)
+		if err != nil {
+			return &ErrorStatus{err, false}
+		}
+		if _, err := d.serveSocket(*daemonSocket, uids); err != nil {
+			return &ErrorStatus{err, false}
+		}
+	}
 	d.loop(daemonRefreshTime)
 	return nil
 }
@@ -84,6 +141,16 @@ type daemon struct {
 	updateErrCount  uint64
 	getKeyErrCount  uint64
 	successCount    uint64
+	consumers       []consumerConfig
+	// keyMode is the mode of cached key files, defaultFilePermission if zero.
+	keyMode os.FileMode
+	// watchKeys replaces the register file for knox register -watch. Other
+	// cached keys are left alone and auth errors are returned by update.
+	watchKeys []string
+	// noSync is set once the server turned out not to support key sync.
+	noSync bool
+	// schedule orders, limits and backs off key refreshes.
+	schedule *refreshScheduler
 }
 
 func (d *daemon) loop(refresh time.Duration) {
@@ -107,7 +174,13 @@ func (d *daemon) loop(refresh time.Duration) {
 		}
 		logf("Update of keys completed after %d ms", time.Since(start).Milliseconds())
 
+		var deferred <-chan time.Time
+		if d.schedule.pending() > 0 {
+			deferred = time.After(daemonDeferredRefreshTime)
+		}
 		select {
+		case <-deferred:
+			logf("Refreshing keys left from the last update")
 		case event := <-watcher.Events:
 			// On any change to register file
 			logf("Got file watcher event: %s on %s", event.Op.String(), event.Name)
@@ -124,9 +197,12 @@ func (d *daemon) loop(refresh time.Duration) {
 }
 
 func (d *daemon) initialize() error {
+	if d.schedule == nil {
+		d.schedule = newRefreshScheduler(nil, 0)
+	}
 	err := os.MkdirAll(d.dir, defaultDirPermission)
 	if err != nil {
-		return fmt.Errorf("Failed to initialize /var/lib/knox (run 'sudo mkdir /var/lib/knox'?): %s", err.Error())
+		return fmt.Errorf("Failed to initialize %s (run 'sudo mkdir %s'?): %s", d.dir, d.dir, err.Error())
 	}
 
 	// Need to chmod due to a umask set on masterless puppet machines
@@ -164,17 +240,24 @@ func (d *daemon) initialize() error {
 }
 
 func (d *daemon) update() error {
-	err := d.registerKeyFile.Lock()
-	if err != nil {
-		return err
-	}
-	// defer this so that functions can update the register file.
-	defer d.registerKeyFile.Unlock()
-	keyIDs, err := d.registerKeyFile.Get()
-	if err != nil {
-		return err
+	d.schedule.startCycle()
+	var keyIDs []string
+	if d.watchKeys != nil {
+		keyIDs = d.watchKeys
+	} else {
+		err := d.registerKeyFile.Lock()
+		if err != nil {
+			return err
+		}
+		// defer this so that functions can update the register file.
+		defer d.registerKeyFile.Unlock()
+		keyIDs, err = d.registerKeyFile.Get()
+		if err != nil {
+			return err
+		}
 	}
 	logf("Requested keys: %s", keyIDs)
+	keyIDs = append(keyIDs, d.consumerKeyIDs()...)
 
 	keyMap := map[string]string{}
 	existingKeys := map[string]bool{}
@@ -204,26 +287,68 @@ func (d *daemon) update() error {
 				}
 			} else {
 				keyMap[keyID] = key.VersionHash
+				d.schedule.observe(key)
 			}
-		} else {
+		} else if d.watchKeys == nil {
 			d.deleteKey(keyID)
 		}
 	}
 
-	if len(keyMap) > 0 {
-		updatedKeys, err := d.cli.GetKeys(keyMap)
+	backingOff := []string{}
+	for keyID := range keyMap {
+		if !d.schedule.ready(keyID) {
+			backingOff = append(backingOff, keyID)
+			delete(keyMap, keyID)
+			existingKeys[keyID] = true
+		}
+	}
+	if len(backingOff) > 0 {
+		logf("Keys backing off after failures: %s", backingOff)
+	}
+
+	var fatal error
+	// Daemons with a register file sync even without keys, so the server can
+	// ask them to prewarm keys.
+	if len(keyMap) > 0 || (d.watchKeys == nil && !d.noSync) {
+		updated, register, err := d.syncKeys(keyMap)
 		if err != nil {
 			return err
 		}
-		logf("Updated keys received from server: %s", updatedKeys)
-		for _, k := range updatedKeys {
-			err = d.processKey(k)
+		// Keys backing off are left out of the sync but already registered.
+		var unregistered []string
+		for _, id := range register {
+			if _, ok := existingKeys[id]; !ok {
+				unregistered = append(unregistered, id)
+			}
+		}
+		if register = d.registerPrewarmed(unregistered); len(register) > 0 {
+			versions := map[string]string{}
+			for _, id := range register {
+				versions[id] = ""
+				existingKeys[id] = false
+			}
+			prewarmed, _, err := d.syncKeys(versions)
+			if err != nil {
+				return err
+			}
+			for id, err := range prewarmed {
+				updated[id] = err
+			}
+		}
+		if n := d.schedule.pending(); n > 0 {
+			logf("Refresh limit reached, %d keys left for the next cycle", n)
+		}
+		for k, err := range updated {
 			existingKeys[k] = true
+			d.schedule.result(k, err)
 
 			if err != nil {
 				// Keep going in spite of failure
 				d.getKeyErrCount++
 				logf("error processing key: %s", err)
+				if d.watchKeys != nil && isAuthError(err) {
+					fatal = err
+				}
 			}
 		}
 	}
@@ -237,7 +362,82 @@ func (d *daemon) update() error {
 	}
 	logf("Keys not found on server: %s", notFound)
 
-	return nil
+	if fatal != nil {
+		return fatal
+	}
+	return d.syncConsumers()
+}
+
+// syncKeys fetches and saves the keys in versions whose version hash changed
+// and returns the result for each of them, nil if the key was saved, and the
+// keys the server asks to register. Servers without the sync route are asked
+// for each changed key separately. Keys are saved in priority order and keys
+// over the per-cycle limit are left for the next cycle.
+func (d *daemon) syncKeys(versions map[string]string) (map[string]error, []string, error) {
+	results := map[string]error{}
+	if !d.noSync {
+		s, err := d.cli.SyncKeys(versions)
+		if err == nil {
+			keys := map[string]*knox.Key{}
+			ids := make([]string, 0, len(s.Keys))
+			for i := range s.Keys {
+				keys[s.Keys[i].ID] = &s.Keys[i]
+				ids = append(ids, s.Keys[i].ID)
+			}
+			for _, id := range d.schedule.limit(d.schedule.order(ids)) {
+				results[id] = d.saveKey(keys[id])
+			}
+			for id, e := range s.Errors {
+				e := e
+				results[id] = d.unavailableKey(id, &e)
+			}
+			logf("Updated keys received from server: %d keys, %d errors", len(s.Keys), len(s.Errors))
+			return results, s.Register, nil
+		}
+		var apiErr *knox.APIError
+		if !errors.As(err, &apiErr) || apiErr.Code != knox.NotFoundCode {
+			return nil, nil, err
+		}
+		logf("Server does not support key sync, getting updated keys separately")
+		d.noSync = true
+	}
+	if len(versions) == 0 {
+		// Without versions the server would list every key.
+		return results, nil, nil
+	}
+	updatedKeys, err := d.cli.GetKeys(versions)
+	if err != nil {
+		return nil, nil, err
+	}
+	logf("Updated keys received from server: %s", updatedKeys)
+	for _, k := range d.schedule.limit(d.schedule.order(updatedKeys)) {
+		results[k] = d.processKey(k)
+	}
+	return results, nil, nil
+}
+
+// registerPrewarmed adds the keys the server asked to prewarm to the register
+// file and returns the ones that were added. The register file must be
+// locked.
+func (d *daemon) registerPrewarmed(ids []string) []string {
+	if len(ids) == 0 || d.watchKeys != nil {
+		return nil
+	}
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if socketKeyIDRegexp.MatchString(id) {
+			valid = append(valid, id)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	if err := d.registerKeyFile.Add(valid); err != nil {
+		logf("Failed to register keys to prewarm: %s", err.Error())
+		return nil
+	}
+	logf("Registered keys to prewarm: %s", valid)
+	return valid
 }
 
 func (d daemon) deleteKey(keyID string) error {
@@ -271,23 +471,47 @@ func (d daemon) keyFilename(id string) string {
 func (d daemon) processKey(keyID string) error {
 	key, err := d.cli.NetworkGetKey(keyID)
 	if err != nil {
-		if err.Error() == "User or machine not authorized" || err.Error() == "Key identifer does not exist" {
-			// This removes keys that do not exist or the machine is unauthorized to access
-			d.registerKeyFile.Remove([]string{keyID})
-		}
-		return fmt.Errorf("Error getting key %s: %s", keyID, err.Error())
+		return d.unavailableKey(keyID, err)
 	}
+	return d.saveKey(key)
+}
+
+// unavailableKey handles an error getting a key. Keys that do not exist or
+// the machine is unauthorized to access are removed from the register file.
+func (d daemon) unavailableKey(keyID string, err error) error {
+	var apiErr *knox.APIError
+	gone := err.Error() == "User or machine not authorized" || err.Error() == "Key identifer does not exist" ||
+		(errors.As(err, &apiErr) && (apiErr.Code == knox.UnauthorizedCode || apiErr.Code == knox.KeyIdentifierDoesNotExistCode))
+	if d.watchKeys == nil && gone {
+		d.registerKeyFile.Remove([]string{keyID})
+	}
+	return fmt.Errorf("Error getting key %s: %w", keyID, err)
+}
+
+// saveKey writes a key returned by the server to its file.
+func (d daemon) saveKey(key *knox.Key) error {
+	keyID := key.ID
 	// Do not cache any new keys if they have invalid content
 	if key.ID == "" || key.ACL == nil || key.VersionList == nil || key.VersionHash == "" {
 		return fmt.Errorf("invalid key content returned")
 	}
+	d.schedule.observe(key)
+	if d := key.Metadata.Deprecation(); d != nil {
+		logf("Key %s is %s", keyID, d)
+	}
 
-	if strings.HasPrefix(keyID, tinkPrefix) {
-		keysetHandle, _, err := getTinkKeysetHandleFromKnoxVersionList(key.VersionList)
+	// Registered templates may use prefixes other than tink:.
+	isTink := strings.HasPrefix(keyID, tink.KeyIDPrefix) || tink.IsKeysetID(keyID)
+	if isTink && key.Metadata[knox.MetadataTinkKMSKeyURI] != "" {
+		// Keysets encrypted with a KMS key are left for clients to decrypt, so
+		// the daemon never writes them in cleartext.
+		logf("Not assembling tink keyset for %s, it is encrypted with a KMS key", keyID)
+	} else if isTink {
+		keysetHandle, _, err := tink.KeysetHandle(key.VersionList, "")
 		if err != nil {
 			return fmt.Errorf("Error fetching keyset handle for this tink key %s: %s", keyID, err.Error())
 		}
-		tinkKeyset, err := convertTinkKeysetHandleToBytes(keysetHandle)
+		tinkKeyset, err := tink.WriteKeyset(keysetHandle, "")
 		if err != nil {
 			return fmt.Errorf("Error converting tink keyset handle to bytes %s: %s", keyID, err.Error())
 		}
@@ -318,7 +542,11 @@ func (d daemon) processKey(keyID string) error {
 		return fmt.Errorf("Error renaming key %s temporary file: %s", keyID, err.Error())
 	}
 
-	err = os.Chmod(d.keyFilename(keyID), defaultFilePermission)
+	mode := d.keyMode
+	if mode == 0 {
+		mode = defaultFilePermission
+	}
+	err = os.Chmod(d.keyFilename(keyID), mode)
 	if err != nil {
 		return fmt.Errorf("Failed to open up key file permissions: %s", err.Error())
 	}
@@ -378,12 +606,94 @@ func (k *KeysFile) Unlock() error {
 }
 
 // Get will get the list of key ids. It expects Lock to have been called.
+// An interrupted write is completed from the journal, and a file damaged by a
+// write without one is repaired by dropping the entries that can't be trusted.
 func (k *KeysFile) Get() ([]string, error) {
+	if b, err := ioutil.ReadFile(k.journal()); err == nil {
+		ks, _ := parseKeysFile(b)
+		logf("Completing interrupted write of register file %s", k.fn)
+		if err := k.write(ks); err != nil {
+			return nil, err
+		}
+		return ks, nil
+	}
 	b, err := ioutil.ReadFile(k.fn)
 	if err != nil {
 		return nil, err
 	}
-	return strings.Fields(string(b)), nil
+	ks, damaged := parseKeysFile(b)
+	if damaged {
+		logf("Register file %s is damaged, rewriting it with keys %s", k.fn, ks)
+		if err := k.write(ks); err != nil {
+			logf("Failed to repair register file %s: %s", k.fn, err.Error())
+		}
+	}
+	return ks, nil
+}
+
+// parseKeysFile reads the key IDs of a register file. Every entry is followed
+// by a newline, so a last entry without one was cut off by an interrupted
+// write. Entries with control characters, such as the NUL padding a crash can
+// leave behind, are dropped as well.
+func parseKeysFile(b []byte) (ks []string, damaged bool) {
+	if i := bytes.LastIndexByte(b, '\n'); i != len(b)-1 {
+		b = b[:i+1]
+		damaged = true
+	}
+	ks = []string{}
+	for _, k := range strings.Fields(string(b)) {
+		if !utf8.ValidString(k) || strings.IndexFunc(k, unicode.IsControl) >= 0 {
+			damaged = true
+			continue
+		}
+		ks = append(ks, k)
+	}
+	return ks, damaged
+}
+
+// journal is where the next contents of the register file are kept while it
+// is rewritten.
+func (k *KeysFile) journal() string {
+	return k.fn + ".journal"
+}
+
+// write replaces the contents of the register file with the key IDs. The file
+// is rewritten in place, since locks are held on it, after the new list is
+// saved to the journal. If the rewrite is interrupted the next Get finishes it
+// from the journal.
+func (k *KeysFile) write(ks []string) error {
+	unique := make(map[string]bool, len(ks))
+	sorted := make([]string, 0, len(ks))
+	for _, key := range ks {
+		if !unique[key] {
+			unique[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	var buffer bytes.Buffer
+	for _, key := range sorted {
+		buffer.WriteString(key)
+		buffer.WriteByte('\n')
+	}
+	if err := writeFileAtomic(k.journal(), buffer.Bytes(), defaultFilePermission); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFilePermission)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buffer.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(k.journal())
 }
 
 // Remove will remove the input key ids from the list. It expects Lock to have been called.
@@ -396,8 +706,7 @@ func (k *KeysFile) Remove(ks []string) error {
 			return err
 		}
 	}
-	// Use a map to remove any duplicates
-	newKeys := make(map[string]bool)
+	newKeys := []string{}
 	for _, oldK := range oldKeys {
 		removeIt := false
 		for _, k := range ks {
@@ -407,16 +716,10 @@ func (k *KeysFile) Remove(ks []string) error {
 			}
 		}
 		if !removeIt {
-			newKeys[oldK] = true
+			newKeys = append(newKeys, oldK)
 		}
 	}
-
-	var buffer bytes.Buffer
-	for k := range newKeys {
-		buffer.WriteString(k)
-		buffer.WriteByte('\n')
-	}
-	return ioutil.WriteFile(k.fn, buffer.Bytes(), 0666)
+	return k.write(newKeys)
 }
 
 // Add will add the key IDs to the list. It expects Lock to have been called.
@@ -441,30 +744,45 @@ func (k *KeysFile) Add(ks []string) error {
 		// Do not write if there are no changes
 		return nil
 	}
-
-	var buffer bytes.Buffer
-	for k := range newKeys {
-		buffer.WriteString(k)
-		buffer.WriteByte('\n')
-	}
-	return ioutil.WriteFile(k.fn, buffer.Bytes(), 0666)
+	return k.write(append(oldKeys, ks...))
 }
 
 // Overwrite deletes all existing values in the key list and writes the input.
 // It expects Lock to have been called.
 func (k *KeysFile) Overwrite(ks []string) error {
-	// Use a map to remove any duplicates
-	newKeys := make(map[string]bool)
-	for _, k := range ks {
-		newKeys[k] = true
-	}
+	return k.write(ks)
+}
 
-	var buffer bytes.Buffer
-	for k := range newKeys {
-		buffer.WriteString(k)
-		buffer.WriteByte('\n')
+// writeFileAtomic replaces fn with data by renaming a temporary file in the
+// same directory. The data is synced before the rename so a crash leaves
+// either the old or the new contents.
+func writeFileAtomic(fn string, data []byte, mode os.FileMode) error {
+	dir, name := filepath.Split(fn)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(dir, fmt.Sprintf(".*.%s.tmp", name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
 	}
-	return ioutil.WriteFile(k.fn, buffer.Bytes(), 0666)
+	return os.Rename(tmpFile.Name(), fn)
 }
 
 func identifyLockHolders(filename string) (string, error) {
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var daemonConsumers = cmdDaemon.Flag.String("consumers", "", "")
+var daemonKeyMode = cmdDaemon.Flag.String("key-mode", "", "")
+
+const consumersDir = "consumers"
+
+var consumerNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// consumerConfig describes a private copy of some keys for one consumer on a
+// multi-tenant host. The copies are written to <knox dir>/consumers/<name>/.
+type consumerConfig struct {
+	Name string `json:"name"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	// Mode is the octal file mode of the key files, 0400 if empty.
+	Mode string   `json:"mode"`
+	Keys []string `json:"keys"`
+
+	mode os.FileMode
+}
+
+// loadConsumers reads a JSON list of consumer configs.
+func loadConsumers(fn string) ([]consumerConfig, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read consumers file: %s", err.Error())
+	}
+	var consumers []consumerConfig
+	if err := json.Unmarshal(b, &consumers); err != nil {
+		return nil, fmt.Errorf("Failed to parse consumers file: %s", err.Error())
+	}
+	seen := map[string]bool{}
+	for i := range consumers {
+		c := &consumers[i]
+		if !consumerNameRegexp.MatchString(c.Name) || seen[c.Name] {
+			return nil, fmt.Errorf("Invalid or duplicate consumer name %q", c.Name)
+		}
+		seen[c.Name] = true
+		c.mode = 0400
+		if c.Mode != "" {
+			m, err := parseFileMode(c.Mode)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid mode for consumer %s: %s", c.Name, err.Error())
+			}
+			c.mode = m
+		}
+	}
+	return consumers, nil
+}
+
+// parseFileMode parses an octal permission mode such as "0640".
+func parseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		return 0, fmt.Errorf("%q is not an octal permission mode", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// consumerKeyIDs returns the keys needed by consumers so they are kept up to
+// date along with the registered keys.
+func (d *daemon) consumerKeyIDs() []string {
+	var ids []string
+	for _, c := range d.consumers {
+		ids = append(ids, c.Keys...)
+	}
+	return ids
+}
+
+func (d *daemon) consumerDir(name string) string {
+	return path.Join(d.dir, consumersDir, name)
+}
+
+// syncConsumers copies cached keys into each consumer's directory and resets
+// ownership and permissions on every run, so manual changes don't persist.
+func (d *daemon) syncConsumers() error {
+	if len(d.consumers) == 0 {
+		return nil
+	}
+	root := path.Join(d.dir, consumersDir)
+	if err := os.MkdirAll(root, 0711); err != nil {
+		return err
+	}
+	// Consumers can traverse to their own directory but not list the others.
+	if err := os.Chmod(root, 0711); err != nil {
+		return err
+	}
+	var failed []string
+	for _, c := range d.consumers {
+		if err := d.syncConsumer(c); err != nil {
+			logf("Failed to update keys for consumer %s: %s", c.Name, err.Error())
+			failed = append(failed, c.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to update keys for consumers %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (d *daemon) syncConsumer(c consumerConfig) error {
+	dir := d.consumerDir(c.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, c.UID, c.GID); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0500); err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, keyID := range c.Keys {
+		wanted[keyID] = true
+		b, err := ioutil.ReadFile(d.keyFilename(keyID))
+		if err != nil {
+			// The key may not be fetched yet or the machine may lack access.
+			logf("Key %s for consumer %s is not cached: %s", keyID, c.Name, err.Error())
+			continue
+		}
+		if err := writeOwnedFile(dir, keyID, b, c.UID, c.GID, c.mode); err != nil {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !wanted[f.Name()] {
+			os.Remove(path.Join(dir, f.Name()))
+		}
+	}
+	return nil
+}
+
+// writeOwnedFile atomically replaces dir/name with data owned by uid and gid.
+func writeOwnedFile(dir, name string, data []byte, uid, gid int, mode os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(dir, fmt.Sprintf(".*.%s.tmp", name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(tmpFile.Name(), uid, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path.Join(dir, name))
+}
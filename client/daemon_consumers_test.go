@@ -0,0 +1,75 @@
+package client
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestSyncConsumers(t *testing.T) {
+	dir, err := os.MkdirTemp("", "knox-consumers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uid, gid := os.Getuid(), os.Getgid()
+	cfg := path.Join(dir, "consumers.json")
+	err = os.WriteFile(cfg, []byte(`[{"name":"web","uid":`+strconv.Itoa(uid)+`,"gid":`+strconv.Itoa(gid)+`,"mode":"0440","keys":["a","missing"]}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumers, err := loadConsumers(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := daemon{dir: dir, registerFile: registeredFile, keysDir: keysDir, consumers: consumers}
+	if err := d.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := d.consumerKeyIDs(); len(ids) != 2 {
+		t.Fatalf("Expected 2 consumer keys, got %v", ids)
+	}
+	if err := os.WriteFile(d.keyFilename("a"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.syncConsumers(); err != nil {
+		t.Fatal(err)
+	}
+	fn := path.Join(d.consumerDir("web"), "a")
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0440 {
+		t.Fatalf("Expected mode 0440, got %o", fi.Mode().Perm())
+	}
+
+	// Permissions are enforced again on the next refresh.
+	if err := os.Chmod(fn, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.syncConsumers(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(fn); fi.Mode().Perm() != 0440 {
+		t.Fatalf("Expected mode 0440, got %o", fi.Mode().Perm())
+	}
+
+	// Keys no longer configured are removed.
+	d.consumers[0].Keys = nil
+	if err := d.syncConsumers(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", fn, err)
+	}
+
+	for _, bad := range []string{`[{"name":"../x"}]`, `[{"name":"a"},{"name":"a"}]`, `[{"name":"a","mode":"999"}]`} {
+		os.WriteFile(cfg, []byte(bad), 0600)
+		if _, err := loadConsumers(cfg); err == nil {
+			t.Fatalf("Expected %s to be rejected", bad)
+		}
+	}
+}
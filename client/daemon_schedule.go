@@ -0,0 +1,156 @@
+package client
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+var daemonPriority = cmdDaemon.Flag.String("priority", "", "")
+var daemonMaxRefresh = cmdDaemon.Flag.Int("max-refresh", 0, "")
+
+// Failing keys are retried after refreshBackoffBase, doubling with every
+// further failure up to refreshBackoffMax.
+var refreshBackoffBase = 30 * time.Second
+var refreshBackoffMax = time.Hour
+
+// daemonDeferredRefreshTime is how soon the daemon refreshes again when keys
+// were left for the next cycle by -max-refresh.
+var daemonDeferredRefreshTime = 30 * time.Second
+
+// refreshScheduler decides in which order and how many changed keys the
+// daemon refreshes in one cycle, and backs off keys that keep failing so they
+// don't hold up the others.
+type refreshScheduler struct {
+	// priority are key ID prefixes refreshed first, in order. Keys with a PEM
+	// primary version, e.g. TLS certificates, follow, then all other keys.
+	priority []string
+	// maxPerCycle is the number of keys refreshed per cycle, 0 for no limit.
+	maxPerCycle int
+	now         func() time.Time
+
+	mu       sync.Mutex
+	pem      map[string]bool
+	failures map[string]keyFailure
+	deferred int
+}
+
+type keyFailure struct {
+	count   int
+	retryAt time.Time
+}
+
+func newRefreshScheduler(priority []string, maxPerCycle int) *refreshScheduler {
+	return &refreshScheduler{
+		priority:    priority,
+		maxPerCycle: maxPerCycle,
+		now:         time.Now,
+		pem:         map[string]bool{},
+		failures:    map[string]keyFailure{},
+	}
+}
+
+// parsePriority parses the comma separated -priority key ID prefixes.
+func parsePriority(s string) []string {
+	var prefixes []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// observe records the content type of a key's primary version to classify it.
+func (s *refreshScheduler) observe(k *knox.Key) {
+	p := k.VersionList.GetPrimary()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pem[k.ID] = p != nil && p.ContentType == knox.ContentTypePEM
+}
+
+// class is the priority class of a key, lower classes are refreshed first.
+func (s *refreshScheduler) class(keyID string) int {
+	for i, p := range s.priority {
+		if strings.HasPrefix(keyID, p) {
+			return i
+		}
+	}
+	if s.pem[keyID] {
+		return len(s.priority)
+	}
+	return len(s.priority) + 1
+}
+
+// order sorts key IDs by priority class, then by ID.
+func (s *refreshScheduler) order(ids []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool {
+		ci, cj := s.class(ids[i]), s.class(ids[j])
+		if ci != cj {
+			return ci < cj
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// ready reports whether a key is not backing off after failures.
+func (s *refreshScheduler) ready(keyID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.failures[keyID]
+	return !ok || !s.now().Before(f.retryAt)
+}
+
+// startCycle forgets the keys left from the last cycle, which are refreshed
+// again when their version hash still differs.
+func (s *refreshScheduler) startCycle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deferred = 0
+}
+
+// limit returns the keys of ids, which must be ordered, to refresh in this
+// cycle and remembers how many were left for the next one.
+func (s *refreshScheduler) limit(ids []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxPerCycle > 0 && len(ids) > s.maxPerCycle {
+		s.deferred += len(ids) - s.maxPerCycle
+		ids = ids[:s.maxPerCycle]
+	}
+	return ids
+}
+
+// pending returns the number of keys left for the next cycle.
+func (s *refreshScheduler) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deferred
+}
+
+// result records the outcome of refreshing a key. Failing keys are backed off
+// exponentially; a success resets the backoff.
+func (s *refreshScheduler) result(keyID string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failures, keyID)
+		return
+	}
+	f := s.failures[keyID]
+	f.count++
+	wait := refreshBackoffMax
+	if f.count <= 32 {
+		if w := refreshBackoffBase << (f.count - 1); w > 0 && w < refreshBackoffMax {
+			wait = w
+		}
+	}
+	f.retryAt = s.now().Add(wait)
+	s.failures[keyID] = f
+}
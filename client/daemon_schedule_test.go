@@ -0,0 +1,78 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestRefreshSchedulerOrder(t *testing.T) {
+	s := newRefreshScheduler(parsePriority("tls_, db_"), 0)
+	s.observe(&knox.Key{ID: "cert", VersionList: knox.KeyVersionList{{ID: 1, Status: knox.Primary, ContentType: knox.ContentTypePEM}}})
+	s.observe(&knox.Key{ID: "api", VersionList: knox.KeyVersionList{{ID: 1, Status: knox.Primary}}})
+
+	ids := s.order([]string{"zzz", "api", "db_password", "cert", "tls_b", "tls_a"})
+	expected := []string{"tls_a", "tls_b", "db_password", "cert", "api", "zzz"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestRefreshSchedulerLimit(t *testing.T) {
+	s := newRefreshScheduler(nil, 2)
+	s.startCycle()
+	ids := s.limit([]string{"a", "b", "c"})
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) || s.pending() != 1 {
+		t.Fatalf("Expected 2 keys and 1 pending, got %v and %d", ids, s.pending())
+	}
+	s.startCycle()
+	if s.pending() != 0 {
+		t.Fatal("Expected no pending keys in a new cycle")
+	}
+
+	s = newRefreshScheduler(nil, 0)
+	if ids := s.limit([]string{"a", "b", "c"}); len(ids) != 3 || s.pending() != 0 {
+		t.Fatalf("Expected no limit, got %v", ids)
+	}
+}
+
+func TestRefreshSchedulerBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newRefreshScheduler(nil, 0)
+	s.now = func() time.Time { return now }
+
+	fail := fmt.Errorf("broken")
+	s.result("k", fail)
+	if s.ready("k") || !s.ready("other") {
+		t.Fatal("Expected only the failing key to back off")
+	}
+	now = now.Add(refreshBackoffBase)
+	if !s.ready("k") {
+		t.Fatal("Expected key to be retried after the first backoff")
+	}
+	s.result("k", fail)
+	now = now.Add(refreshBackoffBase)
+	if s.ready("k") {
+		t.Fatal("Expected backoff to double after the second failure")
+	}
+	now = now.Add(refreshBackoffBase)
+	if !s.ready("k") {
+		t.Fatal("Expected key to be retried after the second backoff")
+	}
+
+	for i := 0; i < 100; i++ {
+		s.result("k", fail)
+	}
+	now = now.Add(refreshBackoffMax)
+	if !s.ready("k") {
+		t.Fatal("Expected backoff to be capped")
+	}
+	s.result("k", fail)
+	s.result("k", nil)
+	if !s.ready("k") {
+		t.Fatal("Expected success to reset the backoff")
+	}
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+var daemonSocket = cmdDaemon.Flag.String("socket", "", "")
+var daemonSocketUIDs = cmdDaemon.Flag.String("socket-uids", "", "")
+
+// socketKeyIDRegexp matches valid key IDs so requests can't escape the cache directory.
+var socketKeyIDRegexp = regexp.MustCompile("^[a-zA-Z0-9_:]+$")
+
+type connContextKey struct{}
+
+// peerCred identifies the process on the other end of a unix socket.
+type peerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// socketServer serves the daemon's cached keys to local processes. Only keys
+// registered with the daemon are available.
+type socketServer struct {
+	d *daemon
+	// allowedUIDs restricts which users may read keys. Nil allows any user.
+	allowedUIDs map[uint32]bool
+}
+
+// parseUIDs parses a comma separated list of user IDs.
+func parseUIDs(s string) (map[uint32]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	uids := map[uint32]bool{}
+	for _, f := range strings.Split(s, ",") {
+		uid, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q", f)
+		}
+		uids[uint32(uid)] = true
+	}
+	return uids, nil
+}
+
+// serveSocket listens on a unix socket at path and serves keys until the
+// listener fails.
+func (d *daemon) serveSocket(path string, allowedUIDs map[uint32]bool) (net.Listener, error) {
+	if !peerCredentialsSupported {
+		return nil, fmt.Errorf("serving keys over a unix socket is not supported on this platform")
+	}
+	// Remove a socket left behind by a previous daemon.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %s: %s", path, err.Error())
+	}
+	// Access is checked with peer credentials rather than file permissions.
+	if err := os.Chmod(path, defaultFilePermission); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to open up socket permissions: %s", err.Error())
+	}
+	s := &socketServer{d: d, allowedUIDs: allowedUIDs}
+	srv := &http.Server{
+		Handler: s,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logf("Stopped serving keys on %s: %s", path, err.Error())
+		}
+	}()
+	return l, nil
+}
+
+// ServeHTTP handles GET /v0/keys/<key_id>/, which returns the key as JSON,
+// GET /v0/keys/<key_id>/primary, which returns the primary version's data, and
+// POST /v0/keys/<key_id>/, which registers the key and returns it as JSON once
+// the daemon cached it.
+func (s *socketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	cred, err := peerCredentials(c)
+	if err != nil {
+		logf("Failed to get socket peer credentials: %s", err.Error())
+		http.Error(w, "unable to identify peer", http.StatusForbidden)
+		return
+	}
+	if s.allowedUIDs != nil && !s.allowedUIDs[cred.UID] {
+		logf("Denied socket request from uid %d pid %d for %s", cred.UID, cred.PID, r.URL.Path)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v0/keys/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	keyID, suffix, _ := strings.Cut(rest, "/")
+	if !socketKeyIDRegexp.MatchString(keyID) || (suffix != "" && suffix != "primary") {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == "POST" && suffix == "":
+		if err := s.register(keyID); err != nil {
+			logf("Failed to register key %s over socket for uid %d pid %d: %s", keyID, cred.UID, cred.PID, err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	case r.Method != "GET":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := ioutil.ReadFile(s.d.keyFilename(keyID))
+	if err != nil {
+		http.Error(w, "key is not registered", http.StatusNotFound)
+		return
+	}
+	var key knox.Key
+	if err := json.Unmarshal(b, &key); err != nil {
+		http.Error(w, "invalid cached key", http.StatusInternalServerError)
+		return
+	}
+	logf("Served key %s over socket to uid %d pid %d", keyID, cred.UID, cred.PID)
+
+	if suffix == "primary" {
+		primary := key.VersionList.GetPrimary()
+		if primary == nil {
+			http.Error(w, "key has no primary version", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(primary.Data)
+		return
+	}
+	w.Header().Set("Content-Type", knox.JSONContentType)
+	w.Write(b)
+}
+
+// socketRegisterTimeout is how long a registration over the socket waits for
+// the daemon to cache the key, the same as the knox register -t default.
+const socketRegisterTimeout = 5 * time.Second
+
+// register adds a key to the register file, which makes the daemon update,
+// and waits for the key to be cached.
+func (s *socketServer) register(keyID string) error {
+	if _, err := os.Stat(s.d.keyFilename(keyID)); err == nil {
+		return nil
+	}
+	// A separate lock from the daemon's, which may be holding it.
+	k := NewKeysFile(s.d.registerFilename())
+	if err := k.Lock(); err != nil {
+		return err
+	}
+	err := k.Add([]string{keyID})
+	if unlockErr := k.Unlock(); err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		return err
+	}
+	logf("Registered key %s over socket", keyID)
+	timeout := time.After(socketRegisterTimeout)
+	for {
+		if _, err := os.Stat(s.d.keyFilename(keyID)); err == nil {
+			return nil
+		}
+		select {
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for the daemon to get key %s", keyID)
+		case <-time.After(registerRecheckTime):
+		}
+	}
+}
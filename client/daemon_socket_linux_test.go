@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestDaemonSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "knox-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := daemon{dir: dir, registerFile: registeredFile, keysDir: keysDir}
+	if err := d.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	key := knox.Key{
+		ID:          "testkey",
+		VersionList: knox.KeyVersionList{{ID: 1, Data: []byte("secret"), Status: knox.Primary}},
+		VersionHash: "hash",
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(d.keyFilename("testkey"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(socket, p string) (int, string) {
+		c := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}}
+		resp, err := c.Get("http://knox" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	socket := path.Join(dir, "knox.sock")
+	l, err := d.serveSocket(socket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if code, body := get(socket, "/v0/keys/testkey/primary"); code != http.StatusOK || body != "secret" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+	code, body := get(socket, "/v0/keys/testkey/")
+	var got knox.Key
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &got) != nil || got.VersionHash != "hash" {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+	for _, p := range []string{"/v0/keys/missing/", "/v0/keys/..%2f.registered/", "/other"} {
+		if code, _ := get(socket, p); code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %s, got %d", p, code)
+		}
+	}
+
+	denied := path.Join(dir, "denied.sock")
+	l2, err := d.serveSocket(denied, map[uint32]bool{uint32(os.Getuid()) + 1: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if code, _ := get(denied, "/v0/keys/testkey/primary"); code != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %d", code)
+	}
+}
+
+func TestDaemonSocketRegister(t *testing.T) {
+	dir, err := os.MkdirTemp("", "knox-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := daemon{dir: dir, registerFile: registeredFile, keysDir: keysDir}
+	if err := d.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	socket := path.Join(dir, "knox.sock")
+	l, err := d.serveSocket(socket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Stand in for the daemon's update loop, caching the key once it is
+	// registered.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(registerRecheckTime):
+			}
+			d.registerKeyFile.Lock()
+			ks, _ := d.registerKeyFile.Get()
+			d.registerKeyFile.Unlock()
+			for _, id := range ks {
+				key := knox.Key{
+					ID:          id,
+					VersionList: knox.KeyVersionList{{ID: 1, Data: []byte("secret"), Status: knox.Primary}},
+					VersionHash: "hash",
+				}
+				b, _ := json.Marshal(key)
+				os.WriteFile(d.keyFilename(id), b, 0600)
+			}
+		}
+	}()
+
+	c, err := knox.NewFileClientWithOptions("testkey", knox.FileClientOptions{Socket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GetPrimary() != "secret" {
+		t.Fatalf("Unexpected primary %q", c.GetPrimary())
+	}
+}
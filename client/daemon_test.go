@@ -52,6 +52,17 @@ func setGoodResponse(params *returnParameters, data interface{}) error {
 	return nil
 }
 
+// setNotFoundResponse answers like a server without the requested route.
+func setNotFoundResponse(params *returnParameters) error {
+	d, err := json.Marshal(&knox.Response{Status: "error", Code: knox.NotFoundCode})
+	if err != nil {
+		return err
+	}
+	params.setData(d)
+	params.setCode(http.StatusNotFound)
+	return nil
+}
+
 type returnParameters struct {
 	sync.Mutex
 	data       []byte
@@ -255,8 +266,11 @@ func TestUpdate(t *testing.T) {
 		t.Fatalf("%s does not equal %s", keys[0], expected.ID)
 	}
 
+	// Servers without key sync are asked for each updated key.
 	params.setFunc(func(r *http.Request) {
 		switch r.URL.Path {
+		case "/v0/sync/":
+			setNotFoundResponse(params)
 		case "/v0/keys/":
 			if r.URL.RawQuery != expected.ID+"=" {
 				t.Fatalf("%s does not equal %s", r.URL.RawQuery, expected.ID+"=")
@@ -400,6 +414,120 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestUpdateSync(t *testing.T) {
+	params, dir, d := setUpTest(t)
+	defer TearDownTest(dir)
+	expected := knox.Key{
+		ID:          "testkey",
+		ACL:         knox.ACL([]knox.Access{}),
+		VersionList: knox.KeyVersionList{},
+		VersionHash: "VersionHash",
+	}
+	for _, k := range []string{expected.ID, "gone"} {
+		if err := addRegisteredKey(k, d.registerFilename()); err != nil {
+			t.Fatal("Failed to register key: " + err.Error())
+		}
+	}
+
+	params.setFunc(func(r *http.Request) {
+		if r.URL.Path != "/v0/sync/" {
+			t.Fatal("Unexpected path:" + r.URL.Path)
+		}
+		versions := map[string]string{}
+		if err := json.Unmarshal([]byte(r.PostFormValue("versions")), &versions); err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || versions[expected.ID] != "" || versions["gone"] != "" {
+			t.Fatalf("Unexpected versions %v", versions)
+		}
+		setGoodResponse(params, knox.KeySync{
+			Keys: []knox.Key{expected},
+			Errors: map[string]knox.APIError{
+				"gone": {Code: knox.KeyIdentifierDoesNotExistCode, Message: "No such key gone"},
+			},
+		})
+	})
+	if err := d.update(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if d.getKeyErrCount != 1 {
+		t.Fatalf("Expected 1 key error, got %d", d.getKeyErrCount)
+	}
+	ret, err := d.cli.CacheGetKey(expected.ID)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if ret.VersionHash != expected.VersionHash {
+		t.Fatalf("%s does not equal %s", ret.VersionHash, expected.VersionHash)
+	}
+
+	// Keys that no longer exist are unregistered.
+	if err := d.registerKeyFile.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.registerKeyFile.Get()
+	d.registerKeyFile.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != expected.ID {
+		t.Fatalf("Expected only %s to be registered, got %v", expected.ID, keys)
+	}
+}
+
+func TestUpdatePrewarm(t *testing.T) {
+	params, dir, d := setUpTest(t)
+	defer TearDownTest(dir)
+	expected := knox.Key{
+		ID:          "prewarmed",
+		ACL:         knox.ACL([]knox.Access{}),
+		VersionList: knox.KeyVersionList{},
+		VersionHash: "VersionHash",
+	}
+
+	// A daemon without registered keys still syncs, and registers the keys
+	// the server asks for.
+	syncs := 0
+	params.setFunc(func(r *http.Request) {
+		if r.URL.Path != "/v0/sync/" {
+			t.Fatal("Unexpected path:" + r.URL.Path)
+		}
+		syncs++
+		versions := map[string]string{}
+		if err := json.Unmarshal([]byte(r.PostFormValue("versions")), &versions); err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) == 0 {
+			setGoodResponse(params, knox.KeySync{Keys: []knox.Key{}, Register: []string{expected.ID, "../bad"}})
+			return
+		}
+		if len(versions) != 1 || versions[expected.ID] != "" {
+			t.Fatalf("Unexpected versions %v", versions)
+		}
+		setGoodResponse(params, knox.KeySync{Keys: []knox.Key{expected}})
+	})
+	if err := d.update(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if syncs != 2 {
+		t.Fatalf("Expected 2 syncs, got %d", syncs)
+	}
+	if _, err := d.cli.CacheGetKey(expected.ID); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := d.registerKeyFile.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.registerKeyFile.Get()
+	d.registerKeyFile.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != expected.ID {
+		t.Fatalf("Expected only %s to be registered, got %v", expected.ID, keys)
+	}
+}
+
 func addRegisteredKey(k, reg string) error {
 	f, err := os.OpenFile(reg, os.O_APPEND|os.O_WRONLY, 0666)
 	defer f.Close()
@@ -562,6 +690,78 @@ func TestOverwrite(t *testing.T) {
 	}
 }
 
+func TestKeysFileRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knox-test")
+	if err != nil {
+		t.Fatal("Failed to create temp directory: " + err.Error())
+	}
+	defer TearDownTest(dir)
+	fn := dir + "/TestKeysFileRepair"
+	k := NewKeysFile(fn)
+
+	for contents, expected := range map[string]string{
+		"a\nb\n":             "a,b",
+		"a\nb\nlong_key_na":  "a,b",
+		"a\nb\n\x00\x00\x00": "a,b",
+		"a\n\x00b\n":         "a",
+		"":                   "",
+	} {
+		if err := ioutil.WriteFile(fn, []byte(contents), defaultFilePermission); err != nil {
+			t.Fatal(err)
+		}
+		ks, err := k.Get()
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if strings.Join(ks, ",") != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, contents, ks)
+		}
+		// The file is repaired.
+		b, _ := ioutil.ReadFile(fn)
+		if ks, damaged := parseKeysFile(b); damaged || strings.Join(ks, ",") != expected {
+			t.Fatalf("File was not repaired: %q", b)
+		}
+	}
+}
+
+func TestKeysFileJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knox-test")
+	if err != nil {
+		t.Fatal("Failed to create temp directory: " + err.Error())
+	}
+	defer TearDownTest(dir)
+	fn := dir + "/TestKeysFileJournal"
+	k := NewKeysFile(fn)
+	if err := k.Add([]string{"a"}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := os.Stat(fn + ".journal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the journal to be removed after a write, got %v", err)
+	}
+
+	// Simulate a crash while rewriting the file for adding b.
+	if err := ioutil.WriteFile(fn+".journal", []byte("a\nb\n"), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("a\n"), defaultFilePermission); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := k.Get()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if strings.Join(ks, ",") != "a,b" {
+		t.Fatalf("Expected the journaled keys, got %q", ks)
+	}
+	b, _ := ioutil.ReadFile(fn)
+	if string(b) != "a\nb\n" {
+		t.Fatalf("Expected the register file to be rewritten, got %q", b)
+	}
+	if _, err := os.Stat(fn + ".journal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the journal to be removed, got %v", err)
+	}
+}
+
 func TestBackwardsCompat(t *testing.T) {
 	dir, err := ioutil.TempDir("", "knox-test")
 	if err != nil {
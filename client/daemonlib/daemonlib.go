@@ -0,0 +1,381 @@
+// Package daemonlib runs the knox daemon's key registration and refresh in
+// process, for long running Go services that would rather not depend on the
+// knox binary and a daemon writing keys to disk.
+//
+// A Daemon keeps the keys registered with it in memory and refreshes them
+// from the knox server in the background:
+//
+//	d := daemonlib.New(daemonlib.Config{Client: apiClient})
+//	key, err := d.Client("service:db_password")
+//	...
+//	go d.Run(ctx)
+//
+// Keys are synced the way the knox daemon syncs them, asking the server only
+// for the keys whose version hash changed.
+package daemonlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// DefaultRefresh is the interval between refreshes of the registered keys,
+// the same as the knox daemon's.
+const DefaultRefresh = 10 * time.Minute
+
+// ErrNotRegistered is returned for keys that were not registered.
+var ErrNotRegistered = errors.New("knox key is not registered")
+
+// Config configures a Daemon.
+type Config struct {
+	// Client talks to the knox server.
+	Client knox.APIClient
+	// Refresh is the interval between refreshes, DefaultRefresh if zero.
+	Refresh time.Duration
+	// Jitter is the largest random delay added to each refresh, so processes
+	// started together don't refresh together. It defaults to a tenth of
+	// Refresh.
+	Jitter time.Duration
+	// OnRotation is called after a refresh changes the versions of a
+	// registered key.
+	OnRotation func(old, new knox.Key)
+	// OnError is called when a key could not be refreshed. The last value of
+	// the key is kept. If nil, errors are logged.
+	OnError func(keyID string, err error)
+}
+
+// Daemon keeps registered keys in memory and refreshes them from the knox
+// server. It is safe for concurrent use.
+type Daemon struct {
+	config Config
+
+	mu      sync.RWMutex
+	keys    map[string]*knox.Key
+	clients map[string][]*keyClient
+	// noSync is set once the server turned out not to support key sync.
+	noSync bool
+}
+
+// New creates a Daemon with no registered keys.
+func New(c Config) *Daemon {
+	if c.Refresh <= 0 {
+		c.Refresh = DefaultRefresh
+	}
+	if c.Jitter == 0 {
+		c.Jitter = c.Refresh / 10
+	}
+	return &Daemon{
+		config:  c,
+		keys:    map[string]*knox.Key{},
+		clients: map[string][]*keyClient{},
+	}
+}
+
+// Register adds keys to refresh. Keys that are not registered yet are fetched
+// from the server before Register returns; if any of them can't be fetched
+// none of them are registered.
+func (d *Daemon) Register(keyIDs ...string) error {
+	fetched := map[string]*knox.Key{}
+	for _, id := range keyIDs {
+		if _, err := d.Get(id); err == nil {
+			continue
+		}
+		key, err := d.config.Client.NetworkGetKey(id)
+		if err != nil {
+			return fmt.Errorf("Error getting key %s: %w", id, err)
+		}
+		if err := validateKey(key); err != nil {
+			return fmt.Errorf("Error getting key %s: %w", id, err)
+		}
+		fetched[id] = key
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, key := range fetched {
+		if _, ok := d.keys[id]; !ok {
+			d.keys[id] = key
+		}
+	}
+	return nil
+}
+
+// Unregister stops refreshing keys. Clients for them keep their last value.
+func (d *Daemon) Unregister(keyIDs ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range keyIDs {
+		delete(d.keys, id)
+		delete(d.clients, id)
+	}
+}
+
+// Registered returns the IDs of the registered keys in order.
+func (d *Daemon) Registered() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ids := make([]string, 0, len(d.keys))
+	for id := range d.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get returns the cached value of a registered key.
+func (d *Daemon) Get(keyID string) (*knox.Key, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	key, ok := d.keys[keyID]
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	return key, nil
+}
+
+// Client registers a key and returns a knox.RotationClient for it that is
+// updated on every refresh, like the clients knox.NewFileClientWithOptions
+// returns, until it is closed. Closing the client leaves the key registered.
+func (d *Daemon) Client(keyID string) (knox.RotationClient, error) {
+	if err := d.Register(keyID); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key, ok := d.keys[keyID]
+	if !ok {
+		// Unregistered concurrently.
+		return nil, ErrNotRegistered
+	}
+	c := &keyClient{d: d, key: *key}
+	d.clients[keyID] = append(d.clients[keyID], c)
+	return c, nil
+}
+
+// removeClient stops updating a closed client.
+func (d *Daemon) removeClient(c *keyClient) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := c.GetKeyObject().ID
+	clients := d.clients[id]
+	for i := range clients {
+		if clients[i] == c {
+			d.clients[id] = append(clients[:i:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(d.clients[id]) == 0 {
+		delete(d.clients, id)
+	}
+}
+
+// Run refreshes the registered keys every Refresh interval until ctx is
+// done, and returns ctx's error.
+func (d *Daemon) Run(ctx context.Context) error {
+	for {
+		delay := d.config.Refresh
+		if d.config.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(d.config.Jitter)))
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if err := d.Refresh(); err != nil {
+			d.reportError("", err)
+		}
+	}
+}
+
+// Refresh gets the registered keys that changed from the server and runs the
+// rotation callbacks for them. It returns an error if the server could not be
+// reached; errors for single keys are passed to OnError.
+func (d *Daemon) Refresh() error {
+	d.mu.RLock()
+	versions := make(map[string]string, len(d.keys))
+	for id, key := range d.keys {
+		versions[id] = key.VersionHash
+	}
+	noSync := d.noSync
+	d.mu.RUnlock()
+	if len(versions) == 0 {
+		return nil
+	}
+
+	updated := []*knox.Key{}
+	if !noSync {
+		s, err := d.config.Client.SyncKeys(versions)
+		var apiErr *knox.APIError
+		switch {
+		case err == nil:
+			for i := range s.Keys {
+				updated = append(updated, &s.Keys[i])
+			}
+			for id, e := range s.Errors {
+				e := e
+				d.reportError(id, &e)
+			}
+		case errors.As(err, &apiErr) && apiErr.Code == knox.NotFoundCode:
+			d.mu.Lock()
+			d.noSync = true
+			d.mu.Unlock()
+			noSync = true
+		default:
+			return err
+		}
+	}
+	if noSync {
+		ids, err := d.config.Client.GetKeys(versions)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			key, err := d.config.Client.NetworkGetKey(id)
+			if err != nil {
+				d.reportError(id, err)
+				continue
+			}
+			updated = append(updated, key)
+		}
+	}
+	for _, key := range updated {
+		if err := validateKey(key); err != nil {
+			d.reportError(key.ID, err)
+			continue
+		}
+		d.update(key)
+	}
+	return nil
+}
+
+// update replaces a registered key and runs the rotation callbacks if its
+// versions changed.
+func (d *Daemon) update(key *knox.Key) {
+	d.mu.Lock()
+	old, ok := d.keys[key.ID]
+	if !ok {
+		// Unregistered during the refresh.
+		d.mu.Unlock()
+		return
+	}
+	d.keys[key.ID] = key
+	clients := d.clients[key.ID]
+	d.mu.Unlock()
+
+	if old.VersionHash == key.VersionHash {
+		return
+	}
+	for _, c := range clients {
+		c.refresh(key)
+	}
+	if d.config.OnRotation != nil {
+		d.config.OnRotation(*old, *key)
+	}
+}
+
+func (d *Daemon) reportError(keyID string, err error) {
+	if d.config.OnError != nil {
+		d.config.OnError(keyID, err)
+		return
+	}
+	if keyID == "" {
+		log.Printf("Failed to refresh knox keys: %s", err)
+		return
+	}
+	log.Printf("Failed to refresh knox key %s: %s", keyID, err)
+}
+
+func validateKey(key *knox.Key) error {
+	if key.ID == "" || key.ACL == nil || key.VersionList == nil || key.VersionHash == "" {
+		return fmt.Errorf("invalid key content returned")
+	}
+	return nil
+}
+
+// keyClient is a knox.Client for a key registered with a Daemon.
+type keyClient struct {
+	d         *Daemon
+	mu        sync.RWMutex
+	key       knox.Key
+	callbacks []func(old, new knox.Key)
+}
+
+func (c *keyClient) refresh(key *knox.Key) {
+	c.mu.Lock()
+	old := c.key
+	c.key = *key
+	callbacks := c.callbacks
+	c.mu.Unlock()
+	for _, f := range callbacks {
+		f(old, *key)
+	}
+}
+
+func (c *keyClient) GetPrimary() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return knox.NewKeyValues(c.key.VersionList).PrimaryData()
+}
+
+func (c *keyClient) GetActive() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return knox.NewKeyValues(c.key.VersionList).ActiveData()
+}
+
+func (c *keyClient) GetPrimaryVersion() (uint64, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p := knox.NewKeyValues(c.key.VersionList).Primary
+	return p.ID, p.Data
+}
+
+func (c *keyClient) GetActiveVersions() map[uint64]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return knox.NewKeyValues(c.key.VersionList).ActiveVersions()
+}
+
+func (c *keyClient) GetPrimaryAndPrevious() (string, string) {
+	primary := c.GetPrimary()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if prev := c.key.PreviousPrimary(time.Now()); prev != nil {
+		return primary, string(prev.Data)
+	}
+	return primary, ""
+}
+
+func (c *keyClient) GetConcatenated(sep string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return string(c.key.VersionList.Concat(sep))
+}
+
+func (c *keyClient) GetKeyObject() knox.Key {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.key
+}
+
+func (c *keyClient) OnRotation(f func(old, new knox.Key)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = append(c.callbacks, f)
+}
+
+// Close stops updating the client. The key stays registered with the Daemon.
+func (c *keyClient) Close() error {
+	c.d.removeClient(c)
+	return nil
+}
@@ -0,0 +1,211 @@
+package daemonlib
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// fakeServer is a knox.APIClient serving keys from memory.
+type fakeServer struct {
+	knox.APIClient
+	mu     sync.Mutex
+	keys   map[string]*knox.Key
+	noSync bool
+	syncs  int
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{keys: map[string]*knox.Key{}}
+}
+
+func (s *fakeServer) put(id string, data ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kvl := knox.KeyVersionList{}
+	for i, d := range data {
+		status := knox.Active
+		if i == 0 {
+			status = knox.Primary
+		}
+		kvl = append(kvl, knox.KeyVersion{ID: uint64(i + 1), Data: []byte(d), Status: status})
+	}
+	s.keys[id] = &knox.Key{ID: id, ACL: knox.ACL{}, VersionList: kvl, VersionHash: kvl.Hash()}
+}
+
+func (s *fakeServer) NetworkGetKey(id string) (*knox.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, &knox.APIError{Code: knox.KeyIdentifierDoesNotExistCode, Message: "Key identifer does not exist"}
+	}
+	out := *k
+	return &out, nil
+}
+
+func (s *fakeServer) SyncKeys(versions map[string]string) (*knox.KeySync, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.noSync {
+		return nil, &knox.APIError{Code: knox.NotFoundCode, Message: "Not found"}
+	}
+	s.syncs++
+	out := &knox.KeySync{Errors: map[string]knox.APIError{}}
+	for id, hash := range versions {
+		k, ok := s.keys[id]
+		if !ok {
+			out.Errors[id] = knox.APIError{Code: knox.KeyIdentifierDoesNotExistCode, Message: "Key identifer does not exist"}
+		} else if k.VersionHash != hash {
+			out.Keys = append(out.Keys, *k)
+		}
+	}
+	return out, nil
+}
+
+func (s *fakeServer) GetKeys(versions map[string]string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, hash := range versions {
+		if k, ok := s.keys[id]; ok && k.VersionHash != hash {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func TestRegisterAndRefresh(t *testing.T) {
+	for _, noSync := range []bool{false, true} {
+		s := newFakeServer()
+		s.noSync = noSync
+		s.put("k1", "a")
+		var rotations []string
+		d := New(Config{Client: s, OnRotation: func(old, new knox.Key) {
+			rotations = append(rotations, new.ID)
+		}})
+
+		if err := d.Register("missing"); err == nil {
+			t.Fatal("Expected a missing key to fail to register")
+		}
+		c, err := d.Client("k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.GetPrimary() != "a" {
+			t.Fatalf("Unexpected primary %q", c.GetPrimary())
+		}
+		var rotated knox.Key
+		c.OnRotation(func(old, new knox.Key) { rotated = new })
+
+		if err := d.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if len(rotations) != 0 {
+			t.Fatalf("Expected no rotations without changes, got %v", rotations)
+		}
+
+		s.put("k1", "b", "a")
+		if err := d.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if c.GetPrimary() != "b" || len(c.GetActive()) != 2 || rotated.ID != "k1" {
+			t.Fatalf("Expected the client to be rotated, got %q %q", c.GetPrimary(), c.GetActive())
+		}
+		if id, data := c.GetPrimaryVersion(); id != 1 || data != "b" || len(c.GetActiveVersions()) != 2 {
+			t.Fatalf("Unexpected versions %d %q %v", id, data, c.GetActiveVersions())
+		}
+		if len(rotations) != 1 || rotations[0] != "k1" {
+			t.Fatalf("Unexpected rotations %v", rotations)
+		}
+		if k, err := d.Get("k1"); err != nil || string(k.VersionList.GetPrimary().Data) != "b" {
+			t.Fatalf("Unexpected cached key %+v, %v", k, err)
+		}
+	}
+}
+
+func TestRefreshErrorsKeepKeys(t *testing.T) {
+	s := newFakeServer()
+	s.put("k1", "a")
+	var failed []string
+	d := New(Config{Client: s, OnError: func(id string, err error) { failed = append(failed, id) }})
+	if err := d.Register("k1"); err != nil {
+		t.Fatal(err)
+	}
+	delete(s.keys, "k1")
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0] != "k1" {
+		t.Fatalf("Expected an error for k1, got %v", failed)
+	}
+	if _, err := d.Get("k1"); err != nil {
+		t.Fatalf("Expected the last value to be kept, got %v", err)
+	}
+
+	d.Unregister("k1")
+	if _, err := d.Get("k1"); err != ErrNotRegistered {
+		t.Fatalf("Expected ErrNotRegistered, got %v", err)
+	}
+	if len(d.Registered()) != 0 {
+		t.Fatalf("Unexpected registered keys %v", d.Registered())
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := newFakeServer()
+	s.put("k1", "a")
+	d := New(Config{Client: s, Refresh: time.Millisecond})
+	if err := d.Register("k1"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		n := s.syncs
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Expected Run to refresh keys")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected Run to stop with the context, got %v", err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	s := newFakeServer()
+	s.put("k1", "a")
+	d := New(Config{Client: s})
+	c1, err := d.Client("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := d.Client("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.put("k1", "b", "a")
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if c1.GetPrimary() != "a" || c2.GetPrimary() != "b" {
+		t.Fatalf("Expected only the open client to be updated, got %q and %q", c1.GetPrimary(), c2.GetPrimary())
+	}
+	if len(d.Registered()) != 1 {
+		t.Fatalf("Expected the key to stay registered, got %v", d.Registered())
+	}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdDeprecate.Run = runDeprecate // break init cycle
+}
+
+var cmdDeprecate = &Command{
+	UsageLine: "deprecate [-m message] [-r replacement_key_identifier] [-undo] <key_identifier>",
+	Short:     "marks a key as deprecated",
+	Long: `
+Deprecate marks a key as deprecated. The key keeps working, but clients that
+fetch it (knox get and knox daemon) log a warning with the given message and
+replacement key so consumers can be moved off of it.
+
+-m sets the message shown to consumers.
+-r sets the key identifier consumers should use instead.
+-undo removes the deprecation notice.
+
+This requires admin access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox tag, knox get
+	`,
+}
+
+var deprecateMessage = cmdDeprecate.Flag.String("m", "this key will be removed", "")
+var deprecateReplacement = cmdDeprecate.Flag.String("r", "", "")
+var deprecateUndo = cmdDeprecate.Flag.Bool("undo", false, "")
+
+func runDeprecate(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("deprecate takes only one argument. See 'knox help deprecate'"), false}
+	}
+	keyID := args[0]
+	md := knox.KeyMetadata{
+		knox.MetadataDeprecated:  *deprecateMessage,
+		knox.MetadataReplacement: *deprecateReplacement,
+	}
+	if *deprecateUndo {
+		md = knox.KeyMetadata{knox.MetadataDeprecated: "", knox.MetadataReplacement: ""}
+	} else if *deprecateMessage == "" {
+		return &ErrorStatus{fmt.Errorf("deprecate requires a non-empty message"), false}
+	}
+	err := cli.UpdateMetadata(keyID, md)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error deprecating key: %s", err.Error()), true}
+	}
+	return nil
+}
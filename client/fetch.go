@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdFetch.Run = runFetch // break init cycle
+}
+
+var cmdFetch = &Command{
+	UsageLine: "fetch -manifest <manifest_file> [-retries n]",
+	Short:     "writes keys to files once and exits",
+	Long: `
+Fetch reads a manifest of keys and destination files, gets every key from the server once, writes the
+files and exits. It is meant for Kubernetes init containers and cloud-init, where no daemon is running.
+
+The manifest is a JSON document (which is also valid YAML):
+
+	{"files": [
+		{"key": "service:db", "path": "/secrets/db_password"},
+		{"key": "service:db", "path": "/secrets/db.conf", "mode": "0440",
+		 "template": "password={{.Primary}}\n"}
+	]}
+
+Without a template the primary version's data is written as is. Templates use Go text/template syntax
+with .Primary, .Active (a list), .Key (the full key) and a base64 function. template_file reads the
+template from a file instead. Files are written with mode 0400 unless mode is set.
+
+All keys are fetched and rendered before any file is written, and each file is replaced atomically,
+so a failed run leaves existing files untouched. Failed requests are retried, except when the server
+rejects the client's credentials or denies access to a key.
+
+-manifest specifies the manifest file.
+-retries specifies how many times to retry getting each key (default 5).
+
+This requires read access to the keys and can use user or machine authentication.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox get, knox register
+	`,
+}
+
+var fetchManifest = cmdFetch.Flag.String("manifest", "", "")
+var fetchRetries = cmdFetch.Flag.Int("retries", 5, "")
+
+const fetchRetryWait = time.Second
+
+// fetchManifestFile is a destination for a key in a fetch manifest.
+type fetchManifestFile struct {
+	Key          string `json:"key"`
+	Path         string `json:"path"`
+	Mode         string `json:"mode"`
+	Template     string `json:"template"`
+	TemplateFile string `json:"template_file"`
+
+	mode os.FileMode
+	tmpl *template.Template
+}
+
+type fetchManifestConfig struct {
+	Files []fetchManifestFile `json:"files"`
+}
+
+// fetchTemplateData is passed to fetch templates.
+type fetchTemplateData struct {
+	Primary string
+	Active  []string
+	Key     *knox.Key
+}
+
+var fetchTemplateFuncs = template.FuncMap{
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+}
+
+// loadFetchManifest reads a manifest and parses its templates.
+func loadFetchManifest(fn string) (*fetchManifestConfig, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read manifest: %s", err.Error())
+	}
+	var m fetchManifestConfig
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest: %s", err.Error())
+	}
+	if len(m.Files) == 0 {
+		return nil, fmt.Errorf("The manifest does not list any files")
+	}
+	for i := range m.Files {
+		f := &m.Files[i]
+		if f.Key == "" || f.Path == "" {
+			return nil, fmt.Errorf("Manifest entry %d needs a key and a path", i)
+		}
+		f.mode = 0400
+		if f.Mode != "" {
+			mode, err := parseFileMode(f.Mode)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid mode for %s: %s", f.Path, err.Error())
+			}
+			f.mode = mode
+		}
+		text := f.Template
+		if f.TemplateFile != "" {
+			if f.Template != "" {
+				return nil, fmt.Errorf("%s has both a template and a template_file", f.Path)
+			}
+			b, err := ioutil.ReadFile(f.TemplateFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read template for %s: %s", f.Path, err.Error())
+			}
+			text = string(b)
+		}
+		if text != "" {
+			f.tmpl, err = template.New(f.Path).Funcs(fetchTemplateFuncs).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid template for %s: %s", f.Path, err.Error())
+			}
+		}
+	}
+	return &m, nil
+}
+
+func runFetch(cmd *Command, args []string) *ErrorStatus {
+	if *fetchManifest == "" {
+		return &ErrorStatus{fmt.Errorf("You must give a manifest file. See 'knox help fetch'"), false}
+	}
+	m, err := loadFetchManifest(*fetchManifest)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	if err := fetchFiles(cli, m, *fetchRetries, fetchRetryWait); err != nil {
+		return &ErrorStatus{err, true}
+	}
+	logf("Wrote %d files from %s", len(m.Files), *fetchManifest)
+	return nil
+}
+
+// fetchFiles gets each key in the manifest once, renders every file and then
+// writes them. Nothing is written if any key can't be fetched or rendered.
+func fetchFiles(c knox.APIClient, m *fetchManifestConfig, retries int, wait time.Duration) error {
+	keys := map[string]*knox.Key{}
+	for _, f := range m.Files {
+		if _, ok := keys[f.Key]; ok {
+			continue
+		}
+		key, err := fetchKey(c, f.Key, retries, wait)
+		if err != nil {
+			return err
+		}
+		keys[f.Key] = key
+	}
+
+	contents := make([][]byte, len(m.Files))
+	for i, f := range m.Files {
+		b, err := f.render(keys[f.Key])
+		if err != nil {
+			return err
+		}
+		contents[i] = b
+	}
+
+	for i, f := range m.Files {
+		if err := writeFileAtomic(f.Path, contents[i], f.mode); err != nil {
+			return fmt.Errorf("Failed to write %s: %s", f.Path, err.Error())
+		}
+	}
+	return nil
+}
+
+// fetchKey gets a key from the server, retrying failures other than
+// authentication and authorization errors.
+func fetchKey(c knox.APIClient, keyID string, retries int, wait time.Duration) (*knox.Key, error) {
+	for attempt := 0; ; attempt++ {
+		key, err := c.NetworkGetKey(keyID)
+		if err == nil {
+			return key, nil
+		}
+		if isAuthError(err) || attempt >= retries {
+			return nil, fmt.Errorf("Error getting key %s: %s", keyID, err.Error())
+		}
+		logf("Failed to get key %s, retrying: %s", keyID, err.Error())
+		time.Sleep(wait)
+	}
+}
+
+func (f fetchManifestFile) render(key *knox.Key) ([]byte, error) {
+	primary := key.VersionList.GetPrimary()
+	if primary == nil {
+		return nil, fmt.Errorf("Key %s has no primary version", f.Key)
+	}
+	if f.tmpl == nil {
+		return primary.Data, nil
+	}
+	data := fetchTemplateData{Primary: string(primary.Data), Key: key}
+	for _, v := range key.VersionList.GetActive() {
+		data.Active = append(data.Active, string(v.Data))
+	}
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("Failed to render template for %s: %s", f.Path, err.Error())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestFetchFiles(t *testing.T) {
+	params, dir, d := setUpTest(t)
+	defer TearDownTest(dir)
+	key := knox.Key{
+		ID:  "testkey",
+		ACL: knox.ACL([]knox.Access{}),
+		VersionList: knox.KeyVersionList{
+			{ID: 1, Data: []byte("secret"), Status: knox.Primary},
+			{ID: 2, Data: []byte("old"), Status: knox.Active},
+		},
+		VersionHash: "VersionHash",
+	}
+	requests := 0
+	params.setFunc(func(r *http.Request) {
+		requests++
+		if r.URL.Path != "/v0/keys/testkey/" {
+			t.Fatal("Unexpected path:" + r.URL.Path)
+		}
+		setGoodResponse(params, key)
+	})
+
+	manifest := path.Join(dir, "manifest.yaml")
+	raw := path.Join(dir, "out", "raw")
+	conf := path.Join(dir, "out", "app.conf")
+	err := os.WriteFile(manifest, []byte(`{"files": [
+		{"key": "testkey", "path": "`+raw+`"},
+		{"key": "testkey", "path": "`+conf+`", "mode": "0440",
+		 "template": "password={{.Primary}} old={{index .Active 1}} b64={{base64 .Primary}}"}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadFetchManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := d.cli
+	if err := fetchFiles(c, m, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected one request for the key, got %d", requests)
+	}
+	if b, _ := os.ReadFile(raw); string(b) != "secret" {
+		t.Fatalf("Unexpected content %q", b)
+	}
+	b, _ := os.ReadFile(conf)
+	if string(b) != "password=secret old=old b64=c2VjcmV0" {
+		t.Fatalf("Unexpected content %q", b)
+	}
+	if fi, _ := os.Stat(conf); fi.Mode().Perm() != 0440 {
+		t.Fatalf("Expected mode 0440, got %o", fi.Mode().Perm())
+	}
+
+	// Nothing is written when a key can't be fetched, and authorization
+	// errors are not retried.
+	denied, _ := json.Marshal(&knox.Response{Status: "error", Code: knox.UnauthorizedCode, Message: "User or machine not authorized"})
+	requests = 0
+	params.setFunc(func(r *http.Request) {
+		requests++
+		params.setData(denied)
+		params.setCode(http.StatusForbidden)
+	})
+	os.Remove(raw)
+	if err := fetchFiles(c, m, 3, 0); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if requests != 1 {
+		t.Fatalf("Expected no retries, got %d requests", requests)
+	}
+	if _, err := os.Stat(raw); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s not to be written", raw)
+	}
+
+	for _, bad := range []string{`{"files": []}`, `{"files": [{"key": "a"}]}`, `{"files": [{"key": "a", "path": "b", "template": "{{"}]}`} {
+		os.WriteFile(manifest, []byte(bad), 0600)
+		if _, err := loadFetchManifest(manifest); err == nil {
+			t.Fatalf("Expected %s to be rejected", bad)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package client
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
 )
 
 func init() {
@@ -14,7 +19,7 @@ func init() {
 }
 
 var cmdGet = &Command{
-	UsageLine: "get [-v key_version] [-n] [-j] [-a] [--tink-keyset] [--tink-keyset-info] <key_identifier>",
+	UsageLine: "get [-v key_version] [-n] [-j] [-a] [-p] [--base64 | --hex] [--concat [--separator sep]] [--tink-keyset] [--tink-keyset-info] <key_identifier>",
 	Short:     "get a knox key",
 	Long: `
 Get gets the key data for a key.
@@ -23,8 +28,12 @@ Get gets the key data for a key.
 -j returns the json version of the key as specified in the knox API.
 -n forces a network call. This will avoid cache issues where the ACL is out of date.
 -a returns all key versions (including inactive ones). Only works when -j is specified.
+-p pretty prints the key data based on its content type: JSON is indented and Tink keysets are shown as keyset metadata without key material.
+--base64 and --hex print the key data base64 (standard encoding) or hex encoded and followed by a newline, so binary keys can be copied through terminals and CI logs unchanged. "knox add --base64" reads such data back. They can't be used with -j, -p or the tink options.
+--concat returns the primary version followed by all other active versions, each terminated by a newline or the string given with --separator. This is the natural form of CA bundles, SSH known_hosts and authorized_keys files, where every active version must be trusted during a rotation.
 --tink-keyset retrieve all the primary and active versions of this identifier in knox, combine them, and return one tink keyset. Force to retrieve tink keyset if -n is specified.
 --tink-keyset-info retrieves keyset metadata for primary and active versions without revealing the secret keys. Force to retrieve tink keyset metadata if -n is specified.
+Both check the versions first: each must hold a single enabled, parseable tink key with a unique tink key ID, and exactly one must be primary. Errors name the knox version at fault.
 
 This requires read access to the key.
 
@@ -37,6 +46,11 @@ var getVersion = cmdGet.Flag.String("v", "", "")
 var getJSON = cmdGet.Flag.Bool("j", false, "")
 var getNetwork = cmdGet.Flag.Bool("n", false, "")
 var getAll = cmdGet.Flag.Bool("a", false, "")
+var getPretty = cmdGet.Flag.Bool("p", false, "")
+var getBase64 = cmdGet.Flag.Bool("base64", false, "")
+var getHex = cmdGet.Flag.Bool("hex", false, "")
+var getConcat = cmdGet.Flag.Bool("concat", false, "")
+var getSeparator = cmdGet.Flag.String("separator", "\n", "")
 var getTinkKeyset = cmdGet.Flag.Bool("tink-keyset", false, "get the stored tink keyset of the given knox identifier entirely")
 var getTinkKeysetInfo = cmdGet.Flag.Bool("tink-keyset-info", false, "get the metadata of the stored tink keyset of the given knox identifier")
 
@@ -61,6 +75,12 @@ func runGet(cmd *Command, args []string) *ErrorStatus {
 		return &ErrorStatus{fmt.Errorf("get takes only one argument. See 'knox help get'"), false}
 	}
 	keyID := args[0]
+	if *getBase64 && *getHex {
+		return &ErrorStatus{fmt.Errorf("--base64 and --hex can't be used together"), false}
+	}
+	if (*getBase64 || *getHex) && (*getJSON || *getPretty || *getTinkKeyset || *getTinkKeysetInfo) {
+		return &ErrorStatus{fmt.Errorf("--base64 and --hex can't be used with -j, -p or the tink options"), false}
+	}
 
 	var err error
 	var key *knox.Key
@@ -103,6 +123,7 @@ func runGet(cmd *Command, args []string) *ErrorStatus {
 		failureGetKeyMetric(keyID, err)
 		return &ErrorStatus{fmt.Errorf("Error getting key: %s", err.Error()), true}
 	}
+	warnIfDeprecated(key)
 	if *getJSON {
 		data, err := json.Marshal(key)
 		if err != nil {
@@ -113,15 +134,20 @@ func runGet(cmd *Command, args []string) *ErrorStatus {
 		successGetKeyMetric(keyID)
 		return nil
 	}
+	if *getConcat {
+		fmt.Printf("%s", string(encodeData(key.VersionList.Concat(*getSeparator), *getBase64, *getHex)))
+		successGetKeyMetric(keyID)
+		return nil
+	}
 	if key.VersionList != nil {
 		if *getVersion == "" {
-			fmt.Printf("%s", string(key.VersionList.GetPrimary().Data))
+			printVersionData(key.VersionList.GetPrimary())
 			successGetKeyMetric(keyID)
 			return nil
 		}
-		for _, v := range key.VersionList {
+		for i, v := range key.VersionList {
 			if strconv.FormatUint(v.ID, 10) == *getVersion {
-				fmt.Printf("%s", string(v.Data))
+				printVersionData(&key.VersionList[i])
 				successGetKeyMetric(keyID)
 				return nil
 			}
@@ -132,7 +158,7 @@ func runGet(cmd *Command, args []string) *ErrorStatus {
 }
 
 func retrieveTinkKeyset(keyID string, getFromNetwork bool) ([]byte, *ErrorStatus) {
-	if !isIDforTinkKeyset(keyID) {
+	if !tink.IsKeysetID(keyID) {
 		return nil, &ErrorStatus{fmt.Errorf("this knox identifier is not for tink keyset"), false}
 	}
 	// get the primary and all active versions of this knox identifier.
@@ -146,11 +172,16 @@ func retrieveTinkKeyset(keyID string, getFromNetwork bool) ([]byte, *ErrorStatus
 	if err != nil {
 		return nil, &ErrorStatus{fmt.Errorf("error getting key: %s", err.Error()), true}
 	}
-	keysetHandle, _, err := getTinkKeysetHandleFromKnoxVersionList(primaryAndActiveVersions.VersionList)
+	kekURI := primaryAndActiveVersions.Metadata[knox.MetadataTinkKMSKeyURI]
+	if err := tink.ValidateVersions(primaryAndActiveVersions.VersionList, kekURI); err != nil {
+		return nil, &ErrorStatus{fmt.Errorf("invalid tink keyset for %s: %s", keyID, err.Error()), false}
+	}
+	keysetHandle, _, err := tink.KeysetHandle(primaryAndActiveVersions.VersionList, kekURI)
 	if err != nil {
 		return nil, &ErrorStatus{err, false}
 	}
-	tinkKeysetInBytes, err := convertTinkKeysetHandleToBytes(keysetHandle)
+	// Keysets of keys with a KMS key are output encrypted with it again.
+	tinkKeysetInBytes, err := tink.WriteKeyset(keysetHandle, kekURI)
 	if err != nil {
 		return nil, &ErrorStatus{err, false}
 	}
@@ -158,7 +189,7 @@ func retrieveTinkKeyset(keyID string, getFromNetwork bool) ([]byte, *ErrorStatus
 }
 
 func retrieveTinkKeysetInfo(keyID string, getFromNetwork bool) (string, *ErrorStatus) {
-	if !isIDforTinkKeyset(keyID) {
+	if !tink.IsKeysetID(keyID) {
 		return "", &ErrorStatus{fmt.Errorf("this knox identifier is not for tink keyset"), false}
 	}
 	// get the primary and all active versions of this knox identifier.
@@ -172,13 +203,55 @@ func retrieveTinkKeysetInfo(keyID string, getFromNetwork bool) (string, *ErrorSt
 	if err != nil {
 		return "", &ErrorStatus{fmt.Errorf("error getting key: %s", err.Error()), true}
 	}
-	keysetHandle, tinkKeyIDToKnoxVersionID, err := getTinkKeysetHandleFromKnoxVersionList(primaryAndActiveVersions.VersionList)
+	kekURI := primaryAndActiveVersions.Metadata[knox.MetadataTinkKMSKeyURI]
+	if err := tink.ValidateVersions(primaryAndActiveVersions.VersionList, kekURI); err != nil {
+		return "", &ErrorStatus{fmt.Errorf("invalid tink keyset for %s: %s", keyID, err.Error()), false}
+	}
+	keysetHandle, tinkKeyIDToKnoxVersionID, err := tink.KeysetHandle(primaryAndActiveVersions.VersionList, kekURI)
 	if err != nil {
 		return "", &ErrorStatus{err, false}
 	}
-	tinkKeysetInfo, err := getKeysetInfoFromTinkKeysetHandle(keysetHandle, tinkKeyIDToKnoxVersionID)
+	tinkKeysetInfo, err := tink.KeysetInfoJSON(keysetHandle, tinkKeyIDToKnoxVersionID)
 	if err != nil {
 		return "", &ErrorStatus{err, false}
 	}
 	return tinkKeysetInfo, nil
 }
+
+func printVersionData(v *knox.KeyVersion) {
+	data := v.Data
+	if *getPretty {
+		data = prettyData(v)
+	}
+	fmt.Printf("%s", string(encodeData(data, *getBase64, *getHex)))
+}
+
+// encodeData returns key data as it is printed with --base64 or --hex.
+func encodeData(data []byte, base64Output, hexOutput bool) []byte {
+	switch {
+	case base64Output:
+		return []byte(base64.StdEncoding.EncodeToString(data) + "\n")
+	case hexOutput:
+		return []byte(hex.EncodeToString(data) + "\n")
+	}
+	return data
+}
+
+// decodeBase64Data decodes key data printed by "knox get --base64", ignoring
+// surrounding whitespace such as the final newline.
+func decodeBase64Data(data []byte) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key data is not valid base64: %s", err.Error())
+	}
+	return decoded, nil
+}
+
+// warnIfDeprecated prints the deprecation notice for a key to stderr so that
+// it does not interfere with key data written to stdout.
+func warnIfDeprecated(key *knox.Key) {
+	if d := key.Metadata.Deprecation(); d != nil {
+		fmt.Fprintf(os.Stderr, "knox: warning: key %s is %s\n", key.ID, d)
+		logf("Key %s is %s", key.ID, d)
+	}
+}
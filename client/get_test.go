@@ -0,0 +1,26 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeData(t *testing.T) {
+	data := []byte{0, 1, 0xfe, '\n', 0xff}
+	if got := string(encodeData(data, false, true)); got != "0001fe0aff\n" {
+		t.Fatalf("Unexpected hex output %q", got)
+	}
+	if got := encodeData(data, false, false); !bytes.Equal(got, data) {
+		t.Fatalf("Expected the raw data, got %q", got)
+	}
+	decoded, err := decodeBase64Data(encodeData(data, true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("Expected %q to round trip, got %q", data, decoded)
+	}
+	if _, err := decodeBase64Data([]byte("not base64!")); err == nil {
+		t.Fatal("Expected invalid base64 to be rejected")
+	}
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// Import statuses of a secret.
+const (
+	importCreated = "created"
+	importMatches = "matches"
+	importDiffers = "differs"
+	importPlanned = "planned"
+	importSkipped = "skipped"
+	importFailed  = "failed"
+)
+
+// importKeyIDRegexp matches the key identifiers knox accepts.
+var importKeyIDRegexp = regexp.MustCompile("^[a-zA-Z0-9_:]+$")
+
+// secretSource is a secret store that secrets are imported from.
+type secretSource interface {
+	// source describes what is imported, for the report.
+	source() string
+	// list returns the names of the secrets, sorted. Names are paths with
+	// / separated components, which are mapped to key identifiers and
+	// matched against ACL templates.
+	list() ([]string, error)
+	// read returns the key data of a secret and its content type. It returns
+	// an importSkip for secrets that can't be imported.
+	read(name string) ([]byte, string, error)
+}
+
+// importSkip is the reason a secret is skipped rather than failed.
+type importSkip string
+
+func (e importSkip) Error() string { return string(e) }
+
+// importACLTemplate is the ACL of the secrets below a path prefix.
+type importACLTemplate struct {
+	Prefix string   `json:"prefix"`
+	ACL    knox.ACL `json:"acl"`
+}
+
+// importResult is the entry of a secret in the reconciliation report.
+type importResult struct {
+	Path   string `json:"path"`
+	KeyID  string `json:"key_id,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// importReport is the reconciliation report of an import.
+type importReport struct {
+	Source  string         `json:"source"`
+	Time    int64          `json:"time"`
+	DryRun  bool           `json:"dry_run"`
+	Counts  map[string]int `json:"counts"`
+	Results []importResult `json:"results"`
+}
+
+// importOptions are the options common to all importers.
+type importOptions struct {
+	prefix    string
+	templates []importACLTemplate
+	dryRun    bool
+}
+
+// runImportCLI runs the command line tool of a secret store and returns its
+// output.
+var runImportCLI = func(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %s", name, args[0], err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// importKeyID maps the name of a secret to a key ID.
+func importKeyID(prefix, name string) (string, error) {
+	id := prefix + strings.NewReplacer("/", ":", "-", "_", ".", "_").Replace(name)
+	if !importKeyIDRegexp.MatchString(id) {
+		return "", fmt.Errorf("%q is not a valid key identifier", id)
+	}
+	return id, nil
+}
+
+// importACL returns the ACL of the template with the longest prefix of name.
+func importACL(templates []importACLTemplate, name string) (knox.ACL, bool) {
+	best := -1
+	for i, t := range templates {
+		if strings.HasPrefix(name, t.Prefix) && (best < 0 || len(t.Prefix) > len(templates[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, false
+	}
+	return templates[best].ACL, true
+}
+
+// importField returns the field of a secret holding the key data and its
+// content type, or the whole secret as JSON if field is empty.
+func importField(data map[string]interface{}, field string) ([]byte, string, error) {
+	if field == "" {
+		b, err := json.Marshal(data)
+		return b, knox.ContentTypeJSON, err
+	}
+	v, ok := data[field]
+	if !ok {
+		return nil, "", fmt.Errorf("the secret has no field %q", field)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, "", fmt.Errorf("the field %q is not a string", field)
+	}
+	if s == "" {
+		return nil, "", fmt.Errorf("the field %q is empty", field)
+	}
+	return []byte(s), "", nil
+}
+
+// importSecrets imports every secret of src and returns the report.
+func importSecrets(c knox.APIClient, src secretSource, opts importOptions) (*importReport, error) {
+	names, err := src.list()
+	if err != nil {
+		return nil, err
+	}
+	report := &importReport{
+		Source: src.source(),
+		Time:   time.Now().UnixNano(),
+		DryRun: opts.dryRun,
+		Counts: map[string]int{},
+	}
+	ids := map[string]string{}
+	for _, name := range names {
+		r := importSecret(c, src, name, opts, ids)
+		report.Counts[r.Status]++
+		report.Results = append(report.Results, r)
+	}
+	return report, nil
+}
+
+func importSecret(c knox.APIClient, src secretSource, name string, opts importOptions, ids map[string]string) importResult {
+	r := importResult{Path: name, Status: importSkipped}
+	id, err := importKeyID(opts.prefix, name)
+	if err != nil {
+		r.Reason = err.Error()
+		return r
+	}
+	r.KeyID = id
+	if other, ok := ids[id]; ok {
+		r.Reason = "the key identifier is already used by " + other
+		return r
+	}
+	ids[id] = name
+	acl, ok := importACL(opts.templates, name)
+	if !ok {
+		r.Reason = "no ACL template matches the path"
+		return r
+	}
+	data, contentType, err := src.read(name)
+	var skip importSkip
+	if errors.As(err, &skip) {
+		r.Reason = err.Error()
+		return r
+	}
+	if err != nil {
+		r.Status, r.Reason = importFailed, err.Error()
+		return r
+	}
+
+	existing, err := c.NetworkGetKey(id)
+	var apiErr *knox.APIError
+	switch {
+	case err == nil:
+		r.Status = importDiffers
+		if p := existing.VersionList.GetPrimary(); p != nil && bytes.Equal(p.Data, data) {
+			r.Status = importMatches
+		}
+		return r
+	case !errors.As(err, &apiErr) || apiErr.Code != knox.KeyIdentifierDoesNotExistCode:
+		r.Status, r.Reason = importFailed, err.Error()
+		return r
+	}
+	if opts.dryRun {
+		r.Status = importPlanned
+		return r
+	}
+	if _, err := c.CreateKeyWithContentType(id, data, acl, contentType); err != nil {
+		r.Status, r.Reason = importFailed, err.Error()
+		return r
+	}
+	r.Status = importCreated
+	return r
+}
+
+func readImportACLTemplates(file string) ([]importACLTemplate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read acl file: %s", err.Error())
+	}
+	var templates []importACLTemplate
+	if err := json.Unmarshal(b, &templates); err != nil {
+		return nil, fmt.Errorf("Could not parse acl file: %s", err.Error())
+	}
+	for _, t := range templates {
+		if err := t.ACL.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid ACL for prefix %q: %s", t.Prefix, err.Error())
+		}
+	}
+	return templates, nil
+}
+
+// runImport imports the secrets of src, prints the results and writes the
+// report to reportFile if set.
+func runImport(src secretSource, opts importOptions, reportFile string) *ErrorStatus {
+	report, err := importSecrets(cli, src, opts)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error listing secrets: %s", err.Error()), false}
+	}
+	for _, r := range report.Results {
+		if r.Reason != "" {
+			fmt.Printf("%s %s -> %s: %s\n", r.Status, r.Path, r.KeyID, r.Reason)
+		} else {
+			fmt.Printf("%s %s -> %s\n", r.Status, r.Path, r.KeyID)
+		}
+	}
+	if reportFile != "" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return &ErrorStatus{err, false}
+		}
+		if err := ioutil.WriteFile(reportFile, b, 0600); err != nil {
+			return &ErrorStatus{fmt.Errorf("Could not write report: %s", err.Error()), false}
+		}
+	}
+	if n := report.Counts[importFailed]; n > 0 {
+		return &ErrorStatus{fmt.Errorf("%d of %d secrets failed to import", n, len(report.Results)), true}
+	}
+	return nil
+}
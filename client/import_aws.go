@@ -0,0 +1,159 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func init() {
+	cmdImportAWS.Run = runImportAWS // break init cycle
+}
+
+var cmdImportAWS = &Command{
+	UsageLine: "import-aws -acls file [-path name_prefix] [-profile name] [-region region] [-field name] [-prefix key_prefix] [-report file] [-dry-run]",
+	Short:     "imports secrets from AWS Secrets Manager",
+	Long: `
+Import-aws reads the secrets in AWS Secrets Manager with the aws command line tool and creates a knox key
+for every secret whose name starts with -path. -profile and -region select the account and region as for
+the aws tool; by default its configured profile is used.
+
+The name of a secret below -path, e.g. db/password for prod/db/password with -path prod/, is mapped to a
+key identifier and matched against the ACL templates of -acls like the paths of "knox import-vault".
+
+-field is the field of the JSON object in each secret string holding the key data. Secrets that aren't a
+JSON object or don't have the field as a string are skipped. By default the whole secret string, or the
+secret binary, is the key data.
+
+-prefix, -report and -dry-run work as for "knox import-vault".
+
+This requires user authentication and the aws tool on the PATH.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox import-vault, knox import-k8s
+	`,
+}
+
+var importAWSPath = cmdImportAWS.Flag.String("path", "", "")
+var importAWSProfile = cmdImportAWS.Flag.String("profile", "", "")
+var importAWSRegion = cmdImportAWS.Flag.String("region", "", "")
+var importAWSField = cmdImportAWS.Flag.String("field", "", "")
+var importAWSACLs = cmdImportAWS.Flag.String("acls", "", "")
+var importAWSPrefix = cmdImportAWS.Flag.String("prefix", "", "")
+var importAWSReport = cmdImportAWS.Flag.String("report", "", "")
+var importAWSDryRun = cmdImportAWS.Flag.Bool("dry-run", false, "")
+
+// awsSource imports the secrets of AWS Secrets Manager below a name prefix.
+type awsSource struct {
+	path    string
+	profile string
+	region  string
+	field   string
+}
+
+func (s *awsSource) source() string {
+	return fmt.Sprintf("aws-secretsmanager:%s/%s", s.region, s.path)
+}
+
+// run runs an aws secretsmanager command and decodes its output into out.
+func (s *awsSource) run(out interface{}, args ...string) error {
+	args = append([]string{"secretsmanager"}, args...)
+	args = append(args, "--output", "json")
+	if s.profile != "" {
+		args = append(args, "--profile", s.profile)
+	}
+	if s.region != "" {
+		args = append(args, "--region", s.region)
+	}
+	b, err := runImportCLI("aws", args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("could not parse the output of aws %s: %s", args[1], err.Error())
+	}
+	return nil
+}
+
+func (s *awsSource) list() ([]string, error) {
+	args := []string{"list-secrets"}
+	if s.path != "" {
+		args = append(args, "--filters", "Key=name,Values="+s.path)
+	}
+	var resp struct {
+		SecretList []struct {
+			Name string `json:"Name"`
+		} `json:"SecretList"`
+	}
+	if err := s.run(&resp, args...); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, secret := range resp.SecretList {
+		// The name filter also matches words inside names.
+		if strings.HasPrefix(secret.Name, s.path) && secret.Name != s.path {
+			names = append(names, strings.TrimPrefix(secret.Name, s.path))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *awsSource) read(name string) ([]byte, string, error) {
+	var resp struct {
+		SecretString *string `json:"SecretString"`
+		SecretBinary string  `json:"SecretBinary"`
+	}
+	if err := s.run(&resp, "get-secret-value", "--secret-id", s.path+name); err != nil {
+		return nil, "", err
+	}
+	if resp.SecretString == nil {
+		if s.field != "" {
+			return nil, "", importSkip("the secret is binary and has no fields")
+		}
+		data, err := base64.StdEncoding.DecodeString(resp.SecretBinary)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not decode the secret binary: %s", err.Error())
+		}
+		if len(data) == 0 {
+			return nil, "", importSkip("the secret is empty")
+		}
+		return data, "", nil
+	}
+	if s.field == "" {
+		if *resp.SecretString == "" {
+			return nil, "", importSkip("the secret is empty")
+		}
+		return []byte(*resp.SecretString), "", nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(*resp.SecretString), &fields); err != nil {
+		return nil, "", importSkip("the secret is not a JSON object")
+	}
+	data, contentType, err := importField(fields, s.field)
+	if err != nil {
+		return nil, "", importSkip(err.Error())
+	}
+	return data, contentType, nil
+}
+
+func runImportAWS(cmd *Command, args []string) *ErrorStatus {
+	if *importAWSACLs == "" {
+		return &ErrorStatus{fmt.Errorf("import-aws needs -acls. See 'knox help import-aws'"), false}
+	}
+	templates, err := readImportACLTemplates(*importAWSACLs)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	src := &awsSource{
+		path:    *importAWSPath,
+		profile: *importAWSProfile,
+		region:  *importAWSRegion,
+		field:   *importAWSField,
+	}
+	opts := importOptions{prefix: *importAWSPrefix, templates: templates, dryRun: *importAWSDryRun}
+	return runImport(src, opts, *importAWSReport)
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdImportK8s.Run = runImportK8s // break init cycle
+}
+
+var cmdImportK8s = &Command{
+	UsageLine: "import-k8s -acls file [-kubeconfig file] [-context name] [-namespace ns] [-selector labels] [-prefix key_prefix] [-report file] [-dry-run]",
+	Short:     "imports Kubernetes secrets",
+	Long: `
+Import-k8s reads Kubernetes Secrets with kubectl and creates a knox key for every entry in their data.
+Secrets are read from -namespace, or from all namespaces if it is empty, and can be filtered with a label
+-selector. -kubeconfig and -context select the cluster as for kubectl; by default kubectl's current
+context is used.
+
+Each data entry is named <namespace>/<secret>/<entry>, which is mapped to a key identifier and matched
+against the ACL templates of -acls like the paths of "knox import-vault". Service account tokens and Helm
+release secrets are skipped. Entries of kubernetes.io/tls secrets are stored as PEM and the docker config
+of kubernetes.io/dockerconfigjson secrets as JSON.
+
+-prefix, -report and -dry-run work as for "knox import-vault".
+
+This requires user authentication and kubectl on the PATH.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox import-vault, knox import-aws
+	`,
+}
+
+var importK8sKubeconfig = cmdImportK8s.Flag.String("kubeconfig", "", "")
+var importK8sContext = cmdImportK8s.Flag.String("context", "", "")
+var importK8sNamespace = cmdImportK8s.Flag.String("namespace", "", "")
+var importK8sSelector = cmdImportK8s.Flag.String("selector", "", "")
+var importK8sACLs = cmdImportK8s.Flag.String("acls", "", "")
+var importK8sPrefix = cmdImportK8s.Flag.String("prefix", "", "")
+var importK8sReport = cmdImportK8s.Flag.String("report", "", "")
+var importK8sDryRun = cmdImportK8s.Flag.Bool("dry-run", false, "")
+
+// k8sSkippedTypes are the types of secrets that are managed by Kubernetes or
+// tools rather than holding application secrets.
+var k8sSkippedTypes = map[string]bool{
+	"kubernetes.io/service-account-token": true,
+	"helm.sh/release.v1":                  true,
+}
+
+// k8sSecret is the part of a Kubernetes Secret the importer reads.
+type k8sSecret struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Type string            `json:"type"`
+	Data map[string]string `json:"data"`
+}
+
+// k8sSource imports the data entries of Kubernetes Secrets.
+type k8sSource struct {
+	kubeconfig string
+	context    string
+	namespace  string
+	selector   string
+
+	// entries holds the secret of each entry once listed.
+	entries map[string]*k8sSecret
+}
+
+func (s *k8sSource) source() string {
+	ns := s.namespace
+	if ns == "" {
+		ns = "*"
+	}
+	return fmt.Sprintf("kubernetes:%s/%s", s.context, ns)
+}
+
+func (s *k8sSource) list() ([]string, error) {
+	args := []string{"get", "secrets", "-o", "json"}
+	if s.kubeconfig != "" {
+		args = append(args, "--kubeconfig", s.kubeconfig)
+	}
+	if s.context != "" {
+		args = append(args, "--context", s.context)
+	}
+	if s.namespace != "" {
+		args = append(args, "--namespace", s.namespace)
+	} else {
+		args = append(args, "--all-namespaces")
+	}
+	if s.selector != "" {
+		args = append(args, "--selector", s.selector)
+	}
+	out, err := runImportCLI("kubectl", args...)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []k8sSecret `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("could not parse the secrets from kubectl: %s", err.Error())
+	}
+	s.entries = map[string]*k8sSecret{}
+	var names []string
+	for i := range list.Items {
+		secret := &list.Items[i]
+		for entry := range secret.Data {
+			name := secret.Metadata.Namespace + "/" + secret.Metadata.Name + "/" + entry
+			s.entries[name] = secret
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *k8sSource) read(name string) ([]byte, string, error) {
+	secret, ok := s.entries[name]
+	if !ok {
+		return nil, "", fmt.Errorf("secret %s not found", name)
+	}
+	if k8sSkippedTypes[secret.Type] {
+		return nil, "", importSkip(fmt.Sprintf("secrets of type %s are not imported", secret.Type))
+	}
+	entry := name[strings.LastIndex(name, "/")+1:]
+	data, err := base64.StdEncoding.DecodeString(secret.Data[entry])
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode %s: %s", name, err.Error())
+	}
+	if len(data) == 0 {
+		return nil, "", importSkip("the entry is empty")
+	}
+	switch secret.Type {
+	case "kubernetes.io/tls":
+		return data, knox.ContentTypePEM, nil
+	case "kubernetes.io/dockerconfigjson":
+		return data, knox.ContentTypeJSON, nil
+	}
+	return data, "", nil
+}
+
+func runImportK8s(cmd *Command, args []string) *ErrorStatus {
+	if *importK8sACLs == "" {
+		return &ErrorStatus{fmt.Errorf("import-k8s needs -acls. See 'knox help import-k8s'"), false}
+	}
+	templates, err := readImportACLTemplates(*importK8sACLs)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	src := &k8sSource{
+		kubeconfig: *importK8sKubeconfig,
+		context:    *importK8sContext,
+		namespace:  *importK8sNamespace,
+		selector:   *importK8sSelector,
+	}
+	opts := importOptions{prefix: *importK8sPrefix, templates: templates, dryRun: *importK8sDryRun}
+	return runImport(src, opts, *importK8sReport)
+}
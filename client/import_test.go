@@ -0,0 +1,104 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+// fakeImportCLI replaces runImportCLI with canned outputs by command line.
+func fakeImportCLI(outputs map[string]string) func() {
+	orig := runImportCLI
+	runImportCLI = func(name string, args ...string) ([]byte, error) {
+		line := name + " " + strings.Join(args, " ")
+		out, ok := outputs[line]
+		if !ok {
+			return nil, fmt.Errorf("unexpected command %s", line)
+		}
+		return []byte(out), nil
+	}
+	return func() { runImportCLI = orig }
+}
+
+func importStatuses(report *importReport) map[string]string {
+	got := map[string]string{}
+	for _, r := range report.Results {
+		got[r.Path] = r.Status + " " + r.KeyID
+	}
+	return got
+}
+
+func TestImportK8s(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	defer fakeImportCLI(map[string]string{
+		"kubectl get secrets -o json --context prod --all-namespaces": `{"items": [
+			{"metadata": {"name": "db", "namespace": "web"}, "type": "Opaque", "data": {"password": "` + b64([]byte("hunter2")) + `", "empty": ""}},
+			{"metadata": {"name": "cert", "namespace": "web"}, "type": "kubernetes.io/tls", "data": {"tls.key": "` + b64([]byte("-----BEGIN KEY-----")) + `"}},
+			{"metadata": {"name": "default-token", "namespace": "web"}, "type": "kubernetes.io/service-account-token", "data": {"token": "` + b64([]byte("t")) + `"}}
+		]}`,
+	})()
+	c := &importClient{keys: map[string][]byte{}, created: map[string]knox.ACL{}}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: "web", AccessType: knox.Read}}
+	src := &k8sSource{context: "prod"}
+	report, err := importSecrets(c, src, importOptions{prefix: "k8s:", templates: []importACLTemplate{{Prefix: "web/", ACL: acl}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"web/cert/tls.key":        "created k8s:web:cert:tls_key",
+		"web/db/empty":            "skipped k8s:web:db:empty",
+		"web/db/password":         "created k8s:web:db:password",
+		"web/default-token/token": "skipped k8s:web:default_token:token",
+	}
+	got := importStatuses(report)
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for p, s := range expected {
+		if got[p] != s {
+			t.Fatalf("Expected %s for %s, got %q", s, p, got[p])
+		}
+	}
+	if string(c.keys["k8s:web:db:password"]) != "hunter2" {
+		t.Fatalf("Expected the decoded entry as key data, got %q", c.keys["k8s:web:db:password"])
+	}
+}
+
+func TestImportAWS(t *testing.T) {
+	suffix := " --output json --region us-east-1"
+	defer fakeImportCLI(map[string]string{
+		"aws secretsmanager list-secrets --filters Key=name,Values=prod/" + suffix: `{"SecretList": [
+			{"Name": "prod/db"}, {"Name": "prod/api/token"}, {"Name": "prod/plain"}, {"Name": "staging/prod/db"}
+		]}`,
+		"aws secretsmanager get-secret-value --secret-id prod/db" + suffix:        `{"SecretString": "{\"password\": \"hunter2\"}"}`,
+		"aws secretsmanager get-secret-value --secret-id prod/api/token" + suffix: `{"SecretString": "{\"password\": 42}"}`,
+		"aws secretsmanager get-secret-value --secret-id prod/plain" + suffix:     `{"SecretString": "not json"}`,
+	})()
+	c := &importClient{keys: map[string][]byte{}, created: map[string]knox.ACL{}}
+	acl := knox.ACL{{Type: knox.UserGroup, ID: "prod", AccessType: knox.Read}}
+	src := &awsSource{path: "prod/", region: "us-east-1", field: "password"}
+	report, err := importSecrets(c, src, importOptions{prefix: "aws:", templates: []importACLTemplate{{ACL: acl}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := importStatuses(report)
+	expected := map[string]string{
+		"api/token": "skipped aws:api:token",
+		"db":        "created aws:db",
+		"plain":     "skipped aws:plain",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for p, s := range expected {
+		if got[p] != s {
+			t.Fatalf("Expected %s for %s, got %q", s, p, got[p])
+		}
+	}
+	if string(c.keys["aws:db"]) != "hunter2" {
+		t.Fatalf("Expected the field as key data, got %q", c.keys["aws:db"])
+	}
+}
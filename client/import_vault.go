@@ -0,0 +1,231 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdImportVault.Run = runImportVault // break init cycle
+}
+
+var cmdImportVault = &Command{
+	UsageLine: "import-vault -addr url -path mount/[prefix/] -acls file [-kv-version n] [-field name] [-prefix key_prefix] [-report file] [-dry-run]",
+	Short:     "imports secrets from a Vault KV mount",
+	Long: `
+Import-vault walks a Vault KV secrets engine under -path and creates a knox key for every secret found.
+The first component of -path is the mount, e.g. secret/ or secret/team-a/. The Vault token is read from
+VAULT_TOKEN, and -addr defaults to VAULT_ADDR.
+
+The key identifier of a secret is -prefix followed by its path below -path, with / replaced by : and
+- and . replaced by _. Secrets whose path maps to an invalid or already used identifier are skipped.
+
+-acls is a file with a JSON list of ACL templates, e.g.
+  [{"prefix": "team-a/", "acl": [{"type": "UserGroup", "id": "team-a", "access": "Admin"}]}]
+Each secret gets the ACL of the template with the longest prefix of its path, in the format of
+"knox access -acl". Secrets without a template are skipped. As with "knox create", you are also given
+access to every key.
+
+-kv-version is the version of the KV secrets engine, 1 or 2 (default 2).
+-field is the field of each secret holding the key data (default "value"). Secrets without the field, or
+where it isn't a string, are skipped. With -field "" the whole secret is stored as JSON.
+-report writes the reconciliation report as JSON to a file, listing for every secret its key identifier
+and whether the key was created, already held the same data, held different data, was skipped or
+failed. Keys that exist already are never changed.
+-dry-run checks every secret and writes the report without creating keys.
+
+This requires user authentication.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox create, knox access
+	`,
+}
+
+var importVaultAddr = cmdImportVault.Flag.String("addr", os.Getenv("VAULT_ADDR"), "")
+var importVaultPath = cmdImportVault.Flag.String("path", "", "")
+var importVaultACLs = cmdImportVault.Flag.String("acls", "", "")
+var importVaultKVVersion = cmdImportVault.Flag.Int("kv-version", 2, "")
+var importVaultField = cmdImportVault.Flag.String("field", "value", "")
+var importVaultPrefix = cmdImportVault.Flag.String("prefix", "", "")
+var importVaultReport = cmdImportVault.Flag.String("report", "", "")
+var importVaultDryRun = cmdImportVault.Flag.Bool("dry-run", false, "")
+
+// vaultKV reads secrets from a Vault KV secrets engine over its HTTP API.
+type vaultKV struct {
+	addr    string
+	token   string
+	mount   string
+	version int
+	client  knox.HTTP
+}
+
+// apiPath returns the API path of a secret or directory in the mount.
+func (v *vaultKV) apiPath(kind, p string) string {
+	if v.version == 1 {
+		return "/v1/" + v.mount + "/" + p
+	}
+	return "/v1/" + v.mount + "/" + kind + "/" + p
+}
+
+func (v *vaultKV) get(apiPath string, query url.Values, out interface{}) (bool, error) {
+	u := strings.TrimSuffix(v.addr, "/") + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("vault returned %s for %s: %s", resp.Status, apiPath, strings.TrimSpace(string(b)))
+	}
+	return true, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list returns the entries of a directory in the mount. Subdirectories end
+// with /.
+func (v *vaultKV) list(dir string) ([]string, error) {
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	_, err := v.get(v.apiPath("metadata", dir), url.Values{"list": {"true"}}, &resp)
+	return resp.Data.Keys, err
+}
+
+// read returns the data of the latest version of a secret.
+func (v *vaultKV) read(p string) (map[string]interface{}, error) {
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	found, err := v.get(v.apiPath("data", p), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("secret %s not found", p)
+	}
+	var data map[string]interface{}
+	if v.version == 1 {
+		err = json.Unmarshal(resp.Data, &data)
+		return data, err
+	}
+	var v2 struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Data, &v2); err != nil {
+		return nil, err
+	}
+	if v2.Data == nil {
+		return nil, fmt.Errorf("the latest version of %s is deleted", p)
+	}
+	return v2.Data, nil
+}
+
+// walk returns the paths of the secrets below dir, sorted.
+func (v *vaultKV) walk(dir string) ([]string, error) {
+	entries, err := v.list(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if !strings.HasSuffix(e, "/") {
+			paths = append(paths, dir+e)
+			continue
+		}
+		sub, err := v.walk(dir + e)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, sub...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// vaultSource imports the secrets below a directory of a KV mount.
+type vaultSource struct {
+	kv    *vaultKV
+	root  string
+	field string
+}
+
+func (s *vaultSource) source() string {
+	return "vault:" + s.kv.mount + "/" + s.root
+}
+
+func (s *vaultSource) list() ([]string, error) {
+	paths, err := s.kv.walk(s.root)
+	if err != nil {
+		return nil, err
+	}
+	for i := range paths {
+		paths[i] = strings.TrimPrefix(paths[i], s.root)
+	}
+	return paths, nil
+}
+
+func (s *vaultSource) read(name string) ([]byte, string, error) {
+	secret, err := s.kv.read(s.root + name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, contentType, err := importField(secret, s.field)
+	if err != nil {
+		return nil, "", importSkip(err.Error())
+	}
+	return data, contentType, nil
+}
+
+func runImportVault(cmd *Command, args []string) *ErrorStatus {
+	if *importVaultAddr == "" || *importVaultPath == "" || *importVaultACLs == "" {
+		return &ErrorStatus{fmt.Errorf("import-vault needs -addr, -path and -acls. See 'knox help import-vault'"), false}
+	}
+	if *importVaultKVVersion != 1 && *importVaultKVVersion != 2 {
+		return &ErrorStatus{fmt.Errorf("-kv-version must be 1 or 2"), false}
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return &ErrorStatus{fmt.Errorf("Set VAULT_TOKEN to a token that can list and read the secrets"), false}
+	}
+	templates, err := readImportACLTemplates(*importVaultACLs)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	mount, root, _ := strings.Cut(strings.Trim(*importVaultPath, "/"), "/")
+	if root != "" {
+		root += "/"
+	}
+	v := &vaultKV{
+		addr:    *importVaultAddr,
+		token:   token,
+		mount:   mount,
+		version: *importVaultKVVersion,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	src := &vaultSource{kv: v, root: root, field: *importVaultField}
+	opts := importOptions{prefix: *importVaultPrefix, templates: templates, dryRun: *importVaultDryRun}
+	return runImport(src, opts, *importVaultReport)
+}
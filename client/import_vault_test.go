@@ -0,0 +1,127 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+// importClient records created keys and serves existing ones.
+type importClient struct {
+	knox.APIClient
+	keys    map[string][]byte
+	created map[string]knox.ACL
+}
+
+func (c *importClient) NetworkGetKey(keyID string) (*knox.Key, error) {
+	if data, ok := c.keys[keyID]; ok {
+		return &knox.Key{ID: keyID, VersionList: knox.KeyVersionList{{ID: 1, Data: data, Status: knox.Primary}}}, nil
+	}
+	return nil, &knox.APIError{Code: knox.KeyIdentifierDoesNotExistCode, Message: "no such key"}
+}
+
+func (c *importClient) CreateKeyWithContentType(keyID string, data []byte, acl knox.ACL, contentType string) (uint64, error) {
+	c.keys[keyID] = data
+	c.created[keyID] = acl
+	return 1, nil
+}
+
+// fakeVault serves a KV v2 mount named secret.
+func fakeVault(t *testing.T, dirs map[string][]string, secrets map[string]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if p := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/"); p != r.URL.Path && r.URL.Query().Get("list") == "true" {
+			keys, ok := dirs[p]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+			return
+		}
+		if p := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/"); p != r.URL.Path {
+			data, ok := secrets[p]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data}})
+			return
+		}
+		t.Errorf("Unexpected request %s", r.URL)
+	}))
+}
+
+func TestVaultImport(t *testing.T) {
+	srv := fakeVault(t, map[string][]string{
+		"apps/":       {"db-password", "web/", "other/", "bad!name", "number"},
+		"apps/web/":   {"tls.key", "same"},
+		"apps/other/": {"token"},
+	}, map[string]map[string]interface{}{
+		"apps/db-password": {"value": "hunter2"},
+		"apps/web/tls.key": {"value": "-----BEGIN KEY-----"},
+		"apps/web/same":    {"value": "unchanged"},
+		"apps/other/token": {"value": "t"},
+		"apps/number":      {"value": 42},
+	})
+	defer srv.Close()
+	v := &vaultKV{addr: srv.URL, token: "token", mount: "secret", version: 2, client: http.DefaultClient}
+	admin := knox.ACL{{Type: knox.UserGroup, ID: "web-team", AccessType: knox.Admin}}
+	templates := []importACLTemplate{
+		{Prefix: "", ACL: knox.ACL{{Type: knox.UserGroup, ID: "apps", AccessType: knox.Read}}},
+		{Prefix: "web/", ACL: admin},
+	}
+	c := &importClient{keys: map[string][]byte{"vault:web:same": []byte("unchanged")}, created: map[string]knox.ACL{}}
+
+	src := &vaultSource{kv: v, root: "apps/", field: "value"}
+	report, err := importSecrets(c, src, importOptions{prefix: "vault:", templates: templates[1:], dryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.created) != 0 || report.Counts[importPlanned] != 1 || report.Counts[importMatches] != 1 {
+		t.Fatalf("Expected a dry run to only plan the web key, got %+v", report)
+	}
+
+	report, err = importSecrets(c, src, importOptions{prefix: "vault:", templates: templates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, r := range report.Results {
+		got[r.Path] = r.Status + " " + r.KeyID
+	}
+	expected := map[string]string{
+		"bad!name":    "skipped ",
+		"db-password": "created vault:db_password",
+		"number":      "skipped vault:number",
+		"other/token": "created vault:other:token",
+		"web/same":    "matches vault:web:same",
+		"web/tls.key": "created vault:web:tls_key",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for p, s := range expected {
+		if got[p] != s {
+			t.Fatalf("Expected %s for %s, got %q", s, p, got[p])
+		}
+	}
+	if acl := c.created["vault:web:tls_key"]; len(acl) != 1 || acl[0].ID != "web-team" {
+		t.Fatalf("Expected the ACL of the longest prefix, got %v", acl)
+	}
+	if string(c.keys["vault:db_password"]) != "hunter2" {
+		t.Fatalf("Expected the value field as key data, got %q", c.keys["vault:db_password"])
+	}
+
+	v.token = "wrong"
+	if _, err := importSecrets(c, src, importOptions{prefix: "vault:", templates: templates}); err == nil {
+		t.Fatal("Expected an error listing secrets without access")
+	}
+}
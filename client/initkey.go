@@ -0,0 +1,366 @@
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func init() {
+	cmdInitKey.Run = runInitKey // break init cycle
+}
+
+var cmdInitKey = &Command{
+	UsageLine: "init-key [--team team] [--env environment] [--rotation policy] [--acl-template template --principal id] [--admin-group group] [--data source] [--yes] [<key_identifier>]",
+	Short:     "creates a new key step by step",
+	Long: `
+Init-key creates a key for a new service, asking for everything a key should be set up with that
+"knox create" leaves to later commands. Settings given as flags are not asked for, so the key can also
+be created from a script; without a terminal every setting must be given.
+
+The team and env options are recorded in the key's team and environment metadata, so the key can be
+found with knox search.
+
+The rotation option is how new versions of the key are made: "manual" to add them with knox add,
+"random:<bytes>" for random data or "tink:<template>" for a Tink key template, see knox key-templates.
+The last two let the key be rotated with knox rotate. The grace-window option sets how long consumers
+keep accepting the previous primary after a rotation.
+
+The acl-template option grants Read access to the principal that consumes the key:
+` + aclTemplateHelp() + `
+The admin-group option also grants Admin access to a user group, so the key doesn't depend on its creator.
+
+The data option is where the first version comes from: "prompt" to type it without echo, "stdin",
+"file:<path>" or "generate" to make it as the rotation policy does.
+
+Once the key is created, init-key prints how to use it from a knox daemon and from Go.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox create, knox tag, knox access, knox rotate
+	`,
+}
+
+var initKeyTeam = cmdInitKey.Flag.String("team", "", "team that owns the key")
+var initKeyEnv = cmdInitKey.Flag.String("env", "", "environment the key is used in, e.g. prod")
+var initKeyRotation = cmdInitKey.Flag.String("rotation", "", "manual, random:<bytes> or tink:<template>")
+var initKeyGraceWindow = cmdInitKey.Flag.Duration("grace-window", 0, "time consumers accept the previous primary after a rotation")
+var initKeyACLTemplate = cmdInitKey.Flag.String("acl-template", "", "kind of principal that reads the key")
+var initKeyPrincipal = cmdInitKey.Flag.String("principal", "", "principal granted Read access by the ACL template")
+var initKeyAdminGroup = cmdInitKey.Flag.String("admin-group", "", "user group granted Admin access")
+var initKeyData = cmdInitKey.Flag.String("data", "", "prompt, stdin, file:<path> or generate")
+var initKeyYes = cmdInitKey.Flag.Bool("yes", false, "create the key without asking for confirmation")
+
+// Metadata entries recording who owns a key created with init-key.
+const (
+	metadataTeam        = "team"
+	metadataEnvironment = "environment"
+)
+
+// aclTemplates are the kinds of principals init-key can grant Read access.
+var aclTemplates = map[string]knox.PrincipalType{
+	"machine-prefix": knox.MachinePrefix,
+	"service":        knox.Service,
+	"service-prefix": knox.ServicePrefix,
+	"user-group":     knox.UserGroup,
+}
+
+var aclTemplateExamples = map[string]string{
+	"machine-prefix": "a hostname prefix, e.g. web-",
+	"service":        "a SPIFFE ID, e.g. spiffe://example.com/web",
+	"service-prefix": "a SPIFFE ID prefix, e.g. spiffe://example.com/web/",
+	"user-group":     "a user group, e.g. web-eng",
+}
+
+func aclTemplateHelp() string {
+	names := make([]string, 0, len(aclTemplates))
+	for name := range aclTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %-15s the principal is %s\n", name, aclTemplateExamples[name])
+	}
+	fmt.Fprintf(&b, "  %-15s only the creator has access\n", "none")
+	return b.String()
+}
+
+// keyIDPattern matches the key identifiers the server accepts.
+var keyIDPattern = regexp.MustCompile("^[a-zA-Z0-9_:]+$")
+
+// keyPlan is what init-key creates.
+type keyPlan struct {
+	ID          string
+	Team        string
+	Environment string
+	Rotation    string
+	GraceWindow time.Duration
+	ACLTemplate string
+	Principal   string
+	AdminGroup  string
+	DataSource  string
+}
+
+// checkRotation validates a rotation policy.
+func checkRotation(keyID, rotation string) error {
+	name, spec, _ := strings.Cut(rotation, ":")
+	switch name {
+	case "manual":
+		if spec == "" {
+			return nil
+		}
+	case "random":
+		if n, err := strconv.Atoi(spec); err == nil && n > 0 && n <= 1024 {
+			return nil
+		}
+		return fmt.Errorf("random rotation needs a size between 1 and 1024 bytes, e.g. random:32")
+	case "tink":
+		return tink.CheckKeyID(spec, keyID)
+	}
+	return fmt.Errorf("rotation must be manual, random:<bytes> or tink:<template>")
+}
+
+// acl returns the ACL the plan's template grants.
+func (p *keyPlan) acl() (knox.ACL, error) {
+	acl := knox.ACL{}
+	if p.ACLTemplate != "none" {
+		t, ok := aclTemplates[p.ACLTemplate]
+		if !ok {
+			return nil, fmt.Errorf("unknown ACL template %q", p.ACLTemplate)
+		}
+		if err := t.IsValidPrincipal(p.Principal, nil); err != nil {
+			return nil, err
+		}
+		acl = append(acl, knox.Access{Type: t, ID: p.Principal, AccessType: knox.Read})
+	}
+	if p.AdminGroup != "" {
+		acl = append(acl, knox.Access{Type: knox.UserGroup, ID: p.AdminGroup, AccessType: knox.Admin})
+	}
+	return acl, acl.Validate()
+}
+
+// metadata returns the metadata of the new key.
+func (p *keyPlan) metadata() knox.KeyMetadata {
+	md := knox.KeyMetadata{
+		metadataTeam:        p.Team,
+		metadataEnvironment: p.Environment,
+	}
+	if p.Rotation != "manual" {
+		md[knox.MetadataGenerator] = p.Rotation
+	}
+	if p.GraceWindow > 0 {
+		md[knox.MetadataGraceWindow] = p.GraceWindow.String()
+	}
+	return md
+}
+
+// data returns the first version of the key and its content type.
+func (p *keyPlan) data() ([]byte, string, error) {
+	name, spec, _ := strings.Cut(p.Rotation, ":")
+	source, path, _ := strings.Cut(p.DataSource, ":")
+	switch {
+	case source == "generate" && name == "random":
+		n, _ := strconv.Atoi(spec)
+		data := make([]byte, n)
+		_, err := rand.Read(data)
+		return data, "", err
+	case source == "generate" && name == "tink":
+		data, err := tink.NewKeyset(spec, "")
+		return data, tink.ContentType(""), err
+	case source == "generate":
+		return nil, "", fmt.Errorf("generate needs a random or tink rotation policy")
+	case source == "prompt":
+		fmt.Fprint(os.Stderr, "Key data: ")
+		data, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return data, "", err
+	case source == "stdin":
+		data, err := readDataFromStdin()
+		return data, "", err
+	case source == "file" && path != "":
+		data, err := os.ReadFile(path)
+		return data, "", err
+	}
+	return nil, "", fmt.Errorf("data must be prompt, stdin, file:<path> or generate")
+}
+
+// consumptionSnippets shows how services use a key.
+func consumptionSnippets(keyID string) string {
+	return fmt.Sprintf(`To keep the key on a machine with the knox daemon:
+
+    knox register -k %[1]s
+
+To use it from Go:
+
+    client, err := knox.NewFileClient(%[1]q)
+    if err != nil {
+        return err
+    }
+    secret := client.GetPrimary()
+`, keyID)
+}
+
+// prompter asks for the settings missing from the flags.
+type prompter struct {
+	in          *bufio.Reader
+	interactive bool
+}
+
+// ask returns value, the value of the named flag, if set and otherwise asks
+// the question until check accepts the answer.
+func (p *prompter) ask(question, flagName, value, def string, check func(string) error) (string, error) {
+	if value != "" {
+		return value, check(value)
+	}
+	if !p.interactive {
+		if def != "" {
+			return def, check(def)
+		}
+		return "", fmt.Errorf("%s must be given without a terminal. See 'knox help init-key'", flagName)
+	}
+	for {
+		if def != "" {
+			fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: ", question)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if checkErr := check(answer); checkErr != nil {
+			if err == io.EOF {
+				return "", checkErr
+			}
+			fmt.Fprintln(os.Stderr, checkErr)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+func required(s string) error {
+	if s == "" {
+		return fmt.Errorf("an answer is required")
+	}
+	return nil
+}
+
+func metadataValue(s string) error {
+	if strings.ContainsAny(s, " \t") || s == "" {
+		return fmt.Errorf("use a single word")
+	}
+	return nil
+}
+
+func runInitKey(cmd *Command, args []string) *ErrorStatus {
+	if len(args) > 1 {
+		return &ErrorStatus{fmt.Errorf("init-key takes at most one argument. See 'knox help init-key'"), false}
+	}
+	var keyID string
+	if len(args) == 1 {
+		keyID = args[0]
+	}
+	pr := &prompter{in: bufio.NewReader(os.Stdin), interactive: terminal.IsTerminal(int(os.Stdin.Fd()))}
+
+	p := &keyPlan{GraceWindow: *initKeyGraceWindow, AdminGroup: *initKeyAdminGroup}
+	var err error
+	ask := func(dst *string, question, flagName, value, def string, check func(string) error) {
+		if err == nil {
+			*dst, err = pr.ask(question, flagName, value, def, check)
+		}
+	}
+	ask(&p.ID, "Key identifier", "<key_identifier>", keyID, "", func(s string) error {
+		if !keyIDPattern.MatchString(s) {
+			return knox.ErrInvalidKeyID
+		}
+		return nil
+	})
+	ask(&p.Team, "Team", "--team", *initKeyTeam, "", metadataValue)
+	ask(&p.Environment, "Environment", "--env", *initKeyEnv, "", metadataValue)
+	ask(&p.Rotation, "Rotation (manual, random:<bytes>, tink:<template>)", "--rotation", *initKeyRotation, "manual", func(s string) error {
+		return checkRotation(p.ID, s)
+	})
+	ask(&p.ACLTemplate, "ACL template (machine-prefix, service, service-prefix, user-group, none)", "--acl-template", *initKeyACLTemplate, "", func(s string) error {
+		if _, ok := aclTemplates[s]; !ok && s != "none" {
+			return fmt.Errorf("unknown ACL template %q", s)
+		}
+		return nil
+	})
+	if err == nil && p.ACLTemplate != "none" {
+		ask(&p.Principal, "Principal reading the key", "--principal", *initKeyPrincipal, "", func(s string) error {
+			return aclTemplates[p.ACLTemplate].IsValidPrincipal(s, nil)
+		})
+	}
+	defData := "prompt"
+	if p.Rotation != "manual" {
+		defData = "generate"
+	}
+	ask(&p.DataSource, "Data (prompt, stdin, file:<path>, generate)", "--data", *initKeyData, defData, required)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	acl, err := p.acl()
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	md := p.metadata()
+
+	fmt.Fprintf(os.Stderr, "\nKey %s\n", p.ID)
+	names := make([]string, 0, len(md))
+	for k := range md {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", k, md[k])
+	}
+	for _, a := range acl {
+		aEnc, _ := json.Marshal(a)
+		fmt.Fprintf(os.Stderr, "  %s\n", aEnc)
+	}
+	if !*initKeyYes && pr.interactive {
+		var ok string
+		if ok, err = pr.ask("Create it? (yes/no)", "--yes", "", "no", required); err != nil {
+			return &ErrorStatus{err, false}
+		}
+		if ok != "yes" && ok != "y" {
+			return &ErrorStatus{fmt.Errorf("key not created"), false}
+		}
+	}
+
+	data, contentType, err := p.data()
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	if err := validateContent(contentType, data); err != nil {
+		return &ErrorStatus{err, false}
+	}
+	versionID, err := cli.CreateKeyWithContentType(p.ID, data, acl, contentType)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error creating key: %s", err.Error()), true}
+	}
+	if err := cli.UpdateMetadata(p.ID, md); err != nil {
+		return &ErrorStatus{fmt.Errorf("Created key with initial version %d but failed to set its metadata: %s", versionID, err.Error()), true}
+	}
+	fmt.Printf("Created key with initial version %d\n\n", versionID)
+	fmt.Print(consumptionSnippets(p.ID))
+	return nil
+}
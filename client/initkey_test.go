@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestKeyPlan(t *testing.T) {
+	p := &keyPlan{
+		ID:          "web:db_password",
+		Team:        "web",
+		Environment: "prod",
+		Rotation:    "random:16",
+		GraceWindow: time.Hour,
+		ACLTemplate: "machine-prefix",
+		Principal:   "web-",
+		AdminGroup:  "web-eng",
+		DataSource:  "generate",
+	}
+	acl, err := p.acl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := knox.ACL{
+		{Type: knox.MachinePrefix, ID: "web-", AccessType: knox.Read},
+		{Type: knox.UserGroup, ID: "web-eng", AccessType: knox.Admin},
+	}
+	if len(acl) != len(want) || acl[0] != want[0] || acl[1] != want[1] {
+		t.Fatalf("Unexpected ACL %+v", acl)
+	}
+	md := p.metadata()
+	if md["team"] != "web" || md["environment"] != "prod" || md[knox.MetadataGenerator] != "random:16" || md[knox.MetadataGraceWindow] != "1h0m0s" {
+		t.Fatalf("Unexpected metadata %+v", md)
+	}
+	data, _, err := p.data()
+	if err != nil || len(data) != 16 {
+		t.Fatalf("Expected 16 random bytes, got %d and %v", len(data), err)
+	}
+
+	p.Rotation = "manual"
+	if _, ok := p.metadata()[knox.MetadataGenerator]; ok {
+		t.Fatal("Expected manually rotated keys to have no generator")
+	}
+	if _, _, err := p.data(); err == nil {
+		t.Fatal("Expected generate to need a generator")
+	}
+	p.ACLTemplate, p.Principal = "service", "not-spiffe"
+	if _, err := p.acl(); err == nil {
+		t.Fatal("Expected an invalid principal to be rejected")
+	}
+
+	for _, r := range []string{"random", "random:0", "manual:1", "other:1", "tink:UNKNOWN"} {
+		if checkRotation("id", r) == nil {
+			t.Fatalf("Expected rotation %q to be rejected", r)
+		}
+	}
+	if !strings.Contains(consumptionSnippets("web:db_password"), `knox.NewFileClient("web:db_password")`) {
+		t.Fatal("Expected a Go snippet for the key")
+	}
+}
+
+func TestPrompter(t *testing.T) {
+	pr := &prompter{in: bufio.NewReader(strings.NewReader("bad value\n\nprod\n")), interactive: true}
+	answer, err := pr.ask("Environment", "--env", "", "", metadataValue)
+	if err != nil || answer != "prod" {
+		t.Fatalf("Expected invalid and empty answers to be asked again, got %q and %v", answer, err)
+	}
+	if answer, _ := pr.ask("Rotation", "--rotation", "", "manual", required); answer != "manual" {
+		t.Fatalf("Expected the default at the end of input, got %q", answer)
+	}
+
+	pr = &prompter{interactive: false}
+	if answer, err := pr.ask("Team", "--team", "web", "", metadataValue); err != nil || answer != "web" {
+		t.Fatalf("Expected the flag value, got %q and %v", answer, err)
+	}
+	if _, err := pr.ask("Team", "--team", "", "", metadataValue); err == nil {
+		t.Fatal("Expected a missing flag to be an error without a terminal")
+	}
+}
@@ -2,6 +2,9 @@ package client
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox/tink"
 )
 
 var cmdListKeyTemplates = &Command{
@@ -9,12 +12,13 @@ var cmdListKeyTemplates = &Command{
 	UsageLine: "key-templates",
 	Short:     "Lists the supported tink key templates",
 	Long: `
-	Lists the supported tink key templates.
+	Lists the supported tink key templates, including the templates registered by this knox
+	binary, e.g. from the file named by KNOX_TINK_TEMPLATES in the dev client.
 `,
 }
 
 func runListKeyTemplates(cmd *Command, args []string) *ErrorStatus {
 	fmt.Println("The following tink key templates are supported:")
-	fmt.Println(nameOfSupportedTinkKeyTemplates())
+	fmt.Println(strings.Join(tink.KeyTemplateNames(), "\n"))
 	return nil
 }
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"fmt"
+)
+
+func init() {
+	cmdLock.Run = runLock // break init cycle
+}
+
+var cmdLock = &Command{
+	UsageLine: "lock [-m message] <key_identifier>",
+	Short:     "locks a key so that it cannot be read",
+	Long: `
+Lock immediately makes every read of the key fail with the given message. It is
+meant for incident response while a compromised key is being rotated.
+
+Keys already cached on machines by knox daemon are not removed.
+
+-m sets the message returned to clients that try to read the key.
+
+This requires admin access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox unlock, knox add, knox promote
+	`,
+}
+
+var lockMessage = cmdLock.Flag.String("m", "", "")
+
+func runLock(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("lock takes only one argument. See 'knox help lock'"), false}
+	}
+	err := cli.LockKey(args[0], *lockMessage)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error locking key: %s", err.Error()), true}
+	}
+	fmt.Printf("Locked key %s\n", args[0])
+	return nil
+}
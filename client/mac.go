@@ -0,0 +1,128 @@
+package client
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/tink/go/mac"
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
+
+	tinkgo "github.com/google/tink/go/tink"
+)
+
+func init() {
+	cmdMAC.Run = runMAC // break init cycle
+}
+
+var cmdMAC = &Command{
+	UsageLine:   "mac compute [-in file] [-n] <key_identifier> | verify [-in file] [-n] <key_identifier> <tag>",
+	Short:       "computes and verifies MACs with Tink keysets",
+	CustomFlags: true,
+	Long: `
+Mac computes and verifies message authentication codes with the Tink MAC keyset stored in a knox
+key, e.g. one created with "knox create --key-template TINK_MAC_HMAC_SHA512_256BITTAG tink:mac:<name>".
+The keyset is made of the key's primary and active versions, as with "knox get --tink-keyset".
+
+mac compute prints the base64 encoded tag of the data, computed with the primary version.
+
+mac verify checks a base64 encoded tag against the data with every version in the keyset, so tags
+computed before a rotation still verify. It fails if the tag is not valid.
+
+-in reads the data from a file instead of stdin.
+-n forces a network call instead of using the daemon's cache.
+
+This requires read access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox get, knox create, knox key-templates
+	`,
+}
+
+func runMAC(cmd *Command, args []string) *ErrorStatus {
+	if len(args) == 0 {
+		return &ErrorStatus{fmt.Errorf("mac needs an operation. See 'knox help mac'"), false}
+	}
+	op := args[0]
+	if op != "compute" && op != "verify" {
+		return &ErrorStatus{fmt.Errorf("Unknown mac operation %q. See 'knox help mac'", op), false}
+	}
+	fs := flag.NewFlagSet("mac "+op, flag.ContinueOnError)
+	in := fs.String("in", "", "")
+	network := fs.Bool("n", false, "")
+	nargs := 1
+	if op == "verify" {
+		nargs = 2
+	}
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != nargs {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help mac'"), false}
+	}
+	keyID := fs.Arg(0)
+	if !tink.IsKeysetID(keyID) {
+		return &ErrorStatus{fmt.Errorf("this knox identifier is not for tink keyset"), false}
+	}
+	var data []byte
+	var err error
+	if *in != "" {
+		data, err = ioutil.ReadFile(*in)
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Failed to read data: %s", err.Error()), false}
+	}
+	var key *knox.Key
+	if *network {
+		key, err = cli.NetworkGetKey(keyID)
+	} else {
+		key, err = cli.GetKey(keyID)
+	}
+	if err != nil {
+		failureGetKeyMetric(keyID, err)
+		return &ErrorStatus{fmt.Errorf("error getting key: %s", err.Error()), true}
+	}
+	successGetKeyMetric(keyID)
+	m, err := tinkMAC(key)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+
+	if op == "compute" {
+		tag, err := m.ComputeMAC(data)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("Failed to compute MAC: %s", err.Error()), false}
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(tag))
+		return nil
+	}
+	tag, err := base64.StdEncoding.DecodeString(fs.Arg(1))
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Invalid tag: %s", err.Error()), false}
+	}
+	if err := m.VerifyMAC(tag, data); err != nil {
+		return &ErrorStatus{fmt.Errorf("MAC verification failed"), false}
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// tinkMAC returns the MAC primitive of the Tink keyset stored in key.
+func tinkMAC(key *knox.Key) (tinkgo.MAC, error) {
+	kekURI := key.Metadata[knox.MetadataTinkKMSKeyURI]
+	if err := tink.ValidateVersions(key.VersionList, kekURI); err != nil {
+		return nil, fmt.Errorf("invalid tink keyset for %s: %s", key.ID, err.Error())
+	}
+	keysetHandle, err := tink.HandleFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mac.New(keysetHandle)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a tink MAC keyset: %s", key.ID, err.Error())
+	}
+	return m, nil
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
+)
+
+func TestTinkMAC(t *testing.T) {
+	key := &knox.Key{ID: "tink:mac:test"}
+	for i, status := range []knox.VersionStatus{knox.Primary, knox.Active} {
+		data, err := tink.NextKeyset("TINK_MAC_HMAC_SHA512_256BITTAG", key.VersionList, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key.VersionList = append(key.VersionList, knox.KeyVersion{ID: uint64(i + 1), Data: data, Status: status})
+	}
+	m, err := tinkMAC(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tag, err := m.ComputeMAC([]byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyMAC(tag, []byte("message")); err != nil {
+		t.Fatalf("unexpected error verifying tag: %v", err)
+	}
+
+	// Tags made with the old primary version still verify after a rotation.
+	key.VersionList[0].Status, key.VersionList[1].Status = knox.Active, knox.Primary
+	rotated, err := tinkMAC(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotated.VerifyMAC(tag, []byte("message")); err != nil {
+		t.Fatalf("unexpected error verifying tag after rotation: %v", err)
+	}
+	if err := rotated.VerifyMAC(tag, []byte("other message")); err == nil {
+		t.Fatal("expected error verifying tag of other data")
+	}
+
+	aeadKey := &knox.Key{ID: "tink:aead:test"}
+	data, err := tink.NewKeyset("TINK_AEAD_AES256_GCM", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aeadKey.VersionList = knox.KeyVersionList{{ID: 1, Data: data, Status: knox.Primary}}
+	if _, err := tinkMAC(aeadKey); err == nil {
+		t.Fatal("expected error for an AEAD keyset")
+	}
+}
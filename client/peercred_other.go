@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+)
+
+const peerCredentialsSupported = false
+
+func peerCredentials(c net.Conn) (*peerCred, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdPrewarm.Run = runPrewarm // break init cycle
+}
+
+var cmdPrewarm = &Command{
+	UsageLine: "prewarm -manifest <manifest_file> [-timeout duration] [-json]",
+	Short:     "makes hosts cache keys before a deploy",
+	Long: `
+Prewarm asks the knox daemons on a set of hosts to cache keys, then waits until every host has the
+current version of every key and prints the readiness of each host. Deploy systems run it before
+sending traffic to new hosts, so they don't start serving before their secrets are local.
+
+The manifest is a JSON document (which is also valid YAML):
+
+	{"hosts": ["web-001.example.com", "web-002.example.com"],
+	 "keys": ["service:db", "service:api_token"]}
+
+Daemons pick up the request the next time they sync, and register the keys as if 'knox register'
+had been run on the host. Hosts only get keys their ACLs allow; the keys a host is denied are
+reported and the host never becomes ready.
+
+-manifest specifies the manifest file.
+-timeout sets how long to wait for the hosts to be ready (default 5m). 0 prints the request ID
+without waiting.
+-json prints the final state as JSON.
+
+This requires user or service authentication.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox register, knox fetch
+	`,
+}
+
+var prewarmManifest = cmdPrewarm.Flag.String("manifest", "", "")
+var prewarmTimeout = cmdPrewarm.Flag.Duration("timeout", 5*time.Minute, "")
+var prewarmJSON = cmdPrewarm.Flag.Bool("json", false, "")
+
+const prewarmPollInterval = 5 * time.Second
+
+func runPrewarm(cmd *Command, args []string) *ErrorStatus {
+	if *prewarmManifest == "" {
+		return &ErrorStatus{fmt.Errorf("You must give a manifest file. See 'knox help prewarm'"), false}
+	}
+	c, ok := cli.(knox.PrewarmClient)
+	if !ok {
+		return &ErrorStatus{fmt.Errorf("This client does not support prewarming"), false}
+	}
+	b, err := ioutil.ReadFile(*prewarmManifest)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Failed to read manifest: %s", err.Error()), false}
+	}
+	var req knox.PrewarmRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return &ErrorStatus{fmt.Errorf("Failed to parse manifest: %s", err.Error()), false}
+	}
+	p, err := c.CreatePrewarm(req)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error creating prewarm request: %s", err.Error()), true}
+	}
+	if *prewarmTimeout == 0 {
+		fmt.Println(p.ID)
+		return nil
+	}
+	p, err = waitForPrewarm(c, p, *prewarmTimeout, prewarmPollInterval)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error getting prewarm request %s: %s", p.ID, err.Error()), true}
+	}
+	if *prewarmJSON {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return &ErrorStatus{err, false}
+		}
+		fmt.Println(string(b))
+	} else {
+		printPrewarm(p)
+	}
+	if !p.Ready {
+		return &ErrorStatus{fmt.Errorf("Not all hosts were ready within %s", *prewarmTimeout), false}
+	}
+	return nil
+}
+
+// waitForPrewarm polls the prewarm request until every host is ready or
+// timeout passes, and returns its last state.
+func waitForPrewarm(c knox.PrewarmClient, p *knox.Prewarm, timeout, interval time.Duration) (*knox.Prewarm, error) {
+	deadline := time.Now().Add(timeout)
+	for !p.Ready && time.Now().Before(deadline) {
+		time.Sleep(interval)
+		next, err := c.GetPrewarm(p.ID)
+		if err != nil {
+			return p, err
+		}
+		p = next
+	}
+	return p, nil
+}
+
+func printPrewarm(p *knox.Prewarm) {
+	hosts := make([]string, 0, len(p.Hosts))
+	for h := range p.Hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tDETAILS")
+	for _, host := range hosts {
+		h := p.Hosts[host]
+		status, details := "ready", ""
+		switch {
+		case h.Ready:
+		case len(h.Errors) > 0:
+			status = "failed"
+			ids := make([]string, 0, len(h.Errors))
+			for id, e := range h.Errors {
+				ids = append(ids, id+": "+e.Message)
+			}
+			sort.Strings(ids)
+			details = strings.Join(ids, "; ")
+		case h.LastSync.IsZero():
+			status, details = "waiting", "daemon has not synced"
+		default:
+			status, details = "pending", strings.Join(h.Pending, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", host, status, details)
+	}
+	w.Flush()
+}
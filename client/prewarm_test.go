@@ -0,0 +1,36 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+type fakePrewarmClient struct {
+	polls int
+	ready int
+}
+
+func (c *fakePrewarmClient) CreatePrewarm(req knox.PrewarmRequest) (*knox.Prewarm, error) {
+	return &knox.Prewarm{ID: "p"}, nil
+}
+
+func (c *fakePrewarmClient) GetPrewarm(id string) (*knox.Prewarm, error) {
+	c.polls++
+	return &knox.Prewarm{ID: id, Ready: c.polls >= c.ready}, nil
+}
+
+func TestWaitForPrewarm(t *testing.T) {
+	c := &fakePrewarmClient{ready: 3}
+	p, err := waitForPrewarm(c, &knox.Prewarm{ID: "p"}, time.Minute, 0)
+	if err != nil || !p.Ready || c.polls != 3 {
+		t.Fatalf("Expected to poll until ready, got %+v, %v after %d polls", p, err, c.polls)
+	}
+
+	c = &fakePrewarmClient{ready: 1000}
+	p, err = waitForPrewarm(c, &knox.Prewarm{ID: "p"}, 20*time.Millisecond, time.Millisecond)
+	if err != nil || p.Ready {
+		t.Fatalf("Expected to stop waiting at the timeout, got %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pinterest/knox"
+)
+
+var flagProfile = flag.String("profile", "", "Profile of the knox config file to use. Defaults to $KNOX_PROFILE or the file's default profile.")
+
+// profileConfigEnv names the knox config file, ~/.knox/config.json by default.
+const profileConfigEnv = "KNOX_CONFIG"
+
+var helpProfiles = &Command{
+	UsageLine: "profiles",
+	Short:     "Explains configuration profiles",
+	Long: `
+
+Profiles configure which knox server the client uses, so that commands meant for one environment
+don't end up on another. They are read from the JSON file named by $KNOX_CONFIG, or
+~/.knox/config.json:
+
+	{
+		"default": "dev",
+		"profiles": {
+			"dev": {"host": "knox.dev.example.com:9000"},
+			"prod": {
+				"host": "knox.example.com:9000",
+				"ca_bundle": "/etc/knox/prod-ca.pem",
+				"auth": "user",
+				"cache_root": "/var/lib/knox-prod"
+			}
+		}
+	}
+
+The profile is chosen with the -profile flag, e.g. "knox -profile prod get <key_identifier>", or the
+$KNOX_PROFILE env variable, and is otherwise the default of the file. Without a config file or a
+chosen profile the client's built in settings are used.
+
+The host is the knox server of the profile. The ca_bundle is a PEM file of the certificate authorities
+that sign its certificate. The auth is the only kind of credentials sent to it, user, machine or
+service, see knox help auth. The cache_root is where the daemon caches its keys, unless -cache-root
+is given.
+
+See also: knox help auth
+	`,
+}
+
+// Profile is the configuration of the knox server of an environment.
+type Profile struct {
+	Host      string `json:"host"`
+	CABundle  string `json:"ca_bundle,omitempty"`
+	Auth      string `json:"auth,omitempty"`
+	CacheRoot string `json:"cache_root,omitempty"`
+}
+
+// profileConfig is the format of the knox config file.
+type profileConfig struct {
+	Default  string             `json:"default,omitempty"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// authTypes are the auth settings of profiles and the type bytes of their
+// authorization headers.
+var authTypes = map[string]byte{
+	"user":    'u',
+	"machine": 't',
+	"service": 's',
+}
+
+// profileConfigPath returns the path of the knox config file.
+func profileConfigPath() string {
+	if p := os.Getenv(profileConfigEnv); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".knox", "config.json")
+}
+
+// loadProfile reads the named profile, or the default one if name is empty,
+// from the config file at path. It returns a nil profile if no profile is
+// chosen, and an error if the chosen profile can't be found.
+func loadProfile(path, name string) (*Profile, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && name == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading knox config: %s", err.Error())
+	}
+	var c profileConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("Error parsing knox config %s: %s", path, err.Error())
+	}
+	if name == "" {
+		name = c.Default
+	}
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("No profile %q in knox config %s, it has %v", name, path, names)
+	}
+	if p.Host == "" {
+		return nil, fmt.Errorf("Profile %q in knox config %s has no host", name, path)
+	}
+	if _, ok := authTypes[p.Auth]; p.Auth != "" && !ok {
+		return nil, fmt.Errorf("Profile %q in knox config %s has auth %q, expected user, machine or service", name, path, p.Auth)
+	}
+	return &p, nil
+}
+
+// applyProfile configures client for the profile. The cache root only
+// applies if no -cache-root was given.
+func applyProfile(client knox.APIClient, p *Profile) error {
+	c, ok := client.(interface {
+		SetHost(string)
+		SetRootCAs(*x509.CertPool) error
+		SetAuthType(byte)
+	})
+	if !ok {
+		return fmt.Errorf("Profiles are not supported by this knox client")
+	}
+	c.SetHost(p.Host)
+	if p.CABundle != "" {
+		pem, err := os.ReadFile(p.CABundle)
+		if err != nil {
+			return fmt.Errorf("Error reading CA bundle: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates in CA bundle %s", p.CABundle)
+		}
+		if err := c.SetRootCAs(pool); err != nil {
+			return err
+		}
+	}
+	if p.Auth != "" {
+		c.SetAuthType(authTypes[p.Auth])
+	}
+	if p.CacheRoot != "" && *flagCacheRoot == "" {
+		*flagCacheRoot = p.CacheRoot
+	}
+	return nil
+}
+
+// setProfile applies the profile chosen with -profile or $KNOX_PROFILE.
+func setProfile(client knox.APIClient) {
+	// Fake keys don't come from a server.
+	if knox.FakeKeysEnabled() {
+		return
+	}
+	name := *flagProfile
+	if name == "" {
+		name = os.Getenv("KNOX_PROFILE")
+	}
+	p, err := loadProfile(profileConfigPath(), name)
+	if err != nil {
+		fatalf("%s", err.Error())
+	}
+	if p == nil {
+		return
+	}
+	if err := applyProfile(client, p); err != nil {
+		fatalf("%s", err.Error())
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestLoadProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if p, err := loadProfile(path, ""); p != nil || err != nil {
+		t.Fatalf("Expected no profile without a config file, got %+v and %v", p, err)
+	}
+	if _, err := loadProfile(path, "prod"); err == nil {
+		t.Fatal("Expected a chosen profile to need a config file")
+	}
+
+	config := `{
+		"default": "dev",
+		"profiles": {
+			"dev": {"host": "dev:9000"},
+			"prod": {"host": "prod:9000", "auth": "user", "cache_root": "/tmp/knox-prod"},
+			"nohost": {},
+			"badauth": {"host": "h", "auth": "root"}
+		}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := loadProfile(path, ""); err != nil || p.Host != "dev:9000" {
+		t.Fatalf("Expected the default profile, got %+v and %v", p, err)
+	}
+	if p, err := loadProfile(path, "prod"); err != nil || p.Host != "prod:9000" || p.Auth != "user" {
+		t.Fatalf("Expected the prod profile, got %+v and %v", p, err)
+	}
+	for _, name := range []string{"missing", "nohost", "badauth"} {
+		if _, err := loadProfile(path, name); err == nil {
+			t.Fatalf("Expected profile %s to be rejected", name)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	defer func(root string) { *flagCacheRoot = root }(*flagCacheRoot)
+	*flagCacheRoot = ""
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, testCAPEM(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := "0tweb1"
+	c := knox.NewClient("default:9000", &http.Client{}, func() string { return auth }, "", "")
+	p := &Profile{Host: "prod:9000", CABundle: caFile, Auth: "user", CacheRoot: "/tmp/knox-prod"}
+	if err := applyProfile(c, p); err != nil {
+		t.Fatal(err)
+	}
+	uc := c.(*knox.HTTPClient).UncachedClient
+	if uc.Host != "prod:9000" || *flagCacheRoot != "/tmp/knox-prod" {
+		t.Fatalf("Expected the profile's host and cache root, got %s and %s", uc.Host, *flagCacheRoot)
+	}
+	if got := uc.AuthHandler(); got != "" {
+		t.Fatalf("Expected machine credentials not to be sent, got %q", got)
+	}
+	auth = "0utoken"
+	if got := uc.AuthHandler(); got != auth {
+		t.Fatalf("Expected user credentials to be sent, got %q", got)
+	}
+	tlsConfig := uc.Client.(*http.Client).Transport.(*http.Transport).TLSClientConfig
+	if tlsConfig.RootCAs == nil || tlsConfig.InsecureSkipVerify {
+		t.Fatal("Expected the server certificate to be verified with the CA bundle")
+	}
+
+	p = &Profile{Host: "prod:9000", CABundle: filepath.Join(t.TempDir(), "missing.pem")}
+	if err := applyProfile(c, p); err == nil {
+		t.Fatal("Expected a missing CA bundle to be an error")
+	}
+}
+
+func testCAPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "knox test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -14,7 +14,7 @@ func init() {
 }
 
 var cmdRegister = &Command{
-	UsageLine: "register [-r] [-k identifier] [-f identifier_file] [-g]",
+	UsageLine: "register [-r] [-k identifier] [-f identifier_file] [-g] [-watch]",
 	Short:     "register keys to cache locally using daemon",
 	Long: `
 Register will cache the key in the file system and keep it up to date using the file system.
@@ -24,6 +24,9 @@ Register will cache the key in the file system and keep it up to date using the
 -f specifies a file containing a new line separated list of key identifiers
 -t specifies a timeout for getting the key from the daemon (e.g. '5s', '500ms')
 -g gets the key as well
+-watch stays in the foreground and keeps the given keys up to date instead of relying on the daemon. It
+only exits, with a non-zero status, when the server rejects the client's credentials or denies access to
+one of the keys. This is meant as a sidecar container entrypoint on hosts without a knox daemon.
 
 For a machine to access a certain key, it needs permissions on that key.
 
@@ -99,6 +102,12 @@ func runRegister(cmd *Command, args []string) *ErrorStatus {
 	} else {
 		ks = []string{*registerKey}
 	}
+	if *registerWatch {
+		if *registerRemove || *registerAndGet {
+			return &ErrorStatus{fmt.Errorf("-watch cannot be combined with -r or -g"), false}
+		}
+		return runWatch(ks, daemonRefreshTime)
+	}
 	// Handle adding new keys to the registered file
 	err = k.Lock()
 	if err != nil {
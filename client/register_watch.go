@@ -0,0 +1,68 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+var registerWatch = cmdRegister.Flag.Bool("watch", false, "")
+
+// authErrorMessages are server and client errors that retrying won't fix.
+var authErrorMessages = []string{
+	"User or machine is not authenticated",
+	"User or machine not authorized",
+	"No authentication data given",
+}
+
+// isAuthError reports whether err means the client's credentials were
+// rejected or it lacks access to a key.
+func isAuthError(err error) bool {
+	var apiErr *knox.APIError
+	if errors.As(err, &apiErr) && (apiErr.Code == knox.UnauthenticatedCode || apiErr.Code == knox.UnauthorizedCode) {
+		return true
+	}
+	for _, m := range authErrorMessages {
+		if strings.Contains(err.Error(), m) {
+			return true
+		}
+	}
+	return false
+}
+
+// runWatch keeps keyIDs up to date in the foreground without using the
+// register file, like a daemon that only knows about these keys. It only
+// returns on authentication or authorization errors.
+func runWatch(keyIDs []string, refresh time.Duration) *ErrorStatus {
+	d := daemon{
+		dir:          daemonFolder,
+		registerFile: daemonToRegister,
+		keysDir:      daemonKeys,
+		cli:          cli,
+		keyMode:      defaultFilePermission,
+		watchKeys:    keyIDs,
+	}
+	if err := d.initialize(); err != nil {
+		return &ErrorStatus{err, false}
+	}
+	return d.watch(refresh)
+}
+
+func (d *daemon) watch(refresh time.Duration) *ErrorStatus {
+	for {
+		logf("Updating watched keys %v", d.watchKeys)
+		if err := d.update(); err != nil {
+			if isAuthError(err) {
+				return &ErrorStatus{fmt.Errorf("Stopped watching keys: %w", err), false}
+			}
+			d.updateErrCount++
+			logf("Failed to update keys: %s", err.Error())
+		} else {
+			d.successCount++
+		}
+		time.Sleep(refresh)
+	}
+}
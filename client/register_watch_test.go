@@ -0,0 +1,64 @@
+package client
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestWatch(t *testing.T) {
+	params, dir, d := setUpTest(t)
+	defer TearDownTest(dir)
+	d.watchKeys = []string{"testkey"}
+	expected := knox.Key{
+		ID:          "testkey",
+		ACL:         knox.ACL([]knox.Access{}),
+		VersionList: knox.KeyVersionList{},
+		VersionHash: "VersionHash",
+	}
+	// Keys cached for someone else are not removed.
+	if err := os.WriteFile(d.keyFilename("other"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	params.setFunc(func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/sync/":
+			setGoodResponse(params, knox.KeySync{Keys: []knox.Key{expected}})
+		default:
+			t.Fatal("Unexpected path:" + r.URL.Path)
+		}
+	})
+	if err := d.update(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := d.cli.CacheGetKey(expected.ID); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := os.Stat(d.keyFilename("other")); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Losing access to a watched key stops the loop.
+	params.setFunc(func(r *http.Request) {
+		setGoodResponse(params, knox.KeySync{
+			Keys: []knox.Key{},
+			Errors: map[string]knox.APIError{
+				expected.ID: {Code: knox.UnauthorizedCode, Message: "Principal not authorized to read testkey"},
+			},
+		})
+	})
+	done := make(chan *ErrorStatus, 1)
+	go func() { done <- d.watch(time.Millisecond) }()
+	select {
+	case status := <-done:
+		if status == nil || !isAuthError(status) {
+			t.Fatalf("Expected an authorization error, got %v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop on an authorization error")
+	}
+}
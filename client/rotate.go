@@ -0,0 +1,41 @@
+package client
+
+import (
+	"fmt"
+)
+
+func init() {
+	cmdRotate.Run = runRotate // break init cycle
+}
+
+var cmdRotate = &Command{
+	UsageLine: "rotate [-p] <key_identifier>",
+	Short:     "has the server generate a new key version",
+	Long: `
+Rotate asks the knox server to generate a new version of the key and add it as active. The version id will be sent to stdout.
+
+The key must have a "knox.generator" metadata entry naming how its data is generated, for example "random:32" for 32
+random bytes. Keys created with "knox create --key-template" are set up to be rotated with their Tink template.
+
+-p also promotes the new version to primary.
+
+This requires write access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox add, knox promote, knox tag
+	`,
+}
+var rotatePromote = cmdRotate.Flag.Bool("p", false, "")
+
+func runRotate(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("rotate takes only one argument. See 'knox help rotate'"), false}
+	}
+	versionID, err := cli.RotateKey(args[0], *rotatePromote)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error rotating key: %s", err.Error()), true}
+	}
+	fmt.Printf("Added key version %d\n", versionID)
+	return nil
+}
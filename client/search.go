@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	cmdSearch.Run = runSearch // break init cycle
+}
+
+var cmdSearch = &Command{
+	UsageLine: "search [-owner principal] [-tag name[:value]] [-created-after time] [-created-before time]",
+	Short:     "searches keys by metadata",
+	Long: `
+Search returns the key identifiers matching all of the given filters.
+
+-owner matches keys where the principal has Admin access.
+-tag matches keys with the given metadata entry, it can be repeated. Without a value any key with the entry matches.
+-created-after and -created-before bound the creation time of the key. Times are RFC 3339 or Unix seconds.
+
+This requires valid user or machine authentication, but there are no authorization requirements.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox keys, knox tag
+	`,
+}
+
+var searchOwner = cmdSearch.Flag.String("owner", "", "")
+var searchTags tagFlags
+var searchCreatedAfter = cmdSearch.Flag.String("created-after", "", "")
+var searchCreatedBefore = cmdSearch.Flag.String("created-before", "", "")
+
+func init() {
+	cmdSearch.Flag.Var(&searchTags, "tag", "")
+}
+
+// tagFlags collects repeated -tag flags.
+type tagFlags []string
+
+func (t *tagFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tagFlags) Set(v string) error {
+	*t = append(*t, v)
+	return nil
+}
+
+func runSearch(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 0 {
+		return &ErrorStatus{fmt.Errorf("search takes no arguments. See 'knox help search'"), false}
+	}
+	q := url.Values{}
+	if *searchOwner != "" {
+		q.Set("owner", *searchOwner)
+	}
+	for _, t := range searchTags {
+		q.Add("tag", t)
+	}
+	if *searchCreatedAfter != "" {
+		q.Set("created_after", *searchCreatedAfter)
+	}
+	if *searchCreatedBefore != "" {
+		q.Set("created_before", *searchCreatedBefore)
+	}
+	l, err := cli.SearchKeys(q)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error searching keys: %s", err.Error()), true}
+	}
+	for _, k := range l {
+		fmt.Println(k)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/shamir"
+)
+
+func init() {
+	cmdShamir.Run = runShamir // break init cycle
+}
+
+var cmdShamir = &Command{
+	UsageLine:   "shamir split -parts n -threshold k [-acls file] <key_identifier> | reconstruct <key_identifier>",
+	Short:       "splits secrets into shares stored as separate keys",
+	CustomFlags: true,
+	Long: `
+Shamir splits extremely sensitive secrets, such as root key material, into shares with Shamir's secret
+sharing scheme. Any threshold of the shares reconstructs the secret, and fewer reveal nothing about it.
+Each share is stored as its own knox key, so each can have its own ACL and no single ACL grants the secret.
+
+shamir split reads the secret from stdin and creates the keys <key_identifier>:share_1 to
+<key_identifier>:share_<parts>, tagged with knox.shamir_share. The secret itself is never sent to knox.
+-parts is the number of shares, at most 255.
+-threshold is the number of shares needed to reconstruct the secret, at least 2.
+-acls gives each share its own ACL, from a file with a JSON list of one ACL per share in the format of
+"knox access -acl". As with "knox create", you are given access to every share; remove your access with
+"knox access" once the shares are handed out.
+
+shamir reconstruct reads the shares of a secret that you have access to and writes the secret to stdout
+once the threshold is reached. It fails if fewer shares are readable.
+
+This requires user authentication.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox create, knox access, knox get
+	`,
+}
+
+func runShamir(cmd *Command, args []string) *ErrorStatus {
+	if len(args) == 0 {
+		return &ErrorStatus{fmt.Errorf("shamir needs an operation. See 'knox help shamir'"), false}
+	}
+	switch args[0] {
+	case "split":
+		return runShamirSplit(args[1:])
+	case "reconstruct":
+		return runShamirReconstruct(args[1:])
+	}
+	return &ErrorStatus{fmt.Errorf("Unknown shamir operation %q. See 'knox help shamir'", args[0]), false}
+}
+
+// shamirShareID returns the ID of the key holding the n-th share of keyID.
+func shamirShareID(keyID string, n int) string {
+	return fmt.Sprintf("%s:share_%d", keyID, n)
+}
+
+func runShamirSplit(args []string) *ErrorStatus {
+	fs := flag.NewFlagSet("shamir split", flag.ContinueOnError)
+	parts := fs.Int("parts", 0, "")
+	threshold := fs.Int("threshold", 0, "")
+	aclFile := fs.String("acls", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help shamir'"), false}
+	}
+	keyID := fs.Arg(0)
+	var acls []knox.ACL
+	if *aclFile != "" {
+		b, err := ioutil.ReadFile(*aclFile)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("Could not read acl file: %s", err.Error()), false}
+		}
+		if err := json.Unmarshal(b, &acls); err != nil {
+			return &ErrorStatus{fmt.Errorf("Could not parse acl file: %s", err.Error()), false}
+		}
+		if len(acls) != *parts {
+			return &ErrorStatus{fmt.Errorf("The acl file has %d ACLs for %d shares", len(acls), *parts), false}
+		}
+		for i, acl := range acls {
+			if err := acl.Validate(); err != nil {
+				return &ErrorStatus{fmt.Errorf("Invalid ACL for share %d: %s", i+1, err.Error()), false}
+			}
+		}
+	}
+	secret, err := readDataFromStdin()
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	shares, err := shamir.Split(secret, *parts, *threshold)
+	for i := range secret {
+		secret[i] = 0
+	}
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	md := knox.KeyMetadata{knox.MetadataShamirShare: fmt.Sprintf("%d-of-%d", *threshold, *parts)}
+	for i, share := range shares {
+		shareID := shamirShareID(keyID, i+1)
+		if _, err := cli.CreateKey(shareID, share, knox.ACL{}); err != nil {
+			return &ErrorStatus{fmt.Errorf("Error creating %s: %s", shareID, err.Error()), true}
+		}
+		if err := cli.UpdateMetadata(shareID, md); err != nil {
+			return &ErrorStatus{fmt.Errorf("Error tagging %s: %s", shareID, err.Error()), true}
+		}
+		if acls != nil {
+			if err := cli.PutAccess(shareID, acls[i]...); err != nil {
+				return &ErrorStatus{fmt.Errorf("Error setting the ACL of %s: %s", shareID, err.Error()), true}
+			}
+		}
+		fmt.Printf("Created %s\n", shareID)
+	}
+	return nil
+}
+
+func runShamirReconstruct(args []string) *ErrorStatus {
+	fs := flag.NewFlagSet("shamir reconstruct", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help shamir'"), false}
+	}
+	secret, err := reconstructShamirSecret(cli, fs.Arg(0))
+	if err != nil {
+		return &ErrorStatus{err, true}
+	}
+	os.Stdout.Write(secret)
+	return nil
+}
+
+// reconstructShamirSecret reads the shares of keyID until it has the
+// threshold and combines them. Shares that can't be read are skipped.
+func reconstructShamirSecret(c knox.APIClient, keyID string) ([]byte, error) {
+	var shares [][]byte
+	var unreadable []string
+	threshold, parts := 0, shamir.MaxParts
+	for n := 1; n <= parts && (threshold == 0 || len(shares) < threshold); n++ {
+		shareID := shamirShareID(keyID, n)
+		key, err := c.NetworkGetKey(shareID)
+		if err != nil {
+			var apiErr *knox.APIError
+			if errors.As(err, &apiErr) && apiErr.Code == knox.KeyIdentifierDoesNotExistCode {
+				break
+			}
+			unreadable = append(unreadable, shareID)
+			continue
+		}
+		var k, p int
+		if _, err := fmt.Sscanf(key.Metadata[knox.MetadataShamirShare], "%d-of-%d", &k, &p); err != nil {
+			return nil, fmt.Errorf("%s is not a share, its %s is %q", shareID, knox.MetadataShamirShare, key.Metadata[knox.MetadataShamirShare])
+		}
+		primary := key.VersionList.GetPrimary()
+		if primary == nil {
+			return nil, fmt.Errorf("%s has no primary version", shareID)
+		}
+		threshold, parts = k, p
+		shares = append(shares, primary.Data)
+	}
+	if threshold == 0 {
+		return nil, fmt.Errorf("Could not read any share of %s", keyID)
+	}
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("Read %d shares of %s, %d are needed; could not read %v", len(shares), keyID, threshold, unreadable)
+	}
+	return shamir.Combine(shares)
+}
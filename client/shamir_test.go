@@ -0,0 +1,64 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/shamir"
+)
+
+// shareClient serves the keys in shares and returns errors for the others.
+type shareClient struct {
+	knox.APIClient
+	shares map[string]*knox.Key
+	denied map[string]bool
+	reads  int
+}
+
+func (c *shareClient) NetworkGetKey(keyID string) (*knox.Key, error) {
+	c.reads++
+	if c.denied[keyID] {
+		return nil, &knox.APIError{Code: knox.UnauthorizedCode, Message: "denied"}
+	}
+	if k, ok := c.shares[keyID]; ok {
+		return k, nil
+	}
+	return nil, &knox.APIError{Code: knox.KeyIdentifierDoesNotExistCode, Message: "no such key"}
+}
+
+func TestReconstructShamirSecret(t *testing.T) {
+	secret := []byte("root key")
+	shares, err := shamir.Split(secret, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &shareClient{shares: map[string]*knox.Key{}, denied: map[string]bool{}}
+	for i, share := range shares {
+		id := shamirShareID("root", i+1)
+		c.shares[id] = &knox.Key{
+			ID:          id,
+			VersionList: knox.KeyVersionList{{ID: 1, Data: share, Status: knox.Primary}},
+			Metadata:    knox.KeyMetadata{knox.MetadataShamirShare: "2-of-4"},
+		}
+	}
+	c.denied["root:share_1"] = true
+	got, err := reconstructShamirSecret(c, "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("reconstructed %q", got)
+	}
+	if c.reads != 3 {
+		t.Fatalf("expected reads to stop at the threshold, got %d reads", c.reads)
+	}
+
+	c.denied["root:share_2"], c.denied["root:share_3"] = true, true
+	if _, err := reconstructShamirSecret(c, "root"); err == nil {
+		t.Fatal("expected error with fewer readable shares than the threshold")
+	}
+	if _, err := reconstructShamirSecret(c, "other"); err == nil {
+		t.Fatal("expected error without shares")
+	}
+}
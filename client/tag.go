@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdTag.Run = runTag // break init cycle
+}
+
+var cmdTag = &Command{
+	UsageLine: "tag <key_identifier> <name=value> ...",
+	Short:     "sets metadata on a key",
+	Long: `
+Tag sets metadata entries on a key. Existing entries not named are left unchanged.
+
+An empty value (e.g. "env=") removes the entry.
+
+Setting "knox.honeytoken=true" marks the key as a canary credential: the server
+raises an alert every time its data is read, whether or not the read is authorized.
+
+Setting "knox.max_reads=n" limits the key's data to n reads in total, e.g. 1 for a bootstrap
+token that should only be read once. Later reads fail. The server counts reads in
+"knox.read_count"; removing it with "knox.read_count=" allows n more reads.
+
+Setting "knox.expires_at" to an RFC 3339 time (e.g. 2030-01-02T15:04:05Z) makes the server refuse
+to return the key's data after that time. With "knox.expiry_action=delete" the key is also deleted.
+
+Metadata is not secret and is stored unencrypted so that it can be searched.
+
+This requires admin access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox search, knox get
+	`,
+}
+
+func runTag(cmd *Command, args []string) *ErrorStatus {
+	if len(args) < 2 {
+		return &ErrorStatus{fmt.Errorf("tag takes a key identifier and at least one entry. See 'knox help tag'"), false}
+	}
+	keyID := args[0]
+	md := knox.KeyMetadata{}
+	for _, arg := range args[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return &ErrorStatus{fmt.Errorf("Invalid entry %q, expected name=value", arg), false}
+		}
+		md[name] = value
+	}
+	err := cli.UpdateMetadata(keyID, md)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error updating metadata: %s", err.Error()), true}
+	}
+	return nil
+}
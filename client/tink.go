@@ -0,0 +1,102 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/tink"
+)
+
+func init() {
+	cmdTink.Run = runTink // break init cycle
+}
+
+var cmdTink = &Command{
+	UsageLine:   "tink prune [-check] <key_identifier>",
+	Short:       "manages Tink keysets stored in knox",
+	CustomFlags: true,
+	Long: `
+Tink runs operations on knox keys that store Tink keysets, one Tink key per knox version.
+
+tink prune assembles the keyset of a key from its primary and active versions only, dropping the
+Tink keys of inactive and scheduled versions, and writes it to stdout like "knox get --tink-keyset".
+The dropped Tink keys are listed on stderr. It first checks that knox and Tink agree on the keyset:
+exactly one knox version is primary, each version's keyset has its own Tink key as primary and the
+Tink keys of primary and active versions are enabled. Keys with a knox.tink_kms_key_uri are decrypted
+and written encrypted with that KMS key.
+-check only runs the checks and lists the Tink keys that would be dropped.
+
+This command uses user access and requires read access in the key's ACL.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox get, knox deactivate, knox key-templates
+	`,
+}
+
+func runTink(cmd *Command, args []string) *ErrorStatus {
+	if len(args) == 0 {
+		return &ErrorStatus{fmt.Errorf("tink needs an operation. See 'knox help tink'"), false}
+	}
+	switch args[0] {
+	case "prune":
+		return runTinkPrune(args[1:])
+	}
+	return &ErrorStatus{fmt.Errorf("Unknown tink operation %q. See 'knox help tink'", args[0]), false}
+}
+
+func runTinkPrune(args []string) *ErrorStatus {
+	fs := flag.NewFlagSet("tink prune", flag.ContinueOnError)
+	check := fs.Bool("check", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return &ErrorStatus{fmt.Errorf("Invalid arguments. See 'knox help tink'"), false}
+	}
+	keyID := fs.Arg(0)
+	if !tink.IsKeysetID(keyID) {
+		return &ErrorStatus{fmt.Errorf("this knox identifier is not for tink keyset"), false}
+	}
+	// get all versions (primary, active, inactive) of this knox identifier
+	key, err := cli.NetworkGetKeyWithStatus(keyID, knox.Inactive)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("error getting key: %s", err.Error()), true}
+	}
+	kekURI := key.Metadata[knox.MetadataTinkKMSKeyURI]
+	if err := tink.CheckPrimaryConsistency(key.VersionList, kekURI); err != nil {
+		return &ErrorStatus{fmt.Errorf("inconsistent tink keyset for %s: %s", keyID, err.Error()), false}
+	}
+	kept, pruned := tink.Prune(key.VersionList)
+	if err := tink.ValidateVersions(kept, kekURI); err != nil {
+		return &ErrorStatus{fmt.Errorf("invalid tink keyset for %s: %s", keyID, err.Error()), false}
+	}
+	for _, v := range pruned {
+		tinkKeyID, err := tink.VersionKeyID(v, kekURI)
+		if err != nil {
+			return &ErrorStatus{err, false}
+		}
+		fmt.Fprintf(os.Stderr, "Dropping tink key %d of knox version %d\n", tinkKeyID, v.ID)
+	}
+	if *check {
+		fmt.Fprintf(os.Stderr, "Tink keyset for %s is consistent, %d of %d knox versions in use\n", keyID, len(kept), len(key.VersionList))
+		return nil
+	}
+	keysetHandle, _, err := tink.KeysetHandle(kept, kekURI)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	data, err := tink.WriteKeyset(keysetHandle, kekURI)
+	if err != nil {
+		return &ErrorStatus{err, false}
+	}
+	fmt.Printf("%s", string(data))
+	return nil
+}
+
+// GenerateTinkVersion creates the data for a new version of a knox key that
+// stores a Tink keyset, using the named template.
+//
+// Deprecated: Use tink.GenerateVersion.
+func GenerateTinkVersion(templateName string, key *knox.Key) ([]byte, error) {
+	return tink.GenerateVersion(templateName, key)
+}
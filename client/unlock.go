@@ -0,0 +1,32 @@
+package client
+
+import (
+	"fmt"
+)
+
+var cmdUnlock = &Command{
+	Run:       runUnlock,
+	UsageLine: "unlock <key_identifier>",
+	Short:     "unlocks a locked key",
+	Long: `
+Unlock allows a key locked with knox lock to be read again.
+
+This requires admin access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox lock
+	`,
+}
+
+func runUnlock(cmd *Command, args []string) *ErrorStatus {
+	if len(args) != 1 {
+		return &ErrorStatus{fmt.Errorf("unlock takes only one argument. See 'knox help unlock'"), false}
+	}
+	err := cli.UnlockKey(args[0])
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Error unlocking key: %s", err.Error()), true}
+	}
+	fmt.Printf("Unlocked key %s\n", args[0])
+	return nil
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"fmt"
+	"path"
 )
 
 var cmdUnregister = &Command{
@@ -21,7 +22,7 @@ func runUnregister(cmd *Command, args []string) *ErrorStatus {
 	if len(args) != 1 {
 		return &ErrorStatus{fmt.Errorf("You must include a key ID to deregister. See 'knox help unregister'"), false}
 	}
-	k := NewKeysFile(daemonFolder + daemonToRegister)
+	k := NewKeysFile(path.Join(daemonFolder, daemonToRegister))
 	err := k.Lock()
 	if err != nil {
 		return &ErrorStatus{fmt.Errorf("Error locking the register file: %s", err.Error()), false}
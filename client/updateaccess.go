@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/pinterest/knox"
 )
@@ -13,7 +14,7 @@ func init() {
 }
 
 var cmdUpdateAccess = &Command{
-	UsageLine: "access (-acl <file> <key_identifier> | {-n|-r|-w|-a} {-M|-U|-G|-P} <key_identifier> <principal>)",
+	UsageLine: "access [-plan [-principals <file>]] [-if-hash hash] (-acl <file> <key_identifier> | {-n|-r|-w|-a} {-M|-U|-G|-P} <key_identifier> <principal>)",
 	Short:     "access modifies the acl of a key",
 	Long: `
 Access will add or change the acl on a key by adding a specific access control rule.
@@ -32,6 +33,14 @@ Access will add or change the acl on a key by adding a specific access control r
 -S: A specific service. The principal should be set to the exact SPIFFE ID. For example, 'spiffe://example.com/service'.
 -N: A service prefix (namespace). The principal should be set to a SPIFFE ID ending with a slash, such as 'spiffe://example.com/namespace/'. This will match all services under that prefix, so for example 'spiffe://example.com/namespace/service' would be allowed.
 
+-if-hash: Only changes the ACL if the key's version hash, as shown by "knox get -j", is still the given
+one. The version hash reflects the key's versions, not its ACL.
+
+-plan: Shows which principals would gain or lose access instead of changing the ACL. The checked
+principals are the users, machines and services named in the change, or those listed in the file given
+with -principals as JSON: [{"type": "user", "id": "alice", "groups": ["eng"]}, {"type": "machine", "id": "host1"}].
+Principal types are user, machine and service. Access granted by groups and prefixes is taken into account.
+
 This command requires admin access to the key.
 
 For more about knox, see https://github.com/pinterest/knox.
@@ -41,6 +50,9 @@ See also: knox create, knox get
 }
 
 var updateAccessACL = cmdUpdateAccess.Flag.String("acl", "", "")
+var updateAccessPlan = cmdUpdateAccess.Flag.Bool("plan", false, "")
+var updateAccessPrincipals = cmdUpdateAccess.Flag.String("principals", "", "")
+var updateAccessIfHash = cmdUpdateAccess.Flag.String("if-hash", "", "")
 
 var updateAccessNone = cmdUpdateAccess.Flag.Bool("n", false, "")
 var updateAccessRead = cmdUpdateAccess.Flag.Bool("r", false, "")
@@ -69,7 +81,10 @@ func runUpdateAccess(cmd *Command, args []string) *ErrorStatus {
 		if err != nil {
 			return &ErrorStatus{fmt.Errorf("Could not decode access list properly: %s", err.Error()), false}
 		}
-		err = cli.PutAccess(keyID, acl...)
+		if *updateAccessPlan {
+			return planAccess(keyID, acl)
+		}
+		err = cli.PutAccessIfHash(keyID, *updateAccessIfHash, acl...)
 		if err != nil {
 			return &ErrorStatus{fmt.Errorf("Failed to update access: %s", err.Error()), true}
 		}
@@ -111,10 +126,58 @@ func runUpdateAccess(cmd *Command, args []string) *ErrorStatus {
 	default:
 		return &ErrorStatus{fmt.Errorf("access requires {-M|-U|-G|-P|-S|-N}. See 'knox help access'"), false}
 	}
-	err := cli.PutAccess(keyID, access)
+	if *updateAccessPlan {
+		return planAccess(keyID, []knox.Access{access})
+	}
+	err := cli.PutAccessIfHash(keyID, *updateAccessIfHash, access)
 	if err != nil {
 		return &ErrorStatus{fmt.Errorf("Failed to update access: %s", err.Error()), true}
 	}
 	fmt.Println("Successfully updated Access")
 	return nil
 }
+
+// planAccess prints how applying acl would change the access of principals.
+func planAccess(keyID string, acl []knox.Access) *ErrorStatus {
+	principals := []knox.PlanPrincipal{}
+	if *updateAccessPrincipals != "" {
+		b, err := ioutil.ReadFile(*updateAccessPrincipals)
+		if err != nil {
+			return &ErrorStatus{fmt.Errorf("Could not read principals file: %s", err.Error()), false}
+		}
+		if err := json.Unmarshal(b, &principals); err != nil {
+			return &ErrorStatus{fmt.Errorf("Could not decode principals properly: %s", err.Error()), false}
+		}
+	} else {
+		for _, a := range acl {
+			switch a.Type {
+			case knox.User:
+				principals = append(principals, knox.PlanPrincipal{Type: "user", ID: a.ID})
+			case knox.Machine:
+				principals = append(principals, knox.PlanPrincipal{Type: "machine", ID: a.ID})
+			case knox.Service:
+				principals = append(principals, knox.PlanPrincipal{Type: "service", ID: a.ID})
+			}
+		}
+	}
+	plan, err := cli.PlanAccess(keyID, principals, acl...)
+	if err != nil {
+		return &ErrorStatus{fmt.Errorf("Failed to plan access change: %s", err.Error()), true}
+	}
+	if len(plan.Changes) == 0 {
+		fmt.Printf("No access changes for the %d checked principals\n", len(principals))
+		return nil
+	}
+	for _, c := range plan.Changes {
+		fmt.Printf("%s %s: %s -> %s\n", c.Principal.Type, c.Principal.ID, accessName(c.Before), accessName(c.After))
+	}
+	return nil
+}
+
+func accessName(a knox.AccessType) string {
+	b, err := a.MarshalJSON()
+	if err != nil {
+		return "Unknown"
+	}
+	return strings.Trim(string(b), `"`)
+}
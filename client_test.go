@@ -2,16 +2,21 @@ package knox
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"reflect"
 	"runtime"
+	"strconv"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMockClient(t *testing.T) {
@@ -42,6 +47,13 @@ func TestMockClient(t *testing.T) {
 
 }
 
+func TestMockClientConcatenated(t *testing.T) {
+	m := NewMock("primary", []string{"active1", "active2"}).(RotationClient)
+	if c := m.GetConcatenated("\n"); c != "primary\nactive1\nactive2\n" {
+		t.Fatalf("Unexpected concatenated versions %q", c)
+	}
+}
+
 func buildGoodResponse(data interface{}) ([]byte, error) {
 	resp := &Response{
 		Status:    "ok",
@@ -148,6 +160,53 @@ func TestGetKey(t *testing.T) {
 	}
 }
 
+func TestGetKeyCollapsesConcurrentCalls(t *testing.T) {
+	resp, err := buildGoodResponse(Key{
+		ID:          "testkey",
+		ACL:         ACL{},
+		VersionList: KeyVersionList{{ID: 1, Data: []byte("data"), Status: Primary}},
+		VersionHash: "VersionHash",
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var requests int32
+	srv := buildServer(200, resp, func(r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	const n = 10
+	keys := make(chan *Key, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			k, err := cli.NetworkGetKey("testkey")
+			if err != nil {
+				t.Errorf("%s is not nil", err)
+			}
+			keys <- k
+		}()
+	}
+	var first *Key
+	for i := 0; i < n; i++ {
+		k := <-keys
+		if k == nil {
+			continue
+		}
+		if first == nil {
+			first = k
+		} else if k == first || &k.VersionList[0] == &first.VersionList[0] {
+			t.Fatal("Expected each caller to get its own copy of the key")
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got >= n {
+		t.Fatalf("Expected concurrent gets to share requests, got %d requests", got)
+	}
+}
+
 func TestGetKeys(t *testing.T) {
 	expected := []string{"a", "b", "c"}
 	resp, err := buildGoodResponse(expected)
@@ -540,3 +599,481 @@ func TestNewFileClient(t *testing.T) {
 		t.Fatal("Unexpected error", err.Error())
 	}
 }
+
+func TestCacheRoot(t *testing.T) {
+	t.Setenv(CacheRootEnv, "")
+	if CacheRoot() != DefaultCacheRoot {
+		t.Fatalf("%s is not %s", CacheRoot(), DefaultCacheRoot)
+	}
+	if f := KeyCacheFolder(CacheRoot()); f != "/var/lib/knox/v0/keys/" {
+		t.Fatalf("%s is not the default key folder", f)
+	}
+
+	root := t.TempDir()
+	t.Setenv(CacheRootEnv, root)
+	if CacheRoot() != root {
+		t.Fatalf("%s is not %s", CacheRoot(), root)
+	}
+
+	kvl := KeyVersionList{{ID: 1, Data: []byte("secret"), Status: Primary, CreationTime: 1}}
+	key := Key{ID: "testkey", ACL: ACL([]Access{}), VersionList: kvl, VersionHash: kvl.Hash()}
+	data, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := KeyCacheFolder(CacheRoot())
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(folder, "testkey"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := MockClient("localhost:0", "")
+	cli.SetCacheRoot(root)
+	k, err := cli.CacheGetKey("testkey")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if k.ID != "testkey" {
+		t.Fatalf("%s is not testkey", k.ID)
+	}
+
+	c := &fileClient{keyID: "testkey", keyFolder: folder}
+	if err := c.update(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if c.GetPrimary() != "secret" {
+		t.Fatalf("%s is not secret", c.GetPrimary())
+	}
+}
+
+func BenchmarkGetKeyCached(b *testing.B) {
+	kvl := KeyVersionList{{ID: 1, Data: []byte("secret"), Status: Primary, CreationTime: 1}}
+	key := Key{
+		ID:          "testkey",
+		ACL:         ACL([]Access{}),
+		VersionList: kvl,
+		VersionHash: kvl.Hash(),
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tempDir := b.TempDir()
+	err = os.WriteFile(path.Join(tempDir, "testkey"), data, 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cli := MockClient("localhost:0", tempDir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cli.GetKey("testkey"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSearchKeys(t *testing.T) {
+	expected := []string{"a", "b"}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "GET" {
+			t.Fatalf("%s is not GET", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/search" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/search")
+		}
+		if r.URL.RawQuery != "owner=teamX&tag=env%3Aprod" {
+			t.Fatalf("%s is not %s", r.URL.RawQuery, "owner=teamX&tag=env%3Aprod")
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	k, err := cli.SearchKeys(url.Values{"owner": {"teamX"}, "tag": {"env:prod"}})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k) != 2 || k[0] != "a" || k[1] != "b" {
+		t.Fatalf("%v is not %v", k, expected)
+	}
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	resp, err := buildGoodResponse("")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "PUT" {
+			t.Fatalf("%s is not PUT", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/testkey/metadata/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/testkey/metadata/")
+		}
+		r.ParseForm()
+		if md := r.PostForm.Get("metadata"); md != `{"env":"prod"}` {
+			t.Fatalf("%s is not %s", md, `{"env":"prod"}`)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+
+	err = cli.UpdateMetadata("testkey", KeyMetadata{"env": "prod"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestGetPrimaryAndPrevious(t *testing.T) {
+	promotedAt := time.Now().Add(-time.Hour).UnixNano()
+	key := &Key{
+		ID: "test",
+		VersionList: KeyVersionList{
+			{ID: 1, Data: []byte("old"), Status: Active},
+			{ID: 2, Data: []byte("new"), Status: Primary},
+		},
+		Metadata: KeyMetadata{
+			MetadataGraceWindow:     "2h",
+			MetadataPreviousPrimary: "1",
+			MetadataPromotedAt:      strconv.FormatInt(promotedAt, 10),
+		},
+	}
+	c := &fileClient{keyID: "test"}
+	c.setValues(key)
+	p, prev := c.GetPrimaryAndPrevious()
+	if p != "new" || prev != "old" {
+		t.Fatalf("Expected new and old, got %q and %q", p, prev)
+	}
+
+	key.Metadata[MetadataGraceWindow] = "30m"
+	c.setValues(key)
+	p, prev = c.GetPrimaryAndPrevious()
+	if p != "new" || prev != "" {
+		t.Fatalf("Expected no previous after the grace window, got %q and %q", p, prev)
+	}
+
+	key.Metadata[MetadataGraceWindow] = "2h"
+	key.VersionList[0].Status = Inactive
+	c.setValues(key)
+	if _, prev = c.GetPrimaryAndPrevious(); prev != "" {
+		t.Fatalf("Expected no previous for an inactive version, got %q", prev)
+	}
+
+	if _, prev = NewMock("primary", nil).(RotationClient).GetPrimaryAndPrevious(); prev != "" {
+		t.Fatalf("Expected no previous for mock, got %q", prev)
+	}
+}
+
+func TestOnRotation(t *testing.T) {
+	key := &Key{
+		ID:          "test",
+		VersionList: KeyVersionList{{ID: 1, Data: []byte("one"), Status: Primary}},
+		VersionHash: "hash1",
+	}
+	c := &fileClient{keyID: "test"}
+	c.setValues(key)
+
+	var calls [][2]Key
+	c.OnRotation(func(old, new Key) {
+		calls = append(calls, [2]Key{old, new})
+	})
+
+	c.refresh(key)
+	if len(calls) != 0 {
+		t.Fatalf("Expected no callbacks without a change, got %d", len(calls))
+	}
+
+	rotated := &Key{
+		ID: "test",
+		VersionList: KeyVersionList{
+			{ID: 1, Data: []byte("one"), Status: Active},
+			{ID: 2, Data: []byte("two"), Status: Primary},
+		},
+		VersionHash: "hash2",
+	}
+	c.refresh(rotated)
+	if len(calls) != 1 {
+		t.Fatalf("Expected one callback, got %d", len(calls))
+	}
+	if calls[0][0].VersionHash != "hash1" || calls[0][1].VersionHash != "hash2" {
+		t.Fatalf("Unexpected callback arguments %+v", calls[0])
+	}
+	if c.GetPrimary() != "two" {
+		t.Fatalf("Expected primary to be updated before callbacks, got %s", c.GetPrimary())
+	}
+}
+
+func TestAPIVersionV1(t *testing.T) {
+	resp, err := buildGoodResponse("")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.URL.Path != "/v1/keys/testkey/metadata/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v1/keys/testkey/metadata/")
+		}
+		if ct := r.Header.Get("Content-Type"); ct != JSONContentType {
+			t.Fatalf("%s is not %s", ct, JSONContentType)
+		}
+		body := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if md := body["metadata"]; md != `{"env":"prod"}` {
+			t.Fatalf("%s is not %s", md, `{"env":"prod"}`)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	cli.SetAPIVersion("v1")
+
+	err = cli.UpdateMetadata("testkey", KeyMetadata{"env": "prod"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestGetKeysV1Pages(t *testing.T) {
+	srv := buildConcurrentServer(200, func(r *http.Request) []byte {
+		if r.URL.Path != "/v1/keys/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v1/keys/")
+		}
+		page := KeyPage{Keys: []string{"a", "b"}, Next: "b"}
+		if r.URL.Query().Get("cursor") == "b" {
+			page = KeyPage{Keys: []string{"c"}}
+		}
+		resp, err := buildGoodResponse(page)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		return resp
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	cli.SetAPIVersion("v1")
+
+	keys, err := cli.GetKeys(map[string]string{})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 3 || keys[2] != "c" {
+		t.Fatalf("Expected a, b, c, got %v", keys)
+	}
+}
+
+func TestUserAgentAndHeaders(t *testing.T) {
+	resp, err := buildGoodResponse("")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "Knox_Client/mock myservice/1.2.3" {
+			t.Fatalf("Unexpected User-Agent %q", ua)
+		}
+		if v := r.Header.Get("X-Request-Source"); v != "batch" {
+			t.Fatalf("Unexpected X-Request-Source %q", v)
+		}
+		if v := r.Header.Get("Authorization"); v != "TESTAUTH" {
+			t.Fatalf("Authorization was replaced with %q", v)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	cli.UncachedClient.Application = "myservice/1.2.3"
+	cli.UncachedClient.Headers = http.Header{
+		"X-Request-Source": {"batch"},
+		"Authorization":    {"spoofed"},
+	}
+
+	if err := cli.UnlockKey("testkey"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+// staticAPIClient serves a single key, reporting it as changed when its
+// version hash differs.
+type staticAPIClient struct {
+	APIClient
+	key     Key
+	fetches int
+}
+
+func (c *staticAPIClient) NetworkGetKey(keyID string) (*Key, error) {
+	c.fetches++
+	k := c.key
+	return &k, nil
+}
+
+func (c *staticAPIClient) GetKeys(versions map[string]string) ([]string, error) {
+	if versions[c.key.ID] != c.key.VersionHash {
+		return []string{c.key.ID}, nil
+	}
+	return []string{}, nil
+}
+
+func TestFileClientWithAPIClient(t *testing.T) {
+	kvl := KeyVersionList{{ID: 1, Data: []byte("a"), Status: Primary}}
+	api := &staticAPIClient{key: Key{ID: "testkey", VersionList: kvl, VersionHash: kvl.Hash()}}
+	c, err := NewFileClientWithOptions("testkey", FileClientOptions{APIClient: api})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if c.GetPrimary() != "a" {
+		t.Fatalf("%s is not a", c.GetPrimary())
+	}
+
+	fc := c.(*managedFileClient)
+	if err := fc.update(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if api.fetches != 1 {
+		t.Fatalf("Expected an unchanged key not to be fetched again, got %d fetches", api.fetches)
+	}
+	kvl = KeyVersionList{{ID: 2, Data: []byte("b"), Status: Primary}, {ID: 1, Data: []byte("a"), Status: Active}}
+	api.key = Key{ID: "testkey", VersionList: kvl, VersionHash: kvl.Hash()}
+	if err := fc.update(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if api.fetches != 2 || c.GetPrimary() != "b" {
+		t.Fatalf("Expected the changed key to be fetched, got %d fetches and primary %s", api.fetches, c.GetPrimary())
+	}
+}
+
+func TestFileClientRefresh(t *testing.T) {
+	kvl := KeyVersionList{{ID: 1, Data: []byte("a"), Status: Primary}}
+	loads := make(chan struct{}, 100)
+	c := &fileClient{keyID: "testkey", load: func() (*Key, error) {
+		loads <- struct{}{}
+		return &Key{ID: "testkey", VersionList: kvl, VersionHash: kvl.Hash()}, nil
+	}}
+	h := c.start(context.Background(), FileClientOptions{Refresh: time.Millisecond, Jitter: time.Millisecond})
+	for i := 0; i < 3; i++ {
+		select {
+		case <-loads:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the key to be refreshed")
+		}
+	}
+	if h.GetPrimary() != "a" {
+		t.Fatalf("%s is not a", h.GetPrimary())
+	}
+
+	c.Close()
+	c.Close()
+	time.Sleep(10 * time.Millisecond)
+	for len(loads) > 0 {
+		<-loads
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(loads) != 0 {
+		t.Fatal("Expected refreshes to stop after close")
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	requests := 0
+	srv := buildServer(200, []byte(`{"status":"ok","code":0,"data":[]}`), func(r *http.Request) {
+		requests++
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String(), "")
+	if _, err := cli.GetKeys(map[string]string{}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := cli.Close(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := cli.GetKeys(map[string]string{}); err != ErrClientClosed {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected no requests after Close, got %d", requests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cli = MockClient(srv.Listener.Addr().String(), "")
+	cli.UncachedClient.Context = ctx
+	cancel()
+	if _, err := cli.GetKeys(map[string]string{}); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestKeyValues(t *testing.T) {
+	kvl := KeyVersionList{
+		{ID: 1, Data: []byte("old"), Status: Inactive},
+		{ID: 2, Data: []byte("previous"), Status: Active},
+		{ID: 3, Data: []byte("current"), Status: Primary},
+		{ID: 4, Data: []byte("next"), Status: Scheduled},
+	}
+	v := NewKeyValues(kvl)
+	if v.Primary != (KeyValue{ID: 3, Data: "current"}) || v.PrimaryData() != "current" {
+		t.Fatalf("Unexpected primary %+v", v.Primary)
+	}
+	if a := v.ActiveData(); !reflect.DeepEqual(a, []string{"previous", "current"}) {
+		t.Fatalf("Unexpected active %q", a)
+	}
+	if i := v.InactiveData(); !reflect.DeepEqual(i, []string{"old"}) {
+		t.Fatalf("Unexpected inactive %q", i)
+	}
+	if m := v.ActiveVersions(); !reflect.DeepEqual(m, map[uint64]string{2: "previous", 3: "current"}) {
+		t.Fatalf("Unexpected active versions %v", m)
+	}
+	if id, ok := v.VersionOf("old"); !ok || id != 1 {
+		t.Fatalf("Unexpected version %d for old", id)
+	}
+	if _, ok := v.VersionOf("next"); ok {
+		t.Fatal("Expected scheduled versions to be left out")
+	}
+	if NewKeyValues(nil).PrimaryData() != "" || len(NewKeyValues(nil).ActiveData()) != 0 {
+		t.Fatal("Expected no values for an empty version list")
+	}
+}
+
+func TestFileClientGetActive(t *testing.T) {
+	kvl := KeyVersionList{
+		{ID: 1, Data: []byte("a"), Status: Active},
+		{ID: 2, Data: []byte("b"), Status: Primary},
+	}
+	c := &fileClient{keyID: "test"}
+	c.setValues(&Key{ID: "test", VersionList: kvl, VersionHash: kvl.Hash()})
+	if a := c.GetActive(); !reflect.DeepEqual(a, []string{"a", "b"}) {
+		t.Fatalf("Unexpected active %q", a)
+	}
+	if id, data := c.GetPrimaryVersion(); id != 2 || data != "b" {
+		t.Fatalf("Unexpected primary version %d %q", id, data)
+	}
+	if v := c.GetActiveVersions(); !reflect.DeepEqual(v, map[uint64]string{1: "a", 2: "b"}) {
+		t.Fatalf("Unexpected active versions %v", v)
+	}
+	// Callers can't change the client's values.
+	c.GetActive()[0] = "changed"
+	if c.GetActive()[0] != "a" {
+		t.Fatal("Expected GetActive to return a copy")
+	}
+}
+
+func TestReportWarnings(t *testing.T) {
+	var warned []string
+	c := &UncachedHTTPClient{Warnf: func(format string, args ...interface{}) {
+		warned = append(warned, fmt.Sprintf(format, args...))
+	}}
+	resp := &Response{Warnings: []string{"please upgrade"}, ServerVersion: "3.1.0"}
+	c.reportWarnings(resp)
+	c.reportWarnings(resp)
+	if len(warned) != 1 || warned[0] != "knox: warning from server 3.1.0: please upgrade" {
+		t.Fatalf("Expected the warning to be reported once with the server version, got %v", warned)
+	}
+}
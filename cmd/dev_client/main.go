@@ -14,6 +14,7 @@ import (
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/client"
+	"github.com/pinterest/knox/tink"
 )
 
 // certPEMBlock is the certificate signed by the CA to identify the machine using the client
@@ -40,16 +41,13 @@ AwEHoUQDQgAEEE23UDaBOf4+poIeBwHW4D8hm7s46RyP8d+Keqj6I3blCvon1Fuj
 G20uWbpo4d9SuQJlmLeI1n1PNkm+rMTylw==
 -----END EC PRIVATE KEY-----`
 
-// hostname is the host running the knox server
-const hostname = "localhost:9000"
+// hostname is the host running the knox server, overridden by $KNOX_SERVER
+var hostname = "localhost:9000"
 
 // tokenEndpoint and clientID are used by "knox login" if your oauth client supports password flows.
 const tokenEndpoint = "https://oauth.token.endpoint.used.for/knox/login"
 const clientID = ""
 
-// keyFolder is the directory where keys are cached
-const keyFolder = "/var/lib/knox/v0/keys/"
-
 // authTokenResp is the format of the OAuth response generated by "knox login"
 type authTokenResp struct {
 	AccessToken string `json:"access_token"`
@@ -104,6 +102,15 @@ func authHandler() string {
 
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
+	if h := os.Getenv("KNOX_SERVER"); h != "" {
+		hostname = h
+	}
+	// KNOX_TINK_TEMPLATES names a JSON file of extra Tink key templates.
+	if f := os.Getenv("KNOX_TINK_TEMPLATES"); f != "" {
+		if err := tink.RegisterKeyTemplatesFromFile(f); err != nil {
+			log.Fatalf("Failed to register tink key templates: %s", err)
+		}
+	}
 
 	tlsConfig := &tls.Config{
 		ServerName:         "knox",
@@ -115,10 +122,13 @@ func main() {
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	cli := &knox.HTTPClient{
-		KeyFolder:      keyFolder,
+	var cli knox.APIClient = &knox.HTTPClient{
+		KeyFolder:      knox.KeyCacheFolder(knox.CacheRoot()),
 		UncachedClient: knox.NewUncachedClient(hostname, &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, authHandler, ""),
 	}
+	if knox.FakeKeysEnabled() {
+		cli = knox.NewFakeAPIClient()
+	}
 
 	loginCommand := client.NewLoginCommand(clientID, tokenEndpoint, "", "", "", "")
 
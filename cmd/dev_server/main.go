@@ -16,11 +16,13 @@ import (
 	"os"
 	"time"
 
+	"github.com/google/tink/go/core/registry"
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/log"
 	"github.com/pinterest/knox/server"
 	"github.com/pinterest/knox/server/auth"
 	"github.com/pinterest/knox/server/keydb"
+	"github.com/pinterest/knox/tink"
 )
 
 const caCert = `-----BEGIN CERTIFICATE-----
@@ -41,21 +43,52 @@ var gitSha = expvar.NewString("version")
 var service = expvar.NewString("service")
 
 var (
-	flagAddr = flag.String("http", ":9000", "HTTP port to listen on")
+	flagAddr              = flag.String("http", ":9000", "HTTP port to listen on")
+	flagDuplicateWarnings = flag.Bool("warn-duplicate-data", false, "Warn when new key data matches another key the principal can read")
+	flagKeyStrength       = flag.String("key-strength", "off", "Analyze the strength of new key data: off, warn, or reject")
+	flagDBDir             = flag.String("db-dir", "", "Keep keys in files under this directory instead of in memory")
+	flagDBFile            = flag.String("db-file", "", "Keep keys in this single file instead of in memory")
+	flagDBConfig          = flag.String("db-config", "", "Open the key store from this JSON file naming a registered keydb driver and its options")
+	flagMaxInFlight       = flag.Int("max-in-flight", 0, "Shed low priority requests once this many requests are being served, 0 for no limit")
+	flagPrincipalInFlight = flag.Int("max-principal-in-flight", 0, "Reject requests from a principal with this many requests being served, 0 for no limit")
+	flagUnsealThreshold   = flag.Int("unseal-threshold", 0, "Start sealed until this many master key shares are submitted with knox admin unseal, 0 to use the dev master key")
+	flagMasterKeyFile     = flag.String("wrapped-master-key", "", "Unseal at startup with the master key in this file, encrypted with -master-key-kms-uri")
+	flagMasterKeyKMSURI   = flag.String("master-key-kms-uri", "", "URI of the KMS key that encrypts -wrapped-master-key")
+	flagKeyEvents         = flag.Bool("key-events", false, "Log an event for every key change through an outbox, with the in memory key store")
+	flagAccessLogFile     = flag.String("access-log-file", "", "Also write the access log to this file, rotated at 100MB")
+	flagAccessLogURL      = flag.String("access-log-url", "", "Also post the access log as newline delimited JSON to this bulk endpoint")
+	flagRecommendedClient = flag.String("recommended-client-version", "", "Warn clients older than this version to upgrade")
+	flagMinimumClient     = flag.String("minimum-client-version", "", "Reject clients older than this version")
+	flagMinimumClientFrom = flag.String("minimum-client-version-from", "", "Only warn clients older than -minimum-client-version until this RFC 3339 time")
+	flagDeletedRetention  = flag.Duration("deleted-key-retention", 0, "Keep deleted keys restorable for this long, 0 to delete them right away")
+	flagSnapshotKeyFile   = flag.String("snapshot-key-file", "", "Enable the admin snapshot routes with the base64 encoded 32 byte key in this file")
+	flagPruneVersions     = flag.Duration("prune-inactive-versions-after", 0, "Remove inactive key versions older than this, 0 to keep them")
+	flagMaxInactive       = flag.Int("max-inactive-versions", 0, "Remove the oldest inactive versions of a key beyond this many, 0 to keep them")
+	flagWebUI             = flag.Bool("web-ui", false, "Serve the web UI for browsing keys at /ui/")
+	flagWebUIChanges      = flag.Bool("web-ui-changes", false, "Let the web UI change versions and delete and restore keys")
 )
 
 const (
-	authTimeout = 10 * time.Second // Calls to auth timeout after 10 seconds
-	serviceName = "knox_dev"
+	authTimeout    = 10 * time.Second // Calls to auth timeout after 10 seconds
+	requestTimeout = 30 * time.Second // Handlers fail after 30 seconds
+	slowRequest    = time.Second      // Requests over a second are logged as slow
+	accessLogSize  = 100 << 20        // Access log files are rotated at 100MB
+	shedLatency    = 5 * time.Second  // Low priority requests are shed while requests average over 5 seconds
+	shedQueue      = time.Second      // Low priority requests wait up to a second for load to drop
+	serviceName    = "knox_dev"
 )
 
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	flag.Parse()
 	accLogger, errLogger := setupLogging("dev", serviceName)
-
-	dbEncryptionKey := []byte("testtesttesttest")
-	cryptor := keydb.NewAESGCMCryptor(0, dbEncryptionKey)
+	var minimumClientFrom time.Time
+	if *flagMinimumClientFrom != "" {
+		var err error
+		if minimumClientFrom, err = time.Parse(time.RFC3339, *flagMinimumClientFrom); err != nil {
+			errLogger.Fatal("Invalid -minimum-client-version-from: ", err)
+		}
+	}
 
 	tlsCert, tlsKey, err := buildCert()
 	if err != nil {
@@ -63,18 +96,141 @@ func main() {
 	}
 
 	db := keydb.NewTempDB()
+	var outbox keydb.Outbox
+	persistent := *flagDBDir != "" || *flagDBFile != "" || *flagDBConfig != ""
+	if *flagKeyEvents && !persistent {
+		outboxDB := keydb.NewTempOutboxDB()
+		db, outbox = outboxDB, outboxDB
+	}
+	if *flagDBDir != "" {
+		fileDB, err := keydb.NewFileDB(*flagDBDir)
+		if err != nil {
+			errLogger.Fatal("Failed to open key directory: ", err)
+		}
+		db = fileDB
+	}
+	if *flagDBFile != "" {
+		if *flagDBDir != "" {
+			errLogger.Fatal("Only one of -db-dir and -db-file can be set")
+		}
+		singleFileDB, err := keydb.NewSingleFileDB(*flagDBFile)
+		if err != nil {
+			errLogger.Fatal("Failed to open key file: ", err)
+		}
+		db = singleFileDB
+	}
+	if *flagDBConfig != "" {
+		if *flagDBDir != "" || *flagDBFile != "" {
+			errLogger.Fatal("-db-config can't be combined with -db-dir or -db-file")
+		}
+		configDB, err := keydb.OpenConfig(*flagDBConfig)
+		if err != nil {
+			errLogger.Fatal("Failed to open key store: ", err)
+		}
+		db = configDB
+	}
+	instrumentedDB := keydb.NewInstrumentedDB(db)
+	db = instrumentedDB
+	if *flagDeletedRetention > 0 {
+		db = keydb.NewTombstoneDB(db, *flagDeletedRetention)
+	}
+
+	var cryptor keydb.Cryptor
+	var unsealer *server.Unsealer
+	if *flagUnsealThreshold > 0 || *flagMasterKeyFile != "" {
+		unsealer = server.NewUnsealer(server.UnsealConfig{
+			Threshold: *flagUnsealThreshold,
+			NewCryptor: func(masterKey []byte) (keydb.Cryptor, error) {
+				return keydb.NewAESGCMCryptor(0, masterKey), nil
+			},
+			Verify: func(c keydb.Cryptor) error {
+				keys, err := db.GetAll()
+				if err != nil || len(keys) == 0 {
+					return err
+				}
+				_, err = c.Decrypt(&keys[0])
+				return err
+			},
+		})
+		cryptor = unsealer.Cryptor()
+		if *flagMasterKeyFile != "" {
+			if err := unwrapMasterKey(unsealer, *flagMasterKeyFile, *flagMasterKeyKMSURI); err != nil {
+				errLogger.Fatal("Failed to unseal with the wrapped master key: ", err)
+			}
+		}
+	} else {
+		dbEncryptionKey := []byte("testtesttesttest")
+		cryptor = keydb.NewAESGCMCryptor(0, dbEncryptionKey)
+	}
 
-	server.AddDefaultAccess(&knox.Access{
-		Type:       knox.UserGroup,
-		ID:         "security-team",
-		AccessType: knox.Admin,
+	var snapshotKey []byte
+	if *flagSnapshotKeyFile != "" {
+		snapshotKey, err = keydb.ReadSnapshotKey(*flagSnapshotKeyFile)
+		if err != nil {
+			errLogger.Fatal("Failed to read the snapshot key: ", err)
+		}
+	}
+
+	strengthPolicy := server.DefaultStrengthPolicy
+	switch *flagKeyStrength {
+	case "off", "warn":
+	case "reject":
+		strengthPolicy.Reject = true
+	default:
+		log.Fatalf("Unknown -key-strength %q", *flagKeyStrength)
+	}
+
+	auditLog := server.NewAuditLog(1000)
+	notifier := server.LogNotifier(errLogger)
+	m := server.NewKeyManagerWithOptions(cryptor, db, server.KeyManagerOptions{
+		DefaultAccess: []knox.Access{{
+			Type:       knox.UserGroup,
+			ID:         "security-team",
+			AccessType: knox.Admin,
+		}},
+		AdminACL: knox.ACL{{Type: knox.UserGroup, ID: "security-team", AccessType: knox.Admin}},
+		AuditLog: auditLog,
+		Unsealer: unsealer,
+		Timeouts: server.TimeoutConfig{
+			Default: server.RouteTimeout{Timeout: requestTimeout, Slow: slowRequest},
+			Logger:  errLogger,
+		},
+		ServerVersion:             "dev",
+		RecommendedClientVersion:  *flagRecommendedClient,
+		MinimumClientVersion:      *flagMinimumClient,
+		EnforceClientVersionAfter: minimumClientFrom,
+		SnapshotKey:               snapshotKey,
+		Idempotency:               server.NewIdempotencyCache(server.DefaultIdempotencyWindow, 10000),
+		DuplicateDataWarnings:     *flagDuplicateWarnings,
+		StrengthPolicy:            &strengthPolicy,
+		DisableStrengthAnalysis:   *flagKeyStrength == "off",
+		Notifier:                  notifier,
+		KeyGenerators: map[string]server.KeyGenerator{
+			"tink": server.KeyGeneratorFunc(tink.GenerateVersion),
+		},
 	})
 
 	certPool := x509.NewCertPool()
 	certPool.AppendCertsFromPEM([]byte(caCert))
 
+	var shippers []*server.LogShipper
+	shipErr := func(err error) { errLogger.Println("Failed to ship access log: ", err) }
+	if *flagAccessLogFile != "" {
+		sink, err := server.NewRotatingFileSink(*flagAccessLogFile, accessLogSize, 5)
+		if err != nil {
+			errLogger.Fatal("Failed to open access log file: ", err)
+		}
+		shippers = append(shippers, server.NewLogShipper(sink, server.LogShipperConfig{OnError: shipErr}))
+	}
+	if *flagAccessLogURL != "" {
+		sink := &server.HTTPBulkSink{URL: *flagAccessLogURL}
+		shippers = append(shippers, server.NewLogShipper(sink, server.LogShipperConfig{OnError: shipErr}))
+	}
+
 	decorators := [](func(http.HandlerFunc) http.HandlerFunc){
-		server.Logger(accLogger),
+		server.Logger(accLogger, shippers...),
+		server.AccessAnalysis(server.NewSimpleDetector(server.DetectorConfig{Notifier: notifier})),
+		server.AccessAnalysis(auditLog),
 		server.AddHeader("Content-Type", "application/json"),
 		server.AddHeader("X-Content-Type-Options", "nosniff"),
 		server.Authentication(
@@ -85,18 +241,87 @@ func main() {
 				auth.NewSpiffeAuthFallbackProvider(certPool),
 			},
 			nil),
+		server.LoadShedding(server.LoadShedConfig{
+			MaxInFlight:  *flagMaxInFlight,
+			MaxLatency:   shedLatency,
+			QueueTimeout: shedQueue,
+			MaxQueue:     100,
+		}),
+		server.PrincipalLimits(server.NewPrincipalLimiter(server.PrincipalLimitConfig{
+			MaxInFlight: *flagPrincipalInFlight,
+		})),
+	}
+	if unsealer != nil {
+		decorators = append(decorators, server.RequireUnsealed(unsealer))
 	}
 
-	r, err := server.GetRouter(cryptor, db, decorators, make([]server.Route, 0))
+	additionalRoutes := make([]server.Route, 0)
+	if *flagWebUI {
+		additionalRoutes = append(additionalRoutes, server.WebUIRoutes(*flagWebUIChanges)...)
+	}
+	r, err := server.GetRouterFromKeyManager(cryptor, m, decorators, additionalRoutes)
 	if err != nil {
 		errLogger.Fatal(err)
 	}
 
+	reaper := &server.ExpiryReaper{Warning: 24 * time.Hour}
+	reaper.Start(m, time.Minute)
+
+	if *flagPruneVersions > 0 || *flagMaxInactive > 0 {
+		pruner := &server.VersionPruner{MaxAge: *flagPruneVersions, MaxInactive: *flagMaxInactive, Audit: auditLog}
+		pruner.Start(m, time.Hour)
+	}
+
+	checker := &server.ConsistencyChecker{}
+	if _, err := checker.Run(m); err != nil {
+		errLogger.Println("Key consistency check failed: ", err)
+	}
+	checker.Start(m, time.Hour)
+	if outbox != nil {
+		dispatcher := &server.OutboxDispatcher{
+			Outbox:   outbox,
+			Consumer: "log",
+			Handlers: []server.EventHandler{server.NotifierEventHandler(notifier)},
+			Trim:     true,
+		}
+		dispatcher.Start(time.Second)
+	}
+
 	http.Handle("/", r)
+	if *flagWebUI {
+		http.Handle("/ui/", http.StripPrefix("/ui/", server.WebUIHandler()))
+	}
+	if unsealer != nil {
+		http.Handle("/healthz", server.HealthHandler(unsealer))
+	}
+	http.Handle("/healthz/keydb", server.DBHealthHandler(db))
+	http.Handle("/metrics/keydb", server.DBStatsHandler(instrumentedDB))
 
 	errLogger.Fatal(serveTLS(tlsCert, tlsKey, *flagAddr))
 }
 
+// unwrapMasterKey decrypts the master key in path with the KMS key at kmsURI
+// and unseals the server with it.
+func unwrapMasterKey(u *server.Unsealer, path, kmsURI string) error {
+	wrapped, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	kms, err := registry.GetKMSClient(kmsURI)
+	if err != nil {
+		return err
+	}
+	aead, err := kms.GetAEAD(kmsURI)
+	if err != nil {
+		return err
+	}
+	masterKey, err := aead.Decrypt(wrapped, nil)
+	if err != nil {
+		return err
+	}
+	return u.Unseal(masterKey)
+}
+
 func setupLogging(gitSha, service string) (*log.Logger, *log.Logger) {
 	accLogger := log.New(os.Stderr, "", 0)
 	accLogger.SetVersion(gitSha)
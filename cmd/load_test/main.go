@@ -0,0 +1,101 @@
+// load_test drives concurrent key reads against a running knox server and
+// reports throughput and latency percentiles. It is meant to be pointed at a
+// dev_server (or a staging deployment) before a release to catch regressions.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+var (
+	flagHost        = flag.String("host", "localhost:9000", "knox server to send requests to")
+	flagKey         = flag.String("key", "", "key ID to read")
+	flagAuth        = flag.String("auth", os.Getenv("KNOX_USER_AUTH"), "authorization header value, e.g. '0utoken'")
+	flagConcurrency = flag.Int("concurrency", 8, "number of concurrent workers")
+	flagDuration    = flag.Duration("duration", 10*time.Second, "how long to run the test")
+	flagInsecure    = flag.Bool("insecure", true, "skip verification of the server certificate")
+)
+
+type result struct {
+	latency time.Duration
+	err     error
+}
+
+func main() {
+	flag.Parse()
+	if *flagKey == "" || *flagAuth == "" {
+		fmt.Fprintln(os.Stderr, "load_test: -key and -auth are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: *flagInsecure},
+		MaxIdleConnsPerHost: *flagConcurrency,
+	}}
+	auth := *flagAuth
+	cli := knox.NewUncachedClient(*flagHost, httpClient, func() string { return auth }, "load_test")
+
+	results := make(chan result, *flagConcurrency*16)
+	deadline := time.Now().Add(*flagDuration)
+	var wg sync.WaitGroup
+	for i := 0; i < *flagConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				_, err := cli.NetworkGetKey(*flagKey)
+				results <- result{time.Since(start), err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var latencies []time.Duration
+	errors := 0
+	var lastErr error
+	for r := range results {
+		if r.err != nil {
+			errors++
+			lastErr = r.err
+			continue
+		}
+		latencies = append(latencies, r.latency)
+	}
+	report(latencies, errors, lastErr)
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func report(latencies []time.Duration, errors int, lastErr error) {
+	total := len(latencies) + errors
+	fmt.Printf("requests: %d (%.1f/s), errors: %d\n", total, float64(total)/flagDuration.Seconds(), errors)
+	if lastErr != nil {
+		fmt.Printf("last error: %s\n", lastErr)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []float64{0.5, 0.9, 0.99, 1} {
+		i := int(p*float64(len(latencies))) - 1
+		if i < 0 {
+			i = 0
+		}
+		fmt.Printf("p%-3.0f %s\n", p*100, latencies[i])
+	}
+}
@@ -1,79 +1,62 @@
+// Command migrate_db copies every key from one keydb backend to another, e.g.
+// from a file DB to Postgres, and verifies the copy. Both backends are opened
+// from keydb configuration files:
+//
+//	migrate_db -from file.json -to postgres.json
+//
+// Keys are copied as stored, still encrypted with the master key. To migrate
+// without downtime, run it while the servers use the old backend until it
+// reports no mismatches, switch the servers to the new backend and run it
+// once more to copy the changes made in between.
 package main
 
 import (
-	"fmt"
+	"flag"
+	"log"
+	"os"
 
-	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/server/keydb"
 )
 
-func moveKeyData(sDB keydb.DB, sCrypt keydb.Cryptor, dDB keydb.DB, dCrypt keydb.Cryptor) error {
-	dbKeys, err := sDB.GetAll()
-	if err != nil {
-		return err
-	}
-	newDBKeys := make([]*keydb.DBKey, 0, len(dbKeys))
-	for _, dbk := range dbKeys {
-		k, err := sCrypt.Decrypt(&dbk)
-		if err != nil {
-			return err
-		}
-		newDBK, err := dCrypt.Encrypt(k)
-		if err != nil {
-			return err
-		}
-		newDBKeys = append(newDBKeys, newDBK)
-	}
+var (
+	flagFrom   = flag.String("from", "", "JSON file configuring the keydb to copy keys from")
+	flagTo     = flag.String("to", "", "JSON file configuring the keydb to copy keys to")
+	flagPrune  = flag.Bool("prune", false, "Remove keys that are only in the destination")
+	flagPasses = flag.Int("passes", 3, "Copy again up to this many times while keys change during a pass")
+)
 
-	err = dDB.Add(newDBKeys...)
-	if err != nil {
-		return err
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+	if *flagFrom == "" || *flagTo == "" || flag.NArg() != 0 || *flagPasses < 1 {
+		flag.Usage()
+		os.Exit(2)
 	}
-	return nil
-}
-
-func generateTestDBWithKeys(crypt keydb.Cryptor) keydb.DB {
-	source := keydb.NewTempDB()
-	d := []byte("test")
-	v1 := knox.KeyVersion{ID: 1, Data: d, Status: knox.Primary, CreationTime: 10}
-	v2 := knox.KeyVersion{ID: 2, Data: d, Status: knox.Active, CreationTime: 10}
-	v3 := knox.KeyVersion{ID: 3, Data: d, Status: knox.Inactive, CreationTime: 10}
-	validKVL := knox.KeyVersionList([]knox.KeyVersion{v1, v2, v3})
-
-	a1 := knox.Access{ID: "testmachine1", AccessType: knox.Admin, Type: knox.Machine}
-	a2 := knox.Access{ID: "testuser", AccessType: knox.Write, Type: knox.User}
-	a3 := knox.Access{ID: "testmachine", AccessType: knox.Read, Type: knox.MachinePrefix}
-	validACL := knox.ACL([]knox.Access{a1, a2, a3})
-
-	key := knox.Key{ID: "test_key", ACL: validACL, VersionList: validKVL, VersionHash: validKVL.Hash()}
-	key2 := knox.Key{ID: "test_key2", ACL: validACL, VersionList: validKVL, VersionHash: validKVL.Hash()}
-
-	dbkey, err := crypt.Encrypt(&key)
+	src, err := keydb.OpenConfig(*flagFrom)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	dbkey2, err := crypt.Encrypt(&key2)
+	dst, err := keydb.OpenConfig(*flagTo)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	source.Add(dbkey, dbkey2)
-	return source
-}
-
-func main() {
-	crypt1 := keydb.NewAESGCMCryptor(0, make([]byte, 16))
-	crypt2 := keydb.NewAESGCMCryptor(1, make([]byte, 16))
-
-	source := generateTestDBWithKeys(crypt1)
-
-	dest := keydb.NewTempDB()
-
-	err := moveKeyData(source, crypt1, dest, crypt2)
-	if err != nil {
-		panic(err)
+	for pass := 1; ; pass++ {
+		result, err := keydb.Migrate(src, dst, *flagPrune)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Pass %d: copied %d keys, updated %d, removed %d and left %d unchanged",
+			pass, result.Copied, result.Updated, result.Removed, result.Unchanged)
+		if len(result.Failed) > 0 {
+			log.Printf("Failed to write %v", result.Failed)
+		}
+		if len(result.Failed) == 0 && len(result.Mismatched) == 0 {
+			log.Printf("Verified that both backends hold the same keys")
+			return
+		}
+		if pass == *flagPasses {
+			log.Fatalf("Keys still differ after %d passes: %v", pass, result.Mismatched)
+		}
 	}
-
-	fmt.Printf("source: %v, dest: %v", source, dest)
-
 }
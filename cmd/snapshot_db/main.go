@@ -0,0 +1,94 @@
+// Command snapshot_db takes and restores encrypted snapshots of a knox key
+// database directly, e.g. for backups from a cron job or to recover a server
+// that can't start. The database is opened from a keydb configuration file:
+//
+//	snapshot_db -db-config db.json -key-file snapshot.key take > knox.snapshot
+//	snapshot_db -db-config db.json -key-file snapshot.key restore < knox.snapshot
+//	snapshot_db genkey > snapshot.key
+//
+// Restoring here doesn't check that the keys can be decrypted with the
+// server's master key; the admin restore route does.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pinterest/knox/server/keydb"
+)
+
+var (
+	flagDBConfig = flag.String("db-config", "", "JSON file naming a registered keydb driver and its options")
+	flagKeyFile  = flag.String("key-file", "", "File with the base64 encoded 32 byte snapshot key")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: snapshot_db [-db-config file -key-file file] take | restore | genkey\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.Arg(0) == "genkey" {
+		key := make([]byte, keydb.SnapshotKeySize)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	if *flagDBConfig == "" || *flagKeyFile == "" {
+		log.Fatal("-db-config and -key-file are required")
+	}
+	key, err := keydb.ReadSnapshotKey(*flagKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := keydb.OpenConfig(*flagDBConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "take":
+		s, err := keydb.TakeSnapshot(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err := s.Encrypt(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := os.Stdout.Write(b); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Took a snapshot of %d keys", len(s.Keys))
+	case "restore":
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, err := keydb.OpenSnapshot(b, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result := keydb.RestoreSnapshot(db, s)
+		log.Printf("Added %d keys, replaced %d and left %d unchanged", result.Added, result.Replaced, result.Unchanged)
+		if len(result.Failed) > 0 {
+			log.Fatalf("Failed to restore %v", result.Failed)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
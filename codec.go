@@ -0,0 +1,140 @@
+package knox
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Media types understood by the knox server and client for API responses.
+const (
+	JSONContentType    = "application/json"
+	MsgpackContentType = "application/msgpack"
+)
+
+// Codec encodes and decodes API responses for a single media type.
+type Codec interface {
+	// ContentType is the media type this codec produces.
+	ContentType() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return JSONContentType
+}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// msgpackCodec reuses the json struct tags so both encodings share field names.
+// Key data is carried as raw bytes instead of base64 strings.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return MsgpackContentType
+}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(w)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+func (c msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	if resp, ok := v.(*Response); ok {
+		return c.decodeResponse(r, resp)
+	}
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// msgpackResponse is a Response with its data left encoded.
+type msgpackResponse struct {
+	Status    string             `json:"status"`
+	Code      int                `json:"code"`
+	Host      string             `json:"host"`
+	Timestamp int64              `json:"ts"`
+	Message   string             `json:"message"`
+	Data      msgpack.RawMessage `json:"data"`
+	Warnings  []string           `json:"warnings,omitempty"`
+	// ServerVersion is the version of the server, if it reports one.
+	ServerVersion string `json:"server_version,omitempty"`
+}
+
+// decodeResponse decodes the data of a response into resp.Data only if it is
+// set. msgpack can't decode the nil data of an error response into the
+// pointer held by resp.Data.
+func (c msgpackCodec) decodeResponse(r io.Reader, resp *Response) error {
+	var m msgpackResponse
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	resp.Status, resp.Code, resp.Host = m.Status, m.Code, m.Host
+	resp.Timestamp, resp.Message, resp.Warnings = m.Timestamp, m.Message, m.Warnings
+	resp.ServerVersion = m.ServerVersion
+	if len(m.Data) == 0 || m.Data[0] == msgpcode.Nil || resp.Data == nil {
+		return nil
+	}
+	return c.Decode(bytes.NewReader(m.Data), resp.Data)
+}
+
+// JSONCodec is the default codec, used whenever no other codec is requested.
+var JSONCodec Codec = jsonCodec{}
+
+// MsgpackCodec encodes responses as MessagePack.
+var MsgpackCodec Codec = msgpackCodec{}
+
+var codecs = map[string]Codec{
+	JSONContentType:    JSONCodec,
+	MsgpackContentType: MsgpackCodec,
+}
+
+// CodecForContentType returns the codec for a Content-Type header value,
+// falling back to JSON for empty or unrecognized values.
+func CodecForContentType(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return JSONCodec
+	}
+	if c, ok := codecs[mediaType]; ok {
+		return c
+	}
+	return JSONCodec
+}
+
+// NegotiateCodec picks a codec based on an Accept header value. Media types
+// are considered in the order listed and the first supported one wins; q
+// values of zero are treated as a refusal. JSON is returned when nothing matches.
+func NegotiateCodec(accept string) Codec {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok && strings.Trim(q, "0.") == "" {
+			continue
+		}
+		if c, ok := codecs[mediaType]; ok {
+			return c
+		}
+	}
+	return JSONCodec
+}
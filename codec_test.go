@@ -0,0 +1,90 @@
+package knox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	cases := map[string]Codec{
+		"":                                      JSONCodec,
+		"*/*":                                   JSONCodec,
+		"application/json":                      JSONCodec,
+		"application/msgpack":                   MsgpackCodec,
+		"text/html, application/msgpack":        MsgpackCodec,
+		"application/msgpack;q=0, */*":          JSONCodec,
+		"application/json, application/msgpack": JSONCodec,
+	}
+	for accept, expected := range cases {
+		if c := NegotiateCodec(accept); c != expected {
+			t.Fatalf("Accept %q: expected %s, got %s", accept, expected.ContentType(), c.ContentType())
+		}
+	}
+}
+
+func TestCodecForContentType(t *testing.T) {
+	if CodecForContentType("application/msgpack") != MsgpackCodec {
+		t.Fatal("Expected msgpack codec")
+	}
+	if CodecForContentType("application/json; charset=utf-8") != JSONCodec {
+		t.Fatal("Expected json codec")
+	}
+	if CodecForContentType("") != JSONCodec {
+		t.Fatal("Expected json codec as default")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	kvl := KeyVersionList{
+		{ID: 1, Data: []byte{0, 1, 2, 255}, Status: Primary, CreationTime: 10},
+		{ID: 2, Data: []byte("active"), Status: Active, CreationTime: 11},
+	}
+	in := Key{
+		ID:          "test",
+		ACL:         ACL{{Type: Machine, ID: "host", AccessType: Read}},
+		VersionList: kvl,
+		VersionHash: kvl.Hash(),
+	}
+	for _, c := range []Codec{JSONCodec, MsgpackCodec} {
+		buf := &bytes.Buffer{}
+		err := c.Encode(buf, &Response{Status: "ok", Data: in})
+		if err != nil {
+			t.Fatalf("%s: %s", c.ContentType(), err)
+		}
+		out := Key{}
+		resp := &Response{Data: &out}
+		err = c.Decode(buf, resp)
+		if err != nil {
+			t.Fatalf("%s: %s", c.ContentType(), err)
+		}
+		if resp.Status != "ok" {
+			t.Fatalf("%s: unexpected status %q", c.ContentType(), resp.Status)
+		}
+		if out.ID != in.ID || out.VersionHash != in.VersionHash || len(out.ACL) != 1 {
+			t.Fatalf("%s: key mismatch %+v", c.ContentType(), out)
+		}
+		if out.ACL[0].AccessType != Read || out.ACL[0].Type != Machine {
+			t.Fatalf("%s: acl mismatch %+v", c.ContentType(), out.ACL)
+		}
+		if len(out.VersionList) != 2 || !bytes.Equal(out.VersionList[0].Data, kvl[0].Data) || out.VersionList[1].Status != Active {
+			t.Fatalf("%s: version mismatch %+v", c.ContentType(), out.VersionList)
+		}
+	}
+}
+
+func TestCodecErrorResponse(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, MsgpackCodec} {
+		buf := &bytes.Buffer{}
+		err := c.Encode(buf, &Response{Status: "error", Code: UnauthorizedCode, Message: "denied"})
+		if err != nil {
+			t.Fatalf("%s: %s", c.ContentType(), err)
+		}
+		resp := &Response{Data: &Key{}}
+		if err := c.Decode(buf, resp); err != nil {
+			t.Fatalf("%s: %s", c.ContentType(), err)
+		}
+		if resp.Status != "error" || resp.Code != UnauthorizedCode || resp.Message != "denied" {
+			t.Fatalf("%s: unexpected response %+v", c.ContentType(), resp)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package knox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// daemonSocketTimeout bounds requests to the daemon, including registrations
+// that wait for the daemon to fetch the key.
+const daemonSocketTimeout = 10 * time.Second
+
+// daemonSocketClient talks to a knox daemon serving keys on a unix socket.
+type daemonSocketClient struct {
+	client *http.Client
+}
+
+func newDaemonSocketClient(socket string) *daemonSocketClient {
+	return &daemonSocketClient{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: daemonSocketTimeout,
+	}}
+}
+
+// register asks the daemon to cache the key and returns it once cached.
+func (d *daemonSocketClient) register(ctx context.Context, keyID string) (*Key, error) {
+	return d.do(ctx, "POST", keyID)
+}
+
+// getKey returns the key cached by the daemon.
+func (d *daemonSocketClient) getKey(ctx context.Context, keyID string) (*Key, error) {
+	return d.do(ctx, "GET", keyID)
+}
+
+func (d *daemonSocketClient) do(ctx context.Context, method, keyID string) (*Key, error) {
+	// The host is ignored, requests always go to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://knox/v0/keys/"+keyID+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Knox daemon socket err: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Knox daemon socket err: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Knox daemon socket err for key %s: %s", keyID, strings.TrimSpace(string(b)))
+	}
+	var key Key
+	if err := json.Unmarshal(b, &key); err != nil {
+		return nil, fmt.Errorf("Knox json decode err: %s", err.Error())
+	}
+	return &key, nil
+}
@@ -0,0 +1,138 @@
+package knox
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Unmarshaler parses key data into v, e.g. json.Unmarshal or yaml.Unmarshal.
+type Unmarshaler func(data []byte, v interface{}) error
+
+// DecodeOptions configures Decode.
+type DecodeOptions[T any] struct {
+	// Unmarshal parses the primary version's data. It defaults to
+	// json.Unmarshal.
+	Unmarshal Unmarshaler
+	// Validate checks a parsed value before it is served.
+	Validate func(*T) error
+	// OnError is called when the primary version after a rotation can't be
+	// parsed or is invalid. The previous value keeps being served. If nil,
+	// errors are logged.
+	OnError func(error)
+}
+
+// Decoded is the value parsed from a key's primary version. It is parsed
+// again whenever the primary version changes.
+type Decoded[T any] struct {
+	opts DecodeOptions[T]
+
+	mu        sync.RWMutex
+	value     T
+	version   uint64
+	data      string
+	parsed    bool
+	callbacks []func(old, new T)
+}
+
+// Decode parses the primary version of the key served by c into a T and keeps
+// it up to date as the key rotates. It fails if the current primary version
+// can't be parsed or is invalid.
+func Decode[T any](c RotationClient, opts DecodeOptions[T]) (*Decoded[T], error) {
+	if opts.Unmarshal == nil {
+		opts.Unmarshal = json.Unmarshal
+	}
+	d := &Decoded[T]{opts: opts}
+	// Registered first so a rotation while parsing the current version isn't
+	// missed.
+	c.OnRotation(func(_, new Key) {
+		if err := d.update(NewKeyValues(new.VersionList).Primary); err != nil {
+			d.reportError(err)
+		}
+	})
+	id, data := c.GetPrimaryVersion()
+	if err := d.update(KeyValue{ID: id, Data: data}); err != nil {
+		return nil, err
+	}
+	// A rotation parsed concurrently may have been replaced by the older
+	// version above.
+	id, data = c.GetPrimaryVersion()
+	if err := d.update(KeyValue{ID: id, Data: data}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DecodeKey is Decode for the key with the given ID, read like NewFileClient
+// does.
+func DecodeKey[T any](keyID string, opts DecodeOptions[T]) (*Decoded[T], error) {
+	c, err := NewFileClientWithOptions(keyID, FileClientOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return Decode(c, opts)
+}
+
+// Get returns the value parsed from the current primary version.
+func (d *Decoded[T]) Get() T {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.value
+}
+
+// Version returns the ID of the primary version the value was parsed from.
+func (d *Decoded[T]) Version() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.version
+}
+
+// OnChange registers a callback that is run after a new primary version is
+// parsed.
+func (d *Decoded[T]) OnChange(f func(old, new T)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.callbacks = append(d.callbacks, f)
+}
+
+// update parses a primary version unless it is the one already parsed.
+func (d *Decoded[T]) update(primary KeyValue) error {
+	d.mu.RLock()
+	current := d.parsed && d.data == primary.Data && d.version == primary.ID
+	d.mu.RUnlock()
+	if current {
+		return nil
+	}
+	var value T
+	if err := d.opts.Unmarshal([]byte(primary.Data), &value); err != nil {
+		return fmt.Errorf("knox: failed to parse key version %d: %w", primary.ID, err)
+	}
+	if d.opts.Validate != nil {
+		if err := d.opts.Validate(&value); err != nil {
+			return fmt.Errorf("knox: invalid key version %d: %w", primary.ID, err)
+		}
+	}
+
+	d.mu.Lock()
+	if d.parsed && d.data == primary.Data && d.version == primary.ID {
+		d.mu.Unlock()
+		return nil
+	}
+	old := d.value
+	d.value, d.version, d.data, d.parsed = value, primary.ID, primary.Data, true
+	callbacks := d.callbacks
+	d.mu.Unlock()
+	for _, f := range callbacks {
+		f(old, value)
+	}
+	return nil
+}
+
+func (d *Decoded[T]) reportError(err error) {
+	if d.opts.OnError != nil {
+		d.opts.OnError(err)
+		return
+	}
+	log.Println(err.Error())
+}
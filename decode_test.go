@@ -0,0 +1,84 @@
+package knox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+func testConfigKey(hash string, versions ...string) *Key {
+	kvl := KeyVersionList{}
+	for i, data := range versions {
+		status := Active
+		if i == len(versions)-1 {
+			status = Primary
+		}
+		kvl = append(kvl, KeyVersion{ID: uint64(i + 1), Data: []byte(data), Status: status})
+	}
+	return &Key{ID: "config", VersionList: kvl, VersionHash: hash}
+}
+
+func TestDecode(t *testing.T) {
+	c := &fileClient{keyID: "config"}
+	c.setValues(testConfigKey("h1", `{"user":"a","password":"one"}`))
+
+	var errs []error
+	d, err := Decode(c, DecodeOptions[testConfig]{
+		Validate: func(v *testConfig) error {
+			if v.Password == "" {
+				return fmt.Errorf("no password")
+			}
+			return nil
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if v := d.Get(); v.User != "a" || v.Password != "one" || d.Version() != 1 {
+		t.Fatalf("Unexpected value %+v at version %d", v, d.Version())
+	}
+	var changes []testConfig
+	d.OnChange(func(old, new testConfig) { changes = append(changes, new) })
+
+	c.refresh(testConfigKey("h2", `{"user":"a","password":"one"}`, `{"user":"a","password":"two"}`))
+	if v := d.Get(); v.Password != "two" || d.Version() != 2 || len(changes) != 1 {
+		t.Fatalf("Expected the rotated version to be parsed, got %+v at version %d", v, d.Version())
+	}
+
+	// Invalid versions are reported and the last good value is kept.
+	c.refresh(testConfigKey("h3", `{"user":"a","password":"one"}`, `{"user":"a","password":"two"}`, `{"user":"a"}`))
+	c.refresh(testConfigKey("h4", `{"user":"a","password":"one"}`, `{"user":"a","password":"two"}`, `{"user":"a"}`, `not json`))
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "no password") {
+		t.Fatalf("Expected two errors, got %v", errs)
+	}
+	if v := d.Get(); v.Password != "two" || d.Version() != 2 || len(changes) != 1 {
+		t.Fatalf("Expected the last good value, got %+v at version %d", v, d.Version())
+	}
+}
+
+func TestDecodeUnmarshaler(t *testing.T) {
+	lines := func(data []byte, v interface{}) error {
+		user, password, ok := strings.Cut(string(data), "\n")
+		if !ok {
+			return fmt.Errorf("expected two lines")
+		}
+		*v.(*testConfig) = testConfig{User: user, Password: password}
+		return nil
+	}
+	d, err := Decode(NewMock("a\nsecret", nil).(RotationClient), DecodeOptions[testConfig]{Unmarshal: lines})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if v := d.Get(); v.User != "a" || v.Password != "secret" {
+		t.Fatalf("Unexpected value %+v", v)
+	}
+	if _, err := Decode[testConfig](NewMock("not json", nil).(RotationClient), DecodeOptions[testConfig]{}); err == nil {
+		t.Fatal("Expected invalid JSON to fail")
+	}
+}
@@ -0,0 +1,294 @@
+package knox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FakeKeysEnv selects fake keys instead of the knox daemon and server when it
+// is set to a true value, e.g. KNOX_FAKE_KEYS=1, so tests and CI pipelines can
+// run code that uses knox without network access or a daemon.
+const FakeKeysEnv = "KNOX_FAKE_KEYS"
+
+// FakeKeysDirEnv is the directory fake keys are read from. Each file is named
+// after a key ID and holds the key as JSON, in the format of the daemon's key
+// cache and `knox get -j`.
+const FakeKeysDirEnv = "KNOX_FAKE_KEYS_DIR"
+
+// FakeKeyEnvPrefix is the prefix of environment variables holding the primary
+// version of a fake key. The rest of the name is the key ID in upper case with
+// every character other than letters and digits replaced by an underscore, e.g.
+// KNOX_FAKE_KEY_TEST_SERVICE_DB_PASSWORD for test_service:db_password. They
+// take precedence over keys in FakeKeysDirEnv.
+const FakeKeyEnvPrefix = "KNOX_FAKE_KEY_"
+
+// ErrFakeKeysReadOnly is returned by the fake client for operations that
+// change keys.
+var ErrFakeKeysReadOnly = fmt.Errorf("Knox fake keys are read only")
+
+// FakeKeysEnabled reports whether FakeKeysEnv selects fake keys.
+func FakeKeysEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(FakeKeysEnv))
+	return enabled
+}
+
+// FakeKeyEnvName returns the environment variable holding the fake key keyID.
+func FakeKeyEnvName(keyID string) string {
+	return FakeKeyEnvPrefix + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, keyID)
+}
+
+// FakeAPIClient is a read only APIClient that resolves keys from environment
+// variables and the directory in FakeKeysDirEnv. Keys are read again on every
+// call, so tests can change them between calls.
+type FakeAPIClient struct {
+	// Dir is the directory of JSON keys, FakeKeysDirEnv if empty.
+	Dir string
+}
+
+// NewFakeAPIClient returns an APIClient for the fake keys in the environment.
+func NewFakeAPIClient() *FakeAPIClient {
+	return &FakeAPIClient{}
+}
+
+func (c *FakeAPIClient) dir() string {
+	if c.Dir != "" {
+		return c.Dir
+	}
+	return os.Getenv(FakeKeysDirEnv)
+}
+
+func (c *FakeAPIClient) readKey(keyID string) (*Key, error) {
+	if data, ok := os.LookupEnv(FakeKeyEnvName(keyID)); ok {
+		kvl := KeyVersionList{{ID: 1, Data: []byte(data), Status: Primary}}
+		return &Key{ID: keyID, ACL: ACL{}, VersionList: kvl, VersionHash: kvl.Hash()}, nil
+	}
+	dir := c.dir()
+	if dir == "" || keyID == "" || strings.ContainsAny(keyID, `/\`) || keyID == "." || keyID == ".." {
+		return nil, fmt.Errorf("Key identifer does not exist")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, keyID))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Key identifer does not exist")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Knox fake key err: %s", err.Error())
+	}
+	var key Key
+	if err := json.Unmarshal(b, &key); err != nil {
+		return nil, fmt.Errorf("Knox fake key %s json decode err: %s", keyID, err.Error())
+	}
+	key.ID = keyID
+	if key.ACL == nil {
+		key.ACL = ACL{}
+	}
+	if key.VersionHash == "" {
+		key.VersionHash = key.VersionList.Hash()
+	}
+	return &key, nil
+}
+
+// keyIDs lists the fake keys in the directory. Keys only set in the
+// environment can't be listed, since variable names don't map back to IDs.
+func (c *FakeAPIClient) keyIDs() []string {
+	if c.dir() == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(c.dir())
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids
+}
+
+func (c *FakeAPIClient) GetKey(keyID string) (*Key, error) {
+	return c.GetKeyWithStatus(keyID, Active)
+}
+
+func (c *FakeAPIClient) CacheGetKey(keyID string) (*Key, error) {
+	return c.GetKey(keyID)
+}
+
+func (c *FakeAPIClient) NetworkGetKey(keyID string) (*Key, error) {
+	return c.GetKey(keyID)
+}
+
+func (c *FakeAPIClient) GetKeyWithStatus(keyID string, status VersionStatus) (*Key, error) {
+	key, err := c.readKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case Inactive:
+	case Active:
+		key.VersionList = key.VersionList.GetActive()
+	case Primary:
+		p := key.VersionList.GetPrimary()
+		if p == nil {
+			return nil, fmt.Errorf("Knox fake key %s has no primary version", keyID)
+		}
+		key.VersionList = KeyVersionList{*p}
+	default:
+		return nil, ErrInvalidStatus
+	}
+	return key, nil
+}
+
+func (c *FakeAPIClient) CacheGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error) {
+	return c.GetKeyWithStatus(keyID, status)
+}
+
+func (c *FakeAPIClient) NetworkGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error) {
+	return c.GetKeyWithStatus(keyID, status)
+}
+
+// GetKeys returns the keys whose version hash differs from the one given.
+func (c *FakeAPIClient) GetKeys(keys map[string]string) ([]string, error) {
+	var updated []string
+	for id, hash := range keys {
+		if k, err := c.GetKey(id); err == nil && k.VersionHash != hash {
+			updated = append(updated, id)
+		}
+	}
+	return updated, nil
+}
+
+func (c *FakeAPIClient) SyncKeys(versions map[string]string) (*KeySync, error) {
+	s := &KeySync{Keys: []Key{}, Errors: map[string]APIError{}}
+	for id, hash := range versions {
+		k, err := c.GetKey(id)
+		if err != nil {
+			s.Errors[id] = APIError{Code: KeyIdentifierDoesNotExistCode, Message: err.Error()}
+		} else if k.VersionHash != hash {
+			s.Keys = append(s.Keys, *k)
+		}
+	}
+	return s, nil
+}
+
+func (c *FakeAPIClient) GetACL(keyID string) (*ACL, error) {
+	k, err := c.readKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &k.ACL, nil
+}
+
+// SearchKeys returns the IDs of keys in the fake key directory with all tags
+// in the query. Other search filters are ignored.
+func (c *FakeAPIClient) SearchKeys(query url.Values) ([]string, error) {
+	ids := []string{}
+	for _, id := range c.keyIDs() {
+		k, err := c.readKey(id)
+		if err != nil {
+			continue
+		}
+		match := true
+		for _, tag := range query["tag"] {
+			name, value, _ := strings.Cut(tag, ":")
+			if v, ok := k.Metadata[name]; !ok || v != value {
+				match = false
+			}
+		}
+		if match {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (c *FakeAPIClient) PlanAccess(keyID string, principals []PlanPrincipal, acl ...Access) (*ACLPlan, error) {
+	return nil, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) CreateKey(keyID string, data []byte, acl ACL) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) CreateKeyWithContentType(keyID string, data []byte, acl ACL, contentType string) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) DeleteKey(keyID string) error {
+	return ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) PutAccess(keyID string, acl ...Access) error {
+	return ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) PutAccessIfHash(keyID, versionHash string, acl ...Access) error {
+	return ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) AddVersion(keyID string, data []byte) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) AddVersionWithContentType(keyID string, data []byte, contentType string) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) AddVersionIfHash(keyID string, data []byte, contentType, versionHash string) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) AddScheduledVersion(keyID string, data []byte, activation time.Time) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) RotateKey(keyID string, promote bool) (uint64, error) {
+	return 0, ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) UpdateVersion(keyID, versionID string, status VersionStatus) error {
+	return ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) UpdateMetadata(keyID string, md KeyMetadata) error {
+	return ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) LockKey(keyID, message string) error {
+	return ErrFakeKeysReadOnly
+}
+
+func (c *FakeAPIClient) UnlockKey(keyID string) error {
+	return ErrFakeKeysReadOnly
+}
+
+// Close does nothing, the fake keys are read from disk on every call.
+func (c *FakeAPIClient) Close() error {
+	return nil
+}
+
+// newFakeClient returns a Client for a fake key that is read again on every
+// refresh.
+func newFakeClient(ctx context.Context, keyID string, opts FileClientOptions) (RotationClient, error) {
+	f := NewFakeAPIClient()
+	key, err := f.GetKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	c := &fileClient{keyID: keyID, load: func() (*Key, error) { return f.GetKey(keyID) }}
+	c.setValues(key)
+	return c.start(ctx, opts), nil
+}
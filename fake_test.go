@@ -0,0 +1,88 @@
+package knox
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFakeKeyEnvName(t *testing.T) {
+	if n := FakeKeyEnvName("test_service:db.password"); n != "KNOX_FAKE_KEY_TEST_SERVICE_DB_PASSWORD" {
+		t.Fatalf("Unexpected variable name %s", n)
+	}
+}
+
+func TestFakeAPIClient(t *testing.T) {
+	dir := t.TempDir()
+	kvl := KeyVersionList{
+		{ID: 1, Data: []byte("old"), Status: Inactive},
+		{ID: 2, Data: []byte("primary"), Status: Primary},
+		{ID: 3, Data: []byte("active"), Status: Active},
+	}
+	b, err := json.Marshal(Key{VersionList: kvl, Metadata: KeyMetadata{"team": "infra"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "service:file"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FakeKeysDirEnv, dir)
+	t.Setenv(FakeKeyEnvName("service:env"), "from env")
+	c := NewFakeAPIClient()
+
+	k, err := c.GetKey("service:file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.ID != "service:file" || len(k.VersionList) != 2 || k.VersionHash != kvl.Hash() {
+		t.Fatalf("Unexpected key %+v", k)
+	}
+	k, err = c.GetKeyWithStatus("service:file", Inactive)
+	if err != nil || len(k.VersionList) != 3 {
+		t.Fatalf("Expected all versions, got %+v, %v", k, err)
+	}
+	k, err = c.GetKey("service:env")
+	if err != nil || string(k.VersionList.GetPrimary().Data) != "from env" {
+		t.Fatalf("Expected key from the environment, got %+v, %v", k, err)
+	}
+	if _, err := c.GetKey("service:missing"); err == nil {
+		t.Fatal("Expected an error for a missing key")
+	}
+	if _, err := c.GetKey("../service:file"); err == nil {
+		t.Fatal("Expected an error for a key outside the directory")
+	}
+	if _, err := c.CreateKey("service:new", []byte("data"), ACL{}); err != ErrFakeKeysReadOnly {
+		t.Fatalf("Expected read only error, got %v", err)
+	}
+
+	s, err := c.SyncKeys(map[string]string{"service:file": "", "service:env": k.VersionHash, "service:missing": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Keys) != 1 || s.Keys[0].ID != "service:file" || s.Errors["service:missing"].Code != KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Unexpected sync %+v", s)
+	}
+
+	ids, err := c.SearchKeys(url.Values{"tag": {"team:infra"}})
+	if err != nil || len(ids) != 1 || ids[0] != "service:file" {
+		t.Fatalf("Unexpected search result %v, %v", ids, err)
+	}
+	ids, _ = c.SearchKeys(url.Values{"tag": {"team:other"}})
+	if len(ids) != 0 {
+		t.Fatalf("Expected no keys, got %v", ids)
+	}
+}
+
+func TestFakeFileClient(t *testing.T) {
+	t.Setenv(FakeKeysEnv, "1")
+	t.Setenv(FakeKeyEnvName("service:env"), "secret")
+	c, err := NewFileClient("service:env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GetPrimary() != "secret" {
+		t.Fatalf("Expected fake primary, got %q", c.GetPrimary())
+	}
+}
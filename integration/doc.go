@@ -0,0 +1,14 @@
+// Package integration holds end-to-end tests that run a knox server with TLS
+// and its real authentication providers, then exercise it through the client
+// library and the dev_client command line tool.
+//
+// The tests are behind the integration build tag:
+//
+//	go test -tags integration ./integration/
+//
+// Keys are stored in Redis when $KNOX_INTEGRATION_REDIS is set to its
+// address, and in memory otherwise. docker-compose.yml in this directory
+// starts Redis and runs the tests against it:
+//
+//	docker compose -f integration/docker-compose.yml run --rm tests
+package integration
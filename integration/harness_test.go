@@ -0,0 +1,221 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// RedisEnv is the address of the Redis server used as the key database.
+const RedisEnv = "KNOX_INTEGRATION_REDIS"
+
+// adminUser is the user the mock GitHub provider authenticates every user
+// token as.
+const adminUser = "testuser"
+
+// harness is a knox server listening with TLS, with mTLS, SPIFFE and user
+// authentication and an audit log.
+type harness struct {
+	t      *testing.T
+	host   string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPool *x509.CertPool
+	audit  *server.AuditLog
+}
+
+func newHarness(t *testing.T) *harness {
+	h := &harness{t: t}
+	h.ca, h.caKey = h.newCA()
+	h.caPool = x509.NewCertPool()
+	h.caPool.AddCert(h.ca)
+
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	h.audit = server.NewAuditLog(1000)
+	m := server.NewKeyManagerWithOptions(cryptor, newDB(t), server.KeyManagerOptions{
+		AdminACL: knox.ACL{{Type: knox.User, ID: adminUser, AccessType: knox.Admin}},
+		AuditLog: h.audit,
+	})
+
+	decorators := [](func(http.HandlerFunc) http.HandlerFunc){
+		server.AccessAnalysis(h.audit),
+		server.AddHeader("Content-Type", "application/json"),
+		server.Authentication([]auth.Provider{
+			auth.NewMTLSAuthProvider(h.caPool),
+			auth.NewSpiffeAuthProvider(h.caPool),
+			auth.MockGitHubProvider(),
+		}, nil),
+	}
+	r, err := server.GetRouterFromKeyManager(cryptor, m, decorators, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(r)
+	srv.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+		Certificates: []tls.Certificate{h.cert(x509.Certificate{
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	h.host = srv.Listener.Addr().String()
+	return h
+}
+
+// newDB returns a RedisDB with a prefix unique to the test if $RedisEnv is
+// set, and a TempDB otherwise.
+func newDB(t *testing.T) keydb.DB {
+	addr := os.Getenv(RedisEnv)
+	if addr == "" {
+		t.Logf("%s is not set, keeping keys in memory", RedisEnv)
+		return keydb.NewTempDB()
+	}
+	c, err := dialRedis(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to redis at %s: %s", addr, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return keydb.NewRedisDB(c, fmt.Sprintf("knox-integration-%d:", time.Now().UnixNano()))
+}
+
+func (h *harness) newCA() (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "knox integration CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return ca, key
+}
+
+// cert issues a certificate from the test CA with the names and usages of
+// template.
+func (h *harness) cert(template x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, &template, h.ca, &key.PublicKey, h.caKey)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// machineCert issues a client certificate for the machine hostname.
+func (h *harness) machineCert(hostname string) tls.Certificate {
+	return h.cert(x509.Certificate{
+		Subject:     pkix.Name{CommonName: hostname},
+		DNSNames:    []string{hostname},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// serviceCert issues a client certificate for a SPIFFE ID.
+func (h *harness) serviceCert(spiffeID string) tls.Certificate {
+	u, err := url.Parse(spiffeID)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return h.cert(x509.Certificate{
+		URIs:        []*url.URL{u},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// client returns a client verifying the server with the test CA, presenting
+// cert if it is not nil and sending the authorization header auth.
+func (h *harness) client(cert *tls.Certificate, auth string) *knox.UncachedHTTPClient {
+	tlsConfig := &tls.Config{RootCAs: h.caPool, ServerName: "localhost"}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return knox.NewUncachedClient(h.host, httpClient, func() string { return auth }, "integration")
+}
+
+// userClient returns a client authenticated as adminUser.
+func (h *harness) userClient() *knox.UncachedHTTPClient {
+	return h.client(nil, "0u"+"token")
+}
+
+// cli runs the dev_client binary against the server as adminUser, with stdin
+// as its input, and returns its output.
+func (h *harness) cli(bin, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(),
+		"KNOX_SERVER="+h.host,
+		"KNOX_USER_AUTH=token",
+		knox.CacheRootEnv+"="+h.t.TempDir(),
+	)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// buildCLI builds the dev_client binary.
+func buildCLI(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "knox")
+	out, err := exec.Command("go", "build", "-o", bin, "github.com/pinterest/knox/cmd/dev_client").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to build dev_client: %s\n%s", err, out)
+	}
+	return bin
+}
+
+// newKeyID returns a key ID that is not used by earlier runs against the same
+// database.
+func newKeyID(name string) string {
+	return fmt.Sprintf("integration_%d:%s", time.Now().UnixNano(), name)
+}
@@ -0,0 +1,204 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+const serviceID = "spiffe://example.com/integration"
+
+func TestClientAuthModes(t *testing.T) {
+	h := newHarness(t)
+	keyID := newKeyID("auth_modes")
+
+	acl := knox.ACL{
+		{Type: knox.Machine, ID: "machine1.example.com", AccessType: knox.Read},
+		{Type: knox.Service, ID: serviceID, AccessType: knox.Read},
+	}
+	user := h.userClient()
+	if _, err := user.CreateKey(keyID, []byte("first"), acl); err != nil {
+		t.Fatalf("Failed to create key: %s", err)
+	}
+	if _, err := user.AddVersion(keyID, []byte("second")); err != nil {
+		t.Fatalf("Failed to add version: %s", err)
+	}
+
+	machineCert := h.machineCert("machine1.example.com")
+	machine := h.client(&machineCert, "0t"+"machine1.example.com")
+	k, err := machine.NetworkGetKey(keyID)
+	if err != nil {
+		t.Fatalf("Machine failed to get key: %s", err)
+	}
+	if string(k.VersionList.GetPrimary().Data) != "first" || len(k.VersionList) != 2 {
+		t.Fatalf("Unexpected key for machine: %+v", k.VersionList)
+	}
+
+	serviceCert := h.serviceCert(serviceID)
+	// The SPIFFE provider ignores the token, but the header must have one.
+	service := h.client(&serviceCert, "0s"+"spiffe")
+	if _, err := service.NetworkGetKey(keyID); err != nil {
+		t.Fatalf("Service failed to get key: %s", err)
+	}
+
+	// A machine the ACL doesn't name is authenticated but not authorized.
+	otherCert := h.machineCert("machine2.example.com")
+	other := h.client(&otherCert, "0t"+"machine2.example.com")
+	if _, err := other.NetworkGetKey(keyID); err == nil {
+		t.Fatal("Expected a machine outside the ACL to be denied")
+	}
+
+	// A certificate for one machine can't be used to claim another.
+	spoof := h.client(&otherCert, "0t"+"machine1.example.com")
+	if _, err := spoof.NetworkGetKey(keyID); err == nil {
+		t.Fatal("Expected a mismatched machine token to be rejected")
+	}
+
+	// Certificates from another CA are rejected.
+	foreign := &harness{t: t}
+	foreign.ca, foreign.caKey = foreign.newCA()
+	untrusted := foreign.machineCert("machine1.example.com")
+	if _, err := h.client(&untrusted, "0t"+"machine1.example.com").NetworkGetKey(keyID); err == nil {
+		t.Fatal("Expected a certificate from an unknown CA to be rejected")
+	}
+
+	if _, err := machine.AddVersion(keyID, []byte("third")); err == nil {
+		t.Fatal("Expected a reader to be denied writes")
+	}
+
+	events, err := user.AdminAuditLog(url.Values{"key": {keyID}})
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %s", err)
+	}
+	type seen struct {
+		principal, principalType, route string
+		success                         bool
+	}
+	got := map[seen]int{}
+	for _, e := range events {
+		got[seen{e.Principal, e.PrincipalType, e.RouteID, e.Success}]++
+	}
+	want := []seen{
+		{adminUser, "user", "postversion", true},
+		{"machine1.example.com", "machine", "getkey", true},
+		{serviceID, "service", "getkey", true},
+		{"machine2.example.com", "machine", "getkey", false},
+		{"machine1.example.com", "machine", "postversion", false},
+	}
+	for _, w := range want {
+		if got[w] != 1 {
+			t.Errorf("Expected one audit event %+v, got %d", w, got[w])
+		}
+	}
+	// Creation is recorded without a key ID since the ID is in the body, and
+	// requests that fail authentication have no principal to record.
+	if len(events) != len(want) {
+		t.Errorf("Expected %d audit events, got %+v", len(want), events)
+	}
+}
+
+func TestClientVersionLifecycle(t *testing.T) {
+	h := newHarness(t)
+	keyID := newKeyID("lifecycle")
+	c := h.userClient()
+
+	if _, err := c.CreateKey(keyID, []byte("v1"), knox.ACL{}); err != nil {
+		t.Fatalf("Failed to create key: %s", err)
+	}
+	v2, err := c.AddVersion(keyID, []byte("v2"))
+	if err != nil {
+		t.Fatalf("Failed to add version: %s", err)
+	}
+	k, err := c.NetworkGetKey(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := k.VersionList.GetPrimary().ID
+	if err := c.UpdateVersion(keyID, strconv.FormatUint(v2, 10), knox.Primary); err != nil {
+		t.Fatalf("Failed to promote version: %s", err)
+	}
+	if err := c.UpdateVersion(keyID, strconv.FormatUint(v1, 10), knox.Inactive); err != nil {
+		t.Fatalf("Failed to deactivate version: %s", err)
+	}
+	k, err = c.NetworkGetKey(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := k.VersionList.GetPrimary(); p.ID != v2 || string(p.Data) != "v2" || len(k.VersionList) != 1 {
+		t.Fatalf("Unexpected versions after rotation: %+v", k.VersionList)
+	}
+	k, err = c.NetworkGetKeyWithStatus(keyID, knox.Inactive)
+	if err != nil || len(k.VersionList) != 2 {
+		t.Fatalf("Expected the inactive version to be kept, got %v, %v", k, err)
+	}
+
+	if err := c.PutAccessIfHash(keyID, "stale", knox.Access{Type: knox.Machine, ID: "m", AccessType: knox.Read}); err == nil {
+		t.Fatal("Expected a stale version hash to be rejected")
+	}
+	if err := c.PutAccessIfHash(keyID, k.VersionHash, knox.Access{Type: knox.Machine, ID: "m", AccessType: knox.Read}); err != nil {
+		t.Fatalf("Failed to update access: %s", err)
+	}
+	acl, err := c.GetACL(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, a := range *acl {
+		found = found || (a.Type == knox.Machine && a.ID == "m")
+	}
+	if !found {
+		t.Fatalf("Expected the ACL to contain the machine, got %+v", acl)
+	}
+}
+
+func TestCLI(t *testing.T) {
+	h := newHarness(t)
+	bin := buildCLI(t)
+	keyID := newKeyID("cli")
+
+	run := func(stdin string, args ...string) string {
+		t.Helper()
+		out, err := h.cli(bin, stdin, args...)
+		if err != nil {
+			t.Fatalf("knox %s failed: %s\n%s", strings.Join(args, " "), err, out)
+		}
+		return out
+	}
+
+	run("cli secret", "create", keyID)
+	if out := run("", "get", "-n", keyID); !strings.Contains(out, "cli secret") {
+		t.Fatalf("Expected the key data, got %q", out)
+	}
+	run("rotated", "add", keyID)
+	if out := run("", "versions", keyID); strings.Count(strings.TrimSpace(out), "\n") != 1 {
+		t.Fatalf("Expected two versions, got %q", out)
+	}
+	run("", "access", "-r", "-M", keyID, "machine1.example.com")
+	if out := run("", "acl", keyID); !strings.Contains(out, "machine1.example.com") {
+		t.Fatalf("Expected the machine in the ACL, got %q", out)
+	}
+
+	machineCert := h.machineCert("machine1.example.com")
+	k, err := h.client(&machineCert, "0t"+"machine1.example.com").NetworkGetKey(keyID)
+	if err != nil {
+		t.Fatalf("Machine failed to get key written by the CLI: %s", err)
+	}
+	if string(k.VersionList.GetPrimary().Data) != "cli secret" {
+		t.Fatalf("Unexpected primary version %q", k.VersionList.GetPrimary().Data)
+	}
+
+	if out, err := h.cli(bin, "", "get", "-n", newKeyID("missing")); err == nil {
+		t.Fatalf("Expected getting a missing key to fail, got %q", out)
+	}
+
+	events := h.audit.Events(adminUser, keyID, 100)
+	if len(events) < 5 {
+		t.Fatalf("Expected the CLI requests in the audit log, got %+v", events)
+	}
+}
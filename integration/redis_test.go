@@ -0,0 +1,134 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// respClient is a minimal keydb.RedisClient speaking the Redis protocol, so
+// the tests don't need a Redis library.
+type respClient struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRedis(addr string) (*respClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &respClient{addr: addr, conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *respClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *respClient) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writeCommand(c.conn, args); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func (c *respClient) Subscribe(ctx context.Context, channel string, f func(string)) error {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if err := writeCommand(conn, []interface{}{"SUBSCRIBE", channel}); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]interface{})
+		if ok && len(msg) == 3 && fmt.Sprintf("%s", msg[0]) == "message" {
+			f(fmt.Sprintf("%s", msg[2]))
+		}
+	}
+}
+
+func writeCommand(conn net.Conn, args []interface{}) error {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		var s []byte
+		switch v := a.(type) {
+		case []byte:
+			s = v
+		default:
+			s = []byte(fmt.Sprint(v))
+		}
+		b = append(b, "$"+strconv.Itoa(len(s))+"\r\n"...)
+		b = append(b, s...)
+		b = append(b, "\r\n"...)
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: short reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,67 @@
+// Package singleflight collapses concurrent calls for the same key into one,
+// so a popular key that misses a cache is loaded once instead of once per
+// caller.
+package singleflight
+
+import (
+	"errors"
+	"sync"
+)
+
+// errPanicked is returned to callers waiting on a call that panicked.
+var errPanicked = errors.New("singleflight: call panicked")
+
+type call[T any] struct {
+	wg   sync.WaitGroup
+	val  T
+	err  error
+	dups int
+}
+
+// Group runs at most one call per key at a time. The zero value is ready to
+// use.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+// Do runs fn and returns its result, unless a call for key is already running,
+// in which case it waits for that call and returns its result instead. shared
+// reports whether the result was given to more than one caller, who must not
+// modify it.
+func (g *Group[T]) Do(key string, fn func() (T, error)) (v T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*call[T]{}
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &call[T]{err: errPanicked}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		shared = c.dups > 0
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
+
+// Forget makes later calls for key start a new call rather than wait for one
+// already running, e.g. after key was changed.
+func (g *Group[T]) Forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, key)
+}
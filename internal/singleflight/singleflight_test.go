@@ -0,0 +1,115 @@
+package singleflight
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoCollapsesCalls(t *testing.T) {
+	var g Group[int]
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, s := g.Do("k", fn)
+			if v != 42 || err != nil {
+				t.Errorf("Unexpected result %d, %v", v, err)
+			}
+			if s {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	// Wait for the callers to join the first call.
+	for {
+		g.mu.Lock()
+		c := g.calls["k"]
+		joined := c != nil && c.dups == 9
+		g.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("Expected one call, got %d", calls)
+	}
+	if shared != 10 {
+		t.Fatalf("Expected every caller to see a shared result, got %d", shared)
+	}
+
+	if _, _, s := g.Do("k", func() (int, error) { return 1, nil }); s {
+		t.Fatal("Expected a lone call not to be shared")
+	}
+}
+
+func TestDoErrorsAndPanics(t *testing.T) {
+	var g Group[int]
+	errTest := errors.New("test")
+	if _, err, _ := g.Do("k", func() (int, error) { return 0, errTest }); err != errTest {
+		t.Fatalf("Expected the error of the call, got %v", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.Do("p", func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err, _ := g.Do("p", func() (int, error) { return 1, nil })
+		done <- err
+	}()
+	for {
+		g.mu.Lock()
+		joined := g.calls["p"] != nil && g.calls["p"].dups == 1
+		g.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-done; err != errPanicked {
+		t.Fatalf("Expected waiters of a panicked call to get an error, got %v", err)
+	}
+}
+
+func TestForget(t *testing.T) {
+	var g Group[int]
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go g.Do("k", func() (int, error) {
+		close(started)
+		<-release
+		return 1, nil
+	})
+	<-started
+	g.Forget("k")
+	v, _, _ := g.Do("k", func() (int, error) { return 2, nil })
+	close(release)
+	if v != 2 {
+		t.Fatalf("Expected a new call after Forget, got %d", v)
+	}
+}
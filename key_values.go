@@ -0,0 +1,85 @@
+package knox
+
+// KeyValue is the data of one key version with the version's ID, so
+// consumers can tell which version produced a value.
+type KeyValue struct {
+	ID   uint64
+	Data string
+}
+
+// KeyValues is the projection of a key's version list that a Client serves.
+type KeyValues struct {
+	// Primary is the primary version. Its Data is empty if there is none.
+	Primary KeyValue
+	// Active holds the primary and active versions in version list order.
+	Active []KeyValue
+	// Inactive holds the inactive versions in version list order.
+	Inactive []KeyValue
+}
+
+// NewKeyValues projects a version list. Scheduled versions are left out.
+func NewKeyValues(kvl KeyVersionList) KeyValues {
+	var v KeyValues
+	for _, kv := range kvl {
+		value := KeyValue{ID: kv.ID, Data: string(kv.Data)}
+		switch kv.Status {
+		case Primary:
+			v.Primary = value
+			v.Active = append(v.Active, value)
+		case Active:
+			v.Active = append(v.Active, value)
+		case Inactive:
+			v.Inactive = append(v.Inactive, value)
+		}
+	}
+	return v
+}
+
+// PrimaryData returns the data of the primary version.
+func (v KeyValues) PrimaryData() string {
+	return v.Primary.Data
+}
+
+// ActiveData returns the data of the primary and active versions.
+func (v KeyValues) ActiveData() []string {
+	return valuesData(v.Active)
+}
+
+// InactiveData returns the data of the inactive versions.
+func (v KeyValues) InactiveData() []string {
+	return valuesData(v.Inactive)
+}
+
+// ActiveVersions returns the data of the primary and active versions by
+// version ID.
+func (v KeyValues) ActiveVersions() map[uint64]string {
+	m := make(map[uint64]string, len(v.Active)+1)
+	if v.Primary != (KeyValue{}) {
+		m[v.Primary.ID] = v.Primary.Data
+	}
+	for _, value := range v.Active {
+		m[value.ID] = value.Data
+	}
+	return m
+}
+
+// VersionOf returns the ID of the primary, active or inactive version with
+// the given data.
+func (v KeyValues) VersionOf(data string) (uint64, bool) {
+	for _, values := range [][]KeyValue{v.Active, v.Inactive} {
+		for _, value := range values {
+			if value.Data == data {
+				return value.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func valuesData(values []KeyValue) []string {
+	data := make([]string, 0, len(values))
+	for _, value := range values {
+		data = append(data, value.Data)
+	}
+	return data
+}
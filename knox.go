@@ -2,15 +2,20 @@
 package knox
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net/url"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -24,25 +29,35 @@ var (
 	ErrACLInvalidServicePrefixTooShort = fmt.Errorf("Service prefix too short, path of namespace for prefix needs to be longer.")
 
 	ErrInvalidKeyID       = fmt.Errorf("KeyID can only contain alphanumeric characters, colons, and underscores.")
+	ErrInvalidMetadataKey = fmt.Errorf("Metadata keys can only contain alphanumeric characters, dots, dashes, and underscores.")
+	ErrInvalidGraceWindow = fmt.Errorf("Grace window must be a positive duration, e.g. 24h.")
+	ErrInvalidMaxReads    = fmt.Errorf("Max reads must be a positive integer.")
+	ErrInvalidExpiry      = fmt.Errorf("Expiry must be an RFC 3339 time and the expiry action must be 'refuse' or 'delete'.")
 	ErrInvalidVersionHash = fmt.Errorf("Hash does not match")
 
 	ErrInactiveToPrimary = fmt.Errorf("Version must be Active to promote to Primary")
 	ErrPrimaryToActive   = fmt.Errorf("Primary Key can not be demoted. Specify Active key to promote.")
 	ErrPrimaryToInactive = fmt.Errorf("Version must be Active to demote to Inactive")
+	ErrRemoveNotInactive = fmt.Errorf("Version must be Inactive to remove it")
 
 	ErrMulitplePrimary = fmt.Errorf("More than one Primary key")
 	ErrSameVersionID   = fmt.Errorf("Repeated Version ID")
 
 	ErrInvalidStatus      = fmt.Errorf("Invalid Status")
+	ErrNoActivationTime   = fmt.Errorf("Scheduled versions require an activation time")
 	ErrKeyVersionNotFound = fmt.Errorf("Key version not found")
 	ErrKeyIDNotFound      = fmt.Errorf("KeyID not found")
 	ErrKeyExists          = fmt.Errorf("Key Exists")
+	ErrKeyReadsExhausted  = fmt.Errorf("Key has no reads remaining")
+	ErrKeyExpired         = fmt.Errorf("Key has expired")
 )
 
 const (
 	spiffeScheme = "spiffe"
 )
 
+var metadataKeyRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
 // InvalidTypeError is an error for to throw when in the json conversion.
 type invalidTypeError struct {
 	badType string
@@ -67,6 +82,10 @@ const (
 	Active
 	// Inactive represents Key Versions no longer in use.
 	Inactive
+	// Scheduled represents Key Versions that become Primary at their
+	// ActivationTime. Until then they are only returned when all versions,
+	// including Inactive ones, are requested.
+	Scheduled
 )
 
 // UnmarshalJSON parses JSON input to set an VersionStatus.
@@ -78,6 +97,8 @@ func (s *VersionStatus) UnmarshalJSON(b []byte) error {
 		*s = Active
 	case `"Inactive"`:
 		*s = Inactive
+	case `"Scheduled"`:
+		*s = Scheduled
 	default:
 		return invalidTypeError{"VersionStatus"}
 	}
@@ -93,6 +114,8 @@ func (s VersionStatus) MarshalJSON() ([]byte, error) {
 		return json.Marshal("Active")
 	case Inactive:
 		return json.Marshal("Inactive")
+	case Scheduled:
+		return json.Marshal("Scheduled")
 	default:
 		return nil, invalidTypeError{"VersionStatus"}
 	}
@@ -307,14 +330,20 @@ type Access struct {
 // Validate ensures the ACL is of valid form. Not specifying the same group
 // or id more than once.
 func (acl ACL) Validate() error {
-	for i, a := range acl {
+	type entry struct {
+		t  PrincipalType
+		id string
+	}
+	counts := make(map[entry]int, len(acl))
+	for _, a := range acl {
+		counts[entry{a.Type, a.ID}]++
+	}
+	for _, a := range acl {
 		if a.AccessType == None {
 			return ErrACLContainsNone
 		}
-		for j, b := range acl {
-			if i != j && a.ID == b.ID && a.Type == b.Type {
-				return ErrACLDuplicateEntries
-			}
+		if counts[entry{a.Type, a.ID}] > 1 {
+			return ErrACLDuplicateEntries
 		}
 	}
 	return nil
@@ -347,6 +376,48 @@ type KeyVersion struct {
 	Data         []byte        `json:"data"`
 	Status       VersionStatus `json:"status"`
 	CreationTime int64         `json:"ts"`
+	// ActivationTime is when a Scheduled version becomes Primary, in Unix
+	// nanoseconds.
+	ActivationTime int64 `json:"activation,omitempty"`
+	// ContentType is the optional media type of Data, e.g. ContentTypePEM.
+	ContentType string `json:"content_type,omitempty"`
+	// StatusTime is when Status last changed, in Unix nanoseconds. Zero means
+	// it hasn't changed since CreationTime.
+	StatusTime int64 `json:"status_ts,omitempty"`
+}
+
+// Well known content types of key data. Other media types may also be used.
+const (
+	ContentTypeJSON       = "application/json"
+	ContentTypePEM        = "application/x-pem-file"
+	ContentTypeTinkKeyset = "tink-keyset"
+	// ContentTypeTinkEncryptedKeyset is a Tink keyset encrypted with the KMS
+	// key named by the key's MetadataTinkKMSKeyURI.
+	ContentTypeTinkEncryptedKeyset = "tink-encrypted-keyset"
+)
+
+var contentTypeRegexp = regexp.MustCompile(`^[a-zA-Z0-9!#$&^_.+-]{1,64}(/[a-zA-Z0-9!#$&^_.+-]{1,64})?$`)
+
+// ValidContentType returns true if contentType is empty or looks like a media
+// type.
+func ValidContentType(contentType string) bool {
+	return contentType == "" || contentTypeRegexp.MatchString(contentType)
+}
+
+// ValidateContent checks that data is well formed for contentType. Content
+// types other than JSON and PEM are not checked.
+func ValidateContent(contentType string, data []byte) error {
+	switch contentType {
+	case ContentTypeJSON:
+		if !json.Valid(data) {
+			return fmt.Errorf("key data is not valid JSON")
+		}
+	case ContentTypePEM:
+		if block, _ := pem.Decode(data); block == nil {
+			return fmt.Errorf("key data does not contain a PEM block")
+		}
+	}
+	return nil
 }
 
 // KeyVersionList represents the list of versions of a key. This will grow as the
@@ -354,7 +425,7 @@ type KeyVersion struct {
 type KeyVersionList []KeyVersion
 
 // Len, Swap, and Less are included to provide a consistant ordering for Key
-// Version lists. This is necessary to hash the list consistantly.
+// Version lists: Primary, then Active, then Inactive, each by version id.
 
 // Len returns the length of the key version list.
 func (kvl KeyVersionList) Len() int {
@@ -382,6 +453,245 @@ type Key struct {
 	VersionHash string         `json:"hash"`
 	Path        string         `json:"path,omitempty"`
 	TinkKeyset  string         `json:"tinkKeyset,omitempty"`
+	// Metadata holds non-secret attributes of the key such as tags.
+	Metadata KeyMetadata `json:"metadata,omitempty"`
+}
+
+// Copy returns a copy of the key whose ACL, versions and metadata can be
+// modified independently. Version data is shared.
+func (k *Key) Copy() *Key {
+	c := *k
+	if k.ACL != nil {
+		c.ACL = append(ACL{}, k.ACL...)
+	}
+	if k.VersionList != nil {
+		c.VersionList = append(KeyVersionList{}, k.VersionList...)
+	}
+	c.Metadata = k.Metadata.Copy()
+	return &c
+}
+
+// KeyMetadata is a set of non-secret string attributes attached to a key.
+// It is stored unencrypted so it can be searched without decrypting keys.
+type KeyMetadata map[string]string
+
+// Copy returns a copy of the metadata that can be modified independently.
+func (md KeyMetadata) Copy() KeyMetadata {
+	if md == nil {
+		return nil
+	}
+	c := make(KeyMetadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+// Update returns a copy of the metadata with the given entries applied.
+// Entries with an empty value are removed.
+func (md KeyMetadata) Update(changes KeyMetadata) KeyMetadata {
+	c := md.Copy()
+	for k, v := range changes {
+		if v == "" {
+			delete(c, k)
+			continue
+		}
+		if c == nil {
+			c = KeyMetadata{}
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// Reserved metadata entries used to mark a key as deprecated. The value of
+// MetadataDeprecated is a message for consumers and MetadataReplacement holds
+// the ID of the key they should move to.
+const (
+	MetadataDeprecated  = "knox.deprecated"
+	MetadataReplacement = "knox.replacement"
+)
+
+// MetadataHoneytoken marks a key as a canary credential. Every read of a
+// honeytoken key is reported to the server's notifier, whether or not the
+// reader is authorized.
+const MetadataHoneytoken = "knox.honeytoken"
+
+// IsHoneytoken reports whether the metadata marks the key as a honeytoken.
+func (md KeyMetadata) IsHoneytoken() bool {
+	return md[MetadataHoneytoken] == "true"
+}
+
+// MetadataNextActivation holds the earliest activation time of the key's
+// Scheduled versions in Unix nanoseconds. It is maintained by the server so
+// that due activations can be found without decrypting keys.
+const MetadataNextActivation = "knox.next_activation"
+
+// Rotation grace window metadata. MetadataGraceWindow is set by key admins to
+// a duration (e.g. "24h") during which consumers should keep accepting the
+// previous primary after a rotation. The server maintains
+// MetadataPreviousPrimary and MetadataPromotedAt (Unix nanoseconds) whenever
+// the primary version changes.
+const (
+	MetadataGraceWindow     = "knox.grace_window"
+	MetadataPreviousPrimary = "knox.previous_primary"
+	MetadataPromotedAt      = "knox.promoted_at"
+)
+
+// PreviousPrimary returns the version that was primary before the most recent
+// rotation if the key's grace window has not yet elapsed at now and the
+// version is still present in the version list. Otherwise it returns nil.
+func (k Key) PreviousPrimary(now time.Time) *KeyVersion {
+	window, err := time.ParseDuration(k.Metadata[MetadataGraceWindow])
+	if err != nil {
+		return nil
+	}
+	promotedAt, err := strconv.ParseInt(k.Metadata[MetadataPromotedAt], 10, 64)
+	if err != nil || now.After(time.Unix(0, promotedAt).Add(window)) {
+		return nil
+	}
+	id, err := strconv.ParseUint(k.Metadata[MetadataPreviousPrimary], 10, 64)
+	if err != nil {
+		return nil
+	}
+	for _, v := range k.VersionList {
+		if v.ID == id && v.Status == Active {
+			return &v
+		}
+	}
+	return nil
+}
+
+// MetadataGenerator selects how the server creates new versions when a key is
+// rotated through the API, as "<generator>:<spec>", e.g. "random:32" for 32
+// random bytes or "tink:TINK_AEAD_AES256_GCM" for a Tink key template.
+const MetadataGenerator = "knox.generator"
+
+// MetadataTinkKMSKeyURI is the URI of the KMS key that encrypts the Tink
+// keysets of a key, e.g. "aws-kms://arn:aws:kms:...". New versions of such
+// keys hold encrypted keysets, so the cleartext keyset is never stored in knox.
+const MetadataTinkKMSKeyURI = "knox.tink_kms_key_uri"
+
+// MetadataShamirShare marks a key holding one share of a secret split with
+// Shamir's scheme, as "<threshold>-of-<parts>". The shares of a secret split
+// into key ID are the keys "<key ID>:share_<n>", for n from 1 to parts.
+const MetadataShamirShare = "knox.shamir_share"
+
+// MetadataStrength ("ok" or "weak") and MetadataEntropyBits record the
+// server's analysis of the most recently written version of a key.
+const (
+	MetadataStrength    = "knox.strength"
+	MetadataEntropyBits = "knox.entropy_bits"
+)
+
+// MetadataLocked marks a key as locked during incident response. Its value is
+// the operator message returned to clients whose reads are refused.
+const MetadataLocked = "knox.locked"
+
+// LockMessage returns the operator message and true if the key is locked.
+func (md KeyMetadata) LockMessage() (string, bool) {
+	msg, ok := md[MetadataLocked]
+	return msg, ok
+}
+
+// Read limit metadata. MetadataMaxReads is set by key admins to the total
+// number of times the key's data may be read, e.g. "1" for a bootstrap token
+// that is read once. The server counts reads in MetadataReadCount; removing it
+// allows the key to be read again.
+const (
+	MetadataMaxReads  = "knox.max_reads"
+	MetadataReadCount = "knox.read_count"
+)
+
+// RemainingReads returns the number of reads left and true if the metadata
+// limits the number of reads of the key.
+func (md KeyMetadata) RemainingReads() (int, bool) {
+	max, err := strconv.Atoi(md[MetadataMaxReads])
+	if err != nil {
+		return 0, false
+	}
+	count, _ := strconv.Atoi(md[MetadataReadCount])
+	if count >= max {
+		return 0, true
+	}
+	return max - count, true
+}
+
+// Key expiry metadata. MetadataExpiresAt is set by key admins to an RFC 3339
+// time after which the server refuses to return the key's data.
+// MetadataExpiryAction selects what else happens at that time: ExpiryRefuse,
+// the default, only refuses reads and ExpiryDelete deletes the key.
+const (
+	MetadataExpiresAt    = "knox.expires_at"
+	MetadataExpiryAction = "knox.expiry_action"
+)
+
+// Expiry actions.
+const (
+	ExpiryRefuse = "refuse"
+	ExpiryDelete = "delete"
+)
+
+// ExpiresAt returns the time the key expires and true if it has an expiry.
+func (md KeyMetadata) ExpiresAt() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, md[MetadataExpiresAt])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// KeyDeprecation describes why a key is deprecated and what replaces it.
+type KeyDeprecation struct {
+	Message     string
+	Replacement string
+}
+
+// String formats the deprecation as a warning suitable for logging.
+func (d KeyDeprecation) String() string {
+	s := "deprecated: " + d.Message
+	if d.Replacement != "" {
+		s += fmt.Sprintf(" (use %s instead)", d.Replacement)
+	}
+	return s
+}
+
+// Deprecation returns the deprecation notice on the metadata, or nil if the
+// key is not deprecated.
+func (md KeyMetadata) Deprecation() *KeyDeprecation {
+	msg, ok := md[MetadataDeprecated]
+	if !ok {
+		return nil
+	}
+	return &KeyDeprecation{Message: msg, Replacement: md[MetadataReplacement]}
+}
+
+// Validate checks that metadata keys are well formed.
+func (md KeyMetadata) Validate() error {
+	for k := range md {
+		if !metadataKeyRegexp.MatchString(k) {
+			return ErrInvalidMetadataKey
+		}
+	}
+	if v, ok := md[MetadataGraceWindow]; ok {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return ErrInvalidGraceWindow
+		}
+	}
+	if v, ok := md[MetadataMaxReads]; ok {
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			return ErrInvalidMaxReads
+		}
+	}
+	if v, ok := md[MetadataExpiresAt]; ok {
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return ErrInvalidExpiry
+		}
+	}
+	if v, ok := md[MetadataExpiryAction]; ok && v != ExpiryRefuse && v != ExpiryDelete {
+		return ErrInvalidExpiry
+	}
+	return nil
 }
 
 // Validate calls makes sure all attributes of key are in good state.
@@ -400,6 +710,9 @@ func (k Key) Validate() error {
 	if vlistErr != nil {
 		return vlistErr
 	}
+	if mdErr := k.Metadata.Validate(); mdErr != nil {
+		return mdErr
+	}
 	if k.VersionHash != k.VersionList.Hash() {
 		return ErrInvalidVersionHash
 	}
@@ -408,7 +721,16 @@ func (k Key) Validate() error {
 
 // GetActive returns the active keys in a KeyVersionList.
 func (kvl KeyVersionList) GetActive() KeyVersionList {
-	var ks KeyVersionList
+	n := 0
+	for _, k := range kvl {
+		if k.Status == Active || k.Status == Primary {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	ks := make(KeyVersionList, 0, n)
 	for _, k := range kvl {
 		if k.Status == Active || k.Status == Primary {
 			ks = append(ks, k)
@@ -417,6 +739,34 @@ func (kvl KeyVersionList) GetActive() KeyVersionList {
 	return ks
 }
 
+// Concat returns the data of the primary version followed by the other active
+// versions in order of their IDs, each terminated by sep unless its data
+// already ends with it. This is the natural form of CA bundles, known_hosts
+// and authorized_keys files, where every active version must be trusted during
+// a rotation.
+func (kvl KeyVersionList) Concat(sep string) []byte {
+	active := kvl.GetActive()
+	sort.SliceStable(active, func(i, j int) bool {
+		if (active[i].Status == Primary) != (active[j].Status == Primary) {
+			return active[i].Status == Primary
+		}
+		return active[i].ID < active[j].ID
+	})
+	size := 0
+	for _, v := range active {
+		size += len(v.Data) + len(sep)
+	}
+	var buf bytes.Buffer
+	buf.Grow(size)
+	for _, v := range active {
+		buf.Write(v.Data)
+		if !bytes.HasSuffix(v.Data, []byte(sep)) {
+			buf.WriteString(sep)
+		}
+	}
+	return buf.Bytes()
+}
+
 // GetPrimary returns the primary key in a KeyVersionList.
 func (kvl KeyVersionList) GetPrimary() *KeyVersion {
 	for _, k := range kvl {
@@ -440,6 +790,9 @@ func (kvl KeyVersionList) Validate() error {
 		if _, ok := versionToData[kv.ID]; ok {
 			return ErrSameVersionID
 		}
+		if kv.Status == Scheduled && kv.ActivationTime == 0 {
+			return ErrNoActivationTime
+		}
 		versionToData[kv.ID] = kv.Data
 	}
 	if primaryCount != 1 {
@@ -450,32 +803,93 @@ func (kvl KeyVersionList) Validate() error {
 
 // Hash computes the Sha256 hash of the ordered key versions.
 // The hash ordering is the Primary version id followed by all
-// Active version id in numeric order.
+// Active version id in numeric order. Inactive versions contribute
+// zero padding so the hash also changes with the total version count.
+// Only the Primary and Active ids are sorted and the list itself is
+// left untouched.
+// Hashing allocates and sorts, so it is computed once when the versions
+// change and stored in Key.VersionHash, which readers use instead.
 func (kvl KeyVersionList) Hash() string {
 	sizeInt64 := 8
-	sort.Sort(kvl)
-	buf := make([]byte, sizeInt64*len(kvl))
-	offset := 0
+	// A valid list has a single Primary, but the hash is also used to
+	// detect invalid lists so any number of them is handled.
+	ids := make([]uint64, 0, len(kvl))
+	for _, kv := range kvl {
+		if kv.Status == Primary {
+			ids = append(ids, kv.ID)
+		}
+	}
+	primaryCount := len(ids)
 	for _, kv := range kvl {
-		if kv.Status != Inactive {
-			binary.LittleEndian.PutUint64(buf[offset:], kv.ID)
-			offset += sizeInt64
+		if kv.Status == Active {
+			ids = append(ids, kv.ID)
 		}
 	}
+	slices.Sort(ids[:primaryCount])
+	slices.Sort(ids[primaryCount:])
+
+	buf := make([]byte, sizeInt64*len(kvl))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(buf[i*sizeInt64:], id)
+	}
 	hash := sha256.Sum256(buf)
 	return hex.EncodeToString(hash[0:32])
+}
+
+// NextActivation returns the earliest activation time of the Scheduled
+// versions, or zero if there are none.
+func (kvl KeyVersionList) NextActivation() int64 {
+	var next int64
+	for _, kv := range kvl {
+		if kv.Status == Scheduled && (next == 0 || kv.ActivationTime < next) {
+			next = kv.ActivationTime
+		}
+	}
+	return next
+}
 
+// ActivateScheduled returns a copy of the list where every Scheduled version
+// with an activation time at or before now has been promoted to Primary, in
+// order of activation time, demoting the previous Primary to Active. The
+// second return value is false, and the list is returned as is, if no
+// version was due.
+func (kvl KeyVersionList) ActivateScheduled(now int64) (KeyVersionList, bool) {
+	var due []int
+	for i, kv := range kvl {
+		if kv.Status == Scheduled && kv.ActivationTime <= now {
+			due = append(due, i)
+		}
+	}
+	if len(due) == 0 {
+		return kvl, false
+	}
+	sort.SliceStable(due, func(a, b int) bool {
+		return kvl[due[a]].ActivationTime < kvl[due[b]].ActivationTime
+	})
+	out := make(KeyVersionList, len(kvl))
+	copy(out, kvl)
+	for _, i := range due {
+		for j := range out {
+			if out[j].Status == Primary {
+				out[j].Status = Active
+			}
+		}
+		out[i].Status = Primary
+	}
+	return out, true
 }
 
 // Update changes the status of a particular key version. It also updates any
 // other key versions that need to be updated. Acceptable changes are
-// Active -> Primary, Active -> Inactive, and Inactive -> Active.
+// Active -> Primary, Active -> Inactive, and Inactive -> Active. Scheduled
+// versions may be promoted early to Primary or cancelled by making them
+// Inactive.
 func (kvl KeyVersionList) Update(versionID uint64, s VersionStatus) (KeyVersionList, error) {
 	for i, v := range kvl {
 		if v.ID == versionID {
 			switch s {
 			case Primary:
-				if v.Status != Active {
+				if v.Status != Active && v.Status != Scheduled {
 					return nil, ErrInactiveToPrimary
 				}
 				for j, v2 := range kvl {
@@ -490,10 +904,12 @@ func (kvl KeyVersionList) Update(versionID uint64, s VersionStatus) (KeyVersionL
 				}
 				kvl[i].Status = Active
 			case Inactive:
-				if v.Status != Active {
+				if v.Status != Active && v.Status != Scheduled {
 					return nil, ErrPrimaryToInactive
 				}
 				kvl[i].Status = Inactive
+			default:
+				return nil, ErrInvalidStatus
 			}
 			return kvl, nil
 		}
@@ -529,9 +945,18 @@ type PrincipalMux struct {
 
 // CanAccess will check the principals in order of adding, and the first
 // Principal that provides at least the AccessType requested will be used.
+// The ACL is indexed once and shared by all principals that support it.
 func (p PrincipalMux) CanAccess(acl ACL, accessType AccessType) bool {
+	var idx *ACLIndex
 	for _, p := range p.allPrincipals {
-		if p.CanAccess(acl, accessType) {
+		if ip, ok := p.(IndexedPrincipal); ok {
+			if idx == nil {
+				idx = NewACLIndex(acl)
+			}
+			if ip.CanAccessIndex(idx, accessType) {
+				return true
+			}
+		} else if p.CanAccess(acl, accessType) {
 			return true
 		}
 	}
@@ -605,8 +1030,53 @@ const (
 	BadRequestDataCode
 	BadKeyFormatCode
 	BadPrincipalIdentifier
+	KeyLockedCode
+	RequestTimeoutCode
+	KeyReadsExhaustedCode
+	KeyExpiredCode
+	KeyVersionHashMismatchCode
+	OverloadedCode
+	SealedCode
+	TooManyRequestsCode
+	ClientVersionTooOldCode
 )
 
+// DeletedKey is a deleted key that can still be restored. Times are in Unix
+// nanoseconds; the key is purged at PurgeAt.
+type DeletedKey struct {
+	ID        string `json:"id"`
+	ACL       ACL    `json:"acl"`
+	DeletedAt int64  `json:"deleted_at"`
+	PurgeAt   int64  `json:"purge_at"`
+}
+
+// KeyPage is a page of key IDs returned by the v1 API. Next is the cursor for
+// the following page and is empty on the last page.
+type KeyPage struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// KeySync is the response to a differential sync of keys. Keys are the keys
+// whose version hash changed and Errors holds, by key ID, why a changed key
+// could not be returned. Register lists keys the daemon should start caching,
+// e.g. because a deploy is prewarming them.
+type KeySync struct {
+	Keys     []Key               `json:"keys"`
+	Errors   map[string]APIError `json:"errors,omitempty"`
+	Register []string            `json:"register,omitempty"`
+}
+
+// APIError is an error response from the api server.
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
 // Response is the format for responses from the api server.
 type Response struct {
 	Status    string      `json:"status"`
@@ -615,6 +1085,11 @@ type Response struct {
 	Timestamp int64       `json:"ts"`
 	Message   string      `json:"message"`
 	Data      interface{} `json:"data"`
+	// Warnings are non fatal problems with a successful request, such as
+	// deprecated parameters or an outdated client.
+	Warnings []string `json:"warnings,omitempty"`
+	// ServerVersion is the version of the server, if it reports one.
+	ServerVersion string `json:"server_version,omitempty"`
 }
 
 // AccessCallbackInput is the input to the access callback function.
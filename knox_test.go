@@ -3,6 +3,10 @@ package knox_test
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 
 	. "github.com/pinterest/knox"
@@ -10,9 +14,9 @@ import (
 
 func TestKeyVersionListHash(t *testing.T) {
 	d := []byte("test")
-	v1 := KeyVersion{1, d, Primary, 10}
-	v2 := KeyVersion{2, d, Active, 10}
-	v3 := KeyVersion{3, d, Active, 10}
+	v1 := KeyVersion{1, d, Primary, 10, 0, "", 0}
+	v2 := KeyVersion{2, d, Active, 10, 0, "", 0}
+	v3 := KeyVersion{3, d, Active, 10, 0, "", 0}
 	versions := []KeyVersion{v1, v2, v3}
 	statuses := []VersionStatus{Active, Inactive}
 	hashes := map[string]string{}
@@ -33,11 +37,38 @@ func TestKeyVersionListHash(t *testing.T) {
 	}
 }
 
+func TestKeyVersionListHashStable(t *testing.T) {
+	// These values were produced by the original sort-based implementation and
+	// are stored in existing databases, so they must never change.
+	kvl := KeyVersionList{
+		{ID: 7, Status: Inactive},
+		{ID: 3, Status: Active},
+		{ID: 9, Status: Primary},
+		{ID: 1, Status: Active},
+		{ID: 5, Status: Inactive},
+	}
+	if h := kvl.Hash(); h != "46e8f63f88a77bcf6570613bfd84e3575cfef58b6c2f2b541320faa206b514f6" {
+		t.Fatalf("Unexpected hash %s", h)
+	}
+	if kvl[0].ID != 7 || kvl[4].ID != 5 {
+		t.Fatal("Hash should not reorder the version list")
+	}
+
+	multiplePrimary := KeyVersionList{
+		{ID: 4, Status: Primary},
+		{ID: 2, Status: Primary},
+		{ID: 8, Status: Active},
+	}
+	if h := multiplePrimary.Hash(); h != "cfb5600bf3bd6d8df706fa64554db0e12d713526f623ba9f1aa5405a8b7f7c3c" {
+		t.Fatalf("Unexpected hash %s", h)
+	}
+}
+
 func TestKeyVersionListUpdate(t *testing.T) {
 	d := []byte("test")
-	v1 := KeyVersion{1, d, Primary, 10}
-	v2 := KeyVersion{2, d, Active, 10}
-	v3 := KeyVersion{3, d, Inactive, 10}
+	v1 := KeyVersion{1, d, Primary, 10, 0, "", 0}
+	v2 := KeyVersion{2, d, Active, 10, 0, "", 0}
+	v3 := KeyVersion{3, d, Inactive, 10, 0, "", 0}
 	kvl := KeyVersionList([]KeyVersion{v1, v2, v3})
 	_, Primary2PrimaryErr := kvl.Update(v1.ID, Primary)
 	if Primary2PrimaryErr == nil {
@@ -286,10 +317,10 @@ func TestAccessTypeCanAccess(t *testing.T) {
 
 func TestKeyValidate(t *testing.T) {
 	d := []byte("test")
-	v1 := KeyVersion{1, d, Primary, 10}
-	v2 := KeyVersion{2, d, Active, 10}
-	v3 := KeyVersion{3, d, Inactive, 10}
-	v4 := KeyVersion{3, d, Active, 10}
+	v1 := KeyVersion{1, d, Primary, 10, 0, "", 0}
+	v2 := KeyVersion{2, d, Active, 10, 0, "", 0}
+	v3 := KeyVersion{3, d, Inactive, 10, 0, "", 0}
+	v4 := KeyVersion{3, d, Active, 10, 0, "", 0}
 	validKVL := KeyVersionList([]KeyVersion{v1, v2, v3})
 	invalidKVL := KeyVersionList([]KeyVersion{v1, v2, v3, v4})
 
@@ -333,21 +364,21 @@ func TestKeyValidate(t *testing.T) {
 
 func TestKeyVersionListValidate(t *testing.T) {
 	d := []byte("test")
-	v1 := KeyVersion{1, d, Primary, 10}
-	v2 := KeyVersion{2, d, Active, 10}
-	v3 := KeyVersion{3, d, Inactive, 10}
+	v1 := KeyVersion{1, d, Primary, 10, 0, "", 0}
+	v2 := KeyVersion{2, d, Active, 10, 0, "", 0}
+	v3 := KeyVersion{3, d, Inactive, 10, 0, "", 0}
 	validKVL := KeyVersionList([]KeyVersion{v1, v2, v3})
 	if validKVL.Validate() != nil {
 		t.Error("Valid KVL should be valid")
 	}
 
-	v4 := KeyVersion{3, d, Active, 10}
+	v4 := KeyVersion{3, d, Active, 10, 0, "", 0}
 	dupKVL := KeyVersionList([]KeyVersion{v1, v2, v3, v4})
 	if dupKVL.Validate() == nil {
 		t.Error("Duplicate version id, KVL should be invalid.")
 	}
 
-	v5 := KeyVersion{4, d, Primary, 10}
+	v5 := KeyVersion{4, d, Primary, 10, 0, "", 0}
 	twoPrimaryKVL := KeyVersionList([]KeyVersion{v1, v2, v3, v5})
 	if twoPrimaryKVL.Validate() == nil {
 		t.Error("KVL with two primary versions should be invalid.")
@@ -356,9 +387,9 @@ func TestKeyVersionListValidate(t *testing.T) {
 
 func TestKVLGetActive(t *testing.T) {
 	d := []byte("test")
-	v1 := KeyVersion{1, d, Primary, 10}
-	v2 := KeyVersion{2, d, Active, 10}
-	v3 := KeyVersion{3, d, Inactive, 10}
+	v1 := KeyVersion{1, d, Primary, 10, 0, "", 0}
+	v2 := KeyVersion{2, d, Active, 10, 0, "", 0}
+	v3 := KeyVersion{3, d, Inactive, 10, 0, "", 0}
 	kvl := KeyVersionList([]KeyVersion{v1, v2, v3})
 	keys := kvl.GetActive()
 	if len(keys) != 2 {
@@ -378,9 +409,9 @@ func TestKVLGetActive(t *testing.T) {
 
 func TestKVLGetPrimary(t *testing.T) {
 	d := []byte("test")
-	v1 := KeyVersion{1, d, Primary, 10}
-	v2 := KeyVersion{2, d, Active, 10}
-	v3 := KeyVersion{3, d, Inactive, 10}
+	v1 := KeyVersion{1, d, Primary, 10, 0, "", 0}
+	v2 := KeyVersion{2, d, Active, 10, 0, "", 0}
+	v3 := KeyVersion{3, d, Inactive, 10, 0, "", 0}
 	kvl := KeyVersionList([]KeyVersion{v1, v2, v3})
 	keyVersion := kvl.GetPrimary()
 	if keyVersion.ID != v1.ID {
@@ -466,3 +497,260 @@ func TestPrincipalValidation(t *testing.T) {
 	validatePrincipal(Service, "spiffe://example.com/service", true)
 	validatePrincipal(ServicePrefix, "spiffe://example.com/prefix/", true)
 }
+
+func benchmarkVersionList(n int) KeyVersionList {
+	kvl := make(KeyVersionList, n)
+	for i := range kvl {
+		kvl[i] = KeyVersion{ID: uint64(n - i), Data: []byte("data"), Status: Active, CreationTime: int64(i)}
+	}
+	kvl[n/2].Status = Primary
+	return kvl
+}
+
+func BenchmarkKeyVersionListHash(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		kvl := benchmarkVersionList(n)
+		b.Run(fmt.Sprintf("versions=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				kvl.Hash()
+			}
+		})
+	}
+}
+
+func BenchmarkACLValidate(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		acl := make(ACL, n)
+		for i := range acl {
+			acl[i] = Access{Type: Machine, ID: fmt.Sprintf("host%d", i), AccessType: Read}
+		}
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				acl.Validate()
+			}
+		})
+	}
+}
+
+func TestKeyMetadata(t *testing.T) {
+	var md KeyMetadata
+	updated := md.Update(KeyMetadata{"env": "prod", "team": "x"})
+	if len(updated) != 2 || updated["env"] != "prod" {
+		t.Fatalf("Unexpected metadata %v", updated)
+	}
+	removed := updated.Update(KeyMetadata{"env": ""})
+	if len(removed) != 1 || removed["team"] != "x" {
+		t.Fatalf("Unexpected metadata %v", removed)
+	}
+	if len(updated) != 2 {
+		t.Fatal("Update should not modify the original metadata")
+	}
+	if err := updated.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (KeyMetadata{"bad key": "x"}).Validate(); err != ErrInvalidMetadataKey {
+		t.Fatalf("Expected %s, got %v", ErrInvalidMetadataKey, err)
+	}
+}
+
+func TestKeyMetadataDeprecation(t *testing.T) {
+	if d := (KeyMetadata{"env": "prod"}).Deprecation(); d != nil {
+		t.Fatalf("Expected no deprecation, got %v", d)
+	}
+	md := KeyMetadata{MetadataDeprecated: "moving to v2", MetadataReplacement: "service:key_v2"}
+	d := md.Deprecation()
+	if d == nil || d.Message != "moving to v2" || d.Replacement != "service:key_v2" {
+		t.Fatalf("Unexpected deprecation %v", d)
+	}
+	if d.String() != "deprecated: moving to v2 (use service:key_v2 instead)" {
+		t.Fatalf("Unexpected deprecation string %q", d.String())
+	}
+}
+
+func TestActivateScheduled(t *testing.T) {
+	d := []byte("test")
+	kvl := KeyVersionList{
+		{ID: 1, Data: d, Status: Primary, CreationTime: 10},
+		{ID: 2, Data: d, Status: Scheduled, CreationTime: 10, ActivationTime: 200},
+		{ID: 3, Data: d, Status: Scheduled, CreationTime: 10, ActivationTime: 100},
+		{ID: 4, Data: d, Status: Scheduled, CreationTime: 10, ActivationTime: 300},
+	}
+	if err := kvl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if kvl.NextActivation() != 100 {
+		t.Fatalf("Expected next activation 100, got %d", kvl.NextActivation())
+	}
+	if active := kvl.GetActive(); len(active) != 1 || active[0].ID != 1 {
+		t.Fatalf("Scheduled versions should not be active: %v", active)
+	}
+
+	if _, changed := kvl.ActivateScheduled(50); changed {
+		t.Fatal("No version should be activated before its activation time")
+	}
+	activated, changed := kvl.ActivateScheduled(250)
+	if !changed {
+		t.Fatal("Expected versions to be activated")
+	}
+	if p := activated.GetPrimary(); p.ID != 2 {
+		t.Fatalf("Expected version 2 to be primary, got %d", p.ID)
+	}
+	expected := []VersionStatus{Active, Primary, Active, Scheduled}
+	for i, v := range activated {
+		if v.Status != expected[i] {
+			t.Fatalf("Version %d has status %d, expected %d", v.ID, v.Status, expected[i])
+		}
+	}
+	if kvl[0].Status != Primary || kvl[1].Status != Scheduled {
+		t.Fatal("ActivateScheduled should not modify the original list")
+	}
+	if activated.NextActivation() != 300 {
+		t.Fatalf("Expected next activation 300, got %d", activated.NextActivation())
+	}
+
+	noTime := KeyVersionList{{ID: 1, Status: Primary}, {ID: 2, Status: Scheduled}}
+	if err := noTime.Validate(); err != ErrNoActivationTime {
+		t.Fatalf("Expected %s, got %v", ErrNoActivationTime, err)
+	}
+
+	cancelled, err := kvl.Update(4, Inactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled[3].Status != Inactive {
+		t.Fatal("Expected scheduled version to be cancelled")
+	}
+	if _, err := kvl.Update(1, Scheduled); err != ErrInvalidStatus {
+		t.Fatalf("Expected %s, got %v", ErrInvalidStatus, err)
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	for _, ct := range []string{"", ContentTypeJSON, ContentTypePEM, ContentTypeTinkKeyset, "text/plain"} {
+		if !ValidContentType(ct) {
+			t.Fatalf("Expected %q to be valid", ct)
+		}
+	}
+	for _, ct := range []string{"text/plain; charset=utf-8", "a/b/c", " json"} {
+		if ValidContentType(ct) {
+			t.Fatalf("Expected %q to be invalid", ct)
+		}
+	}
+	if err := ValidateContent(ContentTypeJSON, []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateContent(ContentTypeJSON, []byte(`{"a": `)); err == nil {
+		t.Fatal("Expected invalid JSON to fail")
+	}
+	if err := ValidateContent(ContentTypePEM, []byte("-----BEGIN CERTIFICATE-----\nMQ==\n-----END CERTIFICATE-----\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateContent(ContentTypePEM, []byte("not pem")); err == nil {
+		t.Fatal("Expected invalid PEM to fail")
+	}
+	if err := ValidateContent("text/plain", []byte("anything")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyVersionListConcat(t *testing.T) {
+	kvl := KeyVersionList{
+		{ID: 3, Data: []byte("ca-3\n"), Status: Active},
+		{ID: 1, Data: []byte("ca-1"), Status: Inactive},
+		{ID: 4, Data: []byte("ca-4"), Status: Primary},
+		{ID: 2, Data: []byte("ca-2"), Status: Active},
+	}
+	if b := string(kvl.Concat("\n")); b != "ca-4\nca-2\nca-3\n" {
+		t.Fatalf("Unexpected concatenation %q", b)
+	}
+	if b := string(kvl.Concat("")); b != "ca-4ca-2ca-3\n" {
+		t.Fatalf("Unexpected concatenation %q", b)
+	}
+	if kvl[0].ID != 3 {
+		t.Fatal("Concat must not reorder the list")
+	}
+}
+
+func FuzzACLUnmarshal(f *testing.F) {
+	f.Add(`[{"type":"Machine","id":"host","access":"Read"}]`)
+	f.Add(`[{"type":"Service","id":"spiffe://example.com/svc","access":"Admin"},{"type":"UserGroup","id":"g","access":"Write"}]`)
+	f.Add(`[{"type":"Bogus","id":"x","access":"None"}]`)
+	f.Add(`[]`)
+	f.Add(`null`)
+	f.Fuzz(func(t *testing.T, data string) {
+		var acl ACL
+		if err := json.Unmarshal([]byte(data), &acl); err != nil {
+			return
+		}
+		validErr := acl.Validate()
+		for _, a := range acl {
+			a.Type.IsValidPrincipal(a.ID, nil)
+		}
+		b, err := json.Marshal(acl)
+		if err != nil {
+			// Unknown principal types are kept so keys stay readable, but
+			// can't be written back.
+			return
+		}
+		var again ACL
+		if err := json.Unmarshal(b, &again); err != nil {
+			t.Fatalf("Failed to unmarshal %s: %s", b, err)
+		}
+		if !reflect.DeepEqual(acl, again) && !(len(acl) == 0 && len(again) == 0) {
+			t.Fatalf("ACL changed after a round trip: %+v, %+v", acl, again)
+		}
+		if again.Validate() != validErr {
+			t.Fatalf("Validation changed after a round trip: %v, %v", validErr, again.Validate())
+		}
+	})
+}
+
+func FuzzIsValidPrincipal(f *testing.F) {
+	f.Add(int(Machine), "host.example.com")
+	f.Add(int(Service), "spiffe://example.com/svc")
+	f.Add(int(ServicePrefix), "spiffe://example.com/svc/")
+	f.Add(int(ServicePrefix), "spiffe://example.com")
+	f.Add(int(MachinePrefix), "")
+	f.Fuzz(func(t *testing.T, typ int, id string) {
+		pt := PrincipalType(typ)
+		if err := pt.IsValidPrincipal(id, nil); err != nil {
+			return
+		}
+		if id == "" {
+			t.Fatal("Empty principal accepted")
+		}
+		if pt == Service || pt == ServicePrefix {
+			u, err := url.Parse(id)
+			if err != nil || u.Scheme != "spiffe" || u.Host == "" {
+				t.Fatalf("Invalid SPIFFE ID %q accepted", id)
+			}
+		}
+		if pt == ServicePrefix && !strings.HasSuffix(id, "/") {
+			t.Fatalf("Service prefix %q without a trailing slash accepted", id)
+		}
+	})
+}
+
+func FuzzKeyIDValidate(f *testing.F) {
+	f.Add("service:key_1")
+	f.Add("")
+	f.Add("../key")
+	f.Add("key/1")
+	f.Add("kéy")
+	f.Fuzz(func(t *testing.T, id string) {
+		vl := KeyVersionList{{ID: 1, Data: []byte("d"), Status: Primary}}
+		k := Key{ID: id, ACL: ACL{}, VersionList: vl, VersionHash: vl.Hash()}
+		err := k.Validate()
+		valid := id != "" && strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_:") == ""
+		if valid && err != nil {
+			t.Fatalf("Key ID %q rejected: %s", id, err)
+		}
+		if !valid && err != ErrInvalidKeyID {
+			t.Fatalf("Key ID %q accepted", id)
+		}
+		// Valid IDs are used in URL paths and file names unescaped.
+		if valid && url.PathEscape(id) != id {
+			t.Fatalf("Key ID %q needs escaping", id)
+		}
+	})
+}
@@ -132,6 +132,14 @@ func (l *Logger) SetService(service string) {
 	l.service = service
 }
 
+// WithOutput returns a copy of the logger that writes to out, e.g. to ship
+// the same records to another destination.
+func (l *Logger) WithOutput(out io.Writer) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &Logger{out: out, prefix: l.prefix, flag: l.flag, service: l.service, version: l.version, host: l.host}
+}
+
 func (l *Logger) formatHeader(buf *[]byte, t time.Time, file string, line int) {
 	*buf = append(*buf, l.prefix...)
 	if l.flag&(Ldate|Ltime|Lmicroseconds) != 0 {
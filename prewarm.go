@@ -0,0 +1,76 @@
+package knox
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+)
+
+// PrewarmRequest asks the daemons on Hosts to cache Keys, e.g. before a
+// deploy sends traffic to new hosts.
+type PrewarmRequest struct {
+	Hosts []string `json:"hosts"`
+	Keys  []string `json:"keys"`
+}
+
+// Prewarm is the state of a prewarm request. It is Ready once the daemon on
+// every host has the current version of every key.
+type Prewarm struct {
+	ID      string                 `json:"id"`
+	Keys    []string               `json:"keys"`
+	Hosts   map[string]PrewarmHost `json:"hosts"`
+	Ready   bool                   `json:"ready"`
+	Expires time.Time              `json:"expires"`
+}
+
+// PrewarmHost is the readiness of one host in a prewarm request. Pending are
+// the keys the host's daemon doesn't have yet and Errors holds, by key ID,
+// why the host can't get a key, e.g. because its ACL doesn't allow it.
+// LastSync is zero until the daemon has synced since the request was made.
+type PrewarmHost struct {
+	Ready    bool                `json:"ready"`
+	Pending  []string            `json:"pending,omitempty"`
+	Errors   map[string]APIError `json:"errors,omitempty"`
+	LastSync time.Time           `json:"last_sync,omitempty"`
+}
+
+// PrewarmClient asks hosts' daemons to cache keys ahead of a deploy.
+type PrewarmClient interface {
+	CreatePrewarm(req PrewarmRequest) (*Prewarm, error)
+	GetPrewarm(id string) (*Prewarm, error)
+}
+
+// CreatePrewarm asks the daemons on the requested hosts to cache the keys.
+func (c *HTTPClient) CreatePrewarm(req PrewarmRequest) (*Prewarm, error) {
+	return c.UncachedClient.CreatePrewarm(req)
+}
+
+// GetPrewarm returns the readiness of each host in a prewarm request.
+func (c *HTTPClient) GetPrewarm(id string) (*Prewarm, error) {
+	return c.UncachedClient.GetPrewarm(id)
+}
+
+// CreatePrewarm asks the daemons on the requested hosts to cache the keys.
+func (c *UncachedHTTPClient) CreatePrewarm(req PrewarmRequest) (*Prewarm, error) {
+	hosts, err := json.Marshal(req.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := json.Marshal(req.Keys)
+	if err != nil {
+		return nil, err
+	}
+	d := url.Values{}
+	d.Set("hosts", string(hosts))
+	d.Set("keys", string(keys))
+	p := &Prewarm{}
+	err = c.getHTTPData("POST", "/v0/prewarm/", d, p)
+	return p, err
+}
+
+// GetPrewarm returns the readiness of each host in a prewarm request.
+func (c *UncachedHTTPClient) GetPrewarm(id string) (*Prewarm, error) {
+	p := &Prewarm{}
+	err := c.getHTTPData("GET", "/v0/prewarm/"+url.PathEscape(id)+"/", nil, p)
+	return p, err
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// PrincipalDirectory reports whether the principal of an ACL entry still
+// exists, for example by looking users up in LDAP or machines in an inventory.
+// It should return true for principal types it does not know about.
+type PrincipalDirectory interface {
+	Exists(a knox.Access) (bool, error)
+}
+
+// PrincipalDirectoryFunc adapts a function to the PrincipalDirectory interface.
+type PrincipalDirectoryFunc func(a knox.Access) (bool, error)
+
+// Exists calls f(a).
+func (f PrincipalDirectoryFunc) Exists(a knox.Access) (bool, error) {
+	return f(a)
+}
+
+// StaleAccess is an ACL entry whose principal no longer exists.
+type StaleAccess struct {
+	KeyID  string
+	Access knox.Access
+	// Removed is true if the entry was pruned from the key's ACL.
+	Removed bool
+	// Reason explains why a stale entry was not removed.
+	Reason string
+}
+
+// ACLCleaner finds ACL entries for principals that the directory reports as
+// gone. By default it only reports them; set Enforce to prune them.
+type ACLCleaner struct {
+	Directory PrincipalDirectory
+	// Enforce removes stale entries. Without it the cleaner runs in report mode.
+	Enforce bool
+	// Report is called with the stale entries found by each run.
+	Report func([]StaleAccess)
+}
+
+// Run checks the ACL of every key once. Keys are never left without an Admin,
+// so the last remaining Admin entry of a key is reported but kept. Errors
+// from the directory skip the entry rather than treating it as stale.
+func (c *ACLCleaner) Run(m KeyManager) ([]StaleAccess, error) {
+	ids, err := m.GetAllKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+	var stale []StaleAccess
+	for _, id := range ids {
+		key, err := m.GetKey(id, knox.Inactive)
+		if err != nil {
+			if err == knox.ErrKeyIDNotFound {
+				continue
+			}
+			return stale, err
+		}
+		admins := 0
+		for _, a := range key.ACL {
+			if a.AccessType == knox.Admin {
+				admins++
+			}
+		}
+		for _, a := range key.ACL {
+			exists, err := c.Directory.Exists(a)
+			if err != nil {
+				log.Printf("Failed to check principal %s on key %s: %s", a.ID, id, err.Error())
+				continue
+			}
+			if exists {
+				continue
+			}
+			s := StaleAccess{KeyID: id, Access: a}
+			switch {
+			case !c.Enforce:
+				s.Reason = "report mode"
+			case a.AccessType == knox.Admin && admins == 1:
+				s.Reason = "last admin of key"
+			default:
+				remove := knox.Access{Type: a.Type, ID: a.ID, AccessType: knox.None}
+				if err := m.UpdateAccess(id, remove); err != nil {
+					s.Reason = fmt.Sprintf("update failed: %s", err.Error())
+					break
+				}
+				s.Removed = true
+				if a.AccessType == knox.Admin {
+					admins--
+				}
+			}
+			stale = append(stale, s)
+		}
+	}
+	if c.Report != nil {
+		c.Report(stale)
+	}
+	return stale, nil
+}
+
+// Start runs the cleaner every interval in a new goroutine until the returned
+// function is called.
+func (c *ACLCleaner) Start(m KeyManager, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := c.Run(m); err != nil {
+					log.Printf("Stale ACL cleanup failed: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestACLCleaner(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	acl := `[{"type":"User","id":"gone","access":"Read"},{"type":"Machine","id":"flaky","access":"Read"}]`
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, auth.NewUser("departed", []string{}), map[string]string{"id": "a2", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	dir := PrincipalDirectoryFunc(func(a knox.Access) (bool, error) {
+		switch a.ID {
+		case "gone", "departed":
+			return false, nil
+		case "flaky":
+			return false, fmt.Errorf("directory unavailable")
+		}
+		return true, nil
+	})
+
+	var reported []StaleAccess
+	c := &ACLCleaner{Directory: dir, Report: func(s []StaleAccess) { reported = s }}
+	stale, runErr := c.Run(m)
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	if len(stale) != 2 || len(reported) != 2 {
+		t.Fatalf("Expected 2 stale entries, got %+v", stale)
+	}
+	for _, s := range stale {
+		if s.Removed {
+			t.Fatalf("Report mode removed %+v", s)
+		}
+	}
+
+	c.Enforce = true
+	stale, runErr = c.Run(m)
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	for _, s := range stale {
+		switch s.Access.ID {
+		case "gone":
+			if !s.Removed {
+				t.Fatalf("Expected %+v to be removed", s)
+			}
+		case "departed":
+			if s.Removed {
+				t.Fatalf("Expected last admin %+v to be kept", s)
+			}
+		default:
+			t.Fatalf("Unexpected stale entry %+v", s)
+		}
+	}
+
+	key, getErr := m.GetKey("a1", knox.Inactive)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if len(key.ACL) != 2 {
+		t.Fatalf("Expected gone to be pruned, got %+v", key.ACL)
+	}
+}
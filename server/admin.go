@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/pinterest/knox"
+)
+
+// Admin routes serve server operations to the principals granted Admin access
+// in the admin ACL. Without an admin ACL every request to them is denied.
+var adminRoutes = []Route{
+	{
+		Method:    "GET",
+		Id:        "adminlistkeys",
+		Path:      "/v0/admin/keys/",
+		Handler:   adminListKeysHandler,
+		Authorize: authorizeAdmin,
+	},
+	{
+		Method:    "POST",
+		Id:        "adminreencrypt",
+		Path:      "/v0/admin/reencrypt/",
+		Handler:   adminReencryptHandler,
+		Authorize: authorizeAdmin,
+	},
+	{
+		Method:    "GET",
+		Id:        "adminaudit",
+		Path:      "/v0/admin/audit/",
+		Handler:   adminAuditHandler,
+		Authorize: authorizeAdmin,
+		Parameters: []Parameter{
+			QueryParameter("principal"),
+			QueryParameter("key"),
+			ValidatedParameter{Parameter: QueryParameter("limit"), Type: UintParam},
+		},
+	},
+	{
+		Method:    "POST",
+		Id:        "adminunseal",
+		Path:      "/v0/admin/unseal/",
+		Handler:   adminUnsealHandler,
+		Authorize: authorizeAdmin,
+		Parameters: []Parameter{
+			ValidatedParameter{Parameter: PostParameter("share"), Type: Base64Param, Required: true},
+		},
+	},
+	{
+		Method:    "GET",
+		Id:        "adminconsistency",
+		Path:      "/v0/admin/consistency/",
+		Handler:   adminConsistencyHandler,
+		Authorize: authorizeAdmin,
+	},
+	{
+		Method:    "POST",
+		Id:        "adminrepair",
+		Path:      "/v0/admin/consistency/",
+		Handler:   adminRepairHandler,
+		Authorize: authorizeAdmin,
+		Parameters: []Parameter{
+			PostParameter("key"),
+		},
+	},
+	{
+		Method:    "GET",
+		Id:        "adminsnapshot",
+		Path:      "/v0/admin/snapshot/",
+		Handler:   adminSnapshotHandler,
+		Authorize: authorizeAdmin,
+	},
+	{
+		Method:    "POST",
+		Id:        "adminrestore",
+		Path:      "/v0/admin/snapshot/",
+		Handler:   adminRestoreHandler,
+		Authorize: authorizeAdmin,
+		Parameters: []Parameter{
+			ValidatedParameter{Parameter: PostParameter("snapshot"), Type: Base64Param, Required: true},
+		},
+	},
+}
+
+var adminACL knox.ACL
+
+// SetAdminACL sets the principals allowed to use the admin routes of
+// KeyManagers made with NewKeyManager or GetRouter. They need Admin access in
+// acl.
+//
+// Deprecated: Set KeyManagerOptions.AdminACL and use NewKeyManagerWithOptions.
+func SetAdminACL(acl knox.ACL) {
+	adminACL = acl
+}
+
+func authorizeAdmin(m KeyManager, principal knox.Principal, parameters map[string]string) *HTTPError {
+	acl := optionsOf(m).AdminACL
+	if len(acl) == 0 || !principal.CanAccess(acl, knox.Admin) {
+		return errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s is not a server admin", principal.GetID()))
+	}
+	return nil
+}
+
+// adminListKeysHandler lists every key with its ACL, metadata and version
+// counts, but no key data.
+// The route for this handler is GET /v0/admin/keys/
+func adminListKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	ids, err := m.GetAllKeyIDs()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	keys := make([]knox.KeySummary, 0, len(ids))
+	for _, id := range ids {
+		k, err := m.GetKey(id, knox.Inactive)
+		if err == knox.ErrKeyIDNotFound {
+			// Deleted since listing the IDs.
+			continue
+		}
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		s := knox.KeySummary{
+			ID:          k.ID,
+			ACL:         k.ACL,
+			Metadata:    k.Metadata,
+			VersionHash: k.VersionHash,
+			Versions:    map[string]int{},
+		}
+		for _, v := range k.VersionList {
+			status, _ := v.Status.MarshalJSON()
+			s.Versions[string(status[1:len(status)-1])]++
+		}
+		if p := k.VersionList.GetPrimary(); p != nil {
+			s.PrimaryVersion = p.ID
+			s.ContentType = p.ContentType
+		}
+		if remaining, ok := k.Metadata.RemainingReads(); ok {
+			s.ReadsRemaining = &remaining
+		}
+		keys = append(keys, s)
+	}
+	return keys, nil
+}
+
+// adminReencryptHandler re-encrypts every key with the current cryptor, e.g.
+// after the master key was changed with keydb.NewRotatingCryptor.
+// The route for this handler is POST /v0/admin/reencrypt/
+func adminReencryptHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	result, err := m.ReencryptKeys()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return result, nil
+}
+
+// adminConsistencyHandler reports the keys with broken invariants, such as
+// zero or several primary versions.
+// The route for this handler is GET /v0/admin/consistency/
+func adminConsistencyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	report, err := m.CheckConsistency(false)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return report, nil
+}
+
+// adminRepairHandler repairs the keys with broken invariants, or only the
+// given key, and records the repairs in the audit log.
+// The route for this handler is POST /v0/admin/consistency/
+func adminRepairHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	var ids []string
+	if id := parameters["key"]; id != "" {
+		ids = append(ids, id)
+	}
+	report, err := m.CheckConsistency(true, ids...)
+	if err == knox.ErrKeyIDNotFound {
+		return nil, errF(knox.KeyIdentifierDoesNotExistCode, err.Error())
+	}
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	auditRepairs(optionsOf(m).AuditLog, principal.GetID(), principal.Type(), report)
+	return report, nil
+}
+
+// adminAuditHandler returns the most recent requests in the audit log, newest
+// first, optionally filtered by principal and key.
+// The route for this handler is GET /v0/admin/audit/?principal=<id>&key=<key_id>&limit=<n>
+func adminAuditHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	audit := optionsOf(m).AuditLog
+	if audit == nil {
+		return nil, errF(knox.NotYetImplementedCode, "The audit log is not enabled on this server")
+	}
+	limit := defaultAuditLimit
+	if l, ok := parameters["limit"]; ok && l != "" {
+		limit, _ = strconv.Atoi(l)
+	}
+	return audit.Events(parameters["principal"], parameters["key"], limit), nil
+}
+
+const defaultAuditLimit = 100
+
+var auditLog *AuditLog
+
+// SetAuditLog makes the audit log available through the admin API of
+// KeyManagers made with NewKeyManager or GetRouter. It must also be installed
+// with AccessAnalysis to record requests.
+//
+// Deprecated: Set KeyManagerOptions.AuditLog and use NewKeyManagerWithOptions.
+func SetAuditLog(l *AuditLog) {
+	auditLog = l
+}
+
+// AuditLog is an AccessAnalyzer that keeps the most recent requests in memory
+// for the admin API.
+type AuditLog struct {
+	mu     sync.Mutex
+	events []knox.AuditEvent
+	next   int
+	full   bool
+}
+
+// NewAuditLog creates an audit log holding up to size events.
+func NewAuditLog(size int) *AuditLog {
+	return &AuditLog{events: make([]knox.AuditEvent, size)}
+}
+
+// Observe records an event, replacing the oldest one if the log is full.
+func (l *AuditLog) Observe(e AccessEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 {
+		return
+	}
+	l.events[l.next] = knox.AuditEvent{
+		Principal:     e.Principal,
+		PrincipalType: e.PrincipalType,
+		RouteID:       e.RouteID,
+		KeyID:         e.KeyID,
+		Success:       e.Success,
+		Time:          e.Time,
+	}
+	l.next = (l.next + 1) % len(l.events)
+	l.full = l.full || l.next == 0
+}
+
+// Events returns up to limit of the most recent events, newest first. Empty
+// principal or keyID match every event.
+func (l *AuditLog) Events(principal, keyID string, limit int) []knox.AuditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.events)
+	}
+	out := []knox.AuditEvent{}
+	for i := 0; i < n && len(out) < limit; i++ {
+		e := l.events[(l.next-1-i+len(l.events))%len(l.events)]
+		if (principal == "" || e.Principal == principal) && (keyID == "" || e.KeyID == keyID) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
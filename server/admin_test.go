@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func TestAuthorizeAdmin(t *testing.T) {
+	u := auth.NewUser("testuser", []string{"ops"})
+	if err := authorizeAdmin(makeDBWithOptions(KeyManagerOptions{}), u, nil); err == nil {
+		t.Fatal("Expected admin routes to be denied without an admin ACL")
+	}
+	m := makeDBWithOptions(KeyManagerOptions{AdminACL: knox.ACL{{Type: knox.UserGroup, ID: "ops", AccessType: knox.Admin}}})
+	if err := authorizeAdmin(m, u, nil); err != nil {
+		t.Fatalf("Expected group member to be an admin, got %+v", err)
+	}
+	if err := authorizeAdmin(m, auth.NewUser("other", []string{}), nil); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected other user to be unauthorized, got %+v", err)
+	}
+}
+
+func TestAdminListKeys(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"team":"infra"}`}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err := adminListKeysHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	keys := i.([]knox.KeySummary)
+	if len(keys) != 1 || keys[0].ID != "a1" {
+		t.Fatalf("Unexpected keys %+v", keys)
+	}
+	k := keys[0]
+	if k.Versions["Primary"] != 1 || k.Versions["Active"] != 1 || k.Metadata["team"] != "infra" || k.PrimaryVersion == 0 {
+		t.Fatalf("Unexpected summary %+v", k)
+	}
+}
+
+func TestAdminReencrypt(t *testing.T) {
+	db := keydb.NewTempDB()
+	old := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	m := NewKeyManager(old, db)
+	u := auth.NewUser("testuser", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	current := keydb.NewAESGCMCryptor(1, []byte("newnewnewnewnewn"))
+	m = NewKeyManager(keydb.NewRotatingCryptor(current, old), db)
+	i, err := adminReencryptHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if r := i.(*knox.ReencryptResult); r.Reencrypted != 1 || len(r.Failed) != 0 {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+
+	// The key is readable without the old master key.
+	k, getErr := NewKeyManager(current, db).GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatalf("Failed to read re-encrypted key: %s", getErr)
+	}
+	if string(k.VersionList[0].Data) != "1" {
+		t.Fatalf("Unexpected data %q", k.VersionList[0].Data)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	l := NewAuditLog(3)
+	for i, id := range []string{"a", "b", "a", "c"} {
+		l.Observe(AccessEvent{Principal: "user" + id, KeyID: id, Success: true, Time: time.Unix(int64(i), 0)})
+	}
+	events := l.Events("", "", 10)
+	if len(events) != 3 || events[0].KeyID != "c" || events[2].KeyID != "b" {
+		t.Fatalf("Expected the 3 newest events, newest first, got %+v", events)
+	}
+	if events := l.Events("usera", "", 10); len(events) != 1 || events[0].Time.Unix() != 2 {
+		t.Fatalf("Unexpected filtered events %+v", events)
+	}
+	if events := l.Events("", "", 1); len(events) != 1 {
+		t.Fatalf("Expected limit to apply, got %+v", events)
+	}
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	if _, err := adminSnapshotHandler(m, u, nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("Expected snapshots to be disabled, got %+v", err)
+	}
+	m = makeDBWithOptions(KeyManagerOptions{SnapshotKey: make([]byte, keydb.SnapshotKeySize)})
+
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err := adminSnapshotHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	snapshot := base64.StdEncoding.EncodeToString(i.([]byte))
+	if _, err := deleteKeyHandler(m, u, map[string]string{"keyID": "a1"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	i, err = adminRestoreHandler(m, u, map[string]string{"snapshot": snapshot})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if result := i.(*knox.RestoreResult); result.Added != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	k, getErr := m.GetKey("a1", knox.Primary)
+	if getErr != nil || string(k.VersionList[0].Data) != "1" {
+		t.Fatalf("Expected the key to be restored, got %+v, %v", k, getErr)
+	}
+
+	// A server with another master key can't use the snapshot.
+	other := NewKeyManagerWithOptions(keydb.NewAESGCMCryptor(0, []byte("otherotherotherr")), keydb.NewTempDB(), optionsOf(m))
+	if _, err := adminRestoreHandler(other, u, map[string]string{"snapshot": snapshot}); err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected the restore to fail, got %+v", err)
+	}
+	if ids, _ := other.GetAllKeyIDs(); len(ids) != 0 {
+		t.Fatalf("Expected nothing to be restored, got %v", ids)
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessEvent describes a single request made by a principal.
+type AccessEvent struct {
+	Principal     string
+	PrincipalType string
+	RouteID       string
+	// KeyID is the key the request is about. Sync requests are also
+	// observed once for each key they served or refused.
+	KeyID string
+	// Success is false if the request returned an error, e.g. because the
+	// principal was not authorized.
+	Success bool
+	Time    time.Time
+}
+
+// AccessAnalyzer receives every authenticated request so that it can look for
+// unusual access patterns. Observe is called inline and must not block.
+type AccessAnalyzer interface {
+	Observe(e AccessEvent)
+}
+
+// AccessAnalysis sends an AccessEvent to the analyzer for every request that
+// has an authenticated principal, and one more for each key a sync request
+// served or refused.
+func AccessAnalysis(a AccessAnalyzer) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			f(w, r)
+			p := GetPrincipal(r)
+			if p == nil {
+				return
+			}
+			e := AccessEvent{
+				Principal:     p.GetID(),
+				PrincipalType: p.Type(),
+				RouteID:       GetRouteID(r),
+				KeyID:         GetParams(r)["keyID"],
+				Success:       GetAPIError(r) == nil,
+				Time:          time.Now(),
+			}
+			a.Observe(e)
+			if s := getSyncedKeys(r); s != nil {
+				for _, k := range s.Keys {
+					e.KeyID, e.Success = k.ID, true
+					a.Observe(e)
+				}
+				refused := make([]string, 0, len(s.Errors))
+				for id := range s.Errors {
+					refused = append(refused, id)
+				}
+				sort.Strings(refused)
+				for _, id := range refused {
+					e.KeyID, e.Success = id, false
+					a.Observe(e)
+				}
+			}
+		}
+	}
+}
+
+// DetectorConfig tunes the thresholds used by the simple detector.
+type DetectorConfig struct {
+	// NewPrincipalAge is how long after it is first seen a principal is
+	// considered new.
+	NewPrincipalAge time.Duration
+	// MaxKeys is the number of distinct keys a new principal may read within
+	// Window before an alert is raised.
+	MaxKeys int
+	Window  time.Duration
+	// LearningPeriod is how long after startup the detector only records
+	// machine prefixes without alerting, so existing fleets are not reported.
+	LearningPeriod time.Duration
+	// MachinePrefix maps a machine ID to the prefix used to group machines.
+	// By default trailing digits and dashes are removed.
+	MachinePrefix func(id string) string
+	// Notifier receives the alerts. If nil, they go to the notifier set
+	// with SetNotifier.
+	Notifier Notifier
+}
+
+// DefaultDetectorConfig is used for any zero fields of a DetectorConfig.
+var DefaultDetectorConfig = DetectorConfig{
+	NewPrincipalAge: time.Hour,
+	MaxKeys:         20,
+	Window:          time.Minute,
+	LearningPeriod:  24 * time.Hour,
+	MachinePrefix:   defaultMachinePrefix,
+}
+
+func defaultMachinePrefix(id string) string {
+	return strings.TrimRight(id, "0123456789-")
+}
+
+type principalStats struct {
+	firstSeen time.Time
+	// reads maps key IDs to the time they were last read within the window.
+	reads   map[string]time.Time
+	alerted bool
+}
+
+// SimpleDetector is a built-in AccessAnalyzer that raises notifications when
+// a newly seen principal reads many keys rapidly, or when a machine from a
+// never-before-seen prefix reads a key. State is kept in memory, so each
+// server instance learns independently.
+type SimpleDetector struct {
+	sync.Mutex
+	config     DetectorConfig
+	started    time.Time
+	principals map[string]*principalStats
+	prefixes   map[string]bool
+}
+
+// NewSimpleDetector creates a detector that reports to config.Notifier.
+func NewSimpleDetector(config DetectorConfig) *SimpleDetector {
+	if config.NewPrincipalAge == 0 {
+		config.NewPrincipalAge = DefaultDetectorConfig.NewPrincipalAge
+	}
+	if config.MaxKeys == 0 {
+		config.MaxKeys = DefaultDetectorConfig.MaxKeys
+	}
+	if config.Window == 0 {
+		config.Window = DefaultDetectorConfig.Window
+	}
+	if config.LearningPeriod == 0 {
+		config.LearningPeriod = DefaultDetectorConfig.LearningPeriod
+	}
+	if config.MachinePrefix == nil {
+		config.MachinePrefix = DefaultDetectorConfig.MachinePrefix
+	}
+	return &SimpleDetector{
+		config:     config,
+		started:    time.Now(),
+		principals: map[string]*principalStats{},
+		prefixes:   map[string]bool{},
+	}
+}
+
+// keyReadRoutes are the routes whose events with a KeyID are reads of the key.
+// Sync requests are observed once for each key they returned.
+var keyReadRoutes = map[string]bool{
+	"getkey":     true,
+	"v1getkey":   true,
+	"synckeys":   true,
+	"v1synckeys": true,
+}
+
+// Observe implements AccessAnalyzer. Only key reads are considered.
+func (d *SimpleDetector) Observe(e AccessEvent) {
+	if !keyReadRoutes[e.RouteID] || e.KeyID == "" {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	now := e.Time
+
+	if e.PrincipalType == "machine" {
+		prefix := d.config.MachinePrefix(e.Principal)
+		if !d.prefixes[prefix] {
+			d.prefixes[prefix] = true
+			if now.Sub(d.started) > d.config.LearningPeriod {
+				d.notify(newAnomaly(NewMachinePrefixNotification, e,
+					fmt.Sprintf("First read from machine prefix %q", prefix)))
+			}
+		}
+	}
+
+	s, ok := d.principals[e.Principal]
+	if !ok {
+		s = &principalStats{firstSeen: now, reads: map[string]time.Time{}}
+		d.principals[e.Principal] = s
+	}
+	if now.Sub(s.firstSeen) > d.config.NewPrincipalAge {
+		// Established principals are not tracked further.
+		s.reads = nil
+		return
+	}
+	for id, t := range s.reads {
+		if now.Sub(t) > d.config.Window {
+			delete(s.reads, id)
+		}
+	}
+	s.reads[e.KeyID] = now
+	if len(s.reads) > d.config.MaxKeys && !s.alerted {
+		s.alerted = true
+		d.notify(newAnomaly(RapidReadsNotification, e,
+			fmt.Sprintf("New principal read %d keys within %s", len(s.reads), d.config.Window)))
+	}
+}
+
+// Stats returns the number of distinct keys each new principal has read
+// within the current window.
+func (d *SimpleDetector) Stats() map[string]int {
+	d.Lock()
+	defer d.Unlock()
+	stats := map[string]int{}
+	for p, s := range d.principals {
+		if s.reads != nil {
+			stats[p] = len(s.reads)
+		}
+	}
+	return stats
+}
+
+func (d *SimpleDetector) notify(n Notification) {
+	if d.config.Notifier != nil {
+		d.config.Notifier.Notify(n)
+		return
+	}
+	notify(notifier, n)
+}
+
+func newAnomaly(t string, e AccessEvent, msg string) Notification {
+	return Notification{
+		Type:          t,
+		KeyID:         e.KeyID,
+		Principal:     e.Principal,
+		PrincipalType: e.PrincipalType,
+		Authorized:    e.Success,
+		Message:       msg,
+		Time:          e.Time.UnixNano(),
+	}
+}
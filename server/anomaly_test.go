@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// record returns a notifier that appends to notifications.
+func record(notifications *[]Notification) Notifier {
+	return NotifierFunc(func(n Notification) {
+		*notifications = append(*notifications, n)
+	})
+}
+
+func TestSimpleDetectorRapidReads(t *testing.T) {
+	var notifications []Notification
+
+	d := NewSimpleDetector(DetectorConfig{MaxKeys: 3, Window: time.Minute, Notifier: record(&notifications)})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		d.Observe(AccessEvent{
+			Principal:     "newuser",
+			PrincipalType: "user",
+			RouteID:       "getkey",
+			KeyID:         fmt.Sprintf("k%d", i),
+			Success:       true,
+			Time:          start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	if len(notifications) != 1 || notifications[0].Type != RapidReadsNotification || notifications[0].Principal != "newuser" {
+		t.Fatalf("Unexpected notifications %+v", notifications)
+	}
+	if stats := d.Stats(); stats["newuser"] != 5 {
+		t.Fatalf("Unexpected stats %v", stats)
+	}
+
+	// Reads spread out beyond the window should not alert.
+	notifications = nil
+	for i := 0; i < 5; i++ {
+		d.Observe(AccessEvent{
+			Principal:     "slowuser",
+			PrincipalType: "user",
+			RouteID:       "getkey",
+			KeyID:         fmt.Sprintf("k%d", i),
+			Time:          start.Add(time.Duration(i) * 2 * time.Minute),
+		})
+	}
+	if len(notifications) != 0 {
+		t.Fatalf("Unexpected notifications %+v", notifications)
+	}
+}
+
+func TestSimpleDetectorNewMachinePrefix(t *testing.T) {
+	var notifications []Notification
+
+	d := NewSimpleDetector(DetectorConfig{LearningPeriod: time.Hour, Notifier: record(&notifications)})
+	now := time.Now()
+	d.Observe(AccessEvent{Principal: "web-001", PrincipalType: "machine", RouteID: "getkey", KeyID: "k", Time: now})
+	if len(notifications) != 0 {
+		t.Fatalf("Expected no notifications while learning, got %+v", notifications)
+	}
+
+	later := now.Add(2 * time.Hour)
+	d.Observe(AccessEvent{Principal: "web-002", PrincipalType: "machine", RouteID: "getkey", KeyID: "k", Time: later})
+	d.Observe(AccessEvent{Principal: "db-001", PrincipalType: "machine", RouteID: "getkey", KeyID: "k", Time: later})
+	d.Observe(AccessEvent{Principal: "db-002", PrincipalType: "machine", RouteID: "getkey", KeyID: "k", Time: later})
+	if len(notifications) != 1 || notifications[0].Type != NewMachinePrefixNotification || notifications[0].Principal != "db-001" {
+		t.Fatalf("Unexpected notifications %+v", notifications)
+	}
+}
+
+// syncRouter serves m with the observed requests going to a.
+func syncRouter(t *testing.T, m KeyManager, a AccessAnalyzer) http.Handler {
+	decorators := [](func(http.HandlerFunc) http.HandlerFunc){
+		AccessAnalysis(a),
+		Authentication([]auth.Provider{auth.MockGitHubProvider()}, nil),
+	}
+	r, err := GetRouterFromKeyManager(keydb.NewAESGCMCryptor(0, []byte("testtesttesttest")), m, decorators, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// syncRequest syncs keys as testuser.
+func syncRequest(h http.Handler, ids ...string) {
+	versions := map[string]string{}
+	for _, id := range ids {
+		versions[id] = ""
+	}
+	b, _ := json.Marshal(versions)
+	req := httptest.NewRequest("POST", "/v0/sync/", strings.NewReader(url.Values{"versions": {string(b)}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "0utestuser")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestAccessAnalysisSyncedKeys(t *testing.T) {
+	m, _ := makeDB()
+	for _, id := range []string{"a1", "a2"} {
+		if _, err := postKeysHandler(m, auth.NewUser("testuser", nil), map[string]string{"id": id, "data": "MQ=="}); err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+	if _, err := postKeysHandler(m, auth.NewUser("other", nil), map[string]string{"id": "private", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	audit := NewAuditLog(10)
+	syncRequest(syncRouter(t, m, audit), "a1", "a2", "private")
+	var got []string
+	for _, e := range audit.Events("testuser", "", 10) {
+		if e.RouteID != "synckeys" {
+			t.Fatalf("Unexpected event %+v", e)
+		}
+		got = append(got, fmt.Sprintf("%s %v", e.KeyID, e.Success))
+	}
+	// Events are newest first.
+	want := []string{"private false", "a2 true", "a1 true", " true"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected events %q, got %q", want, got)
+	}
+	if events := audit.Events("", "a2", 10); len(events) != 1 {
+		t.Fatalf("Expected the synced key to be audited, got %+v", events)
+	}
+}
+
+func TestSimpleDetectorSyncBulkRead(t *testing.T) {
+	m, _ := makeDB()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("k%d", i)
+		if _, err := postKeysHandler(m, auth.NewUser("testuser", nil), map[string]string{"id": id, "data": "MQ=="}); err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		ids = append(ids, id)
+	}
+
+	var notifications []Notification
+	d := NewSimpleDetector(DetectorConfig{MaxKeys: 3, Window: time.Minute, Notifier: record(&notifications)})
+	syncRequest(syncRouter(t, m, d), ids...)
+	if len(notifications) != 1 || notifications[0].Type != RapidReadsNotification || notifications[0].Principal != "testuser" {
+		t.Fatalf("Expected a single sync to raise rapid reads, got %+v", notifications)
+	}
+	if stats := d.Stats(); stats["testuser"] != 5 {
+		t.Fatalf("Unexpected stats %v", stats)
+	}
+}
@@ -1,11 +1,14 @@
 package server
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -47,6 +50,15 @@ var HTTPErrMap = map[int]*httpErrResp{
 	knox.BadRequestDataCode:            {http.StatusBadRequest, "Bad request format"},
 	knox.BadKeyFormatCode:              {http.StatusBadRequest, "Key ID contains unsupported characters"},
 	knox.BadPrincipalIdentifier:        {http.StatusBadRequest, "Invalid principal identifier"},
+	knox.KeyLockedCode:                 {http.StatusLocked, "Key is locked"},
+	knox.RequestTimeoutCode:            {http.StatusServiceUnavailable, "Request timed out"},
+	knox.KeyReadsExhaustedCode:         {http.StatusGone, "Key has no reads remaining"},
+	knox.KeyExpiredCode:                {http.StatusGone, "Key has expired"},
+	knox.KeyVersionHashMismatchCode:    {http.StatusConflict, "Key version hash does not match"},
+	knox.OverloadedCode:                {http.StatusServiceUnavailable, "Server is overloaded"},
+	knox.SealedCode:                    {http.StatusServiceUnavailable, "Server is sealed"},
+	knox.TooManyRequestsCode:           {http.StatusTooManyRequests, "Too many concurrent requests"},
+	knox.ClientVersionTooOldCode:       {http.StatusUpgradeRequired, "Client version is no longer supported"},
 }
 
 func combine(f, g func(http.HandlerFunc) http.HandlerFunc) func(http.HandlerFunc) http.HandlerFunc {
@@ -63,9 +75,12 @@ func GetRouterFromKeyManager(
 	additionalRoutes []Route) (*mux.Router, error) {
 	existingRouteIds := map[string]Route{}
 	existingRouteMethodAndPaths := map[string]map[string]Route{}
-	allRoutes := append(routes[:], additionalRoutes[:]...)
+	allRoutes := append(append(append(append(routes[:], adminRoutes...), v1Routes...), prewarmRoutes...), additionalRoutes...)
 
 	for _, route := range allRoutes {
+		if err := validateRoute(route); err != nil {
+			return nil, err
+		}
 		if _, routeExists := existingRouteIds[route.Id]; routeExists {
 			return nil, fmt.Errorf(
 				"There are ID conflicts for the route with ID: '%v'",
@@ -121,12 +136,45 @@ func GetRouter(
 	return GetRouterFromKeyManager(cryptor, m, decorators, additionalRoutes)
 }
 
+// validateRoute rejects routes that can't be served, so mistakes in
+// additionalRoutes fail when the router is built rather than on a request.
+func validateRoute(route Route) error {
+	if route.Id == "" {
+		return fmt.Errorf("The route for %s %s has no ID", route.Method, route.Path)
+	}
+	if route.Method == "" || route.Path == "" {
+		return fmt.Errorf("The route with ID '%v' needs a method and a path", route.Id)
+	}
+	if route.Handler == nil {
+		return fmt.Errorf("The route with ID '%v' has no handler", route.Id)
+	}
+	names := map[string]bool{}
+	for _, p := range route.Parameters {
+		if p == nil {
+			return fmt.Errorf("The route with ID '%v' has a nil parameter", route.Id)
+		}
+		if names[p.Name()] {
+			return fmt.Errorf("The route with ID '%v' declares parameter '%v' twice", route.Id, p.Name())
+		}
+		names[p.Name()] = true
+		if v, ok := p.(ValidatedParameter); ok {
+			p = v.Parameter
+		}
+		if u, ok := p.(UrlParameter); ok {
+			if !strings.Contains(route.Path, "{"+string(u)+"}") && !strings.Contains(route.Path, "{"+string(u)+":") {
+				return fmt.Errorf("The route with ID '%v' has URL parameter '%v' which is not in its path", route.Id, u)
+			}
+		}
+	}
+	return nil
+}
+
 func addRoute(
 	router *mux.Router,
 	route Route,
 	routeDecorator func(f http.HandlerFunc) http.HandlerFunc,
 	keyManager KeyManager) {
-	handler := setupRoute(route.Id, keyManager)(parseParams(route.Parameters)(routeDecorator(route.ServeHTTP)))
+	handler := setupRoute(route.Id, keyManager)(parseParams(route.Parameters)(routeDecorator(authorizeRoute(route)(route.ServeHTTP))))
 	router.Handle(route.Path, handler).Methods(route.Method)
 }
 
@@ -210,6 +258,24 @@ func (p PostParameter) Name() string {
 	return string(p)
 }
 
+// HeaderParameter is an implementation of the Parameter interface that
+// extracts the value of a request header.
+type HeaderParameter string
+
+// Get returns the value of the header
+func (p HeaderParameter) Get(r *http.Request) (string, bool) {
+	val, ok := r.Header[http.CanonicalHeaderKey(string(p))]
+	if !ok || len(val) == 0 {
+		return "", false
+	}
+	return val[0], true
+}
+
+// Name is the name of the header
+func (p HeaderParameter) Name() string {
+	return string(p)
+}
+
 // Route is a struct that defines a path and method-specific
 // HTTP route on the Knox server
 type Route struct {
@@ -232,76 +298,190 @@ type Route struct {
 	// Parameters is an array that represents the route-specific parameters
 	// that will be passed to the handler function
 	Parameters []Parameter
+
+	// Principals restricts the route to these kinds of principals. If empty,
+	// any authenticated principal may call it.
+	Principals []PrincipalKind
+
+	// KeyAccess is the access the principal needs to the key named by the
+	// keyID path variable. It is checked before the handler runs. None leaves
+	// authorization to the handler.
+	KeyAccess knox.AccessType
+
+	// Authorize is an optional check that runs after the Principals and
+	// KeyAccess requirements, for rules that can't be declared with them.
+	Authorize func(m KeyManager, principal knox.Principal, parameters map[string]string) *HTTPError
 }
 
 // WriteErr returns a function that can encode error information and set an
 // HTTP error response code in the specified HTTP response writer
 func WriteErr(apiErr *HTTPError) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resp := new(knox.Response)
-		hostname, err := os.Hostname()
-		if err != nil {
-			panic("Hostname is required:" + err.Error())
-		}
-		resp.Host = hostname
-		resp.Timestamp = time.Now().UnixNano()
+		resp := newResponse(getDB(r))
 		resp.Status = "error"
 		resp.Code = apiErr.Subcode
 		resp.Message = apiErr.Message
-		code := HTTPErrMap[apiErr.Subcode].Code
-		w.WriteHeader(code)
+		codec := responseCodec(r)
+		w.Header().Set("Content-Type", codec.ContentType())
 		setAPIError(r, apiErr)
 
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			// It is unclear what to do here since the server failed to write the response.
-			log.Println(err.Error())
-		}
+		writeResponse(w, codec, HTTPErrMap[apiErr.Subcode].Code, resp)
 	}
 }
 
 // WriteData returns a function that can write arbitrary data to the specified
 // HTTP response writer
 func WriteData(w http.ResponseWriter, data interface{}) {
-	r := new(knox.Response)
+	writeData(w, knox.JSONCodec, data)
+}
+
+func writeData(w http.ResponseWriter, codec knox.Codec, data interface{}) {
+	writeDataWithWarnings(w, nil, codec, data, nil)
+}
+
+func writeDataWithWarnings(w http.ResponseWriter, m KeyManager, codec knox.Codec, data interface{}, warnings []string) {
+	r := newResponse(m)
 	r.Message = ""
 	r.Code = knox.OKCode
 	r.Status = "ok"
-	hostname, err := os.Hostname()
+	r.Data = data
+	r.Warnings = warnings
+	writeResponse(w, codec, http.StatusOK, r)
+}
+
+// responseCodec selects the response encoding from the request's Accept header.
+func responseCodec(r *http.Request) knox.Codec {
+	if r == nil {
+		return knox.JSONCodec
+	}
+	return knox.NegotiateCodec(r.Header.Get("Accept"))
+}
+
+// hostname is looked up once rather than for every response.
+var hostname = sync.OnceValues(os.Hostname)
+
+// newResponse returns a response with the fields every response has, as
+// configured by the options of m.
+func newResponse(m KeyManager) *knox.Response {
+	r := new(knox.Response)
+	hostname, err := hostname()
 	if err != nil {
 		panic("Hostname is required:" + err.Error())
 	}
 	r.Host = hostname
 	r.Timestamp = time.Now().UnixNano()
-	r.Data = data
-	if err := json.NewEncoder(w).Encode(r); err != nil {
+	r.ServerVersion = optionsOf(m).ServerVersion
+	return r
+}
+
+// responseBuffers holds buffers responses are encoded into, so the memory
+// grown for large keys is reused by later responses.
+var responseBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// maxPooledResponse is the capacity of the largest buffer kept in
+// responseBuffers, so a single huge response doesn't pin its memory.
+const maxPooledResponse = 4 << 20
+
+// writeResponse encodes r into a buffer so the response is sent with its
+// length in a single write.
+func writeResponse(w http.ResponseWriter, codec knox.Codec, code int, r *knox.Response) {
+	buf := responseBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledResponse {
+			responseBuffers.Put(buf)
+		}
+	}()
+	if err := codec.Encode(buf, r); err != nil {
 		// It is unclear what to do here since the server failed to write the response.
 		log.Println(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
 }
 
 // ServeHTTP runs API middleware and calls the underlying handler function.
 func (r Route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	db := getDB(req)
+	if key := getRouteKey(req); key != nil {
+		db = &authorizedKeyManager{KeyManager: db, key: key}
+	}
 	principal := GetPrincipal(req)
 	ps := GetParams(req)
-	data, err := r.Handler(db, principal, ps)
+	var data interface{}
+	err := checkClientVersion(optionsOf(db), req)
+	if err == nil {
+		err = bodyError(req)
+	}
+	if err == nil {
+		err = validateParams(r.Parameters, ps)
+	}
+	if err == nil {
+		data, err = r.runHandler(db, principal, ps)
+	}
 
 	if err != nil {
 		WriteErr(err)(w, req)
 	} else {
-		WriteData(w, data)
+		codec := responseCodec(req)
+		w.Header().Set("Content-Type", codec.ContentType())
+		warnings := requestWarnings(optionsOf(db), r.Id, req, ps)
+		if wd, ok := data.(withWarnings); ok {
+			data, warnings = wd.data, append(warnings, wd.warnings...)
+		}
+		if s, ok := data.(knox.KeySync); ok {
+			setSyncedKeys(req, &s)
+		}
+		writeDataWithWarnings(w, db, codec, data, warnings)
+	}
+}
+
+// withWarnings can be returned by handlers to attach warnings to a
+// successful response.
+type withWarnings struct {
+	data     interface{}
+	warnings []string
+}
+
+// addWarnings attaches warnings to handler data.
+func addWarnings(data interface{}, warnings ...string) interface{} {
+	if len(warnings) == 0 {
+		return data
+	}
+	if wd, ok := data.(withWarnings); ok {
+		return withWarnings{wd.data, append(wd.warnings, warnings...)}
 	}
+	return withWarnings{data, warnings}
 }
 
 // Users besides creator who have default access to all keys.
 // This is by default empty and should be expanded by the main function.
 var defaultAccess []knox.Access
 
-// AddDefaultAccess adds an access to every created key.
+// AddDefaultAccess adds an access to every key created through a KeyManager
+// made with NewKeyManager or GetRouter.
+//
+// Deprecated: Set KeyManagerOptions.DefaultAccess and use
+// NewKeyManagerWithOptions.
 func AddDefaultAccess(a *knox.Access) {
 	defaultAccess = append(defaultAccess, *a)
 }
 
+var duplicateDataWarnings bool
+
+// SetDuplicateDataWarnings turns on warnings when new key data matches a
+// version of another key the principal can read, for KeyManagers made with
+// NewKeyManager or GetRouter. It is off by default.
+//
+// Deprecated: Set KeyManagerOptions.DuplicateDataWarnings and use
+// NewKeyManagerWithOptions.
+func SetDuplicateDataWarnings(enabled bool) {
+	duplicateDataWarnings = enabled
+}
+
 var accessCallback func(knox.AccessCallbackInput) (bool, error)
 
 // SetAccessCallback adds a callback.
@@ -315,6 +495,10 @@ var extraPrincipalValidators []knox.PrincipalValidator
 // AddPrincipalValidator applies additional, custom validation on principals
 // submitted to Knox for adding into ACLs. Can be used to set custom business
 // logic for e.g. what kind of machine or service prefixes are acceptable.
+// It applies to KeyManagers made with NewKeyManager or GetRouter.
+//
+// Deprecated: Set KeyManagerOptions.PrincipalValidators and use
+// NewKeyManagerWithOptions.
 func AddPrincipalValidator(validator knox.PrincipalValidator) {
 	extraPrincipalValidators = append(extraPrincipalValidators, validator)
 }
@@ -330,14 +514,15 @@ func newKeyVersion(d []byte, s knox.VersionStatus) knox.KeyVersion {
 	return version
 }
 
-// NewKey creates a new Key with correctly set defaults.
-func newKey(id string, acl knox.ACL, d []byte, u knox.Principal) knox.Key {
+// NewKey creates a new Key with correctly set defaults. The creator and
+// defaults are added to acl.
+func newKey(id string, acl knox.ACL, d []byte, u knox.Principal, defaults []knox.Access) knox.Key {
 	key := knox.Key{}
 	key.ID = id
 
 	creatorAccess := knox.Access{ID: u.GetID(), AccessType: knox.Admin, Type: knox.User}
 	key.ACL = acl.Add(creatorAccess)
-	for _, a := range defaultAccess {
+	for _, a := range defaults {
 		key.ACL = key.ACL.Add(a)
 	}
 
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -94,7 +95,7 @@ func TestAddDefaultAccess(t *testing.T) {
 	acl := knox.ACL([]knox.Access{})
 	data := []byte("testdata")
 	u := auth.NewUser(uid, []string{})
-	key := newKey(id, acl, data, u)
+	key := newKey(id, acl, data, u, defaultAccess)
 	if !u.CanAccess(key.ACL, knox.Admin) {
 		t.Fatal("creator does not have access to his key")
 	}
@@ -109,6 +110,76 @@ func TestAddDefaultAccess(t *testing.T) {
 
 }
 
+func TestKeyManagerOptions(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	team := knox.Access{ID: "team", AccessType: knox.Read, Type: knox.UserGroup}
+	rejectMachines := func(pt knox.PrincipalType, id string) error {
+		if pt == knox.Machine {
+			return fmt.Errorf("machines are not allowed")
+		}
+		return nil
+	}
+	strict := &timedKeyManager{KeyManager: NewKeyManagerWithOptions(cryptor, keydb.NewTempDB(), KeyManagerOptions{
+		DefaultAccess:       []knox.Access{team},
+		PrincipalValidators: []knox.PrincipalValidator{rejectMachines},
+	})}
+	plain := NewKeyManagerWithOptions(cryptor, keydb.NewTempDB(), KeyManagerOptions{})
+	u := auth.NewUser("testuser", []string{})
+	machineRead := `{"type":"Machine","id":"host1","access":"Read"}`
+
+	for _, m := range []KeyManager{strict, plain} {
+		_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+	k, _ := strict.GetKey("a1", knox.Primary)
+	if len(k.ACL) != 2 || !auth.NewUser("other", []string{"team"}).CanAccess(k.ACL, knox.Read) {
+		t.Fatalf("Expected default access on key, got %v", k.ACL)
+	}
+	k, _ = plain.GetKey("a1", knox.Primary)
+	if len(k.ACL) != 1 {
+		t.Fatalf("Expected only the creator on key, got %v", k.ACL)
+	}
+
+	_, err := putAccessHandler(strict, u, map[string]string{"keyID": "a1", "access": machineRead})
+	if err == nil || err.Subcode != knox.BadPrincipalIdentifier {
+		t.Fatalf("Expected invalid principal, got %+v", err)
+	}
+	_, err = putAccessHandler(plain, u, map[string]string{"keyID": "a1", "access": machineRead})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
+
+func TestKeyManagerOptionsAdmin(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	audit := NewAuditLog(10)
+	admin := &timedKeyManager{KeyManager: NewKeyManagerWithOptions(cryptor, keydb.NewTempDB(), KeyManagerOptions{
+		AdminACL: knox.ACL{{Type: knox.UserGroup, ID: "ops", AccessType: knox.Admin}},
+		AuditLog: audit,
+		Timeouts: TimeoutConfig{Default: RouteTimeout{Timeout: time.Hour}},
+	})}
+	plain := NewKeyManagerWithOptions(cryptor, keydb.NewTempDB(), KeyManagerOptions{})
+	u := auth.NewUser("testuser", []string{"ops"})
+
+	if err := authorizeAdmin(admin, u, nil); err != nil {
+		t.Fatalf("Expected group member to be an admin, got %+v", err)
+	}
+	if err := authorizeAdmin(plain, u, nil); err == nil {
+		t.Fatal("Expected admin routes to be denied without an admin ACL")
+	}
+	if _, err := adminAuditHandler(admin, u, nil); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := adminAuditHandler(plain, u, nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("Expected no audit log, got %+v", err)
+	}
+	if a, p := optionsOf(admin).Timeouts, optionsOf(plain).Timeouts; a.Default.Timeout != time.Hour || p.Default.Timeout != 0 || a.abandoned == p.abandoned {
+		t.Fatalf("Expected separate timeouts, got %+v and %+v", a, p)
+	}
+}
+
 func TestSetAccessCallback(t *testing.T) {
 	defer SetAccessCallback(nil)
 
@@ -233,7 +304,7 @@ func TestNewKey(t *testing.T) {
 	acl := knox.ACL([]knox.Access{{ID: "testmachine", AccessType: knox.Admin, Type: knox.Machine}})
 	data := []byte("testdata")
 	u := auth.NewUser(uid, []string{})
-	key := newKey(id, acl, data, u)
+	key := newKey(id, acl, data, u, defaultAccess)
 	if key.ID != id {
 		t.Fatal("ID does not match: " + key.ID + "!=" + id)
 	}
@@ -403,3 +474,58 @@ func TestAdditionalRouteFunctionality(t *testing.T) {
 		)
 	}
 }
+
+// discardWriter is a ResponseWriter that drops the body, so benchmarks only
+// count the allocations of encoding.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+func BenchmarkWriteKeyResponse(b *testing.B) {
+	kvl := knox.KeyVersionList{}
+	for i := 0; i < 10; i++ {
+		status := knox.Active
+		if i == 0 {
+			status = knox.Primary
+		}
+		kvl = append(kvl, knox.KeyVersion{ID: uint64(i + 1), Data: make([]byte, 64*1024), Status: status})
+	}
+	key := &knox.Key{ID: "k", ACL: knox.ACL{}, VersionList: kvl, VersionHash: kvl.Hash()}
+	for _, codec := range []knox.Codec{knox.JSONCodec, knox.MsgpackCodec} {
+		b.Run(codec.ContentType(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				writeData(discardWriter{http.Header{}}, codec, key)
+			}
+		})
+	}
+}
+
+func TestWriteResponseContentLength(t *testing.T) {
+	for _, codec := range []knox.Codec{knox.JSONCodec, knox.MsgpackCodec} {
+		w := httptest.NewRecorder()
+		writeData(w, codec, map[string]string{"a": strings.Repeat("x", 1000)})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", codec.ContentType(), w.Code)
+		}
+		if l := w.Header().Get("Content-Length"); l != strconv.Itoa(w.Body.Len()) {
+			t.Fatalf("%s: Content-Length %s for %d bytes", codec.ContentType(), l, w.Body.Len())
+		}
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", codec.ContentType())
+		WriteErr(errF(knox.KeyIdentifierDoesNotExistCode, "missing"))(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", codec.ContentType(), w.Code)
+		}
+		resp := &knox.Response{}
+		if err := codec.Decode(w.Body, resp); err != nil || resp.Message != "missing" {
+			t.Fatalf("%s: unexpected error response %+v, %v", codec.ContentType(), resp, err)
+		}
+	}
+}
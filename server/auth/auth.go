@@ -72,7 +72,10 @@ type Provider interface {
 }
 
 func verifyCertificate(r *http.Request, cas *x509.CertPool,
-	timeFunc func() time.Time) (*x509.Certificate, error) {
+	timeFunc func() time.Time, revocation *RevocationChecker) (*x509.Certificate, error) {
+	if r.TLS == nil {
+		return nil, fmt.Errorf("auth: No peer certs configured")
+	}
 	certs := r.TLS.PeerCertificates
 	if len(certs) == 0 {
 		return nil, fmt.Errorf("auth: No peer certs configured")
@@ -95,6 +98,9 @@ func verifyCertificate(r *http.Request, cas *x509.CertPool,
 	if len(chains) == 0 {
 		return nil, fmt.Errorf("auth: No cert chains could be verified")
 	}
+	if err := revocation.Check(chains[0]); err != nil {
+		return nil, err
+	}
 	return certs[0], nil
 }
 
@@ -108,8 +114,10 @@ func NewMTLSAuthProvider(CAs *x509.CertPool) *MTLSAuthProvider {
 
 // MTLSAuthProvider does authentication by verifying TLS certs against a collection of root CAs
 type MTLSAuthProvider struct {
-	CAs  *x509.CertPool
-	time func() time.Time
+	CAs *x509.CertPool
+	// Revocation optionally checks that client certificates aren't revoked.
+	Revocation *RevocationChecker
+	time       func() time.Time
 }
 
 // Version is set to 0 for MTLSAuthProvider
@@ -129,7 +137,7 @@ func (p *MTLSAuthProvider) Type() byte {
 
 // Authenticate performs TLS based Authentication for the MTLSAuthProvider
 func (p *MTLSAuthProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
-	cert, err := verifyCertificate(r, p.CAs, p.time)
+	cert, err := verifyCertificate(r, p.CAs, p.time, p.Revocation)
 	if err != nil {
 		return nil, err
 	}
@@ -155,8 +163,21 @@ func NewSpiffeAuthProvider(CAs *x509.CertPool) *SpiffeProvider {
 
 // SpiffeProvider does authentication by verifying TLS certs against a collection of root CAs
 type SpiffeProvider struct {
-	CAs  *x509.CertPool
-	time func() time.Time
+	CAs *x509.CertPool
+	// Revocation optionally checks that client certificates aren't revoked.
+	Revocation *RevocationChecker
+	// JWTAudience enables JWT-SVIDs in the Authorization header for clients
+	// without a client certificate, e.g. behind a TLS terminating load
+	// balancer. Tokens must include it in their audience and are verified with
+	// the JWT authorities of the provider's trust bundles, so it only applies
+	// to providers created with NewFederatedSpiffeAuthProvider.
+	JWTAudience string
+	// Mapper normalizes SPIFFE IDs before they are used in ACLs. It is
+	// optional.
+	Mapper *SpiffeMapper
+	// bundles replaces CAs with per trust domain roots if set.
+	bundles *TrustBundles
+	time    func() time.Time
 }
 
 // Version is set to 0 for SpiffeProvider
@@ -174,9 +195,24 @@ func (p *SpiffeProvider) Type() byte {
 	return 's'
 }
 
-// Authenticate performs TLS based Authentication and extracts the Spiffe URI extension
+// Authenticate performs TLS based Authentication and extracts the Spiffe URI extension.
+// Requests without a client certificate may instead send a JWT-SVID as the token.
 func (p *SpiffeProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
-	cert, err := verifyCertificate(r, p.CAs, p.time)
+	if !hasPeerCertificates(r) && isJWT(token) {
+		s, err := p.authenticateJWT(token)
+		if err != nil {
+			return nil, err
+		}
+		return p.Mapper.Map(*s)
+	}
+	if p.bundles != nil {
+		s, err := p.authenticateFederated(r)
+		if err != nil {
+			return nil, err
+		}
+		return p.Mapper.Map(*s)
+	}
+	cert, err := verifyCertificate(r, p.CAs, p.time, p.Revocation)
 	if err != nil {
 		return nil, err
 	}
@@ -187,7 +223,11 @@ func (p *SpiffeProvider) Authenticate(token string, r *http.Request) (knox.Princ
 		return nil, err
 	}
 
-	return spiffeToPrincipal(spiffeURIs)
+	principal, err := spiffeToPrincipal(spiffeURIs)
+	if err != nil {
+		return nil, err
+	}
+	return p.Mapper.Map(principal.(service))
 }
 
 func spiffeToPrincipal(spiffeURIs []string) (knox.Principal, error) {
@@ -327,6 +367,15 @@ func IsUser(p knox.Principal) bool {
 	return ok
 }
 
+// IsMachine returns true if the principal, or first principal in the case of mux, is a machine.
+func IsMachine(p knox.Principal) bool {
+	if mux, ok := p.(knox.PrincipalMux); ok {
+		p = mux.Default()
+	}
+	_, ok := p.(machine)
+	return ok
+}
+
 // IsService returns true if the principal, or first principal in the case of mux, is a service.
 func IsService(p knox.Principal) bool {
 	if mux, ok := p.(knox.PrincipalMux); ok {
@@ -412,6 +461,19 @@ func (u user) CanAccess(acl knox.ACL, t knox.AccessType) bool {
 	return false
 }
 
+// CanAccessIndex is the indexed equivalent of CanAccess.
+func (u user) CanAccessIndex(idx *knox.ACLIndex, t knox.AccessType) bool {
+	if a, ok := idx.Exact(knox.User, u.ID); ok && a.CanAccess(t) {
+		return true
+	}
+	for g := range u.groups {
+		if a, ok := idx.Exact(knox.UserGroup, g); ok && a.CanAccess(t) {
+			return true
+		}
+	}
+	return false
+}
+
 // Machine represents a given machine by their hostname.
 type machine string
 
@@ -452,6 +514,15 @@ func (m machine) CanAccess(acl knox.ACL, t knox.AccessType) bool {
 	return false
 }
 
+// CanAccessIndex is the indexed equivalent of CanAccess.
+func (m machine) CanAccessIndex(idx *knox.ACLIndex, t knox.AccessType) bool {
+	if a, ok := idx.Exact(knox.Machine, string(m)); ok && a.CanAccess(t) {
+		return true
+	}
+	a, ok := idx.Prefix(knox.MachinePrefix, string(m))
+	return ok && a.CanAccess(t)
+}
+
 // Service represents a given service from a trust domain
 type service struct {
 	domain string
@@ -495,6 +566,16 @@ func (s service) CanAccess(acl knox.ACL, t knox.AccessType) bool {
 	return false
 }
 
+// CanAccessIndex is the indexed equivalent of CanAccess.
+func (s service) CanAccessIndex(idx *knox.ACLIndex, t knox.AccessType) bool {
+	id := s.GetID()
+	if a, ok := idx.Exact(knox.Service, id); ok && a.CanAccess(t) {
+		return true
+	}
+	a, ok := idx.Prefix(knox.ServicePrefix, id)
+	return ok && a.CanAccess(t)
+}
+
 type mockHTTPClient struct{}
 
 func (c *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -451,3 +452,79 @@ func TestSpiffeFallbackSuccess(t *testing.T) {
 	}
 	testSpiffeAuthFlow(t, "0tANYTHING", &a)
 }
+
+func benchmarkACL(n int) knox.ACL {
+	acl := make(knox.ACL, 0, n)
+	for i := 0; i < n; i++ {
+		switch i % 4 {
+		case 0:
+			acl = append(acl, knox.Access{Type: knox.Machine, ID: "host" + strconv.Itoa(i), AccessType: knox.Read})
+		case 1:
+			acl = append(acl, knox.Access{Type: knox.MachinePrefix, ID: "prefix" + strconv.Itoa(i), AccessType: knox.Read})
+		case 2:
+			acl = append(acl, knox.Access{Type: knox.Service, ID: "spiffe://example.com/svc" + strconv.Itoa(i), AccessType: knox.Read})
+		case 3:
+			acl = append(acl, knox.Access{Type: knox.UserGroup, ID: "group" + strconv.Itoa(i), AccessType: knox.Read})
+		}
+	}
+	return acl
+}
+
+func BenchmarkCanAccess(b *testing.B) {
+	principals := map[string]knox.Principal{
+		"machine": NewMachine("nomatch"),
+		"service": NewService("example.com", "nomatch"),
+		"user":    NewUser("nomatch", []string{"a", "b", "c"}),
+	}
+	for _, n := range []int{10, 100, 1000} {
+		acl := benchmarkACL(n)
+		for name, p := range principals {
+			b.Run(name+"/entries="+strconv.Itoa(n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					p.CanAccess(acl, knox.Read)
+				}
+			})
+		}
+	}
+}
+
+func TestCanAccessIndexMatchesCanAccess(t *testing.T) {
+	acl := knox.ACL{
+		{Type: knox.User, ID: "alice", AccessType: knox.Admin},
+		{Type: knox.UserGroup, ID: "readers", AccessType: knox.Read},
+		{Type: knox.Machine, ID: "web001", AccessType: knox.Write},
+		{Type: knox.MachinePrefix, ID: "web", AccessType: knox.Read},
+		{Type: knox.MachinePrefix, ID: "web00", AccessType: knox.Admin},
+		{Type: knox.MachinePrefix, ID: "", AccessType: knox.Read},
+		{Type: knox.Service, ID: "spiffe://example.com/api", AccessType: knox.Write},
+		{Type: knox.ServicePrefix, ID: "spiffe://example.com/batch/", AccessType: knox.Read},
+	}
+	principals := []knox.Principal{
+		NewUser("alice", nil),
+		NewUser("bob", []string{"readers"}),
+		NewUser("carol", []string{"writers"}),
+		NewMachine("web001"),
+		NewMachine("web002"),
+		NewMachine("web1"),
+		NewMachine("db001"),
+		NewService("example.com", "api"),
+		NewService("example.com", "batch/job"),
+		NewService("example.com", "batchjob"),
+		NewService("other.com", "api"),
+	}
+	for _, n := range []int{0, 1, 4, len(acl)} {
+		idx := knox.NewACLIndex(acl[:n])
+		for _, p := range principals {
+			ip, ok := p.(knox.IndexedPrincipal)
+			if !ok {
+				t.Fatalf("%s does not support indexed access checks", p.GetID())
+			}
+			for _, at := range []knox.AccessType{knox.None, knox.Read, knox.Write, knox.Admin} {
+				expected := p.CanAccess(acl[:n], at)
+				if actual := ip.CanAccessIndex(idx, at); actual != expected {
+					t.Fatalf("%s with %d entries and access %d: expected %t, got %t", p.GetID(), n, at, expected, actual)
+				}
+			}
+		}
+	}
+}
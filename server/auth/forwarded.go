@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// XForwardedClientCert is the header Envoy uses to forward client certificates.
+const XForwardedClientCert = "X-Forwarded-Client-Cert"
+
+// TrustedProxies identifies the TLS terminating proxies allowed to forward
+// client certificates. A request must match every configured check. Proxies
+// must be configured to replace the header rather than pass on a value sent by
+// the client.
+type TrustedProxies struct {
+	// Networks are the addresses proxies connect from.
+	Networks []*net.IPNet
+	// CAs verify the client certificate the proxy itself presents to knox.
+	CAs *x509.CertPool
+	// Names are the DNS or URI SANs one of which the proxy certificate must
+	// have. They are required if CAs is set.
+	Names []string
+}
+
+// ForwardedCertProvider authenticates requests with a client certificate a
+// trusted proxy forwarded in a header, for deployments where TLS terminates
+// before knox and r.TLS.PeerCertificates is empty. The certificate is passed to
+// an MTLSAuthProvider or SpiffeProvider which does the actual verification.
+type ForwardedCertProvider struct {
+	inner   Provider
+	header  string
+	proxies TrustedProxies
+	time    func() time.Time
+}
+
+// NewForwardedCertProvider wraps a certificate based provider to read client
+// certificates from header, which is either an Envoy X-Forwarded-Client-Cert
+// value or a URL encoded PEM certificate chain as sent by nginx's
+// $ssl_client_escaped_cert. Proxies must be identified by address, by
+// certificate or both.
+func NewForwardedCertProvider(inner Provider, header string, proxies TrustedProxies) (*ForwardedCertProvider, error) {
+	if len(proxies.Networks) == 0 && proxies.CAs == nil {
+		return nil, fmt.Errorf("auth: forwarded client certificates need trusted proxy networks or CAs")
+	}
+	if proxies.CAs != nil && len(proxies.Names) == 0 {
+		return nil, fmt.Errorf("auth: trusted proxy CAs need a list of proxy names")
+	}
+	if header == "" {
+		header = XForwardedClientCert
+	}
+	return &ForwardedCertProvider{
+		inner:   inner,
+		header:  header,
+		proxies: proxies,
+		time:    time.Now,
+	}, nil
+}
+
+// Version is the version of the wrapped provider
+func (p *ForwardedCertProvider) Version() byte {
+	return p.inner.Version()
+}
+
+// Name is the name of the provider for logging
+func (p *ForwardedCertProvider) Name() string {
+	return "forwarded-" + p.inner.Name()
+}
+
+// Type is the type of the wrapped provider, so clients don't need to know
+// whether TLS terminates at a proxy.
+func (p *ForwardedCertProvider) Type() byte {
+	return p.inner.Type()
+}
+
+// Authenticate checks that the request came from a trusted proxy and
+// authenticates the forwarded certificate with the wrapped provider.
+func (p *ForwardedCertProvider) Authenticate(token string, r *http.Request) (knox.Principal, error) {
+	value := r.Header.Get(p.header)
+	if value == "" {
+		return nil, fmt.Errorf("auth: no forwarded client certificate")
+	}
+	if err := p.verifyProxy(r); err != nil {
+		return nil, err
+	}
+	certs, err := parseForwardedCerts(value)
+	if err != nil {
+		return nil, err
+	}
+	forwarded := r.Clone(r.Context())
+	forwarded.TLS = &tls.ConnectionState{PeerCertificates: certs}
+	return p.inner.Authenticate(token, forwarded)
+}
+
+func (p *ForwardedCertProvider) verifyProxy(r *http.Request) error {
+	if len(p.proxies.Networks) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		trusted := false
+		for _, n := range p.proxies.Networks {
+			if ip != nil && n.Contains(ip) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return fmt.Errorf("auth: forwarded client certificate from untrusted address %s", r.RemoteAddr)
+		}
+	}
+	if p.proxies.CAs != nil {
+		cert, err := verifyCertificate(r, p.proxies.CAs, p.time, nil)
+		if err != nil {
+			return fmt.Errorf("auth: untrusted proxy: %s", err.Error())
+		}
+		if !proxyNameMatches(cert, p.proxies.Names) {
+			return fmt.Errorf("auth: proxy certificate does not match a trusted proxy name")
+		}
+	}
+	return nil
+}
+
+func proxyNameMatches(cert *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if strings.Contains(name, "://") {
+			for _, u := range cert.URIs {
+				if u.String() == name {
+					return true
+				}
+			}
+		} else if cert.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedCerts extracts the client certificate chain from a forwarded
+// header. For X-Forwarded-Client-Cert values with several elements, the last
+// one was added by the proxy closest to knox.
+func parseForwardedCerts(value string) ([]*x509.Certificate, error) {
+	encoded := value
+	if strings.Contains(value, "Cert=") || strings.Contains(value, "Chain=") {
+		elements := splitXFCC(value, ',')
+		fields := map[string]string{}
+		for _, pair := range splitXFCC(elements[len(elements)-1], ';') {
+			k, v, _ := strings.Cut(pair, "=")
+			fields[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(v, `"`)
+		}
+		encoded = fields["chain"]
+		if encoded == "" {
+			encoded = fields["cert"]
+		}
+	}
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid forwarded client certificate encoding")
+	}
+	var certs []*x509.Certificate
+	rest := []byte(decoded)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("auth: invalid forwarded client certificate: %s", err.Error())
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("auth: no certificate in forwarded header")
+	}
+	return certs, nil
+}
+
+// splitXFCC splits s on sep outside of double quotes.
+func splitXFCC(s string, sep byte) []string {
+	var out []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"' && (i == 0 || s[i-1] != '\\'):
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestForwardedCertProvider(t *testing.T) {
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM([]byte(spiffeCA))
+	inner := NewSpiffeAuthProvider(caPool)
+	inner.time = spiffeTestTime
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	if _, err := NewForwardedCertProvider(inner, "", TrustedProxies{}); err == nil {
+		t.Fatal("Expected proxies to be required")
+	}
+	if _, err := NewForwardedCertProvider(inner, "", TrustedProxies{CAs: caPool}); err == nil {
+		t.Fatal("Expected proxy names to be required with proxy CAs")
+	}
+	p, err := NewForwardedCertProvider(inner, "", TrustedProxies{Networks: []*net.IPNet{loopback}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Type() != 's' || p.Name() != "forwarded-spiffe" {
+		t.Fatalf("Unexpected provider type %c or name %s", p.Type(), p.Name())
+	}
+
+	cert := spiffeTestConnectionState(t).PeerCertificates[0]
+	escaped := url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	headers := []string{
+		escaped,
+		`By=spiffe://example.com/proxy;Hash=abc;Cert="` + escaped + `";Subject="CN=a,O=b";URI=spiffe://example.com/service`,
+		`By=spiffe://other/hop;Cert="garbage",By=spiffe://example.com/proxy;Cert="` + escaped + `"`,
+	}
+	for _, h := range headers {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = "127.0.0.1:23423"
+		req.Header.Set(XForwardedClientCert, h)
+		principal, err := p.Authenticate("ANYTHING", req)
+		if err != nil {
+			t.Fatalf("%s: %s", h, err)
+		}
+		if principal.GetID() != "spiffe://example.com/service" {
+			t.Fatalf("Unexpected ID %s", principal.GetID())
+		}
+	}
+
+	// Requests that don't come through a trusted proxy are rejected.
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "10.1.2.3:23423"
+	req.Header.Set(XForwardedClientCert, escaped)
+	if _, err := p.Authenticate("ANYTHING", req); err == nil {
+		t.Fatal("Expected a request from an untrusted address to be rejected")
+	}
+	req.RemoteAddr = "127.0.0.1:23423"
+	req.Header.Set(XForwardedClientCert, "Cert=\"not a cert\"")
+	if _, err := p.Authenticate("ANYTHING", req); err == nil {
+		t.Fatal("Expected an invalid certificate to be rejected")
+	}
+
+	// A proxy identified by certificate needs one with a trusted name.
+	byCert, err := NewForwardedCertProvider(inner, "X-SSL-Client-Cert", TrustedProxies{CAs: caPool, Names: []string{"spiffe://example.com/proxy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byCert.time = spiffeTestTime
+	req, _ = http.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-SSL-Client-Cert", escaped)
+	req.TLS = spiffeTestConnectionState(t)
+	if _, err := byCert.Authenticate("ANYTHING", req); err == nil {
+		t.Fatal("Expected a proxy certificate without a trusted name to be rejected")
+	}
+	byCert.proxies.Names = []string{"spiffe://example.com/service"}
+	if _, err := byCert.Authenticate("ANYTHING", req); err != nil {
+		t.Fatal(err)
+	}
+}
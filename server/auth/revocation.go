@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/pinterest/knox/log"
+)
+
+const (
+	defaultRevocationRefresh = time.Hour
+	maxOCSPCacheEntries      = 10000
+	// revocationRetry is how long fetching CRLs or asking an OCSP responder
+	// waits after a failure. It doubles with each further failure, up to the
+	// refresh interval.
+	revocationRetry = 10 * time.Second
+)
+
+// defaultRevocationClient fetches CRLs and OCSP responses for checkers
+// without a Client. Its timeout keeps a hung server from holding up
+// authentication.
+var defaultRevocationClient = &http.Client{Timeout: 10 * time.Second}
+
+// RevocationChecker rejects revoked client certificates using CRLs and OCSP
+// responders. Certificates from an issuer that no configured CRL covers and
+// without an OCSP responder are accepted.
+type RevocationChecker struct {
+	// CRLs are file paths or http(s) URLs of DER or PEM encoded CRLs.
+	CRLs []string
+	// OCSP queries the OCSP responder named in each certificate.
+	OCSP bool
+	// FailOpen accepts certificates whose status can't be determined, e.g.
+	// because a responder is down or a CRL is stale. By default they are
+	// rejected.
+	FailOpen bool
+	// Refresh is how often CRLs are reloaded and the longest time an OCSP
+	// response is cached. It defaults to an hour. CRLs are reloaded in the
+	// background while the previous ones keep being used.
+	Refresh time.Duration
+	// Client fetches CRLs and OCSP responses. If nil, a client with a 10
+	// second timeout is used.
+	Client *http.Client
+
+	mu         sync.Mutex
+	crls       []*x509.RevocationList
+	crlsLoaded time.Time
+	// crlLoading is closed when the CRL load in progress finishes.
+	crlLoading chan struct{}
+	crlErr     error
+	crlRetry   retryState
+	ocspCache  map[[32]byte]ocspCacheEntry
+	// ocspRetry backs off OCSP responders that failed, by URL.
+	ocspRetry map[string]retryState
+	time      func() time.Time
+}
+
+type ocspCacheEntry struct {
+	status  int
+	expires time.Time
+}
+
+// retryState backs off a server after failures.
+type retryState struct {
+	failures int
+	next     time.Time
+}
+
+// fail records a failure at now.
+func (r *retryState) fail(now time.Time, max time.Duration) {
+	r.failures++
+	wait := max
+	if r.failures <= 16 && revocationRetry<<(r.failures-1) < max {
+		wait = revocationRetry << (r.failures - 1)
+	}
+	r.next = now.Add(wait)
+}
+
+// errRevocationUnknown means the revocation status could not be determined.
+type errRevocationUnknown struct{ reason string }
+
+func (e errRevocationUnknown) Error() string {
+	return "auth: unable to check certificate revocation: " + e.reason
+}
+
+func (c *RevocationChecker) now() time.Time {
+	if c.time != nil {
+		return c.time()
+	}
+	return time.Now()
+}
+
+func (c *RevocationChecker) refresh() time.Duration {
+	if c.Refresh > 0 {
+		return c.Refresh
+	}
+	return defaultRevocationRefresh
+}
+
+func (c *RevocationChecker) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return defaultRevocationClient
+}
+
+// Check returns an error if any certificate of a verified chain, except the
+// root, is revoked, or if its status is unknown and the checker fails closed.
+// A nil checker accepts every chain.
+func (c *RevocationChecker) Check(chain []*x509.Certificate) error {
+	if c == nil {
+		return nil
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		err := c.checkCert(chain[i], chain[i+1])
+		if _, unknown := err.(errRevocationUnknown); unknown && c.FailOpen {
+			log.Printf("Accepting certificate %s: %s", chain[i].Subject, err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RevocationChecker) checkCert(cert, issuer *x509.Certificate) error {
+	if len(c.CRLs) > 0 {
+		if err := c.checkCRLs(cert, issuer); err != nil {
+			return err
+		}
+	}
+	if c.OCSP && len(cert.OCSPServer) > 0 {
+		status, err := c.ocspStatus(cert, issuer)
+		if err != nil {
+			return errRevocationUnknown{err.Error()}
+		}
+		switch status {
+		case ocsp.Revoked:
+			return fmt.Errorf("auth: certificate %s was revoked", cert.SerialNumber)
+		case ocsp.Unknown:
+			return errRevocationUnknown{"OCSP responder does not know the certificate"}
+		}
+	}
+	return nil
+}
+
+func (c *RevocationChecker) checkCRLs(cert, issuer *x509.Certificate) error {
+	crls, err := c.loadCRLs()
+	if err != nil {
+		return errRevocationUnknown{err.Error()}
+	}
+	now := c.now()
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("auth: certificate %s was revoked", cert.SerialNumber)
+			}
+		}
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			return errRevocationUnknown{fmt.Sprintf("CRL of %s is stale", issuer.Subject)}
+		}
+	}
+	return nil
+}
+
+// loadCRLs returns the configured CRLs. Once they are older than the refresh
+// interval they are reloaded in the background and kept until that succeeds.
+// Only the first load is waited for, and failed loads are retried with
+// backoff.
+func (c *RevocationChecker) loadCRLs() ([]*x509.RevocationList, error) {
+	c.mu.Lock()
+	now := c.now()
+	if c.crls != nil && now.Sub(c.crlsLoaded) < c.refresh() {
+		crls := c.crls
+		c.mu.Unlock()
+		return crls, nil
+	}
+	loading := c.startLoad(now)
+	if c.crls != nil || loading == nil {
+		crls, err := c.crls, c.crlErr
+		c.mu.Unlock()
+		if crls != nil {
+			return crls, nil
+		}
+		return nil, err
+	}
+	c.mu.Unlock()
+
+	<-loading
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crls == nil {
+		return nil, c.crlErr
+	}
+	return c.crls, nil
+}
+
+// startLoad starts loading the CRLs unless a load is in progress or backing
+// off. It returns a channel closed when the load finishes, or nil if none is
+// running. The caller holds the lock.
+func (c *RevocationChecker) startLoad(now time.Time) chan struct{} {
+	if c.crlLoading != nil {
+		return c.crlLoading
+	}
+	if now.Before(c.crlRetry.next) {
+		return nil
+	}
+	loading := make(chan struct{})
+	c.crlLoading = loading
+	go c.reloadCRLs(loading)
+	return loading
+}
+
+// reloadCRLs reads the CRLs without holding the lock and replaces the loaded
+// ones if all of them could be read.
+func (c *RevocationChecker) reloadCRLs(loading chan struct{}) {
+	var crls []*x509.RevocationList
+	var err error
+	for _, src := range c.CRLs {
+		var crl *x509.RevocationList
+		crl, err = c.readCRL(src)
+		if err != nil {
+			err = fmt.Errorf("failed to load CRL %s: %s", src, err.Error())
+			break
+		}
+		crls = append(crls, crl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(loading)
+	c.crlLoading = nil
+	if err != nil {
+		c.crlErr = err
+		c.crlRetry.fail(c.now(), c.refresh())
+		if c.crls != nil {
+			log.Printf("Using the previous CRLs: %s", err.Error())
+		}
+		return
+	}
+	c.crls = crls
+	c.crlsLoaded = c.now()
+	c.crlErr = nil
+	c.crlRetry = retryState{}
+}
+
+func (c *RevocationChecker) readCRL(src string) (*x509.RevocationList, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var resp *http.Response
+		resp, err = c.client().Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("server returned %s", resp.Status)
+		}
+		b, err = io.ReadAll(resp.Body)
+	} else {
+		b, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	return x509.ParseRevocationList(b)
+}
+
+// ocspStatus asks the certificate's OCSP responder for its status. Responses
+// are cached until their next update or the refresh interval, whichever is
+// sooner. A responder that failed isn't asked again until it backed off.
+func (c *RevocationChecker) ocspStatus(cert, issuer *x509.Certificate) (int, error) {
+	cacheKey := sha256.Sum256(append(append([]byte{}, issuer.RawSubjectPublicKeyInfo...), cert.SerialNumber.Bytes()...))
+	server := cert.OCSPServer[0]
+	now := c.now()
+	c.mu.Lock()
+	if e, ok := c.ocspCache[cacheKey]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.status, nil
+	}
+	if r, ok := c.ocspRetry[server]; ok && now.Before(r.next) {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("OCSP responder %s failed recently", server)
+	}
+	c.mu.Unlock()
+
+	status, expires, err := c.queryOCSP(server, cert, issuer, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if c.ocspRetry == nil {
+			c.ocspRetry = map[string]retryState{}
+		}
+		r := c.ocspRetry[server]
+		r.fail(now, c.refresh())
+		c.ocspRetry[server] = r
+		return 0, err
+	}
+	delete(c.ocspRetry, server)
+	c.cacheOCSP(cacheKey, ocspCacheEntry{status: status, expires: expires}, now)
+	return status, nil
+}
+
+// queryOCSP asks server for the status of cert and returns it with the time
+// it may be cached until.
+func (c *RevocationChecker) queryOCSP(server string, cert, issuer *x509.Certificate, now time.Time) (int, time.Time, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp, err := c.client().Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	r, err := ocsp.ParseResponseForCert(b, cert, issuer)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if !r.NextUpdate.IsZero() && now.After(r.NextUpdate) {
+		return 0, time.Time{}, fmt.Errorf("OCSP response is stale")
+	}
+	expires := now.Add(c.refresh())
+	if !r.NextUpdate.IsZero() && r.NextUpdate.Before(expires) {
+		expires = r.NextUpdate
+	}
+	return r.Status, expires, nil
+}
+
+// cacheOCSP caches an OCSP response, first removing expired responses and
+// then arbitrary ones if the cache is full. The caller holds the lock.
+func (c *RevocationChecker) cacheOCSP(key [32]byte, e ocspCacheEntry, now time.Time) {
+	if c.ocspCache == nil {
+		c.ocspCache = map[[32]byte]ocspCacheEntry{}
+	}
+	if len(c.ocspCache) >= maxOCSPCacheEntries {
+		for k, old := range c.ocspCache {
+			if !now.Before(old.expires) {
+				delete(c.ocspCache, k)
+			}
+		}
+	}
+	for k := range c.ocspCache {
+		if len(c.ocspCache) < maxOCSPCacheEntries {
+			break
+		}
+		delete(c.ocspCache, k)
+	}
+	c.ocspCache[key] = e
+}
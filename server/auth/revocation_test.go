@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, hostname, ocspServer string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ocspServer != "" {
+		tmpl.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func mtlsRequest(cert *x509.Certificate) *http.Request {
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	return req
+}
+
+func TestRevocationCRL(t *testing.T) {
+	ca := newTestCA(t)
+	good := ca.issue(t, 10, "good", "")
+	revoked := ca.issue(t, 11, "revoked", "")
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(11), RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := path.Join(t.TempDir(), "ca.crl")
+	if err := os.WriteFile(fn, crl, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	p := NewMTLSAuthProvider(pool)
+	p.Revocation = &RevocationChecker{CRLs: []string{fn}}
+	if _, err := p.Authenticate("good", mtlsRequest(good)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Authenticate("revoked", mtlsRequest(revoked)); err == nil {
+		t.Fatal("Expected a revoked certificate to be rejected")
+	}
+
+	// A stale CRL only rejects certificates if the checker fails closed.
+	p.Revocation.time = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	p.Revocation.Refresh = 3 * time.Hour
+	if err := p.Revocation.Check([]*x509.Certificate{good, ca.cert}); err == nil {
+		t.Fatal("Expected a stale CRL to fail closed")
+	}
+	p.Revocation.FailOpen = true
+	if err := p.Revocation.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Revocation.Check([]*x509.Certificate{revoked, ca.cert}); err == nil {
+		t.Fatal("Expected a revoked certificate to be rejected even when failing open")
+	}
+
+	missing := &RevocationChecker{CRLs: []string{path.Join(t.TempDir(), "missing.crl")}}
+	if err := missing.Check([]*x509.Certificate{good, ca.cert}); err == nil {
+		t.Fatal("Expected a missing CRL to fail closed")
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	requests := 0
+	down := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		status := ocsp.Good
+		if req.SerialNumber.Int64() == 11 {
+			status = ocsp.Revoked
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, crypto.Signer(ca.key))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	good := ca.issue(t, 10, "good", srv.URL)
+	revoked := ca.issue(t, 11, "revoked", srv.URL)
+	c := &RevocationChecker{OCSP: true}
+	if err := c.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check([]*x509.Certificate{revoked, ca.cert}); err == nil {
+		t.Fatal("Expected a revoked certificate to be rejected")
+	}
+
+	// Responses are cached.
+	down = true
+	if err := c.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatalf("Expected 2 OCSP requests, got %d", requests)
+	}
+
+	other := ca.issue(t, 12, "other", srv.URL)
+	if err := c.Check([]*x509.Certificate{other, ca.cert}); err == nil {
+		t.Fatal("Expected an unavailable responder to fail closed")
+	}
+	c.FailOpen = true
+	if err := c.Check([]*x509.Certificate{other, ca.cert}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevocationCRLServerHangs(t *testing.T) {
+	ca := newTestCA(t)
+	good := ca.issue(t, 10, "good", "")
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(3 * time.Hour),
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	requests := 0
+	hang := make(chan struct{})
+	hanging := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		h := hanging
+		mu.Unlock()
+		if h {
+			<-hang
+			return
+		}
+		w.Write(crl)
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	now := time.Now()
+	c := &RevocationChecker{
+		CRLs:   []string{srv.URL},
+		Client: &http.Client{Timeout: 200 * time.Millisecond},
+		time: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	}
+	if err := c.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the CRL is due for a reload that hangs, the previous one is used
+	// without waiting.
+	mu.Lock()
+	hanging = true
+	now = now.Add(2 * time.Hour)
+	mu.Unlock()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := c.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Expected checks not to wait for the reload, took %s", elapsed)
+	}
+	for i := 0; ; i++ {
+		c.mu.Lock()
+		loading := c.crlLoading
+		c.mu.Unlock()
+		if loading == nil {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("Expected the reload to time out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	if requests != 2 {
+		t.Fatalf("Expected a single reload, got %d requests", requests)
+	}
+	mu.Unlock()
+
+	// A failed reload backs off.
+	if err := c.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	loading := c.crlLoading
+	c.mu.Unlock()
+	if loading != nil {
+		t.Fatal("Expected no reload right after a failure")
+	}
+}
+
+func TestRevocationOCSPCacheLimit(t *testing.T) {
+	c := &RevocationChecker{}
+	now := time.Now()
+	for i := 0; i < maxOCSPCacheEntries+10; i++ {
+		c.cacheOCSP(sha256.Sum256([]byte(fmt.Sprint(i))), ocspCacheEntry{status: ocsp.Good, expires: now.Add(time.Hour)}, now)
+	}
+	if len(c.ocspCache) != maxOCSPCacheEntries {
+		t.Fatalf("Expected the cache to hold %d responses, got %d", maxOCSPCacheEntries, len(c.ocspCache))
+	}
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox/log"
+)
+
+// TrustBundles holds the root CAs and JWT signing keys of each trusted SPIFFE
+// trust domain. It is safe for concurrent use so bundles can be refreshed
+// while serving requests.
+type TrustBundles struct {
+	mu    sync.RWMutex
+	pools map[string]*x509.CertPool
+	jwt   map[string]map[string]crypto.PublicKey
+}
+
+// NewTrustBundles creates an empty set of trust bundles.
+func NewTrustBundles() *TrustBundles {
+	return &TrustBundles{
+		pools: map[string]*x509.CertPool{},
+		jwt:   map[string]map[string]crypto.PublicKey{},
+	}
+}
+
+// Set replaces the root CAs of a trust domain.
+func (b *TrustBundles) Set(trustDomain string, CAs *x509.CertPool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pools[trustDomain] = CAs
+}
+
+// Get returns the root CAs of a trust domain or nil if it is not trusted.
+func (b *TrustBundles) Get(trustDomain string) *x509.CertPool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.pools[trustDomain]
+}
+
+// SetJWTAuthorities replaces the keys used to verify JWT-SVIDs of a trust
+// domain, indexed by key ID.
+func (b *TrustBundles) SetJWTAuthorities(trustDomain string, keys map[string]crypto.PublicKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jwt[trustDomain] = keys
+}
+
+// JWTAuthority returns the key with the given ID of a trust domain or nil if
+// there is none.
+func (b *TrustBundles) JWTAuthority(trustDomain, keyID string) crypto.PublicKey {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.jwt[trustDomain][keyID]
+}
+
+// NewFederatedSpiffeAuthProvider initializes a SpiffeProvider that trusts
+// several SPIFFE trust domains. A client certificate is only verified against
+// the bundle of the trust domain in its SPIFFE ID, so one domain's CA can't
+// issue identities for another.
+func NewFederatedSpiffeAuthProvider(bundles *TrustBundles) *SpiffeProvider {
+	return &SpiffeProvider{
+		bundles: bundles,
+		time:    time.Now,
+	}
+}
+
+// NewFederatedSpiffeAuthFallbackProvider is the SpiffeFallbackProvider
+// equivalent of NewFederatedSpiffeAuthProvider.
+func NewFederatedSpiffeAuthFallbackProvider(bundles *TrustBundles) *SpiffeFallbackProvider {
+	return &SpiffeFallbackProvider{
+		SpiffeProvider: *NewFederatedSpiffeAuthProvider(bundles),
+	}
+}
+
+// authenticateFederated verifies the client certificate against the bundle of
+// the trust domain it claims.
+func (p *SpiffeProvider) authenticateFederated(r *http.Request) (*service, error) {
+	if !hasPeerCertificates(r) {
+		return nil, fmt.Errorf("auth: No peer certs configured")
+	}
+	certs := r.TLS.PeerCertificates
+	spiffeURIs, err := GetURINamesFromExtensions(&certs[0].Extensions)
+	if err != nil {
+		return nil, err
+	}
+	principal, err := spiffeToPrincipal(spiffeURIs)
+	if err != nil {
+		return nil, err
+	}
+	s := principal.(service)
+	CAs := p.bundles.Get(s.domain)
+	if CAs == nil {
+		return nil, fmt.Errorf("auth: SPIFFE trust domain %s is not trusted", s.domain)
+	}
+	if _, err := verifyCertificate(r, CAs, p.time, p.Revocation); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// spiffeBundle is the JWK set served by a SPIFFE bundle endpoint.
+type spiffeBundle struct {
+	Keys        []jwk `json:"keys"`
+	RefreshHint int64 `json:"spiffe_refresh_hint"`
+}
+
+type jwk struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Kid string   `json:"kid"`
+	X5c []string `json:"x5c"`
+	Crv string   `json:"crv"`
+	X   string   `json:"x"`
+	Y   string   `json:"y"`
+	N   string   `json:"n"`
+	E   string   `json:"e"`
+}
+
+// FetchSpiffeBundle gets the X.509 roots of a trust domain from a SPIFFE bundle
+// endpoint using the https_web profile, so the endpoint's own certificate is
+// verified with the roots configured in client. It also returns the refresh
+// hint of the bundle, which is zero if there is none.
+func FetchSpiffeBundle(client *http.Client, url string) (*x509.CertPool, time.Duration, error) {
+	pool, _, hint, err := fetchSpiffeBundle(client, url)
+	return pool, hint, err
+}
+
+// fetchSpiffeBundle gets both the X.509 roots and the JWT-SVID keys of a
+// bundle.
+func fetchSpiffeBundle(client *http.Client, url string) (*x509.CertPool, map[string]crypto.PublicKey, time.Duration, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, 0, fmt.Errorf("auth: bundle endpoint returned %s", resp.Status)
+	}
+	var bundle spiffeBundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return nil, nil, 0, fmt.Errorf("auth: invalid SPIFFE bundle: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	jwtKeys := map[string]crypto.PublicKey{}
+	n := 0
+	for _, k := range bundle.Keys {
+		switch k.Use {
+		case "x509-svid":
+			if len(k.X5c) != 1 {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("auth: invalid certificate in SPIFFE bundle: %s", err.Error())
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("auth: invalid certificate in SPIFFE bundle: %s", err.Error())
+			}
+			pool.AddCert(cert)
+			n++
+		case "jwt-svid":
+			key, err := k.publicKey()
+			if err != nil || k.Kid == "" {
+				// Skip keys we can't use rather than the whole bundle.
+				log.Printf("Ignoring JWT key %q in SPIFFE bundle from %s: %v", k.Kid, url, err)
+				continue
+			}
+			jwtKeys[k.Kid] = key
+		}
+	}
+	if n == 0 && len(jwtKeys) == 0 {
+		return nil, nil, 0, fmt.Errorf("auth: SPIFFE bundle has no X.509 or JWT authorities")
+	}
+	return pool, jwtKeys, time.Duration(bundle.RefreshHint) * time.Second, nil
+}
+
+// WatchSpiffeBundleEndpoint fetches the bundle of a trust domain, including
+// its JWT-SVID keys, into bundles and refreshes it every interval, or sooner
+// if the bundle's refresh hint asks for it. The previous bundle is kept when a
+// refresh fails. The first fetch happens before it returns and its error is
+// returned. Call stop to end the refreshes.
+func WatchSpiffeBundleEndpoint(bundles *TrustBundles, trustDomain, url string, client *http.Client, interval time.Duration) (stop func(), err error) {
+	refresh := func() (time.Duration, error) {
+		pool, jwtKeys, hint, err := fetchSpiffeBundle(client, url)
+		if err != nil {
+			return interval, err
+		}
+		bundles.Set(trustDomain, pool)
+		bundles.SetJWTAuthorities(trustDomain, jwtKeys)
+		if hint > 0 && hint < interval {
+			return hint, nil
+		}
+		return interval, nil
+	}
+
+	next, err := refresh()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(next)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+				next, err := refresh()
+				if err != nil {
+					log.Printf("Failed to refresh SPIFFE bundle of %s from %s: %s", trustDomain, url, err.Error())
+				}
+				timer.Reset(next)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
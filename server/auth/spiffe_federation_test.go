@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func spiffeTestTime() time.Time {
+	return time.Date(2018, time.March, 22, 11, 0, 0, 0, time.UTC)
+}
+
+func spiffeTestConnectionState(t *testing.T) *tls.ConnectionState {
+	der, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(spiffeCertB64, "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c}}
+}
+
+func TestFederatedSpiffe(t *testing.T) {
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM([]byte(spiffeCA))
+
+	bundles := NewTrustBundles()
+	bundles.Set("example.com", caPool)
+	a := NewFederatedSpiffeAuthProvider(bundles)
+	a.time = spiffeTestTime
+	testSpiffeAuthFlow(t, "0sANYTHING", a)
+
+	f := NewFederatedSpiffeAuthFallbackProvider(bundles)
+	f.time = spiffeTestTime
+	testSpiffeAuthFlow(t, "0tANYTHING", f)
+
+	// The CA is only trusted for its own trust domain.
+	other := NewTrustBundles()
+	other.Set("partner.example.org", caPool)
+	b := NewFederatedSpiffeAuthProvider(other)
+	b.time = spiffeTestTime
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.TLS = spiffeTestConnectionState(t)
+	if _, err := b.Authenticate("ANYTHING", req); err == nil {
+		t.Fatal("Expected a certificate from an untrusted domain to be rejected")
+	}
+}
+
+func TestWatchSpiffeBundleEndpoint(t *testing.T) {
+	block, _ := pem.Decode([]byte(spiffeCA))
+	jwtKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{"use": "x509-svid", "kty": "EC", "x5c": []string{base64.StdEncoding.EncodeToString(block.Bytes)}},
+			{"use": "jwt-svid", "kty": "EC"},
+			{"use": "jwt-svid", "kty": "EC", "kid": "k1", "crv": "P-256",
+				"x": base64.RawURLEncoding.EncodeToString(jwtKey.X.Bytes()),
+				"y": base64.RawURLEncoding.EncodeToString(jwtKey.Y.Bytes())},
+		},
+	}
+	fail := false
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(bundle)
+	}))
+	defer srv.Close()
+
+	bundles := NewTrustBundles()
+	stop, err := WatchSpiffeBundleEndpoint(bundles, "example.com", srv.URL, srv.Client(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	a := NewFederatedSpiffeAuthProvider(bundles)
+	a.time = spiffeTestTime
+	testSpiffeAuthFlow(t, "0sANYTHING", a)
+	if bundles.JWTAuthority("example.com", "k1") == nil {
+		t.Fatal("Expected the JWT authority to be loaded")
+	}
+
+	bundle["keys"] = []map[string]interface{}{}
+	if _, _, err := FetchSpiffeBundle(srv.Client(), srv.URL); err == nil {
+		t.Fatal("Expected a bundle without X.509 roots to be rejected")
+	}
+	fail = true
+	if _, err := WatchSpiffeBundleEndpoint(NewTrustBundles(), "example.com", srv.URL, srv.Client(), time.Hour); err == nil {
+		t.Fatal("Expected an error for an unavailable bundle endpoint")
+	}
+}
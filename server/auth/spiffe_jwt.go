@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// hasPeerCertificates reports whether the request came over a TLS connection
+// with a client certificate.
+func hasPeerCertificates(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
+
+// isJWT reports whether the token looks like a compact serialized JWT.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Sub string      `json:"sub"`
+	Aud jwtAudience `json:"aud"`
+	Exp int64       `json:"exp"`
+	Nbf int64       `json:"nbf"`
+}
+
+// jwtAudience is a string or a list of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = []string{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// authenticateJWT validates a JWT-SVID against the JWT authorities of the
+// trust domain in its subject.
+func (p *SpiffeProvider) authenticateJWT(token string) (*service, error) {
+	if p.bundles == nil || p.JWTAudience == "" {
+		return nil, fmt.Errorf("auth: JWT-SVIDs are not accepted")
+	}
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Typ != "" && header.Typ != "JWT" && header.Typ != "JOSE" {
+		return nil, fmt.Errorf("auth: unsupported JWT type %q", header.Typ)
+	}
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	principal, err := spiffeToPrincipal([]string{claims.Sub})
+	if err != nil {
+		return nil, err
+	}
+	s := principal.(service)
+
+	key := p.bundles.JWTAuthority(s.domain, header.Kid)
+	if header.Kid == "" || key == nil {
+		return nil, fmt.Errorf("auth: unknown JWT-SVID key %q for trust domain %s", header.Kid, s.domain)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("auth: invalid JWT signature encoding")
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	now := p.time().Unix()
+	if claims.Exp == 0 || now >= claims.Exp {
+		return nil, fmt.Errorf("auth: JWT-SVID is expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return nil, fmt.Errorf("auth: JWT-SVID is not valid yet")
+	}
+	audienceOK := false
+	for _, a := range claims.Aud {
+		if a == p.JWTAudience {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return nil, fmt.Errorf("auth: JWT-SVID audience does not include %s", p.JWTAudience)
+	}
+	return &s, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("auth: invalid JWT encoding")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("auth: invalid JWT: %s", err.Error())
+	}
+	return nil
+}
+
+// verifyJWTSignature checks the signature of a JWT for the asymmetric
+// algorithms allowed for JWT-SVIDs.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("auth: unsupported JWT algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("auth: unsupported JWT algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	invalid := fmt.Errorf("auth: invalid JWT-SVID signature")
+	switch alg[:2] {
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return invalid
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return invalid
+		}
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(k, hash, digest, sig, nil) != nil {
+			return invalid
+		}
+	default:
+		return fmt.Errorf("auth: unsupported JWT algorithm %q", alg)
+	}
+	return nil
+}
+
+// publicKey converts an EC or RSA JWK to a public key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestSpiffeJWT(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundles := NewTrustBundles()
+	bundles.SetJWTAuthorities("example.com", map[string]crypto.PublicKey{
+		"ec":  &ecKey.PublicKey,
+		"rsa": &rsaKey.PublicKey,
+	})
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	a := NewFederatedSpiffeAuthProvider(bundles)
+	a.time = func() time.Time { return now }
+	a.JWTAudience = "knox"
+
+	claims := func(sub string, aud interface{}, exp time.Time) map[string]interface{} {
+		return map[string]interface{}{"sub": sub, "aud": aud, "exp": exp.Unix()}
+	}
+	valid := claims("spiffe://example.com/service", []string{"other", "knox"}, now.Add(time.Minute))
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+
+	for _, token := range []string{
+		signTestJWT(t, "ES256", "ec", ecKey, valid),
+		signTestJWT(t, "RS256", "rsa", rsaKey, valid),
+		signTestJWT(t, "ES256", "ec", ecKey, claims("spiffe://example.com/service", "knox", now.Add(time.Minute))),
+	} {
+		p, err := a.Authenticate(token, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.GetID() != "spiffe://example.com/service" {
+			t.Fatalf("Unexpected ID %s", p.GetID())
+		}
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"ec"}`))
+	validClaims, _ := json.Marshal(valid)
+	bad := map[string]string{
+		"expired":      signTestJWT(t, "ES256", "ec", ecKey, claims("spiffe://example.com/service", "knox", now)),
+		"audience":     signTestJWT(t, "ES256", "ec", ecKey, claims("spiffe://example.com/service", "other", now.Add(time.Minute))),
+		"domain":       signTestJWT(t, "ES256", "ec", ecKey, claims("spiffe://partner.org/service", "knox", now.Add(time.Minute))),
+		"unknown key":  signTestJWT(t, "ES256", "missing", ecKey, valid),
+		"wrong signer": signTestJWT(t, "ES256", "ec", other, valid),
+		"wrong alg":    signTestJWT(t, "RS256", "ec", rsaKey, valid),
+		"none":         noneHeader + "." + base64.RawURLEncoding.EncodeToString(validClaims) + ".",
+	}
+	for name, token := range bad {
+		if _, err := a.Authenticate(token, req); err == nil {
+			t.Errorf("Expected the %s token to be rejected", name)
+		}
+	}
+
+	// Without an audience JWT-SVIDs are not accepted at all.
+	a.JWTAudience = ""
+	if _, err := a.Authenticate(signTestJWT(t, "ES256", "ec", ecKey, valid), req); err == nil {
+		t.Error("Expected JWT-SVIDs to be disabled")
+	}
+}
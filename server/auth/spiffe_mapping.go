@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+// SpiffeMappingRule rewrites a SPIFFE ID after the certificate is verified, so
+// ACLs can name a stable identity instead of every ephemeral workload, e.g.
+// spiffe://example.com/ns/web/pod/web-5d8f maps to spiffe://example.com/ns/web.
+type SpiffeMappingRule struct {
+	// TrustDomain limits the rule to IDs from one trust domain. Empty matches
+	// any trust domain.
+	TrustDomain string `json:"trust_domain"`
+	// Pattern is a regular expression that must match the whole path of the ID,
+	// without the leading slash. Empty matches any path.
+	Pattern string `json:"pattern"`
+	// Replacement is the new path, where $1 or ${name} refer to submatches of
+	// Pattern. Empty keeps the path.
+	Replacement string `json:"replacement"`
+	// Domain replaces the trust domain if set, to map an alias to its
+	// canonical name.
+	Domain string `json:"domain"`
+}
+
+// SpiffeMapper applies the first SpiffeMappingRule that matches an ID.
+type SpiffeMapper struct {
+	rules    []SpiffeMappingRule
+	patterns []*regexp.Regexp
+}
+
+// NewSpiffeMapper compiles mapping rules. Rules are tried in order.
+func NewSpiffeMapper(rules []SpiffeMappingRule) (*SpiffeMapper, error) {
+	m := &SpiffeMapper{rules: rules, patterns: make([]*regexp.Regexp, len(rules))}
+	for i, r := range rules {
+		p := r.Pattern
+		if p == "" {
+			p = ".*"
+		}
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("auth: invalid pattern in SPIFFE mapping rule %d: %s", i, err.Error())
+		}
+		m.patterns[i] = re
+	}
+	return m, nil
+}
+
+// Map returns the principal for a verified SPIFFE ID. A nil mapper returns
+// the ID unchanged.
+func (m *SpiffeMapper) Map(s service) (knox.Principal, error) {
+	if m == nil {
+		return s, nil
+	}
+	for i, r := range m.rules {
+		if r.TrustDomain != "" && r.TrustDomain != s.domain {
+			continue
+		}
+		re := m.patterns[i]
+		match := re.FindStringSubmatchIndex(s.id)
+		if match == nil {
+			continue
+		}
+		mapped := s
+		if r.Replacement != "" {
+			mapped.id = string(re.ExpandString(nil, r.Replacement, s.id, match))
+		}
+		if r.Domain != "" {
+			mapped.domain = r.Domain
+		}
+		if mapped.id == "" || strings.Contains(mapped.domain, "/") {
+			return nil, fmt.Errorf("auth: SPIFFE mapping rule %d produced an invalid ID for %s", i, s.GetID())
+		}
+		return mapped, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+	"testing"
+)
+
+func TestSpiffeMapper(t *testing.T) {
+	m, err := NewSpiffeMapper([]SpiffeMappingRule{
+		{TrustDomain: "example.com", Pattern: `ns/([^/]+)/pod/.*`, Replacement: "ns/$1"},
+		{TrustDomain: "alias.example.com", Domain: "example.com"},
+		{Pattern: `(?P<svc>[a-z]+)-canary`, Replacement: "${svc}"},
+		{Pattern: `drop/.*`, Replacement: "$9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct{ domain, path, expected string }{
+		{"example.com", "ns/web/pod/web-5d8f", "spiffe://example.com/ns/web"},
+		{"other.com", "ns/web/pod/web-5d8f", "spiffe://other.com/ns/web/pod/web-5d8f"},
+		{"alias.example.com", "ns/web", "spiffe://example.com/ns/web"},
+		{"other.com", "api-canary", "spiffe://other.com/api"},
+		{"other.com", "x/api-canary", "spiffe://other.com/x/api-canary"},
+	}
+	for _, c := range cases {
+		p, err := m.Map(service{c.domain, c.path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.GetID() != c.expected {
+			t.Errorf("Expected %s to map to %s, got %s", c.path, c.expected, p.GetID())
+		}
+	}
+	if _, err := m.Map(service{"other.com", "drop/me"}); err == nil {
+		t.Error("Expected a mapping to an empty path to fail")
+	}
+
+	var nilMapper *SpiffeMapper
+	if p, _ := nilMapper.Map(service{"example.com", "a"}); p.GetID() != "spiffe://example.com/a" {
+		t.Errorf("Unexpected ID %s", p.GetID())
+	}
+	if _, err := NewSpiffeMapper([]SpiffeMappingRule{{Pattern: "("}}); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+}
+
+func TestSpiffeProviderMapping(t *testing.T) {
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM([]byte(spiffeCA))
+	m, err := NewSpiffeMapper([]SpiffeMappingRule{{TrustDomain: "example.com", Replacement: "mapped"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewSpiffeAuthProvider(caPool)
+	a.time = spiffeTestTime
+	a.Mapper = m
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.TLS = spiffeTestConnectionState(t)
+	p, err := a.Authenticate("ANYTHING", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GetID() != "spiffe://example.com/mapped" {
+		t.Fatalf("Unexpected ID %s", p.GetID())
+	}
+}
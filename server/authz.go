@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// PrincipalKind is a kind of principal that a route can be restricted to.
+type PrincipalKind string
+
+const (
+	// UserPrincipal is a person authenticated by a user auth provider.
+	UserPrincipal PrincipalKind = "user"
+	// MachinePrincipal is a host authenticated by its hostname.
+	MachinePrincipal PrincipalKind = "machine"
+	// ServicePrincipal is a workload authenticated by its SPIFFE ID.
+	ServicePrincipal PrincipalKind = "service"
+)
+
+func (k PrincipalKind) matches(p knox.Principal) bool {
+	switch k {
+	case UserPrincipal:
+		return auth.IsUser(p)
+	case MachinePrincipal:
+		return auth.IsMachine(p)
+	case ServicePrincipal:
+		return auth.IsService(p)
+	}
+	return false
+}
+
+// needsAuthorization reports whether the route declares any requirements.
+func (r Route) needsAuthorization() bool {
+	return len(r.Principals) > 0 || r.KeyAccess != knox.None || r.Authorize != nil
+}
+
+// authorize checks the principal against the route's declared requirements,
+// in order: principal kinds, access to the key named by the keyID path
+// variable, then the route's Authorize function. It returns the key, with all
+// of its versions, if the route declares KeyAccess.
+func (r Route) authorize(m KeyManager, principal knox.Principal, parameters map[string]string) (*knox.Key, *HTTPError) {
+	if !r.needsAuthorization() {
+		return nil, nil
+	}
+	if principal == nil {
+		return nil, errF(knox.UnauthenticatedCode, "No principal for authorization")
+	}
+
+	if len(r.Principals) > 0 {
+		allowed := false
+		kinds := make([]string, len(r.Principals))
+		for i, k := range r.Principals {
+			allowed = allowed || k.matches(principal)
+			kinds[i] = string(k)
+		}
+		if !allowed {
+			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a %s for %s, principal is %s",
+				strings.Join(kinds, " or "), r.Id, principal.GetID()))
+		}
+	}
+
+	var key *knox.Key
+	if r.KeyAccess != knox.None {
+		keyID := parameters["keyID"]
+		var err *HTTPError
+		if key, err = getKey(m, keyID, knox.Inactive); err != nil {
+			return nil, err
+		}
+		// Access callbacks are given the primary version only, as for reads.
+		primary, _ := withStatus(key.Copy(), knox.Primary)
+		authorized, authzErr := authorizeRequest(primary, principal, r.KeyAccess)
+		if authzErr != nil {
+			return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
+		}
+		if !authorized {
+			access, _ := r.KeyAccess.MarshalJSON()
+			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s needs %s access to %s",
+				principal.GetID(), strings.Trim(string(access), `"`), keyID))
+		}
+	}
+
+	if r.Authorize != nil {
+		if err := r.Authorize(m, principal, parameters); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// getKey reads a key for a handler, which is the key loaded by authorize
+// if the route declares KeyAccess.
+func getKey(m KeyManager, keyID string, status knox.VersionStatus) (*knox.Key, *HTTPError) {
+	key, err := m.GetKey(keyID, status)
+	if err != nil {
+		if err == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return key, nil
+}
+
+// authorizedKeyManager gives handlers the key their route authorized the
+// request with, so it isn't read twice.
+type authorizedKeyManager struct {
+	KeyManager
+	key *knox.Key
+}
+
+// Options returns the options of the wrapped key manager.
+func (m *authorizedKeyManager) Options() KeyManagerOptions {
+	return optionsOf(m.KeyManager)
+}
+
+func (m *authorizedKeyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
+	if id != m.key.ID {
+		return m.KeyManager.GetKey(id, status)
+	}
+	return withStatus(m.key.Copy(), status)
+}
+
+// authorizeRoute is the decorator that enforces route requirements. addRoute
+// applies it after all other decorators, so the principal and parameters are
+// set by the time it runs.
+func authorizeRoute(r Route) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		if !r.needsAuthorization() {
+			return f
+		}
+		return func(w http.ResponseWriter, req *http.Request) {
+			key, err := r.authorize(getDB(req), GetPrincipal(req), GetParams(req))
+			if err != nil {
+				WriteErr(err)(w, req)
+				return
+			}
+			if key != nil {
+				setRouteKey(req, key)
+			}
+			f(w, req)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func TestRouteAuthorize(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("otheruser", []string{})
+	machine := auth.NewMachine("host1")
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	userOnly := Route{Id: "useronly", Principals: []PrincipalKind{UserPrincipal}}
+	if _, err := userOnly.authorize(m, u, nil); err != nil {
+		t.Fatalf("Expected user to be allowed, got %+v", err)
+	}
+	if _, err := userOnly.authorize(m, machine, nil); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected machine to be unauthorized, got %+v", err)
+	}
+	if _, err := userOnly.authorize(m, nil, nil); err == nil || err.Subcode != knox.UnauthenticatedCode {
+		t.Fatalf("Expected missing principal to be unauthenticated, got %+v", err)
+	}
+
+	either := Route{Id: "either", Principals: []PrincipalKind{UserPrincipal, MachinePrincipal}}
+	if _, err := either.authorize(m, machine, nil); err != nil {
+		t.Fatalf("Expected machine to be allowed, got %+v", err)
+	}
+
+	admin := Route{Id: "admin", KeyAccess: knox.Admin}
+	if key, err := admin.authorize(m, u, map[string]string{"keyID": "a1"}); err != nil || key.ID != "a1" {
+		t.Fatalf("Expected key admin to be allowed with the key, got %+v and %+v", key, err)
+	}
+	if _, err := admin.authorize(m, other, map[string]string{"keyID": "a1"}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected other user to be unauthorized, got %+v", err)
+	}
+	if _, err := admin.authorize(m, u, map[string]string{"keyID": "nope"}); err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected missing key error, got %+v", err)
+	}
+
+	custom := Route{Id: "custom", KeyAccess: knox.Read, Authorize: func(m KeyManager, p knox.Principal, params map[string]string) *HTTPError {
+		return errF(knox.UnauthorizedCode, "no")
+	}}
+	if _, err := custom.authorize(m, u, map[string]string{"keyID": "a1"}); err == nil || err.Message != "no" {
+		t.Fatalf("Expected custom authorization error, got %+v", err)
+	}
+
+	if _, err := (Route{Id: "open"}).authorize(m, nil, nil); err != nil {
+		t.Fatalf("Expected route without requirements to be allowed, got %+v", err)
+	}
+}
+
+func TestAdditionalRouteAuthorization(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	db := keydb.NewTempDB()
+	m := NewKeyManager(cryptor, db)
+	u := auth.NewUser("testuser", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	authenticate := func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Machine") != "" {
+				SetPrincipal(r, auth.NewMachine(r.Header.Get("Machine")))
+			} else {
+				SetPrincipal(r, auth.NewUser(r.Header.Get("User"), []string{}))
+			}
+			f(w, r)
+		}
+	}
+	called := false
+	route := Route{
+		Method: "POST",
+		Id:     "custom-admin",
+		Path:   "/v0/custom/{keyID}/",
+		Handler: func(m KeyManager, p knox.Principal, params map[string]string) (interface{}, *HTTPError) {
+			called = true
+			return "ok", nil
+		},
+		Principals: []PrincipalKind{UserPrincipal},
+		KeyAccess:  knox.Admin,
+		Parameters: []Parameter{UrlParameter("keyID")},
+	}
+	decorators := [](func(http.HandlerFunc) http.HandlerFunc){authenticate}
+	router, err := GetRouter(cryptor, db, decorators, []Route{route})
+	if err != nil {
+		t.Fatalf("Did not expect an error while creating router. Details: %v", err)
+	}
+
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"User", "testuser", knox.OKCode},
+		{"User", "otheruser", knox.UnauthorizedCode},
+		{"Machine", "host1", knox.UnauthorizedCode},
+	} {
+		called = false
+		r, _ := http.NewRequest("POST", "/v0/custom/a1/", bytes.NewBufferString(""))
+		r.Header.Set(tc.header, tc.value)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		resp := &knox.Response{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Code != tc.code {
+			t.Fatalf("%s %s: expected code %d, got %d (%s)", tc.header, tc.value, tc.code, resp.Code, resp.Message)
+		}
+		if called != (tc.code == knox.OKCode) {
+			t.Fatalf("%s %s: handler called is %v", tc.header, tc.value, called)
+		}
+	}
+}
+
+// countingKeyManager counts the keys read.
+type countingKeyManager struct {
+	KeyManager
+	gets int
+}
+
+func (m *countingKeyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
+	m.gets++
+	return m.KeyManager.GetKey(id, status)
+}
+
+func TestRouteTableAuthorization(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("host1")
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	params := map[string]string{
+		"keyID":    "a1",
+		"metadata": `{"team":"x"}`,
+		"data":     "Mg==",
+		"access":   `{"type":"Machine","id":"host2","access":"Read"}`,
+	}
+	for _, id := range []string{"putmetadata", "putlock", "postversion", "putaccess", "deletekey"} {
+		if _, err := serveRoute(id, m, machine, params); err == nil || err.Subcode != knox.UnauthorizedCode {
+			t.Fatalf("%s: expected the route to reject the machine, got %+v", id, err)
+		}
+		// Handlers leave authorization to the route and read the key the
+		// route authorized the request with.
+		counting := &countingKeyManager{KeyManager: m}
+		if _, err := serveRoute(id, counting, u, params); err != nil {
+			t.Fatalf("%s: %+v is not nil", id, err)
+		}
+		if counting.gets != 1 {
+			t.Fatalf("%s: expected the key to be read once, got %d reads", id, counting.gets)
+		}
+	}
+	if _, err := serveRoute("postkeys", m, machine, map[string]string{"id": "a2", "data": "MQ=="}); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected machines not to create keys, got %+v", err)
+	}
+}
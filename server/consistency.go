@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// consistencyPrincipal is the principal audit records of repairs made by a
+// ConsistencyChecker are attributed to.
+const consistencyPrincipal = "knox-consistency-checker"
+
+// CheckConsistency checks keys for version lists that break the invariants
+// knox.KeyVersionList.Validate enforces, which serving code relies on, and
+// for stale version hashes. With repair, keys with several primaries keep
+// the newest one and the others become active, keys without a primary get
+// their newest active version promoted, and version hashes are recomputed.
+// Keys with duplicate version IDs are only reported. Without keyIDs every key
+// is checked.
+func (m *keyManager) CheckConsistency(repair bool, keyIDs ...string) (*knox.ConsistencyReport, error) {
+	var keys []keydb.DBKey
+	if len(keyIDs) == 0 {
+		var err error
+		if keys, err = m.db.GetAll(); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range keyIDs {
+		k, err := m.db.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+
+	report := &knox.ConsistencyReport{Issues: []knox.ConsistencyIssue{}}
+	for i := range keys {
+		report.Checked++
+		issues, kvl := checkVersions(&keys[i])
+		if repair && kvl != nil {
+			err := m.repairVersions(&keys[i], kvl)
+			for j := range issues {
+				if err != nil {
+					issues[j].Repair = "Repair failed: " + err.Error()
+					continue
+				}
+				issues[j].Repaired = true
+			}
+		}
+		report.Issues = append(report.Issues, issues...)
+	}
+	return report, nil
+}
+
+// repairVersions writes the repaired version statuses of a key.
+func (m *keyManager) repairVersions(encK *keydb.DBKey, kvl knox.KeyVersionList) error {
+	defer m.reads.Forget(encK.ID)
+	return m.db.Update(withStatuses(encK, kvl, kvl.Hash(), encK.Metadata))
+}
+
+// checkVersions returns the issues of a key, and its versions with repaired
+// statuses if all of them can be repaired.
+func checkVersions(k *keydb.DBKey) ([]knox.ConsistencyIssue, knox.KeyVersionList) {
+	kvl := make(knox.KeyVersionList, 0, len(k.VersionList))
+	seen := map[uint64]bool{}
+	var duplicates []uint64
+	for _, v := range k.VersionList {
+		if seen[v.ID] {
+			duplicates = append(duplicates, v.ID)
+		}
+		seen[v.ID] = true
+		kvl = append(kvl, knox.KeyVersion{ID: v.ID, Status: v.Status, CreationTime: v.CreationTime})
+	}
+	if len(duplicates) > 0 {
+		return []knox.ConsistencyIssue{{
+			KeyID:    k.ID,
+			Problem:  knox.DuplicateVersionProblem,
+			Versions: duplicates,
+			Repair:   "Versions with duplicate IDs must be repaired by hand",
+		}}, nil
+	}
+
+	var issues []knox.ConsistencyIssue
+	var primaries []int
+	newestActive := -1
+	for i, v := range kvl {
+		switch v.Status {
+		case knox.Primary:
+			primaries = append(primaries, i)
+		case knox.Active:
+			if newestActive < 0 || v.CreationTime >= kvl[newestActive].CreationTime {
+				newestActive = i
+			}
+		}
+	}
+	switch {
+	case len(primaries) == 0 && newestActive < 0:
+		return []knox.ConsistencyIssue{{
+			KeyID:   k.ID,
+			Problem: knox.NoPrimaryProblem,
+			Repair:  "There is no active version to promote",
+		}}, nil
+	case len(primaries) == 0:
+		kvl[newestActive].Status = knox.Primary
+		issues = append(issues, knox.ConsistencyIssue{
+			KeyID:    k.ID,
+			Problem:  knox.NoPrimaryProblem,
+			Versions: []uint64{kvl[newestActive].ID},
+			Repair:   fmt.Sprintf("Promote the newest active version %d to primary", kvl[newestActive].ID),
+		})
+	case len(primaries) > 1:
+		newest := primaries[0]
+		for _, i := range primaries[1:] {
+			if kvl[i].CreationTime >= kvl[newest].CreationTime {
+				newest = i
+			}
+		}
+		ids := make([]uint64, 0, len(primaries))
+		var demoted []string
+		for _, i := range primaries {
+			ids = append(ids, kvl[i].ID)
+			if i != newest {
+				kvl[i].Status = knox.Active
+				demoted = append(demoted, fmt.Sprint(kvl[i].ID))
+			}
+		}
+		issues = append(issues, knox.ConsistencyIssue{
+			KeyID:    k.ID,
+			Problem:  knox.MultiplePrimariesProblem,
+			Versions: ids,
+			Repair:   fmt.Sprintf("Keep the newest primary version %d and make %s active", kvl[newest].ID, strings.Join(demoted, ", ")),
+		})
+	}
+	if len(issues) == 0 {
+		if k.VersionHash == kvl.Hash() {
+			return nil, nil
+		}
+		issues = append(issues, knox.ConsistencyIssue{
+			KeyID:   k.ID,
+			Problem: knox.VersionHashProblem,
+			Repair:  "Recompute the version hash",
+		})
+	}
+	return issues, kvl
+}
+
+// ConsistencyChecker checks the keys of a KeyManager for broken invariants
+// at startup and periodically, logging and notifying about them.
+type ConsistencyChecker struct {
+	// Repair fixes the keys that can be repaired instead of only reporting
+	// them. Repairs are recorded in the AuditLog of the KeyManagerOptions.
+	Repair bool
+
+	mu       sync.Mutex
+	notified map[string]string
+}
+
+// Run checks every key once. A notification is sent the first time this
+// checker sees each problem with a key.
+func (c *ConsistencyChecker) Run(m KeyManager) (*knox.ConsistencyReport, error) {
+	report, err := m.CheckConsistency(c.Repair)
+	if err != nil {
+		return nil, err
+	}
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			log.Printf("Repaired key %s with %s: %s", issue.KeyID, issue.Problem, issue.Repair)
+		} else {
+			log.Printf("Key %s has %s: %s", issue.KeyID, issue.Problem, issue.Repair)
+		}
+		c.notifyOnce(m, issue)
+	}
+	auditRepairs(optionsOf(m).AuditLog, consistencyPrincipal, "service", report)
+	return report, nil
+}
+
+func (c *ConsistencyChecker) notifyOnce(m KeyManager, issue knox.ConsistencyIssue) {
+	c.mu.Lock()
+	if c.notified == nil {
+		c.notified = map[string]string{}
+	}
+	seen := c.notified[issue.KeyID] == issue.Problem
+	c.notified[issue.KeyID] = issue.Problem
+	c.mu.Unlock()
+	if seen {
+		return
+	}
+	msg := issue.Repair
+	if issue.Repaired {
+		msg = "Repaired: " + msg
+	}
+	notify(optionsOf(m).Notifier, Notification{
+		Type:    InconsistentKeyNotification,
+		KeyID:   issue.KeyID,
+		Message: fmt.Sprintf("%s: %s", issue.Problem, msg),
+		Time:    time.Now().UnixNano(),
+	})
+}
+
+// Start runs the checker every interval in a new goroutine until the
+// returned function is called.
+func (c *ConsistencyChecker) Start(m KeyManager, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := c.Run(m); err != nil {
+					log.Printf("Key consistency check failed: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// auditRepairs records the keys repaired by principal in auditLog.
+func auditRepairs(auditLog *AuditLog, principal, principalType string, report *knox.ConsistencyReport) {
+	if auditLog == nil {
+		return
+	}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			continue
+		}
+		auditLog.Observe(AccessEvent{
+			Principal:     principal,
+			PrincipalType: principalType,
+			RouteID:       "repairkey",
+			KeyID:         issue.KeyID,
+			Success:       true,
+			Time:          time.Now(),
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// setStatuses overwrites the version statuses of a key in the db, bypassing
+// the validation of the key manager.
+func setStatuses(t *testing.T, db keydb.DB, id string, statuses ...knox.VersionStatus) *keydb.DBKey {
+	k, err := db.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range statuses {
+		k.VersionList[i].Status = s
+	}
+	if err := db.Update(k); err != nil {
+		t.Fatal(err)
+	}
+	k, _ = db.Get(id)
+	return k
+}
+
+func TestCheckConsistency(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	for _, id := range []string{"two", "none", "stuck", "fine"} {
+		if _, err := postKeysHandler(m, u, map[string]string{"id": id, "data": "MQ=="}); err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		if _, err := postVersionHandler(m, u, map[string]string{"keyID": id, "data": "Mg=="}); err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+	two := setStatuses(t, db, "two", knox.Primary, knox.Primary)
+	none := setStatuses(t, db, "none", knox.Active, knox.Active)
+	setStatuses(t, db, "stuck", knox.Inactive, knox.Inactive)
+
+	report, err := m.CheckConsistency(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 4 || len(report.Issues) != 3 {
+		t.Fatalf("Expected issues with 3 keys, got %+v", report)
+	}
+	problems := map[string]string{}
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			t.Fatalf("Expected nothing to be repaired by a check, got %+v", issue)
+		}
+		problems[issue.KeyID] = issue.Problem
+	}
+	// The hash of the changed keys is stale as well, but only reported on its
+	// own once the versions are consistent.
+	if problems["two"] != knox.MultiplePrimariesProblem || problems["none"] != knox.NoPrimaryProblem || problems["stuck"] != knox.NoPrimaryProblem {
+		t.Fatalf("Unexpected problems %v", problems)
+	}
+
+	audit := NewAuditLog(10)
+	report, err = m.CheckConsistency(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditRepairs(audit, "admin", "user", report)
+	for _, issue := range report.Issues {
+		if issue.Repaired != (issue.KeyID != "stuck") {
+			t.Fatalf("Unexpected repair %+v", issue)
+		}
+	}
+	if events := audit.Events("admin", "", 10); len(events) != 2 {
+		t.Fatalf("Expected the repairs to be audited, got %+v", events)
+	}
+
+	k, err := m.GetKey("two", knox.Inactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Validate(); err != nil {
+		t.Fatalf("Expected a valid key after the repair, got %s", err)
+	}
+	if p := k.VersionList.GetPrimary(); p.ID != two.VersionList[1].ID {
+		t.Fatalf("Expected the newest primary to be kept, got %d", p.ID)
+	}
+	k, _ = m.GetKey("none", knox.Inactive)
+	if p := k.VersionList.GetPrimary(); p == nil || p.ID != none.VersionList[1].ID {
+		t.Fatalf("Expected the newest active version to be promoted, got %+v", p)
+	}
+
+	report, err = m.CheckConsistency(true, "fine")
+	if err != nil || report.Checked != 1 || len(report.Issues) != 0 {
+		t.Fatalf("Expected a consistent key, got %+v %v", report, err)
+	}
+	if _, err := m.CheckConsistency(true, "missing"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected a missing key, got %v", err)
+	}
+}
+
+func TestConsistencyChecker(t *testing.T) {
+	var notified []Notification
+	db := &keydb.TempDB{}
+	m := NewKeyManagerWithOptions(keydb.NewAESGCMCryptor(0, []byte("testtesttesttest")), db, KeyManagerOptions{Notifier: record(&notified)})
+	u := auth.NewUser("testuser", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k, _ := db.Get("a1")
+	k.VersionHash = "stale"
+	db.Update(k)
+
+	c := &ConsistencyChecker{}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Run(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(notified) != 1 || notified[0].Type != InconsistentKeyNotification || notified[0].KeyID != "a1" {
+		t.Fatalf("Expected a single notification, got %+v", notified)
+	}
+
+	c.Repair = true
+	report, err := c.Run(m)
+	if err != nil || len(report.Issues) != 1 || !report.Issues[0].Repaired || report.Issues[0].Problem != knox.VersionHashProblem {
+		t.Fatalf("Expected the hash to be repaired, got %+v %v", report, err)
+	}
+	if report, _ := c.Run(m); len(report.Issues) != 0 {
+		t.Fatalf("Expected no issues after the repair, got %+v", report)
+	}
+}
+
+func TestAdminRepairHandler(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	setStatuses(t, db, "a1", knox.Active)
+
+	i, err := adminConsistencyHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if r := i.(*knox.ConsistencyReport); len(r.Issues) != 1 || r.Issues[0].Repaired {
+		t.Fatalf("Unexpected report %+v", r)
+	}
+	if _, err := adminRepairHandler(m, u, map[string]string{"key": "missing"}); err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected a missing key error, got %+v", err)
+	}
+	i, err = adminRepairHandler(m, u, map[string]string{"key": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if r := i.(*knox.ConsistencyReport); len(r.Issues) != 1 || !r.Issues[0].Repaired {
+		t.Fatalf("Unexpected report %+v", r)
+	}
+}
@@ -0,0 +1,119 @@
+// Package dbrotate is a server rotation plugin that changes database user
+// passwords when a new version of a knox key becomes primary, so the new
+// password is valid before any client reads it.
+//
+// It handles keys whose ID starts with "db:" and that carry the metadata
+// entries "db.target", naming a database registered with AddTarget, and
+// "db.user", the database user whose password is the key data. MySQL targets
+// also read "db.host" (default "%"). Keys without this metadata are ignored.
+//
+//	r := dbrotate.New()
+//	r.AddTarget("main", dbrotate.Postgres, adminDB)
+//	m := server.NewKeyManagerWithOptions(cryptor, db, server.KeyManagerOptions{
+//		RotationPlugins: []server.RotationPlugin{r},
+//	})
+package dbrotate
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+// Dialect is the SQL flavor of a target database.
+type Dialect int
+
+// Supported dialects.
+const (
+	Postgres Dialect = iota
+	MySQL
+)
+
+// Key ID prefix and metadata entries read by the plugin.
+const (
+	KeyPrefix        = "db:"
+	MetadataTarget   = "db.target"
+	MetadataUser     = "db.user"
+	MetadataHost     = "db.host"
+	defaultMySQLHost = "%"
+)
+
+type target struct {
+	dialect Dialect
+	db      *sql.DB
+}
+
+// PasswordRotator implements server.RotationPlugin.
+type PasswordRotator struct {
+	targets map[string]target
+}
+
+// New creates a PasswordRotator with no targets.
+func New() *PasswordRotator {
+	return &PasswordRotator{targets: map[string]target{}}
+}
+
+// AddTarget registers a database connection, with privileges to alter users,
+// under the name used in the "db.target" metadata of keys.
+func (r *PasswordRotator) AddTarget(name string, dialect Dialect, db *sql.DB) {
+	r.targets[name] = target{dialect, db}
+}
+
+// BeforePromote sets the database user's password to the new version's data.
+func (r *PasswordRotator) BeforePromote(key *knox.Key, version *knox.KeyVersion) error {
+	if !strings.HasPrefix(key.ID, KeyPrefix) {
+		return nil
+	}
+	name, user := key.Metadata[MetadataTarget], key.Metadata[MetadataUser]
+	if name == "" || user == "" {
+		return nil
+	}
+	t, ok := r.targets[name]
+	if !ok {
+		return fmt.Errorf("Unknown database target %s for key %s", name, key.ID)
+	}
+	stmt, err := alterUser(t.dialect, user, key.Metadata[MetadataHost], string(version.Data))
+	if err != nil {
+		return err
+	}
+	if _, err := t.db.Exec(stmt); err != nil {
+		return fmt.Errorf("Error changing password of %s on %s: %s", user, name, err.Error())
+	}
+	return nil
+}
+
+// alterUser builds the statement changing a password. Neither dialect
+// accepts placeholders in ALTER USER so values are quoted instead.
+func alterUser(d Dialect, user, host, password string) (string, error) {
+	switch d {
+	case Postgres:
+		return fmt.Sprintf("ALTER USER %s WITH PASSWORD %s", quotePostgresIdent(user), quotePostgresLiteral(password)), nil
+	case MySQL:
+		if host == "" {
+			host = defaultMySQLHost
+		}
+		return fmt.Sprintf("ALTER USER %s@%s IDENTIFIED BY %s", quoteMySQL(user), quoteMySQL(host), quoteMySQL(password)), nil
+	default:
+		return "", fmt.Errorf("Unsupported database dialect %d", d)
+	}
+}
+
+func quotePostgresIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quotePostgresLiteral uses the escape string syntax so backslashes are
+// handled the same regardless of standard_conforming_strings.
+func quotePostgresLiteral(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `''`)
+	return `E'` + s + `'`
+}
+
+func quoteMySQL(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return `'` + s + `'`
+}
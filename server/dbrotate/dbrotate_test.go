@@ -0,0 +1,109 @@
+package dbrotate
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+// recordingDriver records executed statements instead of talking to a database.
+type recordingDriver struct {
+	queries []string
+	err     error
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec([]driver.Value) (driver.Result, error) {
+	if s.d.err != nil {
+		return nil, s.d.err
+	}
+	s.d.queries = append(s.d.queries, s.query)
+	return driver.RowsAffected(0), nil
+}
+func (s *recordingStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func TestBeforePromote(t *testing.T) {
+	d := &recordingDriver{}
+	sql.Register("dbrotate_test", d)
+	db, err := sql.Open("dbrotate_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New()
+	r.AddTarget("pg", Postgres, db)
+	r.AddTarget("my", MySQL, db)
+
+	version := &knox.KeyVersion{ID: 2, Data: []byte(`pa'ss\word`)}
+	cases := []struct {
+		key      knox.Key
+		expected string
+	}{
+		{
+			knox.Key{ID: "db:app", Metadata: knox.KeyMetadata{MetadataTarget: "pg", MetadataUser: `app"user`}},
+			`ALTER USER "app""user" WITH PASSWORD E'pa''ss\\word'`,
+		},
+		{
+			knox.Key{ID: "db:app", Metadata: knox.KeyMetadata{MetadataTarget: "my", MetadataUser: "app"}},
+			`ALTER USER 'app'@'%' IDENTIFIED BY 'pa\'ss\\word'`,
+		},
+		{
+			knox.Key{ID: "db:app", Metadata: knox.KeyMetadata{MetadataTarget: "my", MetadataUser: "app", MetadataHost: "10.0.0.1"}},
+			`ALTER USER 'app'@'10.0.0.1' IDENTIFIED BY 'pa\'ss\\word'`,
+		},
+	}
+	for _, c := range cases {
+		d.queries = nil
+		if err := r.BeforePromote(&c.key, version); err != nil {
+			t.Fatal(err)
+		}
+		if len(d.queries) != 1 || d.queries[0] != c.expected {
+			t.Fatalf("Expected %s, got %v", c.expected, d.queries)
+		}
+	}
+
+	// Keys without the prefix or metadata are ignored.
+	d.queries = nil
+	ignored := []knox.Key{
+		{ID: "app", Metadata: knox.KeyMetadata{MetadataTarget: "pg", MetadataUser: "app"}},
+		{ID: "db:app"},
+	}
+	for _, k := range ignored {
+		if err := r.BeforePromote(&k, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(d.queries) != 0 {
+		t.Fatalf("Expected no queries, got %v", d.queries)
+	}
+
+	unknown := &knox.Key{ID: "db:app", Metadata: knox.KeyMetadata{MetadataTarget: "nope", MetadataUser: "app"}}
+	if err := r.BeforePromote(unknown, version); err == nil {
+		t.Fatal("Expected error for unknown target")
+	}
+	d.err = fmt.Errorf("permission denied")
+	k := &knox.Key{ID: "db:app", Metadata: knox.KeyMetadata{MetadataTarget: "pg", MetadataUser: "app"}}
+	if err := r.BeforePromote(k, version); err == nil {
+		t.Fatal("Expected error from the database")
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// DBHealth is the result of a keydb health check.
+type DBHealth struct {
+	Healthy bool             `json:"healthy"`
+	Error   string           `json:"error,omitempty"`
+	Latency time.Duration    `json:"latency"`
+	Pool    *keydb.PoolStats `json:"pool,omitempty"`
+}
+
+// CheckDBHealth pings db and reports its connection pool.
+func CheckDBHealth(db keydb.DB) DBHealth {
+	start := time.Now()
+	err := keydb.Ping(db)
+	h := DBHealth{Healthy: err == nil, Latency: time.Since(start)}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	if p, ok := keydb.GetPoolStats(db); ok {
+		h.Pool = &p
+	}
+	return h
+}
+
+// DBHealthHandler serves the health of db as JSON, with a 503 status while
+// the database can't be reached so load balancers stop routing to the
+// server.
+func DBHealthHandler(db keydb.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := CheckDBHealth(db)
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		knox.JSONCodec.Encode(w, h)
+	}
+}
+
+// DBStatsHandler serves the operation and connection pool metrics of db as
+// JSON, for metrics systems to scrape.
+func DBStatsHandler(db *keydb.InstrumentedDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		knox.JSONCodec.Encode(w, db.Stats())
+	}
+}
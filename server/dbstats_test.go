@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func TestDBHealthHandler(t *testing.T) {
+	db := keydb.NewFaultDB(keydb.NewTempDB(), 1)
+	w := httptest.NewRecorder()
+	DBHealthHandler(db)(w, httptest.NewRequest("GET", "/healthz/keydb", nil))
+	var h DBHealth
+	if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !h.Healthy {
+		t.Fatalf("Expected a healthy DB, got %d %+v", w.Code, h)
+	}
+
+	db.Inject(keydb.OpGet, keydb.Fault{Err: errors.New("connection refused")})
+	w = httptest.NewRecorder()
+	DBHealthHandler(db)(w, httptest.NewRequest("GET", "/healthz/keydb", nil))
+	h = DBHealth{}
+	if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || h.Healthy || h.Error != "connection refused" {
+		t.Fatalf("Expected an unhealthy DB, got %d %+v", w.Code, h)
+	}
+}
+
+func TestDBStatsHandler(t *testing.T) {
+	db := keydb.NewInstrumentedDB(keydb.NewTempDB())
+	db.Get("a")
+	w := httptest.NewRecorder()
+	DBStatsHandler(db)(w, httptest.NewRequest("GET", "/metrics/keydb", nil))
+	var s keydb.DBStats
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Ops[keydb.OpGet].Calls != 1 {
+		t.Fatalf("Expected one get, got %+v", s.Ops)
+	}
+}
@@ -19,6 +19,9 @@ const (
 	paramsContext
 	dbContext
 	idContext
+	bodyContext
+	keyContext
+	syncContext
 )
 
 // GetAPIError gets the HTTP error that will be returned from the server.
@@ -70,6 +73,30 @@ func setDB(r *http.Request, val KeyManager) {
 	context.Set(r, dbContext, val)
 }
 
+// getRouteKey gets the key loaded to authorize the request, if any.
+func getRouteKey(r *http.Request) *knox.Key {
+	if rv := context.Get(r, keyContext); rv != nil {
+		return rv.(*knox.Key)
+	}
+	return nil
+}
+
+func setRouteKey(r *http.Request, val *knox.Key) {
+	context.Set(r, keyContext, val)
+}
+
+// getSyncedKeys gets the result of a sync request, if any.
+func getSyncedKeys(r *http.Request) *knox.KeySync {
+	if rv := context.Get(r, syncContext); rv != nil {
+		return rv.(*knox.KeySync)
+	}
+	return nil
+}
+
+func setSyncedKeys(r *http.Request, val *knox.KeySync) {
+	context.Set(r, syncContext, val)
+}
+
 func getOrInitializePrincipalContext(r *http.Request) auth.PrincipalContext {
 	if ctx := context.Get(r, principalContext); ctx != nil {
 		return ctx.(auth.PrincipalContext)
@@ -102,7 +129,13 @@ func AddHeader(k, v string) func(http.HandlerFunc) http.HandlerFunc {
 }
 
 // Logger logs the request and response information in json format to the logger given.
-func Logger(logger *log.Logger) func(http.HandlerFunc) http.HandlerFunc {
+// The same records are written to each of the shippers, e.g. to send the access log to
+// a SIEM as well.
+func Logger(logger *log.Logger, shippers ...*LogShipper) func(http.HandlerFunc) http.HandlerFunc {
+	shipped := make([]*log.Logger, 0, len(shippers))
+	for _, s := range shippers {
+		shipped = append(shipped, logger.WithOutput(s))
+	}
 	return func(f http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			f(w, r)
@@ -125,6 +158,9 @@ func Logger(logger *log.Logger) func(http.HandlerFunc) http.HandlerFunc {
 				e.Msg = apiError.Message
 			}
 			logger.OutputJSON(e)
+			for _, l := range shipped {
+				l.OutputJSON(e)
+			}
 		}
 	}
 }
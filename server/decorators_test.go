@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox/server/auth"
+)
+
+func FuzzProviderMatch(f *testing.F) {
+	f.Add("0uuser")
+	f.Add("0t")
+	f.Add("0s" + "eyJhbGciOiJFUzI1NiJ9.e30.sig")
+	f.Add("")
+	f.Add("1u\x00")
+	providers := []auth.Provider{
+		auth.NewMTLSAuthProvider(x509.NewCertPool()),
+		auth.NewSpiffeAuthProvider(x509.NewCertPool()),
+		auth.MockGitHubProvider(),
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		r, err := http.NewRequest("GET", "/v0/keys/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header["Authorization"] = []string{header}
+		for _, p := range providers {
+			match, payload := providerMatch(p, r)
+			want := len(header) > 2 && header[0] == p.Version() && header[1] == p.Type()
+			if match != want {
+				t.Fatalf("providerMatch(%s, %q) = %v", p.Name(), header, match)
+			}
+			if match && payload != header[2:] {
+				t.Fatalf("Unexpected payload %q for %q", payload, header)
+			}
+		}
+
+		// Without client certificates only user tokens can authenticate.
+		authenticated := false
+		handler := Authentication(providers, nil)(func(w http.ResponseWriter, r *http.Request) {
+			authenticated = GetPrincipal(r) != nil
+		})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if authenticated != (strings.HasPrefix(header, "0u") && len(header) > 2 && header != "0u"+"notvalid") {
+			t.Fatalf("Header %q authenticated: %v", header, authenticated)
+		}
+		if !authenticated && w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for %q, got %d", header, w.Code)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// defaultExpiryWarning is how long before a key expires reads of it start to
+// carry a warning.
+const defaultExpiryWarning = 7 * 24 * time.Hour
+
+var expiryWarning = defaultExpiryWarning
+
+// SetExpiryWarning sets how long before a key's knox.expires_at time reads of
+// the key return a warning, for KeyManagers made with NewKeyManager or
+// GetRouter. Zero disables the warnings.
+//
+// Deprecated: Set KeyManagerOptions.ExpiryWarning and use
+// NewKeyManagerWithOptions.
+func SetExpiryWarning(d time.Duration) {
+	expiryWarning = d
+}
+
+// globalExpiryWarning is the ExpiryWarning option for the duration set with
+// SetExpiryWarning.
+func globalExpiryWarning() time.Duration {
+	if expiryWarning == 0 {
+		return -1
+	}
+	return expiryWarning
+}
+
+// expiryWarningOf returns how long before expiry reads of keys carry a
+// warning with opts, zero if they never do.
+func expiryWarningOf(opts KeyManagerOptions) time.Duration {
+	switch {
+	case opts.ExpiryWarning < 0:
+		return 0
+	case opts.ExpiryWarning == 0:
+		return defaultExpiryWarning
+	}
+	return opts.ExpiryWarning
+}
+
+// ExpiryReaper acts on keys whose knox.expires_at time has passed. Reads of
+// expired keys are refused whether or not a reaper runs; the reaper sends a
+// KeyExpiredNotification for each of them and deletes those whose expiry
+// action is knox.ExpiryDelete.
+type ExpiryReaper struct {
+	// Warning, if set, also sends a KeyExpiringNotification once for keys
+	// that expire within this duration.
+	Warning time.Duration
+
+	mu       sync.Mutex
+	notified map[string]string
+}
+
+// ExpiredKey is a key the reaper found expired.
+type ExpiredKey struct {
+	KeyID     string
+	ExpiresAt time.Time
+	Deleted   bool
+}
+
+// Run checks the expiry of every key once and returns the expired keys.
+// Notifications are only sent the first time a key is seen expiring or
+// expired by this reaper.
+func (r *ExpiryReaper) Run(m KeyManager) ([]ExpiredKey, error) {
+	ids, err := m.GetAllKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var expired []ExpiredKey
+	for _, id := range ids {
+		key, err := m.GetKey(id, knox.Inactive)
+		if err != nil {
+			if err == knox.ErrKeyIDNotFound {
+				continue
+			}
+			return expired, err
+		}
+		expiresAt, ok := key.Metadata.ExpiresAt()
+		if !ok {
+			continue
+		}
+		if now.Before(expiresAt) {
+			if r.Warning > 0 && expiresAt.Sub(now) < r.Warning {
+				r.notifyOnce(m, id, KeyExpiringNotification, expiresAt)
+			}
+			continue
+		}
+		e := ExpiredKey{KeyID: id, ExpiresAt: expiresAt}
+		r.notifyOnce(m, id, KeyExpiredNotification, expiresAt)
+		if key.Metadata[knox.MetadataExpiryAction] == knox.ExpiryDelete {
+			if err := m.DeleteKey(id); err != nil {
+				log.Printf("Failed to delete expired key %s: %s", id, err.Error())
+			} else {
+				e.Deleted = true
+				r.mu.Lock()
+				delete(r.notified, id)
+				r.mu.Unlock()
+			}
+		}
+		expired = append(expired, e)
+	}
+	return expired, nil
+}
+
+func (r *ExpiryReaper) notifyOnce(m KeyManager, keyID, typ string, expiresAt time.Time) {
+	r.mu.Lock()
+	if r.notified == nil {
+		r.notified = map[string]string{}
+	}
+	seen := r.notified[keyID] == typ
+	r.notified[keyID] = typ
+	r.mu.Unlock()
+	if seen {
+		return
+	}
+	notify(optionsOf(m).Notifier, Notification{
+		Type:    typ,
+		KeyID:   keyID,
+		Message: fmt.Sprintf("Key expires at %s", expiresAt.Format(time.RFC3339)),
+		Time:    time.Now().UnixNano(),
+	})
+}
+
+// Start runs the reaper every interval in a new goroutine until the returned
+// function is called.
+func (r *ExpiryReaper) Start(m KeyManager, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := r.Run(m); err != nil {
+					log.Printf("Key expiry check failed: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func expiryMetadata(expiresAt time.Time, action string) string {
+	md := fmt.Sprintf(`{"knox.expires_at":%q`, expiresAt.UTC().Format(time.RFC3339))
+	if action != "" {
+		md += fmt.Sprintf(`,"knox.expiry_action":%q`, action)
+	}
+	return md + "}"
+}
+
+func TestGetExpiredKey(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "bad", "data": "MQ==", "metadata": `{"knox.expires_at":"tomorrow"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "later", "data": "MQ==", "metadata": expiryMetadata(time.Now().Add(30*24*time.Hour), "")})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "soon", "data": "MQ==", "metadata": expiryMetadata(time.Now().Add(time.Hour), "")})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "past", "data": "MQ==", "metadata": expiryMetadata(time.Now().Add(-time.Hour), "")})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	data, err := getKeyHandler(m, u, map[string]string{"keyID": "later"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, ok := data.(*knox.Key); !ok {
+		t.Fatalf("Expected a key without warnings, got %+v", data)
+	}
+	data, err = getKeyHandler(m, u, map[string]string{"keyID": "soon"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if wd, ok := data.(withWarnings); !ok || len(wd.warnings) != 1 {
+		t.Fatalf("Expected an expiry warning, got %+v", data)
+	}
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "past"})
+	if err == nil || err.Subcode != knox.KeyExpiredCode {
+		t.Fatalf("Expected expired key, got %+v", err)
+	}
+
+	// The warning period is an option.
+	for _, c := range []struct {
+		warning time.Duration
+		warned  bool
+	}{{-1, false}, {time.Minute, false}, {2 * time.Hour, true}} {
+		m := makeDBWithOptions(KeyManagerOptions{ExpiryWarning: c.warning})
+		_, err := postKeysHandler(m, u, map[string]string{"id": "soon", "data": "MQ==", "metadata": expiryMetadata(time.Now().Add(time.Hour), "")})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		data, err := getKeyHandler(m, u, map[string]string{"keyID": "soon"})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		if _, warned := data.(withWarnings); warned != c.warned {
+			t.Fatalf("Expected warning %v with %s, got %+v", c.warned, c.warning, data)
+		}
+	}
+}
+
+func TestExpiryReaper(t *testing.T) {
+	var notifications []Notification
+	m := makeDBWithOptions(KeyManagerOptions{Notifier: record(&notifications)})
+	u := auth.NewUser("testuser", []string{})
+
+	keys := map[string]string{
+		"soon":    expiryMetadata(time.Now().Add(time.Hour), ""),
+		"refused": expiryMetadata(time.Now().Add(-time.Hour), knox.ExpiryRefuse),
+		"deleted": expiryMetadata(time.Now().Add(-time.Hour), knox.ExpiryDelete),
+		"forever": `{}`,
+	}
+	for id, md := range keys {
+		_, err := postKeysHandler(m, u, map[string]string{"id": id, "data": "MQ==", "metadata": md})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+
+	r := &ExpiryReaper{Warning: 24 * time.Hour}
+	expired, err := r.Run(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("Expected 2 expired keys, got %+v", expired)
+	}
+	for _, e := range expired {
+		if e.Deleted != (e.KeyID == "deleted") {
+			t.Fatalf("Unexpected expired key %+v", e)
+		}
+	}
+	if _, err := m.GetKey("deleted", knox.Primary); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected deleted key to be gone, got %v", err)
+	}
+	if _, err := m.GetKey("refused", knox.Primary); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	types := map[string]string{}
+	for _, n := range notifications {
+		types[n.KeyID] = n.Type
+	}
+	if len(notifications) != 3 || types["soon"] != KeyExpiringNotification || types["refused"] != KeyExpiredNotification || types["deleted"] != KeyExpiredNotification {
+		t.Fatalf("Unexpected notifications %+v", notifications)
+	}
+
+	// Keys are only reported once.
+	if _, err := r.Run(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 3 {
+		t.Fatalf("Expected no new notifications, got %+v", notifications[3:])
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pinterest/knox"
+)
+
+// KeyGenerator creates data for a new version of key during server side
+// rotation. spec is the part of the key's generator metadata after the
+// generator name, e.g. "32" for "random:32".
+type KeyGenerator interface {
+	Generate(spec string, key *knox.Key) ([]byte, error)
+}
+
+// KeyGeneratorFunc adapts a function to the KeyGenerator interface.
+type KeyGeneratorFunc func(spec string, key *knox.Key) ([]byte, error)
+
+// Generate calls f(spec, key).
+func (f KeyGeneratorFunc) Generate(spec string, key *knox.Key) ([]byte, error) {
+	return f(spec, key)
+}
+
+// builtinKeyGenerators are available to every KeyManager.
+var builtinKeyGenerators = map[string]KeyGenerator{
+	"random": KeyGeneratorFunc(generateRandom),
+}
+
+var keyGeneratorsMu sync.Mutex
+var keyGenerators = map[string]KeyGenerator{}
+
+// AddKeyGenerator registers a generator that keys of KeyManagers made with
+// NewKeyManager or GetRouter can select with "<name>:<spec>" in their
+// knox.generator metadata. Generators should be added before serving.
+//
+// Deprecated: Set KeyManagerOptions.KeyGenerators and use
+// NewKeyManagerWithOptions.
+func AddKeyGenerator(name string, g KeyGenerator) {
+	keyGeneratorsMu.Lock()
+	defer keyGeneratorsMu.Unlock()
+	keyGenerators[name] = g
+}
+
+// addedKeyGenerators returns a copy of the generators added with
+// AddKeyGenerator.
+func addedKeyGenerators() map[string]KeyGenerator {
+	keyGeneratorsMu.Lock()
+	defer keyGeneratorsMu.Unlock()
+	gens := make(map[string]KeyGenerator, len(keyGenerators))
+	for name, g := range keyGenerators {
+		gens[name] = g
+	}
+	return gens
+}
+
+// maxRandomKeySize bounds the size of generated random keys.
+const maxRandomKeySize = 4096
+
+// generateRandom returns spec bytes from crypto/rand.
+func generateRandom(spec string, key *knox.Key) ([]byte, error) {
+	n, err := strconv.Atoi(spec)
+	if err != nil || n <= 0 || n > maxRandomKeySize {
+		return nil, fmt.Errorf("random generator needs a size between 1 and %d bytes", maxRandomKeySize)
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// generateVersionData runs the generator named in the key's metadata, looking
+// it up in opts before the built-in generators.
+func generateVersionData(opts KeyManagerOptions, key *knox.Key) ([]byte, *HTTPError) {
+	gen, ok := key.Metadata[knox.MetadataGenerator]
+	if !ok {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Key %s has no %s metadata", key.ID, knox.MetadataGenerator))
+	}
+	name, spec, _ := strings.Cut(gen, ":")
+	g, ok := opts.KeyGenerators[name]
+	if !ok {
+		g, ok = builtinKeyGenerators[name]
+	}
+	if !ok {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Unknown key generator %s", name))
+	}
+	data, err := g.Generate(spec, key)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	return data, nil
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// KeyHooks are extension points around KeyManager operations, so validation,
+// notifications or metadata can be layered on without changing the handlers.
+// Before hooks get the key as it is before the operation and can reject the
+// operation by returning an error, which is returned to the client as a
+// rejection. After hooks are called once the operation succeeded. Nil hooks
+// are skipped.
+//
+// A rotation is an UpdateVersion to knox.Primary; RotationPlugin remains the
+// way to prepare external systems before a Scheduled version activates.
+type KeyHooks struct {
+	BeforeCreate func(k *knox.Key) error
+	AfterCreate  func(k *knox.Key)
+
+	// acl is the ACL the key will have after the update.
+	BeforeUpdateAccess func(k *knox.Key, acl knox.ACL) error
+	AfterUpdateAccess  func(k *knox.Key, acl knox.ACL)
+
+	BeforeAddVersion func(k *knox.Key, v *knox.KeyVersion) error
+	AfterAddVersion  func(k *knox.Key, v *knox.KeyVersion)
+
+	BeforeUpdateVersion func(k *knox.Key, versionID uint64, s knox.VersionStatus) error
+	AfterUpdateVersion  func(k *knox.Key, versionID uint64, s knox.VersionStatus)
+
+	BeforeUpdateMetadata func(k *knox.Key, md knox.KeyMetadata) error
+	AfterUpdateMetadata  func(k *knox.Key, md knox.KeyMetadata)
+
+	BeforeDelete func(k *knox.Key) error
+	AfterDelete  func(k *knox.Key)
+}
+
+// HookRejection is the error returned by a KeyManager when a before hook
+// rejects an operation.
+type HookRejection struct {
+	Err error
+}
+
+func (r *HookRejection) Error() string {
+	return r.Err.Error()
+}
+
+func (r *HookRejection) Unwrap() error {
+	return r.Err
+}
+
+// WithHooks returns a KeyManager that runs hooks, in order, around the
+// operations of m.
+func WithHooks(m KeyManager, hooks ...KeyHooks) KeyManager {
+	if len(hooks) == 0 {
+		return m
+	}
+	return &hookedKeyManager{KeyManager: m, hooks: hooks}
+}
+
+type hookedKeyManager struct {
+	KeyManager
+	hooks []KeyHooks
+}
+
+// Options returns the options of the wrapped key manager.
+func (m *hookedKeyManager) Options() KeyManagerOptions {
+	return optionsOf(m.KeyManager)
+}
+
+// before runs the before hooks selected by f and wraps the first error.
+func (m *hookedKeyManager) before(f func(h KeyHooks) error) error {
+	for _, h := range m.hooks {
+		if err := f(h); err != nil {
+			return &HookRejection{Err: err}
+		}
+	}
+	return nil
+}
+
+func (m *hookedKeyManager) after(f func(h KeyHooks)) {
+	for _, h := range m.hooks {
+		f(h)
+	}
+}
+
+func (m *hookedKeyManager) IfVersionHash(versionHash string) KeyManager {
+	return &hookedKeyManager{KeyManager: m.KeyManager.IfVersionHash(versionHash), hooks: m.hooks}
+}
+
+func (m *hookedKeyManager) AddNewKey(k *knox.Key) error {
+	err := m.before(func(h KeyHooks) error {
+		if h.BeforeCreate == nil {
+			return nil
+		}
+		return h.BeforeCreate(k)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.KeyManager.AddNewKey(k); err != nil {
+		return err
+	}
+	m.after(func(h KeyHooks) {
+		if h.AfterCreate != nil {
+			h.AfterCreate(k)
+		}
+	})
+	return nil
+}
+
+func (m *hookedKeyManager) UpdateAccess(id string, acl ...knox.Access) error {
+	k, err := m.KeyManager.GetKey(id, knox.Inactive)
+	if err != nil {
+		return err
+	}
+	updated := append(knox.ACL{}, k.ACL...)
+	for _, a := range acl {
+		updated = updated.Add(a)
+	}
+	err = m.before(func(h KeyHooks) error {
+		if h.BeforeUpdateAccess == nil {
+			return nil
+		}
+		return h.BeforeUpdateAccess(k, updated)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.KeyManager.UpdateAccess(id, acl...); err != nil {
+		return err
+	}
+	m.after(func(h KeyHooks) {
+		if h.AfterUpdateAccess != nil {
+			h.AfterUpdateAccess(k, updated)
+		}
+	})
+	return nil
+}
+
+func (m *hookedKeyManager) AddVersion(id string, v *knox.KeyVersion) error {
+	k, err := m.KeyManager.GetKey(id, knox.Inactive)
+	if err != nil {
+		return err
+	}
+	err = m.before(func(h KeyHooks) error {
+		if h.BeforeAddVersion == nil {
+			return nil
+		}
+		return h.BeforeAddVersion(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.KeyManager.AddVersion(id, v); err != nil {
+		return err
+	}
+	m.after(func(h KeyHooks) {
+		if h.AfterAddVersion != nil {
+			h.AfterAddVersion(k, v)
+		}
+	})
+	return nil
+}
+
+func (m *hookedKeyManager) UpdateVersion(id string, versionID uint64, s knox.VersionStatus) error {
+	k, err := m.KeyManager.GetKey(id, knox.Inactive)
+	if err != nil {
+		return err
+	}
+	err = m.before(func(h KeyHooks) error {
+		if h.BeforeUpdateVersion == nil {
+			return nil
+		}
+		return h.BeforeUpdateVersion(k, versionID, s)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.KeyManager.UpdateVersion(id, versionID, s); err != nil {
+		return err
+	}
+	m.after(func(h KeyHooks) {
+		if h.AfterUpdateVersion != nil {
+			h.AfterUpdateVersion(k, versionID, s)
+		}
+	})
+	return nil
+}
+
+func (m *hookedKeyManager) UpdateMetadata(id string, md knox.KeyMetadata) error {
+	k, err := m.KeyManager.GetKey(id, knox.Inactive)
+	if err != nil {
+		return err
+	}
+	err = m.before(func(h KeyHooks) error {
+		if h.BeforeUpdateMetadata == nil {
+			return nil
+		}
+		return h.BeforeUpdateMetadata(k, md)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.KeyManager.UpdateMetadata(id, md); err != nil {
+		return err
+	}
+	m.after(func(h KeyHooks) {
+		if h.AfterUpdateMetadata != nil {
+			h.AfterUpdateMetadata(k, md)
+		}
+	})
+	return nil
+}
+
+func (m *hookedKeyManager) DeleteKey(id string) error {
+	k, err := m.KeyManager.GetKey(id, knox.Inactive)
+	if err != nil {
+		return err
+	}
+	err = m.before(func(h KeyHooks) error {
+		if h.BeforeDelete == nil {
+			return nil
+		}
+		return h.BeforeDelete(k)
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.KeyManager.DeleteKey(id); err != nil {
+		return err
+	}
+	m.after(func(h KeyHooks) {
+		if h.AfterDelete != nil {
+			h.AfterDelete(k)
+		}
+	})
+	return nil
+}
+
+// keyManagerErr is the response for an error from a KeyManager operation
+// that the handler has no specific response for. Rejections by hooks are
+// reported as bad requests, conflicting changes as version hash mismatches
+// and anything else as an internal error.
+func keyManagerErr(err error) *HTTPError {
+	var r *HookRejection
+	if errors.As(err, &r) {
+		return errF(knox.BadRequestDataCode, err.Error())
+	}
+	var c *keydb.ConflictError
+	if errors.As(err, &c) {
+		return errF(knox.KeyVersionHashMismatchCode, err.Error())
+	}
+	return errF(knox.InternalServerErrorCode, err.Error())
+}
+
+// RequireHumanAdmins returns hooks that keep at least n human admins, users or
+// user groups with Admin access, in the ACL of every key, so a key can't be
+// left to a single person or only to machines.
+func RequireHumanAdmins(n int) KeyHooks {
+	check := func(acl knox.ACL) error {
+		admins := 0
+		for _, a := range acl {
+			if a.AccessType == knox.Admin && (a.Type == knox.User || a.Type == knox.UserGroup) {
+				admins++
+			}
+		}
+		if admins < n {
+			return fmt.Errorf("Keys need at least %d human admins (users or user groups with Admin access), this ACL has %d", n, admins)
+		}
+		return nil
+	}
+	return KeyHooks{
+		BeforeCreate: func(k *knox.Key) error {
+			return check(k.ACL)
+		},
+		BeforeUpdateAccess: func(k *knox.Key, acl knox.ACL) error {
+			return check(acl)
+		},
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func hookedDB(hooks ...KeyHooks) KeyManager {
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	return NewKeyManagerWithOptions(cryptor, keydb.NewTempDB(), KeyManagerOptions{Hooks: hooks, DisableStrengthAnalysis: true})
+}
+
+func TestKeyHooks(t *testing.T) {
+	var calls []string
+	record := KeyHooks{
+		AfterCreate: func(k *knox.Key) { calls = append(calls, "create "+k.ID) },
+		BeforeUpdateVersion: func(k *knox.Key, versionID uint64, s knox.VersionStatus) error {
+			if s == knox.Primary && k.Metadata["frozen"] == "true" {
+				return fmt.Errorf("Key %s is frozen", k.ID)
+			}
+			return nil
+		},
+		AfterUpdateVersion: func(k *knox.Key, versionID uint64, s knox.VersionStatus) {
+			calls = append(calls, fmt.Sprintf("promote %s %d", k.ID, versionID))
+		},
+		AfterDelete: func(k *knox.Key) { calls = append(calls, "delete "+k.ID) },
+	}
+	m := hookedDB(record)
+	u := auth.NewUser("testuser", []string{})
+
+	for _, id := range []string{"a1", "a2"} {
+		_, err := postKeysHandler(m, u, map[string]string{"id": id, "data": "MQ=="})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+	promote := func(id string) (uint64, *HTTPError) {
+		i, err := postVersionHandler(m, u, map[string]string{"keyID": id, "data": "Mg=="})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		v := i.(uint64)
+		_, err = putVersionsHandler(m, u, map[string]string{"keyID": id, "versionID": fmt.Sprint(v), "status": `"Primary"`})
+		return v, err
+	}
+	i, err := promote("a1")
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a2", "metadata": `{"frozen":"true"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = promote("a2")
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected rejected rotation, got %+v", err)
+	}
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a2"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	expected := []string{"create a1", "create a2", fmt.Sprintf("promote a1 %d", i), "delete a2"}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Fatalf("Expected hook calls %v, got %v", expected, calls)
+	}
+}
+
+func TestRequireHumanAdmins(t *testing.T) {
+	m := hookedDB(RequireHumanAdmins(2))
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected too few admins, got %+v", err)
+	}
+	machineAdmin := `[{"type":"Machine","id":"host1","access":"Admin"}]`
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": machineAdmin})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected too few admins, got %+v", err)
+	}
+	groupAdmin := `[{"type":"UserGroup","id":"team","access":"Admin"}]`
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": groupAdmin})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "access": `{"type":"UserGroup","id":"team","access":"Read"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected too few admins, got %+v", err)
+	}
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "access": `{"type":"User","id":"other","access":"Admin"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "access": `{"type":"UserGroup","id":"team","access":"Read"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
@@ -484,3 +484,129 @@ func TestKeyAccessUpdatesWithPrincipalValidation(t *testing.T) {
 	access = knox.Access{ID: "https://ahoy", Type: knox.Service, AccessType: knox.Read}
 	putAccessExpectedFailure(t, keyID, &access, "Service prefix is invalid URL, must conform to 'spiffe://<domain>/<path>/' format.")
 }
+
+func TestMsgpackNegotiation(t *testing.T) {
+	keyID := "testmsgpacknegotiation"
+	data := []byte{0, 1, 2, 3, 255}
+	addKey(t, keyID, data)
+
+	r, err := http.NewRequest("GET", "/v0/keys/"+keyID+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "0u"+"testuser")
+	r.Header.Set("Accept", knox.MsgpackContentType+", "+knox.JSONContentType+";q=0.9")
+	w := httptest.NewRecorder()
+	getRouter().ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != knox.MsgpackContentType {
+		t.Fatalf("Expected msgpack content type, got %q", ct)
+	}
+	key := knox.Key{}
+	resp := &knox.Response{Data: &key}
+	err = knox.MsgpackCodec.Decode(w.Body, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "ok" || key.ID != keyID {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	if !bytes.Equal(key.VersionList.GetPrimary().Data, data) {
+		t.Fatalf("Expected %v, got %v", data, key.VersionList.GetPrimary().Data)
+	}
+}
+
+func getV1Data(method string, path string, body interface{}, data interface{}) (*knox.Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	r, reqErr := http.NewRequest(method, path, &buf)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	r.Header.Set("Authorization", "0u"+"testuser")
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	getRouter().ServeHTTP(w, r)
+	resp := &knox.Response{}
+	resp.Data = data
+	err := json.NewDecoder(w.Body).Decode(resp)
+	return resp, err
+}
+
+func TestV1API(t *testing.T) {
+	setup()
+	for _, id := range []string{"v1c", "v1a", "v1b"} {
+		var versionID uint64
+		resp, err := getV1Data("POST", "/v1/keys/", map[string]interface{}{
+			"id":       id,
+			"data":     base64.StdEncoding.EncodeToString([]byte("secret " + id)),
+			"acl":      knox.ACL{{Type: knox.Machine, ID: "MrRoboto", AccessType: knox.Read}},
+			"metadata": knox.KeyMetadata{"team": "security"},
+		}, &versionID)
+		if err != nil || resp.Status != "ok" || versionID == 0 {
+			t.Fatalf("Failed to create %s: %+v %v", id, resp, err)
+		}
+	}
+
+	var key knox.Key
+	resp, err := getV1Data("GET", "/v1/keys/v1a/", nil, &key)
+	if err != nil || resp.Status != "ok" {
+		t.Fatalf("Failed to get key: %+v %v", resp, err)
+	}
+	if key.Metadata["team"] != "security" {
+		t.Fatalf("Unexpected key %+v", key)
+	}
+	var acl knox.ACL
+	resp, err = getV1Data("GET", "/v1/keys/v1a/access/", nil, &acl)
+	if err != nil || resp.Status != "ok" || len(acl) < 2 {
+		t.Fatalf("Unexpected access %+v %+v %v", acl, resp, err)
+	}
+
+	var page knox.KeyPage
+	resp, err = getV1Data("GET", "/v1/keys/?limit=2", nil, &page)
+	if err != nil || resp.Status != "ok" {
+		t.Fatalf("Failed to list keys: %+v %v", resp, err)
+	}
+	if len(page.Keys) != 2 || page.Keys[0] != "v1a" || page.Next != "v1b" {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	cursor := page.Next
+	page = knox.KeyPage{}
+	resp, err = getV1Data("GET", "/v1/keys/?limit=2&cursor="+cursor, nil, &page)
+	if err != nil || resp.Status != "ok" {
+		t.Fatalf("Failed to list keys: %+v %v", resp, err)
+	}
+	if len(page.Keys) != 1 || page.Keys[0] != "v1c" || page.Next != "" {
+		t.Fatalf("Unexpected last page %+v", page)
+	}
+
+	updated := []string{}
+	resp, err = getV1Data("POST", "/v1/keys/updated/", map[string]interface{}{
+		"versions": map[string]string{"v1a": key.VersionHash, "v1b": "stale"},
+	}, &updated)
+	if err != nil || resp.Status != "ok" {
+		t.Fatalf("Failed to get updated keys: %+v %v", resp, err)
+	}
+	if len(updated) != 1 || updated[0] != "v1b" {
+		t.Fatalf("Expected only v1b to be updated, got %v", updated)
+	}
+
+	resp, err = getV1Data("PUT", "/v1/keys/v1a/versions/"+strconv.FormatUint(key.VersionList[0].ID, 10)+"/", map[string]interface{}{
+		"status": "Nope",
+	}, nil)
+	if err != nil || resp.Status == "ok" || resp.Code != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v %v", resp, err)
+	}
+
+	r, _ := http.NewRequest("POST", "/v1/keys/", strings.NewReader("{not json"))
+	r.Header.Set("Authorization", "0u"+"testuser")
+	w := httptest.NewRecorder()
+	getRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for malformed body, got %d", w.Code)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// Clients send an idempotency key either in the Idempotency-Key header or in
+// the idempotency_key parameter.
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyParam  = "idempotency_key"
+)
+
+// DefaultIdempotencyWindow is how long responses are kept for replay by
+// default.
+const DefaultIdempotencyWindow = 10 * time.Minute
+
+var idempotencyCache *IdempotencyCache
+
+// SetIdempotencyCache sets where responses to requests with an idempotency
+// key are kept by KeyManagers made with NewKeyManager or GetRouter. nil, the
+// default, turns idempotency keys off.
+//
+// Deprecated: Set KeyManagerOptions.Idempotency and use
+// NewKeyManagerWithOptions.
+func SetIdempotencyCache(c *IdempotencyCache) {
+	idempotencyCache = c
+}
+
+// IdempotencyCache keeps the successful responses of requests that carried an
+// idempotency key, so a client retrying a request whose response it never got
+// receives the original response instead of creating a second key or version.
+// Keys are scoped to the principal and route. Failed requests are not kept
+// and can be retried with the same key. The cache is kept in the memory of
+// one process, so a retry that reaches another server replica is not
+// de-duplicated.
+type IdempotencyCache struct {
+	window time.Duration
+	size   int
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	order   []string
+	now     func() time.Time
+}
+
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	data        interface{}
+	err         *HTTPError
+	expires     time.Time
+}
+
+// NewIdempotencyCache creates a cache that replays responses for window and
+// keeps at most size of them.
+func NewIdempotencyCache(window time.Duration, size int) *IdempotencyCache {
+	return &IdempotencyCache{
+		window:  window,
+		size:    size,
+		entries: map[string]*idempotentResponse{},
+		now:     time.Now,
+	}
+}
+
+// do runs handler once per key while its response is kept. Concurrent calls
+// with the same key wait for the first one. A key reused for a request with
+// different parameters is rejected.
+func (c *IdempotencyCache) do(key string, fingerprint [sha256.Size]byte, handler func() (interface{}, *HTTPError)) (interface{}, *HTTPError) {
+	c.mu.Lock()
+	now := c.now()
+	c.expire(now)
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		if e.fingerprint != fingerprint {
+			return nil, errF(knox.BadRequestDataCode, "Idempotency key was used for a different request")
+		}
+		<-e.done
+		if e.err == nil {
+			return e.data, nil
+		}
+		// The first request failed, run this one instead.
+		return c.do(key, fingerprint, handler)
+	}
+	e := &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.data, e.err = handler()
+
+	c.mu.Lock()
+	if e.err != nil {
+		delete(c.entries, key)
+	} else {
+		e.expires = c.now().Add(c.window)
+		c.order = append(c.order, key)
+		for len(c.order) > c.size {
+			c.evict()
+		}
+	}
+	c.mu.Unlock()
+	close(e.done)
+	return e.data, e.err
+}
+
+// expire removes responses older than the window. They are kept in order of
+// completion, so only the front needs to be checked.
+func (c *IdempotencyCache) expire(now time.Time) {
+	for len(c.order) > 0 {
+		e, ok := c.entries[c.order[0]]
+		if ok && now.Before(e.expires) {
+			return
+		}
+		c.evict()
+	}
+}
+
+func (c *IdempotencyCache) evict() {
+	delete(c.entries, c.order[0])
+	c.order = c.order[1:]
+}
+
+// idempotent makes a handler replay its response to retries that carry the
+// same idempotency key.
+func idempotent(routeID string, handler func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError)) func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	return func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+		token := parameters[idempotencyHeader]
+		if token == "" {
+			token = parameters[idempotencyParam]
+		}
+		c := optionsOf(m).Idempotency
+		if token == "" || c == nil {
+			return handler(m, principal, parameters)
+		}
+		key := fmt.Sprintf("%s\x00%s\x00%s", routeID, principal.GetID(), token)
+		return c.do(key, fingerprintParams(parameters), func() (interface{}, *HTTPError) {
+			return handler(m, principal, parameters)
+		})
+	}
+}
+
+// fingerprintParams hashes the parameters of a request other than the
+// idempotency key.
+func fingerprintParams(parameters map[string]string) [sha256.Size]byte {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		if name != idempotencyHeader && name != idempotencyParam {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(name), name, len(parameters[name]), parameters[name])
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
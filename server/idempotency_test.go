@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestIdempotentCreate(t *testing.T) {
+	u := auth.NewUser("testuser", []string{})
+	c := NewIdempotencyCache(time.Minute, 10)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	m := makeDBWithOptions(KeyManagerOptions{Idempotency: c, DisableStrengthAnalysis: true})
+
+	postKeys := idempotent("postkeys", postKeysHandler)
+	params := map[string]string{"id": "a1", "data": "MQ==", "Idempotency-Key": "k1"}
+	first, err := postKeys(m, u, params)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	second, err := postKeys(m, u, params)
+	if err != nil {
+		t.Fatalf("Expected the original response, got %+v", err)
+	}
+	if first != second {
+		t.Fatalf("Expected %v, got %v", first, second)
+	}
+
+	// The key is scoped to the principal and must match the request.
+	_, err = postKeys(m, auth.NewUser("other", []string{}), params)
+	if err == nil || err.Subcode != knox.KeyIdentifierExistsCode {
+		t.Fatalf("Expected key exists, got %+v", err)
+	}
+	_, err = postKeys(m, u, map[string]string{"id": "a2", "data": "MQ==", "Idempotency-Key": "k1"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected a reused key to be rejected, got %+v", err)
+	}
+
+	// Failures are not kept.
+	bad := map[string]string{"id": "a1", "data": "MQ==", "idempotency_key": "k2"}
+	for i := 0; i < 2; i++ {
+		_, err = postKeys(m, u, bad)
+		if err == nil || err.Subcode != knox.KeyIdentifierExistsCode {
+			t.Fatalf("Expected key exists, got %+v", err)
+		}
+	}
+
+	postVersion := idempotent("postversion", postVersionHandler)
+	vparams := map[string]string{"keyID": "a1", "data": "Mg==", "idempotency_key": "k3"}
+	v1, err := postVersion(m, u, vparams)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	v2, err := postVersion(m, u, vparams)
+	if err != nil || v1 != v2 {
+		t.Fatalf("Expected version %v to be replayed, got %v, %+v", v1, v2, err)
+	}
+	now = now.Add(2 * time.Minute)
+	v3, err := postVersion(m, u, vparams)
+	if err != nil || v3 == v1 {
+		t.Fatalf("Expected a new version after the window, got %v, %+v", v3, err)
+	}
+	k, _ := m.GetKey("a1", knox.Active)
+	if len(k.VersionList) != 3 {
+		t.Fatalf("Expected 3 versions, got %d", len(k.VersionList))
+	}
+}
+
+func TestIdempotencyDisabled(t *testing.T) {
+	m := makeDBWithOptions(KeyManagerOptions{})
+	u := auth.NewUser("testuser", []string{})
+	postKeys := idempotent("postkeys", postKeysHandler)
+	params := map[string]string{"id": "a1", "data": "MQ==", "Idempotency-Key": "k1"}
+	if _, err := postKeys(m, u, params); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := postKeys(m, u, params); err == nil || err.Subcode != knox.KeyIdentifierExistsCode {
+		t.Fatalf("Expected the retry to run without a cache, got %+v", err)
+	}
+}
+
+func TestIdempotencyCacheSize(t *testing.T) {
+	c := NewIdempotencyCache(time.Minute, 2)
+	calls := 0
+	handler := func() (interface{}, *HTTPError) {
+		calls++
+		return calls, nil
+	}
+	for _, key := range []string{"a", "b", "c", "a"} {
+		c.do(key, [32]byte{}, handler)
+	}
+	if calls != 4 {
+		t.Fatalf("Expected the oldest response to be evicted, got %d calls", calls)
+	}
+	if d, _ := c.do("c", [32]byte{}, handler); d != 3 {
+		t.Fatalf("Expected response 3 to be replayed, got %v", d)
+	}
+}
+
+func TestHeaderParameter(t *testing.T) {
+	r, _ := http.NewRequest("POST", "http://localhost/", nil)
+	r.Header.Set("idempotency-key", "k1")
+	if v, ok := HeaderParameter("Idempotency-Key").Get(r); !ok || v != "k1" {
+		t.Fatalf("Expected k1, got %q", v)
+	}
+	if _, ok := HeaderParameter("X-Missing").Get(r); ok {
+		t.Fatal("Expected missing header")
+	}
+}
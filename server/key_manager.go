@@ -1,9 +1,14 @@
 package server
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/internal/singleflight"
+	"github.com/pinterest/knox/log"
 	"github.com/pinterest/knox/server/keydb"
 )
 
@@ -14,23 +19,229 @@ type KeyManager interface {
 	GetKey(id string, status knox.VersionStatus) (*knox.Key, error)
 	AddNewKey(*knox.Key) error
 	DeleteKey(id string) error
+	GetDeletedKeys() ([]knox.DeletedKey, error)
+	RestoreKey(id string) error
 	UpdateAccess(string, ...knox.Access) error
 	AddVersion(string, *knox.KeyVersion) error
 	UpdateVersion(keyID string, versionID uint64, s knox.VersionStatus) error
+	RemoveVersions(keyID string, versionIDs ...uint64) error
+	UpdateMetadata(keyID string, md knox.KeyMetadata) error
+	SearchKeyIDs(q KeySearch) ([]string, error)
+	FindKeysWithData(data []byte) ([]*knox.Key, error)
+	ReencryptKeys() (*knox.ReencryptResult, error)
+	ConsumeRead(id string) (remaining int, err error)
+	CheckConsistency(repair bool, keyIDs ...string) (*knox.ConsistencyReport, error)
+	Snapshot() (*keydb.Snapshot, error)
+	RestoreSnapshot(s *keydb.Snapshot) (*knox.RestoreResult, error)
+	// IfVersionHash returns a KeyManager whose UpdateAccess, AddVersion,
+	// UpdateVersion and UpdateMetadata fail with a *keydb.ConflictError
+	// unless the key has the version hash and isn't changed concurrently.
+	// An empty version hash leaves them unconditional.
+	IfVersionHash(versionHash string) KeyManager
 }
 
-// NewKeyManager builds a struct for interfacing with the keydb.
+// KeySearch describes a search over key metadata. Empty fields match all keys.
+type KeySearch struct {
+	// Owner matches keys where the principal has Admin access.
+	Owner string
+	// Tags matches keys whose metadata contains every entry. An empty value
+	// only requires the metadata key to be present.
+	Tags knox.KeyMetadata
+	// CreatedAfter and CreatedBefore bound the key creation time, which is the
+	// creation time of its oldest version, in Unix nanoseconds.
+	CreatedAfter  int64
+	CreatedBefore int64
+}
+
+// Matches reports whether the key satisfies the search.
+func (q KeySearch) Matches(k *keydb.DBKey) bool {
+	if q.Owner != "" {
+		owned := false
+		for _, a := range k.ACL {
+			if a.ID == q.Owner && a.AccessType == knox.Admin {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			return false
+		}
+	}
+	for tk, tv := range q.Tags {
+		v, ok := k.Metadata[tk]
+		if !ok || (tv != "" && v != tv) {
+			return false
+		}
+	}
+	if q.CreatedAfter != 0 || q.CreatedBefore != 0 {
+		created := creationTime(k)
+		if q.CreatedAfter != 0 && created <= q.CreatedAfter {
+			return false
+		}
+		if q.CreatedBefore != 0 && created >= q.CreatedBefore {
+			return false
+		}
+	}
+	return true
+}
+
+func creationTime(k *keydb.DBKey) int64 {
+	var created int64
+	for i, v := range k.VersionList {
+		if i == 0 || v.CreationTime < created {
+			created = v.CreationTime
+		}
+	}
+	return created
+}
+
+// KeyManagerOptions configures the API behavior of a KeyManager, so servers
+// with different settings can run in one process.
+type KeyManagerOptions struct {
+	// DefaultAccess is added to the ACL of every key created through the API,
+	// besides the creator.
+	DefaultAccess []knox.Access
+	// PrincipalValidators apply additional, custom validation to principals
+	// added to ACLs, e.g. to restrict which machine or service prefixes are
+	// acceptable.
+	PrincipalValidators []knox.PrincipalValidator
+	// DuplicateDataWarnings turns on warnings when new key data matches a
+	// version of another key the principal can read. Checking decrypts every
+	// key, so it is best suited to small deployments.
+	DuplicateDataWarnings bool
+	// StrengthPolicy analyzes new key data and records the results in the
+	// knox.strength and knox.entropy_bits metadata of the key. If nil,
+	// DefaultStrengthPolicy is used.
+	StrengthPolicy *StrengthPolicy
+	// DisableStrengthAnalysis turns the analysis of new key data off.
+	DisableStrengthAnalysis bool
+	// KeyGenerators are the generators, by name, that keys can select with
+	// "<name>:<spec>" in their knox.generator metadata for server side
+	// rotation. They take precedence over the built-in "random" generator.
+	KeyGenerators map[string]KeyGenerator
+	// RotationPlugins run, in order, before a version becomes the Primary
+	// of a key.
+	RotationPlugins []RotationPlugin
+	// Notifier receives alerts such as reads of honeytoken keys. If nil, no
+	// notifications are sent.
+	Notifier Notifier
+	// ExpiryWarning is how long before a key's knox.expires_at time reads of
+	// the key return a warning. Zero means 7 days, a negative duration
+	// disables the warnings.
+	ExpiryWarning time.Duration
+	// Hooks run around the operations of the key manager, see WithHooks.
+	Hooks []KeyHooks
+	// AdminACL is the principals allowed to use the admin routes. They need
+	// Admin access in it.
+	AdminACL knox.ACL
+	// AuditLog makes recent requests available through the admin API and
+	// records consistency repairs. It must also be installed with
+	// AccessAnalysis to record requests.
+	AuditLog *AuditLog
+	// Unsealer, if set, accepts master key shares through the admin API.
+	Unsealer *Unsealer
+	// Timeouts configures handler deadlines and slow request logging.
+	Timeouts TimeoutConfig
+	// ServerVersion is reported in the server_version field of every
+	// response.
+	ServerVersion string
+	// RecommendedClientVersion makes successful responses to clients older
+	// than it carry a warning asking to upgrade. Clients identify their
+	// version in the User-Agent header, and clients with a version that isn't
+	// a dotted list of numbers, such as development builds, are not warned.
+	RecommendedClientVersion string
+	// MinimumClientVersion makes requests from older clients fail with a
+	// ClientVersionTooOldCode error, so clients with known bugs can be
+	// retired. Clients are identified like for RecommendedClientVersion and
+	// other clients are not affected.
+	MinimumClientVersion string
+	// EnforceClientVersionAfter is when MinimumClientVersion starts being
+	// enforced. Until then older clients are only warned in successful
+	// responses that they will be rejected, which gives their owners a grace
+	// period to upgrade. If zero, they are rejected right away.
+	EnforceClientVersionAfter time.Time
+	// SnapshotKey enables the admin routes that take and restore snapshots of
+	// the key database, encrypted with it. It must be keydb.SnapshotKeySize
+	// bytes, and should be kept apart from the master key, so a leaked
+	// snapshot doesn't reveal the ACLs and metadata of keys.
+	SnapshotKey []byte
+	// Idempotency, if set, keeps the responses to requests with an
+	// idempotency key for replay. nil turns idempotency keys off.
+	Idempotency *IdempotencyCache
+}
+
+// NewKeyManager builds a struct for interfacing with the keydb. It uses the
+// package level settings, e.g. those made with AddDefaultAccess and
+// SetAdminACL.
 func NewKeyManager(c keydb.Cryptor, db keydb.DB) KeyManager {
-	return &keyManager{c, db}
+	return &keyManager{cryptor: c, db: db}
+}
+
+// NewKeyManagerWithOptions builds a KeyManager configured by opts instead of
+// the package level settings.
+func NewKeyManagerWithOptions(c keydb.Cryptor, db keydb.DB, opts KeyManagerOptions) KeyManager {
+	if opts.Timeouts.abandoned == nil {
+		opts.Timeouts.abandoned = new(int64)
+	}
+	return WithHooks(&keyManager{cryptor: c, db: db, opts: &opts}, opts.Hooks...)
 }
 
 type keyManager struct {
 	cryptor keydb.Cryptor
 	db      keydb.DB
+	opts    *KeyManagerOptions
+	// reads collapses concurrent reads of a key, so a popular key is read
+	// and decrypted once when many clients ask for it at the same time.
+	// Writes forget the read in flight so later reads see them.
+	reads singleflight.Group[*knox.Key]
+}
+
+// Options returns the options of the key manager.
+func (m *keyManager) Options() KeyManagerOptions {
+	if m.opts == nil {
+		return globalOptions()
+	}
+	return *m.opts
+}
+
+// optionsOf returns the options of m, or the package level settings if m
+// doesn't have any.
+func optionsOf(m KeyManager) KeyManagerOptions {
+	if o, ok := m.(interface{ Options() KeyManagerOptions }); ok {
+		return o.Options()
+	}
+	return globalOptions()
+}
+
+func globalOptions() KeyManagerOptions {
+	return KeyManagerOptions{
+		DefaultAccess:         defaultAccess,
+		PrincipalValidators:   extraPrincipalValidators,
+		DuplicateDataWarnings: duplicateDataWarnings,
+		AdminACL:              adminACL,
+		AuditLog:              auditLog,
+		Unsealer:              unsealer,
+		Timeouts:              timeoutConfig,
+
+		// Analysis is off unless SetStrengthPolicy turned it on.
+		StrengthPolicy:          strengthPolicy,
+		DisableStrengthAnalysis: strengthPolicy == nil,
+		KeyGenerators:           addedKeyGenerators(),
+		RotationPlugins:         addedRotationPlugins(),
+		Notifier:                notifier,
+		ExpiryWarning:           globalExpiryWarning(),
+
+		ServerVersion:            serverVersion,
+		RecommendedClientVersion: recommendedClientVersion,
+
+		MinimumClientVersion:      minimumClientVersion,
+		EnforceClientVersionAfter: enforceClientVersionAfter,
+		Idempotency:               idempotencyCache,
+	}
 }
 
 func (m *keyManager) GetAllKeyIDs() ([]string, error) {
-	keys, err := m.db.GetAll()
+	keys, err := keydb.GetAllMetadata(m.db)
 	if err != nil {
 		return nil, err
 	}
@@ -41,14 +252,17 @@ func (m *keyManager) GetAllKeyIDs() ([]string, error) {
 	return output, nil
 }
 
+// GetUpdatedKeyIDs only compares version hashes, so it reads key metadata
+// and never touches encrypted key data.
 func (m *keyManager) GetUpdatedKeyIDs(versions map[string]string) ([]string, error) {
-	keys, err := m.db.GetAll()
+	keys, err := keydb.GetAllMetadata(m.db)
 	if err != nil {
 		return nil, err
 	}
+	now := time.Now().UnixNano()
 	output := []string{}
 	for _, k := range keys {
-		if v, ok := versions[k.ID]; ok && k.VersionHash != v {
+		if v, ok := versions[k.ID]; ok && (k.VersionHash != v || activationDue(k.Metadata, now)) {
 			output = append(output, k.ID)
 		}
 	}
@@ -56,14 +270,16 @@ func (m *keyManager) GetUpdatedKeyIDs(versions map[string]string) ([]string, err
 }
 
 func (m *keyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
-	encK, err := m.db.Get(id)
+	k, err, _ := m.reads.Do(id, func() (*knox.Key, error) { return m.readKey(id) })
 	if err != nil {
 		return nil, err
 	}
-	k, err := m.cryptor.Decrypt(encK)
-	if err != nil {
-		return nil, fmt.Errorf("Error decrypting key: %s", err.Error())
-	}
+	// Callers modify the key, so each gets its own copy.
+	return withStatus(k.Copy(), status)
+}
+
+// withStatus returns k with the versions GetKey returns for status.
+func withStatus(k *knox.Key, status knox.VersionStatus) (*knox.Key, error) {
 	switch status {
 	case knox.Inactive:
 		return k, nil
@@ -78,7 +294,38 @@ func (m *keyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, er
 	}
 }
 
+// readKey reads and decrypts a key with all of its versions, activating
+// versions that are due.
+func (m *keyManager) readKey(id string) (*knox.Key, error) {
+	encK, err := m.db.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	k, err := m.cryptor.Decrypt(encK)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting key: %s", err.Error())
+	}
+	now := time.Now().UnixNano()
+	if kvl, changed := k.VersionList.ActivateScheduled(now); changed {
+		if err := beforePromote(m.Options().RotationPlugins, k, kvl.GetPrimary()); err != nil {
+			// Keep serving the current versions, the activation is retried
+			// on the next read.
+			log.Printf("Failed to activate scheduled version of %s: %s", id, err.Error())
+		} else {
+			k.Metadata = withRotation(k.Metadata, k.VersionList.GetPrimary(), kvl.GetPrimary(), now)
+			k.VersionList = kvl
+			k.VersionHash = kvl.Hash()
+			k.Metadata = withNextActivation(k.Metadata, kvl)
+			// Persist the activation so the version hash seen by clients changes.
+			// If this fails, e.g. due to a concurrent update, the next read retries.
+			m.db.Update(withStatuses(encK, kvl, k.VersionHash, k.Metadata))
+		}
+	}
+	return k, nil
+}
+
 func (m *keyManager) AddNewKey(k *knox.Key) error {
+	defer m.reads.Forget(k.ID)
 	if err := k.Validate(); err != nil {
 		return err
 	}
@@ -90,11 +337,29 @@ func (m *keyManager) AddNewKey(k *knox.Key) error {
 }
 
 func (m *keyManager) DeleteKey(id string) error {
+	defer m.reads.Forget(id)
 	return m.db.Remove(id)
 }
 
+// GetDeletedKeys returns the deleted keys that can be restored, if the DB
+// keeps deleted keys, see keydb.TombstoneDB.
+func (m *keyManager) GetDeletedKeys() ([]knox.DeletedKey, error) {
+	return keydb.GetDeleted(m.db)
+}
+
+// RestoreKey restores a deleted key, if the DB keeps deleted keys.
+func (m *keyManager) RestoreKey(id string) error {
+	defer m.reads.Forget(id)
+	return keydb.Restore(m.db, id)
+}
+
 func (m *keyManager) UpdateAccess(id string, acl ...knox.Access) error {
-	encK, err := m.db.Get(id)
+	return m.updateAccess(id, "", acl...)
+}
+
+func (m *keyManager) updateAccess(id, expected string, acl ...knox.Access) error {
+	defer m.reads.Forget(id)
+	encK, err := m.get(id, expected)
 	if err != nil {
 		return err
 	}
@@ -106,11 +371,16 @@ func (m *keyManager) UpdateAccess(id string, acl ...knox.Access) error {
 	if err != nil {
 		return err
 	}
-	return m.db.Update(newEncK)
+	return m.update(newEncK, expected)
 }
 
 func (m *keyManager) AddVersion(id string, v *knox.KeyVersion) error {
-	encK, err := m.db.Get(id)
+	return m.addVersion(id, "", v)
+}
+
+func (m *keyManager) addVersion(id, expected string, v *knox.KeyVersion) error {
+	defer m.reads.Forget(id)
+	encK, err := m.get(id, expected)
 	if err != nil {
 		return err
 	}
@@ -122,7 +392,8 @@ func (m *keyManager) AddVersion(id string, v *knox.KeyVersion) error {
 
 	k.VersionList = append(k.VersionList, *v)
 	k.VersionHash = k.VersionList.Hash()
-	err = k.Validate()
+	k.Metadata = withNextActivation(k.Metadata, k.VersionList)
+	err = validateVersions(k)
 	if err != nil {
 		return err
 	}
@@ -133,13 +404,147 @@ func (m *keyManager) AddVersion(id string, v *knox.KeyVersion) error {
 
 	newEncK := encK.Copy()
 	newEncK.VersionList = append(newEncK.VersionList, *encV)
-	newEncK.VersionHash = k.VersionList.Hash()
+	newEncK.VersionHash = k.VersionHash
+	newEncK.Metadata = k.Metadata
 
-	return m.db.Update(newEncK)
+	return m.update(newEncK, expected)
+}
+
+func (m *keyManager) UpdateMetadata(id string, md knox.KeyMetadata) error {
+	return m.updateMetadata(id, "", md)
+}
+
+func (m *keyManager) updateMetadata(id, expected string, md knox.KeyMetadata) error {
+	defer m.reads.Forget(id)
+	encK, err := m.get(id, expected)
+	if err != nil {
+		return err
+	}
+	newEncK := encK.Copy()
+	newEncK.Metadata = newEncK.Metadata.Update(md)
+	err = newEncK.Metadata.Validate()
+	if err != nil {
+		return err
+	}
+	return m.update(newEncK, expected)
+}
+
+// maxConsumeReadAttempts bounds the retries of ConsumeRead when concurrent
+// reads update the key first.
+const maxConsumeReadAttempts = 10
+
+// ConsumeRead counts a read of a key limited by knox.MetadataMaxReads and
+// returns the number of reads left after it. The count is updated with the
+// key's DB version so concurrent readers can't exceed the limit. It returns
+// knox.ErrKeyReadsExhausted if no reads are left and -1 if the key has no
+// limit.
+func (m *keyManager) ConsumeRead(id string) (int, error) {
+	defer m.reads.Forget(id)
+	for i := 0; ; i++ {
+		encK, err := m.db.Get(id)
+		if err != nil {
+			return 0, err
+		}
+		remaining, limited := encK.Metadata.RemainingReads()
+		if !limited {
+			return -1, nil
+		}
+		if remaining == 0 {
+			return 0, knox.ErrKeyReadsExhausted
+		}
+		count, _ := strconv.Atoi(encK.Metadata[knox.MetadataReadCount])
+		newEncK := encK.Copy()
+		newEncK.Metadata = newEncK.Metadata.Update(knox.KeyMetadata{knox.MetadataReadCount: strconv.Itoa(count + 1)})
+		err = m.db.Update(newEncK)
+		if err == keydb.ErrDBVersion && i < maxConsumeReadAttempts {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return remaining - 1, nil
+	}
+}
+
+// SearchKeyIDs reads encrypted keys but never decrypts them; all searchable
+// fields are stored in the clear.
+func (m *keyManager) SearchKeyIDs(q KeySearch) ([]string, error) {
+	keys, err := m.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	output := []string{}
+	for i := range keys {
+		if q.Matches(&keys[i]) {
+			output = append(output, keys[i].ID)
+		}
+	}
+	return output, nil
+}
+
+// FindKeysWithData returns the keys that have any version with the given
+// data. It decrypts every key in the database. The returned keys have their
+// version data removed.
+func (m *keyManager) FindKeysWithData(data []byte) ([]*knox.Key, error) {
+	keys, err := m.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	want := sha256.Sum256(data)
+	output := []*knox.Key{}
+	for i := range keys {
+		k, err := m.cryptor.Decrypt(&keys[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error decrypting key: %s", err.Error())
+		}
+		for _, v := range k.VersionList {
+			if sha256.Sum256(v.Data) == want {
+				for j := range k.VersionList {
+					k.VersionList[j].Data = nil
+				}
+				output = append(output, k)
+				break
+			}
+		}
+	}
+	return output, nil
+}
+
+// ReencryptKeys decrypts every key in the database and writes it back
+// encrypted with the current cryptor. Keys that fail, e.g. because they were
+// changed concurrently, are reported and can be retried.
+func (m *keyManager) ReencryptKeys() (*knox.ReencryptResult, error) {
+	keys, err := m.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	result := &knox.ReencryptResult{Failed: []string{}}
+	for i := range keys {
+		k, err := m.cryptor.Decrypt(&keys[i])
+		if err == nil {
+			var encK *keydb.DBKey
+			if encK, err = m.cryptor.Encrypt(k); err == nil {
+				encK.DBVersion = keys[i].DBVersion
+				err = m.db.Update(encK)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to re-encrypt key %s: %s", keys[i].ID, err.Error())
+			result.Failed = append(result.Failed, keys[i].ID)
+			continue
+		}
+		result.Reencrypted++
+	}
+	return result, nil
 }
 
 func (m *keyManager) UpdateVersion(keyID string, versionID uint64, s knox.VersionStatus) error {
-	encK, err := m.db.Get(keyID)
+	return m.updateVersion(keyID, "", versionID, s)
+}
+
+func (m *keyManager) updateVersion(keyID, expected string, versionID uint64, s knox.VersionStatus) error {
+	defer m.reads.Forget(keyID)
+	encK, err := m.get(keyID, expected)
 	if err != nil {
 		return err
 	}
@@ -147,24 +552,168 @@ func (m *keyManager) UpdateVersion(keyID string, versionID uint64, s knox.Versio
 	if err != nil {
 		return fmt.Errorf("Error decrypting key: %s", err.Error())
 	}
+	oldPrimary := k.VersionList.GetPrimary()
 	// Validate the change makes sense
 	kvl, err := k.VersionList.Update(versionID, s)
 	if err != nil {
 		return err
 	}
 	k.VersionHash = kvl.Hash()
-	err = k.Validate()
+	k.Metadata = withNextActivation(k.Metadata, kvl)
+	k.Metadata = withRotation(k.Metadata, oldPrimary, kvl.GetPrimary(), time.Now().UnixNano())
+	err = validateVersions(k)
+	if err != nil {
+		return err
+	}
+	if newPrimary := kvl.GetPrimary(); oldPrimary.ID != newPrimary.ID {
+		if err := beforePromote(m.Options().RotationPlugins, k, newPrimary); err != nil {
+			return err
+		}
+	}
+	return m.update(withStatuses(encK, kvl, k.VersionHash, k.Metadata), expected)
+}
+
+// RemoveVersions deletes Inactive versions of a key for good. It fails
+// without changing the key if any of the versions is missing or not Inactive.
+func (m *keyManager) RemoveVersions(keyID string, versionIDs ...uint64) error {
+	defer m.reads.Forget(keyID)
+	encK, err := m.db.Get(keyID)
+	if err != nil {
+		return err
+	}
+	k, err := m.cryptor.Decrypt(encK)
+	if err != nil {
+		return fmt.Errorf("Error decrypting key: %s", err.Error())
+	}
+	remove := make(map[uint64]bool, len(versionIDs))
+	for _, id := range versionIDs {
+		remove[id] = true
+	}
+	var kvl knox.KeyVersionList
+	for _, v := range k.VersionList {
+		if !remove[v.ID] {
+			kvl = append(kvl, v)
+		} else if v.Status != knox.Inactive {
+			return knox.ErrRemoveNotInactive
+		}
+	}
+	if len(k.VersionList)-len(kvl) != len(remove) {
+		return knox.ErrKeyVersionNotFound
+	}
+	newEncK := encK.Copy()
+	newEncK.VersionList = nil
+	for _, v := range encK.VersionList {
+		if !remove[v.ID] {
+			newEncK.VersionList = append(newEncK.VersionList, v)
+		}
+	}
+	newEncK.VersionHash = kvl.Hash()
+	return m.db.Update(newEncK)
+}
+
+// get reads a key to change. If a version hash is expected, it fails with a
+// *keydb.ConflictError when the key has another one.
+func (m *keyManager) get(id, expected string) (*keydb.DBKey, error) {
+	encK, err := m.db.Get(id)
 	if err != nil {
+		return nil, err
+	}
+	if expected != "" {
+		if err := keydb.CheckVersionHash(encK, expected); err != nil {
+			return nil, err
+		}
+	}
+	return encK, nil
+}
+
+// update writes a key changed from one read with get. If a version hash is
+// expected, the key must still have it when it is written.
+func (m *keyManager) update(encK *keydb.DBKey, expected string) error {
+	if expected == "" {
+		return m.db.Update(encK)
+	}
+	return keydb.UpdateIfHash(m.db, encK, expected)
+}
+
+func (m *keyManager) IfVersionHash(versionHash string) KeyManager {
+	return &conditionalKeyManager{keyManager: m, versionHash: versionHash}
+}
+
+// conditionalKeyManager makes the changes of a keyManager conditional on the
+// version hash of the key, see KeyManager.IfVersionHash.
+type conditionalKeyManager struct {
+	*keyManager
+	versionHash string
+}
+
+func (m *conditionalKeyManager) UpdateAccess(id string, acl ...knox.Access) error {
+	return m.updateAccess(id, m.versionHash, acl...)
+}
+
+func (m *conditionalKeyManager) AddVersion(id string, v *knox.KeyVersion) error {
+	return m.addVersion(id, m.versionHash, v)
+}
+
+func (m *conditionalKeyManager) UpdateVersion(keyID string, versionID uint64, s knox.VersionStatus) error {
+	return m.updateVersion(keyID, m.versionHash, versionID, s)
+}
+
+func (m *conditionalKeyManager) UpdateMetadata(id string, md knox.KeyMetadata) error {
+	return m.updateMetadata(id, m.versionHash, md)
+}
+
+// validateVersions checks the versions and metadata of a key after they
+// changed. Unlike Key.Validate it doesn't hash the versions again, the caller
+// just stored their hash.
+func validateVersions(k *knox.Key) error {
+	if err := k.VersionList.Validate(); err != nil {
 		return err
 	}
+	return k.Metadata.Validate()
+}
+
+// withStatuses returns a copy of the encrypted key with version statuses,
+// version hash, and metadata taken from the updated plaintext versions. Versions
+// whose status changed record the time of the change.
+func withStatuses(encK *keydb.DBKey, kvl knox.KeyVersionList, hash string, md knox.KeyMetadata) *keydb.DBKey {
 	newEncK := encK.Copy()
+	now := time.Now().UnixNano()
 	for j, v := range newEncK.VersionList {
 		for _, nv := range kvl {
-			if v.ID == nv.ID {
+			if v.ID == nv.ID && v.Status != nv.Status {
 				newEncK.VersionList[j].Status = nv.Status
+				newEncK.VersionList[j].StatusTime = now
 			}
 		}
 	}
-	newEncK.VersionHash = k.VersionHash
-	return m.db.Update(newEncK)
+	newEncK.VersionHash = hash
+	newEncK.Metadata = md
+	return newEncK
+}
+
+// withNextActivation records the next activation time of the versions in the
+// key metadata, removing it when nothing is scheduled.
+func withNextActivation(md knox.KeyMetadata, kvl knox.KeyVersionList) knox.KeyMetadata {
+	next := ""
+	if t := kvl.NextActivation(); t != 0 {
+		next = strconv.FormatInt(t, 10)
+	}
+	return md.Update(knox.KeyMetadata{knox.MetadataNextActivation: next})
+}
+
+// withRotation records the previous primary and when it was replaced if the
+// primary version changed, so clients can honor the key's grace window.
+func withRotation(md knox.KeyMetadata, oldPrimary, newPrimary *knox.KeyVersion, now int64) knox.KeyMetadata {
+	if oldPrimary == nil || newPrimary == nil || oldPrimary.ID == newPrimary.ID {
+		return md
+	}
+	return md.Update(knox.KeyMetadata{
+		knox.MetadataPreviousPrimary: strconv.FormatUint(oldPrimary.ID, 10),
+		knox.MetadataPromotedAt:      strconv.FormatInt(now, 10),
+	})
+}
+
+func activationDue(md knox.KeyMetadata, now int64) bool {
+	t, err := strconv.ParseInt(md[knox.MetadataNextActivation], 10, 64)
+	return err == nil && t <= now
 }
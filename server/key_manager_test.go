@@ -1,9 +1,13 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/server/auth"
@@ -41,7 +45,7 @@ func TestGetAllKeyIDs(t *testing.T) {
 		t.Fatal("database should have no keys in it")
 	}
 
-	key1 := newKey("id1", acl, []byte("data"), u)
+	key1 := newKey("id1", acl, []byte("data"), u, nil)
 	m.AddNewKey(&key1)
 	if err != nil {
 		t.Fatalf("%s is not nil", err)
@@ -59,7 +63,7 @@ func TestGetAllKeyIDs(t *testing.T) {
 		t.Fatal("Unexpected # of keys in get all keys response")
 	}
 
-	key2 := newKey("id2", acl, []byte("data"), u)
+	key2 := newKey("id2", acl, []byte("data"), u, nil)
 	m.AddNewKey(&key2)
 	if err != nil {
 		t.Fatalf("%s is not nil", err)
@@ -112,7 +116,7 @@ func TestGetUpdatedKeyIDs(t *testing.T) {
 		t.Fatal("database should have no keys in it")
 	}
 
-	key1 := newKey("id1", acl, []byte("data"), u)
+	key1 := newKey("id1", acl, []byte("data"), u, nil)
 	m.AddNewKey(&key1)
 	if err != nil {
 		t.Fatalf("%s is not nil", err)
@@ -135,7 +139,7 @@ func TestGetUpdatedKeyIDs(t *testing.T) {
 		t.Fatal("database should have no keys in it")
 	}
 
-	key2 := newKey("id2", acl, []byte("data"), u)
+	key2 := newKey("id2", acl, []byte("data"), u, nil)
 	m.AddNewKey(&key2)
 	if err != nil {
 		t.Fatalf("%s is not nil", err)
@@ -186,7 +190,7 @@ func TestGetUpdatedKeyIDs(t *testing.T) {
 
 func TestAddNewKey(t *testing.T) {
 	m, u, acl := GetMocks()
-	key1 := newKey("id1", acl, []byte("data"), u)
+	key1 := newKey("id1", acl, []byte("data"), u, nil)
 
 	key, err := m.GetKey(key1.ID, knox.Active)
 	if err == nil {
@@ -243,7 +247,7 @@ func TestAddNewKey(t *testing.T) {
 
 func TestUpdateAccess(t *testing.T) {
 	m, u, acl := GetMocks()
-	key1 := newKey("id1", acl, []byte("data"), u)
+	key1 := newKey("id1", acl, []byte("data"), u, nil)
 	access := knox.Access{Type: knox.User, ID: "grootan", AccessType: knox.Read}
 	access2 := knox.Access{Type: knox.UserGroup, ID: "group", AccessType: knox.Write}
 	access3 := knox.Access{Type: knox.Machine, ID: "machine", AccessType: knox.Read}
@@ -307,7 +311,7 @@ func TestUpdateAccess(t *testing.T) {
 func TestAddUpdateVersion(t *testing.T) {
 	m, u, acl := GetMocks()
 	var key *knox.Key
-	key1 := newKey("id1", acl, []byte("data"), u)
+	key1 := newKey("id1", acl, []byte("data"), u, nil)
 	kv := newKeyVersion([]byte("data2"), knox.Active)
 	access := knox.Access{Type: knox.User, ID: "grootan", AccessType: knox.Read}
 	err := m.UpdateAccess(key1.ID, access)
@@ -447,7 +451,7 @@ func TestAddUpdateVersion(t *testing.T) {
 func TestGetInactiveKeyVersions(t *testing.T) {
 	m, u, acl := GetMocks()
 
-	keyOrig := newKey("id1", acl, []byte("data"), u)
+	keyOrig := newKey("id1", acl, []byte("data"), u, nil)
 	kv := newKeyVersion([]byte("data2"), knox.Active)
 
 	// Create key and add version so we have two versions
@@ -499,3 +503,267 @@ func TestGetInactiveKeyVersions(t *testing.T) {
 		t.Fatalf("Wanted two key versions, got: %d", len(key.VersionList))
 	}
 }
+
+// noDecryptCryptor fails any attempt to decrypt key data.
+type noDecryptCryptor struct {
+	keydb.Cryptor
+}
+
+func (c noDecryptCryptor) Decrypt(*keydb.DBKey) (*knox.Key, error) {
+	return nil, fmt.Errorf("decryption should not be needed")
+}
+
+func TestGetUpdatedKeyIDsWithoutDecryption(t *testing.T) {
+	db := keydb.NewTempDB()
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u, nil)
+	if err := NewKeyManager(cryptor, db).AddNewKey(&key); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewKeyManager(noDecryptCryptor{cryptor}, db)
+	keys, err := m.GetUpdatedKeyIDs(map[string]string{key.ID: "NOT_THE_HASH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key.ID {
+		t.Fatalf("Expected [%s], got %v", key.ID, keys)
+	}
+	ids, err := m.GetAllKeyIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("Expected 1 key, got %v", ids)
+	}
+}
+
+func TestGetKeyUsesStoredVersionHash(t *testing.T) {
+	db := keydb.NewTempDB()
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	m := NewKeyManager(cryptor, db)
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u, nil)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatal(err)
+	}
+	encK, err := db.Get("id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encK.VersionHash = "stored"
+	if err := db.Update(encK); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []knox.VersionStatus{knox.Primary, knox.Active, knox.Inactive} {
+		k, err := m.GetKey("id1", status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.VersionHash != "stored" {
+			t.Fatalf("Expected the stored version hash, got %s", k.VersionHash)
+		}
+	}
+
+	v := newKeyVersion([]byte("data2"), knox.Active)
+	if err := m.AddVersion("id1", &v); err != nil {
+		t.Fatal(err)
+	}
+	k, err := m.GetKey("id1", knox.Inactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.VersionHash != k.VersionList.Hash() {
+		t.Fatalf("Expected a write to store the hash of the versions, got %s", k.VersionHash)
+	}
+}
+
+func TestConsumeRead(t *testing.T) {
+	m, u, acl := GetMocks()
+	key := newKey("id1", acl, []byte("data"), u, nil)
+	err := m.AddNewKey(&key)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	remaining, err := m.ConsumeRead("id1")
+	if err != nil || remaining != -1 {
+		t.Fatalf("Expected no limit, got %d, %v", remaining, err)
+	}
+
+	err = m.UpdateMetadata("id1", knox.KeyMetadata{knox.MetadataMaxReads: "5"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	var mu sync.Mutex
+	reads := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.ConsumeRead("id1"); err == nil {
+				mu.Lock()
+				reads++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reads > 5 {
+		t.Fatalf("Expected at most 5 reads, got %d", reads)
+	}
+	for ; ; reads++ {
+		remaining, err = m.ConsumeRead("id1")
+		if err == knox.ErrKeyReadsExhausted {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if remaining != 4-reads {
+			t.Fatalf("Expected %d reads remaining, got %d", 4-reads, remaining)
+		}
+	}
+	if reads != 5 {
+		t.Fatalf("Expected 5 reads, got %d", reads)
+	}
+}
+
+func TestConsumeReadRetriesConflicts(t *testing.T) {
+	db := keydb.NewFaultDB(keydb.NewTempDB(), 1)
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u, nil)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.UpdateMetadata("id1", knox.KeyMetadata{knox.MetadataMaxReads: "5"}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	db.Inject(keydb.OpUpdate, keydb.Fault{Err: keydb.ErrDBVersion, Times: 2})
+	remaining, err := m.ConsumeRead("id1")
+	if err != nil || remaining != 4 {
+		t.Fatalf("Expected a read after retries, got %d, %v", remaining, err)
+	}
+
+	db.Inject(keydb.OpUpdate, keydb.Fault{Err: fmt.Errorf("unavailable")})
+	if _, err := m.ConsumeRead("id1"); err == nil {
+		t.Fatal("Expected the backend error to be returned")
+	}
+}
+
+func TestIfVersionHash(t *testing.T) {
+	m, u, acl := GetMocks()
+	key := newKey("id1", acl, []byte("data"), u, nil)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err := m.GetKey("id1", knox.Inactive)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	read := k.VersionHash
+
+	// Another writer adds a version after the key was read.
+	v := newKeyVersion([]byte("other"), knox.Active)
+	if err := m.AddVersion("id1", &v); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	var conflict *keydb.ConflictError
+	v2 := newKeyVersion([]byte("mine"), knox.Active)
+	err = m.IfVersionHash(read).AddVersion("id1", &v2)
+	if !errors.As(err, &conflict) || conflict.Expected != read {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	a := knox.Access{Type: knox.User, ID: "other", AccessType: knox.Read}
+	if err := m.IfVersionHash(read).UpdateAccess("id1", a); !errors.As(err, &conflict) {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	if err := m.IfVersionHash(read).UpdateVersion("id1", v.ID, knox.Primary); !errors.As(err, &conflict) {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	if err := m.IfVersionHash(read).UpdateMetadata("id1", knox.KeyMetadata{"a": "b"}); !errors.As(err, &conflict) {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+
+	k, err = m.GetKey("id1", knox.Inactive)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k.VersionList) != 2 || len(k.ACL) != len(key.ACL) || k.Metadata["a"] != "" {
+		t.Fatalf("Conflicting changes were made: %+v", k)
+	}
+	if err := m.IfVersionHash(k.VersionHash).AddVersion("id1", &v2); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.IfVersionHash("").UpdateMetadata("id1", knox.KeyMetadata{"a": "b"}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestIfVersionHashDetectsRaces(t *testing.T) {
+	db := keydb.NewFaultDB(keydb.NewTempDB(), 1)
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u, nil)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, _ := m.GetKey("id1", knox.Inactive)
+
+	// The key changes between the read and the write of the update.
+	db.Inject(keydb.OpUpdate, keydb.Fault{Err: keydb.ErrDBVersion})
+	v := newKeyVersion([]byte("mine"), knox.Active)
+	var conflict *keydb.ConflictError
+	if err := m.IfVersionHash(k.VersionHash).AddVersion("id1", &v); !errors.As(err, &conflict) {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	if got := keyManagerErr(conflict); got.Subcode != knox.KeyVersionHashMismatchCode {
+		t.Fatalf("Expected a version hash mismatch, got %+v", got)
+	}
+}
+
+func TestGetKeyCollapsesConcurrentReads(t *testing.T) {
+	db := keydb.NewFaultDB(keydb.NewTempDB(), 1)
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u, nil)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	db.Inject(keydb.OpGet, keydb.Fault{Latency: 50 * time.Millisecond})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := m.GetKey("id1", knox.Active)
+			if err != nil || len(k.VersionList) != 1 {
+				t.Errorf("Unexpected key %v, %v", k, err)
+				return
+			}
+			// Callers get their own copies to modify.
+			k.ACL = knox.ACL{}
+			k.VersionList = nil
+		}()
+	}
+	wg.Wait()
+	if n := db.Calls(keydb.OpGet); n > 5 {
+		t.Fatalf("Expected concurrent reads to be collapsed, got %d DB reads", n)
+	}
+
+	// A read after a write sees the write.
+	db.Reset()
+	v := newKeyVersion([]byte("v2"), knox.Active)
+	if err := m.AddVersion("id1", &v); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err := m.GetKey("id1", knox.Active)
+	if err != nil || len(k.VersionList) != 2 {
+		t.Fatalf("Expected the added version, got %v, %v", k, err)
+	}
+}
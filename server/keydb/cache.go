@@ -0,0 +1,317 @@
+package keydb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Cache is a shared key/value store (e.g. redis or memcached) that can sit in
+// front of a DB to absorb read traffic across a fleet of knox servers.
+//
+// Implementations should treat a missing entry as (nil, nil) and only return
+// errors for failures talking to the cache itself.
+//
+// Add sets a value only if the key has none, like SETNX in redis or add in
+// memcached, and reports whether it did.
+type Cache interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+	Delete(key string) error
+}
+
+// cacheEntry is the serialized form of a DBKey stored in the cache. DBVersion
+// is not part of the json form of DBKey, so it is carried separately.
+type cacheEntry struct {
+	Key        *DBKey `json:"key"`
+	DBVersion  int64  `json:"db_version"`
+	Generation string `json:"generation"`
+	// Expires is when the entry stops being valid, in Unix nanoseconds, so an
+	// entry stored again without its TTL is still rejected.
+	Expires int64 `json:"expires"`
+}
+
+// CachedDB wraps a DB with a read-through Cache. Cached entries are signed
+// with an HMAC so a compromised or shared cache cannot be used to inject ACLs
+// or key material; entries that fail verification are treated as misses.
+//
+// Each key has a generation in the cache that every mutation replaces, and
+// entries are stored under and signed with the generation they were read in.
+// A read racing a mutation stores the row it read under the replaced
+// generation, where no later read looks, and an entry from before the
+// mutation can't be served again under the new one. Entries are only
+// written if absent and expire after the configured TTL.
+//
+// The TTL bounds how stale a served key can be when a mutation isn't seen
+// through the generation: when invalidating fails, which is logged, or when
+// a writer bypasses the cache. A revoked ACL entry can be honored for that
+// long. Generations are not signed, so a writer to the cache can also roll a
+// key back to an earlier generation and have the entries signed under it
+// served again; their signed expiry bounds that by the TTL too. With a zero
+// TTL entries never expire and neither is bounded.
+type CachedDB struct {
+	db     DB
+	cache  Cache
+	macKey []byte
+	ttl    time.Duration
+	prefix string
+	now    func() time.Time
+}
+
+// NewCachedDB creates a DB that serves Get from the cache when possible.
+// macKey must be kept secret and shared by all servers using the same cache.
+func NewCachedDB(db DB, cache Cache, macKey []byte, ttl time.Duration) DB {
+	return &CachedDB{
+		db:     db,
+		cache:  cache,
+		macKey: macKey,
+		ttl:    ttl,
+		prefix: "knox:key:",
+		now:    time.Now,
+	}
+}
+
+func (c *CachedDB) cacheKey(id, generation string) string {
+	return c.prefix + id + ":" + generation
+}
+
+func (c *CachedDB) generationKey(id string) string {
+	return c.prefix + "gen:" + id
+}
+
+func newGeneration() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+// generation returns the current generation of a key, starting one if it has
+// none. It returns an error if the cache can't tell, in which case the key is
+// read from the DB without caching it.
+func (c *CachedDB) generation(id string) (string, error) {
+	if gen, err := c.cache.Get(c.generationKey(id)); err != nil || gen != nil {
+		return string(gen), err
+	}
+	gen, err := newGeneration()
+	if err != nil {
+		return "", err
+	}
+	// Another server may start the generation first; its one is used then.
+	if ok, err := c.cache.Add(c.generationKey(id), gen, 0); err != nil || ok {
+		return string(gen), err
+	}
+	gen, err = c.cache.Get(c.generationKey(id))
+	if err == nil && gen == nil {
+		err = fmt.Errorf("cache generation of %s disappeared", id)
+	}
+	return string(gen), err
+}
+
+// invalidate starts a new generation of a key, so that entries cached before
+// a mutation are no longer read. It is called after the mutation, as a read
+// between a new generation and the mutation could cache the old key in it.
+func (c *CachedDB) invalidate(id string) error {
+	gen, err := newGeneration()
+	if err != nil {
+		// Without a new generation the key must not be served from the cache.
+		return c.cache.Delete(c.generationKey(id))
+	}
+	return c.cache.Set(c.generationKey(id), gen, 0)
+}
+
+// invalidateAfter invalidates keys after a mutation. The mutation happened
+// whether or not invalidating works, so failures are logged rather than
+// returned.
+func (c *CachedDB) invalidateAfter(ids ...string) {
+	for _, id := range ids {
+		if err := c.invalidate(id); err != nil {
+			log.Printf("keydb: failed to invalidate the cached entry of %s: %s", id, err.Error())
+		}
+	}
+}
+
+func (c *CachedDB) sign(b []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+func (c *CachedDB) encode(k *DBKey, generation string) ([]byte, error) {
+	b, err := json.Marshal(cacheEntry{
+		Key:        k,
+		DBVersion:  k.DBVersion,
+		Generation: generation,
+		Expires:    c.now().Add(c.ttl).UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(c.sign(b), b...), nil
+}
+
+func (c *CachedDB) decode(id, generation string, value []byte) (*DBKey, error) {
+	if len(value) < sha256.Size {
+		return nil, fmt.Errorf("cache entry too short")
+	}
+	mac, b := value[:sha256.Size], value[sha256.Size:]
+	if !hmac.Equal(mac, c.sign(b)) {
+		return nil, fmt.Errorf("cache entry failed verification")
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	// Guard against an entry being replayed under a different key ID.
+	if e.Key == nil || e.Key.ID != id {
+		return nil, fmt.Errorf("cache entry does not match key ID")
+	}
+	// Entries of earlier generations were made before a mutation.
+	if e.Generation != generation {
+		return nil, fmt.Errorf("cache entry is from another generation")
+	}
+	if c.ttl > 0 && c.now().UnixNano() > e.Expires {
+		return nil, fmt.Errorf("cache entry expired")
+	}
+	e.Key.DBVersion = e.DBVersion
+	return e.Key, nil
+}
+
+// Get returns the key from the cache, falling back to the underlying DB.
+func (c *CachedDB) Get(id string) (*DBKey, error) {
+	gen, err := c.generation(id)
+	if err != nil {
+		return c.db.Get(id)
+	}
+	if value, err := c.cache.Get(c.cacheKey(id, gen)); err == nil && value != nil {
+		if k, err := c.decode(id, gen, value); err == nil {
+			return k, nil
+		}
+		// Drop entries we cannot trust so they are replaced on this read.
+		c.cache.Delete(c.cacheKey(id, gen))
+	}
+	k, err := c.db.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if value, err := c.encode(k, gen); err == nil {
+		c.cache.Add(c.cacheKey(id, gen), value, c.ttl)
+	}
+	return k, nil
+}
+
+// GetAll always reads from the underlying DB.
+func (c *CachedDB) GetAll() ([]DBKey, error) {
+	return c.db.GetAll()
+}
+
+// GetAllMetadata always reads from the underlying DB.
+func (c *CachedDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	return GetAllMetadata(c.db)
+}
+
+// Update writes to the underlying DB and invalidates the cached entry.
+func (c *CachedDB) Update(key *DBKey) error {
+	defer c.invalidateAfter(key.ID)
+	return c.db.Update(key)
+}
+
+// UpdateIfHash writes to the underlying DB if the key has the version hash
+// expected and invalidates the cached entry.
+func (c *CachedDB) UpdateIfHash(key *DBKey, expected string) error {
+	defer c.invalidateAfter(key.ID)
+	return UpdateIfHash(c.db, key, expected)
+}
+
+// Add adds keys to the underlying DB and invalidates any stale entries.
+func (c *CachedDB) Add(keys ...*DBKey) error {
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.ID
+	}
+	defer c.invalidateAfter(ids...)
+	return c.db.Add(keys...)
+}
+
+// Remove removes the key from the underlying DB and invalidates its entry.
+func (c *CachedDB) Remove(id string) error {
+	defer c.invalidateAfter(id)
+	return c.db.Remove(id)
+}
+
+// Invalidate drops the cached entry for a key changed by another server, e.g.
+// on a notification from RedisDB.Listen.
+func (c *CachedDB) Invalidate(id string) error {
+	return c.invalidate(id)
+}
+
+// NewMemoryCache creates an in process Cache. It is intended for testing and
+// development; production deployments should use a shared cache.
+func NewMemoryCache() Cache {
+	return &memoryCache{entries: map[string]memoryCacheEntry{}, now: time.Now}
+}
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryCache struct {
+	sync.Mutex
+	entries map[string]memoryCacheEntry
+	now     func() time.Time
+}
+
+func (m *memoryCache) Get(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if !e.expires.IsZero() && m.now().After(e.expires) {
+		delete(m.entries, key)
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+func (m *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	e := memoryCacheEntry{value: value}
+	if ttl > 0 {
+		e.expires = m.now().Add(ttl)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+func (m *memoryCache) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if e, ok := m.entries[key]; ok && (e.expires.IsZero() || !m.now().After(e.expires)) {
+		return false, nil
+	}
+	e := memoryCacheEntry{value: value}
+	if ttl > 0 {
+		e.expires = m.now().Add(ttl)
+	}
+	m.entries[key] = e
+	return true, nil
+}
+
+func (m *memoryCache) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entries, key)
+	return nil
+}
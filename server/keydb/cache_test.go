@@ -0,0 +1,262 @@
+package keydb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestCachedDB(t *testing.T) {
+	db := NewCachedDB(NewTempDB(), NewMemoryCache(), []byte("mackey"), time.Minute)
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+	TesterUpdateIfHash(t, db)
+	TesterUpdateIfHashRace(t, db)
+}
+
+func TestCachedDBErrs(t *testing.T) {
+	temp := &TempDB{}
+	err := fmt.Errorf("Does not compute... EXTERMINATE! EXTERMINATE!")
+	temp.SetError(err)
+	db := NewCachedDB(temp, NewMemoryCache(), []byte("mackey"), time.Minute)
+	TesterErrs(t, db, err)
+}
+
+func TestCachedDBServesFromCache(t *testing.T) {
+	temp := NewTempDB().(*TempDB)
+	cache := NewMemoryCache()
+	db := NewCachedDB(temp, cache, []byte("mackey"), time.Minute)
+	k := newDBKey("cached", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the backing store failing, reads should still be served.
+	temp.SetError(knox.ErrKeyIDNotFound)
+	cached, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatalf("Expected cached read, got %s", err)
+	}
+	if cached.DBVersion != first.DBVersion {
+		t.Fatalf("DBVersion %d does not equal %d", cached.DBVersion, first.DBVersion)
+	}
+	temp.SetError(nil)
+
+	// Updates invalidate the entry so the next read sees the new version.
+	cached.VersionHash = "updated"
+	if err := db.Update(cached); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.VersionHash != "updated" || updated.DBVersion == first.DBVersion {
+		t.Fatalf("Expected updated key, got %+v", updated)
+	}
+}
+
+func TestCachedDBRejectsPoisonedEntries(t *testing.T) {
+	temp := NewTempDB()
+	cache := NewMemoryCache()
+	db := NewCachedDB(temp, cache, []byte("mackey"), time.Minute)
+	k := newDBKey("poisoned", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+
+	// An attacker with cache access signs an entry granting themselves access.
+	evil := k.Copy()
+	evil.ACL = knox.ACL{{Type: knox.User, ID: "mallory", AccessType: knox.Admin}}
+	attacker := NewCachedDB(temp, cache, []byte("wrongkey"), time.Minute).(*CachedDB)
+	gen, err := attacker.generation(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := attacker.encode(evil, gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set(attacker.cacheKey(k.ID, gen), value, time.Minute)
+
+	got, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ACL) != 0 {
+		t.Fatalf("Poisoned ACL was returned: %+v", got.ACL)
+	}
+
+	// A valid entry for one key must not be accepted for another.
+	other := newDBKey("other", []byte("b"), 0)
+	if err := db.Add(&other); err != nil {
+		t.Fatal(err)
+	}
+	otherGen, err := db.(*CachedDB).generation("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.(*CachedDB).encode(&k, otherGen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set(db.(*CachedDB).cacheKey("other", otherGen), value, time.Minute)
+	got, err = db.Get("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "other" {
+		t.Fatalf("Replayed entry for %s was returned for other", got.ID)
+	}
+}
+
+func TestCachedDBRejectsReplayedEntries(t *testing.T) {
+	temp := NewTempDB()
+	cache := NewMemoryCache()
+	db := NewCachedDB(temp, cache, []byte("mackey"), time.Minute).(*CachedDB)
+	k := newDBKey("replayed", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	oldGen, _ := db.generation(k.ID)
+	old, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldValue, _ := cache.Get(db.cacheKey(k.ID, oldGen))
+
+	// Revoke access, then write the entry signed before it back under the
+	// current generation.
+	updated := old.Copy()
+	updated.ACL = knox.ACL{}
+	if err := db.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	gen, _ := db.generation(k.ID)
+	if gen == oldGen {
+		t.Fatal("Expected the update to start a new generation")
+	}
+	cache.Set(db.cacheKey(k.ID, gen), oldValue, 0)
+	got, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ACL) != 0 {
+		t.Fatalf("Replayed entry from before the update was returned: %+v", got.ACL)
+	}
+
+	// Entries are rejected after their TTL even if stored without one.
+	cache.Set(db.cacheKey(k.ID, oldGen), oldValue, 0)
+	cache.Set(db.generationKey(k.ID), []byte(oldGen), 0)
+	db.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if got, err = db.Get(k.ID); err != nil || len(got.ACL) != 0 {
+		t.Fatalf("Expired entry was returned: %+v and %v", got, err)
+	}
+}
+
+// racingDB runs beforeReturn after reading a key, like a read that is slower
+// than a concurrent update.
+type racingDB struct {
+	DB
+	beforeReturn func()
+}
+
+func (db *racingDB) Get(id string) (*DBKey, error) {
+	k, err := db.DB.Get(id)
+	if f := db.beforeReturn; f != nil {
+		db.beforeReturn = nil
+		f()
+	}
+	return k, err
+}
+
+func TestCachedDBReadRacingUpdate(t *testing.T) {
+	temp := NewTempDB()
+	racing := &racingDB{DB: temp}
+	db := NewCachedDB(racing, NewMemoryCache(), []byte("mackey"), time.Minute)
+	k := newDBKey("racing", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	current, err := temp.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The update commits and invalidates while the read holds the old row.
+	racing.beforeReturn = func() {
+		updated := current.Copy()
+		updated.VersionHash = "updated"
+		if err := db.Update(updated); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if old, err := db.Get(k.ID); err != nil || old.VersionHash == "updated" {
+		t.Fatalf("Expected the racing read to return the old row, got %+v and %v", old, err)
+	}
+	got, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VersionHash != "updated" {
+		t.Fatalf("Expected the row cached by the racing read not to be served, got %s", got.VersionHash)
+	}
+}
+
+// failingSetCache is a cache whose Set fails, so generations can't be
+// replaced.
+type failingSetCache struct {
+	Cache
+}
+
+func (c failingSetCache) Set(key string, value []byte, ttl time.Duration) error {
+	return fmt.Errorf("cache unavailable")
+}
+
+func TestCachedDBFailedInvalidation(t *testing.T) {
+	now := time.Now()
+	db := NewCachedDB(NewTempDB(), failingSetCache{NewMemoryCache()}, []byte("mackey"), time.Minute).(*CachedDB)
+	db.now = func() time.Time { return now }
+	k := newDBKey("k", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The update succeeds, but the stale entry is served until it expires.
+	updated := *cached
+	updated.VersionHash = "updated"
+	if err := db.Update(&updated); err != nil {
+		t.Fatalf("Expected the update to succeed, got %s", err)
+	}
+	if got, err := db.Get(k.ID); err != nil || got.VersionHash == "updated" {
+		t.Fatalf("Expected the stale entry, got %+v %v", got, err)
+	}
+	now = now.Add(2 * time.Minute)
+	if got, err := db.Get(k.ID); err != nil || got.VersionHash != "updated" {
+		t.Fatalf("Expected the update once the entry expired, got %+v %v", got, err)
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := &memoryCache{entries: map[string]memoryCacheEntry{}, now: func() time.Time { return now }}
+	c.Set("a", []byte("1"), time.Second)
+	if v, _ := c.Get("a"); string(v) != "1" {
+		t.Fatalf("Expected cached value, got %q", v)
+	}
+	now = now.Add(2 * time.Second)
+	if v, _ := c.Get("a"); v != nil {
+		t.Fatalf("Expected expired value, got %q", v)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"sync"
 
 	"github.com/pinterest/knox"
 )
@@ -52,6 +53,9 @@ func (c *aesGCMCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKey
 		EncData:        ciphertext,
 		Status:         v.Status,
 		CreationTime:   v.CreationTime,
+		ActivationTime: v.ActivationTime,
+		StatusTime:     v.StatusTime,
+		ContentType:    v.ContentType,
 		CryptoMetadata: buildMetadata(c.version, nonce),
 	}, nil
 }
@@ -89,10 +93,13 @@ func (c *aesGCMCryptor) decryptVersion(k *DBKey, v *EncKeyVersion) (*knox.KeyVer
 	}
 
 	return &knox.KeyVersion{
-		ID:           v.ID,
-		Data:         plaintext,
-		Status:       v.Status,
-		CreationTime: v.CreationTime,
+		ID:             v.ID,
+		Data:           plaintext,
+		Status:         v.Status,
+		CreationTime:   v.CreationTime,
+		ActivationTime: v.ActivationTime,
+		StatusTime:     v.StatusTime,
+		ContentType:    v.ContentType,
 	}, nil
 }
 
@@ -111,6 +118,7 @@ func (c *aesGCMCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
 		ACL:         k.ACL,
 		VersionList: dbVersions,
 		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata,
 	}
 	return &newKey, nil
 }
@@ -130,6 +138,7 @@ func (c *aesGCMCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
 		ACL:         k.ACL,
 		VersionList: versions,
 		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata,
 	}
 	return &newKey, nil
 }
@@ -150,3 +159,117 @@ func buildMetadata(version byte, nonce []byte) aesCryptoMetadata {
 	copy(c[1:], nonce)
 	return c
 }
+
+// NewRotatingCryptor creates a Cryptor that encrypts with current and decrypts
+// keys written by current or any of the previous cryptors, identified by their
+// version. It is used to change the master key: after all keys have been
+// re-encrypted with current the previous cryptors can be removed.
+func NewRotatingCryptor(current Cryptor, previous ...Cryptor) Cryptor {
+	return &rotatingCryptor{current, previous}
+}
+
+type rotatingCryptor struct {
+	current  Cryptor
+	previous []Cryptor
+}
+
+func (c *rotatingCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
+	return c.current.Encrypt(k)
+}
+
+func (c *rotatingCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	return c.current.EncryptVersion(k, v)
+}
+
+// Decrypt decrypts each version separately since a key can have versions
+// written by different cryptors.
+func (c *rotatingCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
+	key, err := c.current.Decrypt(k)
+	if err != ErrCryptorVersion {
+		return key, err
+	}
+	versions := make([]knox.KeyVersion, len(k.VersionList))
+	for i := range k.VersionList {
+		single := *k
+		single.VersionList = k.VersionList[i : i+1]
+		for _, cryptor := range append([]Cryptor{c.current}, c.previous...) {
+			key, err = cryptor.Decrypt(&single)
+			if err != ErrCryptorVersion {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = key.VersionList[0]
+	}
+	key.VersionList = versions
+	return key, nil
+}
+
+// ErrSealed is returned by a SealedCryptor until it is unsealed.
+var ErrSealed = fmt.Errorf("the cryptor is sealed")
+
+// SealedCryptor is a Cryptor without a master key until Unseal is called.
+// It lets a server start and accept the master key from operators instead of
+// reading it from its configuration.
+type SealedCryptor struct {
+	mu      sync.RWMutex
+	cryptor Cryptor
+}
+
+// NewSealedCryptor creates a sealed Cryptor.
+func NewSealedCryptor() *SealedCryptor {
+	return &SealedCryptor{}
+}
+
+// Unseal makes the SealedCryptor use c. It can only be unsealed once.
+func (s *SealedCryptor) Unseal(c Cryptor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cryptor != nil {
+		return fmt.Errorf("the cryptor is already unsealed")
+	}
+	s.cryptor = c
+	return nil
+}
+
+// Sealed reports whether Unseal has not been called yet.
+func (s *SealedCryptor) Sealed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cryptor == nil
+}
+
+func (s *SealedCryptor) get() (Cryptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cryptor == nil {
+		return nil, ErrSealed
+	}
+	return s.cryptor, nil
+}
+
+func (s *SealedCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return c.Decrypt(k)
+}
+
+func (s *SealedCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return c.Encrypt(k)
+}
+
+func (s *SealedCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return c.EncryptVersion(k, v)
+}
@@ -119,3 +119,66 @@ func TestAESMetadata(t *testing.T) {
 		t.Fatalf("%d does not equal %d", cm.Version(), version)
 	}
 }
+
+func TestRotatingCryptor(t *testing.T) {
+	old := NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	current := NewAESGCMCryptor(1, []byte("newnewnewnewnewn"))
+	c := NewRotatingCryptor(current, old)
+
+	k := &knox.Key{ID: "k", VersionList: knox.KeyVersionList{
+		{ID: 1, Data: []byte("one"), Status: knox.Primary},
+		{ID: 2, Data: []byte("two"), Status: knox.Active},
+	}}
+	oldEnc, err := old.Encrypt(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEnc, err := c.Encrypt(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A key with one version from each cryptor.
+	mixed := oldEnc.Copy()
+	mixed.VersionList[1] = newEnc.VersionList[1]
+	for _, dbk := range []*DBKey{oldEnc, newEnc, mixed} {
+		dec, err := c.Decrypt(dbk)
+		if err != nil {
+			t.Fatalf("Failed to decrypt: %s", err)
+		}
+		if string(dec.VersionList[0].Data) != "one" || string(dec.VersionList[1].Data) != "two" {
+			t.Fatalf("Unexpected versions %+v", dec.VersionList)
+		}
+	}
+	if _, err := current.Decrypt(newEnc); err != nil {
+		t.Fatalf("Expected new keys to use the current cryptor: %s", err)
+	}
+	if _, err := NewRotatingCryptor(current).Decrypt(oldEnc); err != ErrCryptorVersion {
+		t.Fatalf("Expected a version error without the old cryptor, got %v", err)
+	}
+}
+
+func TestSealedCryptor(t *testing.T) {
+	c := NewSealedCryptor()
+	if !c.Sealed() {
+		t.Fatal("Expected a new cryptor to be sealed")
+	}
+	if _, err := c.Encrypt(makeTestKey()); err != ErrSealed {
+		t.Fatalf("Expected ErrSealed, got %v", err)
+	}
+	if err := c.Unseal(NewAESGCMCryptor(0, testSecret)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Sealed() {
+		t.Fatal("Expected the cryptor to be unsealed")
+	}
+	enc, err := c.Encrypt(makeTestKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Decrypt(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unseal(NewAESGCMCryptor(0, testSecret)); err == nil {
+		t.Fatal("Expected a second unseal to fail")
+	}
+}
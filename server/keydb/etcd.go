@@ -0,0 +1,268 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// EtcdKV is a key value pair read from etcd.
+type EtcdKV struct {
+	Key         string
+	Value       []byte
+	ModRevision int64
+}
+
+// EtcdClient is the subset of an etcd v3 client EtcdDB needs, usually a thin
+// wrapper around go.etcd.io/etcd/client/v3. It must be safe for concurrent
+// use.
+type EtcdClient interface {
+	// Get returns the key, or nil if it does not exist.
+	Get(ctx context.Context, key string) (*EtcdKV, error)
+	// List returns all keys with the given prefix.
+	List(ctx context.Context, prefix string) ([]EtcdKV, error)
+	// PutIf sets key to value in a transaction comparing the key's
+	// ModRevision to modRevision, 0 for a key that must not exist. It reports
+	// whether the comparison succeeded.
+	PutIf(ctx context.Context, key string, value []byte, modRevision int64) (bool, error)
+	// Delete deletes key and reports whether it existed.
+	Delete(ctx context.Context, key string) (bool, error)
+	// Watch calls f with the key of every put or delete under prefix until
+	// ctx is done or the watch fails.
+	Watch(ctx context.Context, prefix string, f func(key string)) error
+}
+
+// EtcdLeaser is implemented by EtcdClients that can attach a lease to a
+// key, so etcd deletes the key once the lease expires.
+type EtcdLeaser interface {
+	// PutWithLease sets key to value with a new lease expiring after ttl.
+	PutWithLease(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// EtcdDB stores each key as JSON under a common prefix in etcd. The etcd
+// ModRevision of a key is its DBVersion, so updates are compare-and-swap
+// transactions, and watches on the prefix let servers follow changes made by
+// others.
+type EtcdDB struct {
+	client EtcdClient
+	prefix string
+	// tombstoneTTL is how long removed keys are remembered, see
+	// SetTombstoneTTL.
+	tombstoneTTL time.Duration
+}
+
+// NewEtcdDB creates a DB storing keys under prefix, "/knox/keys/" if empty.
+func NewEtcdDB(client EtcdClient, prefix string) *EtcdDB {
+	if prefix == "" {
+		prefix = "/knox/keys/"
+	}
+	return &EtcdDB{client: client, prefix: prefix}
+}
+
+func (db *EtcdDB) etcdKey(id string) string {
+	return db.prefix + id
+}
+
+// tombstonePrefix is next to the prefix rather than under it, so tombstones
+// are neither listed as keys nor watched.
+func (db *EtcdDB) tombstonePrefix() string {
+	return strings.TrimSuffix(db.prefix, "/") + ".tombstones/"
+}
+
+// SetTombstoneTTL makes Remove leave a tombstone for every removed key that
+// expires with an etcd lease after ttl. Servers that lose their watch learn
+// about the keys removed in the meantime from RemovedKeys. The client must
+// implement EtcdLeaser.
+func (db *EtcdDB) SetTombstoneTTL(ttl time.Duration) error {
+	if _, ok := db.client.(EtcdLeaser); !ok && ttl > 0 {
+		return fmt.Errorf("keydb: the etcd client does not support leases")
+	}
+	db.tombstoneTTL = ttl
+	return nil
+}
+
+func (db *EtcdDB) decode(kv *EtcdKV) (*DBKey, error) {
+	var key DBKey
+	if err := json.Unmarshal(kv.Value, &key); err != nil {
+		return nil, err
+	}
+	key.DBVersion = kv.ModRevision
+	return &key, nil
+}
+
+// Get returns the key with the given ID.
+func (db *EtcdDB) Get(id string) (*DBKey, error) {
+	kv, err := db.client.Get(context.Background(), db.etcdKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	return db.decode(kv)
+}
+
+// GetAll returns all of the keys in the database.
+func (db *EtcdDB) GetAll() ([]DBKey, error) {
+	kvs, err := db.client.List(context.Background(), db.prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]DBKey, 0, len(kvs))
+	for i := range kvs {
+		k, err := db.decode(&kvs[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, nil
+}
+
+// Update makes an update to DBKey indexed by its ID.
+// It will fail if the key has been changed since the specified version.
+func (db *EtcdDB) Update(key *DBKey) error {
+	if key.DBVersion == 0 {
+		// A ModRevision of 0 would create the key.
+		if _, err := db.Get(key.ID); err != nil {
+			return err
+		}
+		return ErrDBVersion
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	ok, err := db.client.PutIf(context.Background(), db.etcdKey(key.ID), b, key.DBVersion)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if _, err := db.Get(key.ID); err != nil {
+			return err
+		}
+		return ErrDBVersion
+	}
+	return nil
+}
+
+// UpdateIfHash updates the key if it has the version hash expected. The key is
+// written with a comparison of its mod revision, which only matches the
+// revision whose version hash was checked.
+func (db *EtcdDB) UpdateIfHash(key *DBKey, expected string) error {
+	current, err := db.Get(key.ID)
+	if err != nil {
+		return err
+	}
+	if err := CheckVersionHash(current, expected); err != nil {
+		return err
+	}
+	if err := db.Update(key); err != ErrDBVersion {
+		return err
+	}
+	// Read again for the version hash that is stored now.
+	if current, err = db.Get(key.ID); err != nil {
+		return err
+	}
+	return &ConflictError{ID: key.ID, Expected: expected, Actual: current.VersionHash}
+}
+
+// Add adds the key(s) to the DB (it will fail if the key id exists).
+func (db *EtcdDB) Add(keys ...*DBKey) error {
+	for _, key := range keys {
+		b, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		ok, err := db.client.PutIf(context.Background(), db.etcdKey(key.ID), b, 0)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return knox.ErrKeyExists
+		}
+	}
+	return nil
+}
+
+// Remove permanently removes the key specified by the ID.
+func (db *EtcdDB) Remove(id string) error {
+	ok, err := db.client.Delete(context.Background(), db.etcdKey(id))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return knox.ErrKeyIDNotFound
+	}
+	if db.tombstoneTTL > 0 {
+		// The key is gone either way, so a missing tombstone only delays
+		// invalidation on servers that lost their watch until their cache
+		// expires.
+		removed := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+		err := db.client.(EtcdLeaser).PutWithLease(context.Background(), db.tombstonePrefix()+id, removed, db.tombstoneTTL)
+		if err != nil {
+			log.Printf("keydb: failed to write the tombstone of %s: %s", id, err.Error())
+		}
+	}
+	return nil
+}
+
+// RemovedKeys returns the IDs of the keys removed within the tombstone TTL.
+func (db *EtcdDB) RemovedKeys() ([]string, error) {
+	if db.tombstoneTTL <= 0 {
+		return nil, nil
+	}
+	kvs, err := db.client.List(context.Background(), db.tombstonePrefix())
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		ids = append(ids, strings.TrimPrefix(kv.Key, db.tombstonePrefix()))
+	}
+	return ids, nil
+}
+
+// Listen calls f with the ID of every key changed through any server sharing
+// the prefix, including this one, until ctx is done or the watch fails.
+// Servers caching keys in process should run it and drop the key from their
+// cache, e.g. with CachedDB.Invalidate.
+func (db *EtcdDB) Listen(ctx context.Context, f func(id string)) error {
+	return db.client.Watch(ctx, db.prefix, func(key string) {
+		f(strings.TrimPrefix(key, db.prefix))
+	})
+}
+
+// Follow runs Listen and calls invalidate with every changed key, e.g.
+// CachedDB.Invalidate, until ctx is done. A failed watch is started again
+// after retry, invalidating the keys removed within the tombstone TTL first,
+// as their removals may have happened while the watch was down.
+func (db *EtcdDB) Follow(ctx context.Context, invalidate func(id string) error, retry time.Duration) {
+	changed := func(id string) {
+		if err := invalidate(id); err != nil {
+			log.Printf("keydb: failed to invalidate %s: %s", id, err.Error())
+		}
+	}
+	for {
+		if ids, err := db.RemovedKeys(); err != nil {
+			log.Printf("keydb: failed to read etcd tombstones: %s", err.Error())
+		} else {
+			for _, id := range ids {
+				changed(id)
+			}
+		}
+		err := db.Listen(ctx, changed)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		log.Printf("keydb: restarting the etcd watch after: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package keydb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is an in memory EtcdClient with etcd's revision semantics.
+type fakeEtcd struct {
+	sync.Mutex
+	revision int64
+	kvs      map[string]EtcdKV
+	watchers []func(string)
+	// leases holds the expiry of keys put with a lease.
+	leases map[string]time.Time
+	// failWatches makes this many watches fail right away.
+	failWatches int
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: map[string]EtcdKV{}, leases: map[string]time.Time{}}
+}
+
+func (e *fakeEtcd) PutWithLease(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	e.Lock()
+	defer e.Unlock()
+	e.revision++
+	e.kvs[key] = EtcdKV{Key: key, Value: value, ModRevision: e.revision}
+	e.leases[key] = time.Now().Add(ttl)
+	e.notify(key)
+	return nil
+}
+
+// expire deletes the keys whose lease expired. The caller holds the lock.
+func (e *fakeEtcd) expire() {
+	for k, t := range e.leases {
+		if time.Now().After(t) {
+			delete(e.kvs, k)
+			delete(e.leases, k)
+		}
+	}
+}
+
+func (e *fakeEtcd) Get(ctx context.Context, key string) (*EtcdKV, error) {
+	e.Lock()
+	defer e.Unlock()
+	kv, ok := e.kvs[key]
+	if !ok {
+		return nil, nil
+	}
+	return &kv, nil
+}
+
+func (e *fakeEtcd) List(ctx context.Context, prefix string) ([]EtcdKV, error) {
+	e.Lock()
+	defer e.Unlock()
+	e.expire()
+	var kvs []EtcdKV
+	for k, kv := range e.kvs {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, nil
+}
+
+func (e *fakeEtcd) PutIf(ctx context.Context, key string, value []byte, modRevision int64) (bool, error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.kvs[key].ModRevision != modRevision {
+		return false, nil
+	}
+	e.revision++
+	e.kvs[key] = EtcdKV{Key: key, Value: value, ModRevision: e.revision}
+	e.notify(key)
+	return true, nil
+}
+
+func (e *fakeEtcd) Delete(ctx context.Context, key string) (bool, error) {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.kvs[key]; !ok {
+		return false, nil
+	}
+	e.revision++
+	delete(e.kvs, key)
+	e.notify(key)
+	return true, nil
+}
+
+func (e *fakeEtcd) notify(key string) {
+	for _, f := range e.watchers {
+		f(key)
+	}
+}
+
+func (e *fakeEtcd) Watch(ctx context.Context, prefix string, f func(string)) error {
+	e.Lock()
+	if e.failWatches > 0 {
+		e.failWatches--
+		e.Unlock()
+		return fmt.Errorf("watch failed")
+	}
+	e.watchers = append(e.watchers, func(key string) {
+		if strings.HasPrefix(key, prefix) {
+			f(key)
+		}
+	})
+	e.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestEtcdDB(t *testing.T) {
+	db := NewEtcdDB(newFakeEtcd(), "")
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+	TesterUpdateIfHash(t, db)
+	TesterUpdateIfHashRace(t, db)
+}
+
+func TestEtcdDBWatch(t *testing.T) {
+	e := newFakeEtcd()
+	db := NewEtcdDB(e, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan string, 10)
+	go db.Listen(ctx, func(id string) { changed <- id })
+	for {
+		e.Lock()
+		n := len(e.watchers)
+		e.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	k := newDBKey("service:k1", []byte("data"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	if id := <-changed; id != "service:k1" {
+		t.Fatalf("Expected change of service:k1, got %s", id)
+	}
+	got, err := db.Get("service:k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := got.Copy()
+	if err := db.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(stale); err != ErrDBVersion {
+		t.Fatalf("Expected a version error for a stale update, got %v", err)
+	}
+	if err := db.Remove("service:k1"); err != nil {
+		t.Fatal(err)
+	}
+	if id := <-changed; id != "service:k1" {
+		t.Fatalf("Expected change of service:k1, got %s", id)
+	}
+}
+
+func TestEtcdDBTombstones(t *testing.T) {
+	e := newFakeEtcd()
+	db := NewEtcdDB(e, "")
+	if err := NewEtcdDB(struct{ EtcdClient }{e}, "").SetTombstoneTTL(time.Hour); err == nil {
+		t.Fatal("Expected an error for a client without leases")
+	}
+	if err := db.SetTombstoneTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	a, b := newDBKey("a", []byte("1"), 0), newDBKey("b", []byte("2"), 0)
+	if err := db.Add(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := db.RemovedKeys(); err != nil || len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("Expected a tombstone for a, got %v %v", ids, err)
+	}
+	if keys, _ := db.GetAll(); len(keys) != 1 || keys[0].ID != "b" {
+		t.Fatalf("Expected tombstones not to be listed as keys, got %v", keys)
+	}
+
+	// The removal of a is invalidated again each time the watch is started.
+	e.failWatches = 1
+	invalidated := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		db.Follow(ctx, func(id string) error { invalidated <- id; return nil }, time.Millisecond)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		if id := <-invalidated; id != "a" {
+			t.Fatalf("Expected the removed key to be invalidated, got %s", id)
+		}
+	}
+	for {
+		e.Lock()
+		n := len(e.watchers)
+		e.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if id := <-invalidated; id != "b" {
+		t.Fatalf("Expected the watched removal to be invalidated, got %s", id)
+	}
+	cancel()
+	<-done
+
+	e.Lock()
+	for k := range e.leases {
+		e.leases[k] = time.Now().Add(-time.Second)
+	}
+	e.Unlock()
+	if ids, _ := db.RemovedKeys(); len(ids) != 0 {
+		t.Fatalf("Expected the tombstones to expire with their leases, got %v", ids)
+	}
+}
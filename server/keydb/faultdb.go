@@ -0,0 +1,209 @@
+package keydb
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The operations of a DB faults can be injected into.
+const (
+	OpGet    = "get"
+	OpGetAll = "getall"
+	OpUpdate = "update"
+	OpAdd    = "add"
+	OpRemove = "remove"
+)
+
+// Fault describes how a FaultDB misbehaves on an operation.
+type Fault struct {
+	// Err is returned by the operation. If nil, the fault only adds latency.
+	Err error
+	// Latency delays the operation.
+	Latency time.Duration
+	// Rate is the fraction of matching calls the fault applies to, all of
+	// them if zero.
+	Rate float64
+	// Times limits the fault to this many calls, unlimited if zero.
+	Times int
+	// KeyID limits the fault to operations on one key. Faults on GetAll
+	// ignore it.
+	KeyID string
+	// AfterWrite applies a write to the wrapped DB before returning Err, a
+	// partial failure where the caller can't tell whether the write happened.
+	// For Add of several keys, only the first key is written.
+	AfterWrite bool
+}
+
+// FaultDB wraps a DB and injects errors, latency and partial failures into
+// its operations, so handlers and clients can be tested against a backend
+// that misbehaves. Faults are matched in the order they were injected.
+type FaultDB struct {
+	db DB
+
+	mu     sync.Mutex
+	faults map[string][]*Fault
+	calls  map[string]int
+	rand   *rand.Rand
+}
+
+// NewFaultDB wraps db. seed makes faults with a Rate reproducible.
+func NewFaultDB(db DB, seed int64) *FaultDB {
+	return &FaultDB{
+		db:     db,
+		faults: map[string][]*Fault{},
+		calls:  map[string]int{},
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Inject adds a fault to the operation op.
+func (f *FaultDB) Inject(op string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[op] = append(f.faults[op], &fault)
+}
+
+// Reset removes all faults and call counts.
+func (f *FaultDB) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = map[string][]*Fault{}
+	f.calls = map[string]int{}
+}
+
+// Calls returns the number of calls to op, including failed ones.
+func (f *FaultDB) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// fault counts a call on the keys ids and returns the fault that applies to
+// it, if any.
+func (f *FaultDB) fault(op string, ids ...string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[op]++
+	for i, ft := range f.faults[op] {
+		if ft.KeyID != "" && op != OpGetAll && !containsID(ids, ft.KeyID) {
+			continue
+		}
+		if ft.Rate > 0 && f.rand.Float64() >= ft.Rate {
+			continue
+		}
+		if ft.Times > 0 {
+			ft.Times--
+			if ft.Times == 0 {
+				f.faults[op] = append(f.faults[op][:i:i], f.faults[op][i+1:]...)
+			}
+		}
+		c := *ft
+		return &c
+	}
+	return nil
+}
+
+func containsID(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// faultBefore applies the latency of a fault and returns its error unless it is
+// returned after the write.
+func faultBefore(ft *Fault) error {
+	if ft == nil {
+		return nil
+	}
+	time.Sleep(ft.Latency)
+	if ft.AfterWrite {
+		return nil
+	}
+	return ft.Err
+}
+
+// faultAfter returns the error of a fault applied after the write.
+func faultAfter(ft *Fault, err error) error {
+	if err == nil && ft != nil && ft.AfterWrite {
+		return ft.Err
+	}
+	return err
+}
+
+// Get returns the key from the wrapped DB unless a fault applies.
+func (f *FaultDB) Get(id string) (*DBKey, error) {
+	if err := faultBefore(f.fault(OpGet, id)); err != nil {
+		return nil, err
+	}
+	return f.db.Get(id)
+}
+
+// GetAll returns the keys from the wrapped DB unless a fault applies.
+func (f *FaultDB) GetAll() ([]DBKey, error) {
+	if err := faultBefore(f.fault(OpGetAll)); err != nil {
+		return nil, err
+	}
+	return f.db.GetAll()
+}
+
+// GetAllMetadata returns the key metadata from the wrapped DB unless a fault
+// on GetAll applies.
+func (f *FaultDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	if err := faultBefore(f.fault(OpGetAll)); err != nil {
+		return nil, err
+	}
+	return GetAllMetadata(f.db)
+}
+
+// Update updates the key in the wrapped DB unless a fault applies.
+func (f *FaultDB) Update(key *DBKey) error {
+	ft := f.fault(OpUpdate, key.ID)
+	if err := faultBefore(ft); err != nil {
+		return err
+	}
+	return faultAfter(ft, f.db.Update(key))
+}
+
+// UpdateIfHash updates the key in the wrapped DB if it has the version hash
+// expected, unless a fault on Update applies. An injected ErrDBVersion is
+// returned as the *ConflictError of a concurrent change.
+func (f *FaultDB) UpdateIfHash(key *DBKey, expected string) error {
+	ft := f.fault(OpUpdate, key.ID)
+	err := faultBefore(ft)
+	if err == nil {
+		err = faultAfter(ft, UpdateIfHash(f.db, key, expected))
+	}
+	if err == ErrDBVersion {
+		return &ConflictError{ID: key.ID, Expected: expected, Actual: expected}
+	}
+	return err
+}
+
+// Add adds the keys to the wrapped DB unless a fault applies to one of them.
+func (f *FaultDB) Add(keys ...*DBKey) error {
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.ID
+	}
+	ft := f.fault(OpAdd, ids...)
+	if err := faultBefore(ft); err != nil {
+		return err
+	}
+	if ft != nil && ft.AfterWrite && len(keys) > 1 {
+		keys = keys[:1]
+	}
+	return faultAfter(ft, f.db.Add(keys...))
+}
+
+// Remove removes the key from the wrapped DB unless a fault applies.
+func (f *FaultDB) Remove(id string) error {
+	ft := f.fault(OpRemove, id)
+	if err := faultBefore(ft); err != nil {
+		return err
+	}
+	return faultAfter(ft, f.db.Remove(id))
+}
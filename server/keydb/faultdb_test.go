@@ -0,0 +1,85 @@
+package keydb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestFaultDB(t *testing.T) {
+	db := NewFaultDB(NewTempDB(), 1)
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+}
+
+func TestFaultDBFaults(t *testing.T) {
+	db := NewFaultDB(NewTempDB(), 1)
+	k1 := newDBKey("k1", []byte("a"), 0)
+	k2 := newDBKey("k2", []byte("b"), 0)
+	if err := db.Add(&k1, &k2); err != nil {
+		t.Fatal(err)
+	}
+
+	unavailable := fmt.Errorf("unavailable")
+	db.Inject(OpGet, Fault{Err: unavailable, KeyID: "k1", Times: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := db.Get("k1"); err != unavailable {
+			t.Fatalf("Expected injected error, got %v", err)
+		}
+	}
+	if _, err := db.Get("k1"); err != nil {
+		t.Fatalf("Expected the fault to be used up, got %v", err)
+	}
+	if _, err := db.Get("k2"); err != nil {
+		t.Fatalf("Expected other keys to work, got %v", err)
+	}
+	if n := db.Calls(OpGet); n != 4 {
+		t.Fatalf("Expected 4 calls, got %d", n)
+	}
+
+	db.Inject(OpGetAll, Fault{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	if _, err := db.GetAll(); err != nil || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("Expected a slow GetAll, got %v after %s", err, time.Since(start))
+	}
+
+	// The update happens, but the caller sees an error.
+	db.Inject(OpUpdate, Fault{Err: unavailable, AfterWrite: true, Times: 1})
+	k, _ := db.Get("k2")
+	k.VersionHash = "updated"
+	if err := db.Update(k); err != unavailable {
+		t.Fatalf("Expected injected error, got %v", err)
+	}
+	if k, _ = db.Get("k2"); k.VersionHash != "updated" {
+		t.Fatal("Expected the update to be written")
+	}
+
+	k3 := newDBKey("k3", []byte("c"), 0)
+	k4 := newDBKey("k4", []byte("d"), 0)
+	db.Inject(OpAdd, Fault{Err: unavailable, AfterWrite: true, KeyID: "k4"})
+	if err := db.Add(&k3, &k4); err != unavailable {
+		t.Fatalf("Expected injected error, got %v", err)
+	}
+	if _, err := db.Get("k3"); err != nil {
+		t.Fatal("Expected the first key to be written")
+	}
+	if _, err := db.Get("k4"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the second key not to be written, got %v", err)
+	}
+
+	db.Reset()
+	db.Inject(OpRemove, Fault{Err: unavailable, Rate: 0.5})
+	failed := 0
+	for i := 0; i < 100; i++ {
+		if err := db.Remove("missing"); err == unavailable {
+			failed++
+		}
+	}
+	if failed < 25 || failed > 75 {
+		t.Fatalf("Expected about half of the calls to fail, got %d", failed)
+	}
+}
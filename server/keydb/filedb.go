@@ -0,0 +1,269 @@
+package keydb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pinterest/knox"
+)
+
+const fileDBKeyFile = "key.json"
+const fileDBTempPrefix = ".tmp-"
+
+// fileEntry is the content of a key file. DBVersion is not part of the json
+// form of DBKey, so it is carried separately.
+type fileEntry struct {
+	Key       *DBKey `json:"key"`
+	DBVersion int64  `json:"db_version"`
+}
+
+// FileDB stores every key in its own directory under a root directory, for
+// the dev server and air-gapped appliances without a database. Key files hold
+// the encrypted versions like any other DB. Writes go to a temporary file that
+// is synced and renamed over the key file, so a crash leaves either the old or
+// the new key. It is meant for a single server process.
+type FileDB struct {
+	mu   sync.Mutex
+	root string
+}
+
+// NewFileDB opens or creates a FileDB in root. It scans every key on startup
+// and fails if one can't be read or doesn't match its directory, rather than
+// serving a damaged database.
+func NewFileDB(root string) (*FileDB, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	db := &FileDB{root: root}
+	if err := db.scan(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *FileDB) keyDir(id string) string {
+	return filepath.Join(db.root, url.PathEscape(id))
+}
+
+// scan removes temporary files left by interrupted writes and checks that
+// every key can be decoded.
+func (db *FileDB) scan() error {
+	entries, err := os.ReadDir(db.root)
+	if err != nil {
+		return err
+	}
+	var damaged []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(db.root, e.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), fileDBTempPrefix) {
+				if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		id, err := url.PathUnescape(e.Name())
+		if err != nil {
+			damaged = append(damaged, e.Name())
+			continue
+		}
+		k, err := db.read(id)
+		if err == knox.ErrKeyIDNotFound {
+			// The key was created but never written, or removed while
+			// its directory could not be.
+			os.Remove(dir)
+			continue
+		}
+		if err != nil || k.ID != id {
+			damaged = append(damaged, e.Name())
+		}
+	}
+	if len(damaged) > 0 {
+		sort.Strings(damaged)
+		return fmt.Errorf("keydb: damaged keys in %s: %s", db.root, strings.Join(damaged, ", "))
+	}
+	return nil
+}
+
+func (db *FileDB) read(id string) (*DBKey, error) {
+	b, err := os.ReadFile(filepath.Join(db.keyDir(id), fileDBKeyFile))
+	if os.IsNotExist(err) {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e fileEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("keydb: damaged key %s: %s", id, err.Error())
+	}
+	if e.Key == nil {
+		return nil, fmt.Errorf("keydb: damaged key %s", id)
+	}
+	e.Key.DBVersion = e.DBVersion
+	return e.Key, nil
+}
+
+// write atomically replaces the key file and syncs it and its directory.
+func (db *FileDB) write(key *DBKey, version int64) error {
+	if strings.Trim(key.ID, ".") == "" {
+		return fmt.Errorf("keydb: invalid key ID %q", key.ID)
+	}
+	dir := db.keyDir(key.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(fileEntry{Key: key, DBVersion: version})
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(dir, filepath.Join(dir, fileDBKeyFile), b); err != nil {
+		return err
+	}
+	return syncDir(db.root)
+}
+
+// writeAtomic writes b to a temporary file in dir that is synced and renamed
+// over path, and syncs dir, so a crash leaves either the old or the new file.
+func writeAtomic(dir, path string, b []byte) error {
+	f, err := os.CreateTemp(dir, fileDBTempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Get returns the key with the given ID.
+func (db *FileDB) Get(id string) (*DBKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.read(id)
+}
+
+// GetAll returns all of the keys in the database.
+func (db *FileDB) GetAll() ([]DBKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entries, err := os.ReadDir(db.root)
+	if err != nil {
+		return nil, err
+	}
+	var keys []DBKey
+	for _, e := range entries {
+		id, err := url.PathUnescape(e.Name())
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		k, err := db.read(id)
+		if err == knox.ErrKeyIDNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, nil
+}
+
+// Update makes an update to DBKey indexed by its ID.
+// It will fail if the key has been changed since the specified version.
+func (db *FileDB) Update(key *DBKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	current, err := db.read(key.ID)
+	if err != nil {
+		return err
+	}
+	if current.DBVersion != key.DBVersion {
+		return ErrDBVersion
+	}
+	return db.write(key, key.DBVersion+1)
+}
+
+// UpdateIfHash updates the key if it has the version hash expected.
+func (db *FileDB) UpdateIfHash(key *DBKey, expected string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	current, err := db.read(key.ID)
+	if err != nil {
+		return err
+	}
+	if err := CheckVersionHash(current, expected); err != nil {
+		return err
+	}
+	if current.DBVersion != key.DBVersion {
+		return &ConflictError{ID: key.ID, Expected: expected, Actual: current.VersionHash}
+	}
+	return db.write(key, key.DBVersion+1)
+}
+
+// Add adds the key(s) to the DB (it will fail if the key id exists).
+func (db *FileDB) Add(keys ...*DBKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, key := range keys {
+		if _, err := db.read(key.ID); err == nil {
+			return knox.ErrKeyExists
+		}
+	}
+	for _, key := range keys {
+		if err := db.write(key, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove permanently removes the key specified by the ID.
+func (db *FileDB) Remove(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	dir := db.keyDir(id)
+	if err := os.Remove(filepath.Join(dir, fileDBKeyFile)); err != nil {
+		if os.IsNotExist(err) {
+			return knox.ErrKeyIDNotFound
+		}
+		return err
+	}
+	os.Remove(dir)
+	return syncDir(db.root)
+}
@@ -0,0 +1,65 @@
+package keydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDB(t *testing.T) {
+	db, err := NewFileDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+	TesterUpdateIfHash(t, db)
+	TesterUpdateIfHashRace(t, db)
+}
+
+func TestFileDBReopen(t *testing.T) {
+	root := t.TempDir()
+	db, err := NewFileDB(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newDBKey("service:key", []byte("data"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get("service:key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.VersionHash = "updated"
+	if err := db.Update(got); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write interrupted before its rename leaves a temporary file behind.
+	dir := db.keyDir("service:key")
+	if err := os.WriteFile(filepath.Join(dir, fileDBTempPrefix+"1"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewFileDB(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileDBTempPrefix+"1")); !os.IsNotExist(err) {
+		t.Fatal("Expected the temporary file to be removed")
+	}
+	got, err = db.Get("service:key")
+	if err != nil || got.VersionHash != "updated" || got.DBVersion != 2 {
+		t.Fatalf("Expected the updated key, got %+v, %v", got, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, fileDBKeyFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileDB(root); err == nil {
+		t.Fatal("Expected the damaged key to be reported")
+	}
+}
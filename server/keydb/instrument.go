@@ -0,0 +1,208 @@
+package keydb
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// OpGetAllMetadata is the operation of reading key metadata, reported by
+// InstrumentedDB next to the operations of DB.
+const OpGetAllMetadata = "getallmetadata"
+
+// healthCheckID is read by Ping for DBs that can't be pinged. It is not a
+// valid key ID, so it is never found.
+const healthCheckID = "knox health check"
+
+// PoolStats describes the connection pool of a DB.
+type PoolStats struct {
+	MaxOpen      int           `json:"max_open"`
+	Open         int           `json:"open"`
+	InUse        int           `json:"in_use"`
+	Idle         int           `json:"idle"`
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration"`
+}
+
+// PoolStatsDB is implemented by DBs with a connection pool.
+type PoolStatsDB interface {
+	PoolStats() PoolStats
+}
+
+// Pinger is implemented by DBs that can check their connection to the
+// database.
+type Pinger interface {
+	Ping() error
+}
+
+// GetPoolStats returns the connection pool stats of db, if it has a pool.
+func GetPoolStats(db DB) (PoolStats, bool) {
+	if pdb, ok := db.(PoolStatsDB); ok {
+		return pdb.PoolStats(), true
+	}
+	return PoolStats{}, false
+}
+
+// Ping checks that db can reach its database. DBs that aren't a Pinger are
+// checked by reading a key that doesn't exist.
+func Ping(db DB) error {
+	if p, ok := db.(Pinger); ok {
+		return p.Ping()
+	}
+	_, err := db.Get(healthCheckID)
+	if errors.Is(err, knox.ErrKeyIDNotFound) {
+		return nil
+	}
+	return err
+}
+
+func sqlPoolStats(db *sql.DB) PoolStats {
+	s := db.Stats()
+	return PoolStats{
+		MaxOpen:      s.MaxOpenConnections,
+		Open:         s.OpenConnections,
+		InUse:        s.InUse,
+		Idle:         s.Idle,
+		WaitCount:    s.WaitCount,
+		WaitDuration: s.WaitDuration,
+	}
+}
+
+// QueryHook is called after every operation of an InstrumentedDB with the
+// time it took and its error, e.g. to report them to a metrics system.
+type QueryHook func(op string, elapsed time.Duration, err error)
+
+// OpStats counts the calls of one DB operation. Errors leaves out keys that
+// were not found and updates that lost a race, which are expected.
+type OpStats struct {
+	Calls      uint64        `json:"calls"`
+	Errors     uint64        `json:"errors"`
+	Latency    time.Duration `json:"latency"`
+	MaxLatency time.Duration `json:"max_latency"`
+}
+
+// DBStats are the operational metrics of an InstrumentedDB.
+type DBStats struct {
+	Ops map[string]OpStats `json:"ops"`
+	// Pool is nil for DBs without a connection pool.
+	Pool *PoolStats `json:"pool,omitempty"`
+}
+
+// InstrumentedDB wraps a DB and measures the latency and errors of its
+// operations. It passes through GetAllMetadata and Ping, and reports the pool
+// stats of the wrapped DB in Stats.
+type InstrumentedDB struct {
+	db    DB
+	hooks []QueryHook
+
+	mu  sync.Mutex
+	ops map[string]*OpStats
+}
+
+// NewInstrumentedDB wraps db, calling hooks after every operation.
+func NewInstrumentedDB(db DB, hooks ...QueryHook) *InstrumentedDB {
+	return &InstrumentedDB{db: db, hooks: hooks, ops: map[string]*OpStats{}}
+}
+
+// observe records an operation that started at start.
+func (i *InstrumentedDB) observe(op string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	i.mu.Lock()
+	s, ok := i.ops[op]
+	if !ok {
+		s = &OpStats{}
+		i.ops[op] = s
+	}
+	s.Calls++
+	if err != nil && !errors.Is(err, knox.ErrKeyIDNotFound) && !errors.Is(err, ErrDBVersion) {
+		s.Errors++
+	}
+	s.Latency += elapsed
+	if elapsed > s.MaxLatency {
+		s.MaxLatency = elapsed
+	}
+	i.mu.Unlock()
+	for _, h := range i.hooks {
+		h(op, elapsed, err)
+	}
+}
+
+// Stats returns the counts of each operation since the DB was wrapped, and
+// the pool stats of the wrapped DB.
+func (i *InstrumentedDB) Stats() DBStats {
+	i.mu.Lock()
+	s := DBStats{Ops: make(map[string]OpStats, len(i.ops))}
+	for op, o := range i.ops {
+		s.Ops[op] = *o
+	}
+	i.mu.Unlock()
+	if p, ok := GetPoolStats(i.db); ok {
+		s.Pool = &p
+	}
+	return s
+}
+
+// Get returns the key from the wrapped DB.
+func (i *InstrumentedDB) Get(id string) (*DBKey, error) {
+	start := time.Now()
+	k, err := i.db.Get(id)
+	i.observe(OpGet, start, err)
+	return k, err
+}
+
+// GetAll returns all keys from the wrapped DB.
+func (i *InstrumentedDB) GetAll() ([]DBKey, error) {
+	start := time.Now()
+	keys, err := i.db.GetAll()
+	i.observe(OpGetAll, start, err)
+	return keys, err
+}
+
+// GetAllMetadata returns the metadata of all keys from the wrapped DB.
+func (i *InstrumentedDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	start := time.Now()
+	md, err := GetAllMetadata(i.db)
+	i.observe(OpGetAllMetadata, start, err)
+	return md, err
+}
+
+// Update updates the key in the wrapped DB.
+func (i *InstrumentedDB) Update(key *DBKey) error {
+	start := time.Now()
+	err := i.db.Update(key)
+	i.observe(OpUpdate, start, err)
+	return err
+}
+
+// UpdateIfHash updates the key in the wrapped DB if it has the version hash
+// expected.
+func (i *InstrumentedDB) UpdateIfHash(key *DBKey, expected string) error {
+	start := time.Now()
+	err := UpdateIfHash(i.db, key, expected)
+	i.observe(OpUpdate, start, err)
+	return err
+}
+
+// Add adds the keys to the wrapped DB.
+func (i *InstrumentedDB) Add(keys ...*DBKey) error {
+	start := time.Now()
+	err := i.db.Add(keys...)
+	i.observe(OpAdd, start, err)
+	return err
+}
+
+// Remove removes the key from the wrapped DB.
+func (i *InstrumentedDB) Remove(id string) error {
+	start := time.Now()
+	err := i.db.Remove(id)
+	i.observe(OpRemove, start, err)
+	return err
+}
+
+// Ping checks the wrapped DB.
+func (i *InstrumentedDB) Ping() error {
+	return Ping(i.db)
+}
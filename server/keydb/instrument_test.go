@@ -0,0 +1,61 @@
+package keydb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestInstrumentedDB(t *testing.T) {
+	fault := NewFaultDB(NewTempDB(), 1)
+	var hooked []string
+	db := NewInstrumentedDB(fault, func(op string, elapsed time.Duration, err error) {
+		hooked = append(hooked, op)
+	})
+
+	key := newDBKey("a", []byte("data"), 0)
+	if err := db.Add(&key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("missing"); !errors.Is(err, knox.ErrKeyIDNotFound) {
+		t.Fatalf("Expected a missing key, got %v", err)
+	}
+	fault.Inject(OpGet, Fault{Err: errors.New("connection refused"), Latency: time.Millisecond, Times: 1})
+	if _, err := db.Get("a"); err == nil {
+		t.Fatal("Expected the injected error")
+	}
+	if _, err := db.GetAllMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.Stats()
+	get := s.Ops[OpGet]
+	if get.Calls != 3 || get.Errors != 1 || get.MaxLatency < time.Millisecond {
+		t.Fatalf("Unexpected get stats %+v", get)
+	}
+	if s.Ops[OpAdd].Calls != 1 || s.Ops[OpGetAllMetadata].Calls != 1 {
+		t.Fatalf("Unexpected stats %+v", s.Ops)
+	}
+	if s.Pool != nil {
+		t.Fatalf("Expected no pool stats for a TempDB, got %+v", s.Pool)
+	}
+	if len(hooked) != 5 || hooked[0] != OpAdd {
+		t.Fatalf("Expected the hook to run for every operation, got %v", hooked)
+	}
+}
+
+func TestPing(t *testing.T) {
+	db := NewFaultDB(NewTempDB(), 1)
+	if err := Ping(db); err != nil {
+		t.Fatalf("Expected a healthy DB, got %v", err)
+	}
+	db.Inject(OpGet, Fault{Err: errors.New("connection refused")})
+	if err := Ping(NewInstrumentedDB(db)); err == nil {
+		t.Fatal("Expected the ping to fail")
+	}
+}
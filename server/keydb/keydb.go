@@ -14,10 +14,11 @@ var ErrDBVersion = fmt.Errorf("DB version does not match")
 
 // DBKey is a struct for the json serialization of keys in the database.
 type DBKey struct {
-	ID          string          `json:"id"`
-	ACL         knox.ACL        `json:"acl"`
-	VersionList []EncKeyVersion `json:"versions"`
-	VersionHash string          `json:"hash"`
+	ID          string           `json:"id"`
+	ACL         knox.ACL         `json:"acl"`
+	VersionList []EncKeyVersion  `json:"versions"`
+	VersionHash string           `json:"hash"`
+	Metadata    knox.KeyMetadata `json:"metadata,omitempty"`
 	// The version should be set by the db provider and is not part of the data.
 	DBVersion int64 `json:"-"`
 }
@@ -33,16 +34,64 @@ func (k *DBKey) Copy() *DBKey {
 		ACL:         acl,
 		VersionList: versionList,
 		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
 		DBVersion:   k.DBVersion,
 	}
 }
 
+// DBKeyMetadata is the subset of a DBKey that can be read without loading the
+// encrypted key versions. It is enough to list keys and compare version hashes.
+type DBKeyMetadata struct {
+	ID          string           `json:"id"`
+	ACL         knox.ACL         `json:"acl"`
+	VersionHash string           `json:"hash"`
+	Metadata    knox.KeyMetadata `json:"metadata,omitempty"`
+	DBVersion   int64            `json:"-"`
+}
+
+// toMetadata returns the metadata portion of the key.
+func (k *DBKey) toMetadata() DBKeyMetadata {
+	return DBKeyMetadata{
+		ID:          k.ID,
+		ACL:         k.ACL,
+		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata,
+		DBVersion:   k.DBVersion,
+	}
+}
+
+// MetadataDB is implemented by DBs that can return key metadata without
+// reading the encrypted version payloads.
+type MetadataDB interface {
+	GetAllMetadata() ([]DBKeyMetadata, error)
+}
+
+// GetAllMetadata returns the metadata for every key in db. It uses the
+// MetadataDB fast path when available and falls back to GetAll otherwise.
+func GetAllMetadata(db DB) ([]DBKeyMetadata, error) {
+	if mdb, ok := db.(MetadataDB); ok {
+		return mdb.GetAllMetadata()
+	}
+	keys, err := db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	md := make([]DBKeyMetadata, len(keys))
+	for i := range keys {
+		md[i] = keys[i].toMetadata()
+	}
+	return md, nil
+}
+
 // EncKeyVersion is a struct for encrypting key data
 type EncKeyVersion struct {
 	ID             uint64             `json:"id"`
 	EncData        []byte             `json:"data"`
 	Status         knox.VersionStatus `json:"status"`
 	CreationTime   int64              `json:"ts"`
+	ActivationTime int64              `json:"activation,omitempty"`
+	StatusTime     int64              `json:"status_ts,omitempty"`
+	ContentType    string             `json:"content_type,omitempty"`
 	CryptoMetadata []byte             `json:"crypt"`
 }
 
@@ -65,6 +114,76 @@ type DB interface {
 	Remove(id string) error
 }
 
+// ConflictError is returned by UpdateIfHash when the stored key is not the one
+// the update was made from. It matches ErrDBVersion with errors.Is.
+type ConflictError struct {
+	ID string
+	// Expected is the version hash the update was made from and Actual the
+	// stored one. They are equal if only the ACL or metadata changed.
+	Expected string
+	Actual   string
+}
+
+func (e *ConflictError) Error() string {
+	if e.Expected == e.Actual {
+		return fmt.Sprintf("Key %s was changed concurrently", e.ID)
+	}
+	return fmt.Sprintf("Key %s has version hash %s, not %s", e.ID, e.Actual, e.Expected)
+}
+
+// Is makes a ConflictError match ErrDBVersion.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrDBVersion
+}
+
+// CheckVersionHash returns a *ConflictError if key doesn't have the version
+// hash expected.
+func CheckVersionHash(key *DBKey, expected string) error {
+	if key.VersionHash != expected {
+		return &ConflictError{ID: key.ID, Expected: expected, Actual: key.VersionHash}
+	}
+	return nil
+}
+
+// ConditionalDB is implemented by DBs that compare the version hash of the
+// stored key when they update it, in the same atomic step as the DB version.
+type ConditionalDB interface {
+	// UpdateIfHash updates key if the stored key has the version hash
+	// expected and hasn't changed since key.DBVersion. It returns a
+	// *ConflictError otherwise.
+	UpdateIfHash(key *DBKey, expected string) error
+}
+
+// UpdateIfHash updates key if the stored key has the version hash expected and
+// hasn't changed since key.DBVersion, which makes the update fail instead of
+// overwriting a change the caller hasn't seen. It returns a *ConflictError
+// otherwise. DBs that implement ConditionalDB make the comparison themselves;
+// for others the stored key is read first, and Update's comparison of DB
+// versions makes the update fail if it changes after the read.
+func UpdateIfHash(db DB, key *DBKey, expected string) error {
+	if cdb, ok := db.(ConditionalDB); ok {
+		return cdb.UpdateIfHash(key, expected)
+	}
+	current, err := db.Get(key.ID)
+	if err != nil {
+		return err
+	}
+	if err := CheckVersionHash(current, expected); err != nil {
+		return err
+	}
+	conflict := &ConflictError{ID: key.ID, Expected: expected, Actual: current.VersionHash}
+	if current.DBVersion != key.DBVersion {
+		return conflict
+	}
+	if err := db.Update(key); err != nil {
+		if err == ErrDBVersion {
+			return conflict
+		}
+		return err
+	}
+	return nil
+}
+
 // NewTempDB creates a new TempDB with no data.
 func NewTempDB() DB {
 	return &TempDB{}
@@ -110,48 +229,106 @@ func (db *TempDB) GetAll() ([]DBKey, error) {
 	return db.keys, nil
 }
 
+// GetAllMetadata gets the metadata of all keys from TempDB.
+func (db *TempDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.err != nil {
+		return nil, db.err
+	}
+	md := make([]DBKeyMetadata, len(db.keys))
+	for i := range db.keys {
+		md[i] = db.keys[i].toMetadata()
+	}
+	return md, nil
+}
+
 // Update looks for an existing key and updates the key in the database.
 func (db *TempDB) Update(key *DBKey) error {
 	db.Lock()
 	defer db.Unlock()
+	_, err := db.update(key)
+	return err
+}
+
+// UpdateIfHash updates the key if it has the version hash expected.
+func (db *TempDB) UpdateIfHash(key *DBKey, expected string) error {
+	db.Lock()
+	defer db.Unlock()
+	_, err := db.updateIfHash(key, expected)
+	return err
+}
+
+// updateIfHash replaces a key that has the version hash expected and returns
+// the stored copy. The caller holds the lock.
+func (db *TempDB) updateIfHash(key *DBKey, expected string) (*DBKey, error) {
 	if db.err != nil {
-		return db.err
+		return nil, db.err
+	}
+	for _, dbk := range db.keys {
+		if dbk.ID != key.ID {
+			continue
+		}
+		if err := CheckVersionHash(&dbk, expected); err != nil {
+			return nil, err
+		}
+		if dbk.DBVersion != key.DBVersion {
+			return nil, &ConflictError{ID: key.ID, Expected: expected, Actual: dbk.VersionHash}
+		}
+		return db.update(key)
+	}
+	return nil, knox.ErrKeyIDNotFound
+}
+
+// update replaces a key and returns the stored copy. The caller holds the
+// lock.
+func (db *TempDB) update(key *DBKey) (*DBKey, error) {
+	if db.err != nil {
+		return nil, db.err
 	}
 	for i, dbk := range db.keys {
 		if dbk.ID == key.ID {
 			if dbk.DBVersion != key.DBVersion {
-				return ErrDBVersion
+				return nil, ErrDBVersion
 			}
 			k := key.Copy()
 			k.DBVersion = time.Now().UnixNano()
 			db.keys[i] = *k
-			return nil
+			return k, nil
 		}
 	}
-	return knox.ErrKeyIDNotFound
+	return nil, knox.ErrKeyIDNotFound
 }
 
 // Add adds the key(s) to the DB (it will fail if the key id exists).
 func (db *TempDB) Add(keys ...*DBKey) error {
 	db.Lock()
 	defer db.Unlock()
+	_, err := db.add(keys)
+	return err
+}
+
+// add adds keys and returns the stored copies. The caller holds the lock.
+func (db *TempDB) add(keys []*DBKey) ([]*DBKey, error) {
 	if db.err != nil {
-		return db.err
+		return nil, db.err
 	}
 	for _, key := range keys {
 		for _, oldK := range db.keys {
 			if oldK.ID == key.ID {
-				return knox.ErrKeyExists
+				return nil, knox.ErrKeyExists
 			}
 		}
 	}
+	added := make([]*DBKey, 0, len(keys))
 	for _, key := range keys {
 		k := key.Copy()
 		k.DBVersion = time.Now().UnixNano()
 
 		db.keys = append(db.keys, *k)
+		added = append(added, k)
 	}
-	return nil
+	return added, nil
 
 }
 
@@ -159,6 +336,11 @@ func (db *TempDB) Add(keys ...*DBKey) error {
 func (db *TempDB) Remove(id string) error {
 	db.Lock()
 	defer db.Unlock()
+	return db.remove(id)
+}
+
+// remove removes a key. The caller holds the lock.
+func (db *TempDB) remove(id string) error {
 	if db.err != nil {
 		return db.err
 	}
@@ -173,12 +355,22 @@ func (db *TempDB) Remove(id string) error {
 
 // SQLDB provides a generic way to use SQL providers as Knox DBs.
 type SQLDB struct {
-	getStmt    *sql.Stmt
-	getAllStmt *sql.Stmt
-	UpdateStmt *sql.Stmt
-	AddStmt    *sql.Stmt
-	RemoveStmt *sql.Stmt
-	db         sql.DB
+	getStmt         *sql.Stmt
+	getAllStmt      *sql.Stmt
+	getMetadataStmt *sql.Stmt
+	UpdateStmt      *sql.Stmt
+	// updateIfHashStmt is UpdateStmt that also compares the version hash.
+	updateIfHashStmt *sql.Stmt
+	AddStmt          *sql.Stmt
+	RemoveStmt       *sql.Stmt
+	sqlDB            *sql.DB
+	// postgres is set for databases using $n placeholders.
+	postgres bool
+	// outbox is set once EnableOutbox was called.
+	outbox *sqlOutbox
+	// lockStmt, if set, locks the row of a key for the rest of the
+	// transaction of an update.
+	lockStmt *sql.Stmt
 }
 
 var sqlCreateKeys = `CREATE TABLE IF NOT EXISTS secrets (
@@ -186,30 +378,71 @@ var sqlCreateKeys = `CREATE TABLE IF NOT EXISTS secrets (
 	acl TEXT NOT NULL,
 	version_hash TEXT NOT NULL,
 	versions TEXT NOT NULL,
-	last_updated BIGINT NOT NULL
+	last_updated BIGINT NOT NULL,
+	metadata TEXT
 );`
 
+// sqlAddMetadataColumn upgrades tables created before key metadata existed.
+var sqlAddMetadataColumn = `ALTER TABLE secrets ADD COLUMN metadata TEXT`
+
+// createSQLTables creates the secrets table and adds any columns missing from
+// tables created by older versions of knox.
+func createSQLTables(sqlDB *sql.DB) error {
+	_, err := sqlDB.Exec(sqlCreateKeys)
+	if err != nil {
+		return err
+	}
+	rows, err := sqlDB.Query("SELECT metadata FROM secrets WHERE 1=0")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = sqlDB.Exec(sqlAddMetadataColumn)
+	return err
+}
+
+func marshalMetadata(md knox.KeyMetadata) ([]byte, error) {
+	if len(md) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(md)
+}
+
+func unmarshalMetadata(b []byte, md *knox.KeyMetadata) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, md)
+}
+
 // NewPostgreSQLDB will create a SQLDB with the necessary statements for using postgres.
 func NewPostgreSQLDB(sqlDB *sql.DB) (DB, error) {
-	db := &SQLDB{}
+	db := &SQLDB{sqlDB: sqlDB, postgres: true}
 	var err error
-	_, err = sqlDB.Exec(sqlCreateKeys)
+	err = createSQLTables(sqlDB)
+	if err != nil {
+		return nil, err
+	}
+	db.getStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated, metadata FROM secrets WHERE id=$1")
 	if err != nil {
 		return nil, err
 	}
-	db.getStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets WHERE id=$1")
+	db.getAllStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated, metadata FROM secrets")
 	if err != nil {
 		return nil, err
 	}
-	db.getAllStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets")
+	db.getMetadataStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, last_updated, metadata FROM secrets")
 	if err != nil {
 		return nil, err
 	}
-	db.UpdateStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=$1, version_hash=$2,last_updated=$3,acl=$4 WHERE id=$5 AND last_updated=$6")
+	db.UpdateStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=$1, version_hash=$2,last_updated=$3,acl=$4,metadata=$5 WHERE id=$6 AND last_updated=$7")
 	if err != nil {
 		return nil, err
 	}
-	db.AddStmt, err = sqlDB.Prepare("INSERT INTO secrets (id, acl, versions, version_hash, last_updated) VALUES ($1,$2,$3,$4,$5)")
+	db.updateIfHashStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=$1, version_hash=$2,last_updated=$3,acl=$4,metadata=$5 WHERE id=$6 AND last_updated=$7 AND version_hash=$8")
+	if err != nil {
+		return nil, err
+	}
+	db.AddStmt, err = sqlDB.Prepare("INSERT INTO secrets (id, acl, versions, version_hash, last_updated, metadata) VALUES ($1,$2,$3,$4,$5,$6)")
 	if err != nil {
 		return nil, err
 	}
@@ -222,25 +455,33 @@ func NewPostgreSQLDB(sqlDB *sql.DB) (DB, error) {
 
 // NewSQLDB creates a table and prepared statements suitable for mysql and sqlite databases.
 func NewSQLDB(sqlDB *sql.DB) (DB, error) {
-	db := &SQLDB{}
+	db := &SQLDB{sqlDB: sqlDB}
 	var err error
-	_, err = sqlDB.Exec(sqlCreateKeys)
+	err = createSQLTables(sqlDB)
+	if err != nil {
+		return nil, err
+	}
+	db.getStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated, metadata FROM secrets WHERE id=?")
 	if err != nil {
 		return nil, err
 	}
-	db.getStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets WHERE id=?")
+	db.getAllStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated, metadata FROM secrets")
 	if err != nil {
 		return nil, err
 	}
-	db.getAllStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets")
+	db.getMetadataStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, last_updated, metadata FROM secrets")
 	if err != nil {
 		return nil, err
 	}
-	db.UpdateStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=?, version_hash=?,last_updated=?,acl=? WHERE id=? AND last_updated=?")
+	db.UpdateStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=?, version_hash=?,last_updated=?,acl=?,metadata=? WHERE id=? AND last_updated=?")
 	if err != nil {
 		return nil, err
 	}
-	db.AddStmt, err = sqlDB.Prepare("INSERT INTO secrets (id, acl, versions, version_hash, last_updated) VALUES (?,?,?,?,?)")
+	db.updateIfHashStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=?, version_hash=?,last_updated=?,acl=?,metadata=? WHERE id=? AND last_updated=? AND version_hash=?")
+	if err != nil {
+		return nil, err
+	}
+	db.AddStmt, err = sqlDB.Prepare("INSERT INTO secrets (id, acl, versions, version_hash, last_updated, metadata) VALUES (?,?,?,?,?,?)")
 	if err != nil {
 		return nil, err
 	}
@@ -251,14 +492,28 @@ func NewSQLDB(sqlDB *sql.DB) (DB, error) {
 	return db, nil
 }
 
+// PoolStats returns the stats of the connection pool.
+func (db *SQLDB) PoolStats() PoolStats {
+	return sqlPoolStats(db.sqlDB)
+}
+
+// Ping checks the connection to the database.
+func (db *SQLDB) Ping() error {
+	return db.sqlDB.Ping()
+}
+
 // Get will return the key given its key ID.
 func (db *SQLDB) Get(id string) (*DBKey, error) {
 	var key DBKey
-	var acl, versions []byte
-	err := db.getStmt.QueryRow(id).Scan(&key.ID, &acl, &key.VersionHash, &versions, &key.DBVersion)
+	var acl, versions, metadata []byte
+	err := db.getStmt.QueryRow(id).Scan(&key.ID, &acl, &key.VersionHash, &versions, &key.DBVersion, &metadata)
 	if err != nil {
 		return nil, knox.ErrKeyIDNotFound
 	}
+	err = unmarshalMetadata(metadata, &key.Metadata)
+	if err != nil {
+		return nil, err
+	}
 	err = json.Unmarshal(acl, &key.ACL)
 	if err != nil {
 		return nil, err
@@ -279,8 +534,12 @@ func (db *SQLDB) GetAll() ([]DBKey, error) {
 	}
 	for rows.Next() {
 		var key DBKey
-		var acl, versions []byte
-		err := rows.Scan(&key.ID, &acl, &key.VersionHash, &versions, &key.DBVersion)
+		var acl, versions, metadata []byte
+		err := rows.Scan(&key.ID, &acl, &key.VersionHash, &versions, &key.DBVersion, &metadata)
+		if err != nil {
+			return nil, err
+		}
+		err = unmarshalMetadata(metadata, &key.Metadata)
 		if err != nil {
 			return nil, err
 		}
@@ -301,9 +560,52 @@ func (db *SQLDB) GetAll() ([]DBKey, error) {
 	return keys, nil
 }
 
+// GetAllMetadata returns the metadata of all keys without reading key versions.
+func (db *SQLDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	var md []DBKeyMetadata
+	rows, err := db.getMetadataStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m DBKeyMetadata
+		var acl, metadata []byte
+		err := rows.Scan(&m.ID, &acl, &m.VersionHash, &m.DBVersion, &metadata)
+		if err != nil {
+			return nil, err
+		}
+		err = unmarshalMetadata(metadata, &m.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(acl, &m.ACL)
+		if err != nil {
+			return nil, err
+		}
+		md = append(md, m)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
 // Update makes an update to DBKey indexed by its ID.
 // It will fail if the key has been changed since the specified version.
 func (db *SQLDB) Update(key *DBKey) error {
+	return db.update(key, nil)
+}
+
+// UpdateIfHash updates the key if it has the version hash expected, which the
+// update statement compares along with the DB version.
+func (db *SQLDB) UpdateIfHash(key *DBKey, expected string) error {
+	return db.update(key, &expected)
+}
+
+// update updates a key, if expected is set only if it has that version hash.
+func (db *SQLDB) update(key *DBKey, expected *string) error {
 	versions, err := json.Marshal(key.VersionList)
 	if err != nil {
 		return err
@@ -312,66 +614,120 @@ func (db *SQLDB) Update(key *DBKey) error {
 	if err != nil {
 		return err
 	}
-	updateTime := time.Now().UnixNano()
-	r, err := db.UpdateStmt.Exec(versions, key.VersionHash, updateTime, acl, key.ID, key.DBVersion)
-	if err != nil {
-		return err
-	}
-	affected, err := r.RowsAffected()
+	metadata, err := marshalMetadata(key.Metadata)
 	if err != nil {
-		// This likely shouldn't return an error if rows affected is not implemented.
 		return err
 	}
-	if affected == 0 {
-		rs, err := db.getStmt.Query(key.ID)
-		defer rs.Close()
-		if err != nil {
-			return err
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		updateTime := time.Now().UnixNano()
+		if tx != nil && db.lockStmt != nil {
+			var current int64
+			err := tx.Stmt(db.lockStmt).QueryRow(key.ID).Scan(&current)
+			if err == sql.ErrNoRows {
+				return nil, knox.ErrKeyIDNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+			if current != key.DBVersion && expected == nil {
+				return nil, ErrDBVersion
+			}
+			if current != key.DBVersion {
+				return nil, db.conflict(tx, key.ID, expected)
+			}
+			// Servers' clocks differ, so the new version is kept above the
+			// current one for stale updates to keep failing.
+			if updateTime <= current {
+				updateTime = current + 1
+			}
 		}
-		if !rs.Next() {
-			return knox.ErrKeyIDNotFound
+		stmt := db.UpdateStmt
+		args := []interface{}{versions, key.VersionHash, updateTime, acl, metadata, key.ID, key.DBVersion}
+		if expected != nil {
+			stmt = db.updateIfHashStmt
+			args = append(args, *expected)
 		}
-		return ErrDBVersion
-	}
-	return nil
-}
-
-// Add adds the key version (it will fail if the key id exists).
-func (db *SQLDB) Add(keys ...*DBKey) error {
-	// For loop is the dumbest way to this; should refactor into one query/transaction.
-	for _, key := range keys {
-		versions, err := json.Marshal(key.VersionList)
+		r, err := txStmt(tx, stmt).Exec(args...)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		acl, err := json.Marshal(key.ACL)
+		affected, err := r.RowsAffected()
 		if err != nil {
-			return err
+			// This likely shouldn't return an error if rows affected is not implemented.
+			return nil, err
 		}
-		updateTime := time.Now().UnixNano()
-		_, err = db.AddStmt.Exec(key.ID, acl, versions, key.VersionHash, updateTime)
-		if err != nil {
-			// Not sure how to properly differentiate here...
-			return knox.ErrKeyExists
+		if affected == 0 {
+			return nil, db.conflict(tx, key.ID, expected)
 		}
-		// Not checking rows affected because I assume the db will return an error on primary key collision.
-	}
-	return nil
+		return []Event{newEvent(EventUpdate, key.ID, key.VersionHash, updateTime)}, nil
+	})
 }
 
-// Remove permanently removes the key specified by the ID.
-func (db *SQLDB) Remove(id string) error {
-	r, err := db.RemoveStmt.Exec(id)
-	if err != nil {
-		return err
+// conflict returns why an update of a key changed concurrently failed:
+// ErrKeyIDNotFound if it was removed, a *ConflictError for updates expecting a
+// version hash, and ErrDBVersion otherwise.
+func (db *SQLDB) conflict(tx *sql.Tx, id string, expected *string) error {
+	var actual string
+	var version int64
+	err := txStmt(tx, db.getStmt).QueryRow(id).Scan(new(string), new([]byte), &actual, new([]byte), &version, new([]byte))
+	if err == sql.ErrNoRows {
+		return knox.ErrKeyIDNotFound
 	}
-	affected, err := r.RowsAffected()
 	if err != nil {
-		// This likely shouldn't return an error if rows affected is not implemented.
 		return err
 	}
-	if affected == 0 {
-		return knox.ErrKeyIDNotFound
+	if expected == nil {
+		return ErrDBVersion
 	}
-	return nil
+	return &ConflictError{ID: id, Expected: *expected, Actual: actual}
+}
+
+// Add adds the key version (it will fail if the key id exists).
+func (db *SQLDB) Add(keys ...*DBKey) error {
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		var events []Event
+		// For loop is the dumbest way to this; should refactor into one query/transaction.
+		for _, key := range keys {
+			versions, err := json.Marshal(key.VersionList)
+			if err != nil {
+				return nil, err
+			}
+			acl, err := json.Marshal(key.ACL)
+			if err != nil {
+				return nil, err
+			}
+			metadata, err := marshalMetadata(key.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			updateTime := time.Now().UnixNano()
+			_, err = txStmt(tx, db.AddStmt).Exec(key.ID, acl, versions, key.VersionHash, updateTime, metadata)
+			if err != nil {
+				// Not sure how to properly differentiate here...
+				return nil, knox.ErrKeyExists
+			}
+			// Not checking rows affected because I assume the db will return an error on primary key collision.
+			events = append(events, newEvent(EventAdd, key.ID, key.VersionHash, updateTime))
+		}
+		return events, nil
+	})
+}
+
+// Remove permanently removes the key specified by the ID.
+func (db *SQLDB) Remove(id string) error {
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		r, err := txStmt(tx, db.RemoveStmt).Exec(id)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := r.RowsAffected()
+		if err != nil {
+			// This likely shouldn't return an error if rows affected is not implemented.
+			return nil, err
+		}
+		if affected == 0 {
+			return nil, knox.ErrKeyIDNotFound
+		}
+		return []Event{newEvent(EventRemove, id, "", 0)}, nil
+	})
 }
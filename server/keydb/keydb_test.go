@@ -1,6 +1,7 @@
 package keydb
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -290,3 +291,123 @@ func TesterAddRemove(t *testing.T, db DB, timeout time.Duration) {
 		}
 	}
 }
+
+// getAllOnlyDB hides the MetadataDB implementation of the wrapped DB.
+type getAllOnlyDB struct {
+	DB
+}
+
+func TestGetAllMetadata(t *testing.T) {
+	temp := NewTempDB()
+	k := newDBKey("TestGetAllMetadata", []byte("a"), 0)
+	k.VersionHash = "hash"
+	if err := temp.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []DB{temp, getAllOnlyDB{temp}} {
+		md, err := GetAllMetadata(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(md) != 1 {
+			t.Fatalf("Expected 1 key, got %d", len(md))
+		}
+		if md[0].ID != k.ID || md[0].VersionHash != "hash" || md[0].DBVersion == 0 {
+			t.Fatalf("Unexpected metadata %+v", md[0])
+		}
+	}
+}
+
+func TestUpdateIfHash(t *testing.T) {
+	TesterUpdateIfHash(t, NewTempDB())
+	TesterUpdateIfHashRace(t, NewTempDB())
+}
+
+// TesterUpdateIfHash tests the version hash comparison of UpdateIfHash.
+func TesterUpdateIfHash(t *testing.T, db DB) {
+	k := newDBKey("TestUpdateIfHash", []byte("a"), 0)
+	k.VersionHash = "h1"
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	read, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conflict *ConflictError
+	changed := read.Copy()
+	changed.VersionHash = "h2"
+	err = UpdateIfHash(db, changed, "other")
+	if !errors.As(err, &conflict) || conflict.Expected != "other" || conflict.Actual != "h1" {
+		t.Fatalf("Expected a conflict with the stored hash, got %v", err)
+	}
+	if !errors.Is(err, ErrDBVersion) {
+		t.Fatalf("Expected the conflict to match ErrDBVersion")
+	}
+
+	// A concurrent change that keeps the hash still conflicts.
+	acl := read.Copy()
+	acl.ACL = acl.ACL.Add(knox.Access{Type: knox.User, ID: "u", AccessType: knox.Read})
+	if err := db.Update(acl); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateIfHash(db, changed, "h1"); !errors.As(err, &conflict) {
+		t.Fatalf("Expected a conflict after a concurrent change, got %v", err)
+	}
+
+	current, err := db.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed = current.Copy()
+	changed.VersionHash = "h2"
+	if err := UpdateIfHash(db, changed, "h1"); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ = db.Get(k.ID); current.VersionHash != "h2" || len(current.ACL) != 1 {
+		t.Fatalf("Unexpected key after the update: %+v", current)
+	}
+}
+
+// TesterUpdateIfHashRace has writers race to update a key from the same
+// version hash; only one of them may succeed.
+func TesterUpdateIfHashRace(t *testing.T, db DB) {
+	k := newDBKey("TestUpdateIfHashRace", []byte("a"), 0)
+	k.VersionHash = "h0"
+	if err := db.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	const writers = 8
+	for round := 0; round < 20; round++ {
+		read, err := db.Get(k.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := read.VersionHash
+		start := make(chan struct{})
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			changed := read.Copy()
+			changed.VersionHash = fmt.Sprintf("h%d-%d", round, i)
+			go func() {
+				<-start
+				errs <- UpdateIfHash(db, changed, expected)
+			}()
+		}
+		close(start)
+		won := 0
+		for i := 0; i < writers; i++ {
+			var conflict *ConflictError
+			switch err := <-errs; {
+			case err == nil:
+				won++
+			case !errors.As(err, &conflict):
+				t.Fatalf("Expected a conflict, got %v", err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("Expected one writer to update the key, %d did", won)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package keydb
+
+import "sort"
+
+// MigrateResult is the outcome of a Migrate pass.
+type MigrateResult struct {
+	Copied    int
+	Updated   int
+	Unchanged int
+	Removed   int
+	// Failed are the keys that could not be written to the destination.
+	Failed []string
+	// Mismatched are the keys that differ between the DBs after the pass,
+	// e.g. because they were changed during it.
+	Mismatched []string
+}
+
+// Migrate copies every key of src to dst as it is stored, with its encrypted
+// versions, ACL and metadata, so both DBs must be used with the same Cryptor.
+// Keys that already are in dst are updated if they differ and, with prune,
+// keys that are only in dst are removed. The copy is verified by comparing
+// both DBs afterwards.
+//
+// Servers can keep using src during a migration: passes are repeated until
+// none reports mismatches, the servers are switched to dst and a final pass
+// copies the changes made in between.
+func Migrate(src, dst DB, prune bool) (*MigrateResult, error) {
+	s, err := TakeSnapshot(src)
+	if err != nil {
+		return nil, err
+	}
+	restored := RestoreSnapshot(dst, s)
+	result := &MigrateResult{
+		Copied:    restored.Added,
+		Updated:   restored.Replaced,
+		Unchanged: restored.Unchanged,
+		Failed:    restored.Failed,
+	}
+	if prune {
+		inSrc := make(map[string]bool, len(s.Keys))
+		for _, k := range s.Keys {
+			inSrc[k.ID] = true
+		}
+		dstKeys, err := dst.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range dstKeys {
+			if inSrc[k.ID] {
+				continue
+			}
+			if err := dst.Remove(k.ID); err != nil {
+				result.Failed = append(result.Failed, k.ID)
+				continue
+			}
+			result.Removed++
+		}
+	}
+	if result.Mismatched, err = Compare(src, dst, prune); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Compare returns the IDs of the keys of src that are missing in dst or
+// differ from it, sorted. With extra, keys that are only in dst are
+// returned as well.
+func Compare(src, dst DB, extra bool) ([]string, error) {
+	srcKeys, err := src.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	dstKeys, err := dst.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	inDst := make(map[string]*DBKey, len(dstKeys))
+	for i := range dstKeys {
+		inDst[dstKeys[i].ID] = &dstKeys[i]
+	}
+	var ids []string
+	for i := range srcKeys {
+		k, ok := inDst[srcKeys[i].ID]
+		if !ok || !sameKey(&srcKeys[i], k) {
+			ids = append(ids, srcKeys[i].ID)
+		}
+		delete(inDst, srcKeys[i].ID)
+	}
+	if extra {
+		for id := range inDst {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,47 @@
+package keydb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	src := NewTempDB()
+	dst, err := NewFileDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newDBKey("a", []byte("a"), 0)
+	b := newDBKey("b", []byte("b"), 0)
+	stale := newDBKey("a", []byte("old"), 0)
+	extra := newDBKey("extra", []byte("x"), 0)
+	if err := src.Add(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Add(&stale, &extra); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Migrate(src, dst, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 1 || result.Updated != 1 || result.Removed != 0 || len(result.Mismatched) != 0 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if ids, _ := Compare(src, dst, true); !reflect.DeepEqual(ids, []string{"extra"}) {
+		t.Fatalf("Expected only the extra key to differ, got %v", ids)
+	}
+
+	result, err = Migrate(src, dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Unchanged != 2 || result.Removed != 1 || len(result.Mismatched) != 0 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	k, err := dst.Get("a")
+	if err != nil || string(k.VersionList[0].EncData) != "a" {
+		t.Fatalf("Expected the key to be copied as stored, got %+v, %v", k, err)
+	}
+}
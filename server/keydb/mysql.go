@@ -0,0 +1,37 @@
+package keydb
+
+import (
+	"database/sql"
+)
+
+// sqlCreateMySQLKeys creates the secrets table on InnoDB, which the row locks
+// of a MySQL DB need. The columns are those of NewSQLDB.
+var sqlCreateMySQLKeys = `CREATE TABLE IF NOT EXISTS secrets (
+	id VARCHAR(512) PRIMARY KEY,
+	acl TEXT NOT NULL,
+	version_hash TEXT NOT NULL,
+	versions TEXT NOT NULL,
+	last_updated BIGINT NOT NULL,
+	metadata TEXT
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
+
+// NewMySQLDB creates a DB on sqlDB, opened with any MySQL driver, for several
+// knox servers sharing one database. Updates lock the row of the key with
+// SELECT ... FOR UPDATE and check its DB version in the same transaction, so
+// concurrent updates from different servers are serialized instead of one
+// overwriting the version list written by the other.
+func NewMySQLDB(sqlDB *sql.DB) (*SQLDB, error) {
+	if _, err := sqlDB.Exec(sqlCreateMySQLKeys); err != nil {
+		return nil, err
+	}
+	db, err := NewSQLDB(sqlDB)
+	if err != nil {
+		return nil, err
+	}
+	s := db.(*SQLDB)
+	s.lockStmt, err = sqlDB.Prepare("SELECT last_updated FROM secrets WHERE id=? FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,60 @@
+package keydb
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMySQLDB(t *testing.T) {
+	d := &outboxRecorder{}
+	sql.Register("keydb_mysql_test", d)
+	sqlDB, err := sql.Open("keydb_mysql_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewMySQLDB(sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(d.log[0], "ENGINE=InnoDB") {
+		t.Fatalf("Expected an InnoDB table, got %s", d.log[0])
+	}
+
+	// A version ahead of the clock of this server.
+	d.lastUpdated = time.Now().Add(time.Hour).UnixNano()
+	d.log = nil
+	k := newDBKey("a", []byte("1"), d.lastUpdated)
+	if err := db.Update(&k); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"BEGIN",
+		"SELECT last_updated FROM secrets WHERE id=? FOR UPDATE",
+		"UPDATE secrets SET versions=?, version_hash=?,last_updated=?,acl=?,metadata=? WHERE id=? AND last_updated=?",
+		"COMMIT",
+	}
+	if strings.Join(d.log, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected the update under a row lock, got %v", d.log)
+	}
+
+	d.log = nil
+	k.DBVersion--
+	if err := db.Update(&k); err != ErrDBVersion {
+		t.Fatalf("Expected a stale update to fail, got %v", err)
+	}
+	if d.log[len(d.log)-1] != "ROLLBACK" {
+		t.Fatalf("Expected the transaction to be rolled back, got %v", d.log)
+	}
+
+	// The version hash is compared by the update statement.
+	d.log = nil
+	k.DBVersion = d.lastUpdated
+	if err := db.UpdateIfHash(&k, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.log) != 4 || d.log[2] != "UPDATE secrets SET versions=?, version_hash=?,last_updated=?,acl=?,metadata=? WHERE id=? AND last_updated=? AND version_hash=?" {
+		t.Fatalf("Expected a conditional update, got %v", d.log)
+	}
+}
@@ -0,0 +1,393 @@
+package keydb
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types.
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventRemove = "remove"
+)
+
+// Event records a mutation of a key. Events don't carry key data; consumers
+// read the key to act on it.
+type Event struct {
+	// Seq orders events. It increases with every event, with no gaps between
+	// committed events.
+	Seq         uint64 `json:"seq"`
+	Type        string `json:"type"`
+	KeyID       string `json:"key_id"`
+	VersionHash string `json:"version_hash,omitempty"`
+	// DBVersion is the DB version of the key after an add or update.
+	DBVersion int64 `json:"db_version,omitempty"`
+	Time      int64 `json:"time"`
+}
+
+func newEvent(typ, keyID, versionHash string, dbVersion int64) Event {
+	return Event{
+		Type:        typ,
+		KeyID:       keyID,
+		VersionHash: versionHash,
+		DBVersion:   dbVersion,
+		Time:        time.Now().UnixNano(),
+	}
+}
+
+// Outbox is implemented by DBs that record an Event atomically with every
+// mutation, so events reach other systems even if the server crashes right
+// after the change. Consumers read events in order and commit their
+// position, and receive the events after their cursor again after a crash.
+type Outbox interface {
+	// Events returns up to limit events after the sequence number after.
+	Events(after uint64, limit int) ([]Event, error)
+	// Cursor returns the sequence number of the last event a consumer
+	// committed, zero for new consumers.
+	Cursor(consumer string) (uint64, error)
+	// Commit records that a consumer processed the events through seq.
+	Commit(consumer string, seq uint64) error
+	// Trim deletes the events through seq, e.g. once every consumer
+	// processed them. Implementations may keep the newest event so sequence
+	// numbers are never reused.
+	Trim(seq uint64) error
+}
+
+// TempOutboxDB is a TempDB with an in memory Outbox.
+type TempOutboxDB struct {
+	*TempDB
+
+	seq     uint64
+	events  []Event
+	cursors map[string]uint64
+}
+
+// NewTempOutboxDB creates an empty TempOutboxDB.
+func NewTempOutboxDB() *TempOutboxDB {
+	return &TempOutboxDB{TempDB: &TempDB{}, cursors: map[string]uint64{}}
+}
+
+// record appends events. The caller holds the lock.
+func (db *TempOutboxDB) record(events ...Event) {
+	for _, e := range events {
+		db.seq++
+		e.Seq = db.seq
+		db.events = append(db.events, e)
+	}
+}
+
+// Update updates the key and records an update event.
+func (db *TempOutboxDB) Update(key *DBKey) error {
+	db.Lock()
+	defer db.Unlock()
+	k, err := db.update(key)
+	if err != nil {
+		return err
+	}
+	db.record(newEvent(EventUpdate, k.ID, k.VersionHash, k.DBVersion))
+	return nil
+}
+
+// UpdateIfHash updates the key if it has the version hash expected and
+// records an update event.
+func (db *TempOutboxDB) UpdateIfHash(key *DBKey, expected string) error {
+	db.Lock()
+	defer db.Unlock()
+	k, err := db.updateIfHash(key, expected)
+	if err != nil {
+		return err
+	}
+	db.record(newEvent(EventUpdate, k.ID, k.VersionHash, k.DBVersion))
+	return nil
+}
+
+// Add adds the keys and records an add event for each.
+func (db *TempOutboxDB) Add(keys ...*DBKey) error {
+	db.Lock()
+	defer db.Unlock()
+	added, err := db.add(keys)
+	if err != nil {
+		return err
+	}
+	for _, k := range added {
+		db.record(newEvent(EventAdd, k.ID, k.VersionHash, k.DBVersion))
+	}
+	return nil
+}
+
+// Remove removes the key and records a remove event.
+func (db *TempOutboxDB) Remove(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.remove(id); err != nil {
+		return err
+	}
+	db.record(newEvent(EventRemove, id, "", 0))
+	return nil
+}
+
+// Events returns up to limit events after the sequence number after.
+func (db *TempOutboxDB) Events(after uint64, limit int) ([]Event, error) {
+	db.RLock()
+	defer db.RUnlock()
+	var events []Event
+	for _, e := range db.events {
+		if len(events) == limit {
+			break
+		}
+		if e.Seq > after {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// Cursor returns the sequence number a consumer committed.
+func (db *TempOutboxDB) Cursor(consumer string) (uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.cursors[consumer], nil
+}
+
+// Commit records the sequence number a consumer processed.
+func (db *TempOutboxDB) Commit(consumer string, seq uint64) error {
+	db.Lock()
+	defer db.Unlock()
+	db.cursors[consumer] = seq
+	return nil
+}
+
+// Trim deletes the events through seq.
+func (db *TempOutboxDB) Trim(seq uint64) error {
+	db.Lock()
+	defer db.Unlock()
+	i := 0
+	for i < len(db.events) && db.events[i].Seq <= seq {
+		i++
+	}
+	db.events = append([]Event(nil), db.events[i:]...)
+	return nil
+}
+
+var sqlCreateOutbox = []string{
+	`CREATE TABLE IF NOT EXISTS knox_outbox (
+	seq BIGINT PRIMARY KEY,
+	event_type VARCHAR(16) NOT NULL,
+	key_id VARCHAR(512) NOT NULL,
+	version_hash TEXT NOT NULL,
+	db_version BIGINT NOT NULL,
+	created BIGINT NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS knox_outbox_cursors (
+	consumer VARCHAR(512) PRIMARY KEY,
+	seq BIGINT NOT NULL
+);`,
+}
+
+// sqlOutboxAttempts is the number of times a mutation is tried when its
+// events conflict with those of a concurrent mutation.
+const sqlOutboxAttempts = 3
+
+type sqlOutbox struct {
+	maxSeqStmt   *sql.Stmt
+	insertStmt   *sql.Stmt
+	eventsStmt   *sql.Stmt
+	cursorStmt   *sql.Stmt
+	updateCursor *sql.Stmt
+	insertCursor *sql.Stmt
+	trimStmt     *sql.Stmt
+}
+
+// rebind rewrites ? placeholders to $1, $2... for postgres.
+func (db *SQLDB) rebind(query string) string {
+	if !db.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// EnableOutbox creates the outbox tables and makes every later mutation
+// record its events in the same transaction. Sequence numbers are assigned
+// in the transaction, so concurrent mutations are serialized on the outbox
+// and retried when they conflict.
+func (db *SQLDB) EnableOutbox() error {
+	for _, q := range sqlCreateOutbox {
+		if _, err := db.sqlDB.Exec(q); err != nil {
+			return err
+		}
+	}
+	o := &sqlOutbox{}
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&o.maxSeqStmt, "SELECT COALESCE(MAX(seq), 0) FROM knox_outbox"},
+		{&o.insertStmt, "INSERT INTO knox_outbox (seq, event_type, key_id, version_hash, db_version, created) VALUES (?,?,?,?,?,?)"},
+		{&o.eventsStmt, "SELECT seq, event_type, key_id, version_hash, db_version, created FROM knox_outbox WHERE seq > ? ORDER BY seq LIMIT ?"},
+		{&o.cursorStmt, "SELECT seq FROM knox_outbox_cursors WHERE consumer=?"},
+		{&o.updateCursor, "UPDATE knox_outbox_cursors SET seq=? WHERE consumer=?"},
+		{&o.insertCursor, "INSERT INTO knox_outbox_cursors (consumer, seq) VALUES (?,?)"},
+		{&o.trimStmt, "DELETE FROM knox_outbox WHERE seq <= ?"},
+	}
+	for _, s := range stmts {
+		stmt, err := db.sqlDB.Prepare(db.rebind(s.query))
+		if err != nil {
+			return err
+		}
+		*s.stmt = stmt
+	}
+	db.outbox = o
+	return nil
+}
+
+func txStmt(tx *sql.Tx, s *sql.Stmt) *sql.Stmt {
+	if tx == nil {
+		return s
+	}
+	return tx.Stmt(s)
+}
+
+// mutate runs f, which changes keys and returns the events for the changes.
+// With the outbox enabled f runs in a transaction that also records the
+// events. DBs that lock rows run f in a transaction as well.
+func (db *SQLDB) mutate(f func(tx *sql.Tx) ([]Event, error)) error {
+	if db.outbox == nil && db.lockStmt == nil {
+		_, err := f(nil)
+		return err
+	}
+	var err error
+	for i := 0; i < sqlOutboxAttempts; i++ {
+		var retry bool
+		if retry, err = db.mutateTx(f); !retry {
+			return err
+		}
+	}
+	return fmt.Errorf("keydb: failed to record outbox events: %s", err.Error())
+}
+
+// mutateTx runs f and records its events in one transaction. It reports
+// whether recording the events failed, which is retried.
+func (db *SQLDB) mutateTx(f func(tx *sql.Tx) ([]Event, error)) (bool, error) {
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return false, err
+	}
+	events, err := f(tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if db.outbox == nil {
+		return false, tx.Commit()
+	}
+	for _, e := range events {
+		var seq uint64
+		if err := tx.Stmt(db.outbox.maxSeqStmt).QueryRow().Scan(&seq); err != nil {
+			tx.Rollback()
+			return true, err
+		}
+		// A concurrent transaction taking the same sequence number fails on
+		// the primary key once the other commits.
+		_, err := tx.Stmt(db.outbox.insertStmt).Exec(seq+1, e.Type, e.KeyID, e.VersionHash, e.DBVersion, e.Time)
+		if err != nil {
+			tx.Rollback()
+			return true, err
+		}
+	}
+	return false, tx.Commit()
+}
+
+func (db *SQLDB) requireOutbox() error {
+	if db.outbox == nil {
+		return fmt.Errorf("keydb: the outbox is not enabled")
+	}
+	return nil
+}
+
+// Events returns up to limit events after the sequence number after.
+func (db *SQLDB) Events(after uint64, limit int) ([]Event, error) {
+	if err := db.requireOutbox(); err != nil {
+		return nil, err
+	}
+	rows, err := db.outbox.eventsStmt.Query(after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Seq, &e.Type, &e.KeyID, &e.VersionHash, &e.DBVersion, &e.Time); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Cursor returns the sequence number a consumer committed.
+func (db *SQLDB) Cursor(consumer string) (uint64, error) {
+	if err := db.requireOutbox(); err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err := db.outbox.cursorStmt.QueryRow(consumer).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Commit records the sequence number a consumer processed.
+func (db *SQLDB) Commit(consumer string, seq uint64) error {
+	if err := db.requireOutbox(); err != nil {
+		return err
+	}
+	// Some databases don't count rows updated to the values they had, so the
+	// cursor is looked up rather than upserted by the rows affected.
+	var current uint64
+	err := db.outbox.cursorStmt.QueryRow(consumer).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = db.outbox.insertCursor.Exec(consumer, seq)
+	case err == nil:
+		_, err = db.outbox.updateCursor.Exec(seq, consumer)
+	}
+	return err
+}
+
+// Trim deletes the events through seq, keeping the newest event.
+func (db *SQLDB) Trim(seq uint64) error {
+	if err := db.requireOutbox(); err != nil {
+		return err
+	}
+	var max uint64
+	if err := db.outbox.maxSeqStmt.QueryRow().Scan(&max); err != nil {
+		return err
+	}
+	if max == 0 {
+		return nil
+	}
+	if seq >= max {
+		seq = max - 1
+	}
+	if seq == 0 {
+		return nil
+	}
+	_, err := db.outbox.trimStmt.Exec(seq)
+	return err
+}
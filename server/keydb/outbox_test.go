@@ -0,0 +1,194 @@
+package keydb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestTempOutboxDB(t *testing.T) {
+	db := NewTempOutboxDB()
+	a, b := newDBKey("a", []byte("1"), 0), newDBKey("b", []byte("2"), 0)
+	if err := db.Add(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.VersionHash = "changed"
+	if err := db.Update(stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(stored); err != ErrDBVersion {
+		t.Fatalf("Expected a stale update to fail, got %v", err)
+	}
+	if err := db.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("b"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected removing a missing key to fail, got %v", err)
+	}
+
+	events, err := db.Events(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i, e := range events {
+		if e.Seq != uint64(i+1) {
+			t.Fatalf("Expected sequence number %d, got %d", i+1, e.Seq)
+		}
+		got = append(got, e.Type+":"+e.KeyID)
+	}
+	if strings.Join(got, ",") != "add:a,add:b,update:a,remove:b" {
+		t.Fatalf("Expected an event for each mutation, got %v", got)
+	}
+	if events[2].VersionHash != "changed" {
+		t.Fatalf("Expected the version hash of the update, got %+v", events[2])
+	}
+
+	if events, _ := db.Events(2, 1); len(events) != 1 || events[0].Seq != 3 {
+		t.Fatalf("Expected one event after 2, got %v", events)
+	}
+	if c, _ := db.Cursor("replicator"); c != 0 {
+		t.Fatalf("Expected a new consumer at 0, got %d", c)
+	}
+	db.Commit("replicator", 3)
+	if c, _ := db.Cursor("replicator"); c != 3 {
+		t.Fatalf("Expected the committed cursor, got %d", c)
+	}
+	db.Trim(3)
+	if events, _ := db.Events(0, 10); len(events) != 1 || events[0].Seq != 4 {
+		t.Fatalf("Expected only event 4 after trimming, got %v", events)
+	}
+}
+
+// outboxRecorder is a database/sql driver that records statements and
+// transactions, for checking the statements of the SQL outbox.
+type outboxRecorder struct {
+	log []string
+	// maxSeq is returned for the largest sequence number.
+	maxSeq int64
+	// failInserts fails this many inserts of events.
+	failInserts int
+	// lastUpdated is returned for the DB version of locked rows.
+	lastUpdated int64
+}
+
+func (d *outboxRecorder) Open(string) (driver.Conn, error) { return &outboxRecorderConn{d}, nil }
+
+type outboxRecorderConn struct{ d *outboxRecorder }
+
+func (c *outboxRecorderConn) Prepare(query string) (driver.Stmt, error) {
+	return &outboxRecorderStmt{c.d, query}, nil
+}
+func (c *outboxRecorderConn) Close() error { return nil }
+func (c *outboxRecorderConn) Begin() (driver.Tx, error) {
+	c.d.log = append(c.d.log, "BEGIN")
+	return c, nil
+}
+func (c *outboxRecorderConn) Commit() error {
+	c.d.log = append(c.d.log, "COMMIT")
+	return nil
+}
+func (c *outboxRecorderConn) Rollback() error {
+	c.d.log = append(c.d.log, "ROLLBACK")
+	return nil
+}
+
+type outboxRecorderStmt struct {
+	d     *outboxRecorder
+	query string
+}
+
+func (s *outboxRecorderStmt) Close() error  { return nil }
+func (s *outboxRecorderStmt) NumInput() int { return -1 }
+func (s *outboxRecorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.log = append(s.d.log, s.query)
+	if strings.HasPrefix(s.query, "INSERT INTO knox_outbox ") && s.d.failInserts > 0 {
+		s.d.failInserts--
+		return nil, fmt.Errorf("duplicate key")
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *outboxRecorderStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.d.log = append(s.d.log, s.query)
+	if strings.HasPrefix(s.query, "SELECT COALESCE(MAX(seq)") {
+		return &seqRows{seq: s.d.maxSeq}, nil
+	}
+	if strings.HasSuffix(s.query, "FOR UPDATE") {
+		return &seqRows{seq: s.d.lastUpdated}, nil
+	}
+	return emptyRows{}, nil
+}
+
+type seqRows struct {
+	seq  int64
+	done bool
+}
+
+func (r *seqRows) Columns() []string { return []string{"seq"} }
+func (r *seqRows) Close() error      { return nil }
+func (r *seqRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.seq
+	return nil
+}
+
+func TestSQLOutbox(t *testing.T) {
+	d := &outboxRecorder{maxSeq: 41}
+	sql.Register("keydb_outbox_test", d)
+	sqlDB, err := sql.Open("keydb_outbox_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewPostgreSQLDB(sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdb := db.(*SQLDB)
+	if _, err := sdb.Events(0, 10); err == nil {
+		t.Fatal("Expected an error before the outbox is enabled")
+	}
+	if err := sdb.EnableOutbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.log = nil
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"BEGIN",
+		"DELETE FROM secrets WHERE id=$1",
+		"SELECT COALESCE(MAX(seq), 0) FROM knox_outbox",
+		"INSERT INTO knox_outbox (seq, event_type, key_id, version_hash, db_version, created) VALUES ($1,$2,$3,$4,$5,$6)",
+		"COMMIT",
+	}
+	if strings.Join(d.log, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected the removal and its event in one transaction, got %v", d.log)
+	}
+
+	d.log = nil
+	d.failInserts = 1
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if d.log[4] != "ROLLBACK" || d.log[len(d.log)-1] != "COMMIT" {
+		t.Fatalf("Expected a conflicting event to be retried, got %v", d.log)
+	}
+
+	d.failInserts = sqlOutboxAttempts
+	if err := db.Remove("a"); err == nil {
+		t.Fatal("Expected an error once the attempts are used up")
+	}
+}
@@ -0,0 +1,346 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/pinterest/knox"
+)
+
+// RedisClient is the subset of a Redis client RedisDB needs, so deployments
+// can use the Redis library of their choice. It must be safe for concurrent
+// use.
+type RedisClient interface {
+	// Do runs a command. Replies are nil, int64, a string or []byte for bulk
+	// strings, or []interface{} of those for arrays. A nil reply must be
+	// returned as (nil, nil) rather than as an error.
+	Do(ctx context.Context, args ...interface{}) (interface{}, error)
+	// Subscribe calls f with the payload of every message published on
+	// channel until ctx is done or the subscription fails.
+	Subscribe(ctx context.Context, channel string, f func(payload string)) error
+}
+
+// RedisDB stores keys in Redis, one hash per key holding the JSON encoded
+// ACL, encrypted versions and metadata, plus a set of all key IDs. Writes are
+// made atomic with Lua scripts and published on a channel so other knox
+// servers can invalidate their caches with Listen.
+//
+// It is meant for small deployments that want low latency; Redis persistence
+// and replication must be configured so keys are not lost.
+type RedisDB struct {
+	client  RedisClient
+	prefix  string
+	channel string
+}
+
+// NewRedisDB creates a DB storing keys under prefix, "knox:" if empty.
+func NewRedisDB(client RedisClient, prefix string) *RedisDB {
+	if prefix == "" {
+		prefix = "knox:"
+	}
+	return &RedisDB{
+		client:  client,
+		prefix:  prefix,
+		channel: prefix + "invalidate",
+	}
+}
+
+func (db *RedisDB) hashKey(id string) string {
+	return db.prefix + "key:" + id
+}
+
+func (db *RedisDB) idsKey() string {
+	return db.prefix + "ids"
+}
+
+// redisUpdateScript replaces a key if its version is ARGV[1]. It returns -1
+// if the key does not exist and 0 on a version mismatch.
+const redisUpdateScript = `
+local v = redis.call('HGET', KEYS[1], 'version')
+if not v then return -1 end
+if v ~= ARGV[1] then return 0 end
+redis.call('HSET', KEYS[1], 'acl', ARGV[2], 'versions', ARGV[3], 'hash', ARGV[4], 'metadata', ARGV[5])
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+return 1`
+
+// redisUpdateIfHashScript is redisUpdateScript that also requires the key's
+// version hash to be ARGV[6].
+const redisUpdateIfHashScript = `
+local v, h = unpack(redis.call('HMGET', KEYS[1], 'version', 'hash'))
+if not v then return -1 end
+if v ~= ARGV[1] or h ~= ARGV[6] then return 0 end
+redis.call('HSET', KEYS[1], 'acl', ARGV[2], 'versions', ARGV[3], 'hash', ARGV[4], 'metadata', ARGV[5])
+redis.call('HINCRBY', KEYS[1], 'version', 1)
+return 1`
+
+// redisAddScript adds a key unless it exists, in which case it returns 0.
+const redisAddScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then return 0 end
+redis.call('HSET', KEYS[1], 'id', ARGV[1], 'version', '1', 'acl', ARGV[2], 'versions', ARGV[3], 'hash', ARGV[4], 'metadata', ARGV[5])
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1`
+
+// redisRemoveScript removes a key and returns the number of keys removed.
+const redisRemoveScript = `
+local n = redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+return n`
+
+var redisMetadataFields = []interface{}{"id", "acl", "hash", "metadata", "version"}
+
+// Get returns the key with the given ID.
+func (db *RedisDB) Get(id string) (*DBKey, error) {
+	reply, err := db.client.Do(context.Background(), "HGETALL", db.hashKey(id))
+	if err != nil {
+		return nil, err
+	}
+	fields, err := redisHash(reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	return decodeRedisKey(fields)
+}
+
+// GetAll returns all of the keys in the database.
+func (db *RedisDB) GetAll() ([]DBKey, error) {
+	ids, err := db.ids()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]DBKey, 0, len(ids))
+	for _, id := range ids {
+		k, err := db.Get(id)
+		if err == knox.ErrKeyIDNotFound {
+			// Removed since listing the IDs.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, nil
+}
+
+// GetAllMetadata returns the metadata of all keys without reading key versions.
+func (db *RedisDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	ids, err := db.ids()
+	if err != nil {
+		return nil, err
+	}
+	md := make([]DBKeyMetadata, 0, len(ids))
+	for _, id := range ids {
+		args := append([]interface{}{"HMGET", db.hashKey(id)}, redisMetadataFields...)
+		reply, err := db.client.Do(context.Background(), args...)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != len(redisMetadataFields) {
+			return nil, fmt.Errorf("keydb: unexpected redis reply %T", reply)
+		}
+		fields := map[string]string{}
+		for i, v := range values {
+			if s, ok := redisString(v); ok {
+				fields[redisMetadataFields[i].(string)] = s
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		k, err := decodeRedisKey(fields)
+		if err != nil {
+			return nil, err
+		}
+		md = append(md, k.toMetadata())
+	}
+	return md, nil
+}
+
+// Update makes an update to DBKey indexed by its ID.
+// It will fail if the key has been changed since the specified version.
+func (db *RedisDB) Update(key *DBKey) error {
+	return db.update(key, nil)
+}
+
+// UpdateIfHash updates the key if it has the version hash expected, which the
+// update script compares along with the DB version.
+func (db *RedisDB) UpdateIfHash(key *DBKey, expected string) error {
+	return db.update(key, &expected)
+}
+
+// update updates a key, if expected is set only if it has that version hash.
+func (db *RedisDB) update(key *DBKey, expected *string) error {
+	acl, versions, metadata, err := encodeRedisKey(key)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{"EVAL", redisUpdateScript, 1, db.hashKey(key.ID),
+		strconv.FormatInt(key.DBVersion, 10), acl, versions, key.VersionHash, metadata}
+	if expected != nil {
+		args[1] = redisUpdateIfHashScript
+		args = append(args, *expected)
+	}
+	reply, err := db.client.Do(context.Background(), args...)
+	if err != nil {
+		return err
+	}
+	switch reply {
+	case int64(-1):
+		return knox.ErrKeyIDNotFound
+	case int64(0):
+		if expected == nil {
+			return ErrDBVersion
+		}
+		current, err := db.Get(key.ID)
+		if err != nil {
+			return err
+		}
+		return &ConflictError{ID: key.ID, Expected: *expected, Actual: current.VersionHash}
+	}
+	db.publish(key.ID)
+	return nil
+}
+
+// Add adds the key(s) to the DB (it will fail if the key id exists).
+func (db *RedisDB) Add(keys ...*DBKey) error {
+	for _, key := range keys {
+		acl, versions, metadata, err := encodeRedisKey(key)
+		if err != nil {
+			return err
+		}
+		reply, err := db.client.Do(context.Background(), "EVAL", redisAddScript, 2, db.hashKey(key.ID), db.idsKey(),
+			key.ID, acl, versions, key.VersionHash, metadata)
+		if err != nil {
+			return err
+		}
+		if reply == int64(0) {
+			return knox.ErrKeyExists
+		}
+		db.publish(key.ID)
+	}
+	return nil
+}
+
+// Remove permanently removes the key specified by the ID.
+func (db *RedisDB) Remove(id string) error {
+	reply, err := db.client.Do(context.Background(), "EVAL", redisRemoveScript, 2, db.hashKey(id), db.idsKey(), id)
+	if err != nil {
+		return err
+	}
+	if reply == int64(0) {
+		return knox.ErrKeyIDNotFound
+	}
+	db.publish(id)
+	return nil
+}
+
+// Listen calls f with the ID of every key changed through any RedisDB using
+// the same prefix, including this one, until ctx is done or the subscription
+// fails. Servers caching keys in process should run it and drop the key from
+// their cache, e.g. with CachedDB.Invalidate.
+func (db *RedisDB) Listen(ctx context.Context, f func(id string)) error {
+	return db.client.Subscribe(ctx, db.channel, f)
+}
+
+// publish notifies other servers of a change. A failure is not returned since
+// the change itself succeeded; caches expire the key after their TTL.
+func (db *RedisDB) publish(id string) {
+	db.client.Do(context.Background(), "PUBLISH", db.channel, id)
+}
+
+func (db *RedisDB) ids() ([]string, error) {
+	reply, err := db.client.Do(context.Background(), "SMEMBERS", db.idsKey())
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("keydb: unexpected redis reply %T", reply)
+	}
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := redisString(v); ok {
+			ids = append(ids, s)
+		}
+	}
+	return ids, nil
+}
+
+func encodeRedisKey(key *DBKey) (acl, versions, metadata string, err error) {
+	b, err := json.Marshal(key.ACL)
+	if err != nil {
+		return "", "", "", err
+	}
+	acl = string(b)
+	if b, err = json.Marshal(key.VersionList); err != nil {
+		return "", "", "", err
+	}
+	versions = string(b)
+	if b, err = marshalMetadata(key.Metadata); err != nil {
+		return "", "", "", err
+	}
+	return acl, versions, string(b), nil
+}
+
+func decodeRedisKey(fields map[string]string) (*DBKey, error) {
+	key := &DBKey{ID: fields["id"], VersionHash: fields["hash"]}
+	var err error
+	if key.DBVersion, err = strconv.ParseInt(fields["version"], 10, 64); err != nil {
+		return nil, fmt.Errorf("keydb: invalid version of key %s", key.ID)
+	}
+	if err := json.Unmarshal([]byte(fields["acl"]), &key.ACL); err != nil {
+		return nil, err
+	}
+	if v, ok := fields["versions"]; ok {
+		if err := json.Unmarshal([]byte(v), &key.VersionList); err != nil {
+			return nil, err
+		}
+	}
+	if err := unmarshalMetadata([]byte(fields["metadata"]), &key.Metadata); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// redisHash converts an HGETALL reply to a map.
+func redisHash(reply interface{}) (map[string]string, error) {
+	fields := map[string]string{}
+	switch r := reply.(type) {
+	case nil:
+	case []interface{}:
+		if len(r)%2 != 0 {
+			return nil, fmt.Errorf("keydb: unexpected redis reply length %d", len(r))
+		}
+		for i := 0; i < len(r); i += 2 {
+			k, _ := redisString(r[i])
+			v, _ := redisString(r[i+1])
+			fields[k] = v
+		}
+	case map[interface{}]interface{}:
+		// RESP3 clients return maps.
+		for k, v := range r {
+			ks, _ := redisString(k)
+			vs, _ := redisString(v)
+			fields[ks] = vs
+		}
+	default:
+		return nil, fmt.Errorf("keydb: unexpected redis reply %T", reply)
+	}
+	return fields, nil
+}
+
+func redisString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	}
+	return "", false
+}
@@ -0,0 +1,169 @@
+package keydb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements the commands and scripts used by RedisDB in memory.
+type fakeRedis struct {
+	sync.Mutex
+	hashes      map[string]map[string]string
+	sets        map[string]map[string]bool
+	subscribers map[string][]func(string)
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		hashes:      map[string]map[string]string{},
+		sets:        map[string]map[string]bool{},
+		subscribers: map[string][]func(string){},
+	}
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	r.Lock()
+	defer r.Unlock()
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = fmt.Sprint(a)
+	}
+	switch s[0] {
+	case "HGETALL":
+		var reply []interface{}
+		for k, v := range r.hashes[s[1]] {
+			reply = append(reply, k, []byte(v))
+		}
+		return reply, nil
+	case "HMGET":
+		reply := make([]interface{}, len(s)-2)
+		for i, f := range s[2:] {
+			if v, ok := r.hashes[s[1]][f]; ok {
+				reply[i] = v
+			}
+		}
+		return reply, nil
+	case "SMEMBERS":
+		var reply []interface{}
+		for m := range r.sets[s[1]] {
+			reply = append(reply, m)
+		}
+		return reply, nil
+	case "PUBLISH":
+		for _, f := range r.subscribers[s[1]] {
+			f(s[2])
+		}
+		return int64(len(r.subscribers[s[1]])), nil
+	case "EVAL":
+		return r.eval(s[1], s[3:])
+	}
+	return nil, fmt.Errorf("unsupported command %s", s[0])
+}
+
+func (r *fakeRedis) eval(script string, a []string) (interface{}, error) {
+	switch script {
+	case redisUpdateScript, redisUpdateIfHashScript:
+		h, ok := r.hashes[a[0]]
+		if !ok {
+			return int64(-1), nil
+		}
+		if h["version"] != a[1] || (script == redisUpdateIfHashScript && h["hash"] != a[6]) {
+			return int64(0), nil
+		}
+		v, _ := strconv.ParseInt(h["version"], 10, 64)
+		h["acl"], h["versions"], h["hash"], h["metadata"] = a[2], a[3], a[4], a[5]
+		h["version"] = strconv.FormatInt(v+1, 10)
+		return int64(1), nil
+	case redisAddScript:
+		if _, ok := r.hashes[a[0]]; ok {
+			return int64(0), nil
+		}
+		r.hashes[a[0]] = map[string]string{"id": a[2], "version": "1", "acl": a[3], "versions": a[4], "hash": a[5], "metadata": a[6]}
+		if r.sets[a[1]] == nil {
+			r.sets[a[1]] = map[string]bool{}
+		}
+		r.sets[a[1]][a[2]] = true
+		return int64(1), nil
+	case redisRemoveScript:
+		_, ok := r.hashes[a[0]]
+		delete(r.hashes, a[0])
+		delete(r.sets[a[1]], a[2])
+		if ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("unknown script")
+}
+
+func (r *fakeRedis) Subscribe(ctx context.Context, channel string, f func(string)) error {
+	r.Lock()
+	r.subscribers[channel] = append(r.subscribers[channel], f)
+	r.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRedisDB(t *testing.T) {
+	db := NewRedisDB(newFakeRedis(), "")
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+	TesterUpdateIfHash(t, db)
+	TesterUpdateIfHashRace(t, db)
+}
+
+func TestRedisDBInvalidation(t *testing.T) {
+	r := newFakeRedis()
+	writer := NewRedisDB(r, "")
+	reader := NewRedisDB(r, "")
+	cached := NewCachedDB(reader, NewMemoryCache(), []byte("mac"), time.Hour).(*CachedDB)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	invalidated := make(chan string, 10)
+	go reader.Listen(ctx, func(id string) {
+		cached.Invalidate(id)
+		invalidated <- id
+	})
+	for {
+		r.Lock()
+		n := len(r.subscribers[reader.channel])
+		r.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	k := newDBKey("k1", []byte("data"), 0)
+	if err := writer.Add(&k); err != nil {
+		t.Fatal(err)
+	}
+	<-invalidated
+	got, err := cached.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.VersionHash = "changed"
+	if err := writer.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if id := <-invalidated; id != "k1" {
+		t.Fatalf("Expected invalidation of k1, got %s", id)
+	}
+	got, err = cached.Get("k1")
+	if err != nil || got.VersionHash != "changed" {
+		t.Fatalf("Expected the updated key after invalidation, got %+v, %v", got, err)
+	}
+
+	md, err := writer.GetAllMetadata()
+	if err != nil || len(md) != 1 || md[0].VersionHash != "changed" {
+		t.Fatalf("Unexpected metadata %+v, %v", md, err)
+	}
+}
@@ -0,0 +1,140 @@
+package keydb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Factory creates a DB from the options of its configuration.
+type Factory func(options map[string]string) (DB, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Factory{}
+)
+
+// Register makes a DB driver available by name to Open, so backends outside
+// this package can be selected by configuration. It is meant to be called
+// from the init function of the package providing the backend, and panics if
+// the name is registered twice or factory is nil.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("keydb: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("keydb: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the names of the registered drivers, sorted.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates a DB with the registered driver name.
+func Open(name string, options map[string]string) (DB, error) {
+	driversMu.RLock()
+	factory, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("keydb: unknown driver %q (registered: %v)", name, Drivers())
+	}
+	return factory(options)
+}
+
+// Config selects a DB driver and its options, e.g.
+//
+//	{"driver": "file", "options": {"dir": "/var/lib/knox"}}
+type Config struct {
+	Driver  string            `json:"driver"`
+	Options map[string]string `json:"options"`
+}
+
+// OpenConfig creates the DB of the JSON Config in the file at path.
+func OpenConfig(path string) (DB, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("keydb: could not parse %s: %s", path, err.Error())
+	}
+	return Open(c.Driver, c.Options)
+}
+
+// requireOption returns a required option of a driver.
+func requireOption(driver string, options map[string]string, name string) (string, error) {
+	v := options[name]
+	if v == "" {
+		return "", fmt.Errorf("keydb: the %s driver needs the %q option", driver, name)
+	}
+	return v, nil
+}
+
+// sqlFactory returns the factory of a DB on a database/sql database. The
+// database/sql driver, sqlDriver unless the "sql_driver" option is set, must
+// be linked into the binary.
+func sqlFactory(name, sqlDriver string, create func(*sql.DB) (DB, error)) Factory {
+	return func(options map[string]string) (DB, error) {
+		dsn, err := requireOption(name, options, "dsn")
+		if err != nil {
+			return nil, err
+		}
+		if d := options["sql_driver"]; d != "" {
+			sqlDriver = d
+		}
+		sqlDB, err := sql.Open(sqlDriver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		db, err := create(sqlDB)
+		if err != nil {
+			sqlDB.Close()
+			return nil, err
+		}
+		return db, nil
+	}
+}
+
+func init() {
+	Register("memory", func(map[string]string) (DB, error) {
+		return NewTempDB(), nil
+	})
+	Register("file", func(options map[string]string) (DB, error) {
+		dir, err := requireOption("file", options, "dir")
+		if err != nil {
+			return nil, err
+		}
+		return NewFileDB(dir)
+	})
+	Register("singlefile", func(options map[string]string) (DB, error) {
+		path, err := requireOption("singlefile", options, "path")
+		if err != nil {
+			return nil, err
+		}
+		return NewSingleFileDB(path)
+	})
+	Register("mysql", sqlFactory("mysql", "mysql", func(sqlDB *sql.DB) (DB, error) {
+		return NewMySQLDB(sqlDB)
+	}))
+	Register("postgres", sqlFactory("postgres", "postgres", NewPostgreSQLDB))
+	Register("sqlite", sqlFactory("sqlite", "sqlite3", func(sqlDB *sql.DB) (DB, error) {
+		return NewSQLiteDB(sqlDB)
+	}))
+	Register("replica", openReplicaDB)
+}
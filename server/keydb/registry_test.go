@@ -0,0 +1,70 @@
+package keydb
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	var got map[string]string
+	Register("keydb_registry_test", func(options map[string]string) (DB, error) {
+		got = options
+		return NewTempDB(), nil
+	})
+	defer func() {
+		driversMu.Lock()
+		delete(drivers, "keydb_registry_test")
+		driversMu.Unlock()
+	}()
+
+	found := false
+	for _, name := range Drivers() {
+		found = found || name == "keydb_registry_test"
+	}
+	if !found {
+		t.Fatalf("Expected the driver to be listed, got %v", Drivers())
+	}
+	if _, err := Open("keydb_registry_test", map[string]string{"a": "b"}); err != nil || got["a"] != "b" {
+		t.Fatalf("Expected the factory to get the options, got %v %v", got, err)
+	}
+	if _, err := Open("missing", nil); err == nil {
+		t.Fatal("Expected an error for an unknown driver")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering a name twice to panic")
+		}
+	}()
+	Register("keydb_registry_test", func(map[string]string) (DB, error) { return nil, nil })
+}
+
+func TestOpenConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keydb.json")
+	config := `{"driver": "singlefile", "options": {"path": "` + filepath.Join(dir, "keys.json") + `"}}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.(*SingleFileDB); !ok {
+		t.Fatalf("Expected a SingleFileDB, got %T", db)
+	}
+	if _, err := Open("file", nil); err == nil {
+		t.Fatal("Expected an error without the dir option")
+	}
+
+	sql.Register("keydb_registry_sql_test", &outboxRecorder{})
+	db, err = Open("postgres", map[string]string{"sql_driver": "keydb_registry_sql_test", "dsn": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := db.(*SQLDB); !ok || !s.postgres {
+		t.Fatalf("Expected a postgres SQLDB, got %T", db)
+	}
+}
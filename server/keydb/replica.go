@@ -0,0 +1,262 @@
+package keydb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// ReplicaDB serves reads from read replicas of a DB and sends writes to its
+// primary. Replicas lag behind the primary, so ReplicaDB remembers the keys
+// it wrote for maxLag and reads them from the primary while a replica returns
+// them stale: missing after an add, still present after a remove, with
+// another version hash than the one written, or with the DB version the
+// update was made from. Writes by other servers are only seen once they
+// reach the replicas; an update based on a stale read fails with
+// ErrDBVersion on the primary like any concurrent change.
+//
+// Reads fall back to the primary when a replica fails.
+type ReplicaDB struct {
+	primary  DB
+	replicas []DB
+	maxLag   time.Duration
+	next     uint32
+	stale    uint64
+
+	mu     sync.Mutex
+	recent map[string]recentWrite
+}
+
+// recentWrite is what ReplicaDB remembers about a key it wrote.
+type recentWrite struct {
+	at      time.Time
+	removed bool
+	hash    string
+	// from is the DB version an update was made from, or 0 for adds.
+	from int64
+}
+
+// NewReplicaDB creates a DB that reads from replicas, in turn, and writes to
+// primary. maxLag is how long replicas may take to catch up with a write.
+func NewReplicaDB(primary DB, replicas []DB, maxLag time.Duration) *ReplicaDB {
+	return &ReplicaDB{
+		primary:  primary,
+		replicas: replicas,
+		maxLag:   maxLag,
+		recent:   map[string]recentWrite{},
+	}
+}
+
+// StaleReads returns how many replica reads were found stale and served from
+// the primary instead.
+func (db *ReplicaDB) StaleReads() uint64 {
+	return atomic.LoadUint64(&db.stale)
+}
+
+func (db *ReplicaDB) replica() DB {
+	if len(db.replicas) == 0 {
+		return db.primary
+	}
+	n := atomic.AddUint32(&db.next, 1)
+	return db.replicas[int(n)%len(db.replicas)]
+}
+
+// recentWrites returns the writes replicas may not have caught up with yet.
+func (db *ReplicaDB) recentWrites() map[string]recentWrite {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	recent := make(map[string]recentWrite, len(db.recent))
+	for id, w := range db.recent {
+		if now.Sub(w.at) <= db.maxLag {
+			recent[id] = w
+		}
+	}
+	return recent
+}
+
+// recentWrite returns the write of a key replicas may not have caught up with.
+func (db *ReplicaDB) recentWrite(id string) (recentWrite, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	w, ok := db.recent[id]
+	return w, ok && time.Since(w.at) <= db.maxLag
+}
+
+// remember records a write, forgetting the ones replicas have caught up with.
+func (db *ReplicaDB) remember(id string, w recentWrite) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	w.at = time.Now()
+	for other, ow := range db.recent {
+		if w.at.Sub(ow.at) > db.maxLag {
+			delete(db.recent, other)
+		}
+	}
+	db.recent[id] = w
+}
+
+// isStale reports whether a key read from a replica, nil if it wasn't found,
+// misses the write w.
+func (w recentWrite) isStale(k *DBKey) bool {
+	if w.removed {
+		return k != nil
+	}
+	if k == nil {
+		return true
+	}
+	return k.VersionHash != w.hash || (w.from != 0 && k.DBVersion == w.from)
+}
+
+// Get reads a key from a replica, or from the primary if the replica fails or
+// hasn't caught up with a write of the key.
+func (db *ReplicaDB) Get(id string) (*DBKey, error) {
+	k, err := db.replica().Get(id)
+	if err != nil && err != knox.ErrKeyIDNotFound {
+		return db.primary.Get(id)
+	}
+	if w, ok := db.recentWrite(id); ok && w.isStale(k) {
+		atomic.AddUint64(&db.stale, 1)
+		return db.primary.Get(id)
+	}
+	return k, err
+}
+
+// GetAll reads the keys from a replica, reading the ones it hasn't caught up
+// with from the primary.
+func (db *ReplicaDB) GetAll() ([]DBKey, error) {
+	keys, err := db.replica().GetAll()
+	if err != nil {
+		return db.primary.GetAll()
+	}
+	recent := db.recentWrites()
+	if len(recent) == 0 {
+		return keys, nil
+	}
+	// The slice may be shared by the replica, so the result is a copy.
+	out := make([]DBKey, 0, len(keys))
+	seen := map[string]bool{}
+	for i := range keys {
+		k := &keys[i]
+		seen[k.ID] = true
+		w, ok := recent[k.ID]
+		if !ok || !w.isStale(k) {
+			out = append(out, *k)
+			continue
+		}
+		atomic.AddUint64(&db.stale, 1)
+		fresh, err := db.primary.Get(k.ID)
+		if err == knox.ErrKeyIDNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *fresh)
+	}
+	for id, w := range recent {
+		if seen[id] || !w.isStale(nil) {
+			continue
+		}
+		atomic.AddUint64(&db.stale, 1)
+		fresh, err := db.primary.Get(id)
+		if err == knox.ErrKeyIDNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *fresh)
+	}
+	return out, nil
+}
+
+// GetAllMetadata returns the metadata of the keys, from a replica unless it
+// hasn't caught up with a write.
+func (db *ReplicaDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	if len(db.recentWrites()) > 0 {
+		return GetAllMetadata(db.primary)
+	}
+	md, err := GetAllMetadata(db.replica())
+	if err != nil {
+		return GetAllMetadata(db.primary)
+	}
+	return md, nil
+}
+
+// Update writes a key to the primary.
+func (db *ReplicaDB) Update(key *DBKey) error {
+	if err := db.primary.Update(key); err != nil {
+		return err
+	}
+	db.remember(key.ID, recentWrite{hash: key.VersionHash, from: key.DBVersion})
+	return nil
+}
+
+// UpdateIfHash writes a key to the primary if it has the version hash expected
+// there.
+func (db *ReplicaDB) UpdateIfHash(key *DBKey, expected string) error {
+	if err := UpdateIfHash(db.primary, key, expected); err != nil {
+		return err
+	}
+	db.remember(key.ID, recentWrite{hash: key.VersionHash, from: key.DBVersion})
+	return nil
+}
+
+// Add adds keys to the primary.
+func (db *ReplicaDB) Add(keys ...*DBKey) error {
+	if err := db.primary.Add(keys...); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		db.remember(k.ID, recentWrite{hash: k.VersionHash})
+	}
+	return nil
+}
+
+// Remove removes a key from the primary.
+func (db *ReplicaDB) Remove(id string) error {
+	if err := db.primary.Remove(id); err != nil {
+		return err
+	}
+	db.remember(id, recentWrite{removed: true})
+	return nil
+}
+
+// openReplicaDB opens the DB of the replica driver. Its primary and replicas
+// are given by keydb config files, e.g.
+//
+//	{"driver": "replica", "options": {"primary": "primary.json", "replicas": "replica1.json,replica2.json", "max_lag": "5s"}}
+func openReplicaDB(options map[string]string) (DB, error) {
+	primaryConfig, err := requireOption("replica", options, "primary")
+	if err != nil {
+		return nil, err
+	}
+	replicaConfigs, err := requireOption("replica", options, "replicas")
+	if err != nil {
+		return nil, err
+	}
+	maxLag := 10 * time.Second
+	if s := options["max_lag"]; s != "" {
+		if maxLag, err = time.ParseDuration(s); err != nil || maxLag <= 0 {
+			return nil, fmt.Errorf("keydb: the replica driver needs a positive max_lag, e.g. 5s")
+		}
+	}
+	primary, err := OpenConfig(primaryConfig)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []DB
+	for _, path := range strings.Split(replicaConfigs, ",") {
+		replica, err := OpenConfig(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	return NewReplicaDB(primary, replicas, maxLag), nil
+}
@@ -0,0 +1,130 @@
+package keydb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestReplicaDB(t *testing.T) {
+	primary := NewTempDB().(*TempDB)
+	replica := NewTempDB().(*TempDB)
+	replicate := func() {
+		t.Helper()
+		if _, err := Migrate(primary, replica, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := NewReplicaDB(primary, []DB{replica}, time.Hour)
+
+	a := newDBKey("a", []byte("a"), 0)
+	if err := db.Add(&a); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := db.Get("a"); err != nil || k.ID != "a" {
+		t.Fatalf("Expected a new key to be read from the primary, got %+v and %v", k, err)
+	}
+	if keys, _ := db.GetAll(); len(keys) != 1 {
+		t.Fatalf("Expected the new key to be listed, got %+v", keys)
+	}
+	if db.StaleReads() != 2 {
+		t.Fatalf("Expected 2 stale reads, got %d", db.StaleReads())
+	}
+
+	// Once the replica caught up, reads don't need the primary.
+	replicate()
+	primary.SetError(fmt.Errorf("primary down"))
+	k, err := db.Get("a")
+	if err != nil {
+		t.Fatalf("Expected a to be read from the replica, got %v", err)
+	}
+	primary.SetError(nil)
+
+	updated, _ := primary.Get("a")
+	updated.VersionList = append(updated.VersionList, newEncKeyVersion([]byte("b"), knox.Active))
+	updated.VersionHash = "newhash"
+	if err := db.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ = db.Get("a"); k.VersionHash != "newhash" {
+		t.Fatalf("Expected the update to be read, got hash %s", k.VersionHash)
+	}
+
+	// ACL changes keep the version hash; the replica's DB version gives it
+	// away. Real replicas copy the primary's DB versions.
+	replicate()
+	current, _ := replica.Get("a")
+	primaryA, _ := primary.Get("a")
+	current.DBVersion = primaryA.DBVersion
+	replica.keys[0] = *current
+	current.ACL = knox.ACL{{Type: knox.User, ID: "new", AccessType: knox.Read}}
+	if err := db.Update(current); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ = db.Get("a"); len(k.ACL) != 1 {
+		t.Fatalf("Expected the ACL change to be read, got %+v", k.ACL)
+	}
+
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the removed key to be gone, got %v", err)
+	}
+	if keys, _ := db.GetAll(); len(keys) != 0 {
+		t.Fatalf("Expected no keys, got %+v", keys)
+	}
+
+	// Reads fall back to the primary when the replica fails.
+	b := newDBKey("b", []byte("b"), 0)
+	if err := primary.Add(&b); err != nil {
+		t.Fatal(err)
+	}
+	replica.SetError(fmt.Errorf("replica down"))
+	if k, err := db.Get("b"); err != nil || k.ID != "b" {
+		t.Fatalf("Expected b from the primary, got %+v and %v", k, err)
+	}
+	if keys, err := db.GetAll(); err != nil || len(keys) != 1 {
+		t.Fatalf("Expected b from the primary, got %+v and %v", keys, err)
+	}
+}
+
+func TestReplicaDBMaxLag(t *testing.T) {
+	primary := NewTempDB()
+	replica := NewTempDB()
+	db := NewReplicaDB(primary, []DB{replica}, 10*time.Millisecond)
+	a := newDBKey("a", []byte("a"), 0)
+	if err := db.Add(&a); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// Replicas are trusted to have caught up after the max lag.
+	if _, err := db.Get("a"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the replica to be read, got %v", err)
+	}
+}
+
+func TestOpenReplicaDB(t *testing.T) {
+	dir := t.TempDir()
+	memory := filepath.Join(dir, "memory.json")
+	if err := os.WriteFile(memory, []byte(`{"driver": "memory"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("replica", map[string]string{"primary": memory, "replicas": memory + ", " + memory, "max_lag": "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := db.(*ReplicaDB); len(r.replicas) != 2 || r.maxLag != 5*time.Second {
+		t.Fatalf("Unexpected replica DB %+v", r)
+	}
+	if _, err := Open("replica", map[string]string{"primary": memory, "replicas": memory, "max_lag": "-1s"}); err == nil {
+		t.Fatal("Expected a negative max lag to be rejected")
+	}
+	if _, err := Open("replica", map[string]string{"primary": memory}); err == nil {
+		t.Fatal("Expected replicas to be required")
+	}
+}
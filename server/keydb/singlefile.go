@@ -0,0 +1,142 @@
+package keydb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// singleFileVersion is the format version of SingleFileDB files.
+const singleFileVersion = 1
+
+// singleFile is the content of a SingleFileDB file.
+type singleFile struct {
+	Version int         `json:"version"`
+	Keys    []fileEntry `json:"keys"`
+}
+
+// SingleFileDB keeps keys in memory like TempDB and writes all of them to a
+// single file after every change, so a small install or the dev server keeps
+// its keys across restarts without a database or extra dependencies. The
+// file is replaced atomically and synced before a change returns, and a
+// change that can't be written is undone. Every change rewrites the whole
+// file, so it suits a few thousand keys and a single server process.
+type SingleFileDB struct {
+	*TempDB
+	path string
+}
+
+// NewSingleFileDB opens the DB in the file at path, creating an empty one
+// if it doesn't exist. It fails on a damaged file rather than starting empty.
+func NewSingleFileDB(path string) (*SingleFileDB, error) {
+	db := &SingleFileDB{TempDB: &TempDB{}, path: path}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Remove temporary files left by interrupted writes.
+	tmps, err := filepath.Glob(filepath.Join(dir, fileDBTempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return nil, err
+		}
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, db.write()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f singleFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("keydb: damaged key file %s: %s", path, err.Error())
+	}
+	if f.Version != singleFileVersion {
+		return nil, fmt.Errorf("keydb: key file %s has unknown version %d", path, f.Version)
+	}
+	seen := map[string]bool{}
+	for _, e := range f.Keys {
+		if e.Key == nil || e.Key.ID == "" || seen[e.Key.ID] {
+			return nil, fmt.Errorf("keydb: damaged key file %s", path)
+		}
+		seen[e.Key.ID] = true
+		e.Key.DBVersion = e.DBVersion
+		db.keys = append(db.keys, *e.Key)
+	}
+	return db, nil
+}
+
+// write replaces the file with the keys in memory. The caller holds the lock.
+func (db *SingleFileDB) write() error {
+	f := singleFile{Version: singleFileVersion, Keys: make([]fileEntry, len(db.keys))}
+	for i := range db.keys {
+		f.Keys[i] = fileEntry{Key: &db.keys[i], DBVersion: db.keys[i].DBVersion}
+	}
+	sort.Slice(f.Keys, func(i, j int) bool { return f.Keys[i].Key.ID < f.Keys[j].Key.ID })
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Dir(db.path), db.path, b)
+}
+
+// commit writes the keys after a change, restoring the keys from before the
+// change if that fails. The caller holds the lock.
+func (db *SingleFileDB) commit(before []DBKey) error {
+	if err := db.write(); err != nil {
+		db.keys = before
+		return fmt.Errorf("keydb: failed to write key file: %s", err.Error())
+	}
+	return nil
+}
+
+// Update updates the key and writes the file.
+func (db *SingleFileDB) Update(key *DBKey) error {
+	db.Lock()
+	defer db.Unlock()
+	before := append([]DBKey(nil), db.keys...)
+	if _, err := db.update(key); err != nil {
+		return err
+	}
+	return db.commit(before)
+}
+
+// UpdateIfHash updates the key if it has the version hash expected and writes
+// the file.
+func (db *SingleFileDB) UpdateIfHash(key *DBKey, expected string) error {
+	db.Lock()
+	defer db.Unlock()
+	before := append([]DBKey(nil), db.keys...)
+	if _, err := db.updateIfHash(key, expected); err != nil {
+		return err
+	}
+	return db.commit(before)
+}
+
+// Add adds the keys and writes the file.
+func (db *SingleFileDB) Add(keys ...*DBKey) error {
+	db.Lock()
+	defer db.Unlock()
+	before := append([]DBKey(nil), db.keys...)
+	if _, err := db.add(keys); err != nil {
+		return err
+	}
+	return db.commit(before)
+}
+
+// Remove removes the key and writes the file.
+func (db *SingleFileDB) Remove(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	before := append([]DBKey(nil), db.keys...)
+	if err := db.remove(id); err != nil {
+		return err
+	}
+	return db.commit(before)
+}
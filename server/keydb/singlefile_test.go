@@ -0,0 +1,91 @@
+package keydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestSingleFileDB(t *testing.T) {
+	db, err := NewSingleFileDB(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+	TesterUpdateIfHash(t, db)
+	TesterUpdateIfHashRace(t, db)
+}
+
+func TestSingleFileDBReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.json")
+	db, err := NewSingleFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := newDBKey("a", []byte("1"), 0), newDBKey("b", []byte("2"), 0)
+	if err := db.Add(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := db.Get("a")
+	got.VersionHash = "updated"
+	if err := db.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	updated, _ := db.Get("a")
+
+	// A write interrupted before its rename leaves a temporary file behind.
+	if err := os.WriteFile(filepath.Join(dir, fileDBTempPrefix+"1"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewSingleFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileDBTempPrefix+"1")); !os.IsNotExist(err) {
+		t.Fatal("Expected the temporary file to be removed")
+	}
+	k, err := db.Get("a")
+	if err != nil || k.VersionHash != "updated" || k.DBVersion != updated.DBVersion {
+		t.Fatalf("Expected the updated key after reopening, got %+v %v", k, err)
+	}
+	if _, err := db.Get("b"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the removed key to stay removed, got %v", err)
+	}
+
+	// A change that can't be written is undone.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c := newDBKey("c", []byte("3"), 0)
+	if err := db.Add(&c); err == nil {
+		t.Fatal("Expected an error writing over a directory")
+	}
+	if _, err := db.Get("c"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the failed add to be undone, got %v", err)
+	}
+}
+
+func TestSingleFileDBDamaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	for _, content := range []string{"{", `{"version": 2, "keys": []}`, `{"version": 1, "keys": [{"db_version": 1}]}`} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewSingleFileDB(path); err == nil {
+			t.Fatalf("Expected an error opening %s", content)
+		}
+	}
+}
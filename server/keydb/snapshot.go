@@ -0,0 +1,156 @@
+package keydb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// snapshotMagic starts every snapshot and is authenticated with it, so other
+// files and future formats are recognized.
+const snapshotMagic = "knox-snapshot-v1\n"
+
+// SnapshotKeySize is the size of the AES-256 keys that encrypt snapshots.
+const SnapshotKeySize = 32
+
+// Snapshot is a copy of every key in a DB at one point in time. Key data stays
+// encrypted by the server's Cryptor, so a snapshot can only be restored for a
+// server with the same master key.
+type Snapshot struct {
+	// Time is when the snapshot was taken, in Unix nanoseconds.
+	Time int64   `json:"time"`
+	Keys []DBKey `json:"keys"`
+}
+
+// TakeSnapshot reads every key in db.
+func TakeSnapshot(db DB) (*Snapshot, error) {
+	keys, err := db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Time: time.Now().UnixNano(), Keys: keys}, nil
+}
+
+// ReadSnapshotKey reads a base64 encoded snapshot key from the file at path.
+func ReadSnapshotKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("keydb: the snapshot key in %s is not base64 encoded", path)
+	}
+	if len(key) != SnapshotKeySize {
+		return nil, fmt.Errorf("keydb: the snapshot key in %s is %d bytes, not %d", path, len(key), SnapshotKeySize)
+	}
+	return key, nil
+}
+
+func snapshotAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != SnapshotKeySize {
+		return nil, fmt.Errorf("keydb: snapshot keys are %d bytes, not %d", SnapshotKeySize, len(key))
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// Encrypt returns the snapshot encrypted and authenticated with key, which
+// also hides the ACLs and metadata of the keys.
+func (s *Snapshot) Encrypt(key []byte) ([]byte, error) {
+	gcm, err := snapshotAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(snapshotMagic), nonce...)
+	return gcm.Seal(out, nonce, plaintext, []byte(snapshotMagic)), nil
+}
+
+// OpenSnapshot decrypts a snapshot made with Encrypt. It fails if the
+// snapshot was changed or truncated, or key is not the one it was made with.
+func OpenSnapshot(b, key []byte) (*Snapshot, error) {
+	gcm, err := snapshotAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < len(snapshotMagic) || string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("keydb: not a knox snapshot")
+	}
+	b = b[len(snapshotMagic):]
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("keydb: the snapshot is truncated")
+	}
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(snapshotMagic))
+	if err != nil {
+		return nil, fmt.Errorf("keydb: the snapshot is damaged or encrypted with another key")
+	}
+	var s Snapshot
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return nil, fmt.Errorf("keydb: could not parse the snapshot: %s", err.Error())
+	}
+	return &s, nil
+}
+
+// RestoreSnapshot writes the keys of a snapshot to db. Missing keys are added
+// and keys that differ from the snapshot are replaced. Keys that are not in
+// the snapshot are left alone, so restoring into a DB that is in use doesn't
+// remove keys created since the snapshot. Keys that fail, e.g. because they
+// were changed concurrently, are reported and the snapshot can be restored
+// again.
+func RestoreSnapshot(db DB, s *Snapshot) *knox.RestoreResult {
+	result := &knox.RestoreResult{Failed: []string{}}
+	for i := range s.Keys {
+		k := s.Keys[i].Copy()
+		current, err := db.Get(k.ID)
+		switch {
+		case err == knox.ErrKeyIDNotFound:
+			if err := db.Add(k); err != nil {
+				result.Failed = append(result.Failed, k.ID)
+				continue
+			}
+			result.Added++
+		case err != nil:
+			result.Failed = append(result.Failed, k.ID)
+		default:
+			if sameKey(k, current) {
+				result.Unchanged++
+				continue
+			}
+			k.DBVersion = current.DBVersion
+			if err := db.Update(k); err != nil {
+				result.Failed = append(result.Failed, k.ID)
+				continue
+			}
+			result.Replaced++
+		}
+	}
+	return result
+}
+
+// sameKey reports whether two keys have the same content, ignoring their DB
+// versions.
+func sameKey(a, b *DBKey) bool {
+	ja, errA := json.Marshal(a.Copy())
+	jb, errB := json.Marshal(b.Copy())
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
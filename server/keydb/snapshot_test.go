@@ -0,0 +1,80 @@
+package keydb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, SnapshotKeySize)
+	db := NewTempDB()
+	a := newDBKey("a", []byte("a"), 0)
+	b := newDBKey("b", []byte("b"), 0)
+	if err := db.Add(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	s, err := TakeSnapshot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := s.Encrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(enc, []byte(`"id":"a"`)) {
+		t.Fatal("Expected the snapshot to be encrypted")
+	}
+
+	damaged := append([]byte{}, enc...)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := OpenSnapshot(damaged, key); err == nil {
+		t.Fatal("Expected a damaged snapshot to be rejected")
+	}
+	if _, err := OpenSnapshot(enc, bytes.Repeat([]byte{2}, SnapshotKeySize)); err == nil {
+		t.Fatal("Expected another key to be rejected")
+	}
+	if _, err := OpenSnapshot([]byte("something else"), key); err == nil {
+		t.Fatal("Expected a file that isn't a snapshot to be rejected")
+	}
+	opened, err := OpenSnapshot(enc, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change a, remove b and add c after the snapshot.
+	changed, _ := db.Get("a")
+	changed = changed.Copy()
+	changed.VersionHash = "changed"
+	if err := db.Update(changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	c := newDBKey("c", []byte("c"), 0)
+	if err := db.Add(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	result := RestoreSnapshot(db, opened)
+	if result.Added != 1 || result.Replaced != 1 || result.Unchanged != 0 || len(result.Failed) != 0 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if k, err := db.Get("a"); err != nil || k.VersionHash != "" {
+		t.Fatalf("Expected a to be restored, got %+v, %v", k, err)
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, err := db.Get(id); err != nil {
+			t.Fatalf("Expected %s to exist: %v", id, err)
+		}
+	}
+	if result := RestoreSnapshot(db, opened); result.Unchanged != 2 {
+		t.Fatalf("Expected nothing to change, got %+v", result)
+	}
+
+	db.(*TempDB).SetError(fmt.Errorf("unavailable"))
+	if result := RestoreSnapshot(db, opened); len(result.Failed) != 2 {
+		t.Fatalf("Expected failures to be reported, got %+v", result)
+	}
+}
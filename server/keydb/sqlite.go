@@ -0,0 +1,156 @@
+package keydb
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sqlitePragmas are run on the connection of a SQLiteDB. WAL lets reads go on
+// while a write is in progress and the busy timeout makes writers wait for
+// the lock instead of failing.
+var sqlitePragmas = []string{
+	"PRAGMA journal_mode=WAL",
+	"PRAGMA synchronous=NORMAL",
+	"PRAGMA busy_timeout=5000",
+	"PRAGMA foreign_keys=ON",
+}
+
+// SQLiteDB is a DB in a local SQLite file for single node and edge
+// deployments that should not depend on a database server. Keys are stored
+// in the same tables and encrypted format as with NewSQLDB.
+type SQLiteDB struct {
+	DB
+	sqlDB *sql.DB
+}
+
+// NewSQLiteDB configures sqlDB, opened with any SQLite driver, for knox and
+// creates a DB on it. SQLite allows a single writer, so the pool is limited
+// to one connection, which also keeps the per-connection pragmas in effect.
+func NewSQLiteDB(sqlDB *sql.DB) (*SQLiteDB, error) {
+	sqlDB.SetMaxOpenConns(1)
+	for _, p := range sqlitePragmas {
+		if _, err := sqlDB.Exec(p); err != nil {
+			return nil, fmt.Errorf("keydb: %s: %s", p, err.Error())
+		}
+	}
+	db, err := NewSQLDB(sqlDB)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteDB{DB: db, sqlDB: sqlDB}, nil
+}
+
+// GetAllMetadata returns the metadata of all keys without reading key versions.
+func (db *SQLiteDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	return GetAllMetadata(db.DB)
+}
+
+// UpdateIfHash updates the key if it has the version hash expected.
+func (db *SQLiteDB) UpdateIfHash(key *DBKey, expected string) error {
+	return UpdateIfHash(db.DB, key, expected)
+}
+
+// PoolStats returns the stats of the connection pool.
+func (db *SQLiteDB) PoolStats() PoolStats {
+	return sqlPoolStats(db.sqlDB)
+}
+
+// Ping checks the connection to the database.
+func (db *SQLiteDB) Ping() error {
+	return db.sqlDB.Ping()
+}
+
+// Backup writes a consistent copy of the database to path, which must not
+// exist. It needs SQLite 3.27 or later.
+func (db *SQLiteDB) Backup(path string) error {
+	_, err := db.sqlDB.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// SQLiteBackups writes backups of a SQLiteDB to a directory and keeps the
+// most recent ones.
+type SQLiteBackups struct {
+	DB  *SQLiteDB
+	Dir string
+	// Keep is the number of backups kept, all of them if zero.
+	Keep int
+	// After is called with the path of every new backup, e.g. to copy it off
+	// the host.
+	After func(path string) error
+
+	now func() time.Time
+}
+
+const sqliteBackupPrefix = "knox-"
+const sqliteBackupSuffix = ".db"
+
+// Run writes a backup, calls After and removes old backups. It returns the
+// path of the new backup.
+func (b *SQLiteBackups) Run() (string, error) {
+	now := time.Now
+	if b.now != nil {
+		now = b.now
+	}
+	path := filepath.Join(b.Dir, sqliteBackupPrefix+now().UTC().Format("20060102T150405.000000000Z")+sqliteBackupSuffix)
+	if err := b.DB.Backup(path); err != nil {
+		return "", fmt.Errorf("keydb: backup to %s failed: %s", path, err.Error())
+	}
+	if b.After != nil {
+		if err := b.After(path); err != nil {
+			return path, fmt.Errorf("keydb: backup hook failed for %s: %s", path, err.Error())
+		}
+	}
+	return path, b.prune()
+}
+
+// prune removes all but the Keep most recent backups.
+func (b *SQLiteBackups) prune() error {
+	if b.Keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(b.Dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), sqliteBackupPrefix) && strings.HasSuffix(e.Name(), sqliteBackupSuffix) {
+			backups = append(backups, e.Name())
+		}
+	}
+	// The timestamps in the names sort chronologically.
+	sort.Strings(backups)
+	for len(backups) > b.Keep {
+		if err := os.Remove(filepath.Join(b.Dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Start runs a backup every interval until stop is called.
+func (b *SQLiteBackups) Start(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if _, err := b.Run(); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,121 @@
+package keydb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sqliteRecorder is a database/sql driver that records statements and
+// creates the file of VACUUM INTO statements instead of running SQLite.
+type sqliteRecorder struct {
+	execs []string
+}
+
+func (d *sqliteRecorder) Open(string) (driver.Conn, error) { return &sqliteRecorderConn{d}, nil }
+
+type sqliteRecorderConn struct{ d *sqliteRecorder }
+
+func (c *sqliteRecorderConn) Prepare(query string) (driver.Stmt, error) {
+	return &sqliteRecorderStmt{c.d, query}, nil
+}
+func (c *sqliteRecorderConn) Close() error              { return nil }
+func (c *sqliteRecorderConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+type sqliteRecorderStmt struct {
+	d     *sqliteRecorder
+	query string
+}
+
+func (s *sqliteRecorderStmt) Close() error  { return nil }
+func (s *sqliteRecorderStmt) NumInput() int { return -1 }
+func (s *sqliteRecorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.execs = append(s.d.execs, s.query)
+	if strings.HasPrefix(s.query, "VACUUM INTO") {
+		path := args[0].(string)
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("output file already exists")
+		}
+		if err := os.WriteFile(path, []byte("backup"), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s *sqliteRecorderStmt) Query([]driver.Value) (driver.Rows, error) {
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return []string{"metadata"} }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestSQLiteDB(t *testing.T) {
+	d := &sqliteRecorder{}
+	sql.Register("keydb_sqlite_test", d)
+	sqlDB, err := sql.Open("keydb_sqlite_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewSQLiteDB(sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range sqlitePragmas {
+		if d.execs[i] != p {
+			t.Fatalf("Expected %s, got %s", p, d.execs[i])
+		}
+	}
+	if sqlDB.Stats().MaxOpenConnections != 1 {
+		t.Fatal("Expected a single connection")
+	}
+	if p, ok := GetPoolStats(db); !ok || p.MaxOpen != 1 {
+		t.Fatalf("Expected pool stats with a single connection, got %+v", p)
+	}
+	if err := Ping(db); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	now := time.Unix(1700000000, 0)
+	var hooked []string
+	b := &SQLiteBackups{
+		DB:   db,
+		Dir:  dir,
+		Keep: 2,
+		After: func(path string) error {
+			hooked = append(hooked, path)
+			return nil
+		},
+		now: func() time.Time { return now },
+	}
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, err := b.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		now = now.Add(time.Hour)
+	}
+	if len(hooked) != 3 || hooked[2] != paths[2] {
+		t.Fatalf("Expected the hook to run for every backup, got %v", hooked)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 || filepath.Join(dir, entries[0].Name()) != paths[1] {
+		t.Fatalf("Expected the 2 most recent backups, got %v", entries)
+	}
+
+	b.After = func(string) error { return fmt.Errorf("upload failed") }
+	if _, err := b.Run(); err == nil {
+		t.Fatal("Expected the hook error")
+	}
+}
@@ -0,0 +1,243 @@
+package keydb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// ErrNoTombstones is returned for deleted keys by DBs that don't keep them.
+var ErrNoTombstones = fmt.Errorf("Deleted keys are not kept by this server")
+
+// SoftDeleteDB is implemented by DBs that keep deleted keys for a while so
+// they can be restored.
+type SoftDeleteDB interface {
+	// Deleted returns the deleted keys that can be restored.
+	Deleted() ([]knox.DeletedKey, error)
+	// Restore makes a deleted key available again. It fails with
+	// knox.ErrKeyExists if a key with the ID was created since.
+	Restore(id string) error
+}
+
+// GetDeleted returns the deleted keys of db that can be restored, or
+// ErrNoTombstones if db doesn't keep deleted keys.
+func GetDeleted(db DB) ([]knox.DeletedKey, error) {
+	if sdb, ok := db.(SoftDeleteDB); ok {
+		return sdb.Deleted()
+	}
+	return nil, ErrNoTombstones
+}
+
+// Restore restores a deleted key of db, or returns ErrNoTombstones if db
+// doesn't keep deleted keys.
+func Restore(db DB, id string) error {
+	if sdb, ok := db.(SoftDeleteDB); ok {
+		return sdb.Restore(id)
+	}
+	return ErrNoTombstones
+}
+
+// tombstoneIDPrefix starts the IDs tombstones are stored under. The / can't
+// be part of a key ID, so they don't collide with keys.
+const tombstoneIDPrefix = "deleted/"
+
+// tombstoneDeletedAt is the metadata entry of a tombstone holding the time
+// the key was deleted, in Unix nanoseconds.
+const tombstoneDeletedAt = "knox.deleted_at"
+
+// TombstoneDB keeps deleted keys in the wrapped DB as tombstones for a
+// retention period, during which they can be listed and restored. Tombstones
+// are stored as keys with reserved IDs, so any DB can hold them, and are
+// hidden from the other operations. Expired tombstones are ignored and
+// purged whenever keys are deleted or the deleted keys are listed.
+type TombstoneDB struct {
+	db        DB
+	retention time.Duration
+}
+
+// NewTombstoneDB wraps db to keep deleted keys for retention.
+func NewTombstoneDB(db DB, retention time.Duration) *TombstoneDB {
+	return &TombstoneDB{db: db, retention: retention}
+}
+
+func isTombstone(id string) bool {
+	return strings.HasPrefix(id, tombstoneIDPrefix)
+}
+
+// deletedAt returns the deletion time of a tombstone.
+func deletedAt(k *DBKey) int64 {
+	t, _ := strconv.ParseInt(k.Metadata[tombstoneDeletedAt], 10, 64)
+	return t
+}
+
+func (db *TombstoneDB) expired(k *DBKey, now time.Time) bool {
+	return now.UnixNano()-deletedAt(k) > int64(db.retention)
+}
+
+// Get returns a key that isn't deleted.
+func (db *TombstoneDB) Get(id string) (*DBKey, error) {
+	if isTombstone(id) {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	return db.db.Get(id)
+}
+
+// GetAll returns the keys that aren't deleted.
+func (db *TombstoneDB) GetAll() ([]DBKey, error) {
+	keys, err := db.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	live := keys[:0]
+	for _, k := range keys {
+		if !isTombstone(k.ID) {
+			live = append(live, k)
+		}
+	}
+	return live, nil
+}
+
+// GetAllMetadata returns the metadata of the keys that aren't deleted.
+func (db *TombstoneDB) GetAllMetadata() ([]DBKeyMetadata, error) {
+	md, err := GetAllMetadata(db.db)
+	if err != nil {
+		return nil, err
+	}
+	live := md[:0]
+	for _, k := range md {
+		if !isTombstone(k.ID) {
+			live = append(live, k)
+		}
+	}
+	return live, nil
+}
+
+// Update updates a key that isn't deleted.
+func (db *TombstoneDB) Update(key *DBKey) error {
+	if isTombstone(key.ID) {
+		return knox.ErrKeyIDNotFound
+	}
+	return db.db.Update(key)
+}
+
+// UpdateIfHash updates a key that isn't deleted if it has the version hash
+// expected.
+func (db *TombstoneDB) UpdateIfHash(key *DBKey, expected string) error {
+	if isTombstone(key.ID) {
+		return knox.ErrKeyIDNotFound
+	}
+	return UpdateIfHash(db.db, key, expected)
+}
+
+// Add adds keys. A deleted key with the same ID is kept, but can't be
+// restored while the new key exists.
+func (db *TombstoneDB) Add(keys ...*DBKey) error {
+	for _, k := range keys {
+		if isTombstone(k.ID) {
+			return fmt.Errorf("keydb: %q is reserved for deleted keys", k.ID)
+		}
+	}
+	return db.db.Add(keys...)
+}
+
+// Remove deletes a key, keeping it as a tombstone that replaces any earlier
+// tombstone of the ID.
+func (db *TombstoneDB) Remove(id string) error {
+	if isTombstone(id) {
+		return knox.ErrKeyIDNotFound
+	}
+	k, err := db.db.Get(id)
+	if err != nil {
+		return err
+	}
+	t := k.Copy()
+	t.ID = tombstoneIDPrefix + id
+	t.Metadata = t.Metadata.Update(knox.KeyMetadata{tombstoneDeletedAt: strconv.FormatInt(time.Now().UnixNano(), 10)})
+	if err := db.db.Remove(t.ID); err != nil && err != knox.ErrKeyIDNotFound {
+		return err
+	}
+	if err := db.db.Add(t); err != nil {
+		return fmt.Errorf("keydb: could not keep deleted key %s: %s", id, err.Error())
+	}
+	if err := db.db.Remove(id); err != nil {
+		return err
+	}
+	_, err = db.Purge()
+	return err
+}
+
+// Deleted returns the deleted keys whose retention period hasn't passed,
+// sorted by ID.
+func (db *TombstoneDB) Deleted() ([]knox.DeletedKey, error) {
+	if _, err := db.Purge(); err != nil {
+		return nil, err
+	}
+	keys, err := db.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	deleted := []knox.DeletedKey{}
+	for i := range keys {
+		if !isTombstone(keys[i].ID) || db.expired(&keys[i], now) {
+			continue
+		}
+		t := deletedAt(&keys[i])
+		deleted = append(deleted, knox.DeletedKey{
+			ID:        strings.TrimPrefix(keys[i].ID, tombstoneIDPrefix),
+			ACL:       keys[i].ACL,
+			DeletedAt: t,
+			PurgeAt:   t + int64(db.retention),
+		})
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].ID < deleted[j].ID })
+	return deleted, nil
+}
+
+// Restore makes a deleted key available again, as it was when it was
+// deleted.
+func (db *TombstoneDB) Restore(id string) error {
+	t, err := db.db.Get(tombstoneIDPrefix + id)
+	if err != nil {
+		return err
+	}
+	if db.expired(t, time.Now()) {
+		return knox.ErrKeyIDNotFound
+	}
+	k := t.Copy()
+	k.ID = id
+	delete(k.Metadata, tombstoneDeletedAt)
+	if len(k.Metadata) == 0 {
+		k.Metadata = nil
+	}
+	if err := db.db.Add(k); err != nil {
+		return err
+	}
+	return db.db.Remove(t.ID)
+}
+
+// Purge removes the tombstones whose retention period has passed and returns
+// how many were removed.
+func (db *TombstoneDB) Purge() (int, error) {
+	keys, err := GetAllMetadata(db.db)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	purged := 0
+	for i := range keys {
+		k := &DBKey{ID: keys[i].ID, Metadata: keys[i].Metadata}
+		if !isTombstone(k.ID) || !db.expired(k, now) {
+			continue
+		}
+		if err := db.db.Remove(k.ID); err != nil && err != knox.ErrKeyIDNotFound {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,83 @@
+package keydb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestTombstoneDB(t *testing.T) {
+	inner, err := NewFileDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewTombstoneDB(inner, time.Hour)
+	a := newDBKey("a", []byte("a"), 0)
+	a.Metadata = knox.KeyMetadata{"team": "infra"}
+	b := newDBKey("b", []byte("b"), 0)
+	if err := db.Add(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the deleted key to be gone, got %v", err)
+	}
+	if keys, _ := db.GetAll(); len(keys) != 1 || keys[0].ID != "b" {
+		t.Fatalf("Expected only b, got %+v", keys)
+	}
+	if md, _ := GetAllMetadata(db); len(md) != 1 {
+		t.Fatalf("Expected the tombstone to be hidden, got %+v", md)
+	}
+	deleted, err := GetDeleted(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != "a" || deleted[0].PurgeAt-deleted[0].DeletedAt != int64(time.Hour) {
+		t.Fatalf("Unexpected deleted keys %+v", deleted)
+	}
+
+	// A new key with the ID blocks the restore until it is deleted too.
+	again := newDBKey("a", []byte("again"), 0)
+	if err := db.Add(&again); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(db, "a"); err != knox.ErrKeyExists {
+		t.Fatalf("Expected the restore to fail, got %v", err)
+	}
+	if err := db.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	k, err := db.Get("a")
+	if err != nil || string(k.VersionList[0].EncData) != "again" || len(k.Metadata) != 0 {
+		t.Fatalf("Expected the latest deleted key back, got %+v, %v", k, err)
+	}
+	if deleted, _ := GetDeleted(db); len(deleted) != 0 {
+		t.Fatalf("Expected no deleted keys, got %+v", deleted)
+	}
+
+	// Tombstones past the retention period are purged.
+	if err := db.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	db.retention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err := Restore(db, "b"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the expired key to be gone, got %v", err)
+	}
+	if n, err := db.Purge(); err != nil || n != 1 {
+		t.Fatalf("Expected one purged tombstone, got %d, %v", n, err)
+	}
+	if keys, _ := inner.GetAll(); len(keys) != 1 {
+		t.Fatalf("Expected only the live key to be stored, got %+v", keys)
+	}
+
+	if _, err := GetDeleted(NewTempDB()); err != ErrNoTombstones {
+		t.Fatalf("Expected ErrNoTombstones, got %v", err)
+	}
+}
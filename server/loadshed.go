@@ -0,0 +1,217 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// Priority is how important it is to keep serving a request when the server
+// is overloaded.
+type Priority int
+
+const (
+	// LowPriority requests, such as listing and searching keys, wait for the
+	// server to recover and are shed if it doesn't.
+	LowPriority Priority = iota
+	// NormalPriority requests are shed only once MaxInFlight is reached.
+	NormalPriority
+	// CriticalPriority requests are never shed.
+	CriticalPriority
+)
+
+// LoadShedConfig configures LoadShedding. Zero values disable the
+// corresponding limit.
+type LoadShedConfig struct {
+	// MaxInFlight is the number of requests being served at which the server
+	// is overloaded.
+	MaxInFlight int
+	// MaxLatency is the average latency of recent requests above which the
+	// server is overloaded. It only sheds low priority requests.
+	MaxLatency time.Duration
+	// LatencyWindow is how long the average latency is trusted after the
+	// last request finished. Once it passes, low priority requests are served
+	// again and the next one to finish replaces the average, so a server
+	// that only receives low priority requests doesn't shed them forever. If
+	// zero, 10 seconds is used.
+	LatencyWindow time.Duration
+	// QueueTimeout is how long low priority requests wait for the server to
+	// recover before they are shed.
+	QueueTimeout time.Duration
+	// MaxQueue is the number of low priority requests that may wait at once.
+	// Others are shed immediately.
+	MaxQueue int
+	// Classify returns the priority of a request. If nil, DefaultPriority is
+	// used.
+	Classify func(r *http.Request) Priority
+}
+
+// DefaultPriority keeps machines and services reading their keys responsive:
+// their key reads and syncs are critical, while listing, searching and
+// reading access lists are low priority. v1 routes have the priority of their
+// v0 counterparts.
+func DefaultPriority(r *http.Request) Priority {
+	p := GetPrincipal(r)
+	workload := auth.IsMachine(p) || auth.IsService(p)
+	id := GetRouteID(r)
+	switch id {
+	case "v1updatedkeys":
+		// The v1 daemon checks for updated keys through this route.
+		if workload {
+			return CriticalPriority
+		}
+		return NormalPriority
+	case "v1getkeys":
+		return LowPriority
+	}
+	switch strings.TrimPrefix(id, "v1") {
+	case "getkey", "synckeys":
+		if workload {
+			return CriticalPriority
+		}
+	case "getkeys":
+		// The daemon checks for updated keys through this route.
+		if !workload {
+			return LowPriority
+		}
+	case "searchkeys", "getaccess", "planaccess", "adminlistkeys", "adminaudit", "adminconsistency":
+		return LowPriority
+	}
+	return NormalPriority
+}
+
+// LoadShedding returns a decorator that rejects requests by priority while
+// the server is overloaded, with an OverloadedCode error and a Retry-After
+// header. It must come after Authentication, since priorities depend on the
+// principal.
+func LoadShedding(c LoadShedConfig) func(http.HandlerFunc) http.HandlerFunc {
+	return newLoadShedder(c).decorate
+}
+
+// latencyWeight is the weight of the newest request in the average latency.
+const latencyWeight = 0.1
+
+// defaultLatencyWindow is the LatencyWindow used if none is configured.
+const defaultLatencyWindow = 10 * time.Second
+
+type loadShedder struct {
+	config LoadShedConfig
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	latency  time.Duration
+	// lastDone is when the last admitted request finished.
+	lastDone time.Time
+	// released is closed and replaced when a request finishes while others
+	// are queued, waking them.
+	released chan struct{}
+
+	now func() time.Time
+}
+
+func newLoadShedder(c LoadShedConfig) *loadShedder {
+	if c.Classify == nil {
+		c.Classify = DefaultPriority
+	}
+	if c.LatencyWindow <= 0 {
+		c.LatencyWindow = defaultLatencyWindow
+	}
+	return &loadShedder{config: c, released: make(chan struct{}), now: time.Now}
+}
+
+func (s *loadShedder) decorate(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.admit(s.config.Classify(r)) {
+			w.Header().Set("Retry-After", "1")
+			WriteErr(errF(knox.OverloadedCode, "Server is overloaded, try again later"))(w, r)
+			return
+		}
+		start := time.Now()
+		defer func() { s.done(time.Since(start)) }()
+		f(w, r)
+	}
+}
+
+func (s *loadShedder) overloaded(p Priority) bool {
+	if p == CriticalPriority {
+		return false
+	}
+	if s.config.MaxInFlight > 0 && s.inFlight >= s.config.MaxInFlight {
+		return true
+	}
+	return p == LowPriority && s.config.MaxLatency > 0 && s.latency > s.config.MaxLatency && s.latencyExpiry() > 0
+}
+
+// latencyExpiry returns how long the average latency is still trusted.
+func (s *loadShedder) latencyExpiry() time.Duration {
+	return s.config.LatencyWindow - s.now().Sub(s.lastDone)
+}
+
+// admit reports whether a request with priority p may be served, waiting
+// for load to drop if it is low priority.
+func (s *loadShedder) admit(p Priority) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.overloaded(p) {
+		s.inFlight++
+		return true
+	}
+	if p != LowPriority || s.config.QueueTimeout <= 0 {
+		return false
+	}
+	if s.config.MaxQueue > 0 && s.queued >= s.config.MaxQueue {
+		return false
+	}
+
+	s.queued++
+	defer func() { s.queued-- }()
+	timer := time.NewTimer(s.config.QueueTimeout)
+	defer timer.Stop()
+	for s.overloaded(p) {
+		released := s.released
+		// Also wake when the average latency expires, since no request may
+		// finish before then.
+		wait := s.latencyExpiry()
+		if wait <= 0 {
+			wait = s.config.QueueTimeout
+		}
+		expiry := time.NewTimer(wait)
+		s.mu.Unlock()
+		select {
+		case <-released:
+			s.mu.Lock()
+		case <-expiry.C:
+			s.mu.Lock()
+		case <-timer.C:
+			expiry.Stop()
+			s.mu.Lock()
+			return false
+		}
+		expiry.Stop()
+	}
+	s.inFlight++
+	return true
+}
+
+func (s *loadShedder) done(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	now := s.now()
+	if now.Sub(s.lastDone) >= s.config.LatencyWindow {
+		// The average is stale, start over from this request.
+		s.latency = elapsed
+	} else {
+		s.latency += time.Duration(latencyWeight * float64(elapsed-s.latency))
+	}
+	s.lastDone = now
+	if s.queued > 0 {
+		close(s.released)
+		s.released = make(chan struct{})
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func shedRequest(route string, p knox.Principal) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	setRouteID(r, route)
+	SetPrincipal(r, p)
+	return r
+}
+
+func TestDefaultPriority(t *testing.T) {
+	user := auth.NewUser("testuser", nil)
+	machine := auth.NewMachine("machine1")
+	service := auth.NewService("example.com", "/service")
+	cases := []struct {
+		route string
+		p     knox.Principal
+		want  Priority
+	}{
+		{"getkey", machine, CriticalPriority},
+		{"synckeys", service, CriticalPriority},
+		{"getkey", user, NormalPriority},
+		{"getkeys", machine, NormalPriority},
+		{"getkeys", user, LowPriority},
+		{"searchkeys", machine, LowPriority},
+		{"adminaudit", user, LowPriority},
+		{"postversion", user, NormalPriority},
+		{"getkey", nil, NormalPriority},
+		{"v1getkey", machine, CriticalPriority},
+		{"v1synckeys", service, CriticalPriority},
+		{"v1updatedkeys", machine, CriticalPriority},
+		{"v1getkey", user, NormalPriority},
+		{"v1getkeys", machine, LowPriority},
+		{"v1searchkeys", machine, LowPriority},
+		{"v1getaccess", user, LowPriority},
+		{"v1planaccess", user, LowPriority},
+		{"v1adminaudit", user, LowPriority},
+		{"v1adminlistkeys", user, LowPriority},
+		{"v1adminconsistency", user, LowPriority},
+		{"v1postversion", user, NormalPriority},
+	}
+	for _, c := range cases {
+		if got := DefaultPriority(shedRequest(c.route, c.p)); got != c.want {
+			t.Errorf("Expected priority %d for %s, got %d", c.want, c.route, got)
+		}
+	}
+	// Every v1 twin of a v0 route has its priority.
+	for _, r := range v1Routes {
+		if r.Id == "v1getkeys" || r.Id == "v1updatedkeys" {
+			continue
+		}
+		v0 := strings.TrimPrefix(r.Id, "v1")
+		for _, p := range []knox.Principal{user, machine, service} {
+			want := DefaultPriority(shedRequest(v0, p))
+			if got := DefaultPriority(shedRequest(r.Id, p)); got != want {
+				t.Errorf("Expected priority %d for %s as %s, got %d", want, r.Id, p.Type(), got)
+			}
+		}
+	}
+}
+
+func TestLoadSheddingInFlight(t *testing.T) {
+	s := newLoadShedder(LoadShedConfig{MaxInFlight: 1, QueueTimeout: time.Minute, MaxQueue: 1})
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := s.decorate(func(w http.ResponseWriter, r *http.Request) {
+		if GetRouteID(r) == "postversion" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(route string, p knox.Principal) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, shedRequest(route, p))
+		return w
+	}
+	user := auth.NewUser("testuser", nil)
+
+	go serve("postversion", user)
+	<-entered
+
+	if w := serve("putaccess", user); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected a normal request to be shed, got %d", w.Code)
+	}
+	if w := serve("getkey", auth.NewMachine("machine1")); w.Code != http.StatusOK {
+		t.Fatalf("Expected a critical request to be served, got %d", w.Code)
+	}
+
+	queued := make(chan int)
+	go func() { queued <- serve("getkeys", user).Code }()
+	for {
+		s.mu.Lock()
+		n := s.queued
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := serve("searchkeys", user); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a low priority request to be shed with a full queue, got %d", w.Code)
+	}
+
+	release <- struct{}{}
+	if code := <-queued; code != http.StatusOK {
+		t.Fatalf("Expected the queued request to be served, got %d", code)
+	}
+}
+
+func TestLoadSheddingLatency(t *testing.T) {
+	s := newLoadShedder(LoadShedConfig{MaxLatency: time.Millisecond})
+	for i := 0; i < 50; i++ {
+		if !s.admit(NormalPriority) {
+			t.Fatal("Expected a normal request to be admitted")
+		}
+		s.done(time.Second)
+	}
+	if s.admit(LowPriority) {
+		t.Fatal("Expected a low priority request to be shed while latency is high")
+	}
+	if !s.admit(NormalPriority) {
+		t.Fatal("Expected latency not to shed normal requests")
+	}
+	for i := 0; i < 100; i++ {
+		s.done(0)
+		s.admit(NormalPriority)
+	}
+	if !s.admit(LowPriority) {
+		t.Fatal("Expected low priority requests to be served once latency recovers")
+	}
+}
+
+func TestLoadSheddingLatencyRecoversWithLowPriorityTraffic(t *testing.T) {
+	now := time.Now()
+	s := newLoadShedder(LoadShedConfig{MaxLatency: time.Millisecond, LatencyWindow: time.Minute})
+	s.now = func() time.Time { return now }
+	for i := 0; i < 50; i++ {
+		s.admit(NormalPriority)
+		s.done(time.Second)
+	}
+	if s.admit(LowPriority) {
+		t.Fatal("Expected a low priority request to be shed while latency is high")
+	}
+
+	// Only low priority requests arrive, so none finish to lower the average.
+	now = now.Add(time.Minute)
+	if !s.admit(LowPriority) {
+		t.Fatal("Expected a low priority request to be served once the latency expired")
+	}
+	s.done(0)
+	if !s.admit(LowPriority) {
+		t.Fatal("Expected a fast request to replace the expired latency")
+	}
+	s.done(time.Second)
+	if s.admit(LowPriority) {
+		t.Fatal("Expected slow requests to shed low priority requests again")
+	}
+}
+
+func TestLoadSheddingQueueWakesOnLatencyExpiry(t *testing.T) {
+	s := newLoadShedder(LoadShedConfig{
+		MaxLatency:    time.Millisecond,
+		LatencyWindow: 50 * time.Millisecond,
+		QueueTimeout:  10 * time.Second,
+	})
+	s.admit(NormalPriority)
+	s.done(time.Second)
+	start := time.Now()
+	if !s.admit(LowPriority) {
+		t.Fatal("Expected a queued low priority request to be served once the latency expired")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the queued request to be woken by the expiry, waited %s", elapsed)
+	}
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogSink receives batches of access log records, each a JSON document
+// without the trailing newline. Write is only called from one goroutine at a
+// time.
+type LogSink interface {
+	Write(records [][]byte) error
+}
+
+// LogSinkFunc adapts a function to a LogSink.
+type LogSinkFunc func(records [][]byte) error
+
+func (f LogSinkFunc) Write(records [][]byte) error {
+	return f(records)
+}
+
+// ErrLogBufferFull is returned by LogShipper.Write for records dropped
+// because the buffer was full.
+var ErrLogBufferFull = errors.New("access log buffer is full")
+
+// LogShipperConfig configures a LogShipper. Zero values use the defaults.
+type LogShipperConfig struct {
+	// BufferSize is the number of records waiting to be shipped at which the
+	// buffer is full. It defaults to 10000.
+	BufferSize int
+	// BatchSize is the largest number of records sent to the sink at once. It
+	// defaults to 500.
+	BatchSize int
+	// FlushInterval is how long records wait for a batch to fill. It defaults
+	// to a second.
+	FlushInterval time.Duration
+	// Block makes writes to a full buffer wait up to BlockTimeout for room,
+	// slowing requests down rather than dropping records. Otherwise records
+	// are dropped immediately.
+	Block        bool
+	BlockTimeout time.Duration
+	// RetryBackoff is the wait before retrying a batch the sink failed to
+	// write. It doubles up to MaxRetryBackoff. The defaults are a second and a
+	// minute.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// OnError is called when the sink fails to write a batch.
+	OnError func(error)
+}
+
+// LogShipperStats counts the records handled by a LogShipper.
+type LogShipperStats struct {
+	Shipped  uint64 `json:"shipped"`
+	Dropped  uint64 `json:"dropped"`
+	Failures uint64 `json:"failures"`
+	Buffered int    `json:"buffered"`
+}
+
+// LogShipper is an io.Writer that buffers log records and ships them to a
+// sink in batches from a background goroutine, retrying failed batches. When
+// the sink falls behind and the buffer fills up records are dropped, or
+// writers wait if Block is set. Give it to log.Logger.WithOutput, or pass it
+// to the Logger decorator.
+type LogShipper struct {
+	sink   LogSink
+	config LogShipperConfig
+
+	records chan []byte
+	flush   chan chan struct{}
+	// closing stops retries and new records, then done stops run.
+	closing chan struct{}
+	done    chan struct{}
+	closed  sync.Once
+
+	shipped  uint64
+	dropped  uint64
+	failures uint64
+}
+
+// NewLogShipper starts shipping records to sink. Close it to ship the
+// buffered records and stop.
+func NewLogShipper(sink LogSink, c LogShipperConfig) *LogShipper {
+	if c.BufferSize <= 0 {
+		c.BufferSize = 10000
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 500
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = time.Second
+	}
+	if c.MaxRetryBackoff <= 0 {
+		c.MaxRetryBackoff = time.Minute
+	}
+	s := &LogShipper{
+		sink:    sink,
+		config:  c,
+		records: make(chan []byte, c.BufferSize),
+		flush:   make(chan chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write buffers one record per line of p.
+func (s *LogShipper) Write(p []byte) (int, error) {
+	var err error
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !s.enqueue(append([]byte(nil), line...)) {
+			atomic.AddUint64(&s.dropped, 1)
+			err = ErrLogBufferFull
+		}
+	}
+	return len(p), err
+}
+
+func (s *LogShipper) enqueue(record []byte) bool {
+	select {
+	case <-s.closing:
+		return false
+	default:
+	}
+	select {
+	case s.records <- record:
+		return true
+	default:
+	}
+	if !s.config.Block {
+		return false
+	}
+	t := time.NewTimer(s.config.BlockTimeout)
+	defer t.Stop()
+	select {
+	case s.records <- record:
+		return true
+	case <-t.C:
+		return false
+	case <-s.closing:
+		return false
+	}
+}
+
+// Stats returns the number of records shipped, dropped and waiting, and the
+// number of failed writes to the sink.
+func (s *LogShipper) Stats() LogShipperStats {
+	return LogShipperStats{
+		Shipped:  atomic.LoadUint64(&s.shipped),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+		Failures: atomic.LoadUint64(&s.failures),
+		Buffered: len(s.records),
+	}
+}
+
+// Flush waits until the records buffered so far were written to the sink or
+// given up on.
+func (s *LogShipper) Flush() {
+	ack := make(chan struct{})
+	select {
+	case s.flush <- ack:
+		<-ack
+	case <-s.done:
+	}
+}
+
+// Close ships the buffered records and stops the shipper. Later writes are
+// dropped.
+func (s *LogShipper) Close() error {
+	s.closed.Do(func() {
+		close(s.closing)
+		s.Flush()
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *LogShipper) run() {
+	t := time.NewTicker(s.config.FlushInterval)
+	defer t.Stop()
+	batch := make([][]byte, 0, s.config.BatchSize)
+	for {
+		select {
+		case r := <-s.records:
+			batch = append(batch, r)
+			if len(batch) < s.config.BatchSize {
+				continue
+			}
+		case <-t.C:
+		case ack := <-s.flush:
+			for len(s.records) > 0 {
+				batch = append(batch, <-s.records)
+				if len(batch) == s.config.BatchSize {
+					s.ship(batch, false)
+					batch = batch[:0]
+				}
+			}
+			s.ship(batch, false)
+			batch = batch[:0]
+			close(ack)
+			continue
+		case <-s.done:
+			return
+		}
+		s.ship(batch, true)
+		batch = batch[:0]
+	}
+}
+
+// ship writes a batch to the sink, retrying with backoff until it succeeds.
+// Without retry, or once the shipper is closed, a failed batch is dropped.
+func (s *LogShipper) ship(batch [][]byte, retry bool) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := s.config.RetryBackoff
+	for {
+		err := s.sink.Write(batch)
+		if err == nil {
+			atomic.AddUint64(&s.shipped, uint64(len(batch)))
+			return
+		}
+		atomic.AddUint64(&s.failures, 1)
+		if s.config.OnError != nil {
+			s.config.OnError(err)
+		}
+		if !retry {
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.closing:
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			return
+		}
+		if backoff *= 2; backoff > s.config.MaxRetryBackoff {
+			backoff = s.config.MaxRetryBackoff
+		}
+	}
+}
+
+// RotatingFileSink appends records to a file, renaming it to path.1, path.2
+// and so on once it reaches MaxBytes.
+type RotatingFileSink struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFileSink opens path for appending. Files over maxBytes are
+// rotated, keeping maxBackups old files. A maxBytes of zero never rotates.
+func NewRotatingFileSink(path string, maxBytes int64, maxBackups int) (*RotatingFileSink, error) {
+	s := &RotatingFileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RotatingFileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *RotatingFileSink) Write(records [][]byte) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+func (s *RotatingFileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(s.backup(s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(s.backup(i), s.backup(i+1))
+	}
+	if s.maxBackups > 0 {
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *RotatingFileSink) backup(i int) string {
+	return s.path + "." + strconv.Itoa(i)
+}
+
+// Close closes the file.
+func (s *RotatingFileSink) Close() error {
+	return s.f.Close()
+}
+
+// HTTPBulkSink posts batches of records as newline delimited JSON, the
+// format of bulk ingestion endpoints of most log pipelines.
+type HTTPBulkSink struct {
+	URL string
+	// Client defaults to an http.Client with a 30 second timeout.
+	Client *http.Client
+	// Header is added to every request, e.g. for an API token.
+	Header http.Header
+}
+
+func (s *HTTPBulkSink) Write(records [][]byte) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", s.URL, &buf)
+	if err != nil {
+		return err
+	}
+	for k, vs := range s.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bulk log endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// KafkaProducer sends messages to a Kafka topic. It is implemented by an
+// adapter around the Kafka client the server is built with.
+type KafkaProducer interface {
+	Produce(topic string, messages [][]byte) error
+}
+
+// KafkaSink produces each record as a message to Topic.
+type KafkaSink struct {
+	Producer KafkaProducer
+	Topic    string
+}
+
+func (s *KafkaSink) Write(records [][]byte) error {
+	return s.Producer.Produce(s.Topic, records)
+}
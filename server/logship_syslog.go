@@ -0,0 +1,36 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"log/syslog"
+)
+
+// SyslogSink writes each record as a syslog message.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog server at raddr over network, or to
+// the local syslog daemon if network is empty, tagging messages with tag.
+func NewSyslogSink(network, raddr string, priority syslog.Priority, tag string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, raddr, priority, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+func (s *SyslogSink) Write(records [][]byte) error {
+	for _, r := range records {
+		if _, err := s.w.Write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the connection to the syslog server.
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
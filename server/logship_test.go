@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox/log"
+)
+
+type recordingSink struct {
+	mu      sync.Mutex
+	batches [][][]byte
+	fail    int
+}
+
+func (s *recordingSink) Write(records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("sink unavailable")
+	}
+	s.batches = append(s.batches, append([][]byte(nil), records...))
+	return nil
+}
+
+func (s *recordingSink) records() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []string
+	for _, b := range s.batches {
+		for _, r := range b {
+			records = append(records, string(r))
+		}
+	}
+	return records
+}
+
+func TestLogShipperBatches(t *testing.T) {
+	sink := &recordingSink{}
+	s := NewLogShipper(sink, LogShipperConfig{BatchSize: 2, FlushInterval: time.Hour})
+	defer s.Close()
+
+	if _, err := s.Write([]byte("a\nb\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("c\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.Flush()
+	if r := sink.records(); strings.Join(r, ",") != "a,b,c" {
+		t.Fatalf("Expected a,b,c to be shipped, got %v", r)
+	}
+	if len(sink.batches) != 2 || len(sink.batches[0]) != 2 {
+		t.Fatalf("Expected batches of 2, got %d batches", len(sink.batches))
+	}
+	if st := s.Stats(); st.Shipped != 3 || st.Dropped != 0 || st.Buffered != 0 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+}
+
+func TestLogShipperDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	sink := LogSinkFunc(func(records [][]byte) error {
+		<-release
+		return nil
+	})
+	s := NewLogShipper(sink, LogShipperConfig{BufferSize: 1, BatchSize: 1})
+	defer s.Close()
+	defer close(release)
+
+	var dropped bool
+	for i := 0; i < 10; i++ {
+		if _, err := s.Write([]byte("record\n")); err == ErrLogBufferFull {
+			dropped = true
+		}
+	}
+	if !dropped {
+		t.Fatal("Expected records to be dropped while the sink is stuck")
+	}
+	if st := s.Stats(); st.Dropped == 0 {
+		t.Fatalf("Expected dropped records in stats, got %+v", st)
+	}
+}
+
+func TestLogShipperBlocks(t *testing.T) {
+	release := make(chan struct{})
+	sink := LogSinkFunc(func(records [][]byte) error {
+		<-release
+		return nil
+	})
+	s := NewLogShipper(sink, LogShipperConfig{BufferSize: 1, BatchSize: 1, Block: true, BlockTimeout: 20 * time.Millisecond})
+	defer s.Close()
+	defer close(release)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		s.Write([]byte("record\n"))
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("Expected writes to a full buffer to wait")
+	}
+}
+
+func TestLogShipperRetries(t *testing.T) {
+	sink := &recordingSink{fail: 2}
+	var errs int
+	var mu sync.Mutex
+	s := NewLogShipper(sink, LogShipperConfig{
+		FlushInterval: time.Millisecond,
+		RetryBackoff:  time.Millisecond,
+		OnError: func(error) {
+			mu.Lock()
+			errs++
+			mu.Unlock()
+		},
+	})
+	defer s.Close()
+
+	s.Write([]byte("a\n"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.records()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if r := sink.records(); len(r) != 1 || r[0] != "a" {
+		t.Fatalf("Expected the record to be shipped after retrying, got %v", r)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if errs != 2 {
+		t.Fatalf("Expected 2 errors, got %d", errs)
+	}
+	if st := s.Stats(); st.Failures != 2 || st.Shipped != 1 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+}
+
+func TestLogShipperClose(t *testing.T) {
+	sink := &recordingSink{}
+	s := NewLogShipper(sink, LogShipperConfig{FlushInterval: time.Hour})
+	s.Write([]byte("a\n"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := sink.records(); len(r) != 1 {
+		t.Fatalf("Expected Close to ship buffered records, got %v", r)
+	}
+	if _, err := s.Write([]byte("b\n")); err != ErrLogBufferFull {
+		t.Fatalf("Expected writes after Close to be dropped, got %v", err)
+	}
+	s.Close()
+}
+
+func TestRotatingFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	s, err := NewRotatingFileSink(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, r := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		if err := s.Write([][]byte{[]byte(r)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{
+		path:        "eeee\n",
+		path + ".1": "cccc\ndddd\n",
+		path + ".2": "aaaa\nbbbb\n",
+	} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("Expected %s to contain %q, got %q", name, expected, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Expected at most 2 backups, got %v", err)
+	}
+}
+
+func TestHTTPBulkSink(t *testing.T) {
+	var body, token, contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body, token, contentType = string(b), r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+	}))
+	defer ts.Close()
+
+	s := &HTTPBulkSink{URL: ts.URL, Header: http.Header{"Authorization": {"Bearer t"}}}
+	if err := s.Write([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if body != "{\"a\":1}\n{\"b\":2}\n" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+	if token != "Bearer t" || contentType != "application/x-ndjson" {
+		t.Fatalf("Unexpected headers %q %q", token, contentType)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	s.URL = failing.URL
+	if err := s.Write([][]byte{[]byte("{}")}); err == nil {
+		t.Fatal("Expected an error for a failed bulk request")
+	}
+}
+
+func TestLoggerShipsAccessLog(t *testing.T) {
+	sink := &recordingSink{}
+	s := NewLogShipper(sink, LogShipperConfig{})
+	defer s.Close()
+
+	var local strings.Builder
+	handler := Logger(log.New(&local, "", 0), s)(func(w http.ResponseWriter, r *http.Request) {})
+	r, err := http.NewRequest("GET", "/v0/keys/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(httptest.NewRecorder(), r)
+	s.Flush()
+
+	records := sink.records()
+	if len(records) != 1 {
+		t.Fatalf("Expected one shipped record, got %v", records)
+	}
+	if local.Len() == 0 {
+		t.Fatal("Expected the record to be logged locally too")
+	}
+	var m log.LogMessage
+	entry := &reqLog{}
+	m.Payload = entry
+	if err := json.Unmarshal([]byte(records[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Type != "access" || entry.Request.Path != "/v0/keys/" {
+		t.Fatalf("Unexpected access log record %+v", entry)
+	}
+}
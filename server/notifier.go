@@ -0,0 +1,104 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// Notification is an alert raised by the server about a security relevant
+// event, such as a read of a honeytoken key.
+type Notification struct {
+	Type          string   `json:"type"`
+	KeyID         string   `json:"key_id"`
+	Principal     string   `json:"principal"`
+	PrincipalType string   `json:"principal_type"`
+	Fallbacks     []string `json:"fallback_principals,omitempty"`
+	Authorized    bool     `json:"authorized"`
+	Message       string   `json:"message,omitempty"`
+	Time          int64    `json:"time"`
+}
+
+// Notification types.
+const (
+	HoneytokenReadNotification   = "honeytoken_read"
+	RapidReadsNotification       = "rapid_reads"
+	NewMachinePrefixNotification = "new_machine_prefix"
+	ReadsExhaustedNotification   = "reads_exhausted"
+	KeyExpiringNotification      = "key_expiring"
+	KeyExpiredNotification       = "key_expired"
+	KeyChangedNotification       = "key_changed"
+	InconsistentKeyNotification  = "inconsistent_key"
+)
+
+// Notifier delivers notifications to an alerting system. Notify is called
+// inline while serving the request, so implementations that talk to remote
+// systems should hand the notification off rather than block.
+type Notifier interface {
+	Notify(n Notification)
+}
+
+// NotifierFunc adapts a function to the Notifier interface.
+type NotifierFunc func(n Notification)
+
+// Notify calls f(n).
+func (f NotifierFunc) Notify(n Notification) {
+	f(n)
+}
+
+// LogNotifier writes notifications as json to the given logger.
+func LogNotifier(logger *log.Logger) Notifier {
+	return NotifierFunc(func(n Notification) {
+		logger.OutputJSON(n)
+	})
+}
+
+var notifier Notifier
+
+// SetNotifier sets where alerts such as honeytoken reads are sent by
+// KeyManagers made with NewKeyManager or GetRouter, and by SimpleDetectors
+// without a notifier. By default no notifications are sent.
+//
+// Deprecated: Set KeyManagerOptions.Notifier and use
+// NewKeyManagerWithOptions.
+func SetNotifier(n Notifier) {
+	notifier = n
+}
+
+// notify sends n to the notifier to, if there is one.
+func notify(to Notifier, n Notification) {
+	if to != nil {
+		to.Notify(n)
+	}
+}
+
+func notifyHoneytokenRead(to Notifier, keyID string, principal knox.Principal, authorized bool) {
+	notify(to, principalNotification(HoneytokenReadNotification, keyID, principal, authorized))
+}
+
+// notifyReadsExhausted reports the read that used up the last remaining read
+// of a key with a read limit.
+func notifyReadsExhausted(to Notifier, keyID string, principal knox.Principal) {
+	log.Printf("Key %s has no reads remaining after a read by %s", keyID, principal.GetID())
+	n := principalNotification(ReadsExhaustedNotification, keyID, principal, true)
+	n.Message = "The key's read limit has been reached"
+	notify(to, n)
+}
+
+func principalNotification(typ, keyID string, principal knox.Principal, authorized bool) Notification {
+	n := Notification{
+		Type:       typ,
+		KeyID:      keyID,
+		Authorized: authorized,
+		Time:       time.Now().UnixNano(),
+	}
+	if principal != nil {
+		n.Principal = principal.GetID()
+		n.PrincipalType = principal.Type()
+		if mux, ok := principal.(knox.PrincipalMux); ok {
+			n.Fallbacks = mux.GetIDs()
+		}
+	}
+	return n
+}
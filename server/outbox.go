@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// EventHandler processes key events delivered by an OutboxDispatcher, e.g.
+// to notify an external system or replicate keys. Events are delivered at
+// least once, so handlers should ignore events with a Seq they already
+// processed.
+type EventHandler interface {
+	HandleEvent(e keydb.Event) error
+}
+
+// EventHandlerFunc adapts a function to the EventHandler interface.
+type EventHandlerFunc func(e keydb.Event) error
+
+// HandleEvent calls f(e).
+func (f EventHandlerFunc) HandleEvent(e keydb.Event) error {
+	return f(e)
+}
+
+// NotifierEventHandler sends a KeyChangedNotification for every event.
+func NotifierEventHandler(n Notifier) EventHandler {
+	return EventHandlerFunc(func(e keydb.Event) error {
+		n.Notify(Notification{
+			Type:    KeyChangedNotification,
+			KeyID:   e.KeyID,
+			Message: fmt.Sprintf("Key event %d: %s", e.Seq, e.Type),
+			Time:    e.Time,
+		})
+		return nil
+	})
+}
+
+// defaultOutboxBatch is the number of events read from the outbox at once.
+const defaultOutboxBatch = 100
+
+// OutboxDispatcher delivers the events of a keydb.Outbox to handlers in
+// order. Its position is committed to the outbox after every event, so a
+// dispatcher that crashes resumes after the last delivered event. Run one
+// dispatcher per consumer name.
+type OutboxDispatcher struct {
+	Outbox keydb.Outbox
+	// Consumer names the position of the dispatcher in the outbox.
+	Consumer string
+	// Handlers receive every event in order. An event is retried, on all
+	// handlers, until every handler accepted it.
+	Handlers []EventHandler
+	// BatchSize is the number of events read at once, 100 if zero.
+	BatchSize int
+	// Trim deletes events once they are delivered. Only set it on the only
+	// consumer of the outbox.
+	Trim bool
+}
+
+// Run delivers the events after the dispatcher's position and returns the
+// number delivered. It stops at the first event a handler fails, which is
+// delivered again on the next run.
+func (d *OutboxDispatcher) Run() (int, error) {
+	batch := d.BatchSize
+	if batch <= 0 {
+		batch = defaultOutboxBatch
+	}
+	cursor, err := d.Outbox.Cursor(d.Consumer)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for {
+		events, err := d.Outbox.Events(cursor, batch)
+		if err != nil {
+			return delivered, err
+		}
+		for _, e := range events {
+			for _, h := range d.Handlers {
+				if err := h.HandleEvent(e); err != nil {
+					return delivered, fmt.Errorf("event %d for key %s: %s", e.Seq, e.KeyID, err.Error())
+				}
+			}
+			if err := d.Outbox.Commit(d.Consumer, e.Seq); err != nil {
+				return delivered, err
+			}
+			cursor = e.Seq
+			delivered++
+		}
+		if d.Trim && len(events) > 0 {
+			if err := d.Outbox.Trim(cursor); err != nil {
+				return delivered, err
+			}
+		}
+		if len(events) < batch {
+			return delivered, nil
+		}
+	}
+}
+
+// Start runs the dispatcher every interval in a new goroutine until the
+// returned function is called.
+func (d *OutboxDispatcher) Start(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := d.Run(); err != nil {
+					log.Printf("Key event delivery failed: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func TestOutboxDispatcher(t *testing.T) {
+	db := keydb.NewTempOutboxDB()
+	m := NewKeyManager(keydb.NewAESGCMCryptor(0, []byte("testtesttesttest")), db)
+	_, u, acl := GetMocks()
+	for _, id := range []string{"a", "b", "c"} {
+		key := newKey(id, acl, []byte("data"), u, nil)
+		if err := m.AddNewKey(&key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var delivered []uint64
+	fail := false
+	var notified []Notification
+	d := &OutboxDispatcher{
+		Outbox:   db,
+		Consumer: "test",
+		Handlers: []EventHandler{
+			EventHandlerFunc(func(e keydb.Event) error {
+				if fail && e.KeyID == "b" {
+					return errors.New("unavailable")
+				}
+				delivered = append(delivered, e.Seq)
+				return nil
+			}),
+			NotifierEventHandler(NotifierFunc(func(n Notification) { notified = append(notified, n) })),
+		},
+		BatchSize: 2,
+		Trim:      true,
+	}
+
+	fail = true
+	if n, err := d.Run(); err == nil || n != 1 {
+		t.Fatalf("Expected delivery to stop at the failing event, got %d %v", n, err)
+	}
+	if c, _ := db.Cursor("test"); c != 1 {
+		t.Fatalf("Expected the cursor after the delivered event, got %d", c)
+	}
+
+	fail = false
+	if n, err := d.Run(); err != nil || n != 2 {
+		t.Fatalf("Expected the remaining events to be delivered, got %d %v", n, err)
+	}
+	if len(delivered) != 3 || delivered[1] != 2 || delivered[2] != 3 {
+		t.Fatalf("Expected events in order, got %v", delivered)
+	}
+	if len(notified) != 3 || notified[0].Type != KeyChangedNotification || notified[0].KeyID != "a" {
+		t.Fatalf("Expected a notification for every event, got %v", notified)
+	}
+	if events, _ := db.Events(0, 10); len(events) != 0 {
+		t.Fatalf("Expected delivered events to be trimmed, got %v", events)
+	}
+	if n, err := d.Run(); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to deliver, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+// ParamType is the format a validated parameter value must have.
+type ParamType int
+
+const (
+	// StringParam accepts any value.
+	StringParam ParamType = iota
+	// UintParam is a base 10 unsigned integer.
+	UintParam
+	// BoolParam is a value accepted by strconv.ParseBool.
+	BoolParam
+	// Base64Param is standard base64 encoded data.
+	Base64Param
+	// JSONParam is any valid JSON document.
+	JSONParam
+	// StatusParam is a JSON encoded knox.VersionStatus.
+	StatusParam
+	// TimeParam is Unix seconds or an RFC 3339 timestamp.
+	TimeParam
+)
+
+// maxKeyIDLength bounds the length of new key IDs.
+const maxKeyIDLength = 512
+
+// ValidatedParameter wraps a Parameter with declarative checks. Route.ServeHTTP
+// runs them after the decorators, so requests are authenticated and logged,
+// and before the handler.
+type ValidatedParameter struct {
+	Parameter
+	Type ParamType
+	// Required parameters must be present and non empty.
+	Required bool
+	// MaxLength limits the length of the raw value in bytes if positive.
+	MaxLength int
+	// Pattern must match the raw value if set.
+	Pattern *regexp.Regexp
+	// Code is the error subcode for invalid values. It defaults to
+	// knox.BadRequestDataCode.
+	Code int
+}
+
+// Validate checks the value of the parameter, where ok is false if it was not
+// sent.
+func (p ValidatedParameter) Validate(value string, ok bool) *HTTPError {
+	code := p.Code
+	if code == 0 {
+		code = knox.BadRequestDataCode
+	}
+	name := p.Name()
+	if !ok || value == "" {
+		if !p.Required {
+			return nil
+		}
+		if !ok {
+			return errF(code, fmt.Sprintf("Missing parameter '%s'", name))
+		}
+		return errF(code, fmt.Sprintf("Parameter '%s' is empty", name))
+	}
+	if p.MaxLength > 0 && len(value) > p.MaxLength {
+		return errF(code, fmt.Sprintf("Parameter '%s' is longer than %d bytes", name, p.MaxLength))
+	}
+	if p.Pattern != nil && !p.Pattern.MatchString(value) {
+		return errF(code, fmt.Sprintf("Parameter '%s' does not match %s", name, p.Pattern))
+	}
+	var err error
+	switch p.Type {
+	case UintParam:
+		_, err = strconv.ParseUint(value, 10, 64)
+	case BoolParam:
+		_, err = strconv.ParseBool(value)
+	case Base64Param:
+		// Handlers decode the value again, so it is only checked here
+		// rather than decoded into a copy as large as the key data.
+		_, err = io.Copy(io.Discard, base64.NewDecoder(base64.StdEncoding, strings.NewReader(value)))
+	case JSONParam:
+		if !json.Valid([]byte(value)) {
+			err = fmt.Errorf("invalid JSON")
+		}
+	case StatusParam:
+		_, err = parseStatus(value)
+	case TimeParam:
+		_, err = parseTimeParam(value)
+	}
+	if err != nil {
+		return errF(code, fmt.Sprintf("Invalid parameter '%s': %s", name, err.Error()))
+	}
+	return nil
+}
+
+// validateParams runs the checks of any ValidatedParameters.
+func validateParams(parameters []Parameter, ps map[string]string) *HTTPError {
+	for _, p := range parameters {
+		if v, ok := p.(ValidatedParameter); ok {
+			value, present := ps[v.Name()]
+			if err := v.Validate(value, present); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseStatus(s string) (knox.VersionStatus, error) {
+	status := knox.Active
+	err := status.UnmarshalJSON([]byte(s))
+	return status, err
+}
+
+// statusParam parses the optional status parameter, defaulting to def.
+func statusParam(parameters map[string]string, def knox.VersionStatus) (knox.VersionStatus, *HTTPError) {
+	s, ok := parameters["status"]
+	if !ok {
+		return def, nil
+	}
+	status, err := parseStatus(s)
+	if err != nil {
+		return def, errF(knox.BadRequestDataCode, err.Error())
+	}
+	return status, nil
+}
+
+// contentTypeParam returns the optional content_type parameter after checking
+// that data matches it.
+func contentTypeParam(parameters map[string]string, data []byte) (string, *HTTPError) {
+	ct := parameters["content_type"]
+	if !knox.ValidContentType(ct) {
+		return "", errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid content type %q", ct))
+	}
+	if err := knox.ValidateContent(ct, data); err != nil {
+		return "", errF(knox.BadRequestDataCode, err.Error())
+	}
+	return ct, nil
+}
+
+// dataParam decodes the required base64 data parameter. Missing or empty data
+// is reported with missingCode.
+func dataParam(parameters map[string]string, missingCode int) ([]byte, *HTTPError) {
+	data, ok := parameters["data"]
+	if !ok {
+		return nil, errF(missingCode, "Missing parameter 'data'")
+	}
+	if data == "" {
+		return nil, errF(missingCode, "Parameter 'data' is empty")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	return decoded, nil
+}
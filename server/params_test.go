@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/base64"
+	"regexp"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestValidatedParameter(t *testing.T) {
+	cases := []struct {
+		p     ValidatedParameter
+		value string
+		ok    bool
+		code  int
+	}{
+		{ValidatedParameter{Parameter: PostParameter("a")}, "", false, knox.OKCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Required: true}, "", false, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Required: true, Code: knox.NoKeyIDCode}, "", true, knox.NoKeyIDCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), MaxLength: 3}, "abcd", true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Pattern: regexp.MustCompile("^[a-z]+$")}, "ab1", true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Pattern: regexp.MustCompile("^[a-z]+$")}, "ab", true, knox.OKCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: UintParam}, "-1", true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: UintParam}, "12", true, knox.OKCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: BoolParam}, "maybe", true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: Base64Param}, "NOTBASE64", true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: Base64Param}, "MQ==", true, knox.OKCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: JSONParam}, "{", true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: StatusParam}, `"Primary"`, true, knox.OKCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: StatusParam}, `"Nope"`, true, knox.BadRequestDataCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: TimeParam}, "2030-01-01T00:00:00Z", true, knox.OKCode},
+		{ValidatedParameter{Parameter: PostParameter("a"), Type: TimeParam}, "tomorrow", true, knox.BadRequestDataCode},
+	}
+	for i, c := range cases {
+		err := c.p.Validate(c.value, c.ok)
+		code := knox.OKCode
+		if err != nil {
+			code = err.Subcode
+		}
+		if code != c.code {
+			t.Fatalf("case %d: expected code %d, got %+v", i, c.code, err)
+		}
+	}
+}
+
+func TestValidateRouteParams(t *testing.T) {
+	var putVersion, putAccess Route
+	for _, r := range routes {
+		switch r.Id {
+		case "putversion":
+			putVersion = r
+		case "putaccess":
+			putAccess = r
+		}
+	}
+	// The legacy access parameter may be base64 encoded JSON.
+	legacy := base64.RawURLEncoding.EncodeToString([]byte(`{"type":"Machine","id":"a","access":"Read"}`))
+	if err := validateParams(putAccess.Parameters, map[string]string{"keyID": "a1", "access": legacy}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	err := validateParams(putVersion.Parameters, map[string]string{"keyID": "a1", "versionID": "x", "status": `"Primary"`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	err = validateParams(putVersion.Parameters, map[string]string{"keyID": "a1", "versionID": "1"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	err = validateParams(putVersion.Parameters, map[string]string{"keyID": "a1", "versionID": "1", "status": `"Primary"`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
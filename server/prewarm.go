@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+// Prewarm routes let a deploy system have the daemons on new hosts cache keys
+// before the hosts get traffic. Daemons learn about prewarm requests when
+// they sync, and the version hashes they sync with show which keys they have.
+// Requests are kept in memory, so with several servers a daemon's sync has to
+// reach the server the request was made on.
+var prewarmRoutes = []Route{
+	{
+		Method:     "POST",
+		Id:         "postprewarm",
+		Path:       "/v0/prewarm/",
+		Handler:    postPrewarmHandler,
+		Principals: []PrincipalKind{UserPrincipal, ServicePrincipal},
+		Parameters: []Parameter{
+			ValidatedParameter{Parameter: PostParameter("hosts"), Type: JSONParam, Required: true},
+			ValidatedParameter{Parameter: PostParameter("keys"), Type: JSONParam, Required: true},
+		},
+	},
+	{
+		Method:     "GET",
+		Id:         "getprewarm",
+		Path:       "/v0/prewarm/{prewarmID}/",
+		Handler:    getPrewarmHandler,
+		Principals: []PrincipalKind{UserPrincipal, ServicePrincipal},
+		Parameters: []Parameter{
+			UrlParameter("prewarmID"),
+		},
+	},
+}
+
+const (
+	// prewarmTTL is how long a prewarm request is kept after it is made.
+	prewarmTTL = time.Hour
+	// maxPrewarms is the number of prewarm requests kept at once.
+	maxPrewarms = 1000
+	// maxPrewarmHosts and maxPrewarmKeys limit the size of a request.
+	maxPrewarmHosts = 10000
+	maxPrewarmKeys  = 100
+)
+
+var prewarms = newPrewarmRegistry()
+
+// postPrewarmHandler creates a prewarm request for a JSON list of hosts and
+// keys. It only makes the hosts' daemons ask for the keys, so their ACLs
+// still decide whether they get them.
+// The route for this handler is POST /v0/prewarm/
+func postPrewarmHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	var req knox.PrewarmRequest
+	if err := json.Unmarshal([]byte(parameters["hosts"]), &req.Hosts); err != nil {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid hosts: %s", err))
+	}
+	if err := json.Unmarshal([]byte(parameters["keys"]), &req.Keys); err != nil {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid keys: %s", err))
+	}
+	if len(req.Hosts) == 0 || len(req.Hosts) > maxPrewarmHosts {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("A prewarm request needs 1 to %d hosts", maxPrewarmHosts))
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > maxPrewarmKeys {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("A prewarm request needs 1 to %d keys", maxPrewarmKeys))
+	}
+	for _, h := range req.Hosts {
+		if h == "" {
+			return nil, errF(knox.BadRequestDataCode, "Hosts can't be empty")
+		}
+	}
+	for _, id := range req.Keys {
+		if _, err := m.GetKey(id, knox.Primary); err != nil {
+			if err == knox.ErrKeyIDNotFound {
+				return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", id))
+			}
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+	}
+	p, err := prewarms.create(req)
+	if err != nil {
+		return nil, errF(knox.OverloadedCode, err.Error())
+	}
+	return p, nil
+}
+
+// getPrewarmHandler returns the readiness of each host in a prewarm request.
+// The route for this handler is GET /v0/prewarm/<prewarm_id>/
+func getPrewarmHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	p, ok := prewarms.get(parameters["prewarmID"])
+	if !ok {
+		return nil, errF(knox.NotFoundCode, fmt.Sprintf("No prewarm request %s", parameters["prewarmID"]))
+	}
+	return p, nil
+}
+
+// syncPrewarms returns the keys being prewarmed on principal's host that are
+// missing from versions, if principal is a machine.
+func syncPrewarms(principal knox.Principal, versions map[string]string) []string {
+	if !auth.IsMachine(principal) {
+		return nil
+	}
+	return prewarms.register(principal.GetID(), versions)
+}
+
+// observePrewarms updates the readiness of principal's host from a sync, if
+// principal is a machine.
+func observePrewarms(principal knox.Principal, versions map[string]string, updated []string, errs map[string]knox.APIError) {
+	if auth.IsMachine(principal) {
+		prewarms.observe(principal.GetID(), versions, updated, errs)
+	}
+}
+
+type prewarmRegistry struct {
+	mu       sync.Mutex
+	prewarms map[string]*knox.Prewarm
+	now      func() time.Time
+}
+
+func newPrewarmRegistry() *prewarmRegistry {
+	return &prewarmRegistry{prewarms: map[string]*knox.Prewarm{}, now: time.Now}
+}
+
+func (r *prewarmRegistry) create(req knox.PrewarmRequest) (*knox.Prewarm, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	p := &knox.Prewarm{
+		ID:    hex.EncodeToString(b),
+		Keys:  append([]string{}, req.Keys...),
+		Hosts: make(map[string]knox.PrewarmHost, len(req.Hosts)),
+	}
+	sort.Strings(p.Keys)
+	for _, h := range req.Hosts {
+		p.Hosts[h] = knox.PrewarmHost{Pending: p.Keys}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.expire(now)
+	if len(r.prewarms) >= maxPrewarms {
+		return nil, fmt.Errorf("Too many prewarm requests, at most %d are kept", maxPrewarms)
+	}
+	p.Expires = now.Add(prewarmTTL)
+	r.prewarms[p.ID] = p
+	return copyPrewarm(p), nil
+}
+
+func (r *prewarmRegistry) get(id string) (*knox.Prewarm, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(r.now())
+	p, ok := r.prewarms[id]
+	if !ok {
+		return nil, false
+	}
+	return copyPrewarm(p), true
+}
+
+func (r *prewarmRegistry) expire(now time.Time) {
+	for id, p := range r.prewarms {
+		if !now.Before(p.Expires) {
+			delete(r.prewarms, id)
+		}
+	}
+}
+
+// register returns the keys being prewarmed on host that are missing from
+// versions, in order.
+func (r *prewarmRegistry) register(host string, versions map[string]string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(r.now())
+	missing := map[string]bool{}
+	for _, p := range r.prewarms {
+		if _, ok := p.Hosts[host]; !ok {
+			continue
+		}
+		for _, id := range p.Keys {
+			if _, ok := versions[id]; !ok {
+				missing[id] = true
+			}
+		}
+	}
+	ids := make([]string, 0, len(missing))
+	for id := range missing {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// observe records which of the keys being prewarmed on host it has, given
+// the versions it synced with, the keys whose version changed and the errors
+// returned for them.
+func (r *prewarmRegistry) observe(host string, versions map[string]string, updated []string, errs map[string]knox.APIError) {
+	stale := make(map[string]bool, len(updated))
+	for _, id := range updated {
+		stale[id] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, p := range r.prewarms {
+		if _, ok := p.Hosts[host]; !ok {
+			continue
+		}
+		h := knox.PrewarmHost{LastSync: now}
+		for _, id := range p.Keys {
+			if e, ok := errs[id]; ok {
+				if h.Errors == nil {
+					h.Errors = map[string]knox.APIError{}
+				}
+				h.Errors[id] = e
+			} else if versions[id] == "" || stale[id] {
+				h.Pending = append(h.Pending, id)
+			}
+		}
+		h.Ready = len(h.Pending) == 0 && len(h.Errors) == 0
+		p.Hosts[host] = h
+	}
+}
+
+// copyPrewarm copies p so it can be returned while the registry changes it,
+// and sets whether every host is ready.
+func copyPrewarm(p *knox.Prewarm) *knox.Prewarm {
+	c := *p
+	c.Hosts = make(map[string]knox.PrewarmHost, len(p.Hosts))
+	c.Ready = true
+	for h, s := range p.Hosts {
+		c.Hosts[h] = s
+		c.Ready = c.Ready && s.Ready
+	}
+	return &c
+}
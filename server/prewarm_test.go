@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestPrewarm(t *testing.T) {
+	prewarms = newPrewarmRegistry()
+	defer func() { prewarms = newPrewarmRegistry() }()
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	web1 := auth.NewMachine("web1")
+	web2 := auth.NewMachine("web2")
+	acl := `[{"type":"Machine","id":"web1","access":"Read"}]`
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "db", "data": "MQ==", "acl": acl}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	db, _ := m.GetKey("db", knox.Active)
+
+	_, err := postPrewarmHandler(m, u, map[string]string{"hosts": `["web1"]`, "keys": `["missing"]`})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected a missing key to be rejected, got %+v", err)
+	}
+	_, err = postPrewarmHandler(m, u, map[string]string{"hosts": `[]`, "keys": `["db"]`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected a request without hosts to be rejected, got %+v", err)
+	}
+	data, err := postPrewarmHandler(m, u, map[string]string{"hosts": `["web1","web2"]`, "keys": `["db"]`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	id := data.(*knox.Prewarm).ID
+
+	sync := func(p knox.Principal, versions string) knox.KeySync {
+		t.Helper()
+		data, err := syncKeysHandler(m, p, map[string]string{"versions": versions})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		return data.(knox.KeySync)
+	}
+	status := func() *knox.Prewarm {
+		t.Helper()
+		data, err := getPrewarmHandler(m, u, map[string]string{"prewarmID": id})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		return data.(*knox.Prewarm)
+	}
+
+	if s := sync(web1, `{}`); len(s.Register) != 1 || s.Register[0] != "db" {
+		t.Fatalf("Expected web1 to be asked to register db, got %+v", s.Register)
+	}
+	if s := sync(web1, `{"db":""}`); len(s.Register) != 0 || len(s.Keys) != 1 {
+		t.Fatalf("Expected db to be synced, got %+v", s)
+	}
+	if p := status(); p.Ready || p.Hosts["web1"].Ready || len(p.Hosts["web1"].Pending) != 1 {
+		t.Fatalf("Expected web1 to be pending until it has db, got %+v", p)
+	}
+	sync(web1, `{"db":"`+db.VersionHash+`"}`)
+	sync(web2, `{"db":""}`)
+	p := status()
+	if !p.Hosts["web1"].Ready || p.Hosts["web1"].LastSync.IsZero() {
+		t.Fatalf("Expected web1 to be ready, got %+v", p.Hosts["web1"])
+	}
+	if p.Ready || p.Hosts["web2"].Errors["db"].Code != knox.UnauthorizedCode {
+		t.Fatalf("Expected web2 to be denied db, got %+v", p)
+	}
+
+	// Users don't get keys to register, and other machines aren't affected.
+	if s := sync(u, `{}`); len(s.Register) != 0 {
+		t.Fatalf("Expected no keys to register for a user, got %+v", s.Register)
+	}
+	if s := sync(auth.NewMachine("web3"), `{}`); len(s.Register) != 0 {
+		t.Fatalf("Expected no keys to register for web3, got %+v", s.Register)
+	}
+
+	prewarms.now = func() time.Time { return time.Now().Add(prewarmTTL) }
+	if _, err := getPrewarmHandler(m, u, map[string]string{"prewarmID": id}); err == nil || err.Subcode != knox.NotFoundCode {
+		t.Fatalf("Expected the prewarm request to expire, got %+v", err)
+	}
+}
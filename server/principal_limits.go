@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/pinterest/knox"
+)
+
+// PrincipalLimitConfig configures a PrincipalLimiter.
+type PrincipalLimitConfig struct {
+	// MaxInFlight is the number of requests one principal may have in flight
+	// at once. Zero disables the limit.
+	MaxInFlight int
+	// Limit returns the limit for a principal, overriding MaxInFlight. It
+	// returns zero to use MaxInFlight and a negative number for no limit.
+	Limit func(p knox.Principal) int
+	// OnReject is called for each rejected request, e.g. to count it in a
+	// metrics system. Counts by principal over the life of the server belong
+	// there, the limiter only keeps them while the principal has requests in
+	// flight.
+	OnReject func(principal string, inFlight int)
+}
+
+// PrincipalLimitStats are the in-flight requests of each principal with
+// requests in flight and how many of that principal's requests were rejected
+// since its requests started, plus the total rejected since the limiter was
+// created.
+type PrincipalLimitStats struct {
+	InFlight      map[string]int    `json:"in_flight"`
+	Rejected      map[string]uint64 `json:"rejected"`
+	TotalRejected uint64            `json:"total_rejected"`
+}
+
+// PrincipalLimiter caps the requests each principal has in flight, so one
+// misbehaving machine opening thousands of simultaneous requests can't take
+// the keydb away from everyone else. Use it with the PrincipalLimits
+// decorator.
+type PrincipalLimiter struct {
+	config PrincipalLimitConfig
+
+	mu sync.Mutex
+	// inFlight only holds principals with requests in flight, so it doesn't
+	// grow with every principal ever seen.
+	inFlight      map[string]*principalFlight
+	totalRejected uint64
+}
+
+// principalFlight counts the requests of a principal in flight and the ones
+// rejected since they started.
+type principalFlight struct {
+	inFlight int
+	rejected uint64
+}
+
+// NewPrincipalLimiter creates a PrincipalLimiter.
+func NewPrincipalLimiter(c PrincipalLimitConfig) *PrincipalLimiter {
+	return &PrincipalLimiter{
+		config:   c,
+		inFlight: map[string]*principalFlight{},
+	}
+}
+
+// PrincipalLimits returns a decorator that rejects requests from principals
+// with too many requests in flight, with a TooManyRequestsCode error and a
+// Retry-After header. It must come after Authentication. Requests without a
+// principal are not limited.
+func PrincipalLimits(l *PrincipalLimiter) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			p := GetPrincipal(r)
+			if p == nil {
+				f(w, r)
+				return
+			}
+			limit := l.limit(p)
+			if limit <= 0 {
+				f(w, r)
+				return
+			}
+			id := p.GetID()
+			if !l.acquire(id, limit) {
+				w.Header().Set("Retry-After", "1")
+				WriteErr(errF(knox.TooManyRequestsCode, "Too many concurrent requests from "+id))(w, r)
+				return
+			}
+			defer l.release(id)
+			f(w, r)
+		}
+	}
+}
+
+func (l *PrincipalLimiter) limit(p knox.Principal) int {
+	if l.config.Limit != nil {
+		if limit := l.config.Limit(p); limit != 0 {
+			return limit
+		}
+	}
+	return l.config.MaxInFlight
+}
+
+func (l *PrincipalLimiter) acquire(id string, limit int) bool {
+	l.mu.Lock()
+	f := l.inFlight[id]
+	if f == nil {
+		f = &principalFlight{}
+		l.inFlight[id] = f
+	}
+	n := f.inFlight
+	if n < limit {
+		f.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	f.rejected++
+	l.totalRejected++
+	l.mu.Unlock()
+	if l.config.OnReject != nil {
+		l.config.OnReject(id, n)
+	}
+	return false
+}
+
+func (l *PrincipalLimiter) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.inFlight[id]
+	if f.inFlight <= 1 {
+		delete(l.inFlight, id)
+		return
+	}
+	f.inFlight--
+}
+
+// Stats returns a copy of the limiter's counters.
+func (l *PrincipalLimiter) Stats() PrincipalLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := PrincipalLimitStats{
+		InFlight:      make(map[string]int, len(l.inFlight)),
+		Rejected:      map[string]uint64{},
+		TotalRejected: l.totalRejected,
+	}
+	for id, f := range l.inFlight {
+		s.InFlight[id] = f.inFlight
+		if f.rejected > 0 {
+			s.Rejected[id] = f.rejected
+		}
+	}
+	return s
+}
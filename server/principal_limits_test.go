@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestPrincipalLimits(t *testing.T) {
+	var rejections int
+	l := NewPrincipalLimiter(PrincipalLimitConfig{
+		MaxInFlight: 1,
+		Limit: func(p knox.Principal) int {
+			if auth.IsUser(p) {
+				return -1
+			}
+			return 0
+		},
+		OnReject: func(string, int) { rejections++ },
+	})
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := PrincipalLimits(l)(func(w http.ResponseWriter, r *http.Request) {
+		if GetRouteID(r) == "slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(route string, p knox.Principal) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, shedRequest(route, p))
+		return w
+	}
+	machine := auth.NewMachine("machine1")
+
+	done := make(chan struct{})
+	go func() {
+		serve("slow", machine)
+		close(done)
+	}()
+	<-entered
+
+	w := serve("getkey", machine)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected a second request from the machine to be rejected, got %d", w.Code)
+	}
+	if w := serve("getkey", auth.NewMachine("machine2")); w.Code != http.StatusOK {
+		t.Fatalf("Expected another machine to be served, got %d", w.Code)
+	}
+	if w := serve("getkey", auth.NewUser("testuser", nil)); w.Code != http.StatusOK {
+		t.Fatalf("Expected an unlimited user to be served, got %d", w.Code)
+	}
+	if w := serve("getkey", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected a request without a principal to be served, got %d", w.Code)
+	}
+
+	s := l.Stats()
+	if s.InFlight["machine1"] != 1 || s.Rejected["machine1"] != 1 || s.TotalRejected != 1 || rejections != 1 {
+		t.Fatalf("Unexpected stats %+v", s)
+	}
+
+	close(release)
+	<-done
+	if w := serve("getkey", machine); w.Code != http.StatusOK {
+		t.Fatalf("Expected the machine to be served once its request finished, got %d", w.Code)
+	}
+	if s := l.Stats(); len(s.InFlight) != 0 || len(s.Rejected) != 0 || s.TotalRejected != 1 {
+		t.Fatalf("Expected only the total to be kept once no requests are in flight, got %+v", s)
+	}
+	if len(l.inFlight) != 0 {
+		t.Fatalf("Expected principals without requests in flight to be dropped, got %v", l.inFlight)
+	}
+}
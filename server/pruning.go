@@ -0,0 +1,137 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// pruneRouteID is the route of the audit events recorded for pruned versions.
+const pruneRouteID = "pruneversions"
+
+// VersionPruner removes old Inactive versions from keys so that their version
+// lists don't grow without bound. Primary and Active versions are never
+// removed, and neither are versions made Inactive less than MaxAge ago or
+// among the newest MaxInactive Inactive versions of a key.
+type VersionPruner struct {
+	// MaxAge removes versions that have been Inactive for longer, measured
+	// from their StatusTime, or from their CreationTime if it was never set.
+	// Zero keeps them regardless of age.
+	MaxAge time.Duration
+	// MaxInactive removes the oldest Inactive versions beyond this many per
+	// key. Zero keeps them regardless of count.
+	MaxInactive int
+	// Audit, if set, observes an event for every key versions are removed
+	// from, e.g. the AuditLog of the admin API.
+	Audit AccessAnalyzer
+
+	now func() time.Time
+}
+
+// PrunedVersions are the versions the pruner removed from a key.
+type PrunedVersions struct {
+	KeyID      string
+	VersionIDs []uint64
+}
+
+// Run prunes the versions of every key once and returns what it removed.
+// Keys that fail to update, e.g. because they changed concurrently, are
+// logged and left for the next run.
+func (p *VersionPruner) Run(m KeyManager) ([]PrunedVersions, error) {
+	if p.MaxAge <= 0 && p.MaxInactive <= 0 {
+		return nil, nil
+	}
+	ids, err := m.GetAllKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	var pruned []PrunedVersions
+	for _, id := range ids {
+		key, err := m.GetKey(id, knox.Inactive)
+		if err != nil {
+			if err == knox.ErrKeyIDNotFound {
+				continue
+			}
+			return pruned, err
+		}
+		versionIDs := p.prunable(key.VersionList, now)
+		if len(versionIDs) == 0 {
+			continue
+		}
+		err = m.RemoveVersions(id, versionIDs...)
+		if p.Audit != nil {
+			p.Audit.Observe(AccessEvent{
+				Principal:     "knox",
+				PrincipalType: "server",
+				RouteID:       pruneRouteID,
+				KeyID:         id,
+				Success:       err == nil,
+				Time:          time.Now(),
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to prune versions %v of key %s: %s", versionIDs, id, err.Error())
+			continue
+		}
+		log.Printf("Pruned inactive versions %v of key %s", versionIDs, id)
+		pruned = append(pruned, PrunedVersions{KeyID: id, VersionIDs: versionIDs})
+	}
+	return pruned, nil
+}
+
+// prunable returns the IDs of the Inactive versions to remove.
+func (p *VersionPruner) prunable(kvl knox.KeyVersionList, now time.Time) []uint64 {
+	var inactive knox.KeyVersionList
+	for _, v := range kvl {
+		if v.Status == knox.Inactive {
+			inactive = append(inactive, v)
+		}
+	}
+	// Newest first, so the versions kept by MaxInactive come first.
+	sort.SliceStable(inactive, func(i, j int) bool {
+		if inactive[i].CreationTime != inactive[j].CreationTime {
+			return inactive[i].CreationTime > inactive[j].CreationTime
+		}
+		return inactive[i].ID > inactive[j].ID
+	})
+	var ids []uint64
+	for i, v := range inactive {
+		tooMany := p.MaxInactive > 0 && i >= p.MaxInactive
+		inactiveSince := v.StatusTime
+		if inactiveSince == 0 {
+			inactiveSince = v.CreationTime
+		}
+		tooOld := p.MaxAge > 0 && now.Sub(time.Unix(0, inactiveSince)) > p.MaxAge
+		if tooMany || tooOld {
+			ids = append(ids, v.ID)
+		}
+	}
+	return ids
+}
+
+// Start runs the pruner every interval in a new goroutine until the returned
+// function is called.
+func (p *VersionPruner) Start(m KeyManager, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := p.Run(m); err != nil {
+					log.Printf("Version pruning failed: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
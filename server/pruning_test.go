@@ -0,0 +1,90 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestVersionPruner(t *testing.T) {
+	m, u, acl := GetMocks()
+	key := newKey("id1", acl, []byte("data"), u, nil)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Inactive versions created 1, 2 and 3 days ago and an Active one.
+	var inactive []uint64
+	for days := 1; days <= 4; days++ {
+		v := newKeyVersion([]byte{byte(days)}, knox.Active)
+		v.CreationTime = time.Now().Add(-time.Duration(days) * 24 * time.Hour).UnixNano()
+		if err := m.AddVersion("id1", &v); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if days == 4 {
+			break
+		}
+		if err := m.UpdateVersion("id1", v.ID, knox.Inactive); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		inactive = append(inactive, v.ID)
+	}
+	active, _ := m.GetKey("id1", knox.Active)
+
+	if err := m.RemoveVersions("id1", active.VersionList[0].ID); err != knox.ErrRemoveNotInactive {
+		t.Fatalf("Expected only inactive versions to be removable, got %v", err)
+	}
+	if err := m.RemoveVersions("id1", inactive[0], 12345); err != knox.ErrKeyVersionNotFound {
+		t.Fatalf("Expected a missing version to be reported, got %v", err)
+	}
+
+	// The inactive versions are days old but were only just deactivated.
+	audit := NewAuditLog(10)
+	p := &VersionPruner{MaxAge: 60 * time.Hour, Audit: audit}
+	pruned, err := p.Run(m)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(pruned) != 0 {
+		t.Fatalf("Expected just deactivated versions to be kept, got %+v", pruned)
+	}
+
+	p = &VersionPruner{MaxInactive: 1, Audit: audit}
+	if pruned, _ = p.Run(m); len(pruned) != 1 || len(pruned[0].VersionIDs) != 2 {
+		t.Fatalf("Expected the 2 older inactive versions to be pruned, got %+v", pruned)
+	}
+	for _, id := range pruned[0].VersionIDs {
+		if id == inactive[0] {
+			t.Fatalf("Expected the newest inactive version to be kept, got %+v", pruned)
+		}
+	}
+	if events := audit.Events("", "id1", 10); len(events) != 1 || events[0].RouteID != pruneRouteID || !events[0].Success {
+		t.Fatalf("Unexpected audit events %+v", events)
+	}
+
+	later := time.Now().Add(61 * time.Hour)
+	p = &VersionPruner{MaxAge: 60 * time.Hour, now: func() time.Time { return later }}
+	if pruned, _ = p.Run(m); len(pruned) != 1 || len(pruned[0].VersionIDs) != 1 || pruned[0].VersionIDs[0] != inactive[0] {
+		t.Fatalf("Expected the version inactive for 61 hours to be pruned, got %+v", pruned)
+	}
+	k, _ := m.GetKey("id1", knox.Inactive)
+	if len(k.VersionList) != 2 || k.VersionHash != k.VersionList.Hash() {
+		t.Fatalf("Unexpected versions %+v", k.VersionList)
+	}
+	if pruned, _ = p.Run(m); len(pruned) != 0 {
+		t.Fatalf("Expected nothing left to prune, got %+v", pruned)
+	}
+}
+
+func TestVersionPrunerAgeWithoutStatusTime(t *testing.T) {
+	now := time.Now()
+	kvl := knox.KeyVersionList{
+		{ID: 1, Status: knox.Primary, CreationTime: now.Add(-72 * time.Hour).UnixNano()},
+		{ID: 2, Status: knox.Inactive, CreationTime: now.Add(-72 * time.Hour).UnixNano()},
+		{ID: 3, Status: knox.Inactive, CreationTime: now.Add(-72 * time.Hour).UnixNano(), StatusTime: now.Add(-time.Hour).UnixNano()},
+	}
+	p := &VersionPruner{MaxAge: 60 * time.Hour}
+	if ids := p.prunable(kvl, now); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Expected only the version without a status time to be pruned, got %v", ids)
+	}
+}
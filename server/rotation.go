@@ -0,0 +1,48 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/pinterest/knox"
+)
+
+// RotationPlugin is run before a version becomes the Primary of a key, either
+// through a promotion or a Scheduled activation. It can be used to make the
+// new secret valid in an external system first; returning an error aborts
+// the promotion.
+type RotationPlugin interface {
+	BeforePromote(key *knox.Key, version *knox.KeyVersion) error
+}
+
+var rotationPluginsMu sync.Mutex
+var rotationPlugins []RotationPlugin
+
+// AddRotationPlugin registers a plugin that runs before every promotion by
+// KeyManagers made with NewKeyManager or GetRouter. Plugins should be added
+// before serving.
+//
+// Deprecated: Set KeyManagerOptions.RotationPlugins and use
+// NewKeyManagerWithOptions.
+func AddRotationPlugin(p RotationPlugin) {
+	rotationPluginsMu.Lock()
+	defer rotationPluginsMu.Unlock()
+	rotationPlugins = append(rotationPlugins, p)
+}
+
+// addedRotationPlugins returns a copy of the plugins added with
+// AddRotationPlugin.
+func addedRotationPlugins() []RotationPlugin {
+	rotationPluginsMu.Lock()
+	defer rotationPluginsMu.Unlock()
+	return append([]RotationPlugin(nil), rotationPlugins...)
+}
+
+// beforePromote runs plugins in order, stopping at the first error.
+func beforePromote(plugins []RotationPlugin, key *knox.Key, version *knox.KeyVersion) error {
+	for _, p := range plugins {
+		if err := p.BeforePromote(key, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
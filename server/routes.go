@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/log"
 	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
 )
 
 var routes = [...]Route{
@@ -24,13 +28,57 @@ var routes = [...]Route{
 	},
 	{
 		Method:  "POST",
-		Id:      "postkeys",
-		Path:    "/v0/keys/",
-		Handler: postKeysHandler,
+		Id:      "synckeys",
+		Path:    "/v0/sync/",
+		Handler: syncKeysHandler,
+		Parameters: []Parameter{
+			ValidatedParameter{Parameter: PostParameter("versions"), Type: JSONParam, Required: true},
+		},
+	},
+	{
+		Method:     "POST",
+		Id:         "postkeys",
+		Path:       "/v0/keys/",
+		Handler:    idempotent("postkeys", postKeysHandler),
+		Principals: []PrincipalKind{UserPrincipal},
 		Parameters: []Parameter{
-			PostParameter("id"),
-			PostParameter("data"),
-			PostParameter("acl"),
+			ValidatedParameter{Parameter: PostParameter("id"), Required: true, MaxLength: maxKeyIDLength, Code: knox.NoKeyIDCode},
+			ValidatedParameter{Parameter: PostParameter("data"), Type: Base64Param, Required: true, Code: knox.NoKeyDataCode},
+			ValidatedParameter{Parameter: PostParameter("acl"), Type: JSONParam},
+			ValidatedParameter{Parameter: PostParameter("metadata"), Type: JSONParam},
+			ValidatedParameter{Parameter: PostParameter("content_type"), MaxLength: 129},
+			ValidatedParameter{Parameter: HeaderParameter("Idempotency-Key"), MaxLength: 128},
+			ValidatedParameter{Parameter: PostParameter("idempotency_key"), MaxLength: 128},
+		},
+	},
+	{
+		Method:    "PUT",
+		Id:        "putlock",
+		Path:      "/v0/keys/{keyID}/lock/",
+		Handler:   putLockHandler,
+		KeyAccess: knox.Admin,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			PostParameter("message"),
+		},
+	},
+	{
+		Method:    "DELETE",
+		Id:        "deletelock",
+		Path:      "/v0/keys/{keyID}/lock/",
+		Handler:   deleteLockHandler,
+		KeyAccess: knox.Admin,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "searchkeys",
+		Path:    "/v0/keys/search",
+		Handler: searchKeysHandler,
+		Parameters: []Parameter{
+			RawQueryParameter("queryString"),
 		},
 	},
 
@@ -41,14 +89,31 @@ var routes = [...]Route{
 		Handler: getKeyHandler,
 		Parameters: []Parameter{
 			UrlParameter("keyID"),
-			QueryParameter("status"),
+			ValidatedParameter{Parameter: QueryParameter("status"), Type: StatusParam},
 		},
 	},
 	{
-		Method:  "DELETE",
-		Id:      "deletekey",
-		Path:    "/v0/keys/{keyID}/",
-		Handler: deleteKeyHandler,
+		Method:    "DELETE",
+		Id:        "deletekey",
+		Path:      "/v0/keys/{keyID}/",
+		Handler:   deleteKeyHandler,
+		KeyAccess: knox.Admin,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+		},
+	},
+	{
+		Method:  "GET",
+		Id:      "getdeletedkeys",
+		Path:    "/v0/deleted/",
+		Handler: getDeletedKeysHandler,
+	},
+	{
+		Method:    "POST",
+		Id:        "restorekey",
+		Path:      "/v0/deleted/{keyID}/",
+		Handler:   restoreKeyHandler,
+		Authorize: authorizeDeletedKey,
 		Parameters: []Parameter{
 			UrlParameter("keyID"),
 		},
@@ -63,35 +128,79 @@ var routes = [...]Route{
 		},
 	},
 	{
-		Method:  "PUT",
-		Id:      "putaccess",
-		Path:    "/v0/keys/{keyID}/access/",
-		Handler: putAccessHandler,
+		Method:    "PUT",
+		Id:        "putaccess",
+		Path:      "/v0/keys/{keyID}/access/",
+		Handler:   putAccessHandler,
+		KeyAccess: knox.Admin,
 		Parameters: []Parameter{
 			UrlParameter("keyID"),
 			PostParameter("access"),
-			PostParameter("acl"),
+			ValidatedParameter{Parameter: PostParameter("acl"), Type: JSONParam},
+			ValidatedParameter{Parameter: PostParameter("precondition_version_hash"), MaxLength: 128},
 		},
 	},
 	{
-		Method:  "POST",
-		Id:      "postversion",
-		Path:    "/v0/keys/{keyID}/versions/",
-		Handler: postVersionHandler,
+		Method:    "POST",
+		Id:        "planaccess",
+		Path:      "/v0/keys/{keyID}/access/plan/",
+		Handler:   planAccessHandler,
+		KeyAccess: knox.Admin,
 		Parameters: []Parameter{
 			UrlParameter("keyID"),
-			PostParameter("data"),
+			PostParameter("access"),
+			ValidatedParameter{Parameter: PostParameter("acl"), Type: JSONParam},
+			ValidatedParameter{Parameter: PostParameter("principals"), Type: JSONParam, Required: true},
 		},
 	},
 	{
-		Method:  "PUT",
-		Id:      "putversion",
-		Path:    "/v0/keys/{keyID}/versions/{versionID}/",
-		Handler: putVersionsHandler,
+		Method:    "PUT",
+		Id:        "putmetadata",
+		Path:      "/v0/keys/{keyID}/metadata/",
+		Handler:   putMetadataHandler,
+		KeyAccess: knox.Admin,
 		Parameters: []Parameter{
 			UrlParameter("keyID"),
-			UrlParameter("versionID"),
-			PostParameter("status"),
+			ValidatedParameter{Parameter: PostParameter("metadata"), Type: JSONParam, Required: true},
+		},
+	},
+	{
+		Method:    "POST",
+		Id:        "postversion",
+		Path:      "/v0/keys/{keyID}/versions/",
+		Handler:   idempotent("postversion", postVersionHandler),
+		KeyAccess: knox.Write,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			ValidatedParameter{Parameter: PostParameter("data"), Type: Base64Param, Required: true},
+			ValidatedParameter{Parameter: PostParameter("activation"), Type: TimeParam},
+			ValidatedParameter{Parameter: PostParameter("content_type"), MaxLength: 129},
+			ValidatedParameter{Parameter: HeaderParameter("Idempotency-Key"), MaxLength: 128},
+			ValidatedParameter{Parameter: PostParameter("idempotency_key"), MaxLength: 128},
+			ValidatedParameter{Parameter: PostParameter("precondition_version_hash"), MaxLength: 128},
+		},
+	},
+	{
+		Method:    "POST",
+		Id:        "rotatekey",
+		Path:      "/v0/keys/{keyID}/rotate/",
+		Handler:   rotateKeyHandler,
+		KeyAccess: knox.Write,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			ValidatedParameter{Parameter: PostParameter("promote"), Type: BoolParam},
+		},
+	},
+	{
+		Method:    "PUT",
+		Id:        "putversion",
+		Path:      "/v0/keys/{keyID}/versions/{versionID}/",
+		Handler:   putVersionsHandler,
+		KeyAccess: knox.Write,
+		Parameters: []Parameter{
+			UrlParameter("keyID"),
+			ValidatedParameter{Parameter: UrlParameter("versionID"), Type: UintParam, Required: true},
+			ValidatedParameter{Parameter: PostParameter("status"), Type: StatusParam, Required: true},
 		},
 	},
 }
@@ -133,28 +242,64 @@ func getKeysHandler(m KeyManager, principal knox.Principal, parameters map[strin
 	return keys, nil
 }
 
+// maxSyncKeys is the number of keys a sync request may ask about.
+const maxSyncKeys = 10000
+
+// syncKeysHandler returns the keys whose version hash differs from the one
+// given for them in versions, so clients get all changed keys in one round
+// trip. Every key is read as by getKeyHandler; keys that can't be read are
+// reported in the Errors of the response instead.
+// The route for this handler is POST /v0/sync/
+// Authorization is checked for each key.
+func syncKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	versions := map[string]string{}
+	if err := json.Unmarshal([]byte(parameters["versions"]), &versions); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	if len(versions) > maxSyncKeys {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("At most %d keys can be synced at once", maxSyncKeys))
+	}
+	result := knox.KeySync{Keys: []knox.Key{}, Register: syncPrewarms(principal, versions)}
+	var ids []string
+	if len(versions) > 0 {
+		var err error
+		if ids, err = m.GetUpdatedKeyIDs(versions); err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+	}
+	sort.Strings(ids)
+	var warnings []string
+	for _, id := range ids {
+		data, keyErr := getKeyHandler(m, principal, map[string]string{"keyID": id})
+		if keyErr != nil {
+			if result.Errors == nil {
+				result.Errors = map[string]knox.APIError{}
+			}
+			result.Errors[id] = knox.APIError{Code: keyErr.Subcode, Message: keyErr.Message}
+			continue
+		}
+		if wd, ok := data.(withWarnings); ok {
+			data, warnings = wd.data, append(warnings, wd.warnings...)
+		}
+		result.Keys = append(result.Keys, *data.(*knox.Key))
+	}
+	observePrewarms(principal, versions, ids, result.Errors)
+	return addWarnings(result, warnings...), nil
+}
+
 // postKeysHandler creates a new key and stores it. It reads from the post data
 // key ID, base64 encoded data, and JSON encoded ACL.
 // It returns the key version ID of the original Primary key version.
 // The route for this handler is POST /v0/keys/
-// The postKeysHandler must be a User.
+// The route only allows users.
 func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
-
-	// Authorize
-	if !auth.IsUser(principal) {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a user to create keys, principal is %s", principal.GetID()))
-	}
-
 	keyID, keyIDOK := parameters["id"]
 	if !keyIDOK {
 		return nil, errF(knox.NoKeyIDCode, "Missing parameter 'id'")
 	}
-	data, dataOK := parameters["data"]
-	if !dataOK {
-		return nil, errF(knox.NoKeyDataCode, "Missing parameter 'data'")
-	}
-	if data == "" {
-		return nil, errF(knox.NoKeyDataCode, "Parameter 'data' is empty")
+	decodedData, dataErr := dataParam(parameters, knox.NoKeyDataCode)
+	if dataErr != nil {
+		return nil, dataErr
 	}
 	aclStr, aclOK := parameters["acl"]
 
@@ -166,13 +311,30 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 		}
 	}
 
-	decodedData, decodeErr := base64.StdEncoding.DecodeString(data)
-	if decodeErr != nil {
-		return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
+	var metadata knox.KeyMetadata
+	if mdStr, mdOK := parameters["metadata"]; mdOK {
+		jsonErr := json.Unmarshal([]byte(mdStr), &metadata)
+		if jsonErr != nil {
+			return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+		}
+	}
+
+	contentType, ctErr := contentTypeParam(parameters, decodedData)
+	if ctErr != nil {
+		return nil, ctErr
+	}
+	report, strengthErr := analyzeStrength(optionsOf(m), decodedData)
+	if strengthErr != nil {
+		return nil, strengthErr
 	}
 
 	// Create and add new key
-	key := newKey(keyID, acl, decodedData, principal)
+	key := newKey(keyID, acl, decodedData, principal, optionsOf(m).DefaultAccess)
+	key.VersionList[0].ContentType = contentType
+	key.Metadata = knox.KeyMetadata(nil).Update(metadata)
+	if report != nil {
+		key.Metadata = key.Metadata.Update(report.Metadata())
+	}
 	err := m.AddNewKey(&key)
 	if err != nil {
 		if err == knox.ErrKeyExists {
@@ -181,10 +343,46 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 		if err == knox.ErrInvalidKeyID {
 			return nil, errF(knox.BadKeyFormatCode, fmt.Sprintf("KeyID includes unsupported characters %s", keyID))
 		}
+		if err == knox.ErrInvalidMetadataKey || err == knox.ErrInvalidGraceWindow || err == knox.ErrInvalidMaxReads || err == knox.ErrInvalidExpiry {
+			return nil, errF(knox.BadRequestDataCode, err.Error())
+		}
 
-		return nil, errF(knox.InternalServerErrorCode, err.Error())
+		return nil, keyManagerErr(err)
 	}
-	return key.VersionList[0].ID, nil
+	result := withStrengthWarnings(report, key.VersionList[0].ID)
+	return withDuplicateDataWarnings(m, principal, keyID, decodedData, result), nil
+}
+
+// withStrengthWarnings attaches the problems found by strength analysis to data.
+func withStrengthWarnings(report *StrengthReport, data interface{}) interface{} {
+	if report == nil {
+		return data
+	}
+	return addWarnings(data, report.Problems...)
+}
+
+// withDuplicateDataWarnings attaches a warning to data if duplicate data
+// warnings are enabled and keyData matches a version of another key that the
+// principal can read. Failures to check are ignored since the write succeeded.
+func withDuplicateDataWarnings(m KeyManager, principal knox.Principal, keyID string, keyData []byte, data interface{}) interface{} {
+	if !optionsOf(m).DuplicateDataWarnings {
+		return data
+	}
+	keys, err := m.FindKeysWithData(keyData)
+	if err != nil {
+		log.Printf("Failed to check for duplicate key data: %s", err.Error())
+		return data
+	}
+	var warnings []string
+	for _, k := range keys {
+		if k.ID == keyID {
+			continue
+		}
+		if ok, err := authorizeRequest(k, principal, knox.Read); err == nil && ok {
+			warnings = append(warnings, fmt.Sprintf("Key data is the same as a version of key %s, secrets should not be shared between keys", k.ID))
+		}
+	}
+	return addWarnings(data, warnings...)
 }
 
 // getKeyHandler gets the key matching the keyID in the request.
@@ -193,13 +391,9 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 func getKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
 	keyID := parameters["keyID"]
 
-	status := knox.Active
-	statusStr, statusOK := parameters["status"]
-	if statusOK {
-		statusErr := status.UnmarshalJSON([]byte(statusStr))
-		if statusErr != nil {
-			return nil, errF(knox.BadRequestDataCode, statusErr.Error())
-		}
+	status, statusErr := statusParam(parameters, knox.Active)
+	if statusErr != nil {
+		return nil, statusErr
 	}
 
 	// Get data
@@ -213,6 +407,9 @@ func getKeyHandler(m KeyManager, principal knox.Principal, parameters map[string
 
 	// Authorize access to data
 	authorized, authzErr := authorizeRequest(key, principal, knox.Read)
+	if key.Metadata.IsHoneytoken() {
+		notifyHoneytokenRead(optionsOf(m).Notifier, keyID, principal, authorized && authzErr == nil)
+	}
 	if authzErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
 	}
@@ -221,8 +418,38 @@ func getKeyHandler(m KeyManager, principal knox.Principal, parameters map[string
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to read %s", principal.GetID(), keyID))
 	}
 
+	if msg, locked := key.Metadata.LockMessage(); locked {
+		return nil, errF(knox.KeyLockedCode, fmt.Sprintf("Key %s is locked: %s", keyID, msg))
+	}
+
+	expiresAt, expires := key.Metadata.ExpiresAt()
+	if expires && !time.Now().Before(expiresAt) {
+		return nil, errF(knox.KeyExpiredCode, fmt.Sprintf("Key %s expired at %s", keyID, expiresAt.Format(time.RFC3339)))
+	}
+
+	if _, limited := key.Metadata.RemainingReads(); limited {
+		remaining, err := m.ConsumeRead(keyID)
+		switch err {
+		case nil:
+		case knox.ErrKeyReadsExhausted:
+			return nil, errF(knox.KeyReadsExhaustedCode, fmt.Sprintf("Key %s has no reads remaining", keyID))
+		default:
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		if remaining == 0 {
+			notifyReadsExhausted(optionsOf(m).Notifier, keyID, principal)
+		}
+		max, _ := strconv.Atoi(key.Metadata[knox.MetadataMaxReads])
+		key.Metadata = key.Metadata.Update(knox.KeyMetadata{
+			knox.MetadataReadCount: strconv.Itoa(max - remaining),
+		})
+	}
+
 	// Zero ACL for key response, in order to avoid caching unnecessarily
 	key.ACL = knox.ACL{}
+	if expires && time.Until(expiresAt) < expiryWarningOf(optionsOf(m)) {
+		return addWarnings(key, fmt.Sprintf("Key %s expires at %s", keyID, expiresAt.Format(time.RFC3339))), nil
+	}
 	return key, nil
 }
 
@@ -232,28 +459,83 @@ func getKeyHandler(m KeyManager, principal knox.Principal, parameters map[string
 func deleteKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
 	keyID := parameters["keyID"]
 
-	key, getErr := m.GetKey(keyID, knox.Primary)
-	if getErr != nil {
-		if getErr == knox.ErrKeyIDNotFound {
-			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
-		}
-		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	if _, keyErr := getKey(m, keyID, knox.Primary); keyErr != nil {
+		return nil, keyErr
 	}
 
-	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Admin)
-	if authzErr != nil {
-		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
+	// Delete the key
+	err := m.DeleteKey(keyID)
+	if err != nil {
+		return nil, keyManagerErr(err)
 	}
+	return nil, nil
+}
 
-	if !authorized {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to delete %s", principal.GetID(), keyID))
+// deletedKeysErr is the response for an error listing or restoring deleted
+// keys.
+func deletedKeysErr(keyID string, err error) *HTTPError {
+	switch err {
+	case keydb.ErrNoTombstones:
+		return errF(knox.NotYetImplementedCode, err.Error())
+	case knox.ErrKeyIDNotFound:
+		return errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No deleted key %s", keyID))
+	case knox.ErrKeyExists:
+		return errF(knox.KeyIdentifierExistsCode, fmt.Sprintf("Key %s was created since it was deleted", keyID))
+	}
+	return errF(knox.InternalServerErrorCode, err.Error())
+}
+
+// getDeletedKeysHandler lists the deleted keys the principal can restore.
+// The route for this handler is GET /v0/deleted/
+// Only keys the principal had Admin access to are listed.
+func getDeletedKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	deleted, err := m.GetDeletedKeys()
+	if err != nil {
+		return nil, deletedKeysErr("", err)
+	}
+	visible := []knox.DeletedKey{}
+	for _, d := range deleted {
+		authorized, authzErr := authorizeRequest(&knox.Key{ID: d.ID, ACL: d.ACL}, principal, knox.Admin)
+		if authzErr != nil {
+			return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
+		}
+		if authorized {
+			visible = append(visible, d)
+		}
 	}
+	return visible, nil
+}
 
-	// Delete the key
-	err := m.DeleteKey(keyID)
+// authorizeDeletedKey requires Admin access in the ACL a deleted key had.
+func authorizeDeletedKey(m KeyManager, principal knox.Principal, parameters map[string]string) *HTTPError {
+	keyID := parameters["keyID"]
+	deleted, err := m.GetDeletedKeys()
 	if err != nil {
-		return nil, errF(knox.InternalServerErrorCode, err.Error())
+		return deletedKeysErr(keyID, err)
+	}
+	for _, d := range deleted {
+		if d.ID != keyID {
+			continue
+		}
+		authorized, authzErr := authorizeRequest(&knox.Key{ID: d.ID, ACL: d.ACL}, principal, knox.Admin)
+		if authzErr != nil {
+			return errF(knox.InternalServerErrorCode, authzErr.Error())
+		}
+		if !authorized {
+			return errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to restore %s", principal.GetID(), keyID))
+		}
+		return nil
+	}
+	return deletedKeysErr(keyID, knox.ErrKeyIDNotFound)
+}
+
+// restoreKeyHandler restores a deleted key as it was when it was deleted.
+// The route for this handler is POST /v0/deleted/<key_id>/
+// The principal needs Admin access in the ACL of the deleted key.
+func restoreKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+	if err := m.RestoreKey(keyID); err != nil {
+		return nil, deletedKeysErr(keyID, err)
 	}
 	return nil, nil
 }
@@ -288,6 +570,46 @@ func getAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
 	keyID := parameters["keyID"]
 
+	acl, aclErr := aclChangesParam(parameters)
+	if aclErr != nil {
+		return nil, aclErr
+	}
+
+	key, keyErr := getKey(m, keyID, knox.Primary)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if hashErr := checkVersionHash(key, parameters); hashErr != nil {
+		return nil, hashErr
+	}
+
+	if err := validateACLChanges(acl, optionsOf(m).PrincipalValidators); err != nil {
+		return nil, err
+	}
+
+	// Update Access
+	updateErr := m.IfVersionHash(parameters["precondition_version_hash"]).UpdateAccess(keyID, acl...)
+	if updateErr != nil {
+		return nil, keyManagerErr(updateErr)
+	}
+	return nil, nil
+}
+
+// checkVersionHash rejects a change when the precondition_version_hash
+// parameter is set and differs from the key's version hash, so automation can
+// assert that it is changing the key it last read. It fails early, the change
+// itself is made with KeyManager.IfVersionHash so it can't race with another.
+func checkVersionHash(key *knox.Key, parameters map[string]string) *HTTPError {
+	want := parameters["precondition_version_hash"]
+	if want == "" || want == key.VersionHash {
+		return nil
+	}
+	return errF(knox.KeyVersionHashMismatchCode, fmt.Sprintf("Key %s has version hash %s, not %s", key.ID, key.VersionHash, want))
+}
+
+// aclChangesParam parses the ACL entries to apply from either the access
+// parameter, a single entry, or the acl parameter, a list of entries.
+func aclChangesParam(parameters map[string]string) ([]knox.Access, *HTTPError) {
 	accessStr, accessOK := parameters["access"]
 	aclStr, aclOK := parameters["acl"]
 
@@ -315,95 +637,315 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 	} else {
 		return nil, errF(knox.BadRequestDataCode, "Missing acl and access parameters")
 	}
+	return acl, nil
+}
 
-	// Get the Key
-	key, getErr := m.GetKey(keyID, knox.Primary)
-	if getErr != nil {
-		if getErr == knox.ErrKeyIDNotFound {
-			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
-		}
-		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
-	}
-
-	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Admin)
-	if authzErr != nil {
-		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
-	}
-
-	if !authorized {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update access for %s", principal.GetID(), keyID))
-	}
-
+// validateACLChanges checks the principal IDs of entries that grant access.
+func validateACLChanges(acl []knox.Access, validators []knox.PrincipalValidator) *HTTPError {
 	for _, access := range acl {
 		// If access type change is not "None" (i.e. we're adding, not deleting, an ACL entry) then
 		// we apply validation on the ID string to make sure it conforms to the expectations of the
 		// particular principal type. We do this to block empty machines prefixes and other invalid
 		// or bad entries.
 		if access.AccessType != knox.None {
-			principalErr := access.Type.IsValidPrincipal(access.ID, extraPrincipalValidators)
+			principalErr := access.Type.IsValidPrincipal(access.ID, validators)
 			if principalErr != nil {
-				return nil, errF(knox.BadPrincipalIdentifier, principalErr.Error())
+				return errF(knox.BadPrincipalIdentifier, principalErr.Error())
 			}
 		}
 	}
+	return nil
+}
 
-	// Update Access
-	updateErr := m.UpdateAccess(keyID, acl...)
-	if updateErr != nil {
-		return nil, errF(knox.InternalServerErrorCode, updateErr.Error())
+// planAccessHandler reports how an ACL change would affect the access of the
+// given principals without applying it. It takes the same access or acl
+// parameters as putAccessHandler and a JSON list of knox.PlanPrincipal.
+// The route for this handler is POST /v0/keys/<key_id>/access/plan/
+// The route requires Admin access to the key.
+func planAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+	acl, aclErr := aclChangesParam(parameters)
+	if aclErr != nil {
+		return nil, aclErr
 	}
-	return nil, nil
+	if err := validateACLChanges(acl, optionsOf(m).PrincipalValidators); err != nil {
+		return nil, err
+	}
+	var planPrincipals []knox.PlanPrincipal
+	if err := json.Unmarshal([]byte(parameters["principals"]), &planPrincipals); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+
+	key, keyErr := getKey(m, keyID, knox.Primary)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	after := *key
+	after.ACL = append(knox.ACL{}, key.ACL...)
+	for _, a := range acl {
+		after.ACL = after.ACL.Add(a)
+	}
+	if err := after.ACL.Validate(); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+
+	plan := &knox.ACLPlan{ACL: after.ACL, Changes: []knox.AccessChange{}}
+	for _, pp := range planPrincipals {
+		p, err := planPrincipal(pp)
+		if err != nil {
+			return nil, errF(knox.BadPrincipalIdentifier, err.Error())
+		}
+		before, err := highestAccess(key, p)
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		afterAccess, err := highestAccess(&after, p)
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		if before != afterAccess {
+			plan.Changes = append(plan.Changes, knox.AccessChange{Principal: pp, Before: before, After: afterAccess})
+		}
+	}
+	return plan, nil
+}
+
+// planPrincipal builds the principal described in an ACL plan request.
+func planPrincipal(p knox.PlanPrincipal) (knox.Principal, error) {
+	switch p.Type {
+	case "user":
+		return auth.NewUser(p.ID, p.Groups), nil
+	case "machine":
+		return auth.NewMachine(p.ID), nil
+	case "service":
+		domain, path, ok := strings.Cut(strings.TrimPrefix(p.ID, "spiffe://"), "/")
+		if !strings.HasPrefix(p.ID, "spiffe://") || !ok || domain == "" || path == "" {
+			return nil, fmt.Errorf("Service %q is not a valid SPIFFE ID", p.ID)
+		}
+		return auth.NewService(domain, path), nil
+	}
+	return nil, fmt.Errorf("Unknown principal type %q, must be user, machine or service", p.Type)
+}
+
+// highestAccess returns the highest access the principal has to the key,
+// including access granted by the access callback.
+func highestAccess(key *knox.Key, p knox.Principal) (knox.AccessType, error) {
+	for _, a := range []knox.AccessType{knox.Admin, knox.Write, knox.Read} {
+		ok, err := authorizeRequest(key, p, a)
+		if err != nil {
+			return knox.None, err
+		}
+		if ok {
+			return a, nil
+		}
+	}
+	return knox.None, nil
+}
+
+// searchKeysHandler returns the IDs of keys matching the search parameters.
+// Supported parameters are owner, tag (repeatable, either "name" or
+// "name:value"), created_after, and created_before. Times are RFC 3339 or
+// Unix seconds.
+// The route for this handler is GET /v0/keys/search
+// There are no authorization constraints on this route.
+func searchKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	query, parseErr := url.ParseQuery(parameters["queryString"])
+	if parseErr != nil {
+		return nil, errF(knox.BadRequestDataCode, parseErr.Error())
+	}
+
+	q := KeySearch{Owner: query.Get("owner")}
+	for _, tag := range query["tag"] {
+		if q.Tags == nil {
+			q.Tags = knox.KeyMetadata{}
+		}
+		name, value, _ := strings.Cut(tag, ":")
+		q.Tags[name] = value
+	}
+	var timeErr error
+	if q.CreatedAfter, timeErr = parseTimeParam(query.Get("created_after")); timeErr != nil {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid created_after: %s", timeErr.Error()))
+	}
+	if q.CreatedBefore, timeErr = parseTimeParam(query.Get("created_before")); timeErr != nil {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid created_before: %s", timeErr.Error()))
+	}
+
+	keys, err := m.SearchKeyIDs(q)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return keys, nil
+}
+
+// parseTimeParam converts an RFC 3339 or Unix seconds timestamp into Unix nanoseconds.
+func parseTimeParam(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UnixNano(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+// putMetadataHandler merges the JSON object in the metadata parameter into the
+// key's metadata. Entries with an empty value are removed.
+// The route for this handler is PUT /v0/keys/<key_id>/metadata/
+// The principal needs Admin access.
+func putMetadataHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+
+	mdStr, mdOK := parameters["metadata"]
+	if !mdOK {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'metadata'")
+	}
+	var metadata knox.KeyMetadata
+	jsonErr := json.Unmarshal([]byte(mdStr), &metadata)
+	if jsonErr != nil {
+		return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+	}
+
+	if _, keyErr := getKey(m, keyID, knox.Primary); keyErr != nil {
+		return nil, keyErr
+	}
+
+	err := m.UpdateMetadata(keyID, metadata)
+	switch err {
+	case nil:
+		return nil, nil
+	case knox.ErrInvalidMetadataKey, knox.ErrInvalidGraceWindow, knox.ErrInvalidMaxReads, knox.ErrInvalidExpiry:
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	default:
+		return nil, keyManagerErr(err)
+	}
+}
+
+// putLockHandler locks a key so that every read fails with the given message.
+// The route for this handler is PUT /v0/keys/<key_id>/lock/
+// The principal needs Admin access to the key.
+func putLockHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	message := parameters["message"]
+	if message == "" {
+		message = fmt.Sprintf("locked by %s", principal.GetID())
+	}
+	return nil, setKeyLock(m, principal, parameters["keyID"], message)
+}
+
+// deleteLockHandler unlocks a key.
+// The route for this handler is DELETE /v0/keys/<key_id>/lock/
+// The principal needs Admin access to the key.
+func deleteLockHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	return nil, setKeyLock(m, principal, parameters["keyID"], "")
+}
+
+// setKeyLock sets the lock message on a key, an empty message unlocks it.
+func setKeyLock(m KeyManager, principal knox.Principal, keyID, message string) *HTTPError {
+	if _, keyErr := getKey(m, keyID, knox.Primary); keyErr != nil {
+		return keyErr
+	}
+
+	if err := m.UpdateMetadata(keyID, knox.KeyMetadata{knox.MetadataLocked: message}); err != nil {
+		return keyManagerErr(err)
+	}
+	return nil
 }
 
 // postVersionHandler creates a new key version. This version is immediately
-// added as an Active key.
+// added as an Active key, unless an activation time is given in which case it
+// is Scheduled and becomes Primary at that time.
 // The route for this handler is PUT /v0/keys/<key_id>/versions/
 // The principal needs Write access.
 func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
 
 	keyID := parameters["keyID"]
-	dataStr, dataOK := parameters["data"]
-	if !dataOK {
-		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'data'")
-	}
-	if dataStr == "" {
-		return nil, errF(knox.BadRequestDataCode, "Parameter 'data' is empty")
+	decodedData, dataErr := dataParam(parameters, knox.BadRequestDataCode)
+	if dataErr != nil {
+		return nil, dataErr
 	}
-	decodedData, decodeErr := base64.StdEncoding.DecodeString(dataStr)
-	if decodeErr != nil {
-		return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
+	activation, timeErr := parseTimeParam(parameters["activation"])
+	if timeErr != nil {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid activation: %s", timeErr.Error()))
 	}
-	if decodedData == nil {
-		return nil, errF(knox.BadRequestDataCode, "Parameter 'data' decoded to nil")
+	if activation != 0 && activation <= time.Now().UnixNano() {
+		return nil, errF(knox.BadRequestDataCode, "Parameter 'activation' must be in the future")
 	}
 
-	// Get the key
-	key, getErr := m.GetKey(keyID, knox.Inactive)
-	if getErr != nil {
-		if getErr == knox.ErrKeyIDNotFound {
-			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
-		}
-		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	key, keyErr := getKey(m, keyID, knox.Inactive)
+	if keyErr != nil {
+		return nil, keyErr
 	}
-
-	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Write)
-	if authzErr != nil {
-		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
+	if hashErr := checkVersionHash(key, parameters); hashErr != nil {
+		return nil, hashErr
 	}
 
-	if !authorized {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to write %s", principal.GetID(), keyID))
+	contentType, ctErr := contentTypeParam(parameters, decodedData)
+	if ctErr != nil {
+		return nil, ctErr
+	}
+	report, strengthErr := analyzeStrength(optionsOf(m), decodedData)
+	if strengthErr != nil {
+		return nil, strengthErr
 	}
 
 	// Create and add the new version
 	version := newKeyVersion(decodedData, knox.Active)
+	version.ContentType = contentType
+	if activation != 0 {
+		version.Status = knox.Scheduled
+		version.ActivationTime = activation
+	}
 
-	err := m.AddVersion(keyID, &version)
+	err := m.IfVersionHash(parameters["precondition_version_hash"]).AddVersion(keyID, &version)
 
 	if err != nil {
-		return nil, errF(knox.InternalServerErrorCode, err.Error())
+		return nil, keyManagerErr(err)
+	}
+	if report != nil {
+		if mdErr := m.UpdateMetadata(keyID, report.Metadata()); mdErr != nil {
+			log.Printf("Failed to record strength of key %s: %s", keyID, mdErr.Error())
+		}
+	}
+	result := withStrengthWarnings(report, version.ID)
+	return withDuplicateDataWarnings(m, principal, keyID, decodedData, result), nil
+}
+
+// rotateKeyHandler adds a new version whose data is created by the server
+// with the generator named in the key's metadata. If promote is true the new
+// version also becomes Primary.
+// The route for this handler is POST /v0/keys/<key_id>/rotate/
+// The principal needs Write access.
+func rotateKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+	promote := false
+	if promoteStr, ok := parameters["promote"]; ok {
+		var parseErr error
+		promote, parseErr = strconv.ParseBool(promoteStr)
+		if parseErr != nil {
+			return nil, errF(knox.BadRequestDataCode, "Parameter 'promote' must be a boolean")
+		}
+	}
+
+	key, keyErr := getKey(m, keyID, knox.Inactive)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	data, genErr := generateVersionData(optionsOf(m), key)
+	if genErr != nil {
+		return nil, genErr
+	}
+	version := newKeyVersion(data, knox.Active)
+	if err := m.AddVersion(keyID, &version); err != nil {
+		return nil, keyManagerErr(err)
+	}
+	if promote {
+		if err := m.UpdateVersion(keyID, version.ID, knox.Primary); err != nil {
+			return nil, keyManagerErr(err)
+		}
 	}
 	return version.ID, nil
 }
@@ -415,6 +957,8 @@ func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[s
 //
 //	this will change the current Primary key to Active.
 //
+// If the key version is Scheduled, it can become Primary early or Inactive to
+// cancel the activation.
 // If the key version is Primary, the version status cannot be changed. Instead
 //
 //	promote another key version to Primary to replace it.
@@ -426,37 +970,20 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 	keyID := parameters["keyID"]
 	versionID := parameters["versionID"]
 
-	statusStr, statusOK := parameters["status"]
-	if !statusOK {
+	if _, statusOK := parameters["status"]; !statusOK {
 		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'status'")
 	}
-	status := knox.Active
-	statusErr := status.UnmarshalJSON([]byte(statusStr))
+	status, statusErr := statusParam(parameters, knox.Active)
 	if statusErr != nil {
-		return nil, errF(knox.BadRequestDataCode, statusErr.Error())
+		return nil, statusErr
 	}
 	id, intErr := strconv.ParseUint(versionID, 10, 64)
 	if intErr != nil {
 		return nil, errF(knox.BadRequestDataCode, intErr.Error())
 	}
 
-	// Get the key
-	key, getErr := m.GetKey(keyID, knox.Inactive)
-	if getErr != nil {
-		if getErr == knox.ErrKeyIDNotFound {
-			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
-		}
-		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
-	}
-
-	// Authorize
-	authorized, authzErr := authorizeRequest(key, principal, knox.Write)
-	if authzErr != nil {
-		return nil, errF(knox.InternalServerErrorCode, authzErr.Error())
-	}
-
-	if !authorized {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to write %s", principal.GetID(), keyID))
+	if _, keyErr := getKey(m, keyID, knox.Inactive); keyErr != nil {
+		return nil, keyErr
 	}
 
 	err := m.UpdateVersion(keyID, id, status)
@@ -466,10 +993,10 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 		return nil, nil
 	case knox.ErrKeyVersionNotFound:
 		return nil, errF(knox.KeyVersionDoesNotExistCode, err.Error())
-	case knox.ErrPrimaryToInactive, knox.ErrPrimaryToActive, knox.ErrInactiveToPrimary:
+	case knox.ErrPrimaryToInactive, knox.ErrPrimaryToActive, knox.ErrInactiveToPrimary, knox.ErrInvalidStatus:
 		return nil, errF(knox.BadRequestDataCode, err.Error())
 	default:
-		return nil, errF(knox.InternalServerErrorCode, err.Error())
+		return nil, keyManagerErr(err)
 	}
 }
 
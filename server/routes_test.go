@@ -1,9 +1,13 @@
 package server
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/server/auth"
@@ -17,6 +21,31 @@ func makeDB() (KeyManager, *keydb.TempDB) {
 	return m, db
 }
 
+// makeDBWithOptions is makeDB for a KeyManager configured by opts.
+func makeDBWithOptions(opts KeyManagerOptions) KeyManager {
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	return NewKeyManagerWithOptions(cryptor, &keydb.TempDB{}, opts)
+}
+
+// serveRoute authorizes a request to the route with the ID and runs its
+// handler, as the router does.
+func serveRoute(id string, m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	for _, r := range routes {
+		if r.Id != id {
+			continue
+		}
+		key, err := r.authorize(m, principal, parameters)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			m = &authorizedKeyManager{KeyManager: m, key: key}
+		}
+		return r.Handler(m, principal, parameters)
+	}
+	panic("no route " + id)
+}
+
 func TestGetKeys(t *testing.T) {
 	m, db := makeDB()
 	u := auth.NewUser("testuser", []string{})
@@ -87,7 +116,7 @@ func TestGetKeys(t *testing.T) {
 func TestPostKeys(t *testing.T) {
 	m, db := makeDB()
 	machine := auth.NewMachine("MrRoboto")
-	_, err := postKeysHandler(m, machine, map[string]string{"id": "a1", "data": "MQ=="})
+	_, err := serveRoute("postkeys", m, machine, map[string]string{"id": "a1", "data": "MQ=="})
 	if err == nil {
 		t.Fatal("Expected err")
 	}
@@ -243,6 +272,56 @@ func TestGetKey(t *testing.T) {
 	}
 }
 
+func TestRestoreDeletedKey(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	m := NewKeyManager(cryptor, keydb.NewTombstoneDB(keydb.NewTempDB(), time.Hour))
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("other", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := deleteKeyHandler(m, u, map[string]string{"keyID": "a1"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	i, err := getDeletedKeysHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if deleted := i.([]knox.DeletedKey); len(deleted) != 1 || deleted[0].ID != "a1" {
+		t.Fatalf("Unexpected deleted keys %+v", deleted)
+	}
+	if i, _ := getDeletedKeysHandler(m, other, nil); len(i.([]knox.DeletedKey)) != 0 {
+		t.Fatalf("Expected no deleted keys for another user, got %+v", i)
+	}
+
+	params := map[string]string{"keyID": "a1"}
+	if err := authorizeDeletedKey(m, other, params); err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected another user not to be authorized, got %+v", err)
+	}
+	if err := authorizeDeletedKey(m, u, map[string]string{"keyID": "NOTAKEY"}); err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected a missing key, got %+v", err)
+	}
+	if err := authorizeDeletedKey(m, u, params); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := restoreKeyHandler(m, u, params); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err = getKeyHandler(m, u, params)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if k := i.(*knox.Key); string(k.VersionList[0].Data) != "1" {
+		t.Fatalf("Unexpected restored key %+v", k)
+	}
+
+	plain, _ := makeDB()
+	if _, err := getDeletedKeysHandler(plain, u, nil); err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("Expected deleted keys not to be kept, got %+v", err)
+	}
+}
+
 func TestDeleteKey(t *testing.T) {
 	m, db := makeDB()
 	u := auth.NewUser("testuser", []string{})
@@ -257,7 +336,7 @@ func TestDeleteKey(t *testing.T) {
 		t.Fatal("Expected err")
 	}
 
-	_, err = deleteKeyHandler(m, machine, map[string]string{"keyID": "a1"})
+	_, err = serveRoute("deletekey", m, machine, map[string]string{"keyID": "a1"})
 	if err == nil {
 		t.Fatal("Expected err")
 	}
@@ -347,7 +426,7 @@ func TestPutAccess(t *testing.T) {
 		t.Fatal("Expected err")
 	}
 
-	_, err = putAccessHandler(m, machine, map[string]string{"keyID": "a1", "acl": string(accessJSON)})
+	_, err = serveRoute("putaccess", m, machine, map[string]string{"keyID": "a1", "acl": string(accessJSON)})
 	if err == nil {
 		t.Fatal("Expected err")
 	}
@@ -389,6 +468,58 @@ func TestPutAccess(t *testing.T) {
 
 }
 
+func TestPlanAccess(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	access := []knox.Access{{Type: knox.Machine, ID: "MrRoboto", AccessType: knox.Read}}
+	accessJSON, _ := json.Marshal(&access)
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "acl": string(accessJSON)})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	change := []knox.Access{
+		{Type: knox.Machine, ID: "MrRoboto", AccessType: knox.None},
+		{Type: knox.UserGroup, ID: "eng", AccessType: knox.Write},
+	}
+	changeJSON, _ := json.Marshal(&change)
+	principals := `[{"type":"machine","id":"MrRoboto"},{"type":"user","id":"alice","groups":["eng"]},` +
+		`{"type":"user","id":"testuser"},{"type":"service","id":"spiffe://example.com/svc"}]`
+	i, err := planAccessHandler(m, u, map[string]string{"keyID": "a1", "acl": string(changeJSON), "principals": principals})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	plan := i.(*knox.ACLPlan)
+	want := []knox.AccessChange{
+		{Principal: knox.PlanPrincipal{Type: "machine", ID: "MrRoboto"}, Before: knox.Read, After: knox.None},
+		{Principal: knox.PlanPrincipal{Type: "user", ID: "alice", Groups: []string{"eng"}}, Before: knox.None, After: knox.Write},
+	}
+	if !reflect.DeepEqual(plan.Changes, want) {
+		t.Fatalf("Expected changes %+v, got %+v", want, plan.Changes)
+	}
+
+	// Nothing was applied.
+	k, _ := m.GetKey("a1", knox.Primary)
+	if !auth.NewMachine("MrRoboto").CanAccess(k.ACL, knox.Read) {
+		t.Fatal("Planning changed the ACL")
+	}
+
+	for _, bad := range []string{`[{"type":"robot","id":"x"}]`, `[{"type":"service","id":"svc"}]`, "NotJSON"} {
+		_, err = planAccessHandler(m, u, map[string]string{"keyID": "a1", "acl": string(changeJSON), "principals": bad})
+		if err == nil {
+			t.Fatalf("Expected err for principals %s", bad)
+		}
+	}
+	_, err = planAccessHandler(m, u, map[string]string{"keyID": "NOTAKEY", "acl": string(changeJSON), "principals": "[]"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected missing key error, got %+v", err)
+	}
+}
+
 func TestLegacyPutAccess(t *testing.T) {
 	m, db := makeDB()
 	access := &knox.Access{Type: knox.Machine, ID: "MrRoboto", AccessType: knox.Read}
@@ -418,7 +549,7 @@ func TestLegacyPutAccess(t *testing.T) {
 		t.Fatal("Expected err")
 	}
 
-	_, err = putAccessHandler(m, machine, map[string]string{"keyID": "a1", "access": string(accessJSON)})
+	_, err = serveRoute("putaccess", m, machine, map[string]string{"keyID": "a1", "access": string(accessJSON)})
 	if err == nil {
 		t.Fatal("Expected err")
 	}
@@ -488,7 +619,7 @@ func TestPostVersion(t *testing.T) {
 		t.Fatal("Expected err")
 	}
 
-	_, err = postVersionHandler(m, machine, map[string]string{"keyID": "a1", "data": "Mg=="})
+	_, err = serveRoute("postversion", m, machine, map[string]string{"keyID": "a1", "data": "Mg=="})
 	if err == nil {
 		t.Fatal("Expected err")
 	}
@@ -565,7 +696,7 @@ func TestPutVersions(t *testing.T) {
 		t.Fatal("Expected err")
 	}
 
-	_, err = putVersionsHandler(m, machine, map[string]string{"keyID": "a1", "versionID": newString, "status": `"Primary"`})
+	_, err = serveRoute("putversion", m, machine, map[string]string{"keyID": "a1", "versionID": newString, "status": `"Primary"`})
 	if err == nil {
 		t.Fatal("Expected err")
 	}
@@ -697,3 +828,676 @@ func TestAuthorizeRequest(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkGetKeyHandler(b *testing.B) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		b.Fatalf("%+v is not nil", err)
+	}
+	for i := 0; i < 1000; i++ {
+		access := knox.Access{Type: knox.Machine, ID: fmt.Sprintf("host%d", i), AccessType: knox.Read}
+		if err := m.UpdateAccess("a1", access); err != nil {
+			b.Fatal(err)
+		}
+	}
+	machine := auth.NewMachine("host999")
+	params := map[string]string{"keyID": "a1"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getKeyHandler(m, machine, params); err != nil {
+			b.Fatalf("%+v is not nil", err)
+		}
+	}
+}
+
+func TestSearchKeys(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("otheruser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"env":"prod","team":"x"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a2", "data": "Mg==", "metadata": `{"env":"dev"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, other, map[string]string{"id": "a3", "data": "Mw=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	cases := map[string][]string{
+		"":                                   {"a1", "a2", "a3"},
+		"owner=testuser":                     {"a1", "a2"},
+		"owner=otheruser":                    {"a3"},
+		"tag=env":                            {"a1", "a2"},
+		"tag=env:prod":                       {"a1"},
+		"tag=env:prod&tag=team:x":            {"a1"},
+		"tag=env:prod&tag=team:y":            {},
+		"owner=otheruser&tag=env":            {},
+		"created_after=2000-01-01T00:00:00Z": {"a1", "a2", "a3"},
+		"created_before=946684800":           {},
+	}
+	for qs, expected := range cases {
+		i, err := searchKeysHandler(m, u, map[string]string{"queryString": qs})
+		if err != nil {
+			t.Fatalf("%s: %+v is not nil", qs, err)
+		}
+		keys := i.([]string)
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("%s: expected %v, got %v", qs, expected, keys)
+		}
+	}
+
+	_, err = searchKeysHandler(m, u, map[string]string{"queryString": "created_after=yesterday"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+}
+
+func TestPutMetadata(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"env":"prod"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a2", "data": "MQ==", "metadata": `{"bad key":"x"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": `{"env":"","team":"x"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k, getErr := m.GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if !reflect.DeepEqual(k.Metadata, knox.KeyMetadata{"team": "x"}) {
+		t.Fatalf("Unexpected metadata %v", k.Metadata)
+	}
+
+	_, err = serveRoute("putmetadata", m, machine, map[string]string{"keyID": "a1", "metadata": `{"team":"y"}`})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected unauthorized, got %+v", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": `{"bad key":"y"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "NOTAKEY", "metadata": `{}`})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected missing key, got %+v", err)
+	}
+}
+
+func TestHoneytokenNotification(t *testing.T) {
+	var notifications []Notification
+	m := makeDBWithOptions(KeyManagerOptions{Notifier: record(&notifications)})
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "canary", "data": "MQ==", "metadata": `{"knox.honeytoken":"true"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if len(notifications) != 0 {
+		t.Fatalf("Expected no notifications, got %v", notifications)
+	}
+
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "canary"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = getKeyHandler(m, machine, map[string]string{"keyID": "canary"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected unauthorized, got %+v", err)
+	}
+	if len(notifications) != 2 {
+		t.Fatalf("Expected 2 notifications, got %v", notifications)
+	}
+	if n := notifications[0]; n.Type != HoneytokenReadNotification || n.KeyID != "canary" || n.Principal != "testuser" || !n.Authorized {
+		t.Fatalf("Unexpected notification %+v", n)
+	}
+	if n := notifications[1]; n.Principal != "MrRoboto" || n.Authorized {
+		t.Fatalf("Unexpected notification %+v", n)
+	}
+}
+
+func TestMaxReads(t *testing.T) {
+	var notifications []Notification
+	m := makeDBWithOptions(KeyManagerOptions{Notifier: record(&notifications)})
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "bad", "data": "MQ==", "metadata": `{"knox.max_reads":"0"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "bootstrap", "data": "MQ==", "metadata": `{"knox.max_reads":"2"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		k, err := getKeyHandler(m, u, map[string]string{"keyID": "bootstrap"})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		if c := k.(*knox.Key).Metadata[knox.MetadataReadCount]; c != strconv.Itoa(i) {
+			t.Fatalf("Expected read count %d, got %q", i, c)
+		}
+	}
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "bootstrap"})
+	if err == nil || err.Subcode != knox.KeyReadsExhaustedCode {
+		t.Fatalf("Expected reads exhausted, got %+v", err)
+	}
+	if len(notifications) != 1 || notifications[0].Type != ReadsExhaustedNotification || notifications[0].KeyID != "bootstrap" {
+		t.Fatalf("Expected one reads exhausted notification, got %v", notifications)
+	}
+
+	keys, err := adminListKeysHandler(m, u, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	for _, s := range keys.([]knox.KeySummary) {
+		if s.ID == "bootstrap" && (s.ReadsRemaining == nil || *s.ReadsRemaining != 0) {
+			t.Fatalf("Expected no reads remaining, got %v", s.ReadsRemaining)
+		}
+	}
+
+	// Removing the count allows more reads.
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "bootstrap", "metadata": `{"knox.read_count":""}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "bootstrap"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
+
+func TestSyncKeys(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+	machineRead := `[{"type":"Machine","id":"MrRoboto","access":"Read"}]`
+
+	for _, id := range []string{"a1", "a2"} {
+		_, err := postKeysHandler(m, u, map[string]string{"id": id, "data": "MQ==", "acl": machineRead})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+	_, err := postKeysHandler(m, u, map[string]string{"id": "private", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	a2, _ := m.GetKey("a2", knox.Active)
+
+	versions := `{"a1":"","a2":"` + a2.VersionHash + `","private":"","missing":""}`
+	data, err := syncKeysHandler(m, machine, map[string]string{"versions": versions})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	sync := data.(knox.KeySync)
+	if len(sync.Keys) != 1 || sync.Keys[0].ID != "a1" || len(sync.Keys[0].ACL) != 0 {
+		t.Fatalf("Expected only a1 without its ACL, got %+v", sync.Keys)
+	}
+	if len(sync.Errors) != 1 || sync.Errors["private"].Code != knox.UnauthorizedCode {
+		t.Fatalf("Expected private to be unauthorized, got %+v", sync.Errors)
+	}
+
+	_, err = syncKeysHandler(m, machine, map[string]string{"versions": `["a1"]`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	_, err = serveRoute("putlock", m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected unauthorized, got %+v", err)
+	}
+	_, err = putLockHandler(m, u, map[string]string{"keyID": "a1", "message": "incident 42"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.KeyLockedCode || err.Message != "Key a1 is locked: incident 42" {
+		t.Fatalf("Expected locked error, got %+v", err)
+	}
+	_, err = getKeyHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected unauthorized, got %+v", err)
+	}
+
+	_, err = deleteLockHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putLockHandler(m, u, map[string]string{"keyID": "nope"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected not found, got %+v", err)
+	}
+}
+
+func TestScheduledVersion(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg==", "activation": "2000-01-01T00:00:00Z"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request for past activation, got %+v", err)
+	}
+	activation := time.Now().Add(time.Hour).Format(time.RFC3339)
+	i, err := postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg==", "activation": activation})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	scheduledID := i.(uint64)
+
+	k, getErr := m.GetKey("a1", knox.Active)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if len(k.VersionList) != 1 {
+		t.Fatalf("Scheduled version should not be served: %v", k.VersionList)
+	}
+	updated, getErr := m.GetUpdatedKeyIDs(map[string]string{"a1": k.VersionHash})
+	if getErr != nil || len(updated) != 0 {
+		t.Fatalf("Expected no updated keys, got %v %v", updated, getErr)
+	}
+
+	// Move the activation time into the past.
+	dbk, getErr := db.Get("a1")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	for j := range dbk.VersionList {
+		if dbk.VersionList[j].ID == scheduledID {
+			dbk.VersionList[j].ActivationTime = 1
+		}
+	}
+	dbk.Metadata[knox.MetadataNextActivation] = "1"
+	if err := db.Update(dbk); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, getErr = m.GetUpdatedKeyIDs(map[string]string{"a1": k.VersionHash})
+	if getErr != nil || !reflect.DeepEqual(updated, []string{"a1"}) {
+		t.Fatalf("Expected a1 to be updated, got %v %v", updated, getErr)
+	}
+	k2, getErr := m.GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if k2.VersionList[0].ID != scheduledID || k2.VersionHash == k.VersionHash {
+		t.Fatalf("Expected scheduled version to be primary: %+v", k2)
+	}
+	// The activation is persisted.
+	dbk, getErr = db.Get("a1")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if dbk.VersionHash != k2.VersionHash {
+		t.Fatalf("Expected stored hash %s, got %s", k2.VersionHash, dbk.VersionHash)
+	}
+	if _, ok := dbk.Metadata[knox.MetadataNextActivation]; ok {
+		t.Fatal("Expected next activation to be cleared")
+	}
+}
+
+func TestRotationGraceWindow(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"knox.grace_window":"24h"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": `{"knox.grace_window":"soon"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	old, getErr := m.GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	i, err := postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	newID := strconv.FormatUint(i.(uint64), 10)
+	_, err = putVersionsHandler(m, u, map[string]string{"keyID": "a1", "versionID": newID, "status": `"Primary"`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	k, getErr := m.GetKey("a1", knox.Active)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	prev := k.PreviousPrimary(time.Now())
+	if prev == nil || prev.ID != old.VersionList[0].ID || string(prev.Data) != "1" {
+		t.Fatalf("Expected previous primary %d, got %+v", old.VersionList[0].ID, prev)
+	}
+	if prev := k.PreviousPrimary(time.Now().Add(25 * time.Hour)); prev != nil {
+		t.Fatalf("Expected no previous primary after the window, got %+v", prev)
+	}
+}
+
+type failingRotationPlugin struct {
+	calls int
+}
+
+func (p *failingRotationPlugin) BeforePromote(key *knox.Key, version *knox.KeyVersion) error {
+	p.calls++
+	return fmt.Errorf("external system unavailable")
+}
+
+func TestRotationPluginAbortsPromotion(t *testing.T) {
+	p := &failingRotationPlugin{}
+	m := makeDBWithOptions(KeyManagerOptions{RotationPlugins: []RotationPlugin{p}, DisableStrengthAnalysis: true})
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err := postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	versionID := strconv.FormatUint(i.(uint64), 10)
+	_, err = putVersionsHandler(m, u, map[string]string{"keyID": "a1", "versionID": versionID, "status": `"Primary"`})
+	if err == nil || err.Subcode != knox.InternalServerErrorCode {
+		t.Fatalf("Expected promotion to fail, got %+v", err)
+	}
+	if p.calls != 1 {
+		t.Fatalf("Expected plugin to be called once, got %d", p.calls)
+	}
+	k, getErr := m.GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if strconv.FormatUint(k.VersionList[0].ID, 10) == versionID {
+		t.Fatal("Version should not have been promoted")
+	}
+	// Deactivating does not change the primary and skips plugins.
+	_, err = putVersionsHandler(m, u, map[string]string{"keyID": "a1", "versionID": versionID, "status": `"Inactive"`})
+	if err != nil || p.calls != 1 {
+		t.Fatalf("Expected deactivation without plugin, got %+v and %d calls", err, p.calls)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = rotateKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request without a generator, got %+v", err)
+	}
+
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": `{"knox.generator":"random:16"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = serveRoute("rotatekey", m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected unauthorized, got %+v", err)
+	}
+
+	i, err := rotateKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k, getErr := m.GetKey("a1", knox.Active)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if len(k.VersionList) != 2 || k.VersionList.GetPrimary().ID == i.(uint64) {
+		t.Fatalf("Expected a new active version, got %+v", k.VersionList)
+	}
+
+	i, err = rotateKeyHandler(m, u, map[string]string{"keyID": "a1", "promote": "true"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k, getErr = m.GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if k.VersionList[0].ID != i.(uint64) || len(k.VersionList[0].Data) != 16 {
+		t.Fatalf("Expected new 16 byte primary, got %+v", k.VersionList[0])
+	}
+
+	for _, gen := range []string{"random:0", "random:x", "nope:1"} {
+		_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": `{"knox.generator":"` + gen + `"}`})
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		_, err = rotateKeyHandler(m, u, map[string]string{"keyID": "a1"})
+		if err == nil || err.Subcode != knox.BadRequestDataCode {
+			t.Fatalf("Expected bad request for %s, got %+v", gen, err)
+		}
+	}
+}
+
+func TestRotateKeyOptionGenerator(t *testing.T) {
+	fixed := KeyGeneratorFunc(func(spec string, key *knox.Key) ([]byte, error) {
+		return []byte(spec + key.ID), nil
+	})
+	m := makeDBWithOptions(KeyManagerOptions{
+		KeyGenerators:           map[string]KeyGenerator{"fixed": fixed},
+		DisableStrengthAnalysis: true,
+	})
+	u := auth.NewUser("testuser", []string{})
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"knox.generator":"fixed:v-"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := rotateKeyHandler(m, u, map[string]string{"keyID": "a1", "promote": "true"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k, getErr := m.GetKey("a1", knox.Primary)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if string(k.VersionList[0].Data) != "v-a1" {
+		t.Fatalf("Expected generated data, got %q", k.VersionList[0].Data)
+	}
+
+	// Generators in the options aren't visible to other key managers.
+	other, _ := makeDB()
+	_, err = postKeysHandler(other, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"knox.generator":"fixed:v-"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := rotateKeyHandler(other, u, map[string]string{"keyID": "a1"}); err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected an unknown generator, got %+v", err)
+	}
+}
+
+func TestDuplicateDataWarnings(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("otheruser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Disabled by default.
+	d, err := postKeysHandler(m, u, map[string]string{"id": "a2", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, ok := d.(withWarnings); ok {
+		t.Fatalf("Expected no warnings, got %+v", d)
+	}
+
+	m = NewKeyManagerWithOptions(keydb.NewAESGCMCryptor(0, []byte("testtesttesttest")), db, KeyManagerOptions{DuplicateDataWarnings: true, DisableStrengthAnalysis: true})
+	d, err = postKeysHandler(m, u, map[string]string{"id": "a3", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	wd, ok := d.(withWarnings)
+	if !ok || len(wd.warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got %+v", d)
+	}
+	if _, ok := wd.data.(uint64); !ok {
+		t.Fatalf("Expected version id, got %+v", wd.data)
+	}
+
+	// Other principals can't read the duplicates so aren't warned.
+	d, err = postKeysHandler(m, other, map[string]string{"id": "b1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, ok := d.(withWarnings); ok {
+		t.Fatalf("Expected no warnings, got %+v", d)
+	}
+
+	d, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, ok := d.(withWarnings); ok {
+		t.Fatalf("Expected no warnings, got %+v", d)
+	}
+	d, err = postVersionHandler(m, u, map[string]string{"keyID": "a2", "data": "Mg=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if wd, ok := d.(withWarnings); !ok || len(wd.warnings) != 1 {
+		t.Fatalf("Expected 1 warning, got %+v", d)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	jsonData := base64.StdEncoding.EncodeToString([]byte(`{"user":"a"}`))
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "content_type": knox.ContentTypePEM})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": jsonData, "content_type": "not a type"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": jsonData, "content_type": knox.ContentTypeJSON})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	k, err := getKeyHandler(m, u, map[string]string{"keyID": "a1", "status": `"Active"`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	key := k.(*knox.Key)
+	if len(key.VersionList) != 2 {
+		t.Fatalf("Expected 2 versions, got %+v", key.VersionList)
+	}
+	for _, v := range key.VersionList {
+		want := ""
+		if v.Status == knox.Primary {
+			want = knox.ContentTypeJSON
+		}
+		if v.ContentType != want {
+			t.Fatalf("Expected content type %q for version %d, got %q", want, v.ID, v.ContentType)
+		}
+	}
+}
+
+func TestPreconditionVersionHash(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "guarded", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k, err := getKeyHandler(m, u, map[string]string{"keyID": "guarded"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	hash := k.(*knox.Key).VersionHash
+
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "guarded", "data": "Mg==", "precondition_version_hash": hash})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	// The key changed since hash was read.
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "guarded", "data": "Mw==", "precondition_version_hash": hash})
+	if err == nil || err.Subcode != knox.KeyVersionHashMismatchCode {
+		t.Fatalf("Expected version hash mismatch, got %+v", err)
+	}
+	access := `{"type":"User","id":"other","access":"Read"}`
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "guarded", "access": access, "precondition_version_hash": hash})
+	if err == nil || err.Subcode != knox.KeyVersionHashMismatchCode {
+		t.Fatalf("Expected version hash mismatch, got %+v", err)
+	}
+
+	k, _ = getKeyHandler(m, u, map[string]string{"keyID": "guarded"})
+	hash = k.(*knox.Key).VersionHash
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "guarded", "access": access, "precondition_version_hash": hash})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	key, _ := m.GetKey("guarded", knox.Inactive)
+	if len(key.VersionList) != 2 || len(key.ACL) != 2 {
+		t.Fatalf("Expected 2 versions and 2 ACL entries, got %+v", key)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// Snapshot reads every key in the database, see keydb.TakeSnapshot.
+func (m *keyManager) Snapshot() (*keydb.Snapshot, error) {
+	return keydb.TakeSnapshot(m.db)
+}
+
+// RestoreSnapshot writes the keys of a snapshot to the database, see
+// keydb.RestoreSnapshot. It fails without writing anything if a key can't be
+// decrypted, e.g. because the snapshot was taken on a server with another
+// master key. Hooks are not run for restored keys.
+func (m *keyManager) RestoreSnapshot(s *keydb.Snapshot) (*knox.RestoreResult, error) {
+	for i := range s.Keys {
+		if _, err := m.cryptor.Decrypt(&s.Keys[i]); err != nil {
+			return nil, fmt.Errorf("Key %s of the snapshot can't be decrypted: %s", s.Keys[i].ID, err.Error())
+		}
+	}
+	result := keydb.RestoreSnapshot(m.db, s)
+	for i := range s.Keys {
+		m.reads.Forget(s.Keys[i].ID)
+	}
+	return result, nil
+}
+
+// adminSnapshotHandler returns an encrypted snapshot of every key.
+// The route for this handler is GET /v0/admin/snapshot/
+func adminSnapshotHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	snapshotKey := optionsOf(m).SnapshotKey
+	if snapshotKey == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Snapshots are not enabled on this server")
+	}
+	s, err := m.Snapshot()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	b, err := s.Encrypt(snapshotKey)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return b, nil
+}
+
+// adminRestoreHandler restores the keys of an encrypted snapshot.
+// The route for this handler is POST /v0/admin/snapshot/
+func adminRestoreHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	snapshotKey := optionsOf(m).SnapshotKey
+	if snapshotKey == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Snapshots are not enabled on this server")
+	}
+	b, _ := base64.StdEncoding.DecodeString(parameters["snapshot"])
+	s, err := keydb.OpenSnapshot(b, snapshotKey)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	result, err := m.RestoreSnapshot(s)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	return result, nil
+}
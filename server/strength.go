@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+// StrengthPolicy configures the analysis of key data written by clients.
+type StrengthPolicy struct {
+	// MinLength is the minimum number of bytes of key data.
+	MinLength int
+	// MinEntropyBits is the minimum estimated entropy of the key data.
+	MinEntropyBits float64
+	// KnownWeak lists test and default values that should never be secrets.
+	// Matching ignores case and surrounding whitespace.
+	KnownWeak []string
+	// Reject causes weak data to be refused instead of accepted with a warning.
+	Reject bool
+}
+
+// DefaultStrengthPolicy warns about short, low entropy, and default values.
+var DefaultStrengthPolicy = StrengthPolicy{
+	MinLength:      16,
+	MinEntropyBits: 64,
+	KnownWeak: []string{
+		"changeme", "password", "secret", "test", "testing", "default",
+		"admin", "letmein", "123456", "12345678", "qwerty", "example", "todo",
+	},
+}
+
+var strengthPolicy *StrengthPolicy
+
+// SetStrengthPolicy turns on analysis of new key data for KeyManagers made
+// with NewKeyManager or GetRouter. Results are recorded in the key's
+// knox.strength and knox.entropy_bits metadata. A nil policy, the default,
+// turns analysis off.
+//
+// Deprecated: Set KeyManagerOptions.StrengthPolicy and use
+// NewKeyManagerWithOptions.
+func SetStrengthPolicy(p *StrengthPolicy) {
+	strengthPolicy = p
+}
+
+// StrengthReport is the result of analyzing key data.
+type StrengthReport struct {
+	EntropyBits float64
+	Problems    []string
+}
+
+// Weak returns true if any problems were found.
+func (r StrengthReport) Weak() bool {
+	return len(r.Problems) > 0
+}
+
+// Metadata returns the metadata entries recording the report.
+func (r StrengthReport) Metadata() knox.KeyMetadata {
+	strength := "ok"
+	if r.Weak() {
+		strength = "weak"
+	}
+	return knox.KeyMetadata{
+		knox.MetadataStrength:    strength,
+		knox.MetadataEntropyBits: strconv.FormatFloat(r.EntropyBits, 'f', 0, 64),
+	}
+}
+
+// Analyze checks data against the policy.
+func (p StrengthPolicy) Analyze(data []byte) StrengthReport {
+	r := StrengthReport{EntropyBits: estimateEntropyBits(data)}
+	trimmed := bytes.TrimSpace(data)
+	for _, w := range p.KnownWeak {
+		if bytes.EqualFold(trimmed, []byte(w)) {
+			r.Problems = append(r.Problems, fmt.Sprintf("key data is the well known value %q", w))
+			break
+		}
+	}
+	if len(data) < p.MinLength {
+		r.Problems = append(r.Problems, fmt.Sprintf("key data is %d bytes, less than the minimum of %d", len(data), p.MinLength))
+	}
+	if r.EntropyBits < p.MinEntropyBits {
+		r.Problems = append(r.Problems, fmt.Sprintf("key data has an estimated %.0f bits of entropy, less than the minimum of %.0f", r.EntropyBits, p.MinEntropyBits))
+	}
+	return r
+}
+
+// estimateEntropyBits is the Shannon entropy of the byte distribution of data
+// multiplied by its length. It is a rough upper bound that catches repeated
+// and low variety data, not a measure of how the data was generated.
+func estimateEntropyBits(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	n := float64(len(data))
+	perByte := 0.0
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * n
+}
+
+// analyzeStrength runs the policy of opts over data. It returns a nil report
+// if analysis is off and an error if the policy rejects the data.
+func analyzeStrength(opts KeyManagerOptions, data []byte) (*StrengthReport, *HTTPError) {
+	if opts.DisableStrengthAnalysis {
+		return nil, nil
+	}
+	p := DefaultStrengthPolicy
+	if opts.StrengthPolicy != nil {
+		p = *opts.StrengthPolicy
+	}
+	r := p.Analyze(data)
+	if r.Weak() && p.Reject {
+		return nil, errF(knox.BadRequestDataCode, "Key data rejected: "+strings.Join(r.Problems, "; "))
+	}
+	return &r, nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestStrengthPolicyAnalyze(t *testing.T) {
+	p := DefaultStrengthPolicy
+	strong := []byte("9c1f0e7a2b4d6f8e1a3c5e7092b4d6f8")
+	if r := p.Analyze(strong); r.Weak() {
+		t.Fatalf("Expected %q to be strong, got %v", strong, r.Problems)
+	}
+	for _, d := range []string{"changeme", " CHANGEME\n", "short", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"} {
+		if r := p.Analyze([]byte(d)); !r.Weak() {
+			t.Fatalf("Expected %q to be weak", d)
+		}
+	}
+	if bits := estimateEntropyBits([]byte("aaaa")); bits != 0 {
+		t.Fatalf("Expected 0 bits, got %f", bits)
+	}
+	if bits := estimateEntropyBits([]byte("abcd")); bits != 8 {
+		t.Fatalf("Expected 8 bits, got %f", bits)
+	}
+}
+
+func TestStrengthAnalysisOnWrite(t *testing.T) {
+	p := DefaultStrengthPolicy
+	m := makeDBWithOptions(KeyManagerOptions{StrengthPolicy: &p})
+	u := auth.NewUser("testuser", []string{})
+	weak := base64.StdEncoding.EncodeToString([]byte("changeme"))
+	strong := base64.StdEncoding.EncodeToString([]byte("9c1f0e7a2b4d6f8e1a3c5e7092b4d6f8"))
+
+	d, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": weak})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if wd, ok := d.(withWarnings); !ok || len(wd.warnings) == 0 {
+		t.Fatalf("Expected warnings, got %+v", d)
+	}
+	k, err := getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if s := k.(*knox.Key).Metadata[knox.MetadataStrength]; s != "weak" {
+		t.Fatalf("Expected weak, got %q", s)
+	}
+
+	d, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": strong})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, ok := d.(withWarnings); ok {
+		t.Fatalf("Expected no warnings, got %+v", d)
+	}
+	k, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if s := k.(*knox.Key).Metadata[knox.MetadataStrength]; s != "ok" {
+		t.Fatalf("Expected ok, got %q", s)
+	}
+
+	p.Reject = true
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a2", "data": weak})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": weak})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected bad request, got %+v", err)
+	}
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// RouteTimeout configures the deadline and slow request threshold of a route.
+// Zero values disable the corresponding behavior.
+type RouteTimeout struct {
+	// Timeout is how long a handler may run before the request fails. The
+	// KeyManager calls of a timed out handler fail, but a call in progress is
+	// not stopped, so a hung database call still finishes in the background.
+	// Once a handler starts a write, e.g. a rotation or an ACL change, the
+	// request waits for it instead of timing out: a client told the request
+	// timed out may retry it, and must not find the write applied.
+	Timeout time.Duration
+	// Slow is how long a request may take before it is logged as slow.
+	Slow time.Duration
+}
+
+// TimeoutConfig configures route timeouts. Routes without an entry in Routes
+// use Default.
+type TimeoutConfig struct {
+	Default RouteTimeout
+	Routes  map[string]RouteTimeout
+	// MaxAbandoned, if not zero, is how many timed out handlers may still be
+	// running in KeyManager calls. Beyond it, requests to routes with a
+	// timeout fail right away rather than piling up on a hung database.
+	MaxAbandoned int
+	// Logger receives slow request entries. If nil, the default logger is used.
+	Logger *log.Logger
+
+	// abandoned counts the timed out handlers still running. Copies of the
+	// config share it.
+	abandoned *int64
+}
+
+var timeoutConfig = TimeoutConfig{abandoned: new(int64)}
+
+// SetTimeouts configures handler deadlines and slow request logging of
+// KeyManagers made with NewKeyManager or GetRouter.
+//
+// Deprecated: Set KeyManagerOptions.Timeouts and use NewKeyManagerWithOptions.
+func SetTimeouts(c TimeoutConfig) {
+	// Handlers that timed out under the old config still count.
+	c.abandoned = timeoutConfig.abandoned
+	timeoutConfig = c
+}
+
+func (c TimeoutConfig) route(id string) RouteTimeout {
+	if t, ok := c.Routes[id]; ok {
+		return t
+	}
+	return c.Default
+}
+
+// abandonedHandlers returns how many timed out handlers are still running.
+func (c TimeoutConfig) abandonedHandlers() int64 {
+	if c.abandoned == nil {
+		return 0
+	}
+	return atomic.LoadInt64(c.abandoned)
+}
+
+type slowRequestLog struct {
+	Type      string  `json:"type"`
+	Route     string  `json:"route"`
+	Principal string  `json:"principal"`
+	ElapsedMs float64 `json:"elapsed_ms"`
+	KeyDBMs   float64 `json:"keydb_ms"`
+	TimedOut  bool    `json:"timed_out"`
+}
+
+// runHandler calls the route handler, enforcing the route's timeout and
+// logging the request if it is slow.
+func (r Route) runHandler(db KeyManager, principal knox.Principal, ps map[string]string) (interface{}, *HTTPError) {
+	config := optionsOf(db).Timeouts
+	t := config.route(r.Id)
+	if t.Timeout == 0 && t.Slow == 0 {
+		return r.Handler(db, principal, ps)
+	}
+
+	start := time.Now()
+	tdb := &timedKeyManager{KeyManager: db, abandonedCount: config.abandoned}
+	var data interface{}
+	var err *HTTPError
+	timedOut := false
+	if t.Timeout == 0 {
+		data, err = r.Handler(tdb, principal, ps)
+	} else if max := config.MaxAbandoned; max > 0 && config.abandonedHandlers() >= int64(max) {
+		timedOut = true
+		err = errF(knox.RequestTimeoutCode, "Too many timed out requests are still running")
+	} else {
+		type result struct {
+			data interface{}
+			err  *HTTPError
+		}
+		done := make(chan result, 1)
+		go func() {
+			d, e := r.Handler(tdb, principal, ps)
+			tdb.finish()
+			done <- result{d, e}
+		}()
+		timer := time.NewTimer(t.Timeout)
+		select {
+		case res := <-done:
+			timer.Stop()
+			data, err = res.data, res.err
+		case <-timer.C:
+			if tdb.abandon() {
+				timedOut = true
+				err = errF(knox.RequestTimeoutCode, fmt.Sprintf("Request did not finish within %s", t.Timeout))
+			} else {
+				// The handler is writing or done, so its result is the response.
+				res := <-done
+				data, err = res.data, res.err
+			}
+		}
+	}
+
+	elapsed := time.Since(start)
+	if timedOut || (t.Slow != 0 && elapsed >= t.Slow) {
+		e := &slowRequestLog{
+			Type:      "slow_request",
+			Route:     r.Id,
+			ElapsedMs: float64(elapsed) / float64(time.Millisecond),
+			KeyDBMs:   float64(tdb.elapsed()) / float64(time.Millisecond),
+			TimedOut:  timedOut,
+		}
+		if principal != nil {
+			e.Principal = principal.GetID()
+		}
+		if config.Logger != nil {
+			config.Logger.OutputJSON(e)
+		} else {
+			log.Printf("Slow request to %s by %s: %.1fms total, %.1fms in keydb, timed out: %t",
+				e.Route, e.Principal, e.ElapsedMs, e.KeyDBMs, e.TimedOut)
+		}
+	}
+	return data, err
+}
+
+// errAbandoned is returned by the KeyManager calls of a timed out handler.
+var errAbandoned = fmt.Errorf("Request timed out")
+
+// timedKeyManager records the time spent in KeyManager calls and stops the
+// calls of a handler once its request timed out.
+type timedKeyManager struct {
+	KeyManager
+	nanos int64
+	// parent is the timed key manager this one was derived from with
+	// IfVersionHash, which records the time and state instead.
+	parent *timedKeyManager
+	// abandonedCount counts the timed out handlers of the TimeoutConfig.
+	abandonedCount *int64
+
+	mu        sync.Mutex
+	abandoned bool
+	writing   bool
+	finished  bool
+}
+
+func (m *timedKeyManager) root() *timedKeyManager {
+	for m.parent != nil {
+		m = m.parent
+	}
+	return m
+}
+
+// begin is called before each KeyManager call. It fails once the request
+// timed out, and a write makes the request wait for the handler.
+func (m *timedKeyManager) begin(write bool) error {
+	m = m.root()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.abandoned {
+		return errAbandoned
+	}
+	if write {
+		m.writing = true
+	}
+	return nil
+}
+
+// abandon times out the request, unless the handler is done or started a
+// write and must be waited for.
+func (m *timedKeyManager) abandon() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writing || m.finished {
+		return false
+	}
+	m.abandoned = true
+	if m.abandonedCount != nil {
+		atomic.AddInt64(m.abandonedCount, 1)
+	}
+	return true
+}
+
+// finish is called when the handler returns.
+func (m *timedKeyManager) finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished = true
+	if m.abandoned && m.abandonedCount != nil {
+		atomic.AddInt64(m.abandonedCount, -1)
+	}
+}
+
+// Options returns the options of the wrapped key manager.
+func (m *timedKeyManager) Options() KeyManagerOptions {
+	return optionsOf(m.KeyManager)
+}
+
+func (m *timedKeyManager) elapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.nanos))
+}
+
+func (m *timedKeyManager) track(start time.Time) {
+	atomic.AddInt64(&m.root().nanos, int64(time.Since(start)))
+}
+
+func (m *timedKeyManager) GetAllKeyIDs() ([]string, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.GetAllKeyIDs()
+}
+
+func (m *timedKeyManager) GetUpdatedKeyIDs(versions map[string]string) ([]string, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.GetUpdatedKeyIDs(versions)
+}
+
+func (m *timedKeyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.GetKey(id, status)
+}
+
+func (m *timedKeyManager) AddNewKey(k *knox.Key) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.AddNewKey(k)
+}
+
+func (m *timedKeyManager) DeleteKey(id string) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.DeleteKey(id)
+}
+
+func (m *timedKeyManager) GetDeletedKeys() ([]knox.DeletedKey, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.GetDeletedKeys()
+}
+
+func (m *timedKeyManager) RestoreKey(id string) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.RestoreKey(id)
+}
+
+func (m *timedKeyManager) UpdateAccess(id string, acl ...knox.Access) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.UpdateAccess(id, acl...)
+}
+
+func (m *timedKeyManager) AddVersion(id string, v *knox.KeyVersion) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.AddVersion(id, v)
+}
+
+func (m *timedKeyManager) UpdateVersion(keyID string, versionID uint64, s knox.VersionStatus) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.UpdateVersion(keyID, versionID, s)
+}
+
+func (m *timedKeyManager) RemoveVersions(keyID string, versionIDs ...uint64) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.RemoveVersions(keyID, versionIDs...)
+}
+
+func (m *timedKeyManager) UpdateMetadata(keyID string, md knox.KeyMetadata) error {
+	if err := m.begin(true); err != nil {
+		return err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.UpdateMetadata(keyID, md)
+}
+
+func (m *timedKeyManager) SearchKeyIDs(q KeySearch) ([]string, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.SearchKeyIDs(q)
+}
+
+func (m *timedKeyManager) FindKeysWithData(data []byte) ([]*knox.Key, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.FindKeysWithData(data)
+}
+
+func (m *timedKeyManager) ReencryptKeys() (*knox.ReencryptResult, error) {
+	if err := m.begin(true); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.ReencryptKeys()
+}
+
+func (m *timedKeyManager) ConsumeRead(id string) (int, error) {
+	if err := m.begin(true); err != nil {
+		return 0, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.ConsumeRead(id)
+}
+
+func (m *timedKeyManager) CheckConsistency(repair bool, keyIDs ...string) (*knox.ConsistencyReport, error) {
+	if err := m.begin(repair); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.CheckConsistency(repair, keyIDs...)
+}
+
+func (m *timedKeyManager) Snapshot() (*keydb.Snapshot, error) {
+	if err := m.begin(false); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.Snapshot()
+}
+
+func (m *timedKeyManager) RestoreSnapshot(s *keydb.Snapshot) (*knox.RestoreResult, error) {
+	if err := m.begin(true); err != nil {
+		return nil, err
+	}
+	defer m.track(time.Now())
+	return m.KeyManager.RestoreSnapshot(s)
+}
+
+func (m *timedKeyManager) IfVersionHash(versionHash string) KeyManager {
+	return &timedKeyManager{KeyManager: m.KeyManager.IfVersionHash(versionHash), parent: m}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	u := auth.NewUser("testuser", []string{})
+	var buf bytes.Buffer
+	m := makeDBWithOptions(KeyManagerOptions{Timeouts: TimeoutConfig{
+		Default: RouteTimeout{Slow: time.Hour},
+		Routes: map[string]RouteTimeout{
+			"hang": {Timeout: 10 * time.Millisecond},
+			"slow": {Slow: time.Nanosecond},
+		},
+		Logger: log.New(&buf, "", 0),
+	}})
+
+	release := make(chan struct{})
+	defer close(release)
+	hang := Route{Id: "hang", Handler: func(m KeyManager, p knox.Principal, ps map[string]string) (interface{}, *HTTPError) {
+		<-release
+		return nil, nil
+	}}
+	_, err := hang.runHandler(m, u, nil)
+	if err == nil || err.Subcode != knox.RequestTimeoutCode {
+		t.Fatalf("Expected timeout, got %+v", err)
+	}
+	var msg struct {
+		Payload slowRequestLog `json:"payload"`
+	}
+	if jsonErr := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &msg); jsonErr != nil {
+		t.Fatalf("Bad slow request log %q: %s", buf.String(), jsonErr)
+	}
+	e := msg.Payload
+	if e.Route != "hang" || !e.TimedOut || e.Principal != "testuser" {
+		t.Fatalf("Unexpected slow request log %+v", e)
+	}
+
+	buf.Reset()
+	fast := Route{Id: "getkeys", Handler: getKeysHandler}
+	if _, err := fast.runHandler(m, u, map[string]string{}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no slow request log, got %q", buf.String())
+	}
+
+	slow := Route{Id: "slow", Handler: getKeysHandler}
+	if _, err := slow.runHandler(m, u, map[string]string{}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &msg); err != nil || msg.Payload.Route != "slow" || msg.Payload.TimedOut || msg.Payload.KeyDBMs <= 0 {
+		t.Fatalf("Unexpected slow request log %q", buf.String())
+	}
+}
+
+// waitForAbandonedHandlers waits for the timed out handlers of m to finish.
+func waitForAbandonedHandlers(t *testing.T, m KeyManager) {
+	t.Helper()
+	for i := 0; optionsOf(m).Timeouts.abandonedHandlers() != 0; i++ {
+		if i == 1000 {
+			t.Fatal("Expected the abandoned handlers to be counted as finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouteTimeoutsWrites(t *testing.T) {
+	u := auth.NewUser("testuser", []string{})
+	m := makeDBWithOptions(KeyManagerOptions{Timeouts: TimeoutConfig{
+		Default:      RouteTimeout{Timeout: 10 * time.Millisecond},
+		MaxAbandoned: 1,
+		Logger:       log.New(&bytes.Buffer{}, "", 0),
+	}})
+
+	// A handler that started a write is waited for, so its response tells
+	// whether the write was applied.
+	writing := Route{Id: "writing", Handler: func(m KeyManager, p knox.Principal, ps map[string]string) (interface{}, *HTTPError) {
+		k := newKey("written", knox.ACL{}, []byte("a"), u, nil)
+		if err := m.AddNewKey(&k); err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		time.Sleep(30 * time.Millisecond)
+		return "written", nil
+	}}
+	if data, err := writing.runHandler(m, u, nil); err != nil || data != "written" {
+		t.Fatalf("Expected the writing handler's response, got %v and %+v", data, err)
+	}
+
+	// A timed out handler can't start a write.
+	release := make(chan struct{})
+	written := make(chan error, 1)
+	late := Route{Id: "late", Handler: func(m KeyManager, p knox.Principal, ps map[string]string) (interface{}, *HTTPError) {
+		<-release
+		k := newKey("late", knox.ACL{}, []byte("a"), u, nil)
+		written <- m.AddNewKey(&k)
+		return nil, nil
+	}}
+	if _, err := late.runHandler(m, u, nil); err == nil || err.Subcode != knox.RequestTimeoutCode {
+		t.Fatalf("Expected timeout, got %+v", err)
+	}
+
+	// While it still runs, further requests are shed.
+	fast := Route{Id: "getkeys", Handler: getKeysHandler}
+	if _, err := fast.runHandler(m, u, map[string]string{}); err == nil || err.Subcode != knox.RequestTimeoutCode {
+		t.Fatalf("Expected the request to be shed, got %+v", err)
+	}
+
+	close(release)
+	if err := <-written; err != errAbandoned {
+		t.Fatalf("Expected the write of a timed out handler to fail, got %v", err)
+	}
+	if _, err := m.GetKey("late", knox.Primary); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("Expected the late key not to be added, got %v", err)
+	}
+	waitForAbandonedHandlers(t, m)
+	if _, err := fast.runHandler(m, u, map[string]string{}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// TypedHandler is a route handler that receives its parameters decoded into a
+// struct instead of a map of strings.
+type TypedHandler[P any] func(m KeyManager, principal knox.Principal, params P) (interface{}, *HTTPError)
+
+// NewTypedRoute builds a Route whose parameters are declared with struct tags
+// on P and decoded before handler is called. Each tagged field has the form
+//
+//	KeyID  string `param:"keyID,url,required"`
+//	Data   []byte `param:"data,post,max=4096"`
+//
+// The first element is the parameter name and the second its source: url,
+// query, post, body (a field of a JSON request body) or rawquery. The options
+// are required and max=N, the maximum length of the raw value.
+//
+// Fields are decoded according to their type: strings as is, []byte as
+// standard base64, bools, integers, knox.VersionStatus as JSON, time.Time as
+// Unix seconds or RFC 3339, and any other type as JSON. Values are validated
+// like a ValidatedParameter before the handler runs, and missing optional
+// parameters leave the field at its zero value.
+func NewTypedRoute[P any](method, id, path string, handler TypedHandler[P]) (Route, error) {
+	t := reflect.TypeOf((*P)(nil)).Elem()
+	fields, err := typedParamFields(t)
+	if err != nil {
+		return Route{}, fmt.Errorf("route %s: %s", id, err.Error())
+	}
+	params := make([]Parameter, len(fields))
+	for i, f := range fields {
+		params[i] = f.param
+	}
+	return Route{
+		Method:     method,
+		Id:         id,
+		Path:       path,
+		Parameters: params,
+		Handler: func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+			var p P
+			v := reflect.ValueOf(&p).Elem()
+			for _, f := range fields {
+				value, ok := parameters[f.param.Name()]
+				if !ok || value == "" {
+					continue
+				}
+				if err := decodeParam(v.Field(f.index), value); err != nil {
+					return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid parameter '%s': %s", f.param.Name(), err.Error()))
+				}
+			}
+			return handler(m, principal, p)
+		},
+	}, nil
+}
+
+type typedParamField struct {
+	index int
+	param ValidatedParameter
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	statusType  = reflect.TypeOf(knox.VersionStatus(0))
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+func typedParamFields(t reflect.Type) ([]typedParamField, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("parameters must be a struct, not %s", t)
+	}
+	var fields []typedParamField
+	seen := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("param")
+		if !ok || tag == "-" {
+			continue
+		}
+		if !sf.IsExported() {
+			return nil, fmt.Errorf("field %s has a param tag but is not exported", sf.Name)
+		}
+		parts := strings.Split(tag, ",")
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("field %s: param tag needs a name and a source", sf.Name)
+		}
+		name := parts[0]
+		if seen[name] {
+			return nil, fmt.Errorf("parameter %s is declared twice", name)
+		}
+		seen[name] = true
+
+		p := ValidatedParameter{Type: paramTypeOf(sf.Type)}
+		switch parts[1] {
+		case "url":
+			p.Parameter = UrlParameter(name)
+		case "query":
+			p.Parameter = QueryParameter(name)
+		case "post":
+			p.Parameter = PostParameter(name)
+		case "body":
+			p.Parameter = BodyParameter(name)
+		case "rawquery":
+			p.Parameter = RawQueryParameter(name)
+		default:
+			return nil, fmt.Errorf("field %s: unknown parameter source %q", sf.Name, parts[1])
+		}
+		for _, opt := range parts[2:] {
+			switch {
+			case opt == "required":
+				p.Required = true
+			case strings.HasPrefix(opt, "max="):
+				n, err := strconv.Atoi(strings.TrimPrefix(opt, "max="))
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("field %s: invalid option %q", sf.Name, opt)
+				}
+				p.MaxLength = n
+			default:
+				return nil, fmt.Errorf("field %s: unknown option %q", sf.Name, opt)
+			}
+		}
+		fields = append(fields, typedParamField{index: i, param: p})
+	}
+	return fields, nil
+}
+
+// paramTypeOf picks the validation for a field type. Types without a matching
+// ParamType are checked when they are decoded.
+func paramTypeOf(t reflect.Type) ParamType {
+	switch {
+	case t == timeType:
+		return TimeParam
+	case t == statusType:
+		return StatusParam
+	case t == rawJSONType:
+		return JSONParam
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return Base64Param
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		return StringParam
+	case reflect.Bool:
+		return BoolParam
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return UintParam
+	}
+	return JSONParam
+}
+
+// decodeParam sets v from the raw value of a parameter.
+func decodeParam(v reflect.Value, value string) error {
+	t := v.Type()
+	switch {
+	case t == timeType:
+		ns, err := parseTimeParam(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(time.Unix(0, ns)))
+		return nil
+	case t == statusType:
+		s, err := parseStatus(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(s))
+		return nil
+	case t == rawJSONType:
+		v.SetBytes([]byte(value))
+		return nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		v.SetBytes(b)
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, t.Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, t.Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, t.Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+type typedTestParams struct {
+	KeyID    string             `param:"keyID,url,required"`
+	Data     []byte             `param:"data,post,required,max=64"`
+	Count    uint               `param:"count,post"`
+	Promote  bool               `param:"promote,post"`
+	Status   knox.VersionStatus `param:"status,post"`
+	At       time.Time          `param:"at,post"`
+	Metadata map[string]string  `param:"metadata,post"`
+	Ignored  string
+}
+
+func TestTypedRoute(t *testing.T) {
+	var got typedTestParams
+	route, err := NewTypedRoute("POST", "typed", "/v0/typed/{keyID}/",
+		func(m KeyManager, principal knox.Principal, p typedTestParams) (interface{}, *HTTPError) {
+			got = p
+			return "ok", nil
+		})
+	if err != nil {
+		t.Fatalf("Did not expect an error creating the route: %v", err)
+	}
+
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	router, err := GetRouter(cryptor, keydb.NewTempDB(), nil, []Route{route})
+	if err != nil {
+		t.Fatalf("Did not expect an error while creating router. Details: %v", err)
+	}
+
+	post := func(form url.Values) *knox.Response {
+		r, _ := http.NewRequest("POST", "/v0/typed/a1/", bytes.NewBufferString(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		resp := &knox.Response{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	resp := post(url.Values{
+		"data":     {"aGVsbG8="},
+		"count":    {"3"},
+		"promote":  {"true"},
+		"status":   {`"Primary"`},
+		"at":       {"1000"},
+		"metadata": {`{"owner":"team"}`},
+	})
+	if resp.Code != knox.OKCode {
+		t.Fatalf("Expected success, got %d: %s", resp.Code, resp.Message)
+	}
+	if got.KeyID != "a1" || string(got.Data) != "hello" || got.Count != 3 || !got.Promote ||
+		got.Status != knox.Primary || got.At.Unix() != 1000 || got.Metadata["owner"] != "team" {
+		t.Fatalf("Unexpected parameters %+v", got)
+	}
+
+	for _, form := range []url.Values{
+		{},
+		{"data": {"not base64!"}},
+		{"data": {"aGVsbG8="}, "count": {"-1"}},
+		{"data": {"aGVsbG8="}, "metadata": {`["a"]`}},
+	} {
+		if resp := post(form); resp.Code != knox.BadRequestDataCode {
+			t.Fatalf("Expected bad request for %v, got %d: %s", form, resp.Code, resp.Message)
+		}
+	}
+}
+
+func TestTypedRouteInvalidTags(t *testing.T) {
+	handler := func(m KeyManager, principal knox.Principal, p struct {
+		A string `param:"a,cookie"`
+	}) (interface{}, *HTTPError) {
+		return nil, nil
+	}
+	if _, err := NewTypedRoute("GET", "bad", "/v0/bad/", handler); err == nil {
+		t.Fatal("Expected an error for an unknown parameter source")
+	}
+
+	dup := func(m KeyManager, principal knox.Principal, p struct {
+		A string `param:"a,query"`
+		B string `param:"a,post"`
+	}) (interface{}, *HTTPError) {
+		return nil, nil
+	}
+	if _, err := NewTypedRoute("GET", "dup", "/v0/dup/", dup); err == nil {
+		t.Fatal("Expected an error for a duplicate parameter")
+	}
+}
+
+func TestInvalidAdditionalRoutes(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+	for _, route := range []Route{
+		{Method: "GET", Id: "nohandler", Path: "/v0/custom/"},
+		{Method: "GET", Path: "/v0/custom/", Handler: mockHandler},
+		{Method: "GET", Id: "badurl", Path: "/v0/custom/", Handler: mockHandler,
+			Parameters: []Parameter{UrlParameter("keyID")}},
+		{Method: "GET", Id: "twice", Path: "/v0/custom/", Handler: mockHandler,
+			Parameters: []Parameter{QueryParameter("a"), PostParameter("a")}},
+	} {
+		if _, err := GetRouter(cryptor, keydb.NewTempDB(), nil, []Route{route}); err == nil {
+			t.Fatalf("Expected an error for route %+v", route)
+		}
+	}
+}
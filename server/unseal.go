@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+	"github.com/pinterest/knox/shamir"
+)
+
+// UnsealConfig configures an Unsealer.
+type UnsealConfig struct {
+	// Threshold is the number of master key shares, made with shamir.Split,
+	// needed to unseal the server. If it is 0 or 1 the share is the master key
+	// itself.
+	Threshold int
+	// NewCryptor makes the cryptor for the master key.
+	NewCryptor func(masterKey []byte) (keydb.Cryptor, error)
+	// Verify checks that the cryptor can decrypt the stored keys, e.g. by
+	// decrypting one of them, so a wrong master key leaves the server sealed.
+	// It is optional.
+	Verify func(keydb.Cryptor) error
+}
+
+// Unsealer holds the master key shares submitted by operators until there are
+// enough to unseal the server, similar to Vault's unseal process. The server
+// uses Cryptor, which fails with keydb.ErrSealed until then.
+type Unsealer struct {
+	config  UnsealConfig
+	cryptor *keydb.SealedCryptor
+
+	mu     sync.Mutex
+	shares [][]byte
+}
+
+// NewUnsealer creates a sealed Unsealer.
+func NewUnsealer(c UnsealConfig) *Unsealer {
+	if c.Threshold < 1 {
+		c.Threshold = 1
+	}
+	return &Unsealer{config: c, cryptor: keydb.NewSealedCryptor()}
+}
+
+// Cryptor returns the cryptor to pass to the key manager and router.
+func (u *Unsealer) Cryptor() *keydb.SealedCryptor {
+	return u.cryptor
+}
+
+// Status returns whether the server is sealed and how many shares have been
+// submitted.
+func (u *Unsealer) Status() knox.UnsealStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status()
+}
+
+func (u *Unsealer) status() knox.UnsealStatus {
+	return knox.UnsealStatus{
+		Sealed:    u.cryptor.Sealed(),
+		Threshold: u.config.Threshold,
+		Progress:  len(u.shares),
+	}
+}
+
+// Submit adds a master key share. Once Threshold shares have been submitted
+// they are combined and the server is unsealed. If the combined master key
+// fails verification the shares are discarded and submission starts over.
+func (u *Unsealer) Submit(share []byte) (knox.UnsealStatus, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.cryptor.Sealed() {
+		return u.status(), nil
+	}
+	if len(share) == 0 {
+		return u.status(), fmt.Errorf("empty master key share")
+	}
+	if u.config.Threshold == 1 {
+		err := u.unseal(share)
+		return u.status(), err
+	}
+	for _, s := range u.shares {
+		if len(s) != len(share) {
+			return u.status(), fmt.Errorf("master key share has the wrong length")
+		}
+		if s[len(s)-1] == share[len(share)-1] {
+			return u.status(), fmt.Errorf("master key share was already submitted")
+		}
+	}
+	u.shares = append(u.shares, append([]byte(nil), share...))
+	if len(u.shares) < u.config.Threshold {
+		return u.status(), nil
+	}
+	masterKey, err := shamir.Combine(u.shares)
+	u.resetShares()
+	if err != nil {
+		return u.status(), err
+	}
+	err = u.unseal(masterKey)
+	zero(masterKey)
+	return u.status(), err
+}
+
+// Unseal unseals the server with the whole master key, e.g. after unwrapping
+// it with a KMS at startup.
+func (u *Unsealer) Unseal(masterKey []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.cryptor.Sealed() {
+		return nil
+	}
+	u.resetShares()
+	return u.unseal(masterKey)
+}
+
+func (u *Unsealer) unseal(masterKey []byte) error {
+	c, err := u.config.NewCryptor(bytes.Clone(masterKey))
+	if err != nil {
+		return err
+	}
+	if u.config.Verify != nil {
+		if err := u.config.Verify(c); err != nil {
+			return fmt.Errorf("master key failed verification: %v", err)
+		}
+	}
+	return u.cryptor.Unseal(c)
+}
+
+func (u *Unsealer) resetShares() {
+	for _, s := range u.shares {
+		zero(s)
+	}
+	u.shares = nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+var unsealer *Unsealer
+
+// SetUnsealer makes the unsealer available through the admin API of
+// KeyManagers made with NewKeyManager or GetRouter.
+//
+// Deprecated: Set KeyManagerOptions.Unsealer and use NewKeyManagerWithOptions.
+func SetUnsealer(u *Unsealer) {
+	unsealer = u
+}
+
+// adminUnsealHandler submits a master key share to a sealed server.
+// The route for this handler is POST /v0/admin/unseal/
+func adminUnsealHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	u := optionsOf(m).Unsealer
+	if u == nil {
+		return nil, errF(knox.NotFoundCode, "This server does not start sealed")
+	}
+	share, _ := base64.StdEncoding.DecodeString(parameters["share"])
+	status, err := u.Submit(share)
+	zero(share)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	return status, nil
+}
+
+// RequireUnsealed returns a decorator that fails requests with a SealedCode
+// error while u is sealed, except those submitting master key shares.
+func RequireUnsealed(u *Unsealer) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if u.Cryptor().Sealed() && GetRouteID(r) != "adminunseal" {
+				WriteErr(errF(knox.SealedCode, "Server is sealed until operators submit the master key"))(w, r)
+				return
+			}
+			f(w, r)
+		}
+	}
+}
+
+// HealthHandler serves the seal status of u as JSON, with a 503 status while
+// it is sealed so load balancers only route to unsealed servers.
+func HealthHandler(u *Unsealer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := u.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if status.Sealed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		knox.JSONCodec.Encode(w, status)
+	}
+}
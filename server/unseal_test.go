@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+	"github.com/pinterest/knox/shamir"
+)
+
+var testMasterKey = []byte("testtesttesttest")
+
+func newTestUnsealer(threshold int) *Unsealer {
+	return NewUnsealer(UnsealConfig{
+		Threshold: threshold,
+		NewCryptor: func(masterKey []byte) (keydb.Cryptor, error) {
+			return keydb.NewAESGCMCryptor(0, masterKey), nil
+		},
+	})
+}
+
+func TestUnsealerShares(t *testing.T) {
+	shares, err := shamir.Split(testMasterKey, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newTestUnsealer(3)
+	if s := u.Status(); !s.Sealed || s.Threshold != 3 || s.Progress != 0 {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	if _, err := u.Submit(shares[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Submit(shares[0]); err == nil {
+		t.Fatal("Expected a duplicate share to be rejected")
+	}
+	s, err := u.Submit(shares[3])
+	if err != nil || !s.Sealed || s.Progress != 2 {
+		t.Fatalf("Unexpected status %+v, %v", s, err)
+	}
+	s, err = u.Submit(shares[4])
+	if err != nil || s.Sealed || s.Progress != 0 {
+		t.Fatalf("Unexpected status %+v, %v", s, err)
+	}
+
+	// The unsealed cryptor uses the master key.
+	m := NewKeyManager(u.Cryptor(), keydb.NewTempDB())
+	if _, err := postKeysHandler(m, auth.NewUser("testuser", []string{}), map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err := NewKeyManager(keydb.NewAESGCMCryptor(0, testMasterKey), m.(*keyManager).db).GetKey("a1", knox.Primary); err != nil {
+		t.Fatalf("Failed to read key with the master key: %s", err)
+	}
+}
+
+func TestUnsealerFailedVerification(t *testing.T) {
+	u := newTestUnsealer(1)
+	u.config.Verify = func(keydb.Cryptor) error { return fmt.Errorf("wrong key") }
+	if _, err := u.Submit(testMasterKey); err == nil {
+		t.Fatal("Expected verification to fail")
+	}
+	if !u.Status().Sealed {
+		t.Fatal("Expected the server to stay sealed")
+	}
+	u.config.Verify = nil
+	if err := u.Unseal(testMasterKey); err != nil || u.Status().Sealed {
+		t.Fatalf("Expected the server to unseal, got %v", err)
+	}
+}
+
+func TestAdminUnsealHandler(t *testing.T) {
+	u := auth.NewUser("testuser", []string{})
+	if _, err := adminUnsealHandler(makeDBWithOptions(KeyManagerOptions{}), u, map[string]string{"share": "MQ=="}); err == nil || err.Subcode != knox.NotFoundCode {
+		t.Fatalf("Expected NotFoundCode without an unsealer, got %+v", err)
+	}
+	m := makeDBWithOptions(KeyManagerOptions{Unsealer: newTestUnsealer(1)})
+	i, err := adminUnsealHandler(m, u, map[string]string{"share": base64.StdEncoding.EncodeToString(testMasterKey)})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if s := i.(knox.UnsealStatus); s.Sealed {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+}
+
+func TestRequireUnsealed(t *testing.T) {
+	u := newTestUnsealer(1)
+	handler := setupRoute("getkeys", nil)(RequireUnsealed(u)(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/v0/keys/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected sealed server to reject requests, got %d", w.Code)
+	}
+
+	health := httptest.NewRecorder()
+	HealthHandler(u)(health, httptest.NewRequest("GET", "/healthz", nil))
+	if health.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected sealed health check to fail, got %d", health.Code)
+	}
+
+	if err := u.Unseal(testMasterKey); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/v0/keys/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected unsealed server to serve requests, got %d", w.Code)
+	}
+	health = httptest.NewRecorder()
+	HealthHandler(u)(health, httptest.NewRequest("GET", "/healthz", nil))
+	if health.Code != http.StatusOK {
+		t.Fatalf("Expected health check to pass, got %d", health.Code)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/pinterest/knox"
+)
+
+// The /v1 API serves the same operations as /v0 from the same KeyManager with
+// a few differences:
+//   - Request bodies are JSON objects instead of form encoded values.
+//   - Every response, including errors, uses the knox.Response envelope.
+//   - Listing keys is paginated and checking for updated keys sends the
+//     version hashes in the request body instead of the URL.
+//
+// All other v1 routes are derived from the v0 routes table so new features
+// only need to be added once.
+var v1Routes = buildV1Routes()
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	maxJSONBodySize = 1 << 20
+)
+
+func buildV1Routes() []Route {
+	out := []Route{
+		{
+			Method:  "GET",
+			Id:      "v1getkeys",
+			Path:    "/v1/keys/",
+			Handler: v1GetKeysHandler,
+			Parameters: []Parameter{
+				ValidatedParameter{Parameter: QueryParameter("limit"), Type: UintParam},
+				QueryParameter("cursor"),
+			},
+		},
+		{
+			Method:  "POST",
+			Id:      "v1updatedkeys",
+			Path:    "/v1/keys/updated/",
+			Handler: v1UpdatedKeysHandler,
+			Parameters: []Parameter{
+				ValidatedParameter{Parameter: BodyParameter("versions"), Type: JSONParam, Required: true},
+			},
+		},
+	}
+	for _, r := range append(routes[:], adminRoutes...) {
+		if r.Id == "getkeys" {
+			continue
+		}
+		v := r
+		v.Id = "v1" + r.Id
+		v.Path = "/v1/" + strings.TrimPrefix(r.Path, "/v0/")
+		v.Parameters = make([]Parameter, len(r.Parameters))
+		for i, p := range r.Parameters {
+			v.Parameters[i] = v1Parameter(p)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// v1Parameter reads form parameters from the JSON body instead.
+func v1Parameter(p Parameter) Parameter {
+	switch p := p.(type) {
+	case PostParameter:
+		return BodyParameter(p)
+	case ValidatedParameter:
+		p.Parameter = v1Parameter(p.Parameter)
+		return p
+	}
+	return p
+}
+
+// BodyParameter is an implementation of the Parameter interface that extracts
+// a field of the JSON object in the request body. String fields are passed to
+// handlers as is and any other JSON value as its encoded text, so handlers can
+// parse them the same way as form values.
+type BodyParameter string
+
+// Get returns the value of the field in the request body
+func (p BodyParameter) Get(r *http.Request) (string, bool) {
+	body := getJSONBody(r)
+	if body.err != nil {
+		return "", false
+	}
+	raw, ok := body.fields[string(p)]
+	if !ok || bytes.Equal(raw, []byte("null")) {
+		return "", false
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, true
+	}
+	return string(raw), true
+}
+
+// Name represents the field of the JSON object that this parameter maps to
+func (p BodyParameter) Name() string {
+	return string(p)
+}
+
+type jsonBody struct {
+	fields map[string]json.RawMessage
+	err    error
+}
+
+// getJSONBody decodes the request body once and caches it in the request
+// context.
+func getJSONBody(r *http.Request) *jsonBody {
+	if rv := context.Get(r, bodyContext); rv != nil {
+		return rv.(*jsonBody)
+	}
+	body := &jsonBody{}
+	if r.Body != nil {
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxJSONBodySize+1))
+		switch {
+		case err != nil:
+			body.err = err
+		case len(b) > maxJSONBodySize:
+			body.err = fmt.Errorf("request body is larger than %d bytes", maxJSONBodySize)
+		case len(bytes.TrimSpace(b)) > 0:
+			body.err = json.Unmarshal(b, &body.fields)
+		}
+	}
+	context.Set(r, bodyContext, body)
+	return body
+}
+
+// bodyError returns an error if the request had a JSON body that could not be
+// decoded.
+func bodyError(r *http.Request) *HTTPError {
+	if rv := context.Get(r, bodyContext); rv != nil {
+		if err := rv.(*jsonBody).err; err != nil {
+			return errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid JSON request body: %s", err.Error()))
+		}
+	}
+	return nil
+}
+
+// v1GetKeysHandler returns a page of key IDs in lexical order. The cursor is
+// the Next value of the previous page.
+// The route for this handler is GET /v1/keys/
+// There are no authorization constraints on this route.
+func v1GetKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	limit := defaultPageSize
+	if s, ok := parameters["limit"]; ok && s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Parameter 'limit' must be between 1 and %d", maxPageSize))
+		}
+		limit = n
+	}
+	cursor := parameters["cursor"]
+
+	ids, err := m.GetAllKeyIDs()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	sort.Strings(ids)
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(ids), func(i int) bool { return ids[i] > cursor })
+	}
+	end := start + limit
+	if end > len(ids) {
+		end = len(ids)
+	}
+	page := knox.KeyPage{Keys: ids[start:end]}
+	if end < len(ids) {
+		page.Next = ids[end-1]
+	}
+	return page, nil
+}
+
+// v1UpdatedKeysHandler returns the IDs of keys whose version hash differs from
+// the one given for it in the versions object.
+// The route for this handler is POST /v1/keys/updated/
+// There are no authorization constraints on this route.
+func v1UpdatedKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	versions := map[string]string{}
+	if err := json.Unmarshal([]byte(parameters["versions"]), &versions); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	if len(versions) == 0 {
+		return []string{}, nil
+	}
+	keys, err := m.GetUpdatedKeyIDs(versions)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return keys, nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+var serverVersion string
+
+// SetServerVersion sets the version reported in the server_version field of
+// every response of KeyManagers made with NewKeyManager or GetRouter.
+//
+// Deprecated: Set KeyManagerOptions.ServerVersion and use
+// NewKeyManagerWithOptions.
+func SetServerVersion(version string) {
+	serverVersion = version
+}
+
+var recommendedClientVersion string
+
+// SetRecommendedClientVersion sets the version clients of KeyManagers made
+// with NewKeyManager or GetRouter are asked to upgrade to, see
+// KeyManagerOptions.RecommendedClientVersion.
+//
+// Deprecated: Set KeyManagerOptions.RecommendedClientVersion and use
+// NewKeyManagerWithOptions.
+func SetRecommendedClientVersion(version string) {
+	recommendedClientVersion = version
+}
+
+var (
+	minimumClientVersion      string
+	enforceClientVersionAfter time.Time
+)
+
+// SetMinimumClientVersion sets the minimum client version of KeyManagers
+// made with NewKeyManager or GetRouter and when it is enforced, see
+// KeyManagerOptions.MinimumClientVersion.
+//
+// Deprecated: Set KeyManagerOptions.MinimumClientVersion and
+// EnforceClientVersionAfter and use NewKeyManagerWithOptions.
+func SetMinimumClientVersion(version string, enforceAfter time.Time) {
+	minimumClientVersion = version
+	enforceClientVersionAfter = enforceAfter
+}
+
+// belowMinimumVersion returns the version of the client that made r if it is
+// older than the minimum version.
+func belowMinimumVersion(opts KeyManagerOptions, r *http.Request) (string, bool) {
+	if opts.MinimumClientVersion == "" || r == nil {
+		return "", false
+	}
+	v := clientVersion(r.Header.Get("User-Agent"))
+	c, ok := compareVersions(v, opts.MinimumClientVersion)
+	return v, ok && c < 0
+}
+
+// checkClientVersion rejects requests from clients older than the minimum
+// version once it is enforced.
+func checkClientVersion(opts KeyManagerOptions, r *http.Request) *HTTPError {
+	v, old := belowMinimumVersion(opts, r)
+	if !old || time.Now().Before(opts.EnforceClientVersionAfter) {
+		return nil
+	}
+	return errF(knox.ClientVersionTooOldCode, fmt.Sprintf("Knox client %s is older than the minimum version %s, please upgrade", v, opts.MinimumClientVersion))
+}
+
+var (
+	deprecatedParamsMu sync.RWMutex
+	deprecatedParams   = map[string]map[string]string{}
+)
+
+// DeprecateParameter makes successful responses to requests of the route
+// with the given ID that use the parameter carry a warning with message,
+// e.g. naming its replacement and when it is removed.
+func DeprecateParameter(routeID, param, message string) {
+	deprecatedParamsMu.Lock()
+	defer deprecatedParamsMu.Unlock()
+	if deprecatedParams[routeID] == nil {
+		deprecatedParams[routeID] = map[string]string{}
+	}
+	deprecatedParams[routeID][param] = message
+}
+
+// requestWarnings returns the warnings about how a request was made.
+func requestWarnings(opts KeyManagerOptions, routeID string, r *http.Request, ps map[string]string) []string {
+	var warnings []string
+	deprecatedParamsMu.RLock()
+	for param, message := range deprecatedParams[routeID] {
+		if _, ok := ps[param]; ok {
+			warnings = append(warnings, fmt.Sprintf("The %s parameter is deprecated: %s", param, message))
+		}
+	}
+	deprecatedParamsMu.RUnlock()
+	sort.Strings(warnings)
+
+	if v, old := belowMinimumVersion(opts, r); old {
+		return append(warnings, fmt.Sprintf("Knox client %s is older than the minimum version %s and will be rejected from %s, please upgrade",
+			v, opts.MinimumClientVersion, opts.EnforceClientVersionAfter.UTC().Format(time.RFC3339)))
+	}
+	recommended := opts.RecommendedClientVersion
+	if recommended == "" || r == nil {
+		return warnings
+	}
+	v := clientVersion(r.Header.Get("User-Agent"))
+	if c, ok := compareVersions(v, recommended); ok && c < 0 {
+		warnings = append(warnings, fmt.Sprintf("Knox client %s is older than the recommended version %s, please upgrade", v, recommended))
+	}
+	return warnings
+}
+
+// clientVersion returns the version of the knox client in a User-Agent
+// header, or "" for other user agents.
+func clientVersion(userAgent string) string {
+	for _, product := range strings.Fields(userAgent) {
+		if v, ok := strings.CutPrefix(product, "Knox_Client/"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// compareVersions compares dotted versions such as 1.2.10, with an optional
+// v prefix, and reports whether both could be parsed. Missing components
+// count as zero.
+func compareVersions(a, b string) (int, bool) {
+	pa, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	pb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if v == "" {
+		return nil, false
+	}
+	parts := strings.Split(v, ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
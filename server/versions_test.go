@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/pinterest/knox"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		c    int
+		ok   bool
+	}{
+		{"1.2.3", "1.2.3", 0, true},
+		{"1.2", "1.2.0", 0, true},
+		{"1.2.9", "1.2.10", -1, true},
+		{"v2.0", "1.9.9", 1, true},
+		{"devel", "1.0", 0, false},
+		{"1.0-rc1", "1.0", 0, false},
+	}
+	for _, tc := range tests {
+		if c, ok := compareVersions(tc.a, tc.b); c != tc.c || ok != tc.ok {
+			t.Fatalf("compareVersions(%q, %q) = %d, %v, expected %d, %v", tc.a, tc.b, c, ok, tc.c, tc.ok)
+		}
+	}
+	if v := clientVersion("Knox_Client/1.4.0 myservice/2.0"); v != "1.4.0" {
+		t.Fatalf("Expected the knox client version, got %q", v)
+	}
+	if v := clientVersion("curl/8.0"); v != "" {
+		t.Fatalf("Expected no version for other clients, got %q", v)
+	}
+}
+
+func TestResponseVersionAndWarnings(t *testing.T) {
+	m := makeDBWithOptions(KeyManagerOptions{ServerVersion: "3.1.0", RecommendedClientVersion: "1.5"})
+	DeprecateParameter("versiontest", "old", "use new instead")
+	defer func() {
+		deprecatedParamsMu.Lock()
+		delete(deprecatedParams, "versiontest")
+		deprecatedParamsMu.Unlock()
+	}()
+
+	route := Route{
+		Id:         "versiontest",
+		Parameters: []Parameter{QueryParameter("old"), QueryParameter("new")},
+		Handler: func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+			return addWarnings("ok", "from the handler"), nil
+		},
+	}
+	serve := func(agent string, params map[string]string) *knox.Response {
+		r := httptest.NewRequest("GET", "/", nil)
+		defer context.Clear(r)
+		r.Header.Set("User-Agent", agent)
+		setDB(r, m)
+		setParams(r, params)
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, r)
+		resp := &knox.Response{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := serve("Knox_Client/1.4.2", map[string]string{"old": "x"})
+	if resp.ServerVersion != "3.1.0" {
+		t.Fatalf("Expected the server version, got %q", resp.ServerVersion)
+	}
+	got := strings.Join(resp.Warnings, "\n")
+	for _, w := range []string{"old parameter is deprecated: use new instead", "older than the recommended version 1.5", "from the handler"} {
+		if !strings.Contains(got, w) {
+			t.Fatalf("Expected a warning containing %q, got %v", w, resp.Warnings)
+		}
+	}
+
+	resp = serve("Knox_Client/devel", map[string]string{"new": "x"})
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != "from the handler" {
+		t.Fatalf("Expected only the handler warning, got %v", resp.Warnings)
+	}
+}
+
+func TestMinimumClientVersion(t *testing.T) {
+	var m KeyManager
+	route := Route{
+		Id: "versiontest",
+		Handler: func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+			return "ok", nil
+		},
+	}
+	serve := func(agent string) (int, *knox.Response) {
+		r := httptest.NewRequest("GET", "/", nil)
+		defer context.Clear(r)
+		r.Header.Set("User-Agent", agent)
+		setDB(r, m)
+		setParams(r, map[string]string{})
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, r)
+		resp := &knox.Response{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, resp
+	}
+
+	m = makeDBWithOptions(KeyManagerOptions{MinimumClientVersion: "2.0", EnforceClientVersionAfter: time.Now().Add(time.Hour)})
+	code, resp := serve("Knox_Client/1.9")
+	if code != http.StatusOK || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "will be rejected from") {
+		t.Fatalf("Expected a warning during the grace period, got %d %v", code, resp.Warnings)
+	}
+
+	m = makeDBWithOptions(KeyManagerOptions{MinimumClientVersion: "2.0"})
+	code, resp = serve("Knox_Client/1.9")
+	if code != http.StatusUpgradeRequired || resp.Code != knox.ClientVersionTooOldCode {
+		t.Fatalf("Expected the old client to be rejected, got %d %+v", code, resp)
+	}
+	for _, agent := range []string{"Knox_Client/2.0.1", "Knox_Client/devel", "curl/8.0"} {
+		if code, resp := serve(agent); code != http.StatusOK || len(resp.Warnings) != 0 {
+			t.Fatalf("Expected %s to be served, got %d %+v", agent, code, resp)
+		}
+	}
+}
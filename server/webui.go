@@ -0,0 +1,88 @@
+package server
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/pinterest/knox"
+)
+
+//go:embed webui
+var webUIFiles embed.FS
+
+// WebUIHandler serves the static files of the web UI, a page for browsing
+// keys, their ACLs and versions and the audit log without the CLI. It should
+// be mounted at /ui/ next to the router, with the routes of WebUIRoutes:
+//
+//	http.Handle("/ui/", http.StripPrefix("/ui/", server.WebUIHandler()))
+//
+// The files hold no data. The page asks for the user's auth token, keeps it
+// in the browser session and reads everything from the API with it, so users
+// only see what the API shows them.
+func WebUIHandler() http.Handler {
+	files, err := fs.Sub(webUIFiles, "webui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
+
+// WebUIRoutes returns the routes the web UI needs beyond the API, to be
+// passed as additional routes to GetRouter. They only serve users. With
+// changes, the UI also offers to promote and deactivate versions and to
+// delete and restore keys; the API checks those as for any other client.
+func WebUIRoutes(changes bool) []Route {
+	return []Route{
+		{
+			Method:     "GET",
+			Id:         "webuiconfig",
+			Path:       "/v0/ui/config/",
+			Handler:    webUIConfigHandler(changes),
+			Principals: []PrincipalKind{UserPrincipal},
+		},
+		{
+			Method:     "GET",
+			Id:         "webuikey",
+			Path:       "/v0/ui/keys/{keyID}/",
+			Handler:    webUIKeyHandler,
+			Principals: []PrincipalKind{UserPrincipal},
+			Parameters: []Parameter{
+				UrlParameter("keyID"),
+			},
+		},
+	}
+}
+
+// webUIConfig tells the web UI who is signed in and what it may offer.
+type webUIConfig struct {
+	User    string `json:"user"`
+	Changes bool   `json:"changes"`
+}
+
+func webUIConfigHandler(changes bool) func(KeyManager, knox.Principal, map[string]string) (interface{}, *HTTPError) {
+	return func(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+		return webUIConfig{User: principal.GetID(), Changes: changes}, nil
+	}
+}
+
+// webUIKeyHandler returns a key without the data of its versions, so users
+// can see its versions whether or not they may read it.
+// The route for this handler is GET /v0/ui/keys/<key_id>/
+// There are no authorization constraints on this route, like for the ACL.
+func webUIKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *HTTPError) {
+	keyID := parameters["keyID"]
+	key, getErr := m.GetKey(keyID, knox.Inactive)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+	key.TinkKeyset = ""
+	for i := range key.VersionList {
+		key.VersionList[i].Data = nil
+	}
+	return key, nil
+}
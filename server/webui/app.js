@@ -0,0 +1,244 @@
+// The knox web UI. Everything is read from the knox API with the user's
+// token, which is kept in the session storage of the browser tab.
+"use strict";
+
+const tokenItem = "knox.token";
+let config = null;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+// el creates an element with text content and children. Data from the API is
+// only ever set as text.
+function el(tag, text, ...children) {
+  const e = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    e.textContent = text;
+  }
+  for (const c of children) {
+    e.appendChild(c);
+  }
+  return e;
+}
+
+function table(headers, rows) {
+  const t = el("table");
+  t.appendChild(el("tr", null, ...headers.map((h) => el("th", h))));
+  for (const row of rows) {
+    t.appendChild(el("tr", null, ...row.map((c) => (c instanceof Node ? el("td", null, c) : el("td", c)))));
+  }
+  return t;
+}
+
+function link(text, hash) {
+  const a = el("a", text);
+  a.href = hash;
+  return a;
+}
+
+function button(text, onclick) {
+  const b = el("button", text);
+  b.addEventListener("click", onclick);
+  return b;
+}
+
+// time formats the Unix nanoseconds knox uses for times.
+function time(nanos) {
+  return nanos ? new Date(nanos / 1e6).toISOString() : "";
+}
+
+// api calls a knox route and returns the data of its response, or throws an
+// error with the message of the server.
+async function api(method, path, form) {
+  const init = {
+    method: method,
+    headers: { Authorization: "0u" + sessionStorage.getItem(tokenItem), Accept: "application/json" },
+  };
+  if (form) {
+    init.body = new URLSearchParams(form);
+  }
+  const resp = await fetch(path, init);
+  let body;
+  try {
+    body = await resp.json();
+  } catch (e) {
+    throw new Error(`${method} ${path} failed with HTTP ${resp.status}`);
+  }
+  if (body.status !== "ok") {
+    const err = new Error(body.message || `${method} ${path} failed with code ${body.code}`);
+    err.status = resp.status;
+    throw err;
+  }
+  return body.data;
+}
+
+function showError(err) {
+  $("error").textContent = err.message;
+  $("error").hidden = !err.message;
+}
+
+async function signIn() {
+  try {
+    config = await api("GET", "/v0/ui/config/");
+  } catch (err) {
+    sessionStorage.removeItem(tokenItem);
+    $("signin").hidden = false;
+    $("app").hidden = true;
+    if (err.status !== 401) {
+      showError(err);
+    }
+    return;
+  }
+  $("user").textContent = config.user;
+  $("signout").hidden = false;
+  $("signin").hidden = true;
+  $("app").hidden = false;
+  route();
+}
+
+async function route() {
+  showError({ message: "" });
+  const view = $("view");
+  view.replaceChildren();
+  const [page, ...rest] = location.hash.slice(1).split("/");
+  try {
+    switch (page) {
+      case "key":
+        await showKey(view, decodeURIComponent(rest.join("/")));
+        break;
+      case "deleted":
+        await showDeleted(view);
+        break;
+      case "audit":
+        await showAudit(view, "");
+        break;
+      default:
+        await showKeys(view);
+    }
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function showKeys(view) {
+  const ids = (await api("GET", "/v0/keys/")) || [];
+  ids.sort();
+  const filter = el("input");
+  filter.type = "search";
+  filter.placeholder = "Filter keys";
+  const list = el("ul");
+  const render = () => {
+    list.replaceChildren(
+      ...ids.filter((id) => id.includes(filter.value)).map((id) => el("li", null, link(id, "#key/" + encodeURIComponent(id))))
+    );
+  };
+  filter.addEventListener("input", render);
+  render();
+  view.append(el("h2", `Keys (${ids.length})`), filter, list);
+}
+
+async function showKey(view, id) {
+  const key = await api("GET", `/v0/ui/keys/${encodeURIComponent(id)}/`);
+  view.append(el("h2", key.id));
+  if (config.changes) {
+    view.append(
+      button("Delete key", async () => {
+        if (confirm(`Delete ${key.id}?`)) {
+          await change("DELETE", `/v0/keys/${encodeURIComponent(key.id)}/`);
+          location.hash = "#keys";
+        }
+      })
+    );
+  }
+
+  view.append(el("h3", "Access"), table(["Type", "Principal", "Access"], (key.acl || []).map((a) => [a.type, a.id, a.access])));
+
+  const versions = (key.versions || []).map((v) => {
+    const row = [String(v.id), v.status, time(v.ts), time(v.activation), v.content_type || ""];
+    if (config.changes) {
+      const actions = el("span");
+      const setStatus = (status) =>
+        change("PUT", `/v0/keys/${encodeURIComponent(key.id)}/versions/${v.id}/`, { status: JSON.stringify(status) });
+      if (v.status === "Active") {
+        actions.append(button("Promote", () => setStatus("Primary")), button("Deactivate", () => setStatus("Inactive")));
+      } else if (v.status === "Inactive") {
+        actions.append(button("Reactivate", () => setStatus("Active")));
+      }
+      row.push(actions);
+    }
+    return row;
+  });
+  const headers = ["Version", "Status", "Created", "Activation", "Content type"];
+  view.append(el("h3", "Versions"), table(config.changes ? headers.concat("") : headers, versions));
+
+  const metadata = Object.entries(key.metadata || {}).sort();
+  if (metadata.length > 0) {
+    view.append(el("h3", "Metadata"), table(["Name", "Value"], metadata));
+  }
+
+  await showAudit(view, key.id);
+}
+
+async function showDeleted(view) {
+  const keys = (await api("GET", "/v0/deleted/")) || [];
+  const rows = keys.map((k) => {
+    const row = [k.id, time(k.deleted_at), time(k.purge_at)];
+    if (config.changes) {
+      row.push(button("Restore", () => change("POST", `/v0/deleted/${encodeURIComponent(k.id)}/`)));
+    }
+    return row;
+  });
+  const headers = ["Key", "Deleted", "Purged"];
+  view.append(el("h2", "Deleted keys"), table(config.changes ? headers.concat("") : headers, rows));
+}
+
+// showAudit shows the recent requests for a key, or for all keys without one.
+// Only admins may read the audit log.
+async function showAudit(view, keyID) {
+  view.append(el(keyID ? "h3" : "h2", "Audit log"));
+  let events;
+  try {
+    events = await api("GET", "/v0/admin/audit/?key=" + encodeURIComponent(keyID));
+  } catch (err) {
+    view.append(el("p", err.status === 401 || err.status === 403 ? "Only admins can read the audit log." : err.message));
+    return;
+  }
+  const rows = (events || []).map((e) => [e.time, `${e.principal_type} ${e.principal}`, e.route, e.key_id || "", e.success ? "yes" : "no"]);
+  view.append(table(["Time", "Principal", "Route", "Key", "Succeeded"], rows));
+}
+
+// change makes a change through the API and shows the page again.
+async function change(method, path, form) {
+  try {
+    await api(method, path, form);
+  } catch (err) {
+    showError(err);
+    return;
+  }
+  route();
+}
+
+$("signin-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  sessionStorage.setItem(tokenItem, $("token").value);
+  $("token").value = "";
+  signIn();
+});
+
+$("signout").addEventListener("click", () => {
+  sessionStorage.removeItem(tokenItem);
+  location.reload();
+});
+
+window.addEventListener("hashchange", () => {
+  if (config) {
+    route();
+  }
+});
+
+if (sessionStorage.getItem(tokenItem)) {
+  signIn();
+} else {
+  $("signin").hidden = false;
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+)
+
+func TestWebUIHandler(t *testing.T) {
+	h := WebUIHandler()
+	for path, want := range map[string]string{"/": "<title>Knox</title>", "/app.js": "/v0/ui/config/"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("Unexpected response to %s: %d %q", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWebUIRoutes(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("other", []string{})
+	if _, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	routes := WebUIRoutes(true)
+	for _, r := range routes {
+		if len(r.Principals) != 1 || r.Principals[0] != UserPrincipal {
+			t.Fatalf("Expected route %s to only serve users", r.Id)
+		}
+	}
+	i, err := routes[0].Handler(m, other, nil)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if c := i.(webUIConfig); c.User != "other" || !c.Changes {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+
+	// Users without access see the versions of a key but not their data.
+	i, err = webUIKeyHandler(m, other, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	key := i.(*knox.Key)
+	if len(key.VersionList) != 1 || key.VersionList[0].Data != nil || len(key.ACL) == 0 {
+		t.Fatalf("Unexpected key %+v", key)
+	}
+	if stored, _ := m.GetKey("a1", knox.Primary); string(stored.VersionList[0].Data) != "1" {
+		t.Fatalf("Expected the stored key to keep its data, got %q", stored.VersionList[0].Data)
+	}
+	if _, err := webUIKeyHandler(m, other, map[string]string{"keyID": "missing"}); err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected a missing key to be reported, got %+v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Package shamir splits secrets into shares with Shamir's secret sharing
+// scheme, so that any threshold of the shares reconstructs the secret and
+// fewer reveal nothing about it. Knox stores each share of a root secret as
+// a separate key, so no single ACL grants access to the secret itself.
+//
+// Arithmetic is in GF(2^8), one polynomial per byte of the secret. Each share
+// is as long as the secret plus one byte, its x coordinate.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// MaxParts is the largest number of shares a secret can be split into.
+const MaxParts = 255
+
+var (
+	// ErrTooFewShares is returned when fewer than two shares are combined.
+	ErrTooFewShares = errors.New("shamir: at least two shares are needed")
+	// ErrInvalidShares is returned for shares of different lengths or with
+	// repeated or zero x coordinates.
+	ErrInvalidShares = errors.New("shamir: shares are malformed or from different secrets")
+)
+
+// Split splits secret into parts shares, any threshold of which reconstruct
+// it with Combine.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("shamir: cannot split an empty secret")
+	}
+	if threshold < 2 || threshold > parts || parts > MaxParts {
+		return nil, fmt.Errorf("shamir: need 2 <= threshold <= parts <= %d, got threshold %d and parts %d", MaxParts, threshold, parts)
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for b, s := range secret {
+		// coefficients[0] is the secret byte, the others are random.
+		if _, err := rand.Read(coefficients); err != nil {
+			return nil, err
+		}
+		coefficients[0] = s
+		for i := range shares {
+			shares[i][b] = evaluate(coefficients, byte(i+1))
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// Combine reconstructs a secret from shares made by Split. Given fewer shares
+// than the threshold, it returns a wrong secret rather than an error, so
+// callers must know the threshold.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+	n := len(shares[0])
+	if n < 2 {
+		return nil, ErrInvalidShares
+	}
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, s := range shares {
+		if len(s) != n {
+			return nil, ErrInvalidShares
+		}
+		x := s[n-1]
+		if x == 0 || seen[x] {
+			return nil, ErrInvalidShares
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+	secret := make([]byte, n-1)
+	ys := make([]byte, len(shares))
+	for b := range secret {
+		for i, s := range shares {
+			ys[i] = s[b]
+		}
+		secret[b] = interpolateAtZero(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate returns the polynomial with the given coefficients, lowest degree
+// first, at x.
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = add(mul(y, x), coefficients[i])
+	}
+	return y
+}
+
+// interpolateAtZero returns the value at 0 of the polynomial through the
+// points (xs[i], ys[i]) using Lagrange interpolation.
+func interpolateAtZero(xs, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// The basis polynomial at 0 is the product of x_j / (x_j - x_i),
+			// and subtraction is addition in GF(2^8).
+			basis = mul(basis, div(xs[j], add(xs[j], xs[i])))
+		}
+		result = add(result, mul(ys[i], basis))
+	}
+	return result
+}
+
+func add(a, b byte) byte {
+	return a ^ b
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1,
+// without branching on its inputs.
+func mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7) & 0x1b
+		a = a<<1 ^ carry
+		b >>= 1
+	}
+	return p
+}
+
+// div divides a by a non-zero b.
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
+
+// inverse returns the multiplicative inverse of a non-zero a, a^254.
+func inverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = mul(a, a)
+		result = mul(result, a)
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("root key material")
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares, got %d", len(shares))
+	}
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				got, err := Combine([][]byte{shares[k], shares[i], shares[j]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, secret) {
+					t.Fatalf("shares %d, %d and %d combined to %q", i, j, k, got)
+				}
+			}
+		}
+	}
+	all, err := Combine(shares)
+	if err != nil || !bytes.Equal(all, secret) {
+		t.Fatalf("all shares combined to %q, %v", all, err)
+	}
+	few, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(few, secret) {
+		t.Fatal("expected fewer shares than the threshold not to reconstruct the secret")
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	cases := []struct {
+		secret           []byte
+		parts, threshold int
+	}{
+		{nil, 3, 2},
+		{[]byte("s"), 3, 1},
+		{[]byte("s"), 2, 3},
+		{[]byte("s"), 256, 2},
+	}
+	for _, c := range cases {
+		if _, err := Split(c.secret, c.parts, c.threshold); err == nil {
+			t.Errorf("expected error splitting %q into %d with threshold %d", c.secret, c.parts, c.threshold)
+		}
+	}
+}
+
+func TestCombineErrors(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Combine(shares[:1]); err != ErrTooFewShares {
+		t.Fatalf("expected ErrTooFewShares, got %v", err)
+	}
+	if _, err := Combine([][]byte{shares[0], shares[0]}); err != ErrInvalidShares {
+		t.Fatalf("expected ErrInvalidShares for repeated shares, got %v", err)
+	}
+	if _, err := Combine([][]byte{shares[0], shares[1][1:]}); err != ErrInvalidShares {
+		t.Fatalf("expected ErrInvalidShares for shares of different lengths, got %v", err)
+	}
+}
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inverse(byte(a))); got != 1 {
+			t.Fatalf("%d * inverse(%d) = %d", a, a, got)
+		}
+	}
+	// 0x53 * 0xca = 0x01 in the AES field.
+	if got := mul(0x53, 0xca); got != 0x01 {
+		t.Fatalf("unexpected product %#x", got)
+	}
+}
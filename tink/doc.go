@@ -0,0 +1,19 @@
+// Package tink stores Tink keysets in knox keys, one Tink key per knox
+// version, so Tink keys are rotated, promoted and deactivated like any other
+// key version.
+//
+// The knox CLI uses this package for its --key-template and --tink-keyset
+// options, and services embedding the knox client can use it to get Tink
+// primitives for their keys:
+//
+//	key, err := client.GetKey("tink:aead:my_service")
+//	...
+//	handle, err := tink.HandleFromKey(key)
+//	...
+//	a, err := aead.New(handle)
+//
+// Only the primary and active versions of a key make up its keyset, and the
+// primary version holds the keyset's primary key. Keys whose metadata has a
+// knox.MetadataTinkKMSKeyURI store keysets encrypted with that KMS key; the
+// KMS client for it must be registered with Tink's registry.RegisterKMSClient.
+package tink
@@ -0,0 +1,571 @@
+package tink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/daead"
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/mac"
+	"github.com/google/tink/go/signature"
+	"github.com/google/tink/go/streamingaead"
+	tinkgo "github.com/google/tink/go/tink"
+	"github.com/pinterest/knox"
+
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+)
+
+// keyTemplateInfo represents the info for a supported tink keyset template.
+type keyTemplateInfo struct {
+	knoxIDPrefix string
+	templateFunc func() *tinkpb.KeyTemplate
+}
+
+// keyTemplates contains the supported tink key templates and the correcsponding naming rule for knox identifier
+var keyTemplates = map[string]keyTemplateInfo{
+	"TINK_AEAD_AES256_GCM":                               {"tink:aead:", aead.AES256GCMKeyTemplate},
+	"TINK_AEAD_AES128_GCM":                               {"tink:aead:", aead.AES128GCMKeyTemplate},
+	"TINK_MAC_HMAC_SHA512_256BITTAG":                     {"tink:mac:", mac.HMACSHA512Tag256KeyTemplate},
+	"TINK_DSIG_ECDSA_P256":                               {"tink:dsig:", signature.ECDSAP256KeyTemplate},
+	"TINK_DSIG_ED25519":                                  {"tink:dsig:", signature.ED25519KeyTemplate},
+	"TINK_HYBRID_ECIES_P256_HKDF_HMAC_SHA256_AES128_GCM": {"tink:hybrid:", hybrid.ECIESHKDFAES128GCMKeyTemplate},
+	"TINK_DAEAD_AES256_SIV":                              {"tink:daead:", daead.AESSIVKeyTemplate},
+	"TINK_SAEAD_AES128_GCM_HKDF_1MB":                     {"tink:saead:", streamingaead.AES128GCMHKDF1MBKeyTemplate},
+	"TINK_SAEAD_AES128_GCM_HKDF_4KB":                     {"tink:saead:", streamingaead.AES128GCMHKDF4KBKeyTemplate},
+}
+
+var templateNameRegexp = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
+// KeyIDPrefix starts the knox identifiers of the built-in templates' keys.
+const KeyIDPrefix = "tink:"
+
+// RegisterKeyTemplate adds a Tink key template, e.g. one that knox create and knox add can use with
+// --key-template, and whose keys must have IDs starting with knoxIDPrefix, e.g. "tink:aead:".
+// Templates are checked by generating a keyset from them. Built-in and already registered templates
+// can't be replaced. Templates must be registered at startup, before the other functions of this
+// package are used.
+func RegisterKeyTemplate(name, knoxIDPrefix string, templateFunc func() *tinkpb.KeyTemplate) error {
+	if !templateNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid tink key template name %q, use upper case letters, digits and _", name)
+	}
+	if _, ok := keyTemplates[name]; ok {
+		return fmt.Errorf("tink key template %s is already registered", name)
+	}
+	if len(knoxIDPrefix) < 2 || !strings.HasSuffix(knoxIDPrefix, ":") {
+		return fmt.Errorf("knox identifier prefix %q for %s must end with ':'", knoxIDPrefix, name)
+	}
+	if _, err := keyset.NewHandle(templateFunc()); err != nil {
+		return fmt.Errorf("cannot create a keyset from tink key template %s: %v", name, err)
+	}
+	keyTemplates[name] = keyTemplateInfo{knoxIDPrefix, templateFunc}
+	return nil
+}
+
+// keyTemplateConfig is a Tink key template in a file read by RegisterKeyTemplatesFromFile.
+type keyTemplateConfig struct {
+	Name         string `json:"name"`
+	KnoxIDPrefix string `json:"knox_id_prefix"`
+	TypeURL      string `json:"type_url"`
+	// Value is the serialized key format of the template, base64 encoded.
+	Value            []byte `json:"value"`
+	OutputPrefixType string `json:"output_prefix_type"`
+}
+
+// RegisterKeyTemplatesFromFile registers the Tink key templates listed in a JSON file, e.g.
+//
+//	{"templates": [{"name": "ACME_AEAD_AES256_GCM_RAW", "knox_id_prefix": "tink:aead:",
+//	  "type_url": "type.googleapis.com/google.crypto.tink.AesGcmKey", "value": "ECA=",
+//	  "output_prefix_type": "RAW"}]}
+//
+// output_prefix_type defaults to TINK. See RegisterKeyTemplate.
+func RegisterKeyTemplatesFromFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		Templates []keyTemplateConfig `json:"templates"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("cannot parse tink key templates in %s: %v", path, err)
+	}
+	for _, c := range config.Templates {
+		prefixType := tinkpb.OutputPrefixType_TINK
+		if c.OutputPrefixType != "" {
+			v, ok := tinkpb.OutputPrefixType_value[c.OutputPrefixType]
+			if !ok || v == int32(tinkpb.OutputPrefixType_UNKNOWN_PREFIX) {
+				return fmt.Errorf("invalid output prefix type %q for tink key template %s", c.OutputPrefixType, c.Name)
+			}
+			prefixType = tinkpb.OutputPrefixType(v)
+		}
+		c := c
+		templateFunc := func() *tinkpb.KeyTemplate {
+			return &tinkpb.KeyTemplate{TypeUrl: c.TypeURL, Value: c.Value, OutputPrefixType: prefixType}
+		}
+		if err := RegisterKeyTemplate(c.Name, c.KnoxIDPrefix, templateFunc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyTemplateNames returns the names of the supported tink key templates in sorted order.
+func KeyTemplateNames() []string {
+	supportedTemplates := make([]string, 0, len(keyTemplates))
+	for key := range keyTemplates {
+		supportedTemplates = append(supportedTemplates, key)
+	}
+	sort.Strings(supportedTemplates)
+	return supportedTemplates
+}
+
+// CheckKeyID checks that templateName is a supported template and that the knox identifier starts
+// with its prefix, e.g. "tink:<tink_primitive_short_name>:".
+func CheckKeyID(templateName string, knoxIentifier string) error {
+	templateInfo, ok := keyTemplates[templateName]
+	if !ok {
+		return errors.New("not supported Tink key template. See 'knox key-templates'")
+	} else if !strings.HasPrefix(knoxIentifier, templateInfo.knoxIDPrefix) {
+		return fmt.Errorf("<key_identifier> must have prefix '%s'", templateInfo.knoxIDPrefix)
+	}
+	return nil
+}
+
+// IsKeysetID checks whether knox identifier starts with the prefix of a supported template, e.g.
+// "tink:<tink_primitive_short_name>:".
+func IsKeysetID(knoxIdentifier string) bool {
+	for _, templateInfo := range keyTemplates {
+		if strings.HasPrefix(knoxIdentifier, templateInfo.knoxIDPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewKeyset returns the data for the first version of a knox key storing a tink keyset, made with the
+// named template. If kekURI is set, the keyset is encrypted with that KMS key, and the version's
+// content type must be ContentType(kekURI).
+func NewKeyset(templateName string, kekURI string) ([]byte, error) {
+	templateInfo, ok := keyTemplates[templateName]
+	if !ok {
+		return nil, fmt.Errorf("not supported Tink key template %s", templateName)
+	}
+	return newKeyset(templateInfo.templateFunc, kekURI)
+}
+
+// NextKeyset returns the data for a new version of a knox key storing a tink keyset, made with the
+// named template and with a tink key ID none of the given versions has. See NewKeyset for kekURI.
+func NextKeyset(templateName string, knoxVersionList knox.KeyVersionList, kekURI string) ([]byte, error) {
+	templateInfo, ok := keyTemplates[templateName]
+	if !ok {
+		return nil, fmt.Errorf("not supported Tink key template %s", templateName)
+	}
+	return nextKeyset(templateInfo.templateFunc, knoxVersionList, kekURI)
+}
+
+// newKeyset creates a new tink keyset contains a single fresh key from the given tink key templateFunc.
+// If kekURI is set, the keyset is encrypted with that KMS key.
+func newKeyset(templateFunc func() *tinkpb.KeyTemplate, kekURI string) ([]byte, error) {
+	// Creates a keyset handle that contains a single fresh key
+	keysetHandle, err := keyset.NewHandle(templateFunc())
+	if keysetHandle == nil || err != nil {
+		return nil, fmt.Errorf("cannot get tink keyset handle: %v", err)
+	}
+	return WriteKeyset(keysetHandle, kekURI)
+}
+
+// ContentType returns the content type of versions holding keysets written with kekURI.
+func ContentType(kekURI string) string {
+	if kekURI != "" {
+		return knox.ContentTypeTinkEncryptedKeyset
+	}
+	return knox.ContentTypeTinkKeyset
+}
+
+// kmsAEAD returns the AEAD of the KMS key at kekURI. The KMS client must have been registered with
+// registry.RegisterKMSClient, e.g. from Tink's awskms or gcpkms packages.
+func kmsAEAD(kekURI string) (tinkgo.AEAD, error) {
+	kms, err := registry.GetKMSClient(kekURI)
+	if err != nil {
+		return nil, fmt.Errorf("no KMS client for %s: %v", kekURI, err)
+	}
+	kek, err := kms.GetAEAD(kekURI)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get KMS key %s: %v", kekURI, err)
+	}
+	return kek, nil
+}
+
+// WriteKeyset converts a tink keyset handle to bytes, encrypting it with the KMS key at
+// kekURI if it is set and leaving it in cleartext otherwise.
+func WriteKeyset(keysetHandle *keyset.Handle, kekURI string) ([]byte, error) {
+	if kekURI == "" {
+		return cleartextBytes(keysetHandle)
+	}
+	kek, err := kmsAEAD(kekURI)
+	if err != nil {
+		return nil, err
+	}
+	bytesBuffer := new(bytes.Buffer)
+	if err := keysetHandle.Write(keyset.NewBinaryWriter(bytesBuffer), kek); err != nil {
+		return nil, fmt.Errorf("cannot write encrypted tink keyset: %v", err)
+	}
+	return bytesBuffer.Bytes(), nil
+}
+
+// ReadVersionKeyset extracts the tink keyset of a knox version, decrypting it with the KMS key at
+// kekURI if the version holds an encrypted keyset.
+func ReadVersionKeyset(v knox.KeyVersion, kekURI string) (*tinkpb.Keyset, error) {
+	if v.ContentType != knox.ContentTypeTinkEncryptedKeyset {
+		return ReadKeyset(v.Data)
+	}
+	if kekURI == "" {
+		return nil, fmt.Errorf("the key has no %s to decrypt the tink keyset with", knox.MetadataTinkKMSKeyURI)
+	}
+	kek, err := kmsAEAD(kekURI)
+	if err != nil {
+		return nil, err
+	}
+	keysetHandle, err := keyset.Read(keyset.NewBinaryReader(bytes.NewReader(v.Data)), kek)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt tink keyset: %v", err)
+	}
+	return insecurecleartextkeyset.KeysetMaterial(keysetHandle), nil
+}
+
+// VersionKeyID returns the ID of the primary tink key of a knox version. Encrypted keysets carry
+// their key IDs in cleartext, so they are not decrypted.
+func VersionKeyID(v knox.KeyVersion, kekURI string) (uint32, error) {
+	if v.ContentType == knox.ContentTypeTinkEncryptedKeyset {
+		encrypted, err := keyset.NewBinaryReader(bytes.NewReader(v.Data)).ReadEncrypted()
+		if err != nil {
+			return 0, fmt.Errorf("unexpected error reading encrypted tink keyset: %v", err)
+		}
+		if encrypted.KeysetInfo != nil {
+			return encrypted.KeysetInfo.PrimaryKeyId, nil
+		}
+	}
+	ks, err := ReadVersionKeyset(v, kekURI)
+	if err != nil {
+		return 0, err
+	}
+	return ks.PrimaryKeyId, nil
+}
+
+// cleartextBytes extracts keyset from tink keyset handle and converts it to bytes
+func cleartextBytes(keysetHandle *keyset.Handle) ([]byte, error) {
+	bytesBuffer := new(bytes.Buffer)
+	writer := keyset.NewBinaryWriter(bytesBuffer)
+	// To write cleartext keyset handle, must use package "insecurecleartextkeyset"
+	err := insecurecleartextkeyset.Write(keysetHandle, writer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write tink keyset: %v", err)
+	}
+	return bytesBuffer.Bytes(), nil
+}
+
+// nextKeyset receives a knox version list and a tink key templateFunc, create a new tink keyset contains
+// a single fresh key from the given tink key templateFunc. Most importantly, the ID of this single fresh key is
+// different from the ID of all existing tink keys in the given knox version list (avoid Tink key ID duplications).
+// If kekURI is set, the new keyset is encrypted with that KMS key.
+func nextKeyset(templateFunc func() *tinkpb.KeyTemplate, knoxVersionList knox.KeyVersionList, kekURI string) ([]byte, error) {
+	existingTinkKeysID := make(map[uint32]struct{})
+	for _, v := range knoxVersionList {
+		primaryKeyID, err := VersionKeyID(v, kekURI)
+		if err != nil {
+			return nil, err
+		}
+		existingTinkKeysID[primaryKeyID] = struct{}{}
+	}
+	var keysetHandle *keyset.Handle
+	var err error
+	// This loop is for retrying until a non-duplicate key id is generated.
+	isDuplicated := true
+	for isDuplicated {
+		keysetHandle, err = keyset.NewHandle(templateFunc())
+		if keysetHandle == nil || err != nil {
+			return nil, fmt.Errorf("cannot get tink keyset handle: %v", err)
+		}
+		newTinkKeyID := keysetHandle.KeysetInfo().PrimaryKeyId
+		_, isDuplicated = existingTinkKeysID[newTinkKeyID]
+	}
+	return WriteKeyset(keysetHandle, kekURI)
+}
+
+// GenerateVersion creates the data for a new version of a knox key that
+// stores a Tink keyset, using the named template. It matches the signature of
+// server key generators so knox servers can rotate Tink keys, e.g. with a
+// "tink" entry of server.KeyGeneratorFunc(tink.GenerateVersion) in
+// KeyManagerOptions.KeyGenerators.
+// Keys with a knox.MetadataTinkKMSKeyURI get an encrypted keyset, which needs a KMS
+// client for the key URI to be registered in the server.
+func GenerateVersion(templateName string, key *knox.Key) ([]byte, error) {
+	if err := CheckKeyID(templateName, key.ID); err != nil {
+		return nil, err
+	}
+	return nextKeyset(keyTemplates[templateName].templateFunc, key.VersionList, key.Metadata[knox.MetadataTinkKMSKeyURI])
+}
+
+// ReadKeyset extracts a cleartext tink keyset from bytes.
+func ReadKeyset(data []byte) (*tinkpb.Keyset, error) {
+	bytesBuffer := new(bytes.Buffer)
+	bytesBuffer.Write(data)
+	tinkKeyset, err := keyset.NewBinaryReader(bytesBuffer).Read()
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error reading tink keyset: %v", err)
+	}
+	return tinkKeyset, nil
+}
+
+// HandleFromKey returns a tink keyset handle with the tink keys of the primary and active versions of
+// a knox key, such as one returned by knox.GetKey, decrypting them with the key's KMS key if it has
+// one. Use it to get Tink primitives, e.g. aead.New, for a key stored in knox.
+func HandleFromKey(key *knox.Key) (*keyset.Handle, error) {
+	keysetHandle, _, err := KeysetHandle(key.VersionList, key.Metadata[knox.MetadataTinkKMSKeyURI])
+	return keysetHandle, err
+}
+
+// KeysetHandle returns a tink keyset handle that has all tink keys in the
+// received knox version list and a map from tink key IDs to knox version IDs. To be noticed, each
+// knox version contains a tink keyset that has a single tink key (tink key has a property, tink key id).
+// This func enumerates the given knox version list, put tink keys from different knox versions into
+// one tink keyset "fullTinkKeyset". Also, this func records which tink key is from which knox version
+// in a map "tinkKeyIDToKnoxVersionID". The tink keys of inactive and scheduled knox versions are
+// left out, see Prune.
+// Encrypted keysets are decrypted with the KMS key at kekURI.
+func KeysetHandle(
+	knoxVersionList knox.KeyVersionList,
+	kekURI string,
+) (*keyset.Handle, map[uint32]uint64, error) {
+	fullTinkKeyset := new(tinkpb.Keyset)
+	tinkKeyIDToKnoxVersionID := make(map[uint32]uint64)
+	knoxVersionList, _ = Prune(knoxVersionList)
+	for _, v := range knoxVersionList {
+		// the data of each version is a tink keyset that contains a single tink key
+		keyComponent, err := ReadVersionKeyset(v, kekURI)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(keyComponent.Key) == 0 {
+			return nil, nil, fmt.Errorf("knox version %d holds an empty tink keyset", v.ID)
+		}
+		singleKey := keyComponent.Key[0]
+		if v.Status == knox.Primary {
+			fullTinkKeyset.PrimaryKeyId = singleKey.KeyId
+		}
+		fullTinkKeyset.Key = append(fullTinkKeyset.Key, singleKey)
+		tinkKeyIDToKnoxVersionID[singleKey.KeyId] = v.ID
+	}
+	keysetHandle, err := cleartextHandle(fullTinkKeyset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keysetHandle, tinkKeyIDToKnoxVersionID, nil
+}
+
+// Prune splits a knox version list into the versions whose tink keys belong in the
+// tink keyset, the primary and active ones, and the others, whose tink keys are dropped from it.
+func Prune(knoxVersionList knox.KeyVersionList) (kept, pruned knox.KeyVersionList) {
+	for _, v := range knoxVersionList {
+		if v.Status == knox.Primary || v.Status == knox.Active {
+			kept = append(kept, v)
+		} else {
+			pruned = append(pruned, v)
+		}
+	}
+	return kept, pruned
+}
+
+// CheckPrimaryConsistency checks that the knox and tink statuses of the knox versions agree:
+// exactly one knox version is primary, the keyset of every version has its own tink key as primary,
+// and the tink keys of primary and active versions are enabled, so the knox primary version is also
+// the primary of the assembled tink keyset.
+func CheckPrimaryConsistency(knoxVersionList knox.KeyVersionList, kekURI string) error {
+	var primaryVersions []uint64
+	for _, v := range knoxVersionList {
+		keyComponent, err := ReadVersionKeyset(v, kekURI)
+		if err != nil {
+			return fmt.Errorf("knox version %d does not hold a tink keyset: %v", v.ID, err)
+		}
+		if len(keyComponent.Key) != 1 {
+			return fmt.Errorf("knox version %d holds %d tink keys, each version must hold exactly one", v.ID, len(keyComponent.Key))
+		}
+		key := keyComponent.Key[0]
+		if keyComponent.PrimaryKeyId != key.KeyId {
+			return fmt.Errorf("knox version %d holds tink key %d but its keyset's primary is %d",
+				v.ID, key.KeyId, keyComponent.PrimaryKeyId)
+		}
+		if (v.Status == knox.Primary || v.Status == knox.Active) && key.Status != tinkpb.KeyStatusType_ENABLED {
+			return fmt.Errorf("knox version %d is in use but its tink key %d is %s", v.ID, key.KeyId, key.Status)
+		}
+		if v.Status == knox.Primary {
+			primaryVersions = append(primaryVersions, v.ID)
+		}
+	}
+	if len(primaryVersions) != 1 {
+		return fmt.Errorf("knox versions %v are primary, a tink keyset needs exactly one", primaryVersions)
+	}
+	return nil
+}
+
+// ValidateVersions checks that the knox versions can be assembled into a usable tink
+// keyset: each holds a single enabled tink key whose key data Tink can parse, no two hold the same
+// tink key ID and exactly one is primary. Errors name the offending knox version rather than failing
+// deep inside Tink when the keyset is used.
+func ValidateVersions(knoxVersionList knox.KeyVersionList, kekURI string) error {
+	tinkKeyIDToKnoxVersionID := make(map[uint32]uint64)
+	var primaryVersions []uint64
+	for _, v := range knoxVersionList {
+		keyComponent, err := ReadVersionKeyset(v, kekURI)
+		if err != nil {
+			return fmt.Errorf("knox version %d does not hold a tink keyset: %v", v.ID, err)
+		}
+		if len(keyComponent.Key) != 1 {
+			return fmt.Errorf("knox version %d holds %d tink keys, each version must hold exactly one", v.ID, len(keyComponent.Key))
+		}
+		key := keyComponent.Key[0]
+		if err := validateKey(key); err != nil {
+			return fmt.Errorf("knox version %d holds an invalid tink key: %v", v.ID, err)
+		}
+		if other, ok := tinkKeyIDToKnoxVersionID[key.KeyId]; ok {
+			return fmt.Errorf("knox versions %d and %d hold the same tink key ID %d, deactivate one of them",
+				other, v.ID, key.KeyId)
+		}
+		tinkKeyIDToKnoxVersionID[key.KeyId] = v.ID
+		if v.Status == knox.Primary {
+			primaryVersions = append(primaryVersions, v.ID)
+		}
+	}
+	switch len(primaryVersions) {
+	case 0:
+		return fmt.Errorf("none of the %d knox versions is primary", len(knoxVersionList))
+	case 1:
+		return nil
+	}
+	return fmt.Errorf("knox versions %v are all primary, a tink keyset needs exactly one", primaryVersions)
+}
+
+// validateKey checks that a tink key is enabled and that Tink can parse its key data.
+func validateKey(key *tinkpb.Keyset_Key) error {
+	if key.KeyData == nil {
+		return errors.New("it has no key data")
+	}
+	if key.Status != tinkpb.KeyStatusType_ENABLED {
+		return fmt.Errorf("its status is %s, not ENABLED", key.Status)
+	}
+	if key.OutputPrefixType == tinkpb.OutputPrefixType_UNKNOWN_PREFIX {
+		return errors.New("its output prefix type is unknown")
+	}
+	if _, err := registry.PrimitiveFromKeyData(key.KeyData); err != nil {
+		return fmt.Errorf("cannot parse its %s key data: %v", key.KeyData.TypeUrl, err)
+	}
+	return nil
+}
+
+// cleartextHandle converts cleartext tink keyset to tink keyset handle
+func cleartextHandle(cleartextTinkKeyset *tinkpb.Keyset) (*keyset.Handle, error) {
+	bytesBuffer := new(bytes.Buffer)
+	writer := keyset.NewBinaryWriter(bytesBuffer)
+	writer.Write(cleartextTinkKeyset)
+	reader := keyset.NewBinaryReader(bytesBuffer)
+	// To get keyset handle from cleartext keyset, must use package "insecurecleartextkeyset"
+	keysetHandle, err := insecurecleartextkeyset.Read(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get tink keyset handle: %v", err)
+	}
+	return keysetHandle, nil
+}
+
+// VersionInfo returns the info of the tink keyset of a knox version, without key material. Encrypted
+// keysets carry their info in cleartext, so they are not decrypted.
+func VersionInfo(v knox.KeyVersion) (KeysetInfo, error) {
+	if v.ContentType == knox.ContentTypeTinkEncryptedKeyset {
+		encrypted, err := keyset.NewBinaryReader(bytes.NewReader(v.Data)).ReadEncrypted()
+		if err != nil {
+			return KeysetInfo{}, fmt.Errorf("unexpected error reading encrypted tink keyset: %v", err)
+		}
+		if encrypted.KeysetInfo == nil {
+			return KeysetInfo{}, errors.New("the encrypted tink keyset has no keyset info")
+		}
+		return NewKeysetInfo(encrypted.KeysetInfo, map[uint32]uint64{}), nil
+	}
+	ks, err := ReadKeyset(v.Data)
+	if err != nil {
+		return KeysetInfo{}, err
+	}
+	keysetHandle, err := cleartextHandle(ks)
+	if err != nil {
+		return KeysetInfo{}, err
+	}
+	return NewKeysetInfo(keysetHandle.KeysetInfo(), map[uint32]uint64{}), nil
+}
+
+// KeysetInfoJSON returns a string representation of the info of the given tink keyset
+// handle. The returned string which does not contain any sensitive key material.
+func KeysetInfoJSON(
+	keysetHandle *keyset.Handle,
+	tinkKeyIDToKnoxVersionID map[uint32]uint64,
+) (string, error) {
+	// translate the info from the tink build-in function to json format
+	keysetInfo := NewKeysetInfo(keysetHandle.KeysetInfo(), tinkKeyIDToKnoxVersionID)
+	keysetInfoForPrint, err := json.MarshalIndent(keysetInfo, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(keysetInfoForPrint), nil
+}
+
+// KeysetInfo is tink keyset info in JSON format, doesn't contain any actual key material.
+type KeysetInfo struct {
+	PrimaryKeyId uint32     `json:"primary_key_id"`
+	KeyInfo      []*KeyInfo `json:"key_info"`
+}
+
+// KeyInfo is tink key info in JSON format, doesn't contain any actual key material.
+type KeyInfo struct {
+	TypeUrl          string `json:"type_url"`
+	Status           string `json:"status"`
+	KeyId            uint32 `json:"key_id"`
+	OutputPrefixType string `json:"output_prefix_type"`
+	KnoxVersionID    uint64 `json:"knox_version_id"`
+}
+
+// NewKeysetInfo translates Tink keyset info to JSON format, giving the knox version of each tink key
+// from tinkKeyIDToKnoxVersionID.
+func NewKeysetInfo(
+	keysetInfo *tinkpb.KeysetInfo,
+	tinkKeyIDToKnoxVersionID map[uint32]uint64,
+) KeysetInfo {
+	return KeysetInfo{
+		keysetInfo.PrimaryKeyId,
+		newKeysInfo(keysetInfo.KeyInfo, tinkKeyIDToKnoxVersionID),
+	}
+}
+
+// newKeysInfo translates Tink key info to JSON format.
+func newKeysInfo(
+	keysetInfo_KeyInfo []*tinkpb.KeysetInfo_KeyInfo,
+	tinkKeyIDToKnoxVersionID map[uint32]uint64,
+) []*KeyInfo {
+	var tinkKeysInfo []*KeyInfo
+	for _, v := range keysetInfo_KeyInfo {
+		tinkKeysInfo = append(tinkKeysInfo, &KeyInfo{
+			v.TypeUrl,
+			v.Status.String(),
+			v.KeyId,
+			v.OutputPrefixType.String(),
+			tinkKeyIDToKnoxVersionID[v.KeyId],
+		})
+	}
+	return tinkKeysInfo
+}
@@ -0,0 +1,641 @@
+package tink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/mac"
+	"github.com/google/tink/go/testing/fakekms"
+	"github.com/google/tink/go/testkeyset"
+	"github.com/pinterest/knox"
+
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+)
+
+func TestKeyTemplateNames(t *testing.T) {
+	names := []string{
+		"TINK_AEAD_AES128_GCM",
+		"TINK_AEAD_AES256_GCM",
+		"TINK_DAEAD_AES256_SIV",
+		"TINK_DSIG_ECDSA_P256",
+		"TINK_DSIG_ED25519",
+		"TINK_HYBRID_ECIES_P256_HKDF_HMAC_SHA256_AES128_GCM",
+		"TINK_MAC_HMAC_SHA512_256BITTAG",
+		"TINK_SAEAD_AES128_GCM_HKDF_1MB",
+		"TINK_SAEAD_AES128_GCM_HKDF_4KB",
+	}
+	expected := strings.Join(names, "\n")
+	if expected != strings.Join(KeyTemplateNames(), "\n") {
+		t.Fatalf("cannot list name of supported tink key templates correctly")
+	}
+}
+
+func TestCheckKeyID(t *testing.T) {
+	if err := CheckKeyID("invalid", "invalid"); err == nil {
+		t.Fatalf("cannot identify invalid tink key template")
+	}
+	for k := range keyTemplates {
+		illegalKnoxIdentifier := "wrongKnoxIdentifier"
+		err := CheckKeyID(k, illegalKnoxIdentifier)
+		if err == nil {
+			t.Fatalf("cannot identify illegal knox identifer for template '%s'", k)
+		}
+	}
+	for k, v := range keyTemplates {
+		legalKnoxIdentifier := v.knoxIDPrefix + "test"
+		err := CheckKeyID(k, legalKnoxIdentifier)
+		if err != nil {
+			t.Fatalf("cannot accept legal knox identifer for template '%s'", k)
+		}
+	}
+}
+
+func TestRegisterKeyTemplate(t *testing.T) {
+	defer delete(keyTemplates, "ACME_AEAD_AES128_GCM_RAW")
+	if err := RegisterKeyTemplate("ACME_AEAD_AES128_GCM_RAW", "acme:aead:", aead.AES128GCMKeyTemplate); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := CheckKeyID("ACME_AEAD_AES128_GCM_RAW", "acme:aead:test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !IsKeysetID("acme:aead:test") {
+		t.Fatal("expected the registered prefix to be a tink keyset prefix")
+	}
+	if err := RegisterKeyTemplate("TINK_AEAD_AES256_GCM", "tink:aead:", aead.AES256GCMKeyTemplate); err == nil {
+		t.Fatal("expected error replacing a built-in template")
+	}
+	if err := RegisterKeyTemplate("lower", "tink:aead:", aead.AES256GCMKeyTemplate); err == nil {
+		t.Fatal("expected error for an invalid name")
+	}
+	if err := RegisterKeyTemplate("ACME_NO_PREFIX", "acme", aead.AES256GCMKeyTemplate); err == nil {
+		t.Fatal("expected error for an invalid prefix")
+	}
+	bad := func() *tinkpb.KeyTemplate { return &tinkpb.KeyTemplate{TypeUrl: "type.googleapis.com/nope"} }
+	if err := RegisterKeyTemplate("ACME_BAD", "acme:bad:", bad); err == nil {
+		t.Fatal("expected error for a template Tink can't use")
+	}
+}
+
+func TestRegisterKeyTemplatesFromFile(t *testing.T) {
+	defer delete(keyTemplates, "ACME_AEAD_AES256_GCM_RAW")
+	path := filepath.Join(t.TempDir(), "templates.json")
+	config := `{"templates": [{"name": "ACME_AEAD_AES256_GCM_RAW", "knox_id_prefix": "tink:aead:",
+		"type_url": "type.googleapis.com/google.crypto.tink.AesGcmKey", "value": "ECA=",
+		"output_prefix_type": "RAW"}]}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterKeyTemplatesFromFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := newKeyset(keyTemplates["ACME_AEAD_AES256_GCM_RAW"].templateFunc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := ReadKeyset(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Key[0].OutputPrefixType != tinkpb.OutputPrefixType_RAW {
+		t.Fatalf("expected a RAW key, got %s", ks.Key[0].OutputPrefixType)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"templates": [{"name": "ACME_X", "knox_id_prefix": "tink:aead:", "output_prefix_type": "NOPE"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterKeyTemplatesFromFile(path); err == nil {
+		t.Fatal("expected error for an invalid output prefix type")
+	}
+}
+
+func TestIsKeysetID(t *testing.T) {
+	if IsKeysetID("invalid") {
+		t.Fatalf("cannot identify knox identifier that is not for tink keyset")
+	}
+	for _, templateInfo := range keyTemplates {
+		knoxIdentifierForTinkKeyset := templateInfo.knoxIDPrefix + "test"
+		if !IsKeysetID(knoxIdentifierForTinkKeyset) {
+			t.Fatalf("cannot identify knox identifier that is for tink keyset")
+		}
+	}
+}
+
+func TestNewKeyset(t *testing.T) {
+	keyTemplate := mac.HMACSHA512Tag256KeyTemplate
+	keysetInBytes, err := newKeyset(keyTemplate, "")
+	if err != nil {
+		t.Fatalf("cannot create a new tink keyset: %v", err)
+	}
+	bytesBuffer := new(bytes.Buffer)
+	bytesBuffer.Write(keysetInBytes)
+	tinkKeyset, err := keyset.NewBinaryReader(bytesBuffer).Read()
+	if err != nil {
+		t.Fatalf("unexpected error reading tink keyset data: %v", err)
+	}
+	if len(tinkKeyset.Key) != 1 {
+		t.Fatalf("incorrect number of keys in the keyset: %d", len(tinkKeyset.Key))
+	}
+	tinkKey := tinkKeyset.Key[0]
+	if tinkKeyset.PrimaryKeyId != tinkKey.KeyId {
+		t.Fatalf("incorrect primary key id, expect %d, got %d", tinkKey.KeyId, tinkKeyset.PrimaryKeyId)
+	}
+	if tinkKey.KeyData.TypeUrl != keyTemplate().TypeUrl {
+		t.Fatalf("incorrect type url, expect %s, got %s", keyTemplate().TypeUrl, tinkKey.KeyData.TypeUrl)
+	}
+	keysetHandle, err := testkeyset.NewHandle(tinkKeyset)
+	if err != nil {
+		t.Fatalf("unexpected error creating new KeysetHandle: %v", err)
+	}
+	if _, err = mac.New(keysetHandle); err != nil {
+		t.Fatalf("cannot get primitive from generated keyset: %s", err)
+	}
+}
+
+func TestCleartextBytes(t *testing.T) {
+	keyTemplate := mac.HMACSHA256Tag128KeyTemplate()
+	keysetHandle, err := keyset.NewHandle(keyTemplate)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keysetInBytes, err := cleartextBytes(keysetHandle)
+	if err != nil {
+		t.Fatalf("cannot create convert tink keyset handle to bytes: %v", err)
+	}
+	bytesBuffer := new(bytes.Buffer)
+	bytesBuffer.Write(keysetInBytes)
+	tinkKeyset, err := keyset.NewBinaryReader(bytesBuffer).Read()
+	if err != nil {
+		t.Fatalf("unexpected error reading tink keyset data: %v", err)
+	}
+	if err := keyset.Validate(tinkKeyset); err != nil {
+		t.Fatalf("when convert tink keyset handle to bytes, the keyset becomes invalid")
+	}
+}
+
+// getDummyKnoxVersionList is a helper for test. It returns a dummy knox version list for testing and a map from
+// Tink key ID to knox version ID. The data of each version is a Tink keyset in bytes that contains a single Tink
+// key. Argument counts decides how many versions are in this dummy veriosn list. Argument templateFunc decides
+// the type of created Tink keyset in each version.
+func getDummyKnoxVersionList(
+	counts int,
+	templateFunc func() *tinkpb.KeyTemplate,
+) (knox.KeyVersionList, map[uint32]uint64) {
+	var dummyVersionList knox.KeyVersionList
+	tinkKeyIDToKnoxVersionID := make(map[uint32]uint64)
+	// counts decide how many versions this dummy version list will have
+	for i := 0; i < counts; i++ {
+		// get a tink keyset handle that contains a fresh single key and the keyID is not duplicated
+		var keysetHandle *keyset.Handle
+		var err error
+		isDuplicated := true
+		for isDuplicated {
+			keysetHandle, err = keyset.NewHandle(templateFunc())
+			if keysetHandle == nil || err != nil {
+				panic(fmt.Sprintf("cannot get tink keyset handle: %v", err))
+			}
+			_, isDuplicated = tinkKeyIDToKnoxVersionID[keysetHandle.KeysetInfo().PrimaryKeyId]
+		}
+		// Convert keyset handle to bytes, since the data in each version is bytes
+		var keysetInBytes []byte
+		keysetInBytes, err = cleartextBytes(keysetHandle)
+		if err != nil {
+			panic(err)
+		}
+		// Add a new version to the dummy version list. Only one Primary version, all others are Active version.
+		var status knox.VersionStatus
+		if i == 0 {
+			status = knox.Primary
+		} else {
+			status = knox.Active
+		}
+		// To be noticed, index i is used as dummy knox version ID and dummy creation time.
+		dummyVersionList = append(dummyVersionList, knox.KeyVersion{
+			ID:           uint64(i),
+			Data:         keysetInBytes,
+			Status:       status,
+			CreationTime: int64(i),
+		})
+		tinkKeyIDToKnoxVersionID[keysetHandle.KeysetInfo().PrimaryKeyId] = uint64(i)
+	}
+	return dummyVersionList, tinkKeyIDToKnoxVersionID
+}
+
+func TestNextKeyset(t *testing.T) {
+	keyTemplate := aead.AES256GCMKeyTemplate
+	// create a dummy version list has one million Tink keys, this large number of Tink keys is used to
+	// check whether func nextKeyset will add duplicated Key
+	dummyVersionList, tinkKeyIDToKnoxVersionID := getDummyKnoxVersionList(1000000, keyTemplate)
+	newKeysetInBytes, err := nextKeyset(keyTemplate, dummyVersionList, "")
+	if err != nil {
+		t.Fatalf("cannot add new Tink keyset: %v", err)
+	}
+	// convert bytes to a Tink keyset, and check whether it is a valid keyset
+	tinkKeyset, err := ReadKeyset(newKeysetInBytes)
+	if err != nil {
+		t.Fatalf("unexpected error reading tink keyset data: %v", err)
+	}
+	if len(tinkKeyset.Key) != 1 {
+		t.Fatalf("incorrect number of keys in the keyset: %d", len(tinkKeyset.Key))
+	}
+	tinkKey := tinkKeyset.Key[0]
+	_, isDuplicated := tinkKeyIDToKnoxVersionID[tinkKey.KeyId]
+	if isDuplicated {
+		t.Fatalf("the ID of new Tink key is duplicated")
+	}
+	if tinkKeyset.PrimaryKeyId != tinkKey.KeyId {
+		t.Fatalf("incorrect primary key id, expect %d, got %d", tinkKey.KeyId, tinkKeyset.PrimaryKeyId)
+	}
+	if tinkKey.KeyData.TypeUrl != keyTemplate().TypeUrl {
+		t.Fatalf("incorrect type url, expect %s, got %s", keyTemplate().TypeUrl, tinkKey.KeyData.TypeUrl)
+	}
+	keysetHandle, err := testkeyset.NewHandle(tinkKeyset)
+	if err != nil {
+		t.Fatalf("unexpected error creating new KeysetHandle: %v", err)
+	}
+	if _, err = aead.New(keysetHandle); err != nil {
+		t.Fatalf("cannot get primitive from generated keyset: %s", err)
+	}
+}
+
+func TestGenerateVersion(t *testing.T) {
+	dummyVersionList, _ := getDummyKnoxVersionList(3, aead.AES256GCMKeyTemplate)
+	key := &knox.Key{ID: "tink:aead:test", VersionList: dummyVersionList}
+	data, err := GenerateVersion("TINK_AEAD_AES256_GCM", key)
+	if err != nil {
+		t.Fatalf("cannot generate tink version: %v", err)
+	}
+	if _, err := ReadKeyset(data); err != nil {
+		t.Fatalf("unexpected error reading tink keyset data: %v", err)
+	}
+	key.ID = "tink:mac:test"
+	if _, err := GenerateVersion("TINK_AEAD_AES256_GCM", key); err == nil {
+		t.Fatal("expected error for a key ID not matching the template")
+	}
+}
+
+func TestReadKeyset(t *testing.T) {
+	keyTemplate := mac.HMACSHA256Tag128KeyTemplate()
+	keysetHandle, err := keyset.NewHandle(keyTemplate)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	bytesBuffer := new(bytes.Buffer)
+	writer := keyset.NewBinaryWriter(bytesBuffer)
+	err = insecurecleartextkeyset.Write(keysetHandle, writer)
+	if err != nil {
+		t.Fatalf("unexpected error writing tink keyset handle")
+	}
+	tinkKeyset, err := ReadKeyset(bytesBuffer.Bytes())
+	if err != nil {
+		t.Fatalf("cannot read tink keyset from bytes")
+	}
+	err = keyset.Validate(tinkKeyset)
+	if err != nil {
+		t.Fatalf("the result of ReadKeyset is not a valid Tink keyset")
+	}
+}
+
+func TestKeysetHandle(t *testing.T) {
+	keyTemplate := aead.AES128GCMKeyTemplate
+	dummyVersionList, tinkKeyIDtoKnoxVersionID := getDummyKnoxVersionList(1000, keyTemplate)
+	keysetHandle, mapping, err := KeysetHandle(dummyVersionList, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := aead.New(keysetHandle); err != nil {
+		t.Fatalf("cannot get primitive from generated keyset handle: %s", err)
+	}
+	for k, v := range tinkKeyIDtoKnoxVersionID {
+		if v != mapping[k] {
+			t.Fatalf("cannot map tink key id to knox version id correctly")
+		}
+	}
+}
+
+// newFakeKMSKeyURI registers a fake KMS client and returns the URI of a new key in it.
+func newFakeKMSKeyURI(t *testing.T) string {
+	kms, err := fakekms.NewClient("fake-kms://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.RegisterKMSClient(kms)
+	kek, err := keyset.NewHandle(aead.AES128GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := insecurecleartextkeyset.Write(kek, keyset.NewBinaryWriter(buf)); err != nil {
+		t.Fatal(err)
+	}
+	return "fake-kms://" + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestEncryptedKeyset(t *testing.T) {
+	kekURI := newFakeKMSKeyURI(t)
+	first, err := newKeyset(aead.AES128GCMKeyTemplate, kekURI)
+	if err != nil {
+		t.Fatalf("cannot create encrypted tink keyset: %v", err)
+	}
+	if _, err := ReadKeyset(first); err == nil {
+		t.Fatal("expected encrypted keyset not to be readable in cleartext")
+	}
+	versions := knox.KeyVersionList{{ID: 1, Data: first, Status: knox.Primary, ContentType: knox.ContentTypeTinkEncryptedKeyset}}
+	key := &knox.Key{ID: "tink:aead:test", VersionList: versions, Metadata: knox.KeyMetadata{knox.MetadataTinkKMSKeyURI: kekURI}}
+	second, err := GenerateVersion("TINK_AEAD_AES128_GCM", key)
+	if err != nil {
+		t.Fatalf("cannot generate encrypted tink version: %v", err)
+	}
+	versions = append(versions, knox.KeyVersion{ID: 2, Data: second, Status: knox.Active, ContentType: knox.ContentTypeTinkEncryptedKeyset})
+
+	if err := ValidateVersions(versions, kekURI); err != nil {
+		t.Fatalf("unexpected error validating encrypted versions: %v", err)
+	}
+	if _, _, err := KeysetHandle(versions, ""); err == nil {
+		t.Fatal("expected error decrypting without a KMS key")
+	}
+	keysetHandle, mapping, err := KeysetHandle(versions, kekURI)
+	if err != nil {
+		t.Fatalf("cannot decrypt tink keysets: %v", err)
+	}
+	if len(mapping) != 2 {
+		t.Fatalf("expected 2 tink keys, got %d", len(mapping))
+	}
+	if _, err := aead.New(keysetHandle); err != nil {
+		t.Fatalf("cannot get primitive from decrypted keyset: %s", err)
+	}
+
+	// The combined keyset is written encrypted with the same KMS key.
+	combined, err := WriteKeyset(keysetHandle, kekURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := kmsAEAD(kekURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyset.Read(keyset.NewBinaryReader(bytes.NewReader(combined)), kek); err != nil {
+		t.Fatalf("cannot read combined encrypted keyset: %v", err)
+	}
+	info, err := VersionInfo(versions[0])
+	if err != nil {
+		t.Fatalf("cannot get info of encrypted keyset: %v", err)
+	}
+	if id, _ := VersionKeyID(versions[0], ""); len(info.KeyInfo) != 1 || info.PrimaryKeyId != id {
+		t.Fatalf("unexpected info of encrypted keyset: %+v", info)
+	}
+
+	key.VersionList = versions
+	if _, err := HandleFromKey(key); err != nil {
+		t.Fatalf("cannot get keyset handle from key: %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	versions, _ := getDummyKnoxVersionList(4, aead.AES128GCMKeyTemplate)
+	versions[2].Status = knox.Inactive
+	versions[3].Status = knox.Scheduled
+	kept, pruned := Prune(versions)
+	if len(kept) != 2 || kept[0].ID != versions[0].ID || kept[1].ID != versions[1].ID {
+		t.Fatalf("unexpected kept versions %v", kept)
+	}
+	if len(pruned) != 2 || pruned[0].ID != versions[2].ID || pruned[1].ID != versions[3].ID {
+		t.Fatalf("unexpected pruned versions %v", pruned)
+	}
+	_, mapping, err := KeysetHandle(versions, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapping) != 2 {
+		t.Fatalf("expected the tink keys of inactive versions to be dropped, got %v", mapping)
+	}
+}
+
+func TestCheckPrimaryConsistency(t *testing.T) {
+	versions, _ := getDummyKnoxVersionList(3, aead.AES128GCMKeyTemplate)
+	versions[2].Status = knox.Inactive
+	if err := CheckPrimaryConsistency(versions, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	noPrimary := append(knox.KeyVersionList{}, versions...)
+	noPrimary[0].Status = knox.Active
+	if err := CheckPrimaryConsistency(noPrimary, ""); err == nil {
+		t.Fatal("expected error without a primary version")
+	}
+
+	// A version whose keyset names another key as primary.
+	ks, err := ReadKeyset(versions[1].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.PrimaryKeyId++
+	data, err := proto.Marshal(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := append(knox.KeyVersionList{}, versions...)
+	mismatched[1].Data = data
+	if err := CheckPrimaryConsistency(mismatched, ""); err == nil {
+		t.Fatal("expected error for a keyset whose primary is not its key")
+	}
+
+	// An active version whose tink key is disabled.
+	ks.PrimaryKeyId--
+	ks.Key[0].Status = tinkpb.KeyStatusType_DISABLED
+	data, err = proto.Marshal(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled := append(knox.KeyVersionList{}, versions...)
+	disabled[1].Data = data
+	if err := CheckPrimaryConsistency(disabled, ""); err == nil {
+		t.Fatal("expected error for an active version with a disabled tink key")
+	}
+	disabled[1].Status = knox.Inactive
+	if err := CheckPrimaryConsistency(disabled, ""); err != nil {
+		t.Fatalf("unexpected error for an inactive version with a disabled tink key: %v", err)
+	}
+}
+
+func TestValidateVersions(t *testing.T) {
+	valid, _ := getDummyKnoxVersionList(3, aead.AES128GCMKeyTemplate)
+	if err := ValidateVersions(valid, ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	withVersion := func(i int, f func(v *knox.KeyVersion)) knox.KeyVersionList {
+		l := append(knox.KeyVersionList{}, valid...)
+		f(&l[i])
+		return l
+	}
+	withKey := func(i int, f func(k *tinkpb.Keyset_Key)) knox.KeyVersionList {
+		return withVersion(i, func(v *knox.KeyVersion) {
+			ks, err := ReadKeyset(v.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(ks.Key[0])
+			if v.Data, err = proto.Marshal(ks); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	cases := []struct {
+		name     string
+		versions knox.KeyVersionList
+		want     string
+	}{
+		{"garbage", withVersion(1, func(v *knox.KeyVersion) { v.Data = []byte("garbage") }), "knox version 1 does not hold a tink keyset"},
+		{"duplicate", withVersion(2, func(v *knox.KeyVersion) { v.Data = valid[1].Data }), "knox versions 1 and 2 hold the same tink key ID"},
+		{"no primary", withVersion(0, func(v *knox.KeyVersion) { v.Status = knox.Active }), "none of the 3 knox versions is primary"},
+		{"two primaries", withVersion(2, func(v *knox.KeyVersion) { v.Status = knox.Primary }), "knox versions [0 2] are all primary"},
+		{"disabled", withKey(1, func(k *tinkpb.Keyset_Key) { k.Status = tinkpb.KeyStatusType_DISABLED }), "knox version 1 holds an invalid tink key: its status is DISABLED"},
+		{"bad key data", withKey(2, func(k *tinkpb.Keyset_Key) { k.KeyData.Value = []byte{0xff} }), "knox version 2 holds an invalid tink key: cannot parse"},
+		{"unknown type", withKey(0, func(k *tinkpb.Keyset_Key) { k.KeyData.TypeUrl = "type.example.com/Unknown" }), "knox version 0 holds an invalid tink key: cannot parse"},
+	}
+	for _, c := range cases {
+		err := ValidateVersions(c.versions, "")
+		if err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%s: expected an error starting with %q, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestCleartextHandle(t *testing.T) {
+	// Create a keyset that contains a single HmacKey.
+	keyTemplate := mac.HMACSHA256Tag128KeyTemplate()
+	keysetHandle, err := keyset.NewHandle(keyTemplate)
+	if keysetHandle == nil || err != nil {
+		t.Fatalf("cannot get keyset handle: %v", err)
+	}
+	tinkKeyset := insecurecleartextkeyset.KeysetMaterial(keysetHandle)
+	parsedHandle, err := cleartextHandle(tinkKeyset)
+	if err != nil {
+		t.Fatalf("unexpected error reading keyset: %v", err)
+	}
+	parsedKeyset := insecurecleartextkeyset.KeysetMaterial(parsedHandle)
+	if !proto.Equal(tinkKeyset, parsedKeyset) {
+		t.Fatalf("parsed keyset (%s) doesn't match original keyset (%s)", parsedKeyset, tinkKeyset)
+	}
+}
+
+func TestKeysetInfoJSON(t *testing.T) {
+	keyTemplate := aead.AES128GCMKeyTemplate
+	keysetHandle, err := keyset.NewHandle(keyTemplate())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// 100 is the dummy knox version id
+	tinkKeyIDToKnoxVersionID := map[uint32]uint64{keysetHandle.KeysetInfo().PrimaryKeyId: 100}
+	var keysInfo []*KeyInfo
+	rawKeysetInfo := keysetHandle.KeysetInfo()
+	keysInfo = append(keysInfo, &KeyInfo{
+		rawKeysetInfo.KeyInfo[0].TypeUrl,
+		rawKeysetInfo.KeyInfo[0].Status.String(),
+		rawKeysetInfo.KeyInfo[0].KeyId,
+		rawKeysetInfo.KeyInfo[0].OutputPrefixType.String(),
+		100,
+	})
+	keysetInfo := KeysetInfo{
+		rawKeysetInfo.PrimaryKeyId,
+		keysInfo,
+	}
+	keysetInfoForPrint, err := json.MarshalIndent(keysetInfo, "", "  ")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := string(keysetInfoForPrint)
+	got, err := KeysetInfoJSON(keysetHandle, tinkKeyIDToKnoxVersionID)
+	if err != nil || expected != got {
+		t.Fatalf("cannot get keyset info in json format")
+	}
+}
+
+func TestNewKeysetInfo(t *testing.T) {
+	keyTemplate := aead.AES128GCMKeyTemplate
+	keysetHandle, err := keyset.NewHandle(keyTemplate())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// 123456 is the dummy knox version id
+	tinkKeyIDToKnoxVersionID := map[uint32]uint64{keysetHandle.KeysetInfo().PrimaryKeyId: 123456}
+	var keysInfo []*KeyInfo
+	rawKeysetInfo := keysetHandle.KeysetInfo()
+	keysInfo = append(keysInfo, &KeyInfo{
+		rawKeysetInfo.KeyInfo[0].TypeUrl,
+		rawKeysetInfo.KeyInfo[0].Status.String(),
+		rawKeysetInfo.KeyInfo[0].KeyId,
+		rawKeysetInfo.KeyInfo[0].OutputPrefixType.String(),
+		123456,
+	})
+	expected, _ := json.Marshal(KeysetInfo{
+		rawKeysetInfo.PrimaryKeyId,
+		keysInfo,
+	})
+	got, _ := json.Marshal(NewKeysetInfo(keysetHandle.KeysetInfo(), tinkKeyIDToKnoxVersionID))
+	if string(got) != string(expected) {
+		t.Fatalf("cannot create JSONTinkKeysetInfo correctly")
+	}
+}
+
+func TestNewKeysInfo(t *testing.T) {
+	keyTemplate := aead.AES256GCMKeyTemplate
+	keysetHandle, err := keyset.NewHandle(keyTemplate())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// 1234567890 is the dummy knox version id
+	tinkKeyIDToKnoxVersionID := map[uint32]uint64{keysetHandle.KeysetInfo().PrimaryKeyId: 1234567890}
+	var keysInfo []*KeyInfo
+	rawKeysetInfo := keysetHandle.KeysetInfo()
+	keysInfo = append(keysInfo, &KeyInfo{
+		rawKeysetInfo.KeyInfo[0].TypeUrl,
+		rawKeysetInfo.KeyInfo[0].Status.String(),
+		rawKeysetInfo.KeyInfo[0].KeyId,
+		rawKeysetInfo.KeyInfo[0].OutputPrefixType.String(),
+		1234567890,
+	})
+	expected, _ := json.Marshal(keysInfo)
+	got, _ := json.Marshal(newKeysInfo(keysetHandle.KeysetInfo().KeyInfo, tinkKeyIDToKnoxVersionID))
+	if string(got) != string(expected) {
+		t.Fatalf("cannot create JSONTinkKeysetInfo_KeyInfo correctly")
+	}
+}
+
+func FuzzReadKeyset(f *testing.F) {
+	valid, err := newKeyset(aead.AES128GCMKeyTemplate, "")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add([]byte{})
+	f.Add([]byte("not a keyset"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ks, err := ReadKeyset(data)
+		if err != nil {
+			return
+		}
+		b, err := proto.Marshal(ks)
+		if err != nil {
+			t.Fatalf("Failed to marshal a keyset that was read: %s", err)
+		}
+		again, err := ReadKeyset(b)
+		if err != nil || !proto.Equal(ks, again) {
+			t.Fatalf("Keyset changed after a round trip: %v", err)
+		}
+		// Versions of a knox key storing a Tink keyset are read the same way.
+		versions := knox.KeyVersionList{{ID: 1, Data: data, Status: knox.Primary}}
+		KeysetHandle(versions, "")
+	})
+}
@@ -0,0 +1,53 @@
+package knox
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// TLSConfigFromKey returns a tls.Config that serves the certificate stored in
+// the primary version of the client's key. The version data must be a PEM
+// bundle holding the certificate chain and its private key. The certificate
+// is reloaded whenever the key rotates; if a new version cannot be parsed the
+// previous certificate keeps being served.
+//
+//	client, err := knox.NewFileClientWithOptions("service:tls_cert", knox.FileClientOptions{})
+//	config, err := knox.TLSConfigFromKey(client)
+//	server := &http.Server{TLSConfig: config}
+func TLSConfigFromKey(client RotationClient) (*tls.Config, error) {
+	cert, err := parseCertificate(client.GetPrimary())
+	if err != nil {
+		return nil, err
+	}
+	var current atomic.Pointer[tls.Certificate]
+	current.Store(cert)
+
+	client.OnRotation(func(_, new Key) {
+		primary := new.VersionList.GetPrimary()
+		if primary == nil {
+			return
+		}
+		cert, err := parseCertificate(string(primary.Data))
+		if err != nil {
+			log.Printf("Failed to reload TLS certificate for knox key %s: %s", new.ID, err.Error())
+			return
+		}
+		current.Store(cert)
+	})
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		},
+	}, nil
+}
+
+func parseCertificate(bundle string) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair([]byte(bundle), []byte(bundle))
+	if err != nil {
+		return nil, fmt.Errorf("Knox key is not a PEM certificate and private key: %s", err.Error())
+	}
+	return &cert, nil
+}
@@ -0,0 +1,87 @@
+package knox
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func buildCertBundle(t *testing.T, cn string) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+}
+
+func TestTLSConfigFromKey(t *testing.T) {
+	c := &fileClient{keyID: "test"}
+	c.setValues(&Key{
+		ID:          "test",
+		VersionList: KeyVersionList{{ID: 1, Data: buildCertBundle(t, "first"), Status: Primary}},
+		VersionHash: "hash1",
+	})
+
+	config, err := TLSConfigFromKey(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := config.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if cn := commonName(); cn != "first" {
+		t.Fatalf("Expected first, got %s", cn)
+	}
+
+	c.refresh(&Key{
+		ID:          "test",
+		VersionList: KeyVersionList{{ID: 2, Data: buildCertBundle(t, "second"), Status: Primary}},
+		VersionHash: "hash2",
+	})
+	if cn := commonName(); cn != "second" {
+		t.Fatalf("Expected second, got %s", cn)
+	}
+
+	// An invalid version keeps the previous certificate.
+	c.refresh(&Key{
+		ID:          "test",
+		VersionList: KeyVersionList{{ID: 3, Data: []byte("garbage"), Status: Primary}},
+		VersionHash: "hash3",
+	})
+	if cn := commonName(); cn != "second" {
+		t.Fatalf("Expected second, got %s", cn)
+	}
+
+	if _, err := TLSConfigFromKey(NewMock("garbage", nil).(RotationClient)); err == nil {
+		t.Fatal("Expected error for invalid certificate")
+	}
+}